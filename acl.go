@@ -0,0 +1,130 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ACLAction defines what a listener does with a query from a client.
+type ACLAction int
+
+const (
+	// Forward the query to the listener's resolver.
+	ACLActionAllow ACLAction = iota
+	// Respond with REFUSED.
+	ACLActionRefuse
+	// Drop the query without responding.
+	ACLActionDrop
+	// Forward the query to the resolver defined in the rule.
+	ACLActionRoute
+)
+
+// ParseACLAction converts the string representation of an ACL action into
+// its ACLAction value. Valid values are "allow", "refuse", "drop" and "route".
+func ParseACLAction(s string) (ACLAction, error) {
+	switch s {
+	case "allow":
+		return ACLActionAllow, nil
+	case "refuse":
+		return ACLActionRefuse, nil
+	case "drop":
+		return ACLActionDrop, nil
+	case "route":
+		return ACLActionRoute, nil
+	default:
+		return 0, fmt.Errorf("unsupported acl action %q", s)
+	}
+}
+
+func (a ACLAction) String() string {
+	switch a {
+	case ACLActionAllow:
+		return "allow"
+	case ACLActionRefuse:
+		return "refuse"
+	case ACLActionDrop:
+		return "drop"
+	case ACLActionRoute:
+		return "route"
+	default:
+		return fmt.Sprintf("ACLAction(%d)", int(a))
+	}
+}
+
+// ACLRule applies an action to clients from a network.
+type ACLRule struct {
+	Network *net.IPNet
+	Action  ACLAction
+
+	// Resolver to forward queries to. Only used with ACLActionRoute.
+	Resolver Resolver
+}
+
+// ACL is an ordered list of rules used by listeners to decide how to handle
+// queries from clients. Rules are evaluated in order and the first rule with
+// a network containing the client IP determines the action. Clients that
+// don't match any rule are handled by the default for their IP version. An
+// ACL can be shared between multiple listeners.
+type ACL struct {
+	id  string
+	opt ACLOptions
+}
+
+// ACLOptions contains the rules and defaults of an ACL.
+type ACLOptions struct {
+	Rules []ACLRule
+
+	// Default rule for IPv4 clients that don't match any of the rules.
+	Default4 ACLRule
+
+	// Default rule for IPv6 clients that don't match any of the rules.
+	Default6 ACLRule
+}
+
+// NewACL returns a new instance of an access control list.
+func NewACL(id string, opt ACLOptions) (*ACL, error) {
+	for _, rule := range append([]ACLRule{opt.Default4, opt.Default6}, opt.Rules...) {
+		if rule.Action == ACLActionRoute && rule.Resolver == nil {
+			return nil, errors.New("acl action 'route' requires a resolver")
+		}
+	}
+	return &ACL{
+		id:  id,
+		opt: opt,
+	}, nil
+}
+
+// Lookup returns the rule that applies to a client IP.
+func (a *ACL) Lookup(ip net.IP) ACLRule {
+	for _, rule := range a.opt.Rules {
+		if rule.Network != nil && rule.Network.Contains(ip) {
+			return rule
+		}
+	}
+	if ip.To4() == nil {
+		return a.opt.Default6
+	}
+	return a.opt.Default4
+}
+
+func (a *ACL) String() string {
+	return a.id
+}
+
+// Returns the action for a client along with the resolver that should be used
+// to answer its queries. Listeners configured with the older AllowedNet list
+// refuse clients from networks not in the list.
+func (opt ListenOptions) clientAction(ip net.IP, r Resolver) (ACLAction, Resolver) {
+	if opt.ACL != nil {
+		rule := opt.ACL.Lookup(ip)
+		if rule.Action == ACLActionRoute {
+			return rule.Action, rule.Resolver
+		}
+		return rule.Action, r
+	}
+	if isAllowed(opt.AllowedNet, ip) {
+		return ACLActionAllow, r
+	}
+	return ACLActionRefuse, r
+}
@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLLookup(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, guest, _ := net.ParseCIDR("192.168.0.0/16")
+	_, ula, _ := net.ParseCIDR("fd00::/8")
+	guestResolver := new(TestResolver)
+
+	acl, err := NewACL("test-acl", ACLOptions{
+		Rules: []ACLRule{
+			{Network: lan, Action: ACLActionAllow},
+			{Network: guest, Action: ACLActionRoute, Resolver: guestResolver},
+			{Network: ula, Action: ACLActionAllow},
+		},
+		Default4: ACLRule{Action: ACLActionRefuse},
+		Default6: ACLRule{Action: ACLActionDrop},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip     string
+		action ACLAction
+	}{
+		{"192.168.1.10", ACLActionAllow},
+		{"192.168.2.10", ACLActionRoute},
+		{"10.0.0.1", ACLActionRefuse},
+		{"fd00::1", ACLActionAllow},
+		{"2001:db8::1", ACLActionDrop},
+	}
+	for _, test := range tests {
+		rule := acl.Lookup(net.ParseIP(test.ip))
+		require.Equal(t, test.action, rule.Action, test.ip)
+	}
+
+	// The route action should return the resolver from the rule, the others
+	// the listener's resolver.
+	upstream := new(TestResolver)
+	opt := ListenOptions{ACL: acl}
+	action, r := opt.clientAction(net.ParseIP("192.168.2.10"), upstream)
+	require.Equal(t, ACLActionRoute, action)
+	require.Equal(t, guestResolver, r)
+	action, r = opt.clientAction(net.ParseIP("192.168.1.10"), upstream)
+	require.Equal(t, ACLActionAllow, action)
+	require.Equal(t, upstream, r)
+}
+
+func TestACLRouteWithoutResolver(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.168.1.0/24")
+	_, err := NewACL("test-acl", ACLOptions{
+		Rules: []ACLRule{{Network: n, Action: ACLActionRoute}},
+	})
+	require.Error(t, err)
+}
+
+func TestListenOptionsAllowedNet(t *testing.T) {
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	upstream := new(TestResolver)
+
+	// Without any restrictions, all clients are allowed
+	action, _ := ListenOptions{}.clientAction(net.ParseIP("10.0.0.1"), upstream)
+	require.Equal(t, ACLActionAllow, action)
+
+	// Clients outside the allowed networks are refused
+	opt := ListenOptions{AllowedNet: []*net.IPNet{n}}
+	action, _ = opt.clientAction(net.ParseIP("127.0.0.1"), upstream)
+	require.Equal(t, ACLActionAllow, action)
+	action, _ = opt.clientAction(net.ParseIP("10.0.0.1"), upstream)
+	require.Equal(t, ACLActionRefuse, action)
+}
@@ -2,11 +2,18 @@ package rdns
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -38,8 +45,63 @@ type AdminListenerOptions struct {
 	Transport string
 
 	TLSConfig *tls.Config
+
+	// Graph of the configuration, served at /routedns/graph if set.
+	Graph *ConfigGraph
+
+	// Optional update checker providing the latest version to
+	// /routedns/version.
+	UpdateChecker *UpdateChecker
+
+	// Blocklists by ID that names can be unblocked in temporarily with
+	// /routedns/unblock if Unblock is set.
+	Blocklists map[string]*Blocklist
+
+	// Enable /routedns/unblock. Requires an ACL, allowed networks or an
+	// UnblockToken.
+	Unblock bool
+
+	// Token required to unblock names, sent as bearer token in the
+	// Authorization header or as "token" form value. Optional.
+	UnblockToken string
+
+	// Origins like https://portal.example.com of pages that are allowed to
+	// post unblock requests from another origin. Block pages are always
+	// allowed to unblock the name they're shown for.
+	UnblockOrigins []string
+
+	// Query statistics by ID, served at /routedns/stats/.
+	Stats map[string]*QueryStats
+
+	// Routers by ID whose routes are served at /routedns/routes.
+	Routers map[string]*Router
+
+	// Allow changing routes with POST requests to /routedns/routes. Requires
+	// an ACL, allowed networks or a RoutesToken.
+	ChangeRoutes bool
+
+	// Token required to change routes, sent as bearer token in the
+	// Authorization header or as "token" form value. Optional.
+	RoutesToken string
+
+	// Resolvers by ID that routes added with /routedns/routes can send
+	// queries to.
+	Resolvers map[string]Resolver
+
+	// Exporter of the metrics in Prometheus format, served at
+	// /routedns/metrics. Defaults to one exporting DefaultRegistry.
+	Prometheus *PrometheusExporter
 }
 
+// Longest time names can be unblocked for.
+const maxUnblockDuration = 24 * time.Hour
+
+// Defaults of the statistics endpoints.
+const (
+	defaultStatsPeriod = 24 * time.Hour
+	defaultStatsLimit  = 10
+)
+
 // NewAdminListener returns an instance of an admin service listener.
 func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener, error) {
 	switch opt.Transport {
@@ -50,6 +112,15 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 	default:
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
+	if opt.Unblock && opt.ACL == nil && len(opt.AllowedNet) == 0 && opt.UnblockToken == "" {
+		return nil, errors.New("unblocking names requires an acl, allowed-net or unblock-token")
+	}
+	if opt.ChangeRoutes && opt.ACL == nil && len(opt.AllowedNet) == 0 && opt.RoutesToken == "" {
+		return nil, errors.New("changing routes requires an acl, allowed-net or routes-token")
+	}
+	for i, origin := range opt.UnblockOrigins {
+		opt.UnblockOrigins[i] = strings.TrimSuffix(origin, "/")
+	}
 
 	l := &AdminListener{
 		id:   id,
@@ -59,9 +130,373 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 	}
 	// Serve metrics.
 	l.mux.Handle("/routedns/vars", expvar.Handler())
+	if opt.Prometheus == nil {
+		opt.Prometheus = new(PrometheusExporter)
+	}
+	l.mux.Handle("/routedns/metrics", opt.Prometheus)
+	if opt.Graph != nil {
+		l.mux.HandleFunc("/routedns/graph", l.serveGraph)
+	}
+	l.mux.HandleFunc("/routedns/version", l.serveVersion)
+	l.mux.HandleFunc("/routedns/status", l.serveStatus)
+	if opt.Unblock && len(opt.Blocklists) > 0 {
+		l.mux.HandleFunc("/routedns/unblock", l.serveUnblock)
+	}
+	if len(opt.Stats) > 0 {
+		l.mux.HandleFunc("/routedns/stats/top-domains", l.serveTop(StatsDomains))
+		l.mux.HandleFunc("/routedns/stats/top-blocked", l.serveTop(StatsBlockedDomains))
+		l.mux.HandleFunc("/routedns/stats/top-clients", l.serveTop(StatsClients))
+		l.mux.HandleFunc("/routedns/stats/queries", l.serveQueryTotals)
+	}
+	if len(opt.Routers) > 0 {
+		l.mux.HandleFunc("/routedns/routes", l.serveRoutes)
+	}
 	return l, nil
 }
 
+// Serves the running version, and the latest one if the update checker is
+// enabled, as JSON.
+func (s *AdminListener) serveVersion(w http.ResponseWriter, r *http.Request) {
+	status := currentVersion()
+	if s.opt.UpdateChecker != nil {
+		status = s.opt.UpdateChecker.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Serves the status of all elements as JSON, or of one element with ?id=.
+// Responds with 503 if the one element isn't healthy so it can be used in
+// readiness checks.
+func (s *AdminListener) serveStatus(w http.ResponseWriter, r *http.Request) {
+	// Error messages can include upstream addresses, apply the ACL
+	if !s.allowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ElementStatuses())
+		return
+	}
+	status, ok := GetElementStatus(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("element '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Serves the configuration graph in JSON, or in DOT format with ?format=dot.
+func (s *AdminListener) serveGraph(w http.ResponseWriter, r *http.Request) {
+	// The graph shows upstream addresses and the structure of the configuration
+	if !s.allowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "json", "":
+		w.Header().Set("Content-Type", "application/json")
+		_ = s.opt.Graph.WriteJSON(w)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		_ = s.opt.Graph.WriteDOT(w)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format '%s'", format), http.StatusBadRequest)
+	}
+}
+
+// Temporarily unblocks a name in a blocklist. Expects a POST with the form
+// values "blocklist", "name" and optionally "duration" in seconds, as sent
+// by the block page.
+func (s *AdminListener) serveUnblock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !s.allowed(r) || !validToken(r, s.opt.UnblockToken) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id, name := r.PostFormValue("blocklist"), r.PostFormValue("name")
+	if !s.unblockOriginAllowed(r, name) {
+		http.Error(w, "cross-origin request not allowed", http.StatusForbidden)
+		return
+	}
+	blocklist, ok := s.opt.Blocklists[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("blocklist '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	if err := validHostname(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d := defaultUnblockDuration
+	if v := r.PostFormValue("duration"); v != "" {
+		seconds, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || seconds == 0 {
+			http.Error(w, fmt.Sprintf("invalid duration '%s'", v), http.StatusBadRequest)
+			return
+		}
+		d = min(time.Duration(seconds)*time.Second, maxUnblockDuration)
+	}
+	Log.Info("unblocking name", "id", s.id, "client", client, "blocklist", id, "name", name, "duration", d)
+	blocklist.Unblock(name, d)
+	fmt.Fprintf(w, "'%s' unblocked in '%s' for %s\n", name, id, d)
+}
+
+// Returns true if no token is configured, or the request carries it.
+func validToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		got = r.PostFormValue("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Returns false for requests browsers send from pages of other origins,
+// unless the origin is one of the trusted ones. Without this, any website
+// could submit a form that changes state on behalf of a client allowed by
+// the ACL.
+func originAllowed(r *http.Request, trusted []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not sent by a browser, or an older one that only sets Sec-Fetch-Site
+		switch r.Header.Get("Sec-Fetch-Site") {
+		case "", "same-origin", "none":
+			return true
+		}
+		return false
+	}
+	if slices.Contains(trusted, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// Returns true if an unblock request comes from the same or a trusted origin,
+// or from the block page of the name that is unblocked.
+func (s *AdminListener) unblockOriginAllowed(r *http.Request, name string) bool {
+	if originAllowed(r, s.opt.UnblockOrigins) {
+		return true
+	}
+	// Block pages are served under the blocked name
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && u.Host != "" && strings.EqualFold(u.Hostname(), strings.TrimSuffix(name, "."))
+}
+
+// Serves the most frequent domains or clients of a query statistics element
+// as JSON. Takes the optional query parameters "id" of the element, "period"
+// as duration like 24h, and "limit".
+func (s *AdminListener) serveTop(kind StatsKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := s.statsFromRequest(w, r)
+		if !ok {
+			return
+		}
+		period := defaultStatsPeriod
+		if v := r.URL.Query().Get("period"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid period '%s'", v), http.StatusBadRequest)
+				return
+			}
+			period = d
+		}
+		limit := defaultStatsLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, fmt.Sprintf("invalid limit '%s'", v), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		top, err := stats.Top(kind, period, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(top)
+	}
+}
+
+// Serves the number of queries per hour, or per day with ?window=day, of a
+// query statistics element as JSON.
+func (s *AdminListener) serveQueryTotals(w http.ResponseWriter, r *http.Request) {
+	stats, ok := s.statsFromRequest(w, r)
+	if !ok {
+		return
+	}
+	window := StatsHour
+	if v := r.URL.Query().Get("window"); v != "" {
+		window = StatsWindow(v)
+	}
+	totals, err := stats.Totals(window)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid window '%s'", window), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(totals)
+}
+
+// Serves the routes of a router as JSON, given by the "id" query parameter
+// which is optional if there's only one. Routes are changed with a POST and
+// the form value "action":
+//
+//   - "add" inserts a route before the one at "index", or appends it if not
+//     given, with the form values "resolver", and optionally "name", "types"
+//     as comma-separated list, "source" and "invert".
+//   - "remove" removes the route at "index".
+//   - "move" moves the route at "index" to "to".
+//
+// Changes are only accepted if ChangeRoutes is set, and are lost when the
+// configuration is reloaded.
+func (s *AdminListener) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	// Routes can reveal and change how clients are handled, apply the ACL
+	if !s.allowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" && len(s.opt.Routers) == 1 {
+		for routerID := range s.opt.Routers {
+			id = routerID
+		}
+	}
+	router, ok := s.opt.Routers[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("router '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !s.opt.ChangeRoutes {
+			http.Error(w, "changing routes is not enabled", http.StatusForbidden)
+			return
+		}
+		if !validToken(r, s.opt.RoutesToken) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !originAllowed(r, nil) {
+			http.Error(w, "cross-origin request not allowed", http.StatusForbidden)
+			return
+		}
+		if err := s.changeRoutes(router, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		Log.Info("routes changed", "id", s.id, "client", client, "router", id, "action", r.PostFormValue("action"))
+	default:
+		http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(router.Routes())
+}
+
+// Applies the change to the routes of a router described in a POST request.
+func (s *AdminListener) changeRoutes(router *Router, r *http.Request) error {
+	index := func(key string) (int, error) {
+		v := r.PostFormValue(key)
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s '%s'", key, v)
+		}
+		return i, nil
+	}
+	switch action := r.PostFormValue("action"); action {
+	case "add":
+		resolver, ok := s.opt.Resolvers[r.PostFormValue("resolver")]
+		if !ok {
+			return fmt.Errorf("resolver '%s' not found", r.PostFormValue("resolver"))
+		}
+		var types []string
+		if v := r.PostFormValue("types"); v != "" {
+			types = strings.Split(v, ",")
+		}
+		route, err := NewRoute(r.PostFormValue("name"), "", types, nil, "", "", r.PostFormValue("source"), "", "", "", "", nil, nil, 0, 0, resolver)
+		if err != nil {
+			return err
+		}
+		route.Invert(r.PostFormValue("invert") == "true")
+		if r.PostFormValue("index") == "" {
+			router.Add(route)
+			return nil
+		}
+		i, err := index("index")
+		if err != nil {
+			return err
+		}
+		return router.Insert(i, route)
+	case "remove":
+		i, err := index("index")
+		if err != nil {
+			return err
+		}
+		return router.Remove(i)
+	case "move":
+		from, err := index("index")
+		if err != nil {
+			return err
+		}
+		to, err := index("to")
+		if err != nil {
+			return err
+		}
+		return router.Move(from, to)
+	default:
+		return fmt.Errorf("unsupported action '%s'", action)
+	}
+}
+
+// Returns the query statistics element named in the "id" query parameter of
+// a statistics request. The parameter is optional if there's only one. Writes
+// an error response and returns false if the client isn't allowed or the
+// element doesn't exist.
+func (s *AdminListener) statsFromRequest(w http.ResponseWriter, r *http.Request) (*QueryStats, bool) {
+	// The statistics include client addresses, apply the ACL
+	if !s.allowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" && len(s.opt.Stats) == 1 {
+		for _, stats := range s.opt.Stats {
+			return stats, true
+		}
+	}
+	stats, ok := s.opt.Stats[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("query statistics '%s' not found", id), http.StatusNotFound)
+		return nil, false
+	}
+	return stats, true
+}
+
+// Returns true if the client of a request is allowed by the listen options.
+func (s *AdminListener) allowed(r *http.Request) bool {
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	action, _ := s.opt.clientAction(ParseClientIP(client), nil)
+	return action == ACLActionAllow
+}
+
 // Start the admin server.
 func (s *AdminListener) Start() error {
 	Log.Info("starting listener",
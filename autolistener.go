@@ -0,0 +1,264 @@
+package rdns
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// AutoListener accepts several DNS protocols on a single port. Over TCP, plain
+// DNS and DoT connections are told apart by the first bytes sent by the
+// client, which start the TLS handshake for DoT. Over QUIC, DoQ and DoH/3
+// connections are told apart by the ALPN protocol negotiated in the handshake.
+type AutoListener struct {
+	id   string
+	addr string
+	opt  AutoListenerOptions
+	log  *slog.Logger
+
+	// TCP transport
+	plain *DNSListener
+	dot   *DoTListener
+	ln    net.Listener
+
+	// QUIC transport
+	doq    *DoQListener
+	h3     *http3.Server
+	quicLn *quic.EarlyListener
+}
+
+var _ Listener = &AutoListener{}
+
+// AutoListenerOptions contains options used by the multi-protocol listener.
+type AutoListenerOptions struct {
+	ListenOptions
+
+	// Transport protocol, "tcp" for plain DNS and DoT, "quic" for DoQ and
+	// DoH/3. Defaults to "tcp".
+	Transport string
+
+	// Network to listen on with the tcp transport, "tcp", "tcp4" or "tcp6".
+	// Defaults to "tcp".
+	Network string
+
+	TLSConfig *tls.Config
+}
+
+// Time a client has to send the first bytes of a TCP connection before it's
+// closed.
+const autoListenerPeekTimeout = 10 * time.Second
+
+// NewAutoListener returns an instance of a multi-protocol listener.
+func NewAutoListener(id, addr string, opt AutoListenerOptions, resolver Resolver) (*AutoListener, error) {
+	if opt.TLSConfig == nil {
+		opt.TLSConfig = new(tls.Config)
+	}
+	if opt.Network == "" {
+		opt.Network = "tcp"
+	}
+	l := &AutoListener{
+		id:   id,
+		addr: addr,
+		opt:  opt,
+	}
+	switch opt.Transport {
+	case "tcp", "":
+		l.opt.Transport = "tcp"
+		l.plain = NewDNSListener(id, addr, opt.Network, opt.ListenOptions, resolver)
+		l.dot = NewDoTListener(id, addr, opt.Network+"-tls", DoTListenerOptions{ListenOptions: opt.ListenOptions, TLSConfig: opt.TLSConfig}, resolver)
+	case "quic":
+		l.doq = NewQUICListener(id, addr, DoQListenerOptions{ListenOptions: opt.ListenOptions, TLSConfig: opt.TLSConfig.Clone()}, resolver)
+		doh, err := NewDoHListener(id, addr, DoHListenerOptions{ListenOptions: opt.ListenOptions, Transport: "quic", TLSConfig: opt.TLSConfig}, resolver)
+		if err != nil {
+			return nil, err
+		}
+		l.h3 = &http3.Server{Handler: doh.opt.customMux}
+	default:
+		return nil, fmt.Errorf("unknown transport: '%s'", opt.Transport)
+	}
+	l.log = Log.With("id", id, "protocol", "auto", "transport", l.opt.Transport, "addr", addr)
+	return l, nil
+}
+
+// Start the listener.
+func (s *AutoListener) Start() error {
+	s.log.Info("starting listener")
+	if s.opt.Transport == "quic" {
+		return s.startQUIC()
+	}
+	return s.startTCP()
+}
+
+// Accepts TCP connections and passes them to the plain DNS or DoT server.
+func (s *AutoListener) startTCP() error {
+	if len(s.opt.TLSConfig.Certificates) == 0 && s.opt.TLSConfig.GetCertificate == nil {
+		return errors.New("neither certificates nor GetCertificate set in the tls config")
+	}
+	ln, err := s.opt.TCP.listen(s.opt.Network, s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	plainLn := newConnListener(ln.Addr())
+	dotLn := newConnListener(ln.Addr())
+	defer plainLn.Close()
+	defer dotLn.Close()
+	s.plain.Listener = plainLn
+	s.dot.Listener = tls.NewListener(dotLn, s.opt.TLSConfig)
+	go s.plain.ActivateAndServe()
+	go s.dot.ActivateAndServe()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			conn, isTLS, err := peekTLS(conn)
+			if err != nil {
+				s.log.Debug("failed to read from connection", "client", conn.RemoteAddr(), "error", err)
+				conn.Close()
+				return
+			}
+			if isTLS {
+				dotLn.deliver(conn)
+			} else {
+				plainLn.deliver(conn)
+			}
+		}()
+	}
+}
+
+// Returns true if the client starts the connection with a TLS handshake. Plain
+// DNS starts with the length of the query instead, which can only be mistaken
+// for a TLS record for queries larger than 5.5KB. The returned connection
+// replays the bytes that were read.
+func peekTLS(conn net.Conn) (net.Conn, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(autoListenerPeekTimeout))
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(2)
+	if err != nil {
+		return conn, false, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	// Record type handshake, followed by the major version, 3 for all TLS
+	// versions
+	isTLS := b[0] == 0x16 && b[1] == 0x03
+	return &bufferedConn{Conn: conn, r: br}, isTLS, nil
+}
+
+// Accepts QUIC connections and passes them to the DoQ or DoH/3 server.
+func (s *AutoListener) startQUIC() error {
+	tlsConfig := s.opt.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq", http3.NextProtoH3}
+	ln, err := quic.ListenAddrEarly(s.addr, tlsConfig, &quic.Config{
+		Allow0RTT:      true,
+		MaxIdleTimeout: 5 * time.Minute,
+	})
+	if err != nil {
+		return err
+	}
+	s.quicLn = ln
+
+	for {
+		connection, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			s.log.Warn("failed to accept", "error", err)
+			continue
+		}
+		switch connection.ConnectionState().TLS.NegotiatedProtocol {
+		case "doq":
+			go s.doq.handleConnection(connection)
+		case http3.NextProtoH3:
+			go func() {
+				if err := s.h3.ServeQUICConn(connection); err != nil {
+					s.log.Debug("http/3 connection closed", "client", connection.RemoteAddr(), "error", err)
+				}
+			}()
+		default:
+			connection.CloseWithError(DOQNoError, "")
+		}
+	}
+}
+
+// Stop the listener.
+func (s *AutoListener) Stop() error {
+	s.log.Info("stopping listener")
+	if s.opt.Transport == "quic" {
+		if s.quicLn == nil {
+			return nil
+		}
+		s.h3.Close()
+		return s.quicLn.Close()
+	}
+	if s.ln == nil {
+		return nil
+	}
+	err := s.ln.Close()
+	s.plain.Shutdown()
+	s.dot.Shutdown()
+	return err
+}
+
+func (s *AutoListener) String() string {
+	return s.id
+}
+
+// Listener that hands out connections accepted by another listener.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Passes a connection to Accept, or closes it if the listener is closed.
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
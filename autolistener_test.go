@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoListener(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		transports []string
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			mu.Lock()
+			transports = append(transports, ci.Transport)
+			mu.Unlock()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+
+	// Plain DNS and DoT on the same TCP port, DoQ and DoH/3 on the same UDP
+	// port
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	tcp, err := NewAutoListener("test-auto-tcp", addr, AutoListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go tcp.Start()
+	defer tcp.Stop()
+	quic, err := NewAutoListener("test-auto-quic", addr, AutoListenerOptions{TLSConfig: tlsServerConfig, Transport: "quic"}, upstream)
+	require.NoError(t, err)
+	go quic.Start()
+	defer quic.Stop()
+	time.Sleep(time.Second)
+
+	plain, err := NewDNSClient("test-auto-plain", addr, "tcp", DNSClientOptions{})
+	require.NoError(t, err)
+	dot, err := NewDoTClient("test-auto-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+	doq, err := NewDoQClient("test-auto-doq", addr, DoQClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+	doh, err := NewDoHClient("test-auto-doh", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsConfig, Transport: "quic"})
+	require.NoError(t, err)
+
+	for _, c := range []Resolver{plain, dot, doq, doh} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err, c.String())
+		require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	}
+	require.Equal(t, []string{"tcp", "dot", "doq", "doh"}, transports)
+}
@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Time after which addresses of blocked names are no longer blocked in
+// reverse lookups.
+const reverseBlockExpiry = time.Hour
+
+// Maximum number of addresses to remember per blocklist.
+const reverseBlocksMax = 10000
+
+// Addresses of names blocked by a blocklist, by their reverse lookup name, so
+// PTR queries for them can be blocked as well.
+type reverseBlocks struct {
+	mu    sync.Mutex
+	items map[string]reverseBlock
+}
+
+type reverseBlock struct {
+	// Blocked names the blocklist-resolver returned the address for. Empty
+	// for addresses of names blocked in CNAME chains, those are blocked
+	// like the forward query.
+	names []string
+	match *BlocklistMatch
+	time  time.Time
+}
+
+func newReverseBlocks() *reverseBlocks {
+	return &reverseBlocks{items: make(map[string]reverseBlock)}
+}
+
+// Records an address that a blocked name resolves to. The name is answered in
+// PTR queries if given.
+func (b *reverseBlocks) add(ip net.IP, name string, match *BlocklistMatch, now time.Time) {
+	if ip.IsUnspecified() {
+		return
+	}
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	item, ok := b.items[reverse]
+	if !ok && len(b.items) >= reverseBlocksMax {
+		for k, v := range b.items {
+			if now.Sub(v.time) > reverseBlockExpiry {
+				delete(b.items, k)
+			}
+		}
+		if len(b.items) >= reverseBlocksMax {
+			return
+		}
+	}
+	if ok && now.Sub(item.time) > reverseBlockExpiry {
+		item.names = nil
+	}
+	name = strings.ToLower(name)
+	if name != "" && !slices.Contains(item.names, name) && len(item.names) < maxPTRResponses {
+		item.names = append(item.names, name)
+	}
+	item.match = match
+	item.time = now
+	b.items[reverse] = item
+}
+
+// Records the addresses in the answer of a response to a blocked query.
+func (b *reverseBlocks) addAnswer(a *dns.Msg, name string, match *BlocklistMatch, now time.Time) {
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			b.add(rr.A, name, match, now)
+		case *dns.AAAA:
+			b.add(rr.AAAA, name, match, now)
+		}
+	}
+}
+
+func (b *reverseBlocks) lookup(name string, now time.Time) (reverseBlock, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	item, ok := b.items[strings.ToLower(name)]
+	if !ok || now.Sub(item.time) > reverseBlockExpiry {
+		return reverseBlock{}, false
+	}
+	return item, true
+}
@@ -2,10 +2,11 @@ package rdns
 
 import (
 	"errors"
-	"expvar"
 	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,6 +20,18 @@ type Blocklist struct {
 	resolver Resolver
 	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	// Approximate memory used by the block- and allowlist rules in bytes.
+	memory *Gauge
+
+	// Names that are temporarily not blocked, and until when.
+	unblocked map[string]time.Time
+
+	// Addresses of blocked names, blocked in reverse lookups.
+	reverse *reverseBlocks
+
+	// Set once the blocklist is closed, stops the refresh loops.
+	closed atomic.Bool
 }
 
 var _ Resolver = &Blocklist{}
@@ -46,35 +59,90 @@ type BlocklistOptions struct {
 	// Optional, allows specifying extended errors to be used in the
 	// response when blocking.
 	EDNS0EDETemplate *EDNS0EDETemplate
+
+	// Also check the targets of CNAME records in responses against the
+	// blocklist, to block names that are hidden behind a CNAME chain, such
+	// as trackers using a subdomain of the site.
+	CNAMEChain bool
+
+	// Maximum number of CNAME records followed in a response when
+	// CNAMEChain is set. Defaults to 10.
+	CNAMEMaxDepth int
+
+	// Block PTR queries for addresses that the blocklist-resolver returned
+	// for blocked names, or that names blocked in CNAME chains resolve to,
+	// for up to an hour. PTR queries for addresses from the
+	// blocklist-resolver are answered with the blocked names, others are
+	// blocked like the forward query. Spoofed addresses of hosts rules are
+	// always answered in reverse lookups.
+	BlockReverse bool
+
+	// Optional, respond to blocked A/AAAA queries with the address of a
+	// block page server rather than NXDOMAIN. Rules that map names to the
+	// unspecified address (0.0.0.0 or ::) in hosts files are answered
+	// with these addresses as well.
+	BlockPageIPs []net.IP
+
+	// Clients in these networks are never blocked. Queries that would be
+	// blocked are logged and counted, then forwarded like allowed ones, to
+	// try out rules on a few clients before applying them to everyone.
+	ObserveNets []*net.IPNet
+
+	// Source of time for the refresh loop. Defaults to the system clock.
+	Clock Clock
 }
 
 type BlocklistMetrics struct {
 	// Blocked queries count.
-	blocked *expvar.Int
+	blocked *Counter
 	// Allowed queries count.
-	allowed *expvar.Int
+	allowed *Counter
+	// Responses blocked because of a name in the CNAME chain.
+	blockedCNAME *Counter
+	// Queries of observe-only clients that would have been blocked.
+	observed *Counter
 }
 
 const (
 	// Max number of name records to reply with for PTR lookups
 	maxPTRResponses = 10
+
+	// TTL of block page responses, short to let unblocked names take
+	// effect quickly
+	blockPageTTL = 60
 )
 
 func NewBlocklistMetrics(id string) *BlocklistMetrics {
 	return &BlocklistMetrics{
-		allowed: getVarInt("router", id, "allow"),
-		blocked: getVarInt("router", id, "deny"),
+		allowed:      getCounter("router", id, "allow"),
+		blocked:      getCounter("router", id, "deny"),
+		blockedCNAME: getCounter("router", id, "deny-cname"),
+		observed:     getCounter("router", id, "observe"),
 	}
 }
 
 // NewBlocklist returns a new instance of a blocklist resolver.
 func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklist, error) {
+	if opt.CNAMEMaxDepth == 0 {
+		opt.CNAMEMaxDepth = defaultCNAMEMaxDepth
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
 	blocklist := &Blocklist{
 		id:               id,
 		resolver:         resolver,
 		BlocklistOptions: opt,
 		metrics:          NewBlocklistMetrics(id),
+		memory:           getGauge("router", id, "memory-bytes"),
+		unblocked:        make(map[string]time.Time),
+		reverse:          newReverseBlocks(),
 	}
+	blocklist.updateMemory()
+
+	// Lists loaded in the background aren't counted until they're loaded
+	go func() {
+		WaitForLists()
+		blocklist.updateMemory()
+	}()
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -98,11 +166,23 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	r.mu.RLock()
 	blocklistDB := r.BlocklistDB
 	allowlistDB := r.AllowlistDB
+	unblockedUntil, unblocked := r.unblocked[strings.ToLower(question.Name)]
 	r.mu.RUnlock()
 
+	matchStart := time.Now()
+
+	// Forward names that were unblocked temporarily
+	if unblocked && r.Clock.Now().Before(unblockedUntil) {
+		log.Debug("name temporarily unblocked, forwarding",
+			"resolver", r.resolver.String())
+		r.metrics.allowed.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+
 	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist
 	if allowlistDB != nil {
 		if _, _, match, ok := allowlistDB.Match(q); ok {
+			recordTiming(ci, "blocklist", r.id, matchStart)
 			log = log.With(
 				slog.String("list", match.List),
 				slog.String("rule", match.Rule),
@@ -120,17 +200,75 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	ips, names, match, ok := blocklistDB.Match(q)
+	if !ok && r.BlockReverse && question.Qtype == dns.TypePTR {
+		if b, found := r.reverse.lookup(question.Name, r.Clock.Now()); found {
+			log.Debug("address of blocked name in reverse lookup")
+			names, match, ok = b.names, b.match, true
+		}
+	}
+	recordTiming(ci, "blocklist", r.id, matchStart)
+	if ok && inNets(r.ObserveNets, ci.SourceIP) {
+		r.observe(q, ci, "", match)
+		return r.resolver.Resolve(q, ci)
+	}
 	if !ok {
 		log.Debug("forwarding unmodified query to resolver",
 			"resolver", r.resolver.String())
 		r.metrics.allowed.Add(1)
-		return r.resolver.Resolve(q, ci)
+		a, err := r.resolver.Resolve(q, ci)
+		if err != nil || a == nil || !r.CNAMEChain {
+			return a, err
+		}
+		return r.checkCNAMEChain(q, a, ci, blocklistDB, allowlistDB)
 	}
-	log = log.With(
-		slog.String("list", match.List),
-		slog.String("rule", match.Rule),
-	)
 	r.metrics.blocked.Add(1)
+	return r.block(q, ci, "", ips, names, match)
+}
+
+// Checks the names in the CNAME chain of a response against the blocklist and
+// returns a block response if one of them matches.
+func (r *Blocklist) checkCNAMEChain(q, a *dns.Msg, ci ClientInfo, blocklistDB, allowlistDB BlocklistDB) (*dns.Msg, error) {
+	chain, complete := cnameChain(q.Question[0].Name, a, r.CNAMEMaxDepth)
+	if !complete {
+		logger(r.id, q, ci).Debug("cname chain too long, checking only part of it", "max-depth", r.CNAMEMaxDepth)
+	}
+	for _, name := range chain {
+		target := new(dns.Msg)
+		target.SetQuestion(name, q.Question[0].Qtype)
+		if allowlistDB != nil {
+			if _, _, _, ok := allowlistDB.Match(target); ok {
+				continue
+			}
+		}
+		ips, names, match, ok := blocklistDB.Match(target)
+		if !ok {
+			continue
+		}
+		if inNets(r.ObserveNets, ci.SourceIP) {
+			r.observe(q, ci, name, match)
+			return a, nil
+		}
+		r.metrics.blockedCNAME.Add(1)
+		if r.BlockReverse {
+			r.reverse.addAnswer(a, "", match, r.Clock.Now())
+		}
+		return r.block(q, ci, name, ips, names, match)
+	}
+	return a, nil
+}
+
+// Builds the response to a blocked query. The CNAME target is set if the query
+// is blocked because of a name in the CNAME chain of the response.
+func (r *Blocklist) block(q *dns.Msg, ci ClientInfo, cname string, ips []net.IP, names []string, match *BlocklistMatch) (*dns.Msg, error) {
+	question := q.Question[0]
+	log := logger(r.id, q, ci).With(
+		slog.String("list", match.GetList()),
+		slog.String("rule", match.GetRule()),
+	)
+	if cname != "" {
+		log = log.With(slog.String("cname", cname))
+	}
+	traceBlocked(ci, r.id, match)
 
 	// If we got names for the PTR query, respond to it
 	if question.Qtype == dns.TypePTR && len(names) > 0 {
@@ -145,14 +283,88 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if r.BlocklistResolver != nil {
 		log.Debug("matched blocklist, forwarding",
 			"resolver", r.BlocklistResolver.String())
-		return r.BlocklistResolver.Resolve(q, ci)
+		a, err := r.BlocklistResolver.Resolve(q, ci)
+		if err == nil && a != nil && r.BlockReverse {
+			r.reverse.addAnswer(a, question.Name, match, r.Clock.Now())
+		}
+		return a, err
 	}
 
 	answer := new(dns.Msg)
 	answer.SetReply(q)
 	answer.RecursionAvailable = q.RecursionDesired
 
+	// Respond with the block page address if the rule doesn't come with its own
+	if len(r.BlockPageIPs) > 0 && (question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA) && allUnspecified(ips) {
+		log.Debug("responding with block page address")
+		blockedNames.add(question.Name, blockedName{
+			Blocklist: r.id,
+			List:      match.GetList(),
+			Rule:      match.GetRule(),
+			Time:      r.Clock.Now(),
+		})
+		// Without an address of the right type, respond with NODATA so the
+		// client uses the other one
+		answer.Answer = spoofRecords(question, r.BlockPageIPs, blockPageTTL)
+		return answer, nil
+	}
+
 	// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
+	if spoof := spoofRecords(question, ips, 3600); len(spoof) > 0 {
+		log.Debug("spoofing response")
+		answer.Answer = spoof
+		return answer, nil
+	}
+
+	// Block the request with NXDOMAIN if there was a match but no valid spoofed IP is given
+	log.Debug("blocking request")
+	if err := r.EDNS0EDETemplate.Apply(answer, EDNS0EDEInput{q, match}); err != nil {
+		log.Error("failed to apply edns0ede template", "error", err)
+	}
+	answer.SetRcode(q, dns.RcodeNameError)
+	return answer, nil
+}
+
+// Logs and counts a query of an observe-only client that would have been
+// blocked.
+func (r *Blocklist) observe(q *dns.Msg, ci ClientInfo, cname string, match *BlocklistMatch) {
+	log := logger(r.id, q, ci).With(
+		slog.String("list", match.GetList()),
+		slog.String("rule", match.GetRule()),
+	)
+	if cname != "" {
+		log = log.With(slog.String("cname", cname))
+	}
+	r.metrics.observed.Add(1)
+	log.Info("matched blocklist, not blocking observe-only client")
+}
+
+func (r *Blocklist) String() string {
+	return r.id
+}
+
+// Close stops refreshing the blocklist and allowlist.
+func (r *Blocklist) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
+// Unblock stops blocking queries for a name for the given duration.
+func (r *Blocklist) Unblock(name string, d time.Duration) {
+	now := r.Clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n, until := range r.unblocked {
+		if now.After(until) {
+			delete(r.unblocked, n)
+		}
+	}
+	r.unblocked[strings.ToLower(dns.Fqdn(name))] = now.Add(d)
+}
+
+// Returns A or AAAA records, depending on the query type, with the IPs
+// of the matching type.
+func spoofRecords(question dns.Question, ips []net.IP, ttl uint32) []dns.RR {
 	var spoof []dns.RR
 	for _, ip := range ips {
 		if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
@@ -161,69 +373,95 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 					Name:   question.Name,
 					Rrtype: dns.TypeA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				A: ip,
 			})
-		} else if len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
+		} else if ip.To4() == nil && len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
 			spoof = append(spoof, &dns.AAAA{
 				Hdr: dns.RR_Header{
 					Name:   question.Name,
 					Rrtype: dns.TypeAAAA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				AAAA: ip,
 			})
 		}
 	}
+	return spoof
+}
 
-	if len(spoof) > 0 {
-		log.Debug("spoofing response")
-		answer.Answer = spoof
-		return answer, nil
+// Returns true if the IP is in one of the networks.
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Block the request with NXDOMAIN if there was a match but no valid spoofed IP is given
-	log.Debug("blocking request")
-	if err := r.EDNS0EDETemplate.Apply(answer, EDNS0EDEInput{q, match}); err != nil {
-		log.Error("failed to apply edns0ede template", "error", err)
+// Returns true if none of the IPs is a usable address, like 0.0.0.0 in hosts
+// files.
+func allUnspecified(ips []net.IP) bool {
+	for _, ip := range ips {
+		if !ip.IsUnspecified() {
+			return false
+		}
 	}
-	answer.SetRcode(q, dns.RcodeNameError)
-	return answer, nil
+	return true
 }
 
-func (r *Blocklist) String() string {
-	return r.id
+// Updates the metric of the memory used by the rules.
+func (r *Blocklist) updateMemory() {
+	r.mu.RLock()
+	blocklistDB, allowlistDB := r.BlocklistDB, r.AllowlistDB
+	r.mu.RUnlock()
+	r.memory.Set(memoryUsage(blocklistDB) + memoryUsage(allowlistDB))
 }
 
 func (r *Blocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		r.Clock.Sleep(refresh)
+		if r.closed.Load() {
+			return
+		}
 		log := Log.With(slog.String("id", r.id))
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
 			log.Error("failed to load rules", "error", err)
+			notifyReloadFailed(r.id, err)
+			statusReload(r.id, err)
 			continue
 		}
 		r.mu.Lock()
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		r.updateMemory()
+		statusReload(r.id, nil)
 	}
 }
 func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		r.Clock.Sleep(refresh)
+		if r.closed.Load() {
+			return
+		}
 		log := Log.With(slog.String("id", r.id))
 		log.Debug("reloading allowlist")
 		db, err := r.AllowlistDB.Reload()
 		if err != nil {
 			log.Error("failed to load rules", "error", err)
+			notifyReloadFailed(r.id, err)
+			statusReload(r.id, err)
 			continue
 		}
 		r.mu.Lock()
 		r.AllowlistDB = db
 		r.mu.Unlock()
+		r.updateMemory()
+		statusReload(r.id, nil)
 	}
 }
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -82,3 +83,185 @@ func TestBlocklistAllow(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestBlocklistCNAMEChain(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{ResolveFunc: cnameChainResponse}
+
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader([]string{".ads.test"}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("testlist", NewStaticLoader([]string{"allowed.test"}))
+	require.NoError(t, err)
+
+	// Without following the chain, the response is passed through
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: blockDB})
+	require.NoError(t, err)
+	q.SetQuestion("www.example.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// Following the chain finds the tracker behind the CDN
+	b, err = NewBlocklist("test-bl-cname", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		AllowlistDB: allowDB,
+		CNAMEChain:  true,
+	})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, int64(1), b.metrics.blockedCNAME.Value())
+
+	// The allowlist takes precedence for the query name
+	q.SetQuestion("allowed.test.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// The tracker is beyond the depth limit
+	b, err = NewBlocklist("test-bl-depth", r, BlocklistOptions{
+		BlocklistDB:   blockDB,
+		CNAMEChain:    true,
+		CNAMEMaxDepth: 1,
+	})
+	require.NoError(t, err)
+	q.SetQuestion("www.example.test.", dns.TypeA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
+
+func TestBlocklistBlockReverse(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{ResolveFunc: cnameChainResponse}
+
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{".ads.test", "blocked.test"}))
+	require.NoError(t, err)
+
+	// Blocked in the CNAME chain, the address of the tracker is blocked in
+	// reverse lookups as well
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{
+		BlocklistDB:  db,
+		CNAMEChain:   true,
+		BlockReverse: true,
+	})
+	require.NoError(t, err)
+	q.SetQuestion("www.example.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	q.SetQuestion("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Reverse lookups are forwarded before anything is blocked
+	b, err = NewBlocklist("test-bl-resolver", r, BlocklistOptions{
+		BlocklistDB:       db,
+		BlocklistResolver: &TestResolver{ResolveFunc: cnameChainResponse},
+		BlockReverse:      true,
+	})
+	require.NoError(t, err)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// Addresses returned by the blocklist-resolver are answered with the
+	// blocked name
+	q.SetQuestion("blocked.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+
+	q.SetQuestion("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "blocked.test.", a.Answer[0].(*dns.PTR).Ptr)
+}
+
+// Responds to queries with a CNAME chain leading to a tracker behind a CDN.
+func cnameChainResponse(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	for _, s := range []string{
+		q.Question[0].Name + " 60 IN CNAME edge.cdn.test.",
+		"edge.cdn.test. 60 IN CNAME tracker.ads.test.",
+		"tracker.ads.test. 60 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		a.Answer = append(a.Answer, rr)
+	}
+	return a, nil
+}
+
+func TestBlocklistObserveNets(t *testing.T) {
+	q := new(dns.Msg)
+	r := &TestResolver{ResolveFunc: cnameChainResponse}
+
+	blockDB, err := NewDomainDB("testlist", NewStaticLoader([]string{"evil.test", ".ads.test"}))
+	require.NoError(t, err)
+	observeNet, err := ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl-observe", r, BlocklistOptions{
+		BlocklistDB: blockDB,
+		CNAMEChain:  true,
+		ObserveNets: []*net.IPNet{observeNet},
+	})
+	require.NoError(t, err)
+
+	// Other clients are blocked
+	q.SetQuestion("evil.test.", dns.TypeA)
+	a, err := b.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.0.0.1")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, r.HitCount())
+
+	// Observe-only clients are forwarded, matches counted
+	observed := ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+	_, err = b.Resolve(q, observed)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, int64(1), b.metrics.observed.Value())
+
+	// Including names in the CNAME chain
+	q.SetQuestion("www.example.test.", dns.TypeA)
+	a, err = b.Resolve(q, observed)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, int64(2), b.metrics.observed.Value())
+	require.Equal(t, int64(0), b.metrics.blockedCNAME.Value())
+}
+
+func TestBlocklistMemory(t *testing.T) {
+	small, err := NewDomainDB("small", NewStaticLoader([]string{"block.test"}))
+	require.NoError(t, err)
+	large, err := NewDomainDB("large", NewStaticLoader([]string{"block.test", ".evil.test", "*.ads.example.com"}))
+	require.NoError(t, err)
+	require.Greater(t, memoryUsage(small), int64(0))
+	require.Greater(t, memoryUsage(large), memoryUsage(small))
+
+	hosts, err := NewHostsDB("hosts", NewStaticLoader([]string{"127.0.0.1 block.test"}))
+	require.NoError(t, err)
+	regexps, err := NewRegexpDB("regexp", NewStaticLoader([]string{`(^|\.)block\.test`}))
+	require.NoError(t, err)
+	multi, err := NewMultiDB(large, hosts, regexps)
+	require.NoError(t, err)
+	require.Equal(t, memoryUsage(large)+memoryUsage(hosts)+memoryUsage(regexps), memoryUsage(multi))
+
+	// The blocklist reports the memory of the block- and allowlist
+	b, err := NewBlocklist("test-blocklist-memory", new(TestResolver), BlocklistOptions{
+		BlocklistDB: multi,
+		AllowlistDB: small,
+	})
+	require.NoError(t, err)
+	require.Equal(t, memoryUsage(multi)+memoryUsage(small), b.memory.Value())
+}
@@ -0,0 +1,162 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Lists that are still loading in the background.
+var listsLoading sync.WaitGroup
+
+// WaitForLists blocks until all lists that are loaded in the background have
+// finished loading, successfully or not.
+func WaitForLists() {
+	listsLoading.Wait()
+}
+
+// A list database that's loaded in the background after startup.
+type backgroundList[T any] struct {
+	mu      sync.RWMutex
+	db      T
+	loaded  bool
+	loading bool
+}
+
+// Starts loading the database. The element is marked as loading in its status
+// until it's done.
+func (b *backgroundList[T]) start(id, name string, load func() (T, error)) {
+	listsLoading.Add(1)
+	statusLoading(id, 1)
+	b.loading = true
+	go func() {
+		defer listsLoading.Done()
+		defer statusLoading(id, -1)
+		db, err := load()
+		b.mu.Lock()
+		b.loading = false
+		if err == nil {
+			b.db, b.loaded = db, true
+		}
+		b.mu.Unlock()
+		if err != nil {
+			Log.Error("failed to load list in background", "id", id, "list", name, "error", err)
+			notifyReloadFailed(id, err)
+			statusReload(id, err)
+		}
+	}()
+}
+
+// Returns the database and true once it's loaded.
+func (b *backgroundList[T]) get() (T, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.db, b.loaded
+}
+
+// Returns true while the database is loading.
+func (b *backgroundList[T]) pending() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.loading
+}
+
+// BackgroundDB is a blocklist database that is loaded in the background, so
+// startup doesn't wait for it. It doesn't match anything until it's loaded.
+type BackgroundDB struct {
+	name string
+	load func() (BlocklistDB, error)
+	list backgroundList[BlocklistDB]
+}
+
+var _ BlocklistDB = &BackgroundDB{}
+
+// NewBackgroundDB returns a blocklist database that's loaded in the background
+// with the given function. The ID is that of the element using the database.
+func NewBackgroundDB(id, name string, load func() (BlocklistDB, error)) *BackgroundDB {
+	db := &BackgroundDB{name: name, load: load}
+	db.list.start(id, name, load)
+	return db
+}
+
+// Reload the database. If it failed to load in the background, it's loaded
+// now. Returns the same instance while it's still loading.
+func (m *BackgroundDB) Reload() (BlocklistDB, error) {
+	if db, ok := m.list.get(); ok {
+		return db.Reload()
+	}
+	if m.list.pending() {
+		return m, nil
+	}
+	return m.load()
+}
+
+func (m *BackgroundDB) Match(q *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	if db, ok := m.list.get(); ok {
+		return db.Match(q)
+	}
+	return nil, nil, nil, false
+}
+
+// Returns the approximate memory used by the database once it's loaded.
+func (m *BackgroundDB) memoryUsage() int64 {
+	if db, ok := m.list.get(); ok {
+		return memoryUsage(db)
+	}
+	return 0
+}
+
+func (m *BackgroundDB) String() string {
+	return m.name
+}
+
+// BackgroundIPDB is an IP blocklist database that is loaded in the
+// background, so startup doesn't wait for it. It doesn't match anything until
+// it's loaded.
+type BackgroundIPDB struct {
+	name string
+	load func() (IPBlocklistDB, error)
+	list backgroundList[IPBlocklistDB]
+}
+
+var _ IPBlocklistDB = &BackgroundIPDB{}
+
+// NewBackgroundIPDB returns an IP blocklist database that's loaded in the
+// background with the given function. The ID is that of the element using the
+// database.
+func NewBackgroundIPDB(id, name string, load func() (IPBlocklistDB, error)) *BackgroundIPDB {
+	db := &BackgroundIPDB{name: name, load: load}
+	db.list.start(id, name, load)
+	return db
+}
+
+// Reload the database. If it failed to load in the background, it's loaded
+// now. Returns the same instance while it's still loading.
+func (m *BackgroundIPDB) Reload() (IPBlocklistDB, error) {
+	if db, ok := m.list.get(); ok {
+		return db.Reload()
+	}
+	if m.list.pending() {
+		return m, nil
+	}
+	return m.load()
+}
+
+func (m *BackgroundIPDB) Match(ip net.IP) (*BlocklistMatch, bool) {
+	if db, ok := m.list.get(); ok {
+		return db.Match(ip)
+	}
+	return nil, false
+}
+
+func (m *BackgroundIPDB) Close() error {
+	if db, ok := m.list.get(); ok {
+		return db.Close()
+	}
+	return nil
+}
+
+func (m *BackgroundIPDB) String() string {
+	return m.name
+}
@@ -0,0 +1,65 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundDB(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.evil.test.", dns.TypeA)
+
+	release := make(chan struct{})
+	db := NewBackgroundDB("test-background", "testlist", func() (BlocklistDB, error) {
+		<-release
+		return NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	})
+
+	// Nothing is blocked while the list is loading
+	_, _, _, ok := db.Match(q)
+	require.False(t, ok)
+	status, _ := GetElementStatus("test-background")
+	require.True(t, status.Loading)
+	require.False(t, status.Healthy)
+
+	// Reloading while it's still loading doesn't load it again
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	require.Same(t, db, reloaded)
+
+	close(release)
+	WaitForLists()
+	_, _, _, ok = db.Match(q)
+	require.True(t, ok)
+	status, _ = GetElementStatus("test-background")
+	require.False(t, status.Loading)
+	require.True(t, status.Healthy)
+}
+
+func TestBackgroundDBFailure(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.evil.test.", dns.TypeA)
+
+	fail := true
+	db := NewBackgroundDB("test-background-failure", "testlist", func() (BlocklistDB, error) {
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	})
+	WaitForLists()
+	_, _, _, ok := db.Match(q)
+	require.False(t, ok)
+	status, _ := GetElementStatus("test-background-failure")
+	require.Equal(t, "unavailable", status.LastReloadError)
+
+	// The next reload tries again
+	fail = false
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	_, _, _, ok = reloaded.Match(q)
+	require.True(t, ok)
+}
@@ -0,0 +1,442 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CompiledDB is a blocklist database loaded from a pre-compiled list file,
+// produced by CompileList from a list in domain, hosts or regexp format. The
+// rules are matched directly in the compiled data, so loading it takes no
+// more than reading the file, rather than parsing large text lists on slow
+// devices. Matches are the same as with the list the file was compiled from.
+type CompiledDB struct {
+	name     string
+	filename string
+	format   byte
+	data     []byte
+	root     uint32 // Root node of domain lists, or names of hosts lists
+	ptr      uint32 // PTR names of hosts lists
+	rules    []*regexp.Regexp
+}
+
+var _ BlocklistDB = &CompiledDB{}
+
+// Compiled list files start with the magic, which includes the version of
+// the file format, followed by the format of the list and two offsets
+// pointing at the data of the list.
+//
+// All offsets are 32bit little-endian from the start of the file. Strings
+// are stored as varint length followed by the bytes. Tables, used for the
+// nodes of domain tries and the names in hosts lists, are a varint number of
+// entries followed by the entries, sorted by key, each being the offset of
+// the key string and the offset of the value.
+const (
+	compiledMagic     = "RDNSLST\x01"
+	compiledHeaderLen = len(compiledMagic) + 1 + 2*4
+)
+
+const (
+	compiledDomain byte = iota + 1
+	compiledHosts
+	compiledRegexp
+)
+
+// CompileList parses the rules of a list in domain, hosts or regexp format
+// and writes them in compiled form to w, to be loaded with NewCompiledDB.
+func CompileList(format string, loader BlocklistLoader, w io.Writer) error {
+	c := newListCompiler()
+	switch format {
+	case "domain":
+		db, err := NewDomainDB("", loader)
+		if err != nil {
+			return err
+		}
+		c.writeHeader(compiledDomain, c.writeDomainNode(db.root), 0)
+	case "hosts":
+		db, err := NewHostsDB("", loader)
+		if err != nil {
+			return err
+		}
+		names := make(map[string]uint32, len(db.filters))
+		for name, ips := range db.filters {
+			names[name] = c.writeIPRecords(ips)
+		}
+		ptr := make(map[string]uint32, len(db.ptrMap))
+		for name, targets := range db.ptrMap {
+			ptr[name] = c.writeStringList(targets)
+		}
+		c.writeHeader(compiledHosts, c.writeTable(names), c.writeTable(ptr))
+	case "regexp":
+		db, err := NewRegexpDB("", loader)
+		if err != nil {
+			return err
+		}
+		rules := make([]string, 0, len(db.rules))
+		for _, r := range db.rules {
+			rules = append(rules, r.String())
+		}
+		c.writeHeader(compiledRegexp, c.writeStringList(rules), 0)
+	default:
+		return fmt.Errorf("unsupported format '%s' for compiled lists", format)
+	}
+	if c.buf.Len() > math.MaxUint32 {
+		return errors.New("compiled list exceeds 4GB")
+	}
+	_, err := w.Write(c.buf.Bytes())
+	return err
+}
+
+// NewCompiledDB returns a blocklist database that matches the rules of a
+// compiled list file.
+func NewCompiledDB(name, filename string) (*CompiledDB, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < compiledHeaderLen || string(data[:len(compiledMagic)]) != compiledMagic {
+		return nil, fmt.Errorf("%s is not a compiled list, or was compiled by a different version", filename)
+	}
+	db := &CompiledDB{
+		name:     name,
+		filename: filename,
+		format:   data[len(compiledMagic)],
+		data:     data,
+		root:     binary.LittleEndian.Uint32(data[len(compiledMagic)+1:]),
+		ptr:      binary.LittleEndian.Uint32(data[len(compiledMagic)+5:]),
+	}
+	switch db.format {
+	case compiledDomain, compiledHosts:
+	case compiledRegexp:
+		rules, ok := db.stringList(db.root)
+		if !ok {
+			return nil, fmt.Errorf("invalid compiled list %s", filename)
+		}
+		for _, r := range rules {
+			re, err := regexp.Compile(r)
+			if err != nil {
+				return nil, err
+			}
+			db.rules = append(db.rules, re)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format in compiled list %s", filename)
+	}
+	return db, nil
+}
+
+func (m *CompiledDB) Reload() (BlocklistDB, error) {
+	return NewCompiledDB(m.name, m.filename)
+}
+
+func (m *CompiledDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	switch m.format {
+	case compiledDomain:
+		return m.matchDomain(msg)
+	case compiledHosts:
+		return m.matchHosts(msg)
+	default:
+		return m.matchRegexp(msg)
+	}
+}
+
+// Same as DomainDB.Match, walking the trie in the compiled data.
+func (m *CompiledDB) matchDomain(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	q := msg.Question[0]
+	s := strings.TrimSuffix(q.Name, ".")
+	var matched []string
+	parts := strings.Split(s, ".")
+	n := m.root
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+		subNode, ok := m.lookup(n, part)
+		if !ok {
+			return nil, nil, nil, false
+		}
+		matched = append(matched, part)
+		if _, ok := m.lookup(subNode, ""); ok { // exact and sub-domain match
+			return nil, nil, &BlocklistMatch{List: m.name, Rule: matchedDomainParts(".", matched)}, true
+		}
+		if _, ok := m.lookup(subNode, "*"); ok && i > 0 { // wildcard match on sub-domains
+			return nil, nil, &BlocklistMatch{List: m.name, Rule: matchedDomainParts("*.", matched)}, true
+		}
+		n = subNode
+	}
+	size, _, ok := m.tableSize(n)
+	return nil, nil, &BlocklistMatch{List: m.name, Rule: matchedDomainParts("", matched)}, ok && size == 0 // exact match
+}
+
+// Same as HostsDB.Match, looking up names in the compiled data.
+func (m *CompiledDB) matchHosts(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	q := msg.Question[0]
+	if q.Qtype == dns.TypePTR {
+		var names []string
+		off, ok := m.lookup(m.ptr, q.Name)
+		if ok {
+			names, ok = m.stringList(off)
+		}
+		var rule string
+		if len(names) > 0 {
+			rule = names[0]
+		}
+		return nil, names, &BlocklistMatch{List: m.name, Rule: rule}, ok
+	}
+	name := strings.TrimSuffix(q.Name, ".")
+	var ips ipRecords
+	off, ok := m.lookup(m.root, name)
+	if ok {
+		ips, ok = m.ipRecords(off)
+	}
+	if q.Qtype == dns.TypeA {
+		return ips.ip4, nil, &BlocklistMatch{List: m.name, Rule: name}, ok
+	}
+	return ips.ip6, nil, &BlocklistMatch{List: m.name, Rule: name}, ok
+}
+
+func (m *CompiledDB) matchRegexp(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	q := msg.Question[0]
+	for _, rule := range m.rules {
+		if rule.MatchString(q.Name) {
+			return nil, nil, &BlocklistMatch{List: m.name, Rule: rule.String()}, true
+		}
+	}
+	return nil, nil, nil, false
+}
+
+// Returns the approximate memory used by the compiled data.
+func (m *CompiledDB) memoryUsage() int64 {
+	return int64(len(m.data)) + regexpMemoryUsage(m.rules)
+}
+
+func (m *CompiledDB) String() string {
+	return "Compiled"
+}
+
+// Returns the number of entries in the table at off, and the offset of the
+// first entry.
+func (m *CompiledDB) tableSize(off uint32) (int, uint32, bool) {
+	if uint64(off) >= uint64(len(m.data)) {
+		return 0, 0, false
+	}
+	n, k := binary.Uvarint(m.data[off:])
+	entries := uint64(off) + uint64(k)
+	if k <= 0 || n > uint64(len(m.data)) || entries+n*8 > uint64(len(m.data)) {
+		return 0, 0, false
+	}
+	return int(n), uint32(entries), true
+}
+
+// Looks up a key in the table at off and returns the offset of its value.
+func (m *CompiledDB) lookup(off uint32, key string) (uint32, bool) {
+	n, entries, ok := m.tableSize(off)
+	if !ok {
+		return 0, false
+	}
+	entry := func(i int) uint32 { return entries + uint32(i)*8 }
+	valid := true
+	i := sort.Search(n, func(i int) bool {
+		k, ok := m.bytes(binary.LittleEndian.Uint32(m.data[entry(i):]))
+		valid = valid && ok
+		return string(k) >= key
+	})
+	if !valid || i == n {
+		return 0, false
+	}
+	if k, _ := m.bytes(binary.LittleEndian.Uint32(m.data[entry(i):])); string(k) != key {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(m.data[entry(i)+4:]), true
+}
+
+// Returns the bytes of the string at off.
+func (m *CompiledDB) bytes(off uint32) ([]byte, bool) {
+	if uint64(off) >= uint64(len(m.data)) {
+		return nil, false
+	}
+	l, k := binary.Uvarint(m.data[off:])
+	start := uint64(off) + uint64(k)
+	if k <= 0 || l > uint64(len(m.data)) || start+l > uint64(len(m.data)) {
+		return nil, false
+	}
+	return m.data[start : start+l], true
+}
+
+// Returns the list of strings at off.
+func (m *CompiledDB) stringList(off uint32) ([]string, bool) {
+	if uint64(off) >= uint64(len(m.data)) {
+		return nil, false
+	}
+	n, k := binary.Uvarint(m.data[off:])
+	start := uint64(off) + uint64(k)
+	if k <= 0 || n > uint64(len(m.data)) || start+n*4 > uint64(len(m.data)) {
+		return nil, false
+	}
+	list := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		b, ok := m.bytes(binary.LittleEndian.Uint32(m.data[start+i*4:]))
+		if !ok {
+			return nil, false
+		}
+		list = append(list, string(b))
+	}
+	return list, true
+}
+
+// Returns the addresses of a name in a hosts list, stored as two lists of
+// addresses, IPv4 then IPv6. Each address is stored with its length, 0 for
+// blocked names.
+func (m *CompiledDB) ipRecords(off uint32) (ipRecords, bool) {
+	var records ipRecords
+	pos := uint64(off)
+	readIPs := func() ([]net.IP, bool) {
+		if pos >= uint64(len(m.data)) {
+			return nil, false
+		}
+		n, k := binary.Uvarint(m.data[pos:])
+		if k <= 0 {
+			return nil, false
+		}
+		pos += uint64(k)
+		var ips []net.IP
+		for i := uint64(0); i < n; i++ {
+			if pos >= uint64(len(m.data)) {
+				return nil, false
+			}
+			l := uint64(m.data[pos])
+			pos++
+			if pos+l > uint64(len(m.data)) {
+				return nil, false
+			}
+			var ip net.IP
+			if l > 0 {
+				ip = net.IP(bytes.Clone(m.data[pos : pos+l]))
+			}
+			ips = append(ips, ip)
+			pos += l
+		}
+		return ips, true
+	}
+	var ok bool
+	if records.ip4, ok = readIPs(); !ok {
+		return records, false
+	}
+	records.ip6, ok = readIPs()
+	return records, ok
+}
+
+// Builds the data of a compiled list.
+type listCompiler struct {
+	buf     bytes.Buffer
+	strings map[string]uint32 // Offsets of strings already written, labels repeat a lot
+	empty   uint32            // Offset of the empty table, 0 until written
+}
+
+func newListCompiler() *listCompiler {
+	c := &listCompiler{strings: make(map[string]uint32)}
+	c.buf.Write(make([]byte, compiledHeaderLen)) // Written last
+	return c
+}
+
+// Writes the header with the format and offsets of the list data.
+func (c *listCompiler) writeHeader(format byte, a, b uint32) {
+	header := c.buf.Bytes()[:compiledHeaderLen]
+	copy(header, compiledMagic)
+	header[len(compiledMagic)] = format
+	binary.LittleEndian.PutUint32(header[len(compiledMagic)+1:], a)
+	binary.LittleEndian.PutUint32(header[len(compiledMagic)+5:], b)
+}
+
+func (c *listCompiler) offset() uint32 {
+	return uint32(c.buf.Len())
+}
+
+func (c *listCompiler) writeUvarint(v uint64) {
+	c.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (c *listCompiler) writeUint32(v uint32) {
+	c.buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+// Writes a string, unless it was written before, and returns its offset.
+func (c *listCompiler) writeString(s string) uint32 {
+	if off, ok := c.strings[s]; ok {
+		return off
+	}
+	off := c.offset()
+	c.writeUvarint(uint64(len(s)))
+	c.buf.WriteString(s)
+	c.strings[s] = off
+	return off
+}
+
+// Writes a table of keys and the offsets of their values.
+func (c *listCompiler) writeTable(values map[string]uint32) uint32 {
+	if len(values) == 0 && c.empty != 0 {
+		return c.empty
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	keyOffsets := make([]uint32, len(keys))
+	for i, k := range keys {
+		keyOffsets[i] = c.writeString(k)
+	}
+	off := c.offset()
+	c.writeUvarint(uint64(len(keys)))
+	for i, k := range keys {
+		c.writeUint32(keyOffsets[i])
+		c.writeUint32(values[k])
+	}
+	if len(values) == 0 {
+		c.empty = off
+	}
+	return off
+}
+
+// Writes a node of a domain trie, after its children.
+func (c *listCompiler) writeDomainNode(n node) uint32 {
+	children := make(map[string]uint32, len(n))
+	for label, child := range n {
+		children[label] = c.writeDomainNode(child)
+	}
+	return c.writeTable(children)
+}
+
+func (c *listCompiler) writeStringList(list []string) uint32 {
+	offsets := make([]uint32, len(list))
+	for i, s := range list {
+		offsets[i] = c.writeString(s)
+	}
+	off := c.offset()
+	c.writeUvarint(uint64(len(list)))
+	for _, o := range offsets {
+		c.writeUint32(o)
+	}
+	return off
+}
+
+func (c *listCompiler) writeIPRecords(records ipRecords) uint32 {
+	off := c.offset()
+	for _, ips := range [][]net.IP{records.ip4, records.ip6} {
+		c.writeUvarint(uint64(len(ips)))
+		for _, ip := range ips {
+			c.buf.WriteByte(byte(len(ip)))
+			c.buf.Write(ip)
+		}
+	}
+	return off
+}
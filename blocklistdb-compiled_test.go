@@ -0,0 +1,112 @@
+package rdns
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompiledDB(t *testing.T) {
+	tests := []struct {
+		format  string
+		rules   []string
+		newDB   func(BlocklistLoader) (BlocklistDB, error)
+		queries []string
+	}{
+		{
+			format: "domain",
+			rules: []string{
+				"domain1.com",
+				".domain2.com",
+				"*.domain3.com",
+				"sub.domain4.com.",
+			},
+			newDB: func(l BlocklistLoader) (BlocklistDB, error) { return NewDomainDB("testlist", l) },
+			queries: []string{
+				"domain1.com.", "sub.domain1.com.", "domain2.com.", "sub.domain2.com.",
+				"domain3.com.", "a.b.domain3.com.", "domain4.com.", "sub.domain4.com.",
+				"com.", "other.org.",
+			},
+		},
+		{
+			format: "hosts",
+			rules: []string{
+				"# comment",
+				"127.0.0.1   domain1.com",
+				"0.0.0.0     domain2.com domain3.com.",
+				"::1         domain1.com",
+				"192.168.1.1 domain4.com",
+			},
+			newDB: func(l BlocklistLoader) (BlocklistDB, error) { return NewHostsDB("testlist", l) },
+			queries: []string{
+				"domain1.com.", "domain2.com.", "domain3.com.", "domain4.com.", "domain5.com.",
+				"1.0.0.127.in-addr.arpa.", "1.1.168.192.in-addr.arpa.", "2.0.0.127.in-addr.arpa.",
+			},
+		},
+		{
+			format: "regexp",
+			rules: []string{
+				`(^|\.)domain1\.com\.$`,
+				`^ads[0-9]+\.`,
+			},
+			newDB: func(l BlocklistLoader) (BlocklistDB, error) { return NewRegexpDB("testlist", l) },
+			queries: []string{
+				"domain1.com.", "sub.domain1.com.", "ads12.domain2.com.", "domain2.com.",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			loader := NewStaticLoader(test.rules)
+			var b bytes.Buffer
+			require.NoError(t, CompileList(test.format, loader, &b))
+			filename := filepath.Join(t.TempDir(), "list.bin")
+			require.NoError(t, os.WriteFile(filename, b.Bytes(), 0o644))
+
+			compiled, err := NewCompiledDB("testlist", filename)
+			require.NoError(t, err)
+			db, err := test.newDB(loader)
+			require.NoError(t, err)
+
+			// Matches are the same as from the text list
+			for _, name := range test.queries {
+				for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR} {
+					q := new(dns.Msg)
+					q.SetQuestion(name, qtype)
+					ip, names, match, ok := db.Match(q)
+					cip, cnames, cmatch, cok := compiled.Match(q)
+					require.Equal(t, ok, cok, name)
+					require.Equal(t, ip, cip, name)
+					require.Equal(t, names, cnames, name)
+					if ok {
+						require.Equal(t, match, cmatch, name)
+					}
+				}
+			}
+
+			// Reload reads the file again
+			_, err = compiled.Reload()
+			require.NoError(t, err)
+
+			// Truncated files don't match, but don't panic either
+			for i := compiledHeaderLen; i < b.Len(); i++ {
+				compiled.data = b.Bytes()[:i]
+				for _, name := range test.queries {
+					q := new(dns.Msg)
+					q.SetQuestion(name, dns.TypePTR)
+					compiled.Match(q)
+				}
+			}
+		})
+	}
+
+	// Invalid files are rejected
+	filename := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("domain1.com\n"), 0o644))
+	_, err := NewCompiledDB("testlist", filename)
+	require.Error(t, err)
+}
@@ -105,6 +105,19 @@ func (m *DomainDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, boo
 		len(n) == 0 // exact match
 }
 
+// Returns the approximate memory used by the rules.
+func (m *DomainDB) memoryUsage() int64 {
+	return m.root.memoryUsage()
+}
+
+func (n node) memoryUsage() int64 {
+	size := int64(mapOverhead)
+	for k, sub := range n {
+		size += mapEntryOverhead + stringMemoryUsage(k) + 8 + sub.memoryUsage()
+	}
+	return size
+}
+
 func (m *DomainDB) String() string {
 	return "Domain"
 }
@@ -119,6 +119,21 @@ func (m *HostsDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool
 		ok
 }
 
+// Returns the approximate memory used by the rules.
+func (m *HostsDB) memoryUsage() int64 {
+	size := int64(2 * mapOverhead)
+	for name, r := range m.filters {
+		size += mapEntryOverhead + stringMemoryUsage(name) + ipsMemoryUsage(r.ip4) + ipsMemoryUsage(r.ip6)
+	}
+	for addr, names := range m.ptrMap {
+		size += mapEntryOverhead + stringMemoryUsage(addr) + sliceOverhead
+		for _, name := range names {
+			size += stringMemoryUsage(name)
+		}
+	}
+	return size
+}
+
 func (m *HostsDB) String() string {
 	return "Hosts"
 }
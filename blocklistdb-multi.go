@@ -39,6 +39,15 @@ func (m MultiDB) Match(q *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
 	return nil, nil, nil, false
 }
 
+// Returns the approximate memory used by all databases.
+func (m MultiDB) memoryUsage() int64 {
+	var size int64
+	for _, db := range m.dbs {
+		size += memoryUsage(db)
+	}
+	return size
+}
+
 func (m MultiDB) String() string {
 	return "Multi-Blocklist"
 }
@@ -53,6 +53,11 @@ func (m *RegexpDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, boo
 	return nil, nil, nil, false
 }
 
+// Returns the approximate memory used by the compiled rules.
+func (m *RegexpDB) memoryUsage() int64 {
+	return regexpMemoryUsage(m.rules)
+}
+
 func (m *RegexpDB) String() string {
 	return "Regexp"
 }
@@ -0,0 +1,243 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitLoader reads blocklist rules from a file in a git repository. The
+// repository is cloned on the first load and updated to the latest commit of
+// the branch on every refresh, so rules can be managed with code review and
+// changes are picked up once they're merged. Requires the git command.
+type GitLoader struct {
+	url         string
+	opt         GitLoaderOptions
+	dir         string
+	fromDisk    bool
+	lastSuccess []string
+	commitGauge *GaugeMap
+
+	mu     sync.RWMutex
+	commit string
+}
+
+// GitLoaderOptions holds options for git blocklist loaders.
+type GitLoaderOptions struct {
+	// Branch to load the rules from. Defaults to the default branch of the
+	// repository.
+	Branch string
+
+	// Path of the file with the rules, relative to the root of the
+	// repository.
+	Path string
+
+	// Directory to keep the clone of the repository in. The clone is used
+	// on startup if it exists. Defaults to a temporary directory.
+	CacheDir string
+
+	// Don't fail when trying to load the list
+	AllowFailure bool
+}
+
+var _ BlocklistLoader = &GitLoader{}
+
+const gitTimeout = 10 * time.Minute
+
+// NewGitLoader returns a loader for rules in the repository at url, which can
+// be any URL supported by git, like "https://github.com/org/rules.git".
+func NewGitLoader(url string, opt GitLoaderOptions) (*GitLoader, error) {
+	if opt.Path == "" {
+		return nil, fmt.Errorf("no path to the rules in git repository %s", url)
+	}
+	if !filepath.IsLocal(opt.Path) {
+		return nil, fmt.Errorf("path %q is outside of git repository %s", opt.Path, url)
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git repository %s: %w", url, err)
+	}
+	l := &GitLoader{
+		url:         url,
+		opt:         opt,
+		fromDisk:    opt.CacheDir != "",
+		commitGauge: getGaugeMap("gitloader", url+"#"+opt.Path, "commit", "commit"),
+	}
+	if opt.CacheDir != "" {
+		// Every list gets its own clone, lists are loaded concurrently
+		name := fmt.Sprintf("%x", sha256.Sum256([]byte(url+"#"+opt.Branch+"#"+opt.Path)))
+		l.dir = filepath.Join(opt.CacheDir, name)
+	}
+	return l, nil
+}
+
+func (l *GitLoader) Load() (rules []string, err error) {
+	log := Log.With("url", l.url, "branch", l.opt.Branch, "path", l.opt.Path)
+	log.Debug("loading blocklist")
+
+	// If AllowFailure is enabled, return the last successfully loaded list
+	// and nil
+	defer func() {
+		if err != nil && l.opt.AllowFailure {
+			log.Warn("failed to load blocklist, continuing with previous ruleset",
+				"error", err)
+			rules = l.lastSuccess
+			err = nil
+		} else {
+			l.lastSuccess = rules
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	// If a cache-dir was given, try to use the existing clone on first load
+	if l.fromDisk {
+		l.fromDisk = false
+		if l.cloned() {
+			rules, commit, err := l.read(ctx)
+			if err == nil {
+				log.Debug("loaded blocklist from existing clone", "commit", commit)
+				return rules, nil
+			}
+			log.Warn("unable to use existing clone, loading from upstream", "error", err)
+		}
+	}
+
+	start := time.Now()
+	if err := l.update(ctx); err != nil {
+		return nil, err
+	}
+	previous := l.Commit()
+	rules, commit, err := l.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if previous != commit {
+		log.Info("loaded blocklist from git", "commit", commit, "previous", previous)
+	}
+	log.With("load-time", time.Since(start)).Debug("completed loading blocklist", "commit", commit)
+	return rules, nil
+}
+
+// Commit returns the hash of the commit the rules were last loaded from.
+// Empty if they haven't been loaded yet.
+func (l *GitLoader) Commit() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.commit
+}
+
+func (l *GitLoader) setCommit(commit string) {
+	l.mu.Lock()
+	previous := l.commit
+	l.commit = commit
+	l.mu.Unlock()
+	if previous != "" && previous != commit {
+		l.commitGauge.Set(previous, 0)
+	}
+	l.commitGauge.Set(commit, 1)
+}
+
+// Updates the clone to the latest commit of the branch, or clones the
+// repository if there's no clone yet.
+func (l *GitLoader) update(ctx context.Context) error {
+	if l.dir == "" {
+		dir, err := os.MkdirTemp("", "routedns-git")
+		if err != nil {
+			return err
+		}
+		l.dir = dir
+	}
+	if l.cloned() {
+		ref := "HEAD"
+		if l.opt.Branch != "" {
+			ref = l.opt.Branch
+		}
+		if _, err := l.git(ctx, "fetch", "--quiet", "--depth", "1", "origin", ref); err != nil {
+			return err
+		}
+		_, err := l.git(ctx, "reset", "--quiet", "--hard", "FETCH_HEAD")
+		return err
+	}
+
+	// Not a clone, or a broken one, start over
+	if err := os.RemoveAll(l.dir); err != nil {
+		return err
+	}
+	args := []string{"clone", "--quiet", "--depth", "1", "--single-branch"}
+	if l.opt.Branch != "" {
+		args = append(args, "--branch", l.opt.Branch)
+	}
+	args = append(args, "--", l.url, l.dir)
+	_, err := runGit(ctx, "", args...)
+	return err
+}
+
+// Returns true if the directory holds a clone. The directory could be in
+// another repository, so git itself can't be asked.
+func (l *GitLoader) cloned() bool {
+	_, err := os.Stat(filepath.Join(l.dir, ".git"))
+	return err == nil
+}
+
+// Reads the rules and the commit they're from in the clone.
+func (l *GitLoader) read(ctx context.Context) ([]string, string, error) {
+	commit, err := l.git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	rules, err := l.readRules()
+	if err != nil {
+		return nil, "", err
+	}
+	l.setCommit(commit)
+	return rules, commit, nil
+}
+
+// Reads the rules from the file in the clone.
+func (l *GitLoader) readRules() ([]string, error) {
+	f, err := os.Open(filepath.Join(l.dir, l.opt.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rules = append(rules, scanner.Text())
+	}
+	return rules, scanner.Err()
+}
+
+// Runs a git command in the clone.
+func (l *GitLoader) git(ctx context.Context, args ...string) (string, error) {
+	return runGit(ctx, l.dir, args...)
+}
+
+// Runs a git command and returns its trimmed output. Errors include what git
+// wrote to stderr.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// Fail rather than wait for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", fmt.Errorf("git %s: %w", args[0], err)
+		}
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,84 @@
+package rdns
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitLoader(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	ctx := context.Background()
+
+	// Upstream repository with rules on a branch
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		out, err := runGit(ctx, repo, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		require.NoError(t, err)
+		return out
+	}
+	commit := func(rules string) string {
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, "lists"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(repo, "lists", "block.txt"), []byte(rules), 0o644))
+		git("add", "-A")
+		git("commit", "--quiet", "-m", "update")
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "--quiet", "--initial-branch", "rules")
+	first := commit("example.com\n")
+
+	cacheDir := t.TempDir()
+	opt := GitLoaderOptions{
+		Branch:   "rules",
+		Path:     "lists/block.txt",
+		CacheDir: cacheDir,
+	}
+	l, err := NewGitLoader("file://"+repo, opt)
+	require.NoError(t, err)
+
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com"}, rules)
+	require.Equal(t, first, l.Commit())
+
+	// Merged changes are picked up on refresh
+	second := commit("example.com\nexample.net\n")
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "example.net"}, rules)
+	require.Equal(t, second, l.Commit())
+	require.Equal(t, map[string]int64{first: 0, second: 1}, l.commitGauge.Values())
+
+	// A new loader starts with the existing clone in the cache-dir, even if
+	// the repository isn't available
+	require.NoError(t, os.RemoveAll(filepath.Join(repo, ".git")))
+	l, err = NewGitLoader("file://"+repo, opt)
+	require.NoError(t, err)
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "example.net"}, rules)
+	require.Equal(t, second, l.Commit())
+
+	// Fails to refresh now, unless failures are allowed
+	_, err = l.Load()
+	require.Error(t, err)
+	opt.AllowFailure = true
+	l, err = NewGitLoader("file://"+repo, opt)
+	require.NoError(t, err)
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "example.net"}, rules)
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "example.net"}, rules)
+
+	// Paths outside the repository are rejected
+	_, err = NewGitLoader("file://"+repo, GitLoaderOptions{Path: "../block.txt"})
+	require.Error(t, err)
+}
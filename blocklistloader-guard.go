@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"fmt"
+)
+
+// GuardLoader wraps a loader and rejects reloaded lists with a number of rules
+// that differs too much from the last accepted list, such as a truncated
+// download that would remove most of the rules. Rejected reloads fail, so
+// the blocklist keeps the previous rules and tries again on the next refresh.
+type GuardLoader struct {
+	id       string
+	name     string
+	loader   BlocklistLoader
+	opt      GuardLoaderOptions
+	previous int // Number of rules in the last accepted list
+	metrics  *GuardLoaderMetrics
+}
+
+// GuardLoaderOptions holds options for the guard of list reloads.
+type GuardLoaderOptions struct {
+	// Maximum change of the number of rules in percent of the last accepted
+	// list. Disabled if 0.
+	MaxChange int
+}
+
+type GuardLoaderMetrics struct {
+	// Rejected reloads, by list.
+	rejected *CounterMap
+}
+
+var _ BlocklistLoader = &GuardLoader{}
+
+// NewGuardLoader returns a loader that checks the rules loaded by another
+// loader. The id is that of the element using the list, name identifies the
+// list in logs and metrics.
+func NewGuardLoader(id, name string, loader BlocklistLoader, opt GuardLoaderOptions) *GuardLoader {
+	return &GuardLoader{
+		id:     id,
+		name:   name,
+		loader: loader,
+		opt:    opt,
+		metrics: &GuardLoaderMetrics{
+			rejected: getCounterMap("router", id, "reload-rejected", "list"),
+		},
+	}
+}
+
+func (l *GuardLoader) Load() ([]string, error) {
+	rules, err := l.loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	// The first load is always accepted, as is any list if the previous one
+	// was empty
+	if l.previous > 0 && l.opt.MaxChange > 0 {
+		diff := len(rules) - l.previous
+		if diff < 0 {
+			diff = -diff
+		}
+		change := diff * 100 / l.previous
+		if change > l.opt.MaxChange {
+			l.metrics.rejected.Add(l.name, 1)
+			return nil, fmt.Errorf("rejected reload of %s, number of rules changed by %d%% from %d to %d", l.name, change, l.previous, len(rules))
+		}
+	}
+	l.previous = len(rules)
+	return rules, nil
+}
@@ -0,0 +1,58 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Loader returning the rules it's given, changed between loads.
+type testRulesLoader struct {
+	rules []string
+}
+
+func (l *testRulesLoader) Load() ([]string, error) {
+	return l.rules, nil
+}
+
+func testRules(n int) []string {
+	rules := make([]string, n)
+	for i := range rules {
+		rules[i] = "rule"
+	}
+	return rules
+}
+
+func TestGuardLoader(t *testing.T) {
+	inner := &testRulesLoader{rules: testRules(100)}
+	l := NewGuardLoader("test-guard", "list", inner, GuardLoaderOptions{MaxChange: 20})
+	rejected := func() int64 { return l.metrics.rejected.Values()["list"] }
+
+	// The first load is accepted
+	rules, err := l.Load()
+	require.NoError(t, err)
+	require.Len(t, rules, 100)
+
+	// Changes within the limit are accepted
+	inner.rules = testRules(120)
+	_, err = l.Load()
+	require.NoError(t, err)
+	inner.rules = testRules(96)
+	_, err = l.Load()
+	require.NoError(t, err)
+
+	// A truncated list is rejected and the last accepted one is compared
+	// against on the next reload
+	inner.rules = testRules(5)
+	_, err = l.Load()
+	require.Error(t, err)
+	require.Equal(t, int64(1), rejected())
+	inner.rules = testRules(200)
+	_, err = l.Load()
+	require.Error(t, err)
+	require.Equal(t, int64(2), rejected())
+	inner.rules = testRules(90)
+	rules, err = l.Load()
+	require.NoError(t, err)
+	require.Len(t, rules, 90)
+}
@@ -2,9 +2,11 @@ package rdns
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,6 +27,11 @@ type HTTPLoaderOptions struct {
 
 	// Don't fail when trying to load the list
 	AllowFailure bool
+
+	// Checks the integrity of downloaded lists before they're used. Lists
+	// that fail verification are not used, and not written to CacheDir.
+	// Optional.
+	Verifier ListVerifier
 }
 
 var _ BlocklistLoader = &HTTPLoader{}
@@ -84,7 +91,19 @@ func (l *HTTPLoader) Load() (rules []string, err error) {
 	}
 
 	start := time.Now()
-	scanner := bufio.NewScanner(resp.Body)
+	var body io.Reader = resp.Body
+	if l.opt.Verifier != nil {
+		content, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.opt.Verifier.Verify(l.url, content); err != nil {
+			return nil, err
+		}
+		log.Debug("verified blocklist")
+		body = bytes.NewReader(content)
+	}
+	scanner := bufio.NewScanner(body)
 	for scanner.Scan() {
 		rules = append(rules, scanner.Text())
 	}
@@ -0,0 +1,215 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ListVerifier checks the integrity of a list downloaded from url before
+// it's used.
+type ListVerifier interface {
+	Verify(url string, content []byte) error
+}
+
+// SHA256Verifier checks the SHA256 checksum of a list. The checksum is either
+// pinned, or downloaded from a separate location, typically a different
+// server than the list.
+type SHA256Verifier struct {
+	// Expected checksum of the list. Used if set.
+	Sum []byte
+
+	// URL of a file with the checksum, in the format of sha256sum. If it
+	// contains more than one checksum, the one for the filename of the list
+	// is used.
+	SumURL string
+}
+
+var _ ListVerifier = &SHA256Verifier{}
+
+// Verify compares the checksum of the list to the expected one.
+func (v *SHA256Verifier) Verify(url string, content []byte) error {
+	expected := v.Sum
+	if len(expected) == 0 {
+		b, err := fetchVerificationFile(v.SumURL)
+		if err != nil {
+			return err
+		}
+		expected, err = parseChecksumFile(b, path.Base(url))
+		if err != nil {
+			return fmt.Errorf("invalid checksum file %s: %w", v.SumURL, err)
+		}
+	}
+	sum := sha256.Sum256(content)
+	if subtle.ConstantTimeCompare(sum[:], expected) != 1 {
+		return fmt.Errorf("checksum mismatch for %s, expected %x, got %x", url, expected, sum)
+	}
+	return nil
+}
+
+// Returns the checksum in a file in the format of sha256sum, which is one
+// "<checksum> <filename>" per line. The filename is optional if there's only
+// one checksum.
+func parseChecksumFile(b []byte, filename string) ([]byte, error) {
+	var sums [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		sums = append(sums, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, fields := range sums {
+		if len(sums) == 1 || (len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == filename) {
+			sum, err := hex.DecodeString(fields[0])
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid checksum '%s'", fields[0])
+			}
+			return sum, nil
+		}
+	}
+	return nil, fmt.Errorf("no checksum for %s", filename)
+}
+
+// MinisignVerifier checks the signature of a list created with minisign
+// (https://jedisct1.github.io/minisign/).
+type MinisignVerifier struct {
+	keyID     []byte
+	publicKey ed25519.PublicKey
+
+	// URL of the signature, defaults to that of the list with ".minisig"
+	// appended.
+	sigURL string
+}
+
+var _ ListVerifier = &MinisignVerifier{}
+
+// NewMinisignVerifier returns a verifier for signatures made with the key.
+// The public key is given in base64, like in the second line of a minisign
+// public key file.
+func NewMinisignVerifier(publicKey, sigURL string) (*MinisignVerifier, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+	return &MinisignVerifier{
+		keyID:     b[2:10],
+		publicKey: ed25519.PublicKey(b[10:]),
+		sigURL:    sigURL,
+	}, nil
+}
+
+// Verify downloads the signature of the list and checks it.
+func (v *MinisignVerifier) Verify(url string, content []byte) error {
+	sigURL := v.sigURL
+	if sigURL == "" {
+		sigURL = url + ".minisig"
+	}
+	b, err := fetchVerificationFile(sigURL)
+	if err != nil {
+		return err
+	}
+	if err := v.verify(content, b); err != nil {
+		return fmt.Errorf("failed to verify signature %s of %s: %w", sigURL, url, err)
+	}
+	return nil
+}
+
+// Checks content against a signature file, which has the lines
+//
+//	untrusted comment: <comment>
+//	<base64 of algorithm, key ID and signature>
+//	trusted comment: <comment>
+//	<base64 of the signature of the signature and trusted comment>
+func (v *MinisignVerifier) verify(content, sigFile []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(sigFile)), "\n")
+	if len(lines) < 4 {
+		return errors.New("invalid signature file")
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("invalid signature")
+	}
+	trustedComment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return errors.New("missing trusted comment")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return errors.New("invalid global signature")
+	}
+	if !bytes.Equal(sig[2:10], v.keyID) {
+		return fmt.Errorf("signed with key %X, expected %X", reverse(sig[2:10]), reverse(v.keyID))
+	}
+
+	// Signatures are made over the content, or its BLAKE2b hash
+	message := content
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(content)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm '%s'", sig[:2])
+	}
+	if !ed25519.Verify(v.publicKey, message, sig[10:]) {
+		return errors.New("invalid signature")
+	}
+	// The trusted comment is signed together with the signature
+	if !ed25519.Verify(v.publicKey, append(bytes.Clone(sig[10:]), trustedComment...), globalSig) {
+		return errors.New("invalid signature of trusted comment")
+	}
+	return nil
+}
+
+// Key IDs are shown in little endian by minisign.
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// Maximum size of checksum and signature files.
+const maxVerificationFileSize = 64 * 1024
+
+// Downloads a checksum or signature file.
+func fetchVerificationFile(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("got unexpected status code %d from %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxVerificationFileSize))
+}
@@ -0,0 +1,80 @@
+package rdns
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Returns a minisign public key and a signature file for the content.
+func testMinisign(t *testing.T, content []byte) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	hash := blake2b.Sum512(content)
+	sig := append([]byte("ED"), keyID...)
+	sig = append(sig, ed25519.Sign(priv, hash[:])...)
+	trustedComment := "timestamp:1700000000\tfile:list.txt\thashed"
+	globalSig := ed25519.Sign(priv, append(sig[10:], trustedComment...))
+	sigFile := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sig), trustedComment, base64.StdEncoding.EncodeToString(globalSig))
+	key := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+	return key, sigFile
+}
+
+func TestHTTPLoaderVerify(t *testing.T) {
+	list := []byte("ads.example.com\ntracker.example.com\n")
+	sum := sha256.Sum256(list)
+	key, sigFile := testMinisign(t, list)
+
+	files := map[string]string{
+		"/list.txt":         string(list),
+		"/list.txt.minisig": sigFile,
+		"/SHA256SUMS":       fmt.Sprintf("%x  other.txt\n%x  list.txt\n", sha256.Sum256(nil), sum),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	minisign, err := NewMinisignVerifier(key, "")
+	require.NoError(t, err)
+	verifiers := map[string]ListVerifier{
+		"sha256":     &SHA256Verifier{Sum: sum[:]},
+		"sha256-url": &SHA256Verifier{SumURL: srv.URL + "/SHA256SUMS"},
+		"minisign":   minisign,
+	}
+	for name, verifier := range verifiers {
+		t.Run(name, func(t *testing.T) {
+			files["/list.txt"] = string(list)
+			l := NewHTTPLoader(srv.URL+"/list.txt", HTTPLoaderOptions{Verifier: verifier})
+			rules, err := l.Load()
+			require.NoError(t, err)
+			require.Equal(t, []string{"ads.example.com", "tracker.example.com"}, rules)
+
+			// Modified lists are rejected
+			files["/list.txt"] = "ads.example.com\n"
+			_, err = l.Load()
+			require.Error(t, err)
+		})
+	}
+
+	// Signatures made with other keys are rejected
+	otherKey, _ := testMinisign(t, list)
+	minisign, err = NewMinisignVerifier(otherKey, srv.URL+"/list.txt.minisig")
+	require.NoError(t, err)
+	require.Error(t, minisign.Verify(srv.URL+"/list.txt", list))
+}
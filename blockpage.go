@@ -0,0 +1,253 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// BlockPageListener is an HTTP(S) server that explains to users why a name
+// was blocked. Blocklists configured with block page IPs answer blocked
+// A/AAAA queries with the address of this server, so a browser trying to
+// open a blocked site shows this page rather than a connection error.
+type BlockPageListener struct {
+	httpServer *http.Server
+
+	id   string
+	addr string
+	opt  BlockPageListenerOptions
+
+	metrics *BlockPageListenerMetrics
+}
+
+var _ Listener = &BlockPageListener{}
+
+// BlockPageListenerOptions contains options used by the block page server.
+type BlockPageListenerOptions struct {
+	ListenOptions
+
+	TLSConfig *tls.Config
+
+	// Serve the page over plain HTTP.
+	NoTLS bool
+
+	// URL of the unblock endpoint of an admin listener, for example
+	// https://192.168.1.1:8443/routedns/unblock. The page doesn't offer to
+	// unblock names if empty.
+	UnblockURL string
+
+	// Time a name is unblocked for. Defaults to 1 hour.
+	UnblockDuration time.Duration
+}
+
+type BlockPageListenerMetrics struct {
+	// Block pages served.
+	served *Counter
+	// Block pages served for names that aren't known to be blocked.
+	unknown *Counter
+}
+
+// Read/Write timeout of the block page server
+const blockPageTimeout = 10 * time.Second
+
+// Default time to unblock names for.
+const defaultUnblockDuration = time.Hour
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(blockPageHTML))
+
+// NewBlockPageListener returns an instance of a block page server.
+func NewBlockPageListener(id, addr string, opt BlockPageListenerOptions) *BlockPageListener {
+	if opt.UnblockDuration == 0 {
+		opt.UnblockDuration = defaultUnblockDuration
+	}
+	return &BlockPageListener{
+		id:   id,
+		addr: addr,
+		opt:  opt,
+		metrics: &BlockPageListenerMetrics{
+			served:  getCounter("listener", id, "served"),
+			unknown: getCounter("listener", id, "unknown"),
+		},
+	}
+}
+
+// Start the block page server.
+func (s *BlockPageListener) Start() error {
+	Log.Info("starting listener",
+		"id", s.id,
+		"protocol", "block-page",
+		"addr", s.addr)
+	s.httpServer = &http.Server{
+		Addr:         s.addr,
+		TLSConfig:    s.opt.TLSConfig,
+		Handler:      http.HandlerFunc(s.serveBlockPage),
+		ReadTimeout:  blockPageTimeout,
+		WriteTimeout: blockPageTimeout,
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if s.opt.NoTLS {
+		return s.httpServer.Serve(ln)
+	}
+	return s.httpServer.ServeTLS(ln, "", "")
+}
+
+// Stop the server.
+func (s *BlockPageListener) Stop() error {
+	Log.Info("stopping listener",
+		"id", s.id,
+		"protocol", "block-page",
+		"addr", s.addr)
+	return s.httpServer.Shutdown(context.Background())
+}
+
+func (s *BlockPageListener) String() string {
+	return s.id
+}
+
+// Data passed to the block page template.
+type blockPageData struct {
+	Name            string
+	Unicode         string // Unicode form of internationalized names
+	Blocked         blockedName
+	Known           bool
+	UnblockURL      string
+	UnblockDuration time.Duration
+	UnblockSeconds  int
+}
+
+func (s *BlockPageListener) serveBlockPage(w http.ResponseWriter, r *http.Request) {
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if action, _ := s.opt.clientAction(ParseClientIP(client), nil); action != ACLActionAllow {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.metrics.served.Add(1)
+
+	name := r.Host
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	blocked, ok := blockedNames.lookup(name)
+	if !ok {
+		s.metrics.unknown.Add(1)
+	}
+	data := blockPageData{
+		Name:            strings.TrimSuffix(name, "."),
+		Unicode:         strings.TrimSuffix(unicodeName(name), "."),
+		Blocked:         blocked,
+		Known:           ok,
+		UnblockURL:      s.opt.UnblockURL,
+		UnblockDuration: s.opt.UnblockDuration,
+		UnblockSeconds:  int(s.opt.UnblockDuration.Seconds()),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := blockPageTemplate.Execute(w, data); err != nil {
+		Log.Error("failed to render block page", "id", s.id, "error", err)
+	}
+}
+
+// Details of a blocked name shown on the block page.
+type blockedName struct {
+	Blocklist string // ID of the blocklist element
+	List      string // Name of the list containing the rule
+	Rule      string
+	Time      time.Time
+}
+
+// Time after which blocked names are forgotten.
+const blockedNameExpiry = time.Hour
+
+// Maximum number of blocked names to remember.
+const blockedNamesMax = 10000
+
+// Recently blocked names, recorded by blocklists that answer with the block
+// page IPs and shown by the block page server. The HTTP client isn't
+// necessarily the one that sent the query, for example if it goes through
+// a local forwarder, so they're only looked up by name.
+var blockedNames = &blockedNameLog{items: make(map[string]blockedName)}
+
+type blockedNameLog struct {
+	mu    sync.Mutex
+	items map[string]blockedName
+}
+
+func (l *blockedNameLog) add(name string, b blockedName) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.items) >= blockedNamesMax {
+		for k, v := range l.items {
+			if b.Time.Sub(v.Time) > blockedNameExpiry {
+				delete(l.items, k)
+			}
+		}
+		if len(l.items) >= blockedNamesMax {
+			return
+		}
+	}
+	l.items[strings.ToLower(name)] = b
+}
+
+func (l *blockedNameLog) lookup(name string) (blockedName, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.items[name]
+	if !ok || time.Since(b.Time) > blockedNameExpiry {
+		return blockedName{}, false
+	}
+	return b, true
+}
+
+const blockPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Blocked: {{if .Unicode}}{{.Unicode}} ({{.Name}}){{else}}{{.Name}}{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #333; }
+h1 { font-size: 1.5em; }
+table { border-collapse: collapse; margin: 1em 0; }
+td { padding: 0.25em 1em 0.25em 0; vertical-align: top; }
+td:first-child { color: #777; }
+code { word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>{{if .Unicode}}{{.Unicode}} ({{.Name}}){{else}}{{.Name}}{{end}} is blocked</h1>
+{{if .Known}}
+<p>Access to this site was blocked by the DNS resolver of this network.</p>
+<table>
+<tr><td>Blocklist</td><td><code>{{.Blocked.Blocklist}}</code></td></tr>
+{{if .Blocked.List}}<tr><td>List</td><td><code>{{.Blocked.List}}</code></td></tr>{{end}}
+{{if .Blocked.Rule}}<tr><td>Rule</td><td><code>{{.Blocked.Rule}}</code></td></tr>{{end}}
+<tr><td>Time</td><td>{{.Blocked.Time.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+{{if .UnblockURL}}
+<form method="POST" action="{{.UnblockURL}}">
+<input type="hidden" name="blocklist" value="{{.Blocked.Blocklist}}">
+<input type="hidden" name="name" value="{{.Name}}">
+<input type="hidden" name="duration" value="{{.UnblockSeconds}}">
+<button type="submit">Unblock for {{.UnblockDuration}}</button>
+</form>
+<p>Cached responses may delay the effect of unblocking by a few minutes.</p>
+{{end}}
+{{else}}
+<p>Access to this site was blocked by the DNS resolver of this network, or the block has expired.</p>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,157 @@
+package rdns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPage(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{"blocked.test"}))
+	require.NoError(t, err)
+	clock := NewFakeClock(time.Now())
+	b, err := NewBlocklist("test-blockpage", upstream, BlocklistOptions{
+		BlocklistDB:  db,
+		BlockPageIPs: []net.IP{net.ParseIP("192.0.2.1")},
+		Clock:        clock,
+	})
+	require.NoError(t, err)
+
+	// Blocked A queries are answered with the block page address
+	q := new(dns.Msg)
+	q.SetQuestion("blocked.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	// No IPv6 address configured, AAAA queries get NODATA
+	q.SetQuestion("blocked.test.", dns.TypeAAAA)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Other types are still blocked with NXDOMAIN
+	q.SetQuestion("blocked.test.", dns.TypeMX)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// The block page explains which rule blocked the name
+	s := NewBlockPageListener("test-blockpage", "127.0.0.1:0", BlockPageListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}},
+		UnblockURL:    "https://192.0.2.1:8443/routedns/unblock",
+	})
+	w := httptest.NewRecorder()
+	s.serveBlockPage(w, httptest.NewRequest("GET", "http://blocked.test/path", nil))
+	require.Equal(t, http.StatusForbidden, w.Code)
+	body := w.Body.String()
+	require.Contains(t, body, "blocked.test is blocked")
+	require.Contains(t, body, "test-blockpage")
+	require.Contains(t, body, "testlist")
+	require.Contains(t, body, `action="https://192.0.2.1:8443/routedns/unblock"`)
+	require.Contains(t, body, `name="duration" value="3600"`)
+
+	// Unblock the name through the admin listener
+	admin, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}},
+		Blocklists:    map[string]*Blocklist{"test-blockpage": b},
+		Unblock:       true,
+	})
+	require.NoError(t, err)
+	form := url.Values{"blocklist": {"test-blockpage"}, "name": {"blocked.test"}, "duration": {"60"}}
+	req := httptest.NewRequest("POST", "/routedns/unblock", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	admin.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	q.SetQuestion("blocked.test.", dns.TypeA)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Blocked again after the unblock expired
+	clock.Advance(time.Minute + time.Second)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	// Unknown blocklists are rejected
+	form.Set("blocklist", "unknown")
+	req = httptest.NewRequest("POST", "/routedns/unblock", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	admin.mux.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminUnblockProtection(t *testing.T) {
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{"blocked.test"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-blocklist", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+	blocklists := map[string]*Blocklist{"test-blocklist": b}
+
+	unblock := func(admin *AdminListener, name string, header map[string]string) int {
+		form := url.Values{"blocklist": {"test-blocklist"}, "name": {name}}
+		req := httptest.NewRequest("POST", "https://admin.test/routedns/unblock", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		admin.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Disabled by default
+	admin, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Blocklists: blocklists})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, unblock(admin, "blocked.test", nil))
+
+	// Can't be enabled without restricting access
+	_, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{Blocklists: blocklists, Unblock: true})
+	require.Error(t, err)
+
+	// Token required if set
+	admin, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Blocklists:   blocklists,
+		Unblock:      true,
+		UnblockToken: "secret",
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, unblock(admin, "blocked.test", nil))
+	require.Equal(t, http.StatusForbidden, unblock(admin, "blocked.test", map[string]string{"Authorization": "Bearer wrong"}))
+	require.Equal(t, http.StatusOK, unblock(admin, "blocked.test", map[string]string{"Authorization": "Bearer secret"}))
+
+	// Cross-origin posts are only accepted from the block page of the name,
+	// or trusted origins
+	admin, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		ListenOptions:  ListenOptions{AllowedNet: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}},
+		Blocklists:     blocklists,
+		Unblock:        true,
+		UnblockOrigins: []string{"https://portal.test/"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, unblock(admin, "blocked.test", map[string]string{"Origin": "https://evil.test"}))
+	require.Equal(t, http.StatusForbidden, unblock(admin, "blocked.test", map[string]string{"Origin": "null"}))
+	require.Equal(t, http.StatusForbidden, unblock(admin, "blocked.test", map[string]string{"Sec-Fetch-Site": "cross-site"}))
+	require.Equal(t, http.StatusOK, unblock(admin, "blocked.test", map[string]string{"Origin": "http://blocked.test"}))
+	require.Equal(t, http.StatusOK, unblock(admin, "blocked.test", map[string]string{"Origin": "https://portal.test"}))
+	require.Equal(t, http.StatusOK, unblock(admin, "blocked.test", map[string]string{"Origin": "https://admin.test"}))
+	require.Equal(t, http.StatusOK, unblock(admin, "blocked.test", nil))
+}
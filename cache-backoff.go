@@ -0,0 +1,111 @@
+package rdns
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheErrorBackoffOptions define how long the cache stops forwarding queries
+// for names that the upstream resolver fails to answer.
+type CacheErrorBackoffOptions struct {
+	// Time queries for a name are answered with SERVFAIL after the first
+	// failure. Doubles with every consecutive failure. Disabled if 0.
+	Initial time.Duration
+
+	// Upper limit of the backoff. Defaults to, and is capped at, 5 minutes
+	// as per RFC2308.
+	Max time.Duration
+}
+
+// Tracks failures per query name and the time until which queries for the
+// name are answered with SERVFAIL.
+type errorBackoff struct {
+	opt   CacheErrorBackoffOptions
+	clock Clock
+
+	mu    sync.Mutex
+	names map[string]*errorBackoffItem
+}
+
+type errorBackoffItem struct {
+	failures int
+	until    time.Time
+}
+
+func newErrorBackoff(opt CacheErrorBackoffOptions, clock Clock) *errorBackoff {
+	if opt.Max == 0 || opt.Max > 5*time.Minute {
+		opt.Max = 5 * time.Minute
+	}
+	return &errorBackoff{
+		opt:   opt,
+		clock: clock,
+		names: make(map[string]*errorBackoffItem),
+	}
+}
+
+// Returns true if queries for the name should not be forwarded.
+func (b *errorBackoff) active(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	item, ok := b.names[strings.ToLower(name)]
+	return ok && b.clock.Now().Before(item.until)
+}
+
+// Records a failure for a name and returns the time queries for it are
+// answered with SERVFAIL.
+func (b *errorBackoff) failed(name string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name = strings.ToLower(name)
+	now := b.clock.Now()
+	item, ok := b.names[name]
+	if !ok || b.stale(item, now) {
+		item = new(errorBackoffItem)
+		b.names[name] = item
+	}
+	// Concurrent queries that were forwarded before the backoff started
+	// count as one failure
+	if now.Before(item.until) {
+		return item.until.Sub(now)
+	}
+	item.failures++
+	backoff := b.opt.Initial
+	for i := 1; i < item.failures && backoff < b.opt.Max; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, b.opt.Max)
+	item.until = now.Add(backoff)
+	return backoff
+}
+
+// Forgets the failures of a name after it was answered successfully.
+func (b *errorBackoff) succeeded(name string) {
+	b.mu.Lock()
+	delete(b.names, strings.ToLower(name))
+	b.mu.Unlock()
+}
+
+// Removes stale names and returns the number of names in backoff.
+func (b *errorBackoff) gc() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	var active int
+	for name, item := range b.names {
+		if b.stale(item, now) {
+			delete(b.names, name)
+			continue
+		}
+		if now.Before(item.until) {
+			active++
+		}
+	}
+	return active
+}
+
+// Failures are no longer consecutive if there haven't been any for longer
+// than the maximum backoff after the last one ended.
+func (b *errorBackoff) stale(item *errorBackoffItem, now time.Time) bool {
+	return now.After(item.until.Add(b.opt.Max))
+}
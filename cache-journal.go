@@ -0,0 +1,220 @@
+package rdns
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// cacheJournal persists the changes of a memory backend in its file as they
+// happen, instead of only writing the whole cache regularly. Changes are
+// appended to the file in the background, so responses don't wait for the
+// disk. The file is regularly compacted into a snapshot of the cache, which
+// the journal then continues.
+type cacheJournal struct {
+	b        *memoryBackend
+	filename string
+	interval time.Duration
+
+	records chan journalRecord
+	// Set if changes couldn't be queued, the next compaction is moved up to
+	// bring the file in line with the cache.
+	lost atomic.Bool
+	stop chan struct{}
+	done chan struct{}
+
+	// Only used by the writer
+	file *os.File
+	w    *bufio.Writer
+}
+
+// A change of the cache in the journal. Records without operation are
+// stored responses, so a snapshot of the cache can be read as journal as
+// well.
+type journalRecord struct {
+	Op     string       `json:",omitempty"`
+	Key    *lruKey      `json:",omitempty"`
+	Answer *cacheAnswer `json:",omitempty"`
+	Zones  []string     `json:",omitempty"`
+}
+
+const (
+	journalOpEvict      = "evict"
+	journalOpFlush      = "flush"
+	journalOpFlushZones = "flush-zones"
+)
+
+const (
+	defaultJournalCompactInterval = 5 * time.Minute
+
+	// Number of changes that can wait to be written
+	journalQueueSize = 4096
+)
+
+// Starts the journal of a backend that was loaded from the file already.
+func newCacheJournal(b *memoryBackend, filename string, interval time.Duration) (*cacheJournal, error) {
+	if interval <= 0 {
+		interval = defaultJournalCompactInterval
+	}
+	j := &cacheJournal{
+		b:        b,
+		filename: filename,
+		interval: interval,
+		records:  make(chan journalRecord, journalQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	// Start with a compacted file, dropping expired and replaced records
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	go j.writer()
+	return j, nil
+}
+
+// Queues a change to be written without waiting.
+func (j *cacheJournal) add(r journalRecord) {
+	select {
+	case j.records <- r:
+	default:
+		j.lost.Store(true)
+	}
+}
+
+// Stops the writer and compacts the file. Changes still queued are part of
+// the final snapshot.
+func (j *cacheJournal) close() error {
+	close(j.stop)
+	<-j.done
+	err := j.compact()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Writes queued changes to the file and compacts it regularly, until the
+// journal is closed.
+func (j *cacheJournal) writer() {
+	defer close(j.done)
+	compact := time.NewTicker(j.interval)
+	defer compact.Stop()
+	// Check for lost changes more often than the regular compaction
+	lost := time.NewTicker(time.Second)
+	defer lost.Stop()
+	log := Log.With("filename", j.filename)
+	for {
+		select {
+		case r := <-j.records:
+			if err := j.write(r); err != nil {
+				log.Warn("failed to write cache journal", "error", err)
+			}
+		case <-compact.C:
+			j.lost.Store(false)
+			if err := j.compact(); err != nil {
+				log.Warn("failed to compact cache file", "error", err)
+			}
+		case <-lost.C:
+			if j.lost.Swap(false) {
+				log.Warn("cache journal can't keep up, compacting early")
+				if err := j.compact(); err != nil {
+					log.Warn("failed to compact cache file", "error", err)
+				}
+			}
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Appends a change to the file. Flushes the buffer once there are no more
+// changes waiting, so little is lost when the process is killed.
+func (j *cacheJournal) write(r journalRecord) error {
+	if err := json.NewEncoder(j.w).Encode(r); err != nil {
+		return err
+	}
+	if len(j.records) == 0 {
+		return j.w.Flush()
+	}
+	return nil
+}
+
+// Replaces the file with a snapshot of the cache and continues the journal
+// after it. Changes queued but not yet written are in the snapshot already
+// and are written again after it, which leads to the same result when the
+// file is replayed.
+func (j *cacheJournal) compact() error {
+	tmp := j.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = j.b.serialize(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, j.w = f, w
+	return nil
+}
+
+// Loads the cache by replaying a snapshot or journal. Records that expired
+// in the meantime are skipped, and a truncated record at the end, left by a
+// process that was killed while writing it, is ignored.
+func (b *memoryBackend) replay(filename string) error {
+	log := Log.With("filename", filename)
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		log.Warn("failed to open cache file", "error", err)
+		return err
+	}
+	defer f.Close()
+	log.Info("reading cache file")
+
+	now := b.opt.Clock.Now()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var r journalRecord
+		if err := dec.Decode(&r); err != nil {
+			log.Warn("failed to read cache file, ignoring remainder", "error", err)
+			break
+		}
+		switch r.Op {
+		case "":
+			// Skip bad (or incompatible) records
+			if r.Key == nil || r.Key.Question.Name == "" || r.Answer == nil || now.After(r.Answer.Expiry) {
+				continue
+			}
+			b.storeKey(*r.Key, r.Answer)
+		case journalOpEvict:
+			if r.Key != nil {
+				b.evictKey(*r.Key)
+			}
+		case journalOpFlush:
+			b.reset()
+		case journalOpFlushZones:
+			b.deleteZones(r.Zones)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package rdns
 
 import (
+	"hash/maphash"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
@@ -11,15 +14,40 @@ import (
 )
 
 type memoryBackend struct {
-	lru *lruCache
+	shards []*memoryShard
+	seed   maphash.Seed
+	opt    MemoryBackendOptions
+
+	// Set once the backend is closed, stops the GC and save loops.
+	closed atomic.Bool
+
+	// Writes changes to the file as they happen, only set with
+	// MemoryBackendOptions.Journal.
+	journal *cacheJournal
+}
+
+// Part of the cache with its own lock. Queries are spread over the shards by
+// the hash of their name and type.
+type memoryShard struct {
 	mu  sync.Mutex
-	opt MemoryBackendOptions
+	lru *lruCache
 }
 
 type MemoryBackendOptions struct {
 	// Total capacity of the cache, default unlimited
 	Capacity int
 
+	// Maximum approximate memory used by cached responses in bytes, default
+	// unlimited. The least-recently used responses are removed when it's
+	// exceeded, like with the capacity.
+	MaxMemory int64
+
+	// Number of independently locked parts the cache is split into, to
+	// reduce lock contention with many concurrent queries. The capacity and
+	// memory limit are split evenly between them, so the least-recently used
+	// responses are removed per shard. Default 1.
+	Shards int
+
 	// How often to run garbage collection, default 1 minute
 	GCPeriod time.Duration
 
@@ -28,98 +56,181 @@ type MemoryBackendOptions struct {
 
 	// Write the file in an interval. Only write on shutdown if not set
 	SaveInterval time.Duration
+
+	// Append changes to the file as they happen so they aren't lost if the
+	// process is killed. The file is compacted every SaveInterval then,
+	// default 5 minutes.
+	Journal bool
+
+	// Source of time for record expiry and garbage collection. Defaults to
+	// the system clock.
+	Clock Clock
 }
 
-var _ CacheBackend = (*memoryBackend)(nil)
+var (
+	_ CacheBackend     = (*memoryBackend)(nil)
+	_ CacheZoneFlusher = (*memoryBackend)(nil)
+)
 
 func NewMemoryBackend(opt MemoryBackendOptions) *memoryBackend {
 	if opt.GCPeriod == 0 {
 		opt.GCPeriod = time.Minute
 	}
+	if opt.Shards <= 0 {
+		opt.Shards = 1
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
 	b := &memoryBackend{
-		lru: newLRUCache(opt.Capacity),
-		opt: opt,
+		shards: make([]*memoryShard, opt.Shards),
+		seed:   maphash.MakeSeed(),
+		opt:    opt,
+	}
+	// Round the limits up so the total is never below the configured one
+	capacity := (opt.Capacity + opt.Shards - 1) / opt.Shards
+	maxMemory := (opt.MaxMemory + int64(opt.Shards) - 1) / int64(opt.Shards)
+	for i := range b.shards {
+		b.shards[i] = &memoryShard{lru: newLRUCache(capacity, maxMemory)}
 	}
 	if opt.Filename != "" {
-		b.loadFromFile(opt.Filename)
+		b.replay(opt.Filename)
+	}
+	if opt.Filename != "" && opt.Journal {
+		j, err := newCacheJournal(b, opt.Filename, opt.SaveInterval)
+		if err != nil {
+			Log.Error("failed to start cache journal, writing the cache on shutdown only", "filename", opt.Filename, "error", err)
+		}
+		b.journal = j
 	}
 	go b.startGC(opt.GCPeriod)
 	go b.intervalSave()
 	return b
 }
 
-func (b *memoryBackend) Store(query *dns.Msg, item *cacheAnswer) {
-	b.mu.Lock()
-	b.lru.add(query, item)
-	b.mu.Unlock()
+// Returns the shard a query is stored in.
+func (b *memoryBackend) shard(key lruKey) *memoryShard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+	var h maphash.Hash
+	h.SetSeed(b.seed)
+	h.WriteString(key.Question.Name)
+	h.WriteByte(byte(key.Question.Qtype >> 8))
+	h.WriteByte(byte(key.Question.Qtype))
+	return b.shards[h.Sum64()%uint64(len(b.shards))]
 }
 
-func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
-	var answer *dns.Msg
-	var timestamp time.Time
-	var prefetchEligible bool
-	var expiry time.Time
-	b.mu.Lock()
-	if a := b.lru.get(q); a != nil {
-		answer = a.Msg.Copy()
-		timestamp = a.Timestamp
-		prefetchEligible = a.PrefetchEligible
-		expiry = a.Expiry
+func (b *memoryBackend) Store(query *dns.Msg, item *cacheAnswer) {
+	key := lruKeyFromQuery(query)
+	b.storeKey(key, item)
+	if b.journal != nil {
+		// Copy the response, it's encoded later while it may be in use
+		a := *item
+		a.Msg = item.Msg.Copy()
+		b.journal.add(journalRecord{Key: &key, Answer: &a})
 	}
-	b.mu.Unlock()
+}
 
-	// Return a cache-miss if there's no answer record in the map
-	if answer == nil {
-		return nil, false, false
+func (b *memoryBackend) storeKey(key lruKey, item *cacheAnswer) {
+	s := b.shard(key)
+	s.mu.Lock()
+	s.lru.addKey(key, item)
+	s.mu.Unlock()
+}
+
+func (b *memoryBackend) Lookup(q *dns.Msg) (*dns.Msg, time.Duration, bool, bool) {
+	a, ok := b.lookupAnswer(q)
+	if !ok {
+		return nil, 0, false, false
 	}
+	answer := a.Msg
+	answer.Id = q.Id
 
-	// Check if item has expired from the cache
-	if time.Now().After(expiry) {
+	// Adjust the TTL of the records by the time spent in the cache. If
+	// the record is too old, evict it and return a cache-miss.
+	now := b.opt.Clock.Now()
+	if !adjustTTL(answer, now, a.Timestamp, a.Expiry) {
 		b.Evict(q)
-		return nil, false, false
+		return nil, 0, false, false
 	}
 
-	// Make a copy of the response before returning it. Some later
-	// elements might make changes.
-	answer = answer.Copy()
-	answer.Id = q.Id
+	return answer, now.Sub(a.Timestamp), a.PrefetchEligible, true
+}
 
-	// Calculate the time the record spent in the cache. We need to
-	// subtract that from the TTL of each answer record.
-	age := uint32(time.Since(timestamp).Seconds())
-
-	// Go through all the answers, NS, and Extra and adjust the TTL (subtract the time
-	// it's spent in the cache). If the record is too old, evict it from the cache
-	// and return a cache-miss. OPT records have a TTL of 0 and are ignored.
-	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
-		for _, a := range rr {
-			if _, ok := a.(*dns.OPT); ok {
-				continue
-			}
-			h := a.Header()
-			if age >= h.Ttl {
-				b.Evict(q)
-				return nil, false, false
-			}
-			h.Ttl -= age
-		}
+// Returns a copy of the cached item for a query, without adjusting the TTL.
+func (b *memoryBackend) lookupAnswer(q *dns.Msg) (*cacheAnswer, bool) {
+	var item cacheAnswer
+	key := lruKeyFromQuery(q)
+	s := b.shard(key)
+	s.mu.Lock()
+	a := s.lru.getKey(key)
+	if a != nil {
+		// Make a copy of the response before returning it. Some later
+		// elements might make changes.
+		item = *a
+		item.Msg = a.Msg.Copy()
+	}
+	s.mu.Unlock()
+
+	// Return a cache-miss if there's no answer record in the map
+	if a == nil {
+		return nil, false
 	}
 
-	return answer, prefetchEligible, true
+	// Check if item has expired from the cache
+	if b.opt.Clock.Now().After(item.Expiry) {
+		b.Evict(q)
+		return nil, false
+	}
+	return &item, true
 }
 
 func (b *memoryBackend) Evict(queries ...*dns.Msg) {
-	b.mu.Lock()
 	for _, query := range queries {
-		b.lru.delete(query)
+		key := lruKeyFromQuery(query)
+		b.evictKey(key)
+		if b.journal != nil {
+			b.journal.add(journalRecord{Op: journalOpEvict, Key: &key})
+		}
 	}
-	b.mu.Unlock()
+}
+
+func (b *memoryBackend) evictKey(key lruKey) {
+	s := b.shard(key)
+	s.mu.Lock()
+	s.lru.deleteKey(key)
+	s.mu.Unlock()
 }
 
 func (b *memoryBackend) Flush() {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.lru.reset()
+	b.reset()
+	if b.journal != nil {
+		b.journal.add(journalRecord{Op: journalOpFlush})
+	}
+}
+
+func (b *memoryBackend) reset() {
+	for _, s := range b.shards {
+		s.mu.Lock()
+		s.lru.reset()
+		s.mu.Unlock()
+	}
+}
+
+func (b *memoryBackend) FlushZones(zones ...string) {
+	b.deleteZones(zones)
+	if b.journal != nil {
+		b.journal.add(journalRecord{Op: journalOpFlushZones, Zones: zones})
+	}
+}
+
+func (b *memoryBackend) deleteZones(zones []string) {
+	for _, s := range b.shards {
+		s.mu.Lock()
+		s.lru.deleteFunc(func(a *cacheAnswer) bool {
+			return len(a.Msg.Question) > 0 && inZones(a.Msg.Question[0].Name, zones)
+		})
+		s.mu.Unlock()
+	}
 }
 
 // Runs every period time and evicts all items from the cache that are
@@ -129,19 +240,25 @@ func (b *memoryBackend) Flush() {
 // older than max.
 func (b *memoryBackend) startGC(period time.Duration) {
 	for {
-		time.Sleep(period)
-		now := time.Now()
+		b.opt.Clock.Sleep(period)
+		if b.closed.Load() {
+			return
+		}
+		now := b.opt.Clock.Now()
 		var total, removed int
-		b.mu.Lock()
-		b.lru.deleteFunc(func(a *cacheAnswer) bool {
-			if now.After(a.Expiry) {
-				removed++
-				return true
-			}
-			return false
-		})
-		total = b.lru.size()
-		b.mu.Unlock()
+		// One shard at a time so queries for the others can be answered
+		for _, s := range b.shards {
+			s.mu.Lock()
+			s.lru.deleteFunc(func(a *cacheAnswer) bool {
+				if now.After(a.Expiry) {
+					removed++
+					return true
+				}
+				return false
+			})
+			total += s.lru.size()
+			s.mu.Unlock()
+		}
 
 		Log.Debug("cache garbage collection",
 			slog.Group("details",
@@ -153,21 +270,54 @@ func (b *memoryBackend) startGC(period time.Duration) {
 }
 
 func (b *memoryBackend) Size() int {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.lru.size()
+	var n int
+	for _, s := range b.shards {
+		s.mu.Lock()
+		n += s.lru.size()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Returns the approximate memory used by cached responses.
+func (b *memoryBackend) memoryUsage() int64 {
+	var n int64
+	for _, s := range b.shards {
+		s.mu.Lock()
+		n += s.lru.memoryUsage()
+		s.mu.Unlock()
+	}
+	return n
 }
 
 func (b *memoryBackend) Close() error {
+	if b.closed.Swap(true) {
+		return nil
+	}
+	if b.journal != nil {
+		return b.journal.close()
+	}
 	if b.opt.Filename != "" {
 		return b.writeToFile(b.opt.Filename)
 	}
 	return nil
 }
 
+// Writes the cached items of all shards, each from least to most recently
+// used.
+func (b *memoryBackend) serialize(w io.Writer) error {
+	for _, s := range b.shards {
+		s.mu.Lock()
+		err := s.lru.serialize(w)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *memoryBackend) writeToFile(filename string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
 	log := Log.With("filename", filename)
 	log.Info("writing cache file")
 	f, err := os.Create(filename)
@@ -177,38 +327,22 @@ func (b *memoryBackend) writeToFile(filename string) error {
 	}
 	defer f.Close()
 
-	if err := b.lru.serialize(f); err != nil {
+	if err := b.serialize(f); err != nil {
 		log.Warn("failed to persist cache to disk", "error", err)
 		return err
 	}
 	return nil
 }
 
-func (b *memoryBackend) loadFromFile(filename string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	log := Log.With("filename", filename)
-	log.Info("reading cache file")
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Warn("failed to open cache file", "error", err)
-		return err
-	}
-	defer f.Close()
-
-	if err := b.lru.deserialize(f); err != nil {
-		log.Warn("failed to read cache from disk", "error", err)
-		return err
-	}
-	return nil
-}
-
 func (b *memoryBackend) intervalSave() {
-	if b.opt.Filename == "" || b.opt.SaveInterval == 0 {
+	if b.opt.Filename == "" || b.opt.SaveInterval == 0 || b.journal != nil {
 		return
 	}
 	for {
-		time.Sleep(b.opt.SaveInterval)
+		b.opt.Clock.Sleep(b.opt.SaveInterval)
+		if b.closed.Load() {
+			return
+		}
 		b.writeToFile(b.opt.Filename)
 	}
 }
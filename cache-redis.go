@@ -20,11 +20,23 @@ type redisBackend struct {
 type RedisBackendOptions struct {
 	RedisOptions redis.Options
 	KeyPrefix    string
+
+	// Source of time used to age cached records. Defaults to the system
+	// clock. Expiry of keys is handled by the Redis server.
+	Clock Clock
 }
 
-var _ CacheBackend = (*redisBackend)(nil)
+var (
+	_ CacheBackend     = (*redisBackend)(nil)
+	_ CacheZoneFlusher = (*redisBackend)(nil)
+)
+var _ HAStateStore = (*redisBackend)(nil)
+
+// Key of the state handed over between instances of an active-standby pair.
+const redisHAStateKey = "routedns:ha-state"
 
 func NewRedisBackend(opt RedisBackendOptions) *redisBackend {
+	opt.Clock = clockOrDefault(opt.Clock)
 	b := &redisBackend{
 		client: redis.NewClient(&opt.RedisOptions),
 		opt:    opt,
@@ -41,54 +53,50 @@ func (b *redisBackend) Store(query *dns.Msg, item *cacheAnswer) {
 		Log.Error("failed to marshal cache record", "error", err)
 		return
 	}
-	if err := b.client.Set(ctx, key, value, time.Until(item.Expiry)).Err(); err != nil {
+	if err := b.client.Set(ctx, key, value, item.Expiry.Sub(b.opt.Clock.Now())).Err(); err != nil {
 		Log.Error("failed to write to redis", "error", err)
 	}
 }
 
-func (b *redisBackend) Lookup(q *dns.Msg) (*dns.Msg, bool, bool) {
+func (b *redisBackend) Lookup(q *dns.Msg) (*dns.Msg, time.Duration, bool, bool) {
+	a, ok := b.lookupAnswer(q)
+	if !ok {
+		return nil, 0, false, false
+	}
+
+	answer := a.Msg
+	prefetchEligible := a.PrefetchEligible
+	answer.Id = q.Id
+
+	// Adjust the TTL of the records by the time spent in the cache. If
+	// the record is too old, return a cache-miss.
+	now := b.opt.Clock.Now()
+	if !adjustTTL(answer, now, a.Timestamp, a.Expiry) {
+		return nil, 0, false, false
+	}
+
+	return answer, now.Sub(a.Timestamp), prefetchEligible, true
+}
+
+// Returns the cached item for a query, without adjusting the TTL.
+func (b *redisBackend) lookupAnswer(q *dns.Msg) (*cacheAnswer, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
 	key := b.keyFromQuery(q)
 	value, err := b.client.Get(ctx, key).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) { // Return a cache-miss if there's no such key
-			return nil, false, false
+			return nil, false
 		}
 		Log.Error("failed to read from redis", "error", err)
-		return nil, false, false
+		return nil, false
 	}
 	var a *cacheAnswer
 	if err := json.Unmarshal([]byte(value), &a); err != nil {
 		Log.Error("failed to unmarshal cache record from redis", "error", err)
-		return nil, false, false
-	}
-
-	answer := a.Msg
-	prefetchEligible := a.PrefetchEligible
-	answer.Id = q.Id
-
-	// Calculate the time the record spent in the cache. We need to
-	// subtract that from the TTL of each answer record.
-	age := uint32(time.Since(a.Timestamp).Seconds())
-
-	// Go through all the answers, NS, and Extra and adjust the TTL (subtract the time
-	// it's spent in the cache). If the record is too old, evict it from the cache
-	// and return a cache-miss. OPT records have a TTL of 0 and are ignored.
-	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
-		for _, a := range rr {
-			if _, ok := a.(*dns.OPT); ok {
-				continue
-			}
-			h := a.Header()
-			if age >= h.Ttl {
-				return nil, false, false
-			}
-			h.Ttl -= age
-		}
+		return nil, false
 	}
-
-	return answer, prefetchEligible, true
+	return a, true
 }
 
 func (b *redisBackend) Flush() {
@@ -99,6 +107,25 @@ func (b *redisBackend) Flush() {
 	}
 }
 
+func (b *redisBackend) FlushZones(zones ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	iter := b.client.Scan(ctx, 0, b.opt.KeyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		name, _, _ := strings.Cut(strings.TrimPrefix(key, b.opt.KeyPrefix), ":")
+		if !inZones(name, zones) {
+			continue
+		}
+		if err := b.client.Del(ctx, key).Err(); err != nil {
+			Log.Error("failed to delete key in redis", "error", err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		Log.Error("failed to scan keys in redis", "error", err)
+	}
+}
+
 func (b *redisBackend) Size() int {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
@@ -109,6 +136,36 @@ func (b *redisBackend) Size() int {
 	return int(size)
 }
 
+// SaveHAState stores the state of groups of an active-standby pair.
+func (b *redisBackend) SaveHAState(state map[string]int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return b.client.Set(ctx, b.opt.KeyPrefix+redisHAStateKey, value, 0).Err()
+}
+
+// LoadHAState returns the state stored by the other instance of an
+// active-standby pair, or an empty state if there is none.
+func (b *redisBackend) LoadHAState() (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	value, err := b.client.Get(ctx, b.opt.KeyPrefix+redisHAStateKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state map[string]int
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ha state: %w", err)
+	}
+	return state, nil
+}
+
 func (b *redisBackend) Close() error {
 	return b.client.Close()
 }
@@ -123,6 +180,9 @@ func (b *redisBackend) keyFromQuery(q *dns.Msg) string {
 	key.WriteByte(':')
 	key.WriteString(dns.Type(q.Question[0].Qtype).String())
 	key.WriteByte(':')
+	if q.CheckingDisabled {
+		key.WriteString("cd:")
+	}
 
 	edns0 := q.IsEdns0()
 	if edns0 != nil {
@@ -0,0 +1,145 @@
+package rdns
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tieredBackend combines two cache backends, typically a small in-memory L1
+// with a large shared L2 such as Redis. Responses are written to both tiers,
+// lookups are served from L1 first and fall back to L2. Hits in L2 are copied
+// into L1, keeping the original expiry so records don't live longer in L1
+// than they would in L2.
+type tieredBackend struct {
+	opt     TieredBackendOptions
+	metrics *TieredBackendMetrics
+}
+
+type TieredBackendOptions struct {
+	// First-level cache, checked first.
+	L1 CacheBackend
+
+	// Second-level cache, used when there's no hit in L1.
+	L2 CacheBackend
+
+	// Source of time used to age records found in L2. Defaults to the system
+	// clock.
+	Clock Clock
+}
+
+type TieredBackendMetrics struct {
+	// Cache hit count by tier.
+	hit *CounterMap
+	// Cache miss count by tier.
+	miss *CounterMap
+	// Current entry count by tier.
+	entries *GaugeMap
+}
+
+var (
+	_ CacheBackend     = (*tieredBackend)(nil)
+	_ CacheZoneFlusher = (*tieredBackend)(nil)
+)
+
+// Backends that can return cached items as they were stored, which is
+// needed to copy them into another tier without changing their expiry.
+type cacheAnswerLookup interface {
+	lookupAnswer(q *dns.Msg) (*cacheAnswer, bool)
+}
+
+// NewTieredBackend returns a cache backend with two tiers. The ID is used to
+// identify the metrics of the tiers.
+func NewTieredBackend(id string, opt TieredBackendOptions) *tieredBackend {
+	opt.Clock = clockOrDefault(opt.Clock)
+	return &tieredBackend{
+		opt: opt,
+		metrics: &TieredBackendMetrics{
+			hit:     getCounterMap("cache", id, "tier-hit", "tier"),
+			miss:    getCounterMap("cache", id, "tier-miss", "tier"),
+			entries: getGaugeMap("cache", id, "tier-entries", "tier"),
+		},
+	}
+}
+
+// Store a response in both tiers.
+func (b *tieredBackend) Store(query *dns.Msg, item *cacheAnswer) {
+	b.opt.L1.Store(query, item)
+	b.opt.L2.Store(query, item)
+}
+
+func (b *tieredBackend) Lookup(q *dns.Msg) (*dns.Msg, time.Duration, bool, bool) {
+	if answer, age, prefetchEligible, ok := b.opt.L1.Lookup(q); ok {
+		b.metrics.hit.Add("l1", 1)
+		return answer, age, prefetchEligible, true
+	}
+	b.metrics.miss.Add("l1", 1)
+
+	// Without access to the stored item, L2 hits can't be copied into L1
+	l2, ok := b.opt.L2.(cacheAnswerLookup)
+	if !ok {
+		answer, age, prefetchEligible, ok := b.opt.L2.Lookup(q)
+		if ok {
+			b.metrics.hit.Add("l2", 1)
+		} else {
+			b.metrics.miss.Add("l2", 1)
+		}
+		return answer, age, prefetchEligible, ok
+	}
+	a, ok := l2.lookupAnswer(q)
+	if !ok {
+		b.metrics.miss.Add("l2", 1)
+		return nil, 0, false, false
+	}
+	answer := a.Msg.Copy()
+	answer.Id = q.Id
+	now := b.opt.Clock.Now()
+	if !adjustTTL(answer, now, a.Timestamp, a.Expiry) {
+		b.metrics.miss.Add("l2", 1)
+		return nil, 0, false, false
+	}
+	b.metrics.hit.Add("l2", 1)
+	b.opt.L1.Store(q, a)
+	return answer, now.Sub(a.Timestamp), a.PrefetchEligible, true
+}
+
+// Returns the stored item from L1, or from L2 if it's not in L1.
+func (b *tieredBackend) lookupAnswer(q *dns.Msg) (*cacheAnswer, bool) {
+	for _, backend := range []CacheBackend{b.opt.L1, b.opt.L2} {
+		if l, ok := backend.(cacheAnswerLookup); ok {
+			if a, ok := l.lookupAnswer(q); ok {
+				return a, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Size returns the number of items in L2 which holds all cached responses.
+func (b *tieredBackend) Size() int {
+	l1, l2 := b.opt.L1.Size(), b.opt.L2.Size()
+	b.metrics.entries.Set("l1", int64(l1))
+	b.metrics.entries.Set("l2", int64(l2))
+	return l2
+}
+
+// Returns the approximate memory used by the tiers that keep responses in
+// memory.
+func (b *tieredBackend) memoryUsage() int64 {
+	return memoryUsage(b.opt.L1) + memoryUsage(b.opt.L2)
+}
+
+func (b *tieredBackend) Flush() {
+	b.opt.L1.Flush()
+	b.opt.L2.Flush()
+}
+
+func (b *tieredBackend) FlushZones(zones ...string) {
+	flushZones(b.opt.L1, zones...)
+	flushZones(b.opt.L2, zones...)
+}
+
+func (b *tieredBackend) Close() error {
+	return errors.Join(b.opt.L1.Close(), b.opt.L2.Close())
+}
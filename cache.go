@@ -2,9 +2,10 @@ package rdns
 
 import (
 	"errors"
-	"expvar"
 	"math"
 	"math/rand"
+	"net"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,15 +22,45 @@ type Cache struct {
 	resolver Resolver
 	metrics  *CacheMetrics
 	backend  CacheBackend
+	backoff  *errorBackoff
+
+	// Records that are currently prefetched
+	prefetchMu  sync.Mutex
+	prefetching map[lruKey]struct{}
+
+	// Set once the cache is closed, done is closed with it to stop the
+	// metrics updates.
+	closed atomic.Bool
+	done   chan struct{}
+
+	// Stops watching for network changes, nil if not watching.
+	stopNetworkWatch func()
+
+	// The backend was created by the cache and is closed with it.
+	ownBackend bool
 }
 
 type CacheMetrics struct {
 	// Cache hit count.
-	hit *expvar.Int
+	hit *Counter
 	// Cache miss count.
-	miss *expvar.Int
+	miss *Counter
 	// Current cache entry count.
-	entries *expvar.Int
+	entries *Gauge
+	// Queries answered with SERVFAIL because of the error backoff.
+	backoff *Counter
+	// Names currently in error backoff.
+	backoffNames *Gauge
+	// Approximate memory used by cached responses in bytes, for backends
+	// that keep them in memory.
+	memory *Gauge
+	// Prefetches by result, success, failure or discarded.
+	prefetch *CounterMap
+	// Total time of successful prefetches in milliseconds, which clients
+	// would have waited for without prefetch.
+	prefetchSaved *Counter
+	// Responses not cached because they matched a skip condition.
+	skipped *Counter
 }
 
 var _ Resolver = &Cache{}
@@ -76,13 +107,81 @@ type CacheOptions struct {
 
 	// Cache backend used to store records.
 	Backend CacheBackend
+
+	// Flush the cache when addresses or routes of the host change, for example
+	// when a VPN connection comes up. Avoids returning stale answers from
+	// split-horizon DNS.
+	FlushOnNetworkChange bool
+
+	// Only flush records in these zones on network changes. Flushes all records
+	// if empty.
+	FlushZones []string
+
+	// Source of time for cache expiry. Defaults to the system clock. Also
+	// used by the default memory backend, other backends have their own.
+	Clock Clock
+
+	// Stop forwarding queries for names that fail with an error or SERVFAIL,
+	// and answer them with SERVFAIL for an exponentially growing time instead.
+	// Protects upstream resolvers from retries for broken zones. SERVFAIL
+	// responses are not stored in the cache backend if enabled.
+	ErrorBackoff CacheErrorBackoffOptions
+
+	// Options for building cache keys from queries. By default, names are
+	// case-sensitive, the DO bit is part of the key and the CD bit is not.
+	Key CacheKeyOptions
+
+	// Responses matching any of these conditions are returned to the client
+	// but not stored in the cache, for example answers from a captive portal.
+	Skip CacheSkipOptions
+}
+
+// CacheSkipOptions define responses that are not cached.
+type CacheSkipOptions struct {
+	// Responses with any of these response codes.
+	Rcodes []int
+
+	// Responses with A or AAAA records with an address in any of these
+	// networks.
+	Networks []*net.IPNet
+
+	// Responses with any record with a TTL of 0.
+	ZeroTTL bool
+
+	// Responses that passed through any of these elements, by ID. Requires
+	// the elements to be wrapped in a StatusTracker, as is done by the config
+	// loader, which records the path of responses.
+	Resolvers []string
+}
+
+// CacheKeyOptions define how queries are mapped to cache entries. Relaxing
+// them improves the hit rate for clients that randomize the case of names or
+// send inconsistent EDNS0 options.
+type CacheKeyOptions struct {
+	// Match names case-insensitively, so queries with randomized case (DNS
+	// 0x20) share cache entries. Responses from the cache have the case of
+	// the query.
+	IgnoreCase bool
+
+	// Cache responses to queries with the CD (checking disabled) bit set
+	// separately.
+	CD bool
+
+	// Don't cache responses to queries with the DO (DNSSEC OK) bit set
+	// separately. Clients asking for DNSSEC records may receive responses
+	// without them.
+	IgnoreDO bool
+
+	// Treat queries with an ECS option with a source prefix of 0, like
+	// 0.0.0.0/0, like queries without ECS option.
+	IgnoreECSZero bool
 }
 
 type CacheBackend interface {
 	Store(query *dns.Msg, item *cacheAnswer)
 
-	// Lookup a cached response
-	Lookup(q *dns.Msg) (answer *dns.Msg, prefetchEligible bool, ok bool)
+	// Lookup a cached response, with the time it's been in the cache
+	Lookup(q *dns.Msg) (answer *dns.Msg, age time.Duration, prefetchEligible bool, ok bool)
 
 	// Return the number of items in the cache
 	Size() int
@@ -93,35 +192,93 @@ type CacheBackend interface {
 	Close() error
 }
 
+// CacheZoneFlusher is implemented by cache backends that can flush individual
+// zones. Backends without it are flushed entirely instead.
+type CacheZoneFlusher interface {
+	// Flush all records for names in the given zones, including subdomains
+	FlushZones(zones ...string)
+}
+
+// Flushes the given zones from the backend, or everything if the backend
+// doesn't support flushing individual zones.
+func flushZones(b CacheBackend, zones ...string) {
+	if f, ok := b.(CacheZoneFlusher); ok {
+		f.FlushZones(zones...)
+		return
+	}
+	b.Flush()
+}
+
 // NewCache returns a new instance of a Cache resolver.
 func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 	c := &Cache{
 		CacheOptions: opt,
 		id:           id,
 		resolver:     resolver,
+		prefetching:  make(map[lruKey]struct{}),
+		done:         make(chan struct{}),
 		metrics: &CacheMetrics{
-			hit:     getVarInt("cache", id, "hit"),
-			miss:    getVarInt("cache", id, "miss"),
-			entries: getVarInt("cache", id, "entries"),
+			hit:           getCounter("cache", id, "hit"),
+			miss:          getCounter("cache", id, "miss"),
+			entries:       getGauge("cache", id, "entries"),
+			backoff:       getCounter("cache", id, "backoff"),
+			backoffNames:  getGauge("cache", id, "backoff-names"),
+			memory:        getGauge("cache", id, "memory-bytes"),
+			prefetch:      getCounterMap("cache", id, "prefetch", "result"),
+			prefetchSaved: getCounter("cache", id, "prefetch-saved-ms"),
+			skipped:       getCounter("cache", id, "skipped"),
 		},
 	}
 	if c.NegativeTTL == 0 {
 		c.NegativeTTL = 60
 	}
+	c.Clock = clockOrDefault(opt.Clock)
 	if opt.Backend == nil {
 		opt.Backend = NewMemoryBackend(MemoryBackendOptions{
 			Capacity: opt.Capacity,
 			GCPeriod: opt.GCPeriod,
+			Clock:    c.Clock,
 		})
+		c.ownBackend = true
 	}
 	c.backend = opt.Backend
+	if opt.ErrorBackoff.Initial > 0 {
+		c.backoff = newErrorBackoff(opt.ErrorBackoff, c.Clock)
+	}
+
+	if opt.FlushOnNetworkChange {
+		stop, err := onNetworkChange(func() {
+			log := Log.With("id", id)
+			if len(opt.FlushZones) > 0 {
+				log.Info("network change detected, flushing zones", "zones", opt.FlushZones)
+				flushZones(c.backend, opt.FlushZones...)
+				return
+			}
+			log.Info("network change detected, flushing cache")
+			c.backend.Flush()
+		})
+		if err != nil {
+			Log.Error("failed to watch for network changes", "id", id, "error", err)
+		}
+		c.stopNetworkWatch = stop
+	}
 
 	// Regularly query the cache size and emit metrics
 	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Minute)
+			select {
+			case <-ticker.C:
+			case <-c.done:
+				return
+			}
 			total := c.backend.Size()
 			c.metrics.entries.Set(int64(total))
+			c.metrics.memory.Set(memoryUsage(c.backend))
+			if c.backoff != nil {
+				c.metrics.backoffNames.Set(int64(c.backoff.gc()))
+			}
 		}
 	}()
 
@@ -140,6 +297,11 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if len(q.Question) > 1 {
 		return r.resolver.Resolve(q, ci)
 	}
+	// Only standard queries are cached, NOTIFY and UPDATE messages are passed
+	// through as-is.
+	if q.Opcode != dns.OpcodeQuery {
+		return r.resolver.Resolve(q, ci)
+	}
 
 	log := logger(r.id, q, ci)
 
@@ -152,40 +314,22 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Returned an answer from the cache if one exists
-	a, prefetchEligible, ok := r.answerFromCache(q)
+	lookupStart := time.Now()
+	a, age, prefetchEligible, ok := r.answerFromCache(q)
+	recordTiming(ci, "cache", r.id, lookupStart)
+	if ok {
+		a = withQuestion(a, q)
+	}
 	if ok {
 		log.Debug("cache-hit")
 		r.metrics.hit.Add(1)
+		recordResponseAge(ci, age)
 
-		// If prefetch is enabled and the TTL has fallen below the trigger time, send
-		// a concurrent query upstream (to refresh the cached record)
+		// If prefetch is enabled and the TTL has fallen below the trigger time,
+		// refresh the record in the background while serving the cached one.
 		if prefetchEligible && r.CacheOptions.PrefetchTrigger > 0 {
 			if min, ok := minTTL(a); ok && min < r.CacheOptions.PrefetchTrigger {
-				prefetchQ := q.Copy()
-				go func() {
-					log.Debug("prefetching record")
-
-					// Send the same query upstream
-					prefetchA, err := r.resolver.Resolve(prefetchQ, ci)
-					if err != nil || prefetchA == nil {
-						return
-					}
-
-					// Don't cache truncated responses
-					if prefetchA.Truncated {
-						return
-					}
-
-					// If the prefetched record has a lower TTL than what we had already, there
-					// is no point in storing it in the cache. This can happen when the upstream
-					// resolver also uses caching.
-					if prefetchAMin, ok := minTTL(prefetchA); !ok || prefetchAMin < min {
-						return
-					}
-
-					// Put the upstream response into the cache and return it.
-					r.storeInCache(prefetchQ, prefetchA)
-				}()
+				r.prefetch(q, ci, min)
 			}
 		}
 
@@ -193,10 +337,26 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	r.metrics.miss.Add(1)
 
+	// Don't forward queries for names that failed recently
+	name := q.Question[0].Name
+	if r.backoff != nil && r.backoff.active(name) {
+		log.Debug("name in error backoff, answering with servfail")
+		r.metrics.backoff.Add(1)
+		return servfail(q), nil
+	}
+
 	log.With("resolver", r.resolver.String()).Debug("cache-miss, forwarding")
 
 	// Get a response from upstream
+	ci, path := r.trackPath(ci)
 	a, err := r.resolver.Resolve(q.Copy(), ci)
+	if r.backoff != nil && !isPolicyError(err) {
+		if err != nil || (a != nil && a.Rcode == dns.RcodeServerFailure) {
+			log.Debug("starting error backoff", "duration", r.backoff.failed(name))
+		} else if a != nil {
+			r.backoff.succeeded(name)
+		}
+	}
 	if err != nil || a == nil {
 		return nil, err
 	}
@@ -205,6 +365,11 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	if a.Truncated {
 		return a, nil
 	}
+	if r.skip(a, path) {
+		log.Debug("not caching response")
+		r.metrics.skipped.Add(1)
+		return a, nil
+	}
 
 	// Put the upstream response into the cache and return it. Need to store
 	// a copy since other elements might modify the response, like the replacer.
@@ -216,14 +381,150 @@ func (r *Cache) String() string {
 	return r.id
 }
 
-// Returns an answer from the cache with it's TTL updated or false in case of a cache-miss.
-func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
-	a, prefetchEligible, ok := r.backend.Lookup(q)
+// Close stops the background metrics updates and the network change watcher.
+// The backend is only closed if the cache created it, backends passed in the
+// options are closed by the caller.
+func (r *Cache) Close() error {
+	if r.closed.Swap(true) {
+		return nil
+	}
+	close(r.done)
+	if r.stopNetworkWatch != nil {
+		r.stopNetworkWatch()
+	}
+	if r.ownBackend {
+		return r.backend.Close()
+	}
+	return nil
+}
+
+// Sends the query upstream in the background to refresh the cached record
+// which has min seconds TTL left. Only one refresh per record is in flight at
+// any time, further hits on the record while it's refreshed are answered
+// from the cache without triggering another one.
+func (r *Cache) prefetch(q *dns.Msg, ci ClientInfo, min uint32) {
+	key := lruKeyFromQuery(r.keyQuery(q))
+	r.prefetchMu.Lock()
+	if _, ok := r.prefetching[key]; ok {
+		r.prefetchMu.Unlock()
+		return
+	}
+	r.prefetching[key] = struct{}{}
+	r.prefetchMu.Unlock()
+
+	prefetchQ := q.Copy()
+	go func() {
+		defer func() {
+			r.prefetchMu.Lock()
+			delete(r.prefetching, key)
+			r.prefetchMu.Unlock()
+		}()
+		log := logger(r.id, prefetchQ, ci)
+		log.Debug("prefetching record")
+
+		// Send the same query upstream
+		start := r.Clock.Now()
+		ci, path := r.trackPath(ci)
+		a, err := r.resolver.Resolve(prefetchQ, ci)
+		if err != nil || a == nil {
+			log.Debug("failed to prefetch record", "error", err)
+			r.metrics.prefetch.Add("failure", 1)
+			return
+		}
+
+		// Don't cache truncated responses. Also, if the prefetched record has
+		// a lower TTL than what we had already, there is no point in storing
+		// it in the cache. This can happen when the upstream resolver also
+		// uses caching.
+		if aMin, ok := minTTL(a); a.Truncated || !ok || aMin < min || r.skip(a, path) {
+			r.metrics.prefetch.Add("discarded", 1)
+			return
+		}
+
+		// Put the upstream response into the cache. The client was answered
+		// from the cache, so it didn't have to wait for it.
+		r.storeInCache(prefetchQ, a)
+		r.metrics.prefetch.Add("success", 1)
+		r.metrics.prefetchSaved.Add(r.Clock.Now().Sub(start).Milliseconds())
+	}()
+}
+
+// Adds a record of the elements a response passes through to the query if
+// the cache needs it to decide whether to store the response.
+func (r *Cache) trackPath(ci ClientInfo) (ClientInfo, *responsePath) {
+	if len(r.Skip.Resolvers) == 0 {
+		return ci, nil
+	}
+	path := new(responsePath)
+	return ci.WithValue(responsePathKey{}, path), path
+}
+
+type responseAgeKey struct{}
+
+// Adds a record of how long the response was cached to the query, for
+// listeners that tell their clients. It's zero if the response didn't come
+// from a cache.
+func trackResponseAge(ci ClientInfo) (ClientInfo, *atomic.Int64) {
+	age := new(atomic.Int64)
+	return ci.WithValue(responseAgeKey{}, age), age
+}
+
+// Records the time a response was in the cache, if an element up the pipeline
+// asked for it. With several caches in the pipeline, the first one that has
+// the response records it.
+func recordResponseAge(ci ClientInfo, age time.Duration) {
+	if a, ok := ci.Value(responseAgeKey{}).(*atomic.Int64); ok {
+		a.Store(int64(age))
+	}
+}
+
+// Returns true if a response matches one of the conditions for not caching
+// it.
+func (r *Cache) skip(a *dns.Msg, path *responsePath) bool {
+	opt := r.Skip
+	if slices.Contains(opt.Rcodes, a.Rcode) {
+		return true
+	}
+	if path != nil && path.contains(opt.Resolvers...) {
+		return true
+	}
+	if !opt.ZeroTTL && len(opt.Networks) == 0 {
+		return false
+	}
+	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range rrs {
+			if opt.ZeroTTL && rr.Header().Ttl == 0 && rr.Header().Rrtype != dns.TypeOPT {
+				return true
+			}
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			for _, n := range opt.Networks {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Returns an answer from the cache with it's TTL updated and its age, or false in
+// case of a cache-miss.
+func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, time.Duration, bool, bool) {
+	q = r.keyQuery(q)
+	a, age, prefetchEligible, ok := r.backend.Lookup(q)
 	if ok {
 		if r.ShuffleAnswerFunc != nil {
 			r.ShuffleAnswerFunc(a)
 		}
-		return a, prefetchEligible, true
+		return a, age, prefetchEligible, true
 	}
 
 	// We couldn't find it in the cache, but a parent domain may already be with NXDOMAIN.
@@ -234,20 +535,20 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
 		fragments := strings.Split(name, ".")
 		for i := 1; i < len(fragments)-1; i++ {
 			newQ.Question[0].Name = strings.Join(fragments[i:], ".")
-			if a, _, ok := r.backend.Lookup(newQ); ok {
+			if a, age, _, ok := r.backend.Lookup(newQ); ok {
 				if a.Rcode == dns.RcodeNameError {
-					return nxdomain(q), false, true
+					return nxdomain(q), age, false, true
 				}
 				break
 			}
 		}
 	}
 
-	return nil, false, false
+	return nil, 0, false, false
 }
 
 func (r *Cache) storeInCache(query, answer *dns.Msg) {
-	now := time.Now()
+	now := r.Clock.Now()
 
 	// Prepare an item for the cache, without expiry for now
 	item := &cacheAnswer{Msg: answer, Timestamp: now}
@@ -265,6 +566,10 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 			item.Expiry = now.Add(time.Duration(r.NegativeTTL) * time.Second)
 		}
 	case dns.RcodeServerFailure:
+		// Failures are handled by the backoff if it's enabled
+		if r.backoff != nil {
+			return
+		}
 		// According to RFC2308, a SERVFAIL response must not be cached for longer than 5 minutes.
 		if r.NegativeTTL < 300 {
 			item.Expiry = now.Add(time.Duration(r.NegativeTTL) * time.Second)
@@ -284,7 +589,108 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 	}
 
 	// Store it in the cache
-	r.backend.Store(query, item)
+	r.backend.Store(r.keyQuery(query), item)
+}
+
+// Returns the query the backend builds the cache key from, normalized as per
+// the key options. The query is copied if it needs to be changed.
+func (r *Cache) keyQuery(q *dns.Msg) *dns.Msg {
+	opt := r.CacheOptions.Key
+	edns0 := q.IsEdns0()
+	name := q.Question[0].Name
+	if opt.IgnoreCase {
+		name = strings.ToLower(name)
+	}
+	changeName := name != q.Question[0].Name
+	changeCD := q.CheckingDisabled && !opt.CD
+	changeDO := edns0 != nil && edns0.Do() && opt.IgnoreDO
+	changeECS := edns0 != nil && opt.IgnoreECSZero && hasECSZero(edns0)
+	if !changeName && !changeCD && !changeDO && !changeECS {
+		return q
+	}
+	q = q.Copy()
+	q.Question[0].Name = name
+	q.CheckingDisabled = q.CheckingDisabled && opt.CD
+	if edns0 = q.IsEdns0(); edns0 != nil {
+		if changeDO {
+			edns0.SetDo(false)
+		}
+		if changeECS {
+			options := edns0.Option[:0]
+			for _, o := range edns0.Option {
+				if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask == 0 {
+					continue
+				}
+				options = append(options, o)
+			}
+			edns0.Option = options
+		}
+	}
+	return q
+}
+
+// Returns true if the OPT record has an ECS option with a source prefix of 0.
+func hasECSZero(edns0 *dns.OPT) bool {
+	for _, o := range edns0.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the question of a cached answer to that of the query, which can differ
+// in case. Names of answer records that match the question are changed to
+// the case of the query as well.
+func withQuestion(a, q *dns.Msg) *dns.Msg {
+	qName := q.Question[0].Name
+	if len(a.Question) > 0 && a.Question[0].Name == qName {
+		return a
+	}
+	for _, rr := range a.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, qName) {
+			h.Name = qName
+		}
+	}
+	a.Question = []dns.Question{q.Question[0]}
+	return a
+}
+
+// Go through all the answers, NS, and Extra and adjust the TTL of a cached response.
+// The time the response spent in the cache is subtracted and TTLs are capped to the
+// time left until the cache entry expires which can be earlier than the TTLs if a
+// limit like CacheRcodeMaxTTL applied. Returns false if any of the records expired
+// at time now.
+// OPT records have a TTL of 0 and are ignored.
+func adjustTTL(answer *dns.Msg, now, timestamp, expiry time.Time) bool {
+	age := uint32(now.Sub(timestamp).Seconds())
+	var remaining uint32 = math.MaxUint32
+	if !expiry.IsZero() {
+		remaining = uint32(max(expiry.Sub(now).Seconds(), 0))
+	}
+	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, a := range rr {
+			if _, ok := a.(*dns.OPT); ok {
+				continue
+			}
+			h := a.Header()
+			if age >= h.Ttl {
+				return false
+			}
+			h.Ttl = min(h.Ttl-age, remaining)
+		}
+	}
+	return true
+}
+
+// Returns true if the name is equal to or a subdomain of any of the zones.
+func inZones(name string, zones []string) bool {
+	for _, zone := range zones {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(zone)), strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
 }
 
 // Find the lowest TTL in all resource records (except OPT).
@@ -1,7 +1,12 @@
 package rdns
 
 import (
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,8 +37,10 @@ func TestCache(t *testing.T) {
 		},
 	}
 
+	clock := NewFakeClock(time.Now())
 	opt := CacheOptions{
 		GCPeriod: time.Minute,
+		Clock:    clock,
 	}
 	c := NewCache("test-cache", r, opt)
 
@@ -44,13 +51,13 @@ func TestCache(t *testing.T) {
 	require.Equal(t, 1, r.HitCount())
 	require.Equal(t, uint32(3600), a.Answer[0].Header().Ttl)
 
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
 	// Second one should come from the cache and should have a lower TTL
 	a, err = c.Resolve(q, ci)
 	require.NoError(t, err)
 	require.Equal(t, 1, r.HitCount())
-	require.True(t, a.Answer[0].Header().Ttl < answerTTL)
+	require.Equal(t, answerTTL-1, a.Answer[0].Header().Ttl)
 
 	// Different question should go through to upstream again, low TTL
 	answerTTL = 1
@@ -60,7 +67,7 @@ func TestCache(t *testing.T) {
 	require.Equal(t, 2, r.HitCount())
 	require.Equal(t, answerTTL, a.Answer[0].Header().Ttl)
 
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
 	// TTL should have expired now, so this should be a cache-miss and be sent upstream
 	q.SetQuestion("example2.com.", dns.TypeA)
@@ -69,6 +76,208 @@ func TestCache(t *testing.T) {
 	require.Equal(t, 3, r.HitCount())
 }
 
+func TestCacheErrorBackoff(t *testing.T) {
+	var ci ClientInfo
+	failing := true
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if failing {
+				return servfail(q), nil
+			}
+			return new(dns.Msg).SetReply(q), nil
+		},
+	}
+	clock := NewFakeClock(time.Now())
+	c := NewCache("test-cache-error-backoff", r, CacheOptions{
+		Clock:        clock,
+		ErrorBackoff: CacheErrorBackoffOptions{Initial: 10 * time.Second, Max: 30 * time.Second},
+	})
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// The first failure starts the backoff for the name, other types included
+	require.Equal(t, dns.RcodeServerFailure, resolve("broken.com.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeServerFailure, resolve("BROKEN.com.", dns.TypeAAAA).Rcode)
+	require.Equal(t, 1, r.HitCount())
+
+	// Other names are still forwarded
+	resolve("example.com.", dns.TypeA)
+	require.Equal(t, 2, r.HitCount())
+
+	// The backoff doubles with consecutive failures, up to the maximum
+	for _, backoff := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		hits := r.HitCount()
+		clock.Advance(backoff - time.Second)
+		resolve("broken.com.", dns.TypeA)
+		require.Equal(t, hits, r.HitCount())
+		clock.Advance(time.Second)
+		resolve("broken.com.", dns.TypeA)
+		require.Equal(t, hits+1, r.HitCount())
+	}
+
+	// Success resets the backoff
+	failing = false
+	clock.Advance(30 * time.Second)
+	require.Equal(t, dns.RcodeSuccess, resolve("broken.com.", dns.TypeA).Rcode)
+	failing = true
+	resolve("broken.com.", dns.TypeMX)
+	clock.Advance(10 * time.Second)
+	hits := r.HitCount()
+	resolve("broken.com.", dns.TypeMX)
+	require.Equal(t, hits+1, r.HitCount())
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var ci ClientInfo
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var blocking bool
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if blocking {
+				started <- struct{}{}
+				<-release
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	clock := NewFakeClock(time.Now())
+	c := NewCache("test-cache-prefetch", r, CacheOptions{
+		Clock:            clock,
+		PrefetchTrigger:  30,
+		PrefetchEligible: 10,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	// Within the prefetch window, the cached record is served right away
+	// while a single refresh is in flight
+	blocking = true
+	clock.Advance(40 * time.Second)
+	for range 3 {
+		a, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, uint32(20), a.Answer[0].Header().Ttl)
+	}
+	<-started
+	require.Equal(t, 2, r.HitCount())
+	close(release)
+	require.Eventually(t, func() bool {
+		return c.metrics.prefetch.Get("success").Value() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The refreshed record is in the cache
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, 2, r.HitCount())
+
+	// Failed refreshes keep the cached record
+	r.SetFail(true)
+	clock.Advance(40 * time.Second)
+	a, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(20), a.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool {
+		return c.metrics.prefetch.Get("failure").Value() == 1
+	}, time.Second, 10*time.Millisecond)
+	a, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(20), a.Answer[0].Header().Ttl)
+}
+
+func TestCacheKeyOptions(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, err := dns.NewRR(q.Question[0].Name + " 3600 IN A 127.0.0.1")
+			require.NoError(t, err)
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+	query := func(name string, cd, do bool, ecs *dns.EDNS0_SUBNET) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.CheckingDisabled = cd
+		q.SetEdns0(4096, do)
+		if ecs != nil {
+			edns0 := q.IsEdns0()
+			edns0.Option = append(edns0.Option, ecs)
+		}
+		return q
+	}
+	ecsZero := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, Address: net.IPv4zero}
+
+	// By default, case and DO are part of the key, CD is not
+	c := NewCache("test-cache", r, CacheOptions{})
+	for _, q := range []*dns.Msg{
+		query("example.com.", false, false, nil),
+		query("example.com.", true, false, nil),
+		query("ExAmPlE.com.", false, false, nil),
+		query("example.com.", false, true, nil),
+		query("example.com.", false, false, ecsZero),
+	} {
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, r.HitCount())
+
+	// Relaxed keys
+	r.hitCount = 0
+	c = NewCache("test-cache", r, CacheOptions{
+		Key: CacheKeyOptions{IgnoreCase: true, IgnoreDO: true, IgnoreECSZero: true},
+	})
+	for _, q := range []*dns.Msg{
+		query("example.com.", false, false, nil),
+		query("example.com.", false, true, nil),
+		query("example.com.", false, false, ecsZero),
+	} {
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, r.HitCount())
+
+	// The response from the cache has the case of the query
+	a, err := c.Resolve(query("ExAmPlE.com.", false, false, nil), ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, "ExAmPlE.com.", a.Question[0].Name)
+	require.Equal(t, "ExAmPlE.com.", a.Answer[0].Header().Name)
+
+	// Queries with CD are cached separately if enabled
+	r.hitCount = 0
+	c = NewCache("test-cache", r, CacheOptions{Key: CacheKeyOptions{CD: true}})
+	for _, q := range []*dns.Msg{
+		query("example.com.", false, false, nil),
+		query("example.com.", true, false, nil),
+		query("example.com.", true, false, nil),
+	} {
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, r.HitCount())
+}
+
 func TestCacheNXDOMAIN(t *testing.T) {
 	var ci ClientInfo
 	q := new(dns.Msg)
@@ -212,3 +421,295 @@ func TestCacheNoTruncated(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestCacheRcodeMaxTTLLimitsResponseTTL(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+					A:   net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{
+		GCPeriod:         time.Minute,
+		CacheRcodeMaxTTL: map[int]uint32{dns.RcodeSuccess: 60},
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// The cached response should not have a TTL beyond the cache expiry
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.LessOrEqual(t, a.Answer[0].Header().Ttl, uint32(60))
+}
+
+func TestAdjustTTL(t *testing.T) {
+	now := time.Now()
+	a := new(dns.Msg)
+	a.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}},
+	}
+
+	// 10 seconds in the cache without an expiry
+	require.True(t, adjustTTL(a, now, now.Add(-10*time.Second), time.Time{}))
+	require.Equal(t, uint32(90), a.Answer[0].Header().Ttl)
+
+	// Expired
+	require.False(t, adjustTTL(a, now, now.Add(-90*time.Second), time.Time{}))
+}
+
+func TestMemoryBackendFlushZones(t *testing.T) {
+	b := NewMemoryBackend(MemoryBackendOptions{})
+	for _, name := range []string{"host.corp.example.com.", "corp.example.com.", "example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		b.Store(q, &cacheAnswer{Msg: a, Timestamp: time.Now(), Expiry: time.Now().Add(time.Minute)})
+	}
+	require.Equal(t, 3, b.Size())
+
+	// Only records in the zone should be removed
+	b.FlushZones("corp.example.com")
+	require.Equal(t, 1, b.Size())
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, _, _, ok := b.Lookup(q)
+	require.True(t, ok)
+}
+
+func TestTieredBackend(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	l1 := NewMemoryBackend(MemoryBackendOptions{Clock: clock})
+	l2 := NewMemoryBackend(MemoryBackendOptions{Clock: clock})
+	b := NewTieredBackend("test-tiered", TieredBackendOptions{L1: l1, L2: l2, Clock: clock})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}}}
+
+	// Responses are written to both tiers
+	b.Store(q, &cacheAnswer{Msg: a, Timestamp: clock.Now(), Expiry: clock.Now().Add(time.Minute)})
+	require.Equal(t, 1, l1.Size())
+	require.Equal(t, 1, l2.Size())
+
+	// Served from L2 if it's not in L1 and copied into L1 with the remaining TTL
+	l1.Flush()
+	clock.Advance(10 * time.Second)
+	answer, _, _, ok := b.Lookup(q)
+	require.True(t, ok)
+	require.Equal(t, uint32(50), answer.Answer[0].Header().Ttl)
+	require.Equal(t, int64(1), b.metrics.hit.Get("l2").Value())
+
+	answer, _, _, ok = l1.Lookup(q)
+	require.True(t, ok)
+	require.Equal(t, uint32(50), answer.Answer[0].Header().Ttl)
+
+	// The record expires in both tiers at the same time
+	clock.Advance(time.Minute)
+	_, _, _, ok = b.Lookup(q)
+	require.False(t, ok)
+	require.Equal(t, int64(2), b.metrics.miss.Get("l1").Value())
+	require.Equal(t, int64(1), b.metrics.miss.Get("l2").Value())
+}
+
+func TestMemoryBackendJournal(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	filename := filepath.Join(t.TempDir(), "cache.json")
+	opt := MemoryBackendOptions{Filename: filename, Journal: true, Clock: clock}
+	b := NewMemoryBackend(opt)
+
+	store := func(b *memoryBackend, name string, ttl time.Duration) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		b.Store(q, &cacheAnswer{Msg: a, Timestamp: clock.Now(), Expiry: clock.Now().Add(ttl)})
+		return q
+	}
+	store(b, "a.example.com.", time.Minute)
+	evicted := store(b, "b.example.com.", time.Minute)
+	store(b, "expired.example.com.", time.Second)
+	b.Evict(evicted)
+
+	// Changes are written to the journal in the background
+	require.Eventually(t, func() bool {
+		content, _ := os.ReadFile(filename)
+		return strings.Contains(string(content), `"Op":"evict"`)
+	}, time.Second, 10*time.Millisecond)
+
+	// The journal is replayed when the cache is loaded after a crash, without
+	// records that expired in the meantime
+	clock.Advance(2 * time.Second)
+	crashed := NewMemoryBackend(opt)
+	require.Equal(t, 1, crashed.Size())
+	_, _, _, ok := crashed.Lookup(evicted)
+	require.False(t, ok)
+	require.NoError(t, crashed.Close())
+	require.NoError(t, b.Close())
+
+	// Changes still in the queue on close are persisted too
+	b = NewMemoryBackend(opt)
+	store(b, "c.example.com.", time.Minute)
+	b.FlushZones("a.example.com.")
+	require.NoError(t, b.Close())
+
+	b = NewMemoryBackend(opt)
+	require.Equal(t, 1, b.Size())
+	q := new(dns.Msg)
+	q.SetQuestion("c.example.com.", dns.TypeA)
+	_, _, _, ok = b.Lookup(q)
+	require.True(t, ok)
+	require.NoError(t, b.Close())
+
+	// A file written without journal can be loaded as well
+	require.NoError(t, NewMemoryBackend(MemoryBackendOptions{Filename: filename, Clock: clock}).Close())
+	b = NewMemoryBackend(opt)
+	defer b.Close()
+	require.Equal(t, 1, b.Size())
+}
+
+func TestMemoryBackendShards(t *testing.T) {
+	b := NewMemoryBackend(MemoryBackendOptions{Capacity: 100, Shards: 4})
+	queries := make([]*dns.Msg, 400)
+	for i := range queries {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		b.Store(q, &cacheAnswer{Msg: a, Timestamp: time.Now(), Expiry: time.Now().Add(time.Minute)})
+		queries[i] = q
+	}
+
+	// Every shard is filled up to its part of the capacity
+	require.Equal(t, 100, b.Size())
+	for _, s := range b.shards {
+		require.Equal(t, 25, s.lru.size())
+	}
+
+	// The most recent responses are in the cache regardless of the shard
+	_, _, _, ok := b.Lookup(queries[399])
+	require.True(t, ok)
+	b.Evict(queries[399])
+	_, _, _, ok = b.Lookup(queries[399])
+	require.False(t, ok)
+
+	b.FlushZones("example.com.")
+	require.Equal(t, 0, b.Size())
+}
+
+// Answers queries from the cache from many goroutines at once, with one in
+// ten resulting in a new response being stored.
+func BenchmarkMemoryBackend(b *testing.B) {
+	const names = 10000
+	queries := make([]*dns.Msg, names)
+	answers := make([]*cacheAnswer, names)
+	for i := range queries {
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{192, 0, 2, byte(i)},
+		}}
+		queries[i] = q
+		answers[i] = &cacheAnswer{Msg: a, Timestamp: time.Now(), Expiry: time.Now().Add(time.Hour)}
+	}
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			backend := NewMemoryBackend(MemoryBackendOptions{Shards: shards})
+			defer backend.Close()
+			for i, q := range queries {
+				backend.Store(q, answers[i])
+			}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(next.Add(1)) % names
+					if i%10 == 0 {
+						backend.Store(queries[i], answers[i])
+						continue
+					}
+					backend.Lookup(queries[i])
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+		})
+	}
+}
+
+func TestCacheSkip(t *testing.T) {
+	var ci ClientInfo
+	portal, err := NewStaticResolver("test-cache-skip-portal", StaticResolverOptions{
+		Answer: []string{"portal.example. 60 IN A 192.0.2.1"},
+	})
+	require.NoError(t, err)
+	tracked := NewStatusTracker(portal)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			name := q.Question[0].Name
+			switch name {
+			case "captive.example.":
+				a.Answer = []dns.RR{testRR(t, "captive.example. 60 IN A 10.1.2.3")}
+			case "zero.example.":
+				a.Answer = []dns.RR{testRR(t, "zero.example. 0 IN A 192.0.2.2")}
+			case "refused.example.":
+				a.Rcode = dns.RcodeRefused
+			case "portal.example.":
+				return tracked.Resolve(q, ci)
+			default:
+				a.Answer = []dns.RR{testRR(t, name+" 60 IN A 192.0.2.3")}
+			}
+			return a, nil
+		},
+	}
+	_, captive, _ := net.ParseCIDR("10.0.0.0/8")
+	c := NewCache("test-cache-skip", r, CacheOptions{
+		Skip: CacheSkipOptions{
+			Rcodes:    []int{dns.RcodeRefused},
+			Networks:  []*net.IPNet{captive},
+			ZeroTTL:   true,
+			Resolvers: []string{"test-cache-skip-portal"},
+		},
+	})
+
+	// Each response matching a condition is forwarded every time
+	hits := 0
+	for _, name := range []string{"captive.example.", "zero.example.", "refused.example.", "portal.example."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		for range 2 {
+			_, err := c.Resolve(q, ci)
+			require.NoError(t, err)
+			hits++
+			require.Equal(t, hits, r.HitCount(), name)
+		}
+	}
+	require.Equal(t, int64(8), c.metrics.skipped.Value())
+
+	// Other responses are cached
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.", dns.TypeA)
+	for range 2 {
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, hits+1, r.HitCount())
+}
@@ -0,0 +1,239 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CatalogZone forwards queries for the member zones of a catalog zone
+// (RFC9432) to a dedicated resolver, and all other queries to the default
+// resolver. The catalog is transferred from its primary server and reloaded
+// whenever its serial changes, so forwarders track zone membership without
+// configuration changes. The serial is checked as per the timers in the SOA
+// of the catalog, and right away when the primary sends a NOTIFY.
+type CatalogZone struct {
+	id       string
+	resolver Resolver
+	opt      CatalogZoneOptions
+	metrics  *CatalogZoneMetrics
+
+	mu      sync.RWMutex
+	members map[string]struct{}
+
+	// Keeps the catalog in sync with the primary.
+	secondary *secondaryZone
+}
+
+// CatalogZoneOptions contain settings for the catalog zone group.
+type CatalogZoneOptions struct {
+	// Name of the catalog zone.
+	Zone string
+
+	// Address of the primary server to transfer the catalog from, host:port.
+	Primary string
+
+	// Resolver for queries in member zones.
+	MemberResolver Resolver
+
+	// Time between checks for a new serial of the catalog. Defaults to the
+	// refresh and retry intervals in the SOA of the catalog.
+	Refresh time.Duration
+
+	// TSIG key name, secret (base64) and algorithm used to authenticate
+	// transfers. The algorithm defaults to hmac-sha256. Disabled if the name
+	// is empty.
+	TSIGName      string
+	TSIGSecret    string
+	TSIGAlgorithm string
+
+	// Source of time for the refresh timers. Defaults to the system clock.
+	Clock Clock
+}
+
+type CatalogZoneMetrics struct {
+	// Queries forwarded to the member resolver.
+	member *Counter
+	// Queries forwarded to the default resolver.
+	other *Counter
+	// Number of member zones.
+	zones *Gauge
+	// Transfers of the catalog.
+	transfer *Counter
+	// Failed serial checks or transfers.
+	err *Counter
+}
+
+var _ Resolver = &CatalogZone{}
+
+// Catalog zones with other schema versions must not be processed.
+const catalogZoneVersion = "2"
+
+// NewCatalogZone returns a resolver that forwards queries to member zones of
+// a catalog zone to the member resolver, and others to the resolver. The
+// catalog is transferred once before returning. If that fails, the error is
+// logged and all queries go to the resolver until a later transfer succeeds.
+func NewCatalogZone(id string, resolver Resolver, opt CatalogZoneOptions) (*CatalogZone, error) {
+	if opt.Zone == "" {
+		return nil, errors.New("no catalog zone name")
+	}
+	if opt.MemberResolver == nil {
+		return nil, errors.New("no resolver for member zones")
+	}
+	if _, _, err := net.SplitHostPort(opt.Primary); err != nil {
+		return nil, fmt.Errorf("invalid catalog primary '%s': %w", opt.Primary, err)
+	}
+	opt.Zone = dns.CanonicalName(opt.Zone)
+	if opt.TSIGName != "" {
+		opt.TSIGName = dns.CanonicalName(opt.TSIGName)
+		if opt.TSIGAlgorithm == "" {
+			opt.TSIGAlgorithm = dns.HmacSHA256
+		}
+		opt.TSIGAlgorithm = dns.Fqdn(opt.TSIGAlgorithm)
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	r := &CatalogZone{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &CatalogZoneMetrics{
+			member:   getCounter("router", id, "member"),
+			other:    getCounter("router", id, "other"),
+			zones:    getGauge("router", id, "zones"),
+			transfer: getCounter("router", id, "transfer"),
+			err:      getCounter("router", id, "error"),
+		},
+		members: make(map[string]struct{}),
+	}
+	r.secondary = newSecondaryZone(id, secondaryZoneOptions{
+		Zone:          opt.Zone,
+		Primary:       opt.Primary,
+		Refresh:       opt.Refresh,
+		TSIGName:      opt.TSIGName,
+		TSIGSecret:    opt.TSIGSecret,
+		TSIGAlgorithm: opt.TSIGAlgorithm,
+		Load:          r.load,
+		Expire:        r.expire,
+		Transfers:     r.metrics.transfer,
+		Errors:        r.metrics.err,
+		Clock:         opt.Clock,
+	})
+	r.secondary.start()
+	return r, nil
+}
+
+// Resolve a DNS query by forwarding it to the resolver for its zone.
+func (r *CatalogZone) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	if r.secondary.isNotify(q) {
+		return r.secondary.handleNotify(q, ci), nil
+	}
+	log := logger(r.id, q, ci)
+	if zone, ok := r.memberZone(q.Question[0].Name); ok {
+		log.With("zone", zone, "resolver", r.opt.MemberResolver).Debug("forwarding query for member zone")
+		r.metrics.member.Add(1)
+		return r.opt.MemberResolver.Resolve(q, ci)
+	}
+	log.With("resolver", r.resolver).Debug("forwarding query")
+	r.metrics.other.Add(1)
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *CatalogZone) String() string {
+	return r.id
+}
+
+// Returns the member zone a name is in, if any.
+func (r *CatalogZone) memberZone(name string) (string, bool) {
+	name = strings.ToLower(name)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := r.members[name[off:]]; ok {
+			return name[off:], true
+		}
+	}
+	return "", false
+}
+
+// Close stops refreshing the catalog.
+func (r *CatalogZone) Close() error {
+	r.secondary.close()
+	return nil
+}
+
+// Updates the member zones from the records of a transferred catalog.
+func (r *CatalogZone) load(records []dns.RR) (*dns.SOA, error) {
+	soa, members, err := parseCatalogZone(r.opt.Zone, records)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.members = members
+	r.mu.Unlock()
+	r.metrics.zones.Set(int64(len(members)))
+	Log.Info("loaded catalog zone", "id", r.id, "zone", r.opt.Zone, "serial", soa.Serial, "members", len(members))
+	return soa, nil
+}
+
+// Removes all member zones once the catalog expired, so all queries go to the
+// default resolver until it can be transferred again.
+func (r *CatalogZone) expire() {
+	r.mu.Lock()
+	r.members = make(map[string]struct{})
+	r.mu.Unlock()
+	r.metrics.zones.Set(0)
+}
+
+// Returns the SOA and the member zones of a catalog. Members are defined by
+// PTR records in the form "<unique-id>.zones.<catalog>", those with more than
+// one PTR record are ignored as per RFC9432.
+func parseCatalogZone(zone string, records []dns.RR) (*dns.SOA, map[string]struct{}, error) {
+	var (
+		soa     *dns.SOA
+		version string
+		ptrs    = make(map[string][]string)
+	)
+	zonesSuffix := "zones." + zone
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if name == zone {
+				soa = rr
+			}
+		case *dns.TXT:
+			if name == "version."+zone {
+				version = strings.Join(rr.Txt, "")
+			}
+		case *dns.PTR:
+			// Only PTR records directly below "zones." define members, others are
+			// properties
+			if prefix, ok := strings.CutSuffix(name, "."+zonesSuffix); ok && !strings.Contains(prefix, ".") {
+				ptrs[prefix] = append(ptrs[prefix], rr.Ptr)
+			}
+		}
+	}
+	if soa == nil {
+		return nil, nil, fmt.Errorf("no soa record in catalog zone %s", zone)
+	}
+	if version != catalogZoneVersion {
+		return nil, nil, fmt.Errorf("unsupported catalog zone version '%s' in %s", version, zone)
+	}
+	members := make(map[string]struct{})
+	for id, targets := range ptrs {
+		if len(targets) != 1 {
+			Log.Warn("ignoring catalog member with multiple ptr records", "zone", zone, "member", id)
+			continue
+		}
+		members[dns.CanonicalName(targets[0])] = struct{}{}
+	}
+	return soa, members, nil
+}
@@ -0,0 +1,269 @@
+package rdns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogZone(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		serial    uint32 = 1
+		transfers int
+		catalog   = []string{
+			"version.catalog.example. IN TXT \"2\"",
+			"a1.zones.catalog.example. IN PTR corp.example.",
+			"a2.zones.catalog.example. IN PTR Lab.Example.net.",
+			"group.a2.zones.catalog.example. IN TXT \"lab\"",
+			"a3.zones.catalog.example. IN PTR dup1.example.",
+			"a3.zones.catalog.example. IN PTR dup2.example.",
+		}
+	)
+	soa := func() dns.RR {
+		rr, _ := dns.NewRR("catalog.example. IN SOA invalid. invalid. 1 3600 600 86400 0")
+		rr.(*dns.SOA).Serial = serial
+		return rr
+	}
+
+	// Primary serving the catalog over TCP
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	srv := &dns.Server{Addr: addr, Net: "tcp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		a := new(dns.Msg)
+		a.SetReply(q)
+		switch q.Question[0].Qtype {
+		case dns.TypeSOA:
+			a.Answer = []dns.RR{soa()}
+		case dns.TypeAXFR:
+			transfers++
+			a.Answer = []dns.RR{soa()}
+			for _, s := range catalog {
+				rr, _ := dns.NewRR(s)
+				a.Answer = append(a.Answer, rr)
+			}
+			a.Answer = append(a.Answer, soa())
+		}
+		_ = w.WriteMsg(a)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ListenAndServe() }()
+	defer srv.Shutdown()
+	<-started
+
+	members := new(TestResolver)
+	other := new(TestResolver)
+	clock := NewFakeClock(time.Now())
+	r, err := NewCatalogZone("test-catalog", other, CatalogZoneOptions{
+		Zone:           "catalog.example.",
+		Primary:        addr,
+		MemberResolver: members,
+		Refresh:        time.Minute,
+		Clock:          clock,
+	})
+	require.NoError(t, err)
+
+	resolve := func(name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// Names in member zones go to the member resolver, members with multiple
+	// PTR records are ignored
+	resolve("corp.example.")
+	resolve("www.CORP.example.")
+	resolve("host.lab.example.net.")
+	require.Equal(t, 3, members.HitCount())
+	resolve("example.")
+	resolve("dup1.example.")
+	resolve("catalog.example.")
+	require.Equal(t, 3, other.HitCount())
+
+	// Transfers only happen when the serial changes
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	mu.Lock()
+	require.Equal(t, 1, transfers)
+	serial = 2
+	catalog = catalog[:2]
+	mu.Unlock()
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	mu.Lock()
+	require.Equal(t, 2, transfers)
+	mu.Unlock()
+
+	resolve("host.lab.example.net.")
+	require.Equal(t, 4, other.HitCount())
+	resolve("corp.example.")
+	require.Equal(t, 4, members.HitCount())
+}
+
+func TestParseCatalogZoneVersion(t *testing.T) {
+	var records []dns.RR
+	for _, s := range []string{
+		"catalog.example. IN SOA invalid. invalid. 1 3600 600 86400 0",
+		"version.catalog.example. IN TXT \"1\"",
+		"a1.zones.catalog.example. IN PTR corp.example.",
+	} {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		records = append(records, rr)
+	}
+	_, _, err := parseCatalogZone("catalog.example.", records)
+	require.Error(t, err)
+}
+
+// Primary serving a catalog with one member over TCP, or failing all queries
+// while it's down.
+type testCatalogPrimary struct {
+	addr string
+
+	mu        sync.Mutex
+	soa       string
+	down      bool
+	transfers int
+}
+
+func newTestCatalogPrimary(t *testing.T, soa string) *testCatalogPrimary {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	p := &testCatalogPrimary{addr: addr, soa: soa}
+	srv := &dns.Server{Addr: addr, Net: "tcp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		a := new(dns.Msg)
+		if p.down {
+			_ = w.WriteMsg(a.SetRcode(q, dns.RcodeServerFailure))
+			return
+		}
+		a.SetReply(q)
+		soa, _ := dns.NewRR(p.soa)
+		switch q.Question[0].Qtype {
+		case dns.TypeSOA:
+			a.Answer = []dns.RR{soa}
+		case dns.TypeAXFR:
+			p.transfers++
+			version, _ := dns.NewRR("version.catalog.example. IN TXT \"2\"")
+			member, _ := dns.NewRR("a1.zones.catalog.example. IN PTR corp.example.")
+			a.Answer = []dns.RR{soa, version, member, soa}
+		}
+		_ = w.WriteMsg(a)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ListenAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	<-started
+	return p
+}
+
+func (p *testCatalogPrimary) set(soa string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.soa = soa
+	p.down = down
+}
+
+func (p *testCatalogPrimary) transferCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.transfers
+}
+
+func TestCatalogZoneNotify(t *testing.T) {
+	primary := newTestCatalogPrimary(t, "catalog.example. IN SOA invalid. invalid. 1 3600 600 86400 0")
+	clock := NewFakeClock(time.Now())
+	r, err := NewCatalogZone("test-catalog-notify", new(TestResolver), CatalogZoneOptions{
+		Zone:           "catalog.example.",
+		Primary:        primary.addr,
+		MemberResolver: new(TestResolver),
+		Clock:          clock,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, 1, primary.transferCount())
+
+	notify := new(dns.Msg)
+	notify.SetNotify("Catalog.Example.")
+
+	// NOTIFY from other addresses is refused
+	a, err := r.Resolve(notify, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// NOTIFY from the primary triggers a transfer of the new serial
+	primary.set("catalog.example. IN SOA invalid. invalid. 2 3600 600 86400 0", false)
+	a, err = r.Resolve(notify, ClientInfo{SourceIP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.Authoritative)
+	require.Eventually(t, func() bool { return primary.transferCount() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func TestCatalogZoneExpire(t *testing.T) {
+	// Refresh after 60s, retry every 10s and expire after 100s
+	primary := newTestCatalogPrimary(t, "catalog.example. IN SOA invalid. invalid. 1 60 10 100 0")
+	members := new(TestResolver)
+	clock := NewFakeClock(time.Now())
+	r, err := NewCatalogZone("test-catalog-expire", new(TestResolver), CatalogZoneOptions{
+		Zone:           "catalog.example.",
+		Primary:        primary.addr,
+		MemberResolver: members,
+		Clock:          clock,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("corp.example.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, members.HitCount())
+
+	// The serial is checked at the refresh interval of the SOA
+	clock.BlockUntil(1)
+	require.Equal(t, time.Minute, r.secondary.nextCheck())
+
+	// Failed checks are retried, the catalog expires after 100s
+	primary.set("catalog.example. IN SOA invalid. invalid. 1 60 10 100 0", true)
+	clock.Advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		clock.BlockUntil(1)
+		require.Equal(t, 10*time.Second, r.secondary.nextCheck())
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, 2+i, members.HitCount())
+		clock.Advance(10 * time.Second)
+	}
+	clock.BlockUntil(1)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 5, members.HitCount())
+
+	// Transferred again once the primary is back
+	primary.set("catalog.example. IN SOA invalid. invalid. 1 60 10 100 0", false)
+	clock.Advance(10 * time.Second)
+	clock.BlockUntil(1)
+	require.Equal(t, 2, primary.transferCount())
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 6, members.HitCount())
+}
+
+func TestSerialNewer(t *testing.T) {
+	require.True(t, serialNewer(2, 1))
+	require.False(t, serialNewer(1, 1))
+	require.False(t, serialNewer(1, 2))
+	require.True(t, serialNewer(1, 0xffffffff)) // Wrapped around
+}
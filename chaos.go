@@ -0,0 +1,114 @@
+package rdns
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosMode determines how listeners handle queries in the CHAOS class, like
+// version.bind or hostname.bind, which are used to identify servers.
+type ChaosMode string
+
+const (
+	// Refuse all CHAOS class queries.
+	ChaosRefuse ChaosMode = "refuse"
+	// Answer identification queries with the version and identity of the
+	// server, refuse all other CHAOS class queries.
+	ChaosReveal ChaosMode = "reveal"
+	// Answer identification queries with "none", refuse all other CHAOS
+	// class queries.
+	ChaosObscure ChaosMode = "obscure"
+	// Pass CHAOS class queries to the resolver like all other queries.
+	ChaosForward ChaosMode = "forward"
+)
+
+// ChaosOptions contain the settings for CHAOS class queries on a listener.
+type ChaosOptions struct {
+	// How queries are handled. Defaults to ChaosRefuse.
+	Mode ChaosMode
+
+	// Identity returned for hostname.bind and id.server in ChaosReveal mode.
+	// Defaults to the hostname of the system.
+	Identity string
+}
+
+// Kinds of identification queries in the CHAOS class.
+const (
+	chaosVersion = iota
+	chaosIdentity
+)
+
+var chaosNames = map[string]int{
+	"version.bind.":   chaosVersion,
+	"version.server.": chaosVersion,
+	"hostname.bind.":  chaosIdentity,
+	"id.server.":      chaosIdentity,
+}
+
+// chaosResponder answers CHAOS class queries as configured in the listener
+// options and passes all other queries to the resolver.
+type chaosResponder struct {
+	resolver Resolver
+	opt      ChaosOptions
+}
+
+var _ Resolver = chaosResponder{}
+
+// Returns the resolver of a listener, wrapped to handle CHAOS class queries
+// unless they're forwarded.
+func (opt ListenOptions) chaos(r Resolver) Resolver {
+	if opt.Chaos.Mode == ChaosForward {
+		return r
+	}
+	return chaosResponder{resolver: r, opt: opt.Chaos}
+}
+
+func (r chaosResponder) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassCHAOS {
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	kind, ok := chaosNames[strings.ToLower(question.Name)]
+	if !ok || (r.opt.Mode != ChaosReveal && r.opt.Mode != ChaosObscure) {
+		logger(ci.Listener, q, ci).Debug("refusing chaos query")
+		return refused(q), nil
+	}
+	logger(ci.Listener, q, ci).Debug("answering chaos query")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	if question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY {
+		return a, nil
+	}
+	value := "none"
+	if r.opt.Mode == ChaosReveal {
+		switch kind {
+		case chaosVersion:
+			value = "routedns " + BuildVersion
+		case chaosIdentity:
+			value = r.identity()
+		}
+	}
+	a.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{value},
+	}}
+	return a, nil
+}
+
+func (r chaosResponder) String() string {
+	return r.resolver.String()
+}
+
+func (r chaosResponder) identity() string {
+	if r.opt.Identity != "" {
+		return r.opt.Identity
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "none"
+	}
+	return hostname
+}
@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaos(t *testing.T) {
+	ci := ClientInfo{SourceIP: net.ParseIP("127.0.0.1")}
+	query := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		q.Question[0].Qclass = dns.ClassCHAOS
+		return q
+	}
+	txt := func(a *dns.Msg) string {
+		require.Len(t, a.Answer, 1)
+		return a.Answer[0].(*dns.TXT).Txt[0]
+	}
+
+	tests := map[string]struct {
+		opt   ChaosOptions
+		q     *dns.Msg
+		rcode int
+		txt   string // Expected TXT value, no answer if empty
+	}{
+		"refused by default": {
+			q:     query("version.bind.", dns.TypeTXT),
+			rcode: dns.RcodeRefused,
+		},
+		"reveal version": {
+			opt:   ChaosOptions{Mode: ChaosReveal},
+			q:     query("version.bind.", dns.TypeTXT),
+			rcode: dns.RcodeSuccess,
+			txt:   "routedns " + BuildVersion,
+		},
+		"reveal identity": {
+			opt:   ChaosOptions{Mode: ChaosReveal, Identity: "dns1.example.com"},
+			q:     query("ID.Server.", dns.TypeTXT),
+			rcode: dns.RcodeSuccess,
+			txt:   "dns1.example.com",
+		},
+		"obscure identity": {
+			opt:   ChaosOptions{Mode: ChaosObscure, Identity: "dns1.example.com"},
+			q:     query("hostname.bind.", dns.TypeTXT),
+			rcode: dns.RcodeSuccess,
+			txt:   "none",
+		},
+		"other type": {
+			opt:   ChaosOptions{Mode: ChaosReveal},
+			q:     query("version.bind.", dns.TypeA),
+			rcode: dns.RcodeSuccess,
+		},
+		"other name": {
+			opt:   ChaosOptions{Mode: ChaosReveal},
+			q:     query("authors.bind.", dns.TypeTXT),
+			rcode: dns.RcodeRefused,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := new(TestResolver)
+			a, err := ResolveQuery(test.q, ci, ListenOptions{Chaos: test.opt}, r)
+			require.NoError(t, err)
+			require.Equal(t, test.rcode, a.Rcode)
+			require.Equal(t, 0, r.HitCount())
+			if test.txt == "" {
+				require.Empty(t, a.Answer)
+			} else {
+				require.Equal(t, test.txt, txt(a))
+			}
+		})
+	}
+
+	// Queries in other classes are passed through, as are CHAOS class queries
+	// when forwarding
+	r := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("version.bind.", dns.TypeTXT)
+	_, err := ResolveQuery(q, ci, ListenOptions{}, r)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	_, err = ResolveQuery(query("version.bind.", dns.TypeTXT), ci, ListenOptions{Chaos: ChaosOptions{Mode: ChaosForward}}, r)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
@@ -35,17 +35,17 @@ func NewCidrDB(name string, loader BlocklistLoader) (*CidrDB, error) {
 		}
 		// Append a mask suffix if there isn't one already
 		if !strings.Contains(r, "/") {
-			if strings.Contains(r, ".") { // ip4
-				r += "/32"
-			} else if strings.Contains(r, ":") { // ip6
+			if strings.Contains(r, ":") { // ip6, including IPv4-mapped
 				r += "/128"
+			} else if strings.Contains(r, ".") { // ip4
+				r += "/32"
 			}
 		}
-		ip, n, err := net.ParseCIDR(r)
+		n, err := ParseCIDR(r)
 		if err != nil {
 			return nil, err
 		}
-		if addr := ip.To4(); addr == nil {
+		if len(n.IP) == net.IPv6len {
 			db.ip6.add(n)
 		} else {
 			db.ip4.add(n)
@@ -12,6 +12,8 @@ func TestCidrDB(t *testing.T) {
 		"127.0.0.0/24",
 		"1.2.0.0/16",
 		"2a03:2880:f101:83::0/64",
+		"::ffff:10.1.0.0/112",
+		"::ffff:10.2.0.1",
 	})
 	db, err := NewCidrDB("testlist", loader)
 	require.NoError(t, err)
@@ -25,6 +27,10 @@ func TestCidrDB(t *testing.T) {
 		{ip: net.ParseIP("192.168.1.1"), match: false},
 		{ip: net.ParseIP("2a03:2880:f101:83:1:1:1:1"), match: true},
 		{ip: net.ParseIP("::1"), match: false},
+		{ip: net.ParseIP("10.1.2.3"), match: true},
+		{ip: net.ParseIP("10.2.0.1").To4(), match: true},
+		{ip: net.ParseIP("10.2.0.2"), match: false},
+		{ip: net.ParseIP("::ffff:1.2.3.4"), match: true},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,174 @@
+package rdns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CircuitBreaker passes queries to a resolver and stops doing so after it
+// failed a number of times in a row. While the breaker is open, queries fail
+// immediately with ErrCircuitOpen, or are sent to a fallback resolver, rather
+// than waiting for the upstream to time out. After a cool-down period, the
+// next query is passed to the resolver again to test it. The breaker is closed
+// if that succeeds, and opened again otherwise.
+type CircuitBreaker struct {
+	id       string
+	resolver Resolver
+	opt      CircuitBreakerOptions
+	metrics  *CircuitBreakerMetrics
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int       // Consecutive failures while closed
+	openedAt time.Time // Time the breaker was last opened
+}
+
+// CircuitBreakerOptions contain settings for the circuit breaker.
+type CircuitBreakerOptions struct {
+	// Number of consecutive failures after which the breaker opens. Default 5.
+	Threshold int
+
+	// Time the breaker stays open before the resolver is tested again.
+	// Default 30 seconds.
+	Cooldown time.Duration
+
+	// Determines if a SERVFAIL returned by the resolver is considered a
+	// failure.
+	ServfailError bool
+
+	// Resolver for queries while the breaker is open. Queries fail with
+	// ErrCircuitOpen if not set.
+	FallbackResolver Resolver
+
+	// Source of time for the cool-down. Defaults to the system clock.
+	Clock Clock
+}
+
+type CircuitBreakerMetrics struct {
+	// State of the breaker, 0 closed, 1 open, 2 half-open.
+	state *Gauge
+	// Number of times the breaker opened.
+	tripped *Counter
+	// Queries not sent to the resolver while the breaker was open.
+	rejected *Counter
+	// Queries sent to the fallback resolver.
+	fallback *Counter
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen // A query is testing the resolver
+)
+
+var _ Resolver = &CircuitBreaker{}
+
+// NewCircuitBreaker returns a new instance of a circuit breaker.
+func NewCircuitBreaker(id string, resolver Resolver, opt CircuitBreakerOptions) *CircuitBreaker {
+	if opt.Threshold <= 0 {
+		opt.Threshold = 5
+	}
+	if opt.Cooldown <= 0 {
+		opt.Cooldown = 30 * time.Second
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	return &CircuitBreaker{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &CircuitBreakerMetrics{
+			state:    getGauge("router", id, "state"),
+			tripped:  getCounter("router", id, "tripped"),
+			rejected: getCounter("router", id, "circuit-breaker-rejected"),
+			fallback: getCounter("router", id, "fallback"),
+		},
+	}
+}
+
+// Resolve a DNS query with the resolver unless the breaker is open.
+func (r *CircuitBreaker) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	allowed, probe := r.allow()
+	if !allowed {
+		r.metrics.rejected.Add(1)
+		if r.opt.FallbackResolver != nil {
+			log.Debug("circuit open, forwarding query to fallback resolver", "resolver", r.opt.FallbackResolver.String())
+			r.metrics.fallback.Add(1)
+			return r.opt.FallbackResolver.Resolve(q, ci)
+		}
+		log.Debug("circuit open, failing query")
+		return nil, fmt.Errorf("%w for '%s'", ErrCircuitOpen, r.resolver.String())
+	}
+	if probe {
+		log.Debug("testing resolver after cool-down", "resolver", r.resolver.String())
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	failed := isFailoverError(err) || (err == nil && r.opt.ServfailError && a != nil && a.Rcode == dns.RcodeServerFailure)
+	r.record(probe, failed)
+	return a, err
+}
+
+func (r *CircuitBreaker) String() string {
+	return r.id
+}
+
+// Returns true if a query can be sent to the resolver. The query tests the
+// resolver if the cool-down has passed.
+func (r *CircuitBreaker) allow() (allowed, probe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.state {
+	case circuitClosed:
+		return true, false
+	case circuitOpen:
+		if r.opt.Clock.Now().Sub(r.openedAt) < r.opt.Cooldown {
+			return false, false
+		}
+		r.setState(circuitHalfOpen)
+		return true, true
+	default: // Another query is testing the resolver
+		return false, false
+	}
+}
+
+// Records the outcome of a query.
+func (r *CircuitBreaker) record(probe, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case probe && failed:
+		r.trip()
+	case probe:
+		Log.Info("resolver recovered, closing circuit", "id", r.id, "resolver", r.resolver.String())
+		r.failures = 0
+		r.setState(circuitClosed)
+	case r.state != circuitClosed:
+		// Query was sent before the breaker opened
+	case failed:
+		r.failures++
+		if r.failures >= r.opt.Threshold {
+			r.trip()
+		}
+	default:
+		r.failures = 0
+	}
+}
+
+// Opens the breaker. Must be called with the lock held.
+func (r *CircuitBreaker) trip() {
+	Log.Warn("resolver failing, opening circuit", "id", r.id, "resolver", r.resolver.String(), "cooldown", r.opt.Cooldown)
+	r.failures = 0
+	r.openedAt = r.opt.Clock.Now()
+	r.metrics.tripped.Add(1)
+	r.setState(circuitOpen)
+}
+
+func (r *CircuitBreaker) setState(s circuitState) {
+	r.state = s
+	r.metrics.state.Set(int64(s))
+}
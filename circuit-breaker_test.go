@@ -0,0 +1,94 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	upstream := new(TestResolver)
+	r := NewCircuitBreaker("test-breaker", upstream, CircuitBreakerOptions{
+		Threshold: 3,
+		Cooldown:  10 * time.Second,
+		Clock:     clock,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Queries are passed through while the upstream works
+	_, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// Trips after 3 consecutive failures
+	upstream.SetFail(true)
+	for i := 0; i < 3; i++ {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	require.Equal(t, 4, upstream.HitCount())
+	require.Equal(t, int64(1), r.metrics.state.Value())
+
+	// Fails immediately while open
+	_, err = r.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 4, upstream.HitCount())
+
+	// A failing test after the cool-down opens the breaker again
+	clock.Advance(10 * time.Second)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, 5, upstream.HitCount())
+	_, err = r.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 5, upstream.HitCount())
+
+	// A successful test closes it
+	upstream.SetFail(false)
+	clock.Advance(10 * time.Second)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 7, upstream.HitCount())
+	require.Equal(t, int64(0), r.metrics.state.Value())
+	require.Equal(t, int64(2), r.metrics.tripped.Value())
+	require.Equal(t, int64(2), r.metrics.rejected.Value())
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return servfail(q), nil
+		},
+	}
+	fallback := new(TestResolver)
+	r := NewCircuitBreaker("test-breaker-fallback", upstream, CircuitBreakerOptions{
+		Threshold:        2,
+		ServfailError:    true,
+		FallbackResolver: fallback,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// SERVFAIL responses are failures and returned as they are
+	for i := 0; i < 2; i++ {
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	}
+
+	// Queries go to the fallback while open
+	_, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 1, fallback.HitCount())
+}
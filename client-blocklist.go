@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
@@ -16,6 +18,9 @@ type ClientBlocklist struct {
 	resolver Resolver
 	mu       sync.RWMutex
 	metrics  *BlocklistMetrics
+
+	// Set once the blocklist is closed, stops the refresh loop.
+	closed atomic.Bool
 }
 
 var _ Resolver = &ClientBlocklist{}
@@ -33,10 +38,19 @@ type ClientBlocklistOptions struct {
 	// provided. This can be used to "test" blocklists by simulating different
 	// client IPs.
 	UseECS bool
+
+	// Clients in these networks are never blocked. Matches are logged and
+	// counted, and the query is forwarded like an allowed one. The actual
+	// client IP is checked, even if UseECS is set.
+	ObserveNets []*net.IPNet
+
+	// Source of time for the refresh loop. Defaults to the system clock.
+	Clock Clock
 }
 
 // NewClientBlocklistIP returns a new instance of a client blocklist resolver.
 func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions) (*ClientBlocklist, error) {
+	opt.Clock = clockOrDefault(opt.Clock)
 	blocklist := &ClientBlocklist{
 		id:                     id,
 		resolver:               resolver,
@@ -51,9 +65,9 @@ func NewClientBlocklist(id string, resolver Resolver, opt ClientBlocklistOptions
 	return blocklist, nil
 }
 
-// Resolve a DNS query after checking the client's IP against a blocklist. Responds with
-// REFUSED if the client IP is on the blocklist, or sends the query to an alternative
-// resolver if one is configured.
+// Resolve a DNS query after checking the client's IP against a blocklist. Returns a
+// BlockedError if the client IP is on the blocklist which listeners answer with REFUSED,
+// or sends the query to an alternative resolver if one is configured.
 func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	ip := ci.SourceIP
 
@@ -78,7 +92,13 @@ func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			slog.String("rule", match.Rule),
 			slog.String("ip", ci.SourceIP.String()),
 		)
+		if inNets(r.ObserveNets, ci.SourceIP) {
+			r.metrics.observed.Add(1)
+			log.Info("client on blocklist, not blocking observe-only client")
+			return r.resolver.Resolve(q, ci)
+		}
 		r.metrics.blocked.Add(1)
+		traceBlocked(ci, r.id, match)
 		if r.BlocklistResolver != nil {
 			log.With(
 				slog.String("resolver", r.BlocklistResolver.String()),
@@ -86,7 +106,7 @@ func (r *ClientBlocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			return r.BlocklistResolver.Resolve(q, ci)
 		}
 		log.Debug("blocking client")
-		return refused(q), nil
+		return nil, &BlockedError{List: match.List, Rule: match.Rule}
 	}
 
 	r.metrics.allowed.Add(1)
@@ -97,9 +117,20 @@ func (r *ClientBlocklist) String() string {
 	return r.id
 }
 
+// Close stops refreshing the blocklist and closes its database.
+func (r *ClientBlocklist) Close() error {
+	r.closed.Store(true)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.BlocklistDB.Close()
+}
+
 func (r *ClientBlocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		r.Clock.Sleep(refresh)
+		if r.closed.Load() {
+			return
+		}
 		log := Log.With(
 			slog.String("id", r.id),
 		)
@@ -108,11 +139,14 @@ func (r *ClientBlocklist) refreshLoopBlocklist(refresh time.Duration) {
 		if err != nil {
 			log.Error("failed to load rules",
 				"error", err)
+			notifyReloadFailed(r.id, err)
+			statusReload(r.id, err)
 			continue
 		}
 		r.mu.Lock()
 		r.BlocklistDB.Close()
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		statusReload(r.id, nil)
 	}
 }
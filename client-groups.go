@@ -0,0 +1,277 @@
+package rdns
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// ClientGroups classifies clients into named groups by the name in their TLS
+// client certificate, their MAC address, or their source address. Listeners
+// attach the name of the group to queries, so routers and other elements can
+// apply policies to groups of clients without repeating their addresses.
+type ClientGroups struct {
+	opt   ClientGroupsOptions
+	names map[string]struct{}
+
+	// Group names by certificate name and by MAC address
+	certNames map[string]string
+	macs      map[string]string
+
+	// Networks of all groups, most specific first
+	networks []clientGroupNetwork
+
+	// MAC addresses of clients by IP from the lease files
+	leases atomic.Pointer[map[string]string]
+
+	// Stops watching the lease files for changes, nil without lease files
+	stopWatch func()
+}
+
+// ClientGroup defines which clients belong to a group.
+type ClientGroup struct {
+	Name string
+
+	// Source networks of the clients.
+	Networks []*net.IPNet
+
+	// MAC addresses of the clients. Looked up in the lease files by the source
+	// address of a query, or taken from the EDNS0 option 65001 if present.
+	MACs []net.HardwareAddr
+
+	// Common names of TLS client certificates of the clients.
+	CertNames []string
+}
+
+// ClientGroupsOptions contain settings for the classification of clients.
+type ClientGroupsOptions struct {
+	// DHCP lease files of dnsmasq or ISC dhcpd to look up the MAC addresses of
+	// clients. Reloaded when they change.
+	LeaseFiles []string
+}
+
+type clientGroupNetwork struct {
+	network *net.IPNet
+	group   string
+}
+
+// Metadata key of the client group of a query.
+type clientGroupKey struct{}
+
+// NewClientGroups returns a classifier for the given groups. A client that
+// matches several groups is put into the one that identifies it most
+// specifically: certificate names take precedence over MAC addresses, and
+// those over networks, with the longest matching prefix winning.
+func NewClientGroups(groups []ClientGroup, opt ClientGroupsOptions) (*ClientGroups, error) {
+	g := &ClientGroups{
+		opt:       opt,
+		names:     make(map[string]struct{}),
+		certNames: make(map[string]string),
+		macs:      make(map[string]string),
+	}
+	for _, group := range groups {
+		if group.Name == "" {
+			return nil, errors.New("client group without name")
+		}
+		g.names[group.Name] = struct{}{}
+		for _, name := range group.CertNames {
+			if other, ok := g.certNames[name]; ok && other != group.Name {
+				return nil, fmt.Errorf("certificate name '%s' is in client groups '%s' and '%s'", name, other, group.Name)
+			}
+			g.certNames[name] = group.Name
+		}
+		for _, mac := range group.MACs {
+			if other, ok := g.macs[string(mac)]; ok && other != group.Name {
+				return nil, fmt.Errorf("mac address '%s' is in client groups '%s' and '%s'", mac, other, group.Name)
+			}
+			g.macs[string(mac)] = group.Name
+		}
+		for _, n := range group.Networks {
+			g.networks = append(g.networks, clientGroupNetwork{network: n, group: group.Name})
+		}
+		if len(group.MACs) > 0 && len(opt.LeaseFiles) == 0 {
+			Log.Warn("client group has mac addresses but no lease files, only the edns0 option is used", "group", group.Name)
+		}
+	}
+	slices.SortStableFunc(g.networks, func(a, b clientGroupNetwork) int {
+		aOnes, _ := a.network.Mask.Size()
+		bOnes, _ := b.network.Mask.Size()
+		return bOnes - aOnes
+	})
+
+	if len(opt.LeaseFiles) > 0 {
+		if err := g.loadLeases(); err != nil {
+			return nil, err
+		}
+		stop, err := onFileChange(opt.LeaseFiles, g.reloadLeases)
+		if err != nil {
+			return nil, err
+		}
+		g.stopWatch = stop
+	}
+	return g, nil
+}
+
+// Close stops watching the lease files for changes.
+func (g *ClientGroups) Close() error {
+	if g.stopWatch != nil {
+		g.stopWatch()
+	}
+	return nil
+}
+
+// Classify returns the name of the group of a client, or an empty string if
+// it's not in any.
+func (g *ClientGroups) Classify(q *dns.Msg, ci ClientInfo) string {
+	if ci.TLSClientName != "" {
+		if group, ok := g.certNames[ci.TLSClientName]; ok {
+			return group
+		}
+	}
+	if len(g.macs) > 0 {
+		mac := queryMAC(q)
+		if mac == nil && ci.SourceIP != nil {
+			if leases := g.leases.Load(); leases != nil {
+				mac = []byte((*leases)[ci.SourceIP.String()])
+			}
+		}
+		if group, ok := g.macs[string(mac)]; ok {
+			return group
+		}
+	}
+	for _, n := range g.networks {
+		if n.network.Contains(ci.SourceIP) {
+			return n.group
+		}
+	}
+	return ""
+}
+
+// Has returns true if a group with the given name is defined.
+func (g *ClientGroups) Has(name string) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := g.names[name]
+	return ok
+}
+
+// ClientGroup returns the name of the client group the listener put the
+// client into, or an empty string if it's not in one.
+func (ci ClientInfo) ClientGroup() string {
+	group, _ := ci.Value(clientGroupKey{}).(string)
+	return group
+}
+
+// Reloads the lease files after they changed. The current leases are kept
+// if that fails.
+func (g *ClientGroups) reloadLeases() {
+	if err := g.loadLeases(); err != nil {
+		Log.Error("failed to reload lease files", "files", g.opt.LeaseFiles, "error", err)
+	}
+}
+
+func (g *ClientGroups) loadLeases() error {
+	leases := make(map[string]string)
+	for _, name := range g.opt.LeaseFiles {
+		if err := readLeaseFile(name, leases); err != nil {
+			return err
+		}
+	}
+	g.leases.Store(&leases)
+	return nil
+}
+
+// Reads the MAC addresses by IP from a lease file of dnsmasq or ISC dhcpd.
+// dnsmasq has one lease per line, like
+//
+//	1700000000 aa:bb:cc:dd:ee:ff 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:ff
+//
+// while dhcpd has blocks, with later ones for the same address replacing
+// earlier ones:
+//
+//	lease 192.168.1.10 {
+//	  binding state active;
+//	  hardware ethernet aa:bb:cc:dd:ee:ff;
+//	}
+func readLeaseFile(name string, leases map[string]string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		ip, state string
+		mac       net.HardwareAddr
+	)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+		case fields[0] == "lease" && len(fields) >= 2:
+			ip, state, mac = leaseIP(fields[1]), "", nil
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			state = fields[2]
+		case fields[0] == "hardware" && len(fields) == 3:
+			mac, _ = net.ParseMAC(fields[2])
+		case fields[0] == "}":
+			if ip == "" {
+				continue
+			}
+			if mac != nil && (state == "" || state == "active") {
+				leases[ip] = string(mac)
+			} else {
+				delete(leases, ip)
+			}
+			ip = ""
+		case ip == "" && len(fields) >= 3:
+			// dnsmasq lease, IPv6 leases have a DUID instead of a MAC
+			hw, err := net.ParseMAC(fields[1])
+			if addr := leaseIP(fields[2]); err == nil && len(hw) == 6 && addr != "" {
+				leases[addr] = string(hw)
+			}
+		}
+	}
+	return s.Err()
+}
+
+// Returns the IP address in the same form as the source address of queries,
+// or an empty string if it's invalid.
+func leaseIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Puts the client into its group if the listener classifies clients.
+func (opt ListenOptions) classify(q *dns.Msg, ci ClientInfo) ClientInfo {
+	if opt.ClientGroups == nil {
+		return ci
+	}
+	if group := opt.ClientGroups.Classify(q, ci); group != "" {
+		ci = ci.WithValue(clientGroupKey{}, group)
+	}
+	return ci
+}
+
+// Returns the common name of the client certificate of a TLS connection, or
+// an empty string if the client didn't present one.
+func tlsClientName(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,144 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientGroupsClassify(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	err := os.WriteFile(leaseFile, []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:01\n"), 0644)
+	require.NoError(t, err)
+
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, guests, _ := net.ParseCIDR("192.168.1.128/25")
+	kidsMAC, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	phoneMAC, _ := net.ParseMAC("aa:bb:cc:dd:ee:02")
+
+	g, err := NewClientGroups([]ClientGroup{
+		{Name: "lan", Networks: []*net.IPNet{lan}},
+		{Name: "guests", Networks: []*net.IPNet{guests}},
+		{Name: "kids", MACs: []net.HardwareAddr{kidsMAC, phoneMAC}},
+		{Name: "office", CertNames: []string{"laptop.example.com"}},
+	}, ClientGroupsOptions{LeaseFiles: []string{leaseFile}})
+	require.NoError(t, err)
+	defer g.Close()
+	require.True(t, g.Has("kids"))
+	require.False(t, g.Has("adults"))
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// MAC address in an EDNS0 option
+	qMAC := q.Copy()
+	qMAC.SetEdns0(4096, false)
+	edns0 := qMAC.IsEdns0()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_LOCAL{Code: 65001, Data: phoneMAC})
+
+	tests := []struct {
+		q     *dns.Msg
+		ci    ClientInfo
+		group string
+	}{
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.20")}, group: "lan"},
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.200")}, group: "guests"},
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("10.0.0.1")}, group: ""},
+		{q: q, ci: ClientInfo{}, group: ""},
+
+		// MAC from the lease file takes precedence over the network
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}, group: "kids"},
+		// MAC from the EDNS0 option
+		{q: qMAC, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.200")}, group: "kids"},
+		// Certificate name takes precedence over everything else
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.10"), TLSClientName: "laptop.example.com"}, group: "office"},
+		{q: q, ci: ClientInfo{SourceIP: net.ParseIP("192.168.1.20"), TLSClientName: "other.example.com"}, group: "lan"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.group, g.Classify(test.q, test.ci), "%+v", test.ci)
+	}
+
+	// The listener attaches the group to the client info
+	opt := ListenOptions{ClientGroups: g}
+	ci := opt.classify(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.200")})
+	require.Equal(t, "guests", ci.ClientGroup())
+	ci = ListenOptions{}.classify(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.200")})
+	require.Equal(t, "", ci.ClientGroup())
+}
+
+func TestClientGroupsDuplicate(t *testing.T) {
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	_, err := NewClientGroups([]ClientGroup{
+		{Name: "a", MACs: []net.HardwareAddr{mac}},
+		{Name: "b", MACs: []net.HardwareAddr{mac}},
+	}, ClientGroupsOptions{})
+	require.Error(t, err)
+
+	_, err = NewClientGroups([]ClientGroup{
+		{Name: "a", CertNames: []string{"client"}},
+		{Name: "b", CertNames: []string{"client"}},
+	}, ClientGroupsOptions{})
+	require.Error(t, err)
+}
+
+func TestReadLeaseFile(t *testing.T) {
+	dir := t.TempDir()
+	dnsmasq := filepath.Join(dir, "dnsmasq.leases")
+	err := os.WriteFile(dnsmasq, []byte(`1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:01
+1700000000 AA:BB:CC:DD:EE:02 192.168.1.11 * *
+duid 00:01:00:01:2c:4f:5a:3e:aa:bb:cc:dd:ee:ff
+1700000000 1234567 2001:db8::10 phone 00:01:00:01:2c:4f:5a:3e:aa:bb:cc:dd:ee:03
+`), 0644)
+	require.NoError(t, err)
+
+	dhcpd := filepath.Join(dir, "dhcpd.leases")
+	err = os.WriteFile(dhcpd, []byte(`# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.2.10 {
+  starts 4 2023/11/16 10:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:04;
+  client-hostname "desktop";
+}
+lease 192.168.2.11 {
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:05;
+}
+lease 192.168.2.11 {
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:05;
+}
+`), 0644)
+	require.NoError(t, err)
+
+	leases := make(map[string]string)
+	require.NoError(t, readLeaseFile(dnsmasq, leases))
+	require.NoError(t, readLeaseFile(dhcpd, leases))
+
+	mac := func(s string) string {
+		hw, err := net.ParseMAC(s)
+		require.NoError(t, err)
+		return string(hw)
+	}
+	require.Equal(t, map[string]string{
+		"192.168.1.10": mac("aa:bb:cc:dd:ee:01"),
+		"192.168.1.11": mac("aa:bb:cc:dd:ee:02"),
+		"192.168.2.10": mac("aa:bb:cc:dd:ee:04"),
+	}, leases)
+
+	require.Error(t, readLeaseFile(filepath.Join(dir, "missing"), leases))
+}
+
+func TestTLSClientName(t *testing.T) {
+	require.Equal(t, "", tlsClientName(nil))
+	require.Equal(t, "", tlsClientName(&tls.ConnectionState{}))
+	require.Equal(t, "client.example.com", tlsClientName(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "client.example.com"}}},
+	}))
+}
@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+)
+
+// NormalizeIP returns the canonical form of a client address so it can be
+// compared consistently. IPv4-mapped IPv6 addresses like ::ffff:192.0.2.1
+// are returned as 4-byte IPv4 addresses, other IPv6 addresses as 16-byte
+// addresses. Returns nil if the address is invalid.
+func NormalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// ParseClientIP parses a client address as found in remote addresses of
+// connections or in headers like X-Forwarded-For. Surrounding whitespace and
+// brackets as well as IPv6 zone IDs like in fe80::1%eth0 are removed. The
+// address is normalized with NormalizeIP. Returns nil if the address is
+// invalid.
+func ParseClientIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return NormalizeIP(net.ParseIP(s))
+}
+
+// ParseCIDR parses a network in CIDR notation, like net.ParseCIDR. Networks
+// given as IPv4-mapped IPv6 networks with a prefix of at least 96 bits, like
+// ::ffff:192.0.2.0/120, are turned into the equivalent IPv4 network so they
+// match IPv4 clients.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return normalizeNet(n), nil
+}
+
+// Turns IPv4-mapped IPv6 networks into IPv4 networks. Other networks are
+// returned unchanged.
+func normalizeNet(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if bits != 8*net.IPv6len || ones < 96 {
+		return n
+	}
+	ip4 := n.IP.To4()
+	if ip4 == nil {
+		return n
+	}
+	return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+}
+
+// Returns the normalized IP of the remote address of a connection, or nil if
+// it's of an unsupported type.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return NormalizeIP(addr.IP)
+	case *net.UDPAddr:
+		return NormalizeIP(addr.IP)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientIP(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		len int
+	}{
+		{"192.0.2.1", "192.0.2.1", net.IPv4len},
+		{"::ffff:192.0.2.1", "192.0.2.1", net.IPv4len},
+		{"[::ffff:c000:201]", "192.0.2.1", net.IPv4len},
+		{" 192.0.2.1 ", "192.0.2.1", net.IPv4len},
+		{"2001:db8::1", "2001:db8::1", net.IPv6len},
+		{"[2001:DB8:0::1]", "2001:db8::1", net.IPv6len},
+		{"fe80::1%eth0", "fe80::1", net.IPv6len},
+		{"[fe80::1%25]", "fe80::1", net.IPv6len},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ip := ParseClientIP(test.in)
+			require.Equal(t, test.out, ip.String())
+			require.Len(t, ip, test.len)
+		})
+	}
+
+	for _, in := range []string{"", "example.com", "192.0.2.1:53", "%eth0"} {
+		require.Nil(t, ParseClientIP(in), in)
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24"},
+		{"::ffff:0:0/96", "0.0.0.0/0"},
+		{"::/0", "::/0"},
+		{"2001:db8::/32", "2001:db8::/32"},
+	}
+	for _, test := range tests {
+		n, err := ParseCIDR(test.in)
+		require.NoError(t, err)
+		require.Equal(t, test.out, n.String())
+	}
+
+	_, err := ParseCIDR("192.0.2.1")
+	require.Error(t, err)
+
+	// IPv4 clients match mapped networks, mapped clients match IPv4 networks
+	n, _ := ParseCIDR("::ffff:192.0.2.0/120")
+	require.True(t, isAllowed([]*net.IPNet{n}, net.ParseIP("192.0.2.1").To4()))
+	n, _ = ParseCIDR("192.0.2.0/24")
+	require.True(t, isAllowed([]*net.IPNet{n}, net.ParseIP("::ffff:192.0.2.1")))
+	require.False(t, isAllowed([]*net.IPNet{n}, net.ParseIP("2001:db8::1")))
+}
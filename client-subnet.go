@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"hash/fnv"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Default prefix lengths used to group clients into subnets for load
+// balancing.
+const (
+	DefaultSubnetPrefix4 = 24
+	DefaultSubnetPrefix6 = 56
+)
+
+// Returns the subnet of the client that sent the query. Uses the address in
+// the ECS option if the query has one, the source IP of the client otherwise.
+// The subnet is no longer than the given prefix lengths.
+func clientSubnet(q *dns.Msg, ci ClientInfo, prefix4, prefix6 uint8) *net.IPNet {
+	ip := ci.SourceIP
+	var ecsPrefix uint8 = 128
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		for _, opt := range edns0.Option {
+			if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok && ecs.Address != nil {
+				ip = ecs.Address
+				ecsPrefix = ecs.SourceNetmask
+				break
+			}
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ones := min(prefix4, ecsPrefix)
+		mask := net.CIDRMask(int(ones), 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	if len(ip) != net.IPv6len {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	ones := min(prefix6, ecsPrefix)
+	mask := net.CIDRMask(int(ones), 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Picks the resolver for a client subnet using rendezvous hashing. Each
+// subnet is consistently sent to the same resolver, and only subnets of a
+// resolver that's no longer in the list move to other resolvers.
+func pickBySubnet(subnet *net.IPNet, resolvers []Resolver) Resolver {
+	var (
+		picked Resolver
+		best   uint64
+	)
+	for _, resolver := range resolvers {
+		h := fnv.New64a()
+		h.Write(subnet.IP)
+		h.Write(subnet.Mask)
+		h.Write([]byte(resolver.String()))
+		if sum := h.Sum64(); picked == nil || sum > best {
+			picked, best = resolver, sum
+		}
+	}
+	return picked
+}
@@ -0,0 +1,105 @@
+package rdns
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for elements with time-based logic, such as
+// cache expiry, failover reset timers and blocklist refreshes. It can be
+// replaced with a FakeClock to control time in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep blocks for at least the duration d.
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the Clock used by default. It uses the functions of the
+// time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Returns the clock, or the system clock if it's nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// FakeClock is a Clock that only moves forward when Advance is called. Calls
+// to Sleep block until the clock has been advanced far enough.
+type FakeClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	sleepers []fakeSleeper
+}
+
+type fakeSleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+var _ Clock = &FakeClock{}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock was advanced by at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.sleepers = append(c.sleepers, fakeSleeper{until: c.now.Add(d), done: done})
+	c.mu.Unlock()
+	<-done
+}
+
+// Advance moves the clock forward by d and wakes up all sleepers whose time
+// has come, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.sleepers, func(i, j int) bool {
+		return c.sleepers[i].until.Before(c.sleepers[j].until)
+	})
+	var i int
+	for ; i < len(c.sleepers) && !c.sleepers[i].until.After(c.now); i++ {
+		close(c.sleepers[i].done)
+	}
+	c.sleepers = c.sleepers[i:]
+}
+
+// BlockUntil waits until n goroutines are sleeping on the clock. Used to
+// make sure background tasks have reached the point where they wait for
+// time to pass before calling Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting := len(c.sleepers)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,36 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	require.Equal(t, start, c.Now())
+
+	done := make(chan struct{})
+	go func() {
+		c.Sleep(time.Minute)
+		close(done)
+	}()
+	c.BlockUntil(1)
+
+	// Not enough time has passed
+	c.Advance(30 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("sleep returned early")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.Advance(30 * time.Second)
+	<-done
+	require.Equal(t, start.Add(time.Minute), c.Now())
+
+	// Sleeping for no time returns right away
+	c.Sleep(0)
+}
@@ -12,11 +12,20 @@ import (
 
 type config struct {
 	Title             string
+	MaxDepth          int      `toml:"max-depth"` // Maximum number of elements a query can pass through, default 64, -1 to disable
 	BootstrapResolver resolver `toml:"bootstrap-resolver"`
 	Listeners         map[string]listener
 	Resolvers         map[string]resolver
 	Groups            map[string]group
 	Routers           map[string]router
+	ACLs              map[string]acl         `toml:"acls"`
+	ClientGroups      map[string]clientGroup `toml:"client-groups"`
+	DHCPLeaseFiles    []string               `toml:"dhcp-lease-files"` // Lease files to look up MAC addresses of clients in client groups
+	Notifiers         map[string]notifier
+	UpdateCheck       updateCheck `toml:"update-check"`
+	HA                ha
+
+	ListLoadConcurrency int `toml:"list-load-concurrency"` // Number of list sources loaded at the same time, default 8
 }
 
 type listener struct {
@@ -31,10 +40,59 @@ type listener struct {
 	MutualTLS  bool     `toml:"mutual-tls"`
 	NoTLS      bool     `toml:"no-tls"` // Disable TLS in DoH servers
 	AllowedNet []string `toml:"allowed-net"`
+	ACL        string   // Name of a shared access control list, can't be used with allowed-net
 	KeySeed    string   `toml:"key-seed"`  // ODoH HPKE key seed, 16 byte hex key. Generate for example with: "openssl rand -hex 16"
 	OdohMode   string   `toml:"odoh-mode"` // ODoH mode - accepts "proxy", "target" or "dual", default is target mode
 	AllowDoH   bool     `toml:"allow-doh"` // Allow ODoH listeners to also handle DoH queries to /dns-query
 	Frontend   dohFrontend
+
+	Compression    string // Response name compression, "auto", "always" or "never"
+	MaxUDPSize     uint16 `toml:"max-udp-size"`    // Maximum size of UDP responses regardless of the client buffer size
+	TruncatePolicy string `toml:"truncate-policy"` // Handling of UDP responses that are too large, "fit", "empty" or "never"
+
+	Chaos         string // Handling of CHAOS class queries like version.bind, "refuse", "reveal", "obscure" or "forward"
+	ChaosIdentity string `toml:"chaos-identity"` // Identity returned for hostname.bind and id.server, defaults to the hostname
+
+	HTTPCompression bool `toml:"http-compression"` // Gzip DoH responses if the client supports it
+
+	ServerTiming bool `toml:"server-timing"` // Return a breakdown of the time spent resolving queries
+
+	AcceptUpdate bool `toml:"accept-update"` // Accept dynamic UPDATE messages to route them by opcode
+
+	RelatedRecords string `toml:"related-records"` // DoH only: "prefetch" or "push" records related to queries, experimental
+
+	ResInfo string `toml:"resinfo"` // DoH only: ID of a resinfo group whose information is served at /.well-known/resolver-info/
+
+	WaitForLists bool `toml:"wait-for-lists"` // Start accepting queries once lists loading in the background are ready
+
+	// TCP socket options, "tcp" and "dot" only
+	TCPFastOpen    bool `toml:"tcp-fast-open"`
+	TCPKeepAlive   int  `toml:"tcp-keepalive"`    // Interval of keepalive probes in seconds, -1 to disable
+	TCPUserTimeout int  `toml:"tcp-user-timeout"` // Seconds sent data may remain unacknowledged before the connection is closed
+
+	// Block page options
+	UnblockURL      string `toml:"unblock-url"`      // URL of the admin listener unblock endpoint offered on the block page
+	UnblockDuration int    `toml:"unblock-duration"` // Time in seconds names are unblocked for, default 3600
+
+	// Admin listener unblock options
+	AllowUnblock   bool     `toml:"allow-unblock"`   // Enable the unblock endpoint, requires allowed-net, acl or unblock-token
+	UnblockToken   string   `toml:"unblock-token"`   // Bearer token required to unblock names
+	UnblockOrigins []string `toml:"unblock-origins"` // Origins of other pages allowed to post unblock requests
+
+	// Admin listener route change options
+	AllowRouteChanges bool   `toml:"allow-route-changes"` // Enable changing routes, requires allowed-net, acl or routes-token
+	RoutesToken       string `toml:"routes-token"`        // Bearer token required to change routes
+
+	// mDNS reflector options
+	MDNSInterfaces []string `toml:"mdns-interfaces"` // Interfaces to reflect mDNS packets between
+	MDNSServices   []string `toml:"mdns-services"`   // Services to reflect, like "_ipp._tcp", all if empty
+}
+
+// Clients that are put into a group by the listeners
+type clientGroup struct {
+	Networks  []string // Source networks of the clients
+	MACs      []string `toml:"macs"`       // MAC addresses of the clients
+	CertNames []string `toml:"cert-names"` // Common names of TLS client certificates
 }
 
 // DoH listener frontend options
@@ -52,19 +110,59 @@ type resolver struct {
 	ClientCrt     string `toml:"client-crt"`
 	ServerName    string `toml:"server-name"` // TLS server name presented in the server certificate
 	BootstrapAddr string `toml:"bootstrap-address"`
+	Bootstrap     string `toml:"bootstrap-resolver"` // ID of a resolver or group used to look up the hostname of this resolver
 	LocalAddr     string `toml:"local-address"`
 	EDNS0UDPSize  uint16 `toml:"edns0-udp-size"` // UDP resolver option
 	QueryTimeout  int    `toml:"query-timeout"`  // Query timeout in seconds
+	EDNS0Fallback bool   `toml:"edns0-fallback"` // Retry without EDNS0 on FORMERR, UDP and TCP resolvers only
+
+	// Outbound query rate limit
+	QPSLimit   float64 `toml:"qps-limit"`    // Queries per second sent to the resolver, unlimited if 0
+	QPSBurst   int     `toml:"qps-burst"`    // Queries that can be sent at once, defaults to qps-limit
+	QPSMaxWait int     `toml:"qps-max-wait"` // Milliseconds a query can wait to be sent, fail right away if 0
+
+	// Active health checks
+	HealthCheckInterval int    `toml:"health-check-interval"` // Seconds between probes, health checks are disabled if 0
+	HealthCheckName     string `toml:"health-check-name"`     // Name of the probe query, default "."
+	HealthCheckType     string `toml:"health-check-type"`     // Type of the probe query, default "NS" for "." and "A" otherwise
+	HealthCheckTimeout  int    `toml:"health-check-timeout"`  // Seconds to wait for the response to a probe, default 2
+	HealthCheckFall     int    `toml:"health-check-fall"`     // Failed probes in a row after which the resolver is down, default 3
+	HealthCheckRise     int    `toml:"health-check-rise"`     // Successful probes in a row after which the resolver is up again, default 2
 
 	// Proxy configuration
 	Socks5Address      string `toml:"socks5-address"`
 	Socks5Username     string `toml:"socks5-username"`
 	Socks5Password     string `toml:"socks5-password"`
-	Socks5ResolveLocal bool   `toml:"socks5-resolve-local"` // Resolve DNS server address locally (i.e. bootstrap-resolver), not on the SOCK5 proxy
+	Socks5ResolveLocal bool   `toml:"socks5-resolve-local"`   // Resolve DNS server address locally (i.e. bootstrap-resolver), not on the SOCK5 proxy
+	Socks5Isolate      bool   `toml:"socks5-isolate-streams"` // Use random credentials for every connection, Tor stream isolation
+	HTTPProxyAddress   string `toml:"http-proxy-address"`     // HTTP proxy supporting CONNECT, TCP-based protocols only
+	HTTPProxyUsername  string `toml:"http-proxy-username"`    // Basic authentication with the HTTP proxy
+	HTTPProxyPassword  string `toml:"http-proxy-password"`
 
 	//QUIC and DoH/3 configuration
 	Use0RTT bool `toml:"enable-0rtt"`
 
+	// DoH connection options
+	HappyEyeballs            bool `toml:"happy-eyeballs"`              // Race connections to all IPv6 and IPv4 addresses of the hostname
+	ReconnectOnNetworkChange bool `toml:"reconnect-on-network-change"` // Close connections when addresses or routes of the host change
+	MaxConcurrentStreams     int  `toml:"max-concurrent-streams"`      // Maximum number of queries sent at the same time
+	H2PingInterval           int  `toml:"h2-ping-interval"`            // Seconds without frames after which HTTP/2 connections are pinged
+	H2PingTimeout            int  `toml:"h2-ping-timeout"`             // Seconds to wait for the ping response before closing, default 15
+	H2MaxStreamErrors        int  `toml:"h2-max-stream-errors"`        // Replace HTTP/2 connections after this many failed queries in a row
+
+	// mDNS resolver options
+	MDNSMode      string `toml:"mdns-mode"`      // "qu" (default) or "qm"
+	MDNSInterface string `toml:"mdns-interface"` // Interface to send queries on
+	MDNSCacheTTL  int    `toml:"mdns-cache-ttl"` // Max seconds responses are cached, default 10, -1 disables the cache
+
+	// Share TLS sessions and DoH connections with resolvers that have the same settings
+	ShareConnections bool `toml:"share-connections"`
+
+	// TCP socket options, "tcp" and "dot" only
+	TCPFastOpen    bool `toml:"tcp-fast-open"`
+	TCPKeepAlive   int  `toml:"tcp-keepalive"`    // Interval of keepalive probes in seconds, -1 to disable
+	TCPUserTimeout int  `toml:"tcp-user-timeout"` // Seconds sent data may remain unacknowledged before the connection is closed
+
 	// URL for Oblivious DNS target
 	Target       string `toml:"target"`
 	TargetConfig string `toml:"target-config"`
@@ -79,9 +177,12 @@ type doh struct {
 type cacheBackend struct {
 	Type                 string // Cache backend type.Defaults to "memory"
 	Size                 int    // Max number of items to keep in the cache. Default 0 == unlimited. Deprecated, use backend
+	MaxMemory            int64  `toml:"max-memory"` // Max approximate memory used by cached responses in MB, for "memory" type cache. Default 0 == unlimited
+	Shards               int    // Number of independently locked parts of "memory" type cache. Default 1
 	GCPeriod             int    `toml:"gc-period"` // Time-period (seconds) used to expire cached items
 	Filename             string // File to load/store cache content, optional, for "memory" type cache
-	SaveInterval         int    `toml:"save-interval"`           // Seconds to write the cache to file
+	SaveInterval         int    `toml:"save-interval"` // Seconds to write the cache to file, or to compact it with journal
+	Journal              bool   // Append changes to the file as they happen, for "memory" type cache
 	RedisNetwork         string `toml:"redis-network"`           // The network type, either tcp or unix. Defaults to tcp.
 	RedisAddress         string `toml:"redis-address"`           // Address for redis cache
 	RedisUsername        string `toml:"redis-username"`          // Redis username
@@ -91,6 +192,10 @@ type cacheBackend struct {
 	RedisMaxRetries      int    `toml:"redis-max-retries"`       // Maximum number of retries before giving up. Default is 3 retries; -1 (not 0) disables retries.
 	RedisMinRetryBackoff int    `toml:"redis-min-retry-backoff"` // Minimum back-off between each retry. Default is 8 milliseconds; -1 disables back-off.
 	RedisMaxRetryBackoff int    `toml:"redis-max-retry-backoff"` // Maximum back-off between each retry. Default is 512 milliseconds; -1 disables back-off.
+
+	// Backends of the "tiered" type
+	L1 *cacheBackend `toml:"l1"` // Checked first, typically a small "memory" backend
+	L2 *cacheBackend `toml:"l2"` // Used if there's no hit in L1, typically "redis"
 }
 
 type group struct {
@@ -112,6 +217,18 @@ type group struct {
 	ResetAfter    int  `toml:"reset-after"`    // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
 	ServfailError bool `toml:"servfail-error"` // If true, SERVFAIL responses are considered errors and cause failover etc.
 
+	// Circuit breaker options
+	BreakerThreshold int    `toml:"breaker-threshold"` // Consecutive failures after which the breaker opens, default 5
+	BreakerCooldown  int    `toml:"breaker-cooldown"`  // Seconds the breaker stays open before the resolver is tested again, default 30
+	BreakerResolver  string `toml:"breaker-resolver"`  // Resolver for queries while the breaker is open, fail if not set
+
+	// Concurrency limiter options
+	ConcurrencyLimit        int    `toml:"concurrency-limit"`         // Maximum number of queries in flight
+	ConcurrencyQueue        int    `toml:"concurrency-queue"`         // Number of queries that can wait for a slot, default 0
+	ConcurrencyQueueTimeout int    `toml:"concurrency-queue-timeout"` // Milliseconds a query waits in the queue, default 1000
+	ConcurrencyOverflow     string `toml:"concurrency-overflow"`      // Handling of queries over the limit, "servfail" (default), "drop" or "fallback"
+	ConcurrencyResolver     string `toml:"concurrency-resolver"`      // Resolver for queries over the limit with "fallback"
+
 	// Cache options
 	Backend                  *cacheBackend
 	GCPeriod                 int               `toml:"gc-period"`                   // Time-period (seconds) used to expire cached items in the "cache" type. Deprecated, use backend
@@ -124,6 +241,25 @@ type group struct {
 	PrefetchEligible         uint32            `toml:"cache-prefetch-eligible"`     // Only records with TTL greater than this are considered for prefetch
 	CacheRcodeMaxTTL         map[string]uint32 `toml:"cache-rcode-max-ttl"`         // Rcode specific max TTL to keep in the cache
 
+	CacheFlushOnNetworkChange bool     `toml:"cache-flush-on-network-change"` // Flush the cache when addresses or routes change
+	CacheFlushZones           []string `toml:"cache-flush-zones"`             // Only flush these zones on network changes
+
+	// Cache error backoff options
+	CacheErrorBackoff    uint32 `toml:"cache-error-backoff"`     // Seconds to answer failing names with SERVFAIL after the first failure, doubles on consecutive failures
+	CacheErrorBackoffMax uint32 `toml:"cache-error-backoff-max"` // Maximum backoff in seconds, default and limit 300
+
+	// Cache key options
+	CacheKeyIgnoreCase    bool `toml:"cache-key-ignore-case"`     // Match names case-insensitively
+	CacheKeyCD            bool `toml:"cache-key-cd"`              // Cache responses to queries with the CD bit separately
+	CacheKeyIgnoreDO      bool `toml:"cache-key-ignore-do"`       // Don't cache responses to queries with the DO bit separately
+	CacheKeyIgnoreECSZero bool `toml:"cache-key-ignore-ecs-zero"` // Treat ECS with a /0 source prefix like no ECS
+
+	// Options to not cache some responses
+	CacheSkipRcodes    []int    `toml:"cache-skip-rcodes"`    // Don't cache responses with these response codes
+	CacheSkipNetworks  []string `toml:"cache-skip-networks"`  // Don't cache responses with addresses in these networks (CIDR)
+	CacheSkipZeroTTL   bool     `toml:"cache-skip-zero-ttl"`  // Don't cache responses with any record with TTL 0
+	CacheSkipResolvers []string `toml:"cache-skip-resolvers"` // Don't cache responses that passed through these elements
+
 	// Blocklist options
 	Blocklist []string // Blocklist rules, only used by "blocklist" type
 	Format    string   // Blocklist input format: "regex", "domain", "hosts", or "mac"
@@ -145,6 +281,17 @@ type group struct {
 	Inverted          bool     // Only allow IPs on the blocklist. Supported in response-blocklist-ip and response-blocklist-name
 	UseECS            bool     `toml:"use-ecs"` // Use ECS IP address in client-blocklist
 
+	BlockPageIP []string `toml:"block-page-ip"` // Respond to blocked A/AAAA queries with these block page server IPs
+
+	CNAMEChain    bool `toml:"cname-chain"`     // Check the names in the CNAME chain of responses, blocklist-v2 and response-blocklist-name
+	CNAMEMaxDepth int  `toml:"cname-max-depth"` // Maximum number of CNAME records followed, default 10
+
+	BlockReverse bool `toml:"block-reverse"` // Block PTR queries for addresses of blocked names in blocklist-v2
+
+	ObserveNet []string `toml:"observe-net"` // Client networks that are never blocked, matches are only logged and counted
+
+	ReloadMaxChange int `toml:"reload-max-change"` // Reject list reloads that change the number of rules by more than this percentage
+
 	// Static responder options
 	Answer   []string
 	NS       []string
@@ -157,11 +304,12 @@ type group struct {
 	Truncate bool `toml:"truncate"` // When true, TC-Bit is set
 
 	// Rate-limiting options
-	Requests      uint   // Number of requests allowed
-	Window        uint   // Time period in seconds for the requests
-	Prefix4       uint8  // Prefix bits to identify IPv4 client
-	Prefix6       uint8  // Prefix bits to identify IPv6 client
-	LimitResolver string `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Requests      uint          // Number of requests allowed
+	Window        uint          // Time period in seconds for the requests
+	Prefix4       uint8         // Prefix bits to identify IPv4 client
+	Prefix6       uint8         // Prefix bits to identify IPv6 client
+	LimitResolver string        `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	LimitStore    *cacheBackend `toml:"limit-store"`    // Store for counters shared between instances, only "redis" is supported
 
 	// Fastest-TCP probe options
 	Port          int
@@ -184,8 +332,155 @@ type group struct {
 	Verbose     bool   `toml:"verbose"`      // When logging responses, include types that don't match the query type
 
 	// Query logging options
-	OutputFile   string `toml:"output-file"`   // Log filename or blank for STDOUT
-	OutputFormat string `toml:"output-format"` // "text" or "json"
+	OutputFile     string `toml:"output-file"`      // Log filename or blank for STDOUT
+	OutputFormat   string `toml:"output-format"`    // "text", "json" or "dnstap"
+	OutputMaxSize  int64  `toml:"output-max-size"`  // Rotate the log file when it exceeds this size in MB
+	OutputMaxFiles int    `toml:"output-max-files"` // Number of rotated log files to keep, default 1
+
+	// Log redaction options for syslog and query-log
+	RedactZones   []string `toml:"redact-zones"`   // Private zones with names that are hashed or truncated in logs
+	RedactMode    string   `toml:"redact-mode"`    // "hash" or "truncate", default "hash"
+	RedactClients bool     `toml:"redact-clients"` // Replace client IPs with tokens
+	RedactKey     string   `toml:"redact-key"`     // Key for hashes and tokens, random if not set
+	RedactSkip    []string `toml:"redact-skip"`    // Names in domain format that aren't logged at all
+
+	// PCAP writer options, also uses output-file
+	PCAPSampleRate float64 `toml:"pcap-sample-rate"` // Fraction of queries to write, between 0 and 1, default 1
+	PCAPMaxSize    int64   `toml:"pcap-max-size"`    // Rotate the file when it exceeds this size in MB
+	PCAPMaxFiles   int     `toml:"pcap-max-files"`   // Number of rotated files to keep, default 1
+
+	// HTTPS synthesizer options
+	HTTPSNODATA     []string `toml:"https-nodata"`     // Domains to respond to HTTPS queries with NODATA
+	HTTPSSynthesize []string `toml:"https-synthesize"` // Domains to synthesize HTTPS records for from A/AAAA records
+
+	// Special-use domain options
+	SpecialUseZones map[string]string `toml:"special-use-zones"` // Zone to action, "nxdomain", "refused", "loopback" or "forward"
+
+	// Search domain options
+	SearchDomains  []string `toml:"search-domains"`  // Domains appended to names that don't exist, tried in order
+	SearchSuffixes []string `toml:"search-suffixes"` // Names with these suffixes are retried too, not only single-label names
+
+	// Response rewrite options
+	RewriteAddresses map[string]string `toml:"rewrite-addresses"` // Network in responses to the network it's mapped to, in CIDR notation
+	RewriteNames     map[string]string `toml:"rewrite-names"`     // Domain of CNAME, SRV and MX targets to the domain it's replaced with
+
+	// RESINFO responder options
+	ResInfoNames             []string `toml:"resinfo-names"`              // Names to answer RESINFO queries for, default resolver.arpa
+	ResInfoQNameMinimization bool     `toml:"resinfo-qname-minimization"` // The resolver minimizes query names
+	ResInfoExtendedErrors    []uint16 `toml:"resinfo-extended-errors"`    // Extended DNS Error codes the resolver can return
+	ResInfoInfoURL           string   `toml:"resinfo-info-url"`           // URL of the resolver information page
+	ResInfoFiltering         string   `toml:"resinfo-filtering"`          // Description of the filtering policy on the information page
+
+	// Homograph detector options
+	HomographDomains []string `toml:"homograph-domains"` // Domains to detect look-alikes of
+	HomographBlock   bool     `toml:"homograph-block"`   // Respond to queries for look-alikes with NXDOMAIN
+
+	// DNSSEC monitor options
+	MonitorZones         []string `toml:"monitor-zones"`          // Zones to check the DNSSEC configuration of
+	MonitorInterval      int      `toml:"monitor-interval"`       // Seconds between checks, default 3600
+	MonitorExpiryWarning int      `toml:"monitor-expiry-warning"` // Alert when signatures expire within this many seconds, default 7 days
+
+	// DNSSEC validator options
+	TrustAnchors    []string `toml:"trust-anchors"`     // DS records the chain of trust starts from, default the root zone keys
+	TrustAnchorFile string   `toml:"trust-anchor-file"` // File with trust anchors in the IANA root-anchors.xml format
+	KeyCacheTTL     int      `toml:"key-cache-ttl"`     // Maximum seconds validated keys are cached, default 3600
+
+	// Header flag policy options
+	FlagsClearAA     bool              `toml:"flags-clear-aa"`     // Clear the AA flag in responses
+	FlagsRA          string            `toml:"flags-ra"`           // "set" or "clear" the RA flag in responses
+	FlagsRAListeners map[string]string `toml:"flags-ra-listeners"` // RA flag action by listener ID
+	FlagsAD          string            `toml:"flags-ad"`           // AD flag in responses, "strip" or "client"
+	FlagsCD          string            `toml:"flags-cd"`           // "set" or "clear" the CD flag in upstream queries
+
+	// Query validator options
+	ValidatorRcode          int  `toml:"validator-rcode"`           // Response code of invalid queries, 1 (FORMERR, default) or 5 (REFUSED)
+	ValidatorRejectReserved bool `toml:"validator-reject-reserved"` // Reject queries for reserved types
+
+	// Response clamp options
+	ClampMaxAnswers int    `toml:"clamp-max-answers"` // Maximum number of answer records of the queried type
+	ClampMaxSize    int    `toml:"clamp-max-size"`    // Maximum response size in bytes
+	ClampPolicy     string `toml:"clamp-policy"`      // Records to keep, "first" (default), "random" or "fastest-tcp"
+
+	// Require-encrypted options
+	RequireEncryptedZones []string `toml:"require-encrypted-zones"` // Zones only resolved for queries received encrypted, all if empty
+	PlaintextResolver     string   `toml:"plaintext-resolver"`      // Resolver for plaintext queries for the zones, refused if not set
+
+	// Query budget options
+	BudgetDaily     int           `toml:"budget-daily"`     // Queries per day (UTC), unlimited if 0
+	BudgetMonthly   int           `toml:"budget-monthly"`   // Queries per month (UTC), unlimited if 0
+	BudgetExhausted string        `toml:"budget-exhausted"` // Handling of queries without budget, "fail-over" (default) or "stale"
+	BudgetResolver  string        `toml:"budget-resolver"`  // Resolver used when the budget is exhausted
+	BudgetStaleTTL  int           `toml:"budget-stale-ttl"` // Time in seconds responses are kept to be served stale, default 86400
+	BudgetFile      string        `toml:"budget-file"`      // File the counters are written to, to survive restarts
+	BudgetBackend   *cacheBackend `toml:"budget-backend"`   // Backend for stale responses, default memory
+
+	// Query statistics options
+	StatsFile            string `toml:"stats-file"`             // File to keep the statistics in across restarts
+	StatsSaveInterval    int    `toml:"stats-save-interval"`    // Seconds between writes of the file, only written on shutdown if 0
+	StatsHourlyRetention int    `toml:"stats-hourly-retention"` // Number of hours to keep, default 48
+	StatsDailyRetention  int    `toml:"stats-daily-retention"`  // Number of days to keep, default 30
+	StatsMaxEntries      int    `toml:"stats-max-entries"`      // Domains and clients counted per hour or day, default 10000
+
+	// Popularity export options
+	PopularityURL        string `toml:"popularity-url"`         // URL the reports are sent to
+	PopularityInterval   int    `toml:"popularity-interval"`    // Seconds between reports, default 3600
+	PopularityK          int    `toml:"popularity-k"`           // Clients that need to query a name for it to be reported as-is, default 10
+	PopularityHashKey    string `toml:"popularity-hash-key"`    // Key of the hash of names below popularity-k, random if empty
+	PopularityMaxEntries int    `toml:"popularity-max-entries"` // Names counted per interval, default 10000
+
+	// Response router options
+	ResponseRoutes []responseRoute `toml:"response-routes"` // Routes evaluated against the response of the first resolver
+
+	// Hosts file resolver options
+	HostsFiles []string `toml:"hosts-files"` // Hosts files, or directories of them, to answer queries from
+	HostsTTL   uint32   `toml:"hosts-ttl"`   // TTL of the records, default 60
+
+	// HTTP API resolver options
+	HTTPAPIURL       string            `toml:"http-api-url"`        // Endpoint that queries are POSTed to as JSON
+	HTTPAPIHeaders   map[string]string `toml:"http-api-headers"`    // Headers added to the requests, like Authorization
+	HTTPAPITimeout   int               `toml:"http-api-timeout"`    // Time in seconds to wait for a reply, default 2
+	HTTPAPITTL       uint32            `toml:"http-api-ttl"`        // TTL of records if the reply doesn't contain one, default 60
+	HTTPAPICacheSize int               `toml:"http-api-cache-size"` // Replies kept in the cache, default 1000, -1 disables caching
+
+	// Catalog zone options
+	CatalogZone          string `toml:"catalog-zone"`           // Name of the catalog zone
+	CatalogPrimary       string `toml:"catalog-primary"`        // Primary server to transfer the catalog from, host:port
+	CatalogResolver      string `toml:"catalog-resolver"`       // Resolver for queries in member zones
+	CatalogRefresh       int    `toml:"catalog-refresh"`        // Seconds between checks for changes, defaults to the SOA refresh and retry
+	CatalogTSIGName      string `toml:"catalog-tsig-name"`      // TSIG key name to authenticate transfers
+	CatalogTSIGSecret    string `toml:"catalog-tsig-secret"`    // TSIG secret, base64
+	CatalogTSIGAlgorithm string `toml:"catalog-tsig-algorithm"` // TSIG algorithm, default hmac-sha256
+
+	// Kubernetes options
+	KubernetesServer        string   `toml:"kubernetes-server"`         // URL of the API server, defaults to the cluster routedns is running in
+	KubernetesTokenFile     string   `toml:"kubernetes-token-file"`     // File with the bearer token to authenticate with
+	KubernetesCA            string   `toml:"kubernetes-ca"`             // CA certificate of the API server
+	KubernetesClientCrt     string   `toml:"kubernetes-client-crt"`     // Client certificate to authenticate with
+	KubernetesClientKey     string   `toml:"kubernetes-client-key"`     // Key of the client certificate
+	KubernetesDomain        string   `toml:"kubernetes-domain"`         // Cluster domain, default "cluster.local"
+	KubernetesNamespaces    []string `toml:"kubernetes-namespaces"`     // Namespaces to serve records for, all if empty
+	KubernetesLabelSelector string   `toml:"kubernetes-label-selector"` // Only serve records for services matching the selector
+	KubernetesPodRecords    bool     `toml:"kubernetes-pod-records"`    // Answer queries for pod names
+	KubernetesTTL           uint32   `toml:"kubernetes-ttl"`            // TTL of the records, default 5
+
+	// Options for modifiers with multiple resolvers
+	Select       string            // Strategy to pick the resolver, "all", "hash", "route" or "subnet"
+	SelectRoutes map[string]string `toml:"select-routes"` // Listener ID to resolver ID, used by the "route" strategy
+
+	// Client subnet load-balancing options, used by random groups and the "subnet" select strategy
+	SubnetAffinity bool  `toml:"subnet-affinity"` // Pin client subnets to the same resolver in random groups
+	SubnetPrefix4  uint8 `toml:"subnet-prefix4"`  // Prefix length of IPv4 client subnets, default 24
+	SubnetPrefix6  uint8 `toml:"subnet-prefix6"`  // Prefix length of IPv6 client subnets, default 56
+}
+
+// Route in a response-router, all conditions that are set have to match
+type responseRoute struct {
+	Rcodes      []string // "NXDOMAIN", "SERVFAIL", etc
+	AnswerCount *int     `toml:"answer-count"` // Number of answer records
+	Flags       []string // Flags that need to be set, "AA", "TC", "RA", "AD", "CD"
+	Error       bool     // Match if the resolver failed or dropped the query
+	CNAME       string   // Regular expression matched against CNAME targets in the answer
+	Resolver    string
 }
 
 // Block/Allowlist items for blocklist-v2
@@ -195,6 +490,64 @@ type list struct {
 	Source       string
 	CacheDir     string `toml:"cache-dir"`     // Where to store copies of remote blocklists for faster startup
 	AllowFailure bool   `toml:"allow-failure"` // Don't fail on error and keep using the prior ruleset
+	Background   bool   // Load the list after startup, without it until then
+
+	// Branch and file of sources in git repositories
+	GitBranch string `toml:"git-branch"`
+	GitPath   string `toml:"git-path"`
+
+	// Integrity verification of lists downloaded via HTTP(S)
+	SHA256      string `toml:"sha256"`       // Expected SHA256 checksum of the list, in hex
+	SHA256URL   string `toml:"sha256-url"`   // URL of a file with the checksum, in the format of sha256sum
+	MinisignKey string `toml:"minisign-key"` // Public key the list is signed with using minisign
+	MinisignURL string `toml:"minisign-url"` // URL of the signature, defaults to the source with ".minisig" appended
+
+	// Reload guard of the element using the list, set from its options
+	element   string
+	maxChange int
+}
+
+// Access control list that can be shared by listeners
+type acl struct {
+	Rules    []aclRule
+	Default4 *aclRule // Rule for IPv4 clients not matching any of the rules, default is to refuse
+	Default6 *aclRule // Rule for IPv6 clients not matching any of the rules, defaults to the IPv4 default
+}
+
+type aclRule struct {
+	Net      string // Client network in CIDR notation
+	Action   string // "allow", "refuse", "drop" or "route"
+	Resolver string // Resolver used by the "route" action
+}
+
+// Receives operational events such as failovers
+type notifier struct {
+	Type       string   // "webhook"
+	URL        string   `toml:"url"`
+	Events     []string // Types of events to send, all if empty
+	Retries    int      // Number of retries of failed requests, default 3
+	RetryDelay int      `toml:"retry-delay"` // Seconds before the first retry, doubling with every retry, default 5
+}
+
+// Periodically checks for newer versions
+type updateCheck struct {
+	Enabled  bool
+	URL      string `toml:"url"`      // URL returning the latest version, default is the latest GitHub release
+	TXTName  string `toml:"txt-name"` // Name of a TXT record with the latest version, instead of url
+	Interval int    // Seconds between checks, default 86400
+}
+
+// Active-standby coordination with a second instance
+type ha struct {
+	Role       string        // "active" or "standby", disabled if empty
+	PeerURL    string        `toml:"peer-url"` // Health endpoint of the active instance, used by the standby
+	PeerCA     string        `toml:"peer-ca"`  // CA certificate to validate the health endpoint
+	Interval   int           // Seconds between health checks, default 2
+	Failures   int           // Consecutive failed or successful checks before taking over or handing back, default 3
+	Listeners  []string      // Listeners only running while active, default all except admin and prometheus
+	OnActive   []string      `toml:"on-active"`   // Command run when becoming active
+	OnStandby  []string      `toml:"on-standby"`  // Command run when becoming standby
+	StateStore *cacheBackend `toml:"state-store"` // Store to hand over the state of failover groups, only "redis" is supported
 }
 
 type router struct {
@@ -213,7 +566,17 @@ type route struct {
 	DoHPath       string   `toml:"doh-path"` // DoH query path if received over DoH (regexp)
 	Resolver      string
 	Listener      string // ID of the listener that received the original request
-	TLSServerName string `toml:"servername"` // TLS servername
+	TLSServerName string `toml:"servername"`   // TLS servername
+	ClientGroup   string `toml:"client-group"` // Name of the client group the listener put the client into
+
+	Opcodes []string // 'QUERY', 'NOTIFY', 'UPDATE', etc
+
+	Transports []string // Transport of the listener, 'udp', 'tcp', 'dot', 'doh', 'doq', 'dtls', 'odoh'
+	MinSize    int      `toml:"min-size"` // Minimum query size in bytes
+	MaxSize    int      `toml:"max-size"` // Maximum query size in bytes
+
+	MinRate    float64 `toml:"min-rate"`    // Minimum queries per second for the name across all clients
+	RateWindow int     `toml:"rate-window"` // Seconds the rate is measured over, default 1
 }
 
 // LoadConfig reads a config file and returns the decoded structure.
@@ -243,7 +606,7 @@ func loadFile(w io.Writer, name string) error {
 func parseCIDRList(networks []string) ([]*net.IPNet, error) {
 	var out []*net.IPNet
 	for _, s := range networks {
-		_, n, err := net.ParseCIDR(s)
+		n, err := rdns.ParseCIDR(s)
 		if err != nil {
 			return out, err
 		}
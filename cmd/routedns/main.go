@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -9,7 +11,10 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,6 +28,9 @@ import (
 type options struct {
 	logLevel uint32
 	version  bool
+	graph    string
+
+	resolvConf string
 }
 
 func main() {
@@ -55,6 +63,12 @@ arguments.
 
 	cmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 4, "log level; 0=None .. 6=Trace")
 	cmd.Flags().BoolVarP(&opt.version, "version", "v", false, "Prints code version string")
+	cmd.Flags().StringVar(&opt.graph, "graph", "", "Prints the configuration as graph in 'json' or 'dot' format and exits")
+	cmd.Flags().StringVar(&opt.resolvConf, "resolv-conf", "", "Points /etc/resolv.conf at this address while running, restores the original on exit")
+	cmd.AddCommand(newTestCommand())
+	cmd.AddCommand(newCompileListCommand())
+	cmd.AddCommand(newQueryCommand())
+	cmd.AddCommand(newSetupCommand())
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -76,26 +90,40 @@ func (n Node) ID() string {
 // Functions to call on shutdown
 var onClose []func()
 
+// Blocklists by ID, names can be unblocked in them temporarily through the
+// admin listener.
+var blocklists = make(map[string]*rdns.Blocklist)
+
+// Failover groups by ID, their state is handed over between the instances
+// of an active-standby pair.
+var haGroups = make(map[string]rdns.HAStateGroup)
+
+// Query statistics by ID, served by the admin listener.
+var queryStats = make(map[string]*rdns.QueryStats)
+
+// Routers by ID, their routes can be changed through the admin listener.
+var routers = make(map[string]*rdns.Router)
+
+// Resolver information responders by ID, their information page is served
+// by DoH listeners.
+var resInfos = make(map[string]*rdns.ResInfo)
+
+// Client groups that all listeners put clients into, nil if there are none.
+var clientGroups *rdns.ClientGroups
+
+// Default number of list sources that are loaded at the same time.
+const defaultListLoadConcurrency = 8
+
+// Limits the number of list sources that are loaded at the same time.
+var listLoadSlots = make(chan struct{}, defaultListLoadConcurrency)
+
 func start(opt options, args []string) error {
 	// Set the log level in the library package
 	if opt.logLevel > 6 {
 		return fmt.Errorf("invalid log level: %d", opt.logLevel)
 	}
 
-	// Convert logrus levels to slog levels
-	var level slog.Level
-	switch opt.logLevel {
-	case 0:
-		level = slog.LevelError
-	case 1, 2:
-		level = slog.LevelWarn
-	case 3, 4:
-		level = slog.LevelInfo
-	case 5, 6:
-		level = slog.LevelDebug
-	default:
-		level = slog.LevelInfo
-	}
+	level := slogLevel(opt.logLevel)
 	if opt.version {
 		printVersion()
 		os.Exit(0)
@@ -111,7 +139,111 @@ func start(opt options, args []string) error {
 	if err != nil {
 		return err
 	}
+	configGraph := newConfigGraph(config)
+	switch opt.graph {
+	case "":
+	case "json":
+		return configGraph.WriteJSON(os.Stdout)
+	case "dot":
+		return configGraph.WriteDOT(os.Stdout)
+	default:
+		return fmt.Errorf("unsupported graph format '%s'", opt.graph)
+	}
+
+	switch {
+	case config.ListLoadConcurrency < 0:
+		return errors.New("list-load-concurrency can't be negative")
+	case config.ListLoadConcurrency > 0:
+		listLoadSlots = make(chan struct{}, config.ListLoadConcurrency)
+	}
+
+	// Notifiers are set up first so they receive events from elements as they start
+	for id, n := range config.Notifiers {
+		if err := instantiateNotifier(id, n); err != nil {
+			return err
+		}
+	}
+
+	resolvers, err := instantiateResolvers(config)
+	if err != nil {
+		return err
+	}
+
+	// Look for newer versions if enabled, after any bootstrap resolver is set up
+	var updateChecker *rdns.UpdateChecker
+	if config.UpdateCheck.Enabled {
+		updateChecker = rdns.NewUpdateChecker("update-check", rdns.UpdateCheckerOptions{
+			URL:      config.UpdateCheck.URL,
+			TXTName:  config.UpdateCheck.TXTName,
+			Interval: time.Duration(config.UpdateCheck.Interval) * time.Second,
+		})
+	}
 
+	s := newServer(args, updateChecker)
+	p, err := s.prepare(config, resolvers)
+	if err != nil {
+		return err
+	}
+
+	// Send events when listener certificates are about to expire
+	if len(config.Notifiers) > 0 {
+		for id, l := range config.Listeners {
+			if l.ServerCrt != "" {
+				rdns.MonitorCertificate(id, l.ServerCrt, rdns.CertificateMonitorOptions{})
+			}
+		}
+	}
+	rdns.Notify(rdns.Event{
+		Type:    rdns.EventConfigLoaded,
+		Message: "configuration loaded from " + strings.Join(args, ", "),
+	})
+
+	// Listeners of an active-standby pair are started by the coordinator
+	if config.HA.Role != "" {
+		s.ha, err = startHACoordinator(config, p.listeners)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Start the listeners
+	s.commit(p)
+
+	// Send system queries to the listeners, once they're started
+	if opt.resolvConf != "" {
+		if net.ParseIP(opt.resolvConf) == nil {
+			return fmt.Errorf("invalid resolv-conf address '%s'", opt.resolvConf)
+		}
+		if err := writeResolvConf(opt.resolvConf); err != nil {
+			return fmt.Errorf("failed to update %s: %w", resolvConfPath, err)
+		}
+		// Not part of onClose which is also run on reload
+		defer func() {
+			if _, err := restoreResolvConf(); err != nil {
+				rdns.Log.Error("failed to restore resolv.conf", "error", err)
+			}
+		}()
+	}
+
+	// Reload the configuration on SIGHUP, graceful shutdown on other signals
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for received := range sig {
+		if received != syscall.SIGHUP {
+			break
+		}
+		s.reload()
+	}
+	rdns.Log.Info("stopping")
+	for _, f := range onClose {
+		f()
+	}
+
+	return nil
+}
+
+// Instantiate all resolvers, groups and routers. Returns them in a map by ID.
+func instantiateResolvers(config config) (map[string]rdns.Resolver, error) {
 	// Map to hold all the resolvers extracted from the config, key'ed by resolver ID. It
 	// holds configured resolvers, groups, as well as routers (since they all implement
 	// rdns.Resolver)
@@ -122,10 +254,13 @@ func start(opt options, args []string) error {
 	// for all other entities to use.
 	if config.BootstrapResolver.Address != "" {
 		if err := instantiateResolver("bootstrap-resolver", config.BootstrapResolver, resolvers); err != nil {
-			return fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
+			return nil, fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
 		}
 		net.DefaultResolver = rdns.NewNetResolver(resolvers["bootstrap-resolver"])
 	}
+	if err := instantiateClientGroups(config); err != nil {
+		return nil, err
+	}
 	// Add all types of nodes to a DAG, this is to find duplicates. Then populate the edges (dependencies).
 	graph := dag.NewDAG()
 	edges := make(map[string][]string)
@@ -133,22 +268,40 @@ func start(opt options, args []string) error {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		edges[id] = []string{v.Bootstrap}
 	}
 	for id, v := range config.Groups {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver, v.CatalogResolver)
+		if !slices.Contains(edges[id], v.BudgetResolver) {
+			edges[id] = append(edges[id], v.BudgetResolver)
+		}
+		if !slices.Contains(edges[id], v.PlaintextResolver) {
+			edges[id] = append(edges[id], v.PlaintextResolver)
+		}
+		if !slices.Contains(edges[id], v.BreakerResolver) {
+			edges[id] = append(edges[id], v.BreakerResolver)
+		}
+		if !slices.Contains(edges[id], v.ConcurrencyResolver) {
+			edges[id] = append(edges[id], v.ConcurrencyResolver)
+		}
+		for _, route := range v.ResponseRoutes {
+			if !slices.Contains(edges[id], route.Resolver) {
+				edges[id] = append(edges[id], route.Resolver)
+			}
 		}
-		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
 	}
 	for id, v := range config.Routers {
 		node := &Node{id, v}
 		_, err := graph.AddVertex(node)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		// One router can have multiple edges to the same resolver.
 		// Dedup them before adding to the list of edges.
@@ -167,11 +320,18 @@ func start(opt options, args []string) error {
 				continue
 			}
 			if err := graph.AddEdge(id, e); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
+	// Every element is wrapped to track its status, recover from panics and
+	// optionally limit the depth of queries
+	wrap := rdns.Chain(rdns.StatusTrackerMiddleware(), rdns.PanicRecoveryMiddleware())
+	if config.MaxDepth >= 0 {
+		wrap = rdns.Chain(rdns.DepthLimiterMiddleware(config.MaxDepth), wrap)
+	}
+
 	// Instantiate the elements from leaves to the root nodes
 	for graph.GetOrder() > 0 {
 		leaves := graph.GetLeaves()
@@ -179,175 +339,412 @@ func start(opt options, args []string) error {
 			node := v.(*Node)
 			if r, ok := node.value.(resolver); ok {
 				if err := instantiateResolver(id, r, resolvers); err != nil {
-					return err
+					return nil, err
 				}
 			}
 			if g, ok := node.value.(group); ok {
 				if err := instantiateGroup(id, g, resolvers); err != nil {
-					return err
+					return nil, err
 				}
 			}
 			if r, ok := node.value.(router); ok {
 				if err := instantiateRouter(id, r, resolvers); err != nil {
-					return err
+					return nil, err
 				}
 			}
+			resolvers[id] = wrap(resolvers[id])
 			if err := graph.DeleteVertex(id); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
+	return resolvers, nil
+}
 
-	// Build the Listeners last as they can point to routers, groups or resolvers directly.
-	var listeners []rdns.Listener
+// Returns the protocol of every listener and resolver, and the type of every
+// group and router, by ID.
+func elementProtocols(config config) map[string]string {
+	protocols := make(map[string]string)
+	for id, r := range config.Resolvers {
+		protocols[id] = r.Protocol
+	}
+	for id, g := range config.Groups {
+		protocols[id] = g.Type
+	}
+	for id := range config.Routers {
+		protocols[id] = "router"
+	}
 	for id, l := range config.Listeners {
-		resolver, ok := resolvers[l.Resolver]
-		// All Listeners should route queries (except the admin service).
-		if !ok && l.Protocol != "admin" {
-			return fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver)
-		}
-		allowedNet, err := parseCIDRList(l.AllowedNet)
+		protocols[id] = l.Protocol
+	}
+	return protocols
+}
+
+// Group types that wrap exactly one resolver.
+var singleResolverTypes = map[string]bool{
+	"blocklist":               true,
+	"blocklist-v2":            true,
+	"replace":                 true,
+	"ttl-modifier":            true,
+	"truncate-retry":          true,
+	"request-dedup":           true,
+	"fastest-tcp":             true,
+	"response-clamp":          true,
+	"ecs-modifier":            true,
+	"edns0-modifier":          true,
+	"syslog":                  true,
+	"response-blocklist-ip":   true,
+	"response-blocklist-cidr": true,
+	"response-blocklist-name": true,
+	"client-blocklist":        true,
+	"response-minimize":       true,
+	"response-collapse":       true,
+	"rate-limiter":            true,
+	"query-log":               true,
+	"query-stats":             true,
+	"popularity-export":       true,
+	"pcap":                    true,
+	"special-use":             true,
+	"search-domain":           true,
+	"response-rewrite":        true,
+	"resinfo":                 true,
+	"homograph-detector":      true,
+	"dnssec-monitor":          true,
+	"dnssec":                  true,
+	"header-flags":            true,
+	"query-validator":         true,
+	"require-encrypted":       true,
+	"circuit-breaker":         true,
+	"concurrency-limiter":     true,
+	"query-budget":            true,
+	"response-router":         true,
+	"hosts":                   true,
+	"catalog-zone":            true,
+	"kubernetes":              true,
+	"https-synth":             true,
+}
+
+// Instantiate all access control lists.
+func instantiateACLs(config config, resolvers map[string]rdns.Resolver) (map[string]*rdns.ACL, error) {
+	acls := make(map[string]*rdns.ACL)
+	for id, a := range config.ACLs {
+		acl, err := instantiateACL(id, a, resolvers)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		acls[id] = acl
+	}
+	return acls, nil
+}
 
-		if l.IPVersion != 4 && l.IPVersion != 6 && l.IPVersion != 0 {
-			return errors.New("ip-version must be 4 or 6")
+// Instantiate the client groups the listeners put clients into.
+func instantiateClientGroups(config config) error {
+	clientGroups = nil
+	if len(config.ClientGroups) == 0 {
+		return nil
+	}
+	var groups []rdns.ClientGroup
+	for name, g := range config.ClientGroups {
+		networks, err := parseCIDRList(g.Networks)
+		if err != nil {
+			return fmt.Errorf("client group '%s': %w", name, err)
 		}
-
-		opt := rdns.ListenOptions{AllowedNet: allowedNet}
-
-		switch l.Protocol {
-		case "tcp":
-			network := networkForIPVersion("tcp", l.IPVersion)
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, network, opt, resolver))
-		case "udp":
-			network := networkForIPVersion("udp", l.IPVersion)
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
-			listeners = append(listeners, rdns.NewDNSListener(id, l.Address, network, opt, resolver))
-		case "admin":
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-			if err != nil {
-				return err
-			}
-			opt := rdns.AdminListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-			}
-			ln, err := rdns.NewAdminListener(id, l.Address, opt)
+		group := rdns.ClientGroup{
+			Name:      name,
+			Networks:  networks,
+			CertNames: g.CertNames,
+		}
+		for _, s := range g.MACs {
+			mac, err := net.ParseMAC(s)
 			if err != nil {
-				return err
+				return fmt.Errorf("client group '%s': %w", name, err)
 			}
-			listeners = append(listeners, ln)
-		case "dot":
-			network := networkForIPVersion("tcp", l.IPVersion)
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+			group.MACs = append(group.MACs, mac)
+		}
+		groups = append(groups, group)
+	}
+	// Sort the groups so conflicts are reported consistently
+	slices.SortFunc(groups, func(a, b rdns.ClientGroup) int { return strings.Compare(a.Name, b.Name) })
+	g, err := rdns.NewClientGroups(groups, rdns.ClientGroupsOptions{LeaseFiles: config.DHCPLeaseFiles})
+	if err != nil {
+		return fmt.Errorf("failed to instantiate client groups: %w", err)
+	}
+	onClose = append(onClose, func() { g.Close() })
+	clientGroups = g
+	return nil
+}
+
+// State of the configuration served by admin and prometheus listeners.
+type adminState struct {
+	graph         *rdns.ConfigGraph
+	updateChecker *rdns.UpdateChecker
+	prometheus    *rdns.PrometheusExporter
+	resolvers     map[string]rdns.Resolver // All resolvers, groups and routers by ID
+}
+
+// Instantiate a listener from its configuration. The resolver is nil for
+// listeners that don't resolve queries.
+func instantiateListener(id string, l listener, resolver rdns.Resolver, acls map[string]*rdns.ACL, admin adminState) (rdns.Listener, error) {
+	opt, err := listenOptions(id, l, acls)
+	if err != nil {
+		return nil, err
+	}
+	switch l.Protocol {
+	case "tcp":
+		network := networkForIPVersion("tcp", l.IPVersion)
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		return rdns.NewDNSListener(id, l.Address, network, opt, resolver), nil
+	case "udp":
+		network := networkForIPVersion("udp", l.IPVersion)
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort)
+		return rdns.NewDNSListener(id, l.Address, network, opt, resolver), nil
+	case "admin":
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		opt := rdns.AdminListenerOptions{
+			TLSConfig:      tlsConfig,
+			ListenOptions:  opt,
+			Transport:      l.Transport,
+			Graph:          admin.graph,
+			UpdateChecker:  admin.updateChecker,
+			Blocklists:     blocklists,
+			Unblock:        l.AllowUnblock,
+			UnblockToken:   l.UnblockToken,
+			UnblockOrigins: l.UnblockOrigins,
+			Stats:          queryStats,
+			Prometheus:     admin.prometheus,
+			Routers:        routers,
+			ChangeRoutes:   l.AllowRouteChanges,
+			RoutesToken:    l.RoutesToken,
+			Resolvers:      admin.resolvers,
+		}
+		ln, err := rdns.NewAdminListener(id, l.Address, opt)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "block-page":
+		var tlsConfig *tls.Config
+		if !l.NoTLS {
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			ln := rdns.NewDoTListener(id, l.Address, network, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "dtls":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
-			dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		}
+		opt := rdns.BlockPageListenerOptions{
+			TLSConfig:       tlsConfig,
+			ListenOptions:   opt,
+			NoTLS:           l.NoTLS,
+			UnblockURL:      l.UnblockURL,
+			UnblockDuration: time.Duration(l.UnblockDuration) * time.Second,
+		}
+		return rdns.NewBlockPageListener(id, l.Address, opt), nil
+	case "prometheus":
+		var tlsConfig *tls.Config
+		if !l.NoTLS {
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
-			}
-			ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "doh":
-			if l.Transport != "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
-			} else if l.Transport == "quic" {
-				l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
-			}
-			var tlsConfig *tls.Config
-			if l.NoTLS {
-				if l.Transport == "quic" {
-					return errors.New("no-tls is not supported for doh servers with quic transport")
-				}
-			} else {
-				tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
-				if err != nil {
-					return err
-				}
-			}
-			var httpProxyNet *net.IPNet
-			if l.Frontend.HTTPProxyNet != "" {
-				_, httpProxyNet, err = net.ParseCIDR(l.Frontend.HTTPProxyNet)
-				if err != nil {
-					return fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
-				}
+				return nil, err
 			}
-			opt := rdns.DoHListenerOptions{
-				TLSConfig:     tlsConfig,
-				ListenOptions: opt,
-				Transport:     l.Transport,
-				HTTPProxyNet:  httpProxyNet,
-				NoTLS:         l.NoTLS,
-			}
-			ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
-			if err != nil {
-				return err
+		}
+		opt := rdns.PrometheusListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			NoTLS:         l.NoTLS,
+			Exporter:      admin.prometheus,
+		}
+		return rdns.NewPrometheusListener(id, l.Address, opt), nil
+	case "mdns-reflector":
+		opt := rdns.MDNSReflectorOptions{
+			Interfaces: l.MDNSInterfaces,
+			Services:   l.MDNSServices,
+			IPVersion:  l.IPVersion,
+		}
+		ln, err := rdns.NewMDNSReflector(id, opt)
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
+		}
+		return ln, nil
+	case "dot":
+		network := networkForIPVersion("tcp", l.IPVersion)
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDoTListener(id, l.Address, network, rdns.DoTListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "dtls":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DTLSPort)
+		dtlsConfig, err := rdns.DTLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewDTLSListener(id, l.Address, rdns.DTLSListenerOptions{DTLSConfig: dtlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "doh":
+		if l.Transport != "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+		} else if l.Transport == "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DohQuicPort)
+		}
+		var tlsConfig *tls.Config
+		if l.NoTLS {
+			if l.Transport == "quic" {
+				return nil, errors.New("no-tls is not supported for doh servers with quic transport")
 			}
-			listeners = append(listeners, ln)
-		case "doq":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
-
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		} else {
+			tlsConfig, err = rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
-			listeners = append(listeners, ln)
-		case "odoh":
-			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
-			tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		}
+		var httpProxyNet *net.IPNet
+		if l.Frontend.HTTPProxyNet != "" {
+			httpProxyNet, err = rdns.ParseCIDR(l.Frontend.HTTPProxyNet)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("listener '%s' trusted-proxy '%s': %v", id, l.Frontend.HTTPProxyNet, err)
 			}
-			opt := rdns.ODoHListenerOptions{
-				TLSConfig:     tlsConfig,
-				KeySeed:       l.KeySeed,
-				OdohMode:      l.OdohMode,
-				AllowDoH:      l.AllowDoH,
-				ListenOptions: opt,
-			}
-			ln, err := rdns.NewODoHListener(id, l.Address, opt, resolver)
-			if err != nil {
-				return err
+		}
+		var resinfo *rdns.ResolverInfo
+		if l.ResInfo != "" {
+			r, ok := resInfos[l.ResInfo]
+			if !ok {
+				return nil, fmt.Errorf("listener '%s' references non-existent resinfo group '%s'", id, l.ResInfo)
 			}
-			listeners = append(listeners, ln)
-		default:
-			return fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
+			resinfo = r.Info()
+		}
+		opt := rdns.DoHListenerOptions{
+			TLSConfig:       tlsConfig,
+			ListenOptions:   opt,
+			Transport:       l.Transport,
+			HTTPProxyNet:    httpProxyNet,
+			NoTLS:           l.NoTLS,
+			HTTPCompression: l.HTTPCompression,
+			Related:         rdns.DoHRelatedMode(l.RelatedRecords),
+			ResolverInfo:    resinfo,
+		}
+		ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	case "doq":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		ln := rdns.NewQUICListener(id, l.Address, rdns.DoQListenerOptions{TLSConfig: tlsConfig, ListenOptions: opt}, resolver)
+		return ln, nil
+	case "auto":
+		if l.Transport == "quic" {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoQPort)
+		} else {
+			l.Address = rdns.AddressWithDefault(l.Address, rdns.DoTPort)
+		}
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		opt := rdns.AutoListenerOptions{
+			TLSConfig:     tlsConfig,
+			ListenOptions: opt,
+			Transport:     l.Transport,
+			Network:       networkForIPVersion("tcp", l.IPVersion),
+		}
+		ln, err := rdns.NewAutoListener(id, l.Address, opt, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("listener '%s': %w", id, err)
+		}
+		return ln, nil
+	case "odoh":
+		l.Address = rdns.AddressWithDefault(l.Address, rdns.DoHPort)
+		tlsConfig, err := rdns.TLSServerConfig(l.CA, l.ServerCrt, l.ServerKey, l.MutualTLS)
+		if err != nil {
+			return nil, err
+		}
+		opt := rdns.ODoHListenerOptions{
+			TLSConfig:     tlsConfig,
+			KeySeed:       l.KeySeed,
+			OdohMode:      l.OdohMode,
+			AllowDoH:      l.AllowDoH,
+			ListenOptions: opt,
 		}
+		ln, err := rdns.NewODoHListener(id, l.Address, opt, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s' for listener '%s'", l.Protocol, id)
 	}
+}
 
-	// Start the listeners
-	for _, l := range listeners {
-		go func(l rdns.Listener) {
-			for {
-				err := l.Start()
-				rdns.Log.Error("listener failed",
-					"error", err)
-				time.Sleep(time.Second)
-			}
-		}(l)
+// Returns the options common to all listeners.
+func listenOptions(id string, l listener, acls map[string]*rdns.ACL) (rdns.ListenOptions, error) {
+	allowedNet, err := parseCIDRList(l.AllowedNet)
+	if err != nil {
+		return rdns.ListenOptions{}, err
 	}
 
-	// Graceful shutdown
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	<-sig
-	rdns.Log.Info("stopping")
-	for _, f := range onClose {
-		f()
+	if l.IPVersion != 4 && l.IPVersion != 6 && l.IPVersion != 0 {
+		return rdns.ListenOptions{}, errors.New("ip-version must be 4 or 6")
 	}
 
-	return nil
+	opt := rdns.ListenOptions{
+		AllowedNet:     allowedNet,
+		MaxUDPSize:     l.MaxUDPSize,
+		Compression:    rdns.CompressionMode(l.Compression),
+		TruncatePolicy: rdns.TruncatePolicy(l.TruncatePolicy),
+		TCP:            tcpOptions(l.TCPFastOpen, l.TCPKeepAlive, l.TCPUserTimeout),
+		ClientGroups:   clientGroups,
+		Chaos: rdns.ChaosOptions{
+			Mode:     rdns.ChaosMode(l.Chaos),
+			Identity: l.ChaosIdentity,
+		},
+		ServerTiming: l.ServerTiming,
+		AcceptUpdate: l.AcceptUpdate,
+	}
+	switch opt.Compression {
+	case "", rdns.CompressionAuto, rdns.CompressionAlways, rdns.CompressionNever:
+	default:
+		return rdns.ListenOptions{}, fmt.Errorf("listener '%s' has unsupported compression '%s'", id, l.Compression)
+	}
+	switch opt.TruncatePolicy {
+	case "", rdns.TruncatePolicyFit, rdns.TruncatePolicyEmpty, rdns.TruncatePolicyNever:
+	default:
+		return rdns.ListenOptions{}, fmt.Errorf("listener '%s' has unsupported truncate-policy '%s'", id, l.TruncatePolicy)
+	}
+	switch opt.Chaos.Mode {
+	case "", rdns.ChaosRefuse, rdns.ChaosReveal, rdns.ChaosObscure, rdns.ChaosForward:
+	default:
+		return rdns.ListenOptions{}, fmt.Errorf("listener '%s' has unsupported chaos mode '%s'", id, l.Chaos)
+	}
+	if l.ACL != "" {
+		if len(l.AllowedNet) > 0 {
+			return rdns.ListenOptions{}, fmt.Errorf("listener '%s' can't use both 'acl' and 'allowed-net'", id)
+		}
+		acl, ok := acls[l.ACL]
+		if !ok {
+			return rdns.ListenOptions{}, fmt.Errorf("listener '%s' references non-existent acl '%s'", id, l.ACL)
+		}
+		opt.ACL = acl
+	}
+	return opt, nil
+}
+
+// Returns the TCP socket options of a listener or resolver. Times are in
+// seconds.
+func tcpOptions(fastOpen bool, keepAlive, userTimeout int) rdns.TCPOptions {
+	return rdns.TCPOptions{
+		FastOpen:    fastOpen,
+		KeepAlive:   time.Duration(keepAlive) * time.Second,
+		UserTimeout: time.Duration(userTimeout) * time.Second,
+	}
 }
 
 // Instantiate a group object based on configuration and add to the map of resolvers by ID.
@@ -361,6 +758,37 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		gr = append(gr, resolver)
 	}
+
+	// Modifiers only support one resolver. Combine multiple into one that
+	// picks a resolver for each query if a strategy is configured.
+	if g.Select != "" {
+		switch g.Type {
+		case "round-robin", "fail-rotate", "fail-back", "fastest", "random", "static-responder", "static-template", "drop":
+			return fmt.Errorf("type %s does not support 'select' in '%s'", g.Type, id)
+		}
+		opt := rdns.SelectorOptions{
+			Strategy:      rdns.SelectStrategy(g.Select),
+			Routes:        make(map[string]rdns.Resolver),
+			SubnetPrefix4: g.SubnetPrefix4,
+			SubnetPrefix6: g.SubnetPrefix6,
+		}
+		for listenerID, rid := range g.SelectRoutes {
+			if !slices.Contains(g.Resolvers, rid) {
+				return fmt.Errorf("select-routes in '%s' references resolver '%s' that is not in the list of resolvers", id, rid)
+			}
+			opt.Routes[listenerID] = resolvers[rid]
+		}
+		selector, err := rdns.NewSelector(id, opt, gr...)
+		if err != nil {
+			return fmt.Errorf("failed to configure '%s': %w", id, err)
+		}
+		gr = []rdns.Resolver{selector}
+	}
+
+	if singleResolverTypes[g.Type] && len(gr) != 1 {
+		return fmt.Errorf("type %s only supports one resolver in '%s'", g.Type, id)
+	}
+
 	switch g.Type {
 	case "round-robin":
 		resolvers[id] = rdns.NewRoundRobin(id, gr...)
@@ -368,44 +796,59 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		opt := rdns.FailRotateOptions{
 			ServfailError: g.ServfailError,
 		}
-		resolvers[id] = rdns.NewFailRotate(id, opt, gr...)
+		group := rdns.NewFailRotate(id, opt, gr...)
+		haGroups[id] = group
+		resolvers[id] = group
 	case "fail-back":
 		opt := rdns.FailBackOptions{
 			ResetAfter:    time.Duration(time.Duration(g.ResetAfter) * time.Second),
 			ServfailError: g.ServfailError,
 		}
-		resolvers[id] = rdns.NewFailBack(id, opt, gr...)
+		group := rdns.NewFailBack(id, opt, gr...)
+		onClose = append(onClose, func() { group.Close() })
+		haGroups[id] = group
+		resolvers[id] = group
 	case "fastest":
 		resolvers[id] = rdns.NewFastest(id, gr...)
 	case "random":
 		opt := rdns.RandomOptions{
-			ResetAfter:    time.Duration(time.Duration(g.ResetAfter) * time.Second),
-			ServfailError: g.ServfailError,
+			ResetAfter:     time.Duration(time.Duration(g.ResetAfter) * time.Second),
+			ServfailError:  g.ServfailError,
+			SubnetAffinity: g.SubnetAffinity,
+			SubnetPrefix4:  g.SubnetPrefix4,
+			SubnetPrefix6:  g.SubnetPrefix6,
 		}
 		resolvers[id] = rdns.NewRandom(id, opt, gr...)
 	case "blocklist":
-		if len(gr) != 1 {
-			return fmt.Errorf("type blocklist only supports one resolver in '%s'", id)
-		}
 		if len(g.Blocklist) > 0 && g.Source != "" {
 			return fmt.Errorf("static blocklist can't be used with 'source' in '%s'", id)
 		}
-		blocklistDB, err := newBlocklistDB(list{Name: id, Format: g.Format, Source: g.Source}, g.Blocklist)
+		blocklistDB, err := newBlocklistDB(withGuard(id, g, list{Name: id, Format: g.Format, Source: g.Source}), g.Blocklist)
 		if err != nil {
 			return err
 		}
+		blockPageIPs, err := parseBlockPageIPs(g.BlockPageIP)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		observeNets, err := parseCIDRList(g.ObserveNet)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.BlocklistOptions{
 			BlocklistDB:      blocklistDB,
 			BlocklistRefresh: time.Duration(g.Refresh) * time.Second,
+			BlockPageIPs:     blockPageIPs,
+			ObserveNets:      observeNets,
 		}
-		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
+		blocklist, err := rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		onClose = append(onClose, func() { blocklist.Close() })
+		resolvers[id] = blocklist
+		blocklists[id] = blocklist
 	case "blocklist-v2":
-		if len(gr) != 1 {
-			return fmt.Errorf("type blocklist-v2 only supports one resolver in '%s'", id)
-		}
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'source' in '%s'", id)
 		}
@@ -419,13 +862,11 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
+			dbs, err := loadLists(id, g.BlocklistSource, func(s list) (rdns.BlocklistDB, error) {
+				return newBlocklistDB(withGuard(id, g, s), nil)
+			}, backgroundDB)
+			if err != nil {
+				return err
 			}
 			blocklistDB, err = rdns.NewMultiDB(dbs...)
 			if err != nil {
@@ -439,13 +880,11 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.AllowlistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
+			dbs, err := loadLists(id, g.AllowlistSource, func(s list) (rdns.BlocklistDB, error) {
+				return newBlocklistDB(withGuard(id, g, s), nil)
+			}, backgroundDB)
+			if err != nil {
+				return err
 			}
 			allowlistDB, err = rdns.NewMultiDB(dbs...)
 			if err != nil {
@@ -456,6 +895,14 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return fmt.Errorf("failed to parse edn0 template in %q: %w", id, err)
 		}
+		blockPageIPs, err := parseBlockPageIPs(g.BlockPageIP)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		observeNets, err := parseCIDRList(g.ObserveNet)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.BlocklistOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
@@ -464,23 +911,25 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowlistDB:       allowlistDB,
 			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
 			EDNS0EDETemplate:  edeTpl,
+			BlockPageIPs:      blockPageIPs,
+			CNAMEChain:        g.CNAMEChain,
+			CNAMEMaxDepth:     g.CNAMEMaxDepth,
+			BlockReverse:      g.BlockReverse,
+			ObserveNets:       observeNets,
 		}
-		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
+		blocklist, err := rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		onClose = append(onClose, func() { blocklist.Close() })
+		resolvers[id] = blocklist
+		blocklists[id] = blocklist
 	case "replace":
-		if len(gr) != 1 {
-			return fmt.Errorf("type replace only supports one resolver in '%s'", id)
-		}
 		resolvers[id], err = rdns.NewReplace(id, gr[0], g.Replace...)
 		if err != nil {
 			return err
 		}
 	case "ttl-modifier":
-		if len(gr) != 1 {
-			return fmt.Errorf("type ttl-modifier only supports one resolver in '%s'", id)
-		}
 		var selectFunc rdns.TTLSelectFunc
 		switch g.TTLSelect {
 		case "lowest":
@@ -506,9 +955,6 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		resolvers[id] = rdns.NewTTLModifier(id, gr[0], opt)
 	case "truncate-retry":
-		if len(gr) != 1 {
-			return fmt.Errorf("type truncate-retry only supports one resolver in '%s'", id)
-		}
 		retryResolver := resolvers[g.RetryResolver]
 		if retryResolver == nil {
 			return errors.New("type truncate-retry requires 'retry-resolver' option")
@@ -516,24 +962,26 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		opt := rdns.TruncateRetryOptions{}
 		resolvers[id] = rdns.NewTruncateRetry(id, gr[0], retryResolver, opt)
 	case "request-dedup":
-		if len(gr) != 1 {
-			return fmt.Errorf("type request-dedup only supports one resolver in '%s'", id)
-		}
 		resolvers[id] = rdns.NewRequestDedup(id, gr[0])
 	case "fastest-tcp":
-		if len(gr) != 1 {
-			return fmt.Errorf("type fastest-tcp only supports one resolver in '%s'", id)
-		}
 		opt := rdns.FastestTCPOptions{
 			Port:          g.Port,
 			WaitAll:       g.WaitAll,
 			SuccessTTLMin: g.SuccessTTLMin,
 		}
 		resolvers[id] = rdns.NewFastestTCP(id, gr[0], opt)
-	case "ecs-modifier":
-		if len(gr) != 1 {
-			return fmt.Errorf("type ecs-modifier only supports one resolver in '%s'", id)
+	case "response-clamp":
+		opt := rdns.ResponseClampOptions{
+			MaxAnswers: g.ClampMaxAnswers,
+			MaxSize:    g.ClampMaxSize,
+			Policy:     rdns.ResponseClampPolicy(g.ClampPolicy),
+			Port:       g.Port,
+		}
+		resolvers[id], err = rdns.NewResponseClamp(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'response-clamp': %w", err)
 		}
+	case "ecs-modifier":
 		var f rdns.ECSModifierFunc
 		switch g.ECSOp {
 		case "add":
@@ -553,9 +1001,6 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return err
 		}
 	case "edns0-modifier":
-		if len(gr) != 1 {
-			return fmt.Errorf("type edns0-modifier only supports one resolver in '%s'", id)
-		}
 		var f rdns.EDNS0ModifierFunc
 		switch g.EDNS0Op {
 		case "add":
@@ -571,9 +1016,6 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return err
 		}
 	case "syslog":
-		if len(gr) != 1 {
-			return fmt.Errorf("type syslog only supports one resolver in '%s'", id)
-		}
 		var priority int
 		switch g.Priority {
 		case "emergency", "":
@@ -595,6 +1037,10 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		default:
 			return fmt.Errorf("unsupported syslog priority %q", g.Priority)
 		}
+		redaction, err := logRedaction(id, g)
+		if err != nil {
+			return err
+		}
 		opt := rdns.SyslogOptions{
 			Network:     g.Network,
 			Address:     g.Address,
@@ -603,6 +1049,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			LogRequest:  g.LogRequest,
 			LogResponse: g.LogResponse,
 			Verbose:     g.Verbose,
+			Redaction:   redaction,
 		}
 		resolvers[id] = rdns.NewSyslog(id, gr[0], opt)
 	case "cache":
@@ -626,61 +1073,54 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			cacheRcodeMaxTTL[code] = v
 		}
 
+		var cacheSkipNetworks []*net.IPNet
+		for _, s := range g.CacheSkipNetworks {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("failed to parse cache-skip-networks: %w", err)
+			}
+			cacheSkipNetworks = append(cacheSkipNetworks, n)
+		}
+
 		opt := rdns.CacheOptions{
-			GCPeriod:            time.Duration(g.GCPeriod) * time.Second,
-			Capacity:            g.CacheSize,
-			NegativeTTL:         g.CacheNegativeTTL,
-			CacheRcodeMaxTTL:    cacheRcodeMaxTTL,
-			ShuffleAnswerFunc:   shuffleFunc,
-			HardenBelowNXDOMAIN: g.CacheHardenBelowNXDOMAIN,
-			FlushQuery:          g.CacheFlushQuery,
-			PrefetchTrigger:     g.PrefetchTrigger,
-			PrefetchEligible:    g.PrefetchEligible,
+			GCPeriod:             time.Duration(g.GCPeriod) * time.Second,
+			Capacity:             g.CacheSize,
+			NegativeTTL:          g.CacheNegativeTTL,
+			CacheRcodeMaxTTL:     cacheRcodeMaxTTL,
+			ShuffleAnswerFunc:    shuffleFunc,
+			HardenBelowNXDOMAIN:  g.CacheHardenBelowNXDOMAIN,
+			FlushQuery:           g.CacheFlushQuery,
+			PrefetchTrigger:      g.PrefetchTrigger,
+			PrefetchEligible:     g.PrefetchEligible,
+			FlushOnNetworkChange: g.CacheFlushOnNetworkChange,
+			FlushZones:           g.CacheFlushZones,
+			ErrorBackoff: rdns.CacheErrorBackoffOptions{
+				Initial: time.Duration(g.CacheErrorBackoff) * time.Second,
+				Max:     time.Duration(g.CacheErrorBackoffMax) * time.Second,
+			},
+			Key: rdns.CacheKeyOptions{
+				IgnoreCase:    g.CacheKeyIgnoreCase,
+				CD:            g.CacheKeyCD,
+				IgnoreDO:      g.CacheKeyIgnoreDO,
+				IgnoreECSZero: g.CacheKeyIgnoreECSZero,
+			},
+			Skip: rdns.CacheSkipOptions{
+				Rcodes:    g.CacheSkipRcodes,
+				Networks:  cacheSkipNetworks,
+				ZeroTTL:   g.CacheSkipZeroTTL,
+				Resolvers: g.CacheSkipResolvers,
+			},
 		}
 		if g.Backend != nil {
-			var backend rdns.CacheBackend
-			switch g.Backend.Type {
-			case "memory":
-				backend = rdns.NewMemoryBackend(rdns.MemoryBackendOptions{
-					Capacity:     g.Backend.Size,
-					GCPeriod:     time.Duration(g.Backend.GCPeriod) * time.Second,
-					Filename:     g.Backend.Filename,
-					SaveInterval: time.Duration(g.Backend.SaveInterval) * time.Second,
-				})
-				onClose = append(onClose, func() { backend.Close() })
-			case "redis":
-				minRetryBackoff := time.Duration(g.Backend.RedisMinRetryBackoff) * time.Millisecond
-				if g.Backend.RedisMinRetryBackoff == -1 {
-					minRetryBackoff = -1
-				}
-				maxRetryBackoff := time.Duration(g.Backend.RedisMaxRetryBackoff) * time.Millisecond
-				if g.Backend.RedisMaxRetryBackoff == -1 {
-					maxRetryBackoff = -1
-				}
-				backend = rdns.NewRedisBackend(rdns.RedisBackendOptions{
-					RedisOptions: redis.Options{
-						Network:               g.Backend.RedisNetwork,
-						Addr:                  g.Backend.RedisAddress,
-						Username:              g.Backend.RedisUsername,
-						Password:              g.Backend.RedisPassword,
-						DB:                    g.Backend.RedisDB,
-						ContextTimeoutEnabled: true,
-						MaxRetries:            g.Backend.RedisMaxRetries,
-						MinRetryBackoff:       minRetryBackoff,
-						MaxRetryBackoff:       maxRetryBackoff,
-					},
-					KeyPrefix: g.Backend.RedisKeyPrefix,
-				})
-			default:
-				return fmt.Errorf("unsupported cache backend %q", g.Backend.Type)
-			}
-			opt.Backend = backend
-		}
-		resolvers[id] = rdns.NewCache(id, gr[0], opt)
-	case "response-blocklist-ip", "response-blocklist-cidr": // "response-blocklist-cidr" has been retired/renamed to "response-blocklist-ip"
-		if len(gr) != 1 {
-			return fmt.Errorf("type response-blocklist-ip only supports one resolver in '%s'", id)
+			opt.Backend, err = instantiateCacheBackend(id, g.Backend)
+			if err != nil {
+				return err
+			}
 		}
+		cache := rdns.NewCache(id, gr[0], opt)
+		onClose = append(onClose, func() { cache.Close() })
+		resolvers[id] = cache
+	case "response-blocklist-ip", "response-blocklist-cidr": // "response-blocklist-cidr" has been retired/renamed to "response-blocklist-ip"
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
 		}
@@ -691,13 +1131,11 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.IPBlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
+			dbs, err := loadLists(id, g.BlocklistSource, func(s list) (rdns.IPBlocklistDB, error) {
+				return newIPBlocklistDB(withGuard(id, g, s), g.LocationDB, nil)
+			}, backgroundIPDB)
+			if err != nil {
+				return err
 			}
 			blocklistDB, err = rdns.NewMultiIPDB(dbs...)
 			if err != nil {
@@ -716,14 +1154,13 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Inverted:          g.Inverted,
 			EDNS0EDETemplate:  edeTpl,
 		}
-		resolvers[id], err = rdns.NewResponseBlocklistIP(id, gr[0], opt)
+		blocklist, err := rdns.NewResponseBlocklistIP(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		onClose = append(onClose, func() { blocklist.Close() })
+		resolvers[id] = blocklist
 	case "response-blocklist-name":
-		if len(gr) != 1 {
-			return fmt.Errorf("type response-blocklist-name only supports one resolver in '%s'", id)
-		}
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
 		}
@@ -734,13 +1171,11 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.BlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newBlocklistDB(s, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
+			dbs, err := loadLists(id, g.BlocklistSource, func(s list) (rdns.BlocklistDB, error) {
+				return newBlocklistDB(withGuard(id, g, s), nil)
+			}, backgroundDB)
+			if err != nil {
+				return err
 			}
 			blocklistDB, err = rdns.NewMultiDB(dbs...)
 			if err != nil {
@@ -752,15 +1187,16 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
 			Inverted:          g.Inverted,
+			CNAMEChain:        g.CNAMEChain,
+			CNAMEMaxDepth:     g.CNAMEMaxDepth,
 		}
-		resolvers[id], err = rdns.NewResponseBlocklistName(id, gr[0], opt)
+		blocklist, err := rdns.NewResponseBlocklistName(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		onClose = append(onClose, func() { blocklist.Close() })
+		resolvers[id] = blocklist
 	case "client-blocklist":
-		if len(gr) != 1 {
-			return fmt.Errorf("type client-blocklist only supports one resolver in '%s'", id)
-		}
 		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
 			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
 		}
@@ -771,29 +1207,34 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 				return err
 			}
 		} else {
-			var dbs []rdns.IPBlocklistDB
-			for _, s := range g.BlocklistSource {
-				db, err := newIPBlocklistDB(s, g.LocationDB, nil)
-				if err != nil {
-					return fmt.Errorf("%s: %w", id, err)
-				}
-				dbs = append(dbs, db)
+			dbs, err := loadLists(id, g.BlocklistSource, func(s list) (rdns.IPBlocklistDB, error) {
+				return newIPBlocklistDB(withGuard(id, g, s), g.LocationDB, nil)
+			}, backgroundIPDB)
+			if err != nil {
+				return err
 			}
 			blocklistDB, err = rdns.NewMultiIPDB(dbs...)
 			if err != nil {
 				return err
 			}
 		}
+		observeNets, err := parseCIDRList(g.ObserveNet)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
 		opt := rdns.ClientBlocklistOptions{
 			BlocklistResolver: resolvers[g.BlockListResolver],
 			BlocklistDB:       blocklistDB,
 			BlocklistRefresh:  time.Duration(g.BlocklistRefresh) * time.Second,
 			UseECS:            g.UseECS,
+			ObserveNets:       observeNets,
 		}
-		resolvers[id], err = rdns.NewClientBlocklist(id, gr[0], opt)
+		blocklist, err := rdns.NewClientBlocklist(id, gr[0], opt)
 		if err != nil {
 			return err
 		}
+		onClose = append(onClose, func() { blocklist.Close() })
+		resolvers[id] = blocklist
 
 	case "static-responder":
 		edeTpl, err := rdns.NewEDNS0EDETemplate(g.EDNS0EDE.Code, g.EDNS0EDE.Text)
@@ -830,14 +1271,8 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return err
 		}
 	case "response-minimize":
-		if len(gr) != 1 {
-			return fmt.Errorf("type response-minimize only supports one resolver in '%s'", id)
-		}
 		resolvers[id] = rdns.NewResponseMinimize(id, gr[0])
 	case "response-collapse":
-		if len(gr) != 1 {
-			return fmt.Errorf("type response-collapse only supports one resolver in '%s'", id)
-		}
 		opt := rdns.ResponseCollapseOptions{
 			NullRCode: g.NullRCode,
 		}
@@ -845,9 +1280,6 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 	case "drop":
 		resolvers[id] = rdns.NewDropResolver(id)
 	case "rate-limiter":
-		if len(gr) != 1 {
-			return fmt.Errorf("type rate-limiter only supports one resolver in '%s'", id)
-		}
 		opt := rdns.RateLimiterOptions{
 			Requests:      g.Requests,
 			Window:        g.Window,
@@ -855,25 +1287,504 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Prefix6:       g.Prefix6,
 			LimitResolver: resolvers[g.LimitResolver],
 		}
+		if g.LimitStore != nil {
+			if g.LimitStore.Type != "redis" {
+				return fmt.Errorf("unsupported limit-store type '%s' in '%s', only 'redis' is supported", g.LimitStore.Type, id)
+			}
+			store := rdns.NewRedisRateLimiterStore(rdns.RedisRateLimiterStoreOptions{
+				RedisOptions: redisOptions(g.LimitStore),
+				KeyPrefix:    g.LimitStore.RedisKeyPrefix,
+			})
+			onClose = append(onClose, func() { store.Close() })
+			opt.Store = store
+		}
 		resolvers[id] = rdns.NewRateLimiter(id, gr[0], opt)
 	case "query-log":
-		if len(gr) != 1 {
-			return fmt.Errorf("type query-log only supports one resolver in '%s'", id)
+		redaction, err := logRedaction(id, g)
+		if err != nil {
+			return err
 		}
 		opt := rdns.QueryLogResolverOptions{
 			OutputFile:   g.OutputFile,
 			OutputFormat: rdns.LogFormat(g.OutputFormat),
+			MaxSize:      g.OutputMaxSize * 1024 * 1024,
+			MaxFiles:     g.OutputMaxFiles,
+			Redaction:    redaction,
 		}
-		resolvers[id], err = rdns.NewQueryLogResolver(id, gr[0], opt)
+		queryLog, err := rdns.NewQueryLogResolver(id, gr[0], opt)
 		if err != nil {
 			return fmt.Errorf("failed to initialize 'query-log': %w", err)
 		}
+		onClose = append(onClose, func() { queryLog.Close() })
+		resolvers[id] = queryLog
+	case "query-stats":
+		opt := rdns.QueryStatsOptions{
+			Filename:        g.StatsFile,
+			SaveInterval:    time.Duration(g.StatsSaveInterval) * time.Second,
+			HourlyRetention: g.StatsHourlyRetention,
+			DailyRetention:  g.StatsDailyRetention,
+			MaxEntries:      g.StatsMaxEntries,
+		}
+		stats, err := rdns.NewQueryStats(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'query-stats': %w", err)
+		}
+		onClose = append(onClose, func() { stats.Close() })
+		queryStats[id] = stats
+		resolvers[id] = stats
+	case "popularity-export":
+		opt := rdns.PopularityExportOptions{
+			URL:        g.PopularityURL,
+			Interval:   time.Duration(g.PopularityInterval) * time.Second,
+			K:          g.PopularityK,
+			HashKey:    g.PopularityHashKey,
+			MaxEntries: g.PopularityMaxEntries,
+		}
+		export, err := rdns.NewPopularityExport(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'popularity-export': %w", err)
+		}
+		onClose = append(onClose, func() { export.Close() })
+		resolvers[id] = export
+	case "pcap":
+		opt := rdns.PCAPWriterOptions{
+			OutputFile: g.OutputFile,
+			SampleRate: g.PCAPSampleRate,
+			MaxSize:    g.PCAPMaxSize * 1024 * 1024,
+			MaxFiles:   g.PCAPMaxFiles,
+		}
+		pcap, err := rdns.NewPCAPWriter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'pcap': %w", err)
+		}
+		onClose = append(onClose, func() { pcap.Close() })
+		resolvers[id] = pcap
+	case "special-use":
+		opt := rdns.SpecialUseOptions{
+			Overrides: make(map[string]rdns.SpecialUseAction),
+		}
+		for zone, action := range g.SpecialUseZones {
+			opt.Overrides[zone] = rdns.SpecialUseAction(action)
+		}
+		resolvers[id], err = rdns.NewSpecialUse(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'special-use': %w", err)
+		}
+	case "search-domain":
+		opt := rdns.SearchDomainOptions{
+			Domains:  g.SearchDomains,
+			Suffixes: g.SearchSuffixes,
+		}
+		resolvers[id], err = rdns.NewSearchDomain(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'search-domain': %w", err)
+		}
+	case "response-rewrite":
+		var opt rdns.ResponseRewriteOptions
+		for from, to := range g.RewriteAddresses {
+			_, fromNet, err := net.ParseCIDR(from)
+			if err != nil {
+				return fmt.Errorf("invalid network in rewrite-addresses of '%s': %w", id, err)
+			}
+			_, toNet, err := net.ParseCIDR(to)
+			if err != nil {
+				return fmt.Errorf("invalid network in rewrite-addresses of '%s': %w", id, err)
+			}
+			opt.Addresses = append(opt.Addresses, rdns.AddressMapping{From: fromNet, To: toNet})
+		}
+		for from, to := range g.RewriteNames {
+			opt.Names = append(opt.Names, rdns.NameMapping{From: from, To: to})
+		}
+		resolvers[id], err = rdns.NewResponseRewrite(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'response-rewrite': %w", err)
+		}
+	case "resinfo":
+		opt := rdns.ResInfoOptions{
+			ResolverInfo: rdns.ResolverInfo{
+				QNameMinimization: g.ResInfoQNameMinimization,
+				ExtendedErrors:    g.ResInfoExtendedErrors,
+				InfoURL:           g.ResInfoInfoURL,
+				Filtering:         g.ResInfoFiltering,
+			},
+			Names: g.ResInfoNames,
+		}
+		resinfo, err := rdns.NewResInfo(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'resinfo': %w", err)
+		}
+		resInfos[id] = resinfo
+		resolvers[id] = resinfo
+	case "homograph-detector":
+		opt := rdns.HomographDetectorOptions{
+			Domains: g.HomographDomains,
+			Block:   g.HomographBlock,
+		}
+		resolvers[id], err = rdns.NewHomographDetector(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'homograph-detector': %w", err)
+		}
+	case "dnssec-monitor":
+		if len(g.MonitorZones) == 0 {
+			return fmt.Errorf("no zones to monitor in '%s'", id)
+		}
+		opt := rdns.DNSSECMonitorOptions{
+			Zones:         g.MonitorZones,
+			Interval:      time.Duration(g.MonitorInterval) * time.Second,
+			ExpiryWarning: time.Duration(g.MonitorExpiryWarning) * time.Second,
+		}
+		monitor := rdns.NewDNSSECMonitor(id, gr[0], opt)
+		onClose = append(onClose, func() { monitor.Close() })
+		resolvers[id] = monitor
+	case "dnssec":
+		opt := rdns.DNSSECValidatorOptions{
+			KeyCacheTTL: time.Duration(g.KeyCacheTTL) * time.Second,
+		}
+		for _, s := range g.TrustAnchors {
+			ds, err := rdns.ParseTrustAnchor(s)
+			if err != nil {
+				return fmt.Errorf("invalid trust anchor in '%s': %w", id, err)
+			}
+			opt.TrustAnchors = append(opt.TrustAnchors, ds)
+		}
+		if g.TrustAnchorFile != "" {
+			anchors, err := rdns.LoadTrustAnchorFile(g.TrustAnchorFile, time.Now())
+			if err != nil {
+				return err
+			}
+			opt.TrustAnchors = append(opt.TrustAnchors, anchors...)
+		}
+		resolvers[id], err = rdns.NewDNSSECValidator(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'dnssec': %w", err)
+		}
+	case "header-flags":
+		opt := rdns.HeaderFlagsOptions{
+			ClearAA:      g.FlagsClearAA,
+			RA:           rdns.HeaderFlagAction(g.FlagsRA),
+			RAByListener: make(map[string]rdns.HeaderFlagAction),
+			AD:           rdns.HeaderFlagADPolicy(g.FlagsAD),
+			CD:           rdns.HeaderFlagAction(g.FlagsCD),
+		}
+		for listener, action := range g.FlagsRAListeners {
+			opt.RAByListener[listener] = rdns.HeaderFlagAction(action)
+		}
+		resolvers[id], err = rdns.NewHeaderFlags(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'header-flags': %w", err)
+		}
+	case "query-validator":
+		opt := rdns.QueryValidatorOptions{
+			Rcode:               g.ValidatorRcode,
+			RejectReservedTypes: g.ValidatorRejectReserved,
+		}
+		resolvers[id], err = rdns.NewQueryValidator(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'query-validator': %w", err)
+		}
+	case "require-encrypted":
+		opt := rdns.RequireEncryptedOptions{
+			Zones: g.RequireEncryptedZones,
+		}
+		if g.PlaintextResolver != "" {
+			resolver, ok := resolvers[g.PlaintextResolver]
+			if !ok {
+				return fmt.Errorf("require-encrypted '%s' references non-existent resolver or group '%s'", id, g.PlaintextResolver)
+			}
+			opt.PlaintextResolver = resolver
+		}
+		resolvers[id] = rdns.NewRequireEncrypted(id, gr[0], opt)
+	case "circuit-breaker":
+		opt := rdns.CircuitBreakerOptions{
+			Threshold:     g.BreakerThreshold,
+			Cooldown:      time.Duration(g.BreakerCooldown) * time.Second,
+			ServfailError: g.ServfailError,
+		}
+		if g.BreakerResolver != "" {
+			resolver, ok := resolvers[g.BreakerResolver]
+			if !ok {
+				return fmt.Errorf("circuit-breaker '%s' references non-existent resolver or group '%s'", id, g.BreakerResolver)
+			}
+			opt.FallbackResolver = resolver
+		}
+		resolvers[id] = rdns.NewCircuitBreaker(id, gr[0], opt)
+	case "concurrency-limiter":
+		opt := rdns.ConcurrencyLimiterOptions{
+			Limit:        g.ConcurrencyLimit,
+			QueueSize:    g.ConcurrencyQueue,
+			QueueTimeout: time.Duration(g.ConcurrencyQueueTimeout) * time.Millisecond,
+			Overflow:     rdns.ConcurrencyOverflow(g.ConcurrencyOverflow),
+		}
+		if g.ConcurrencyResolver != "" {
+			resolver, ok := resolvers[g.ConcurrencyResolver]
+			if !ok {
+				return fmt.Errorf("concurrency-limiter '%s' references non-existent resolver or group '%s'", id, g.ConcurrencyResolver)
+			}
+			opt.FallbackResolver = resolver
+		}
+		resolvers[id], err = rdns.NewConcurrencyLimiter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'concurrency-limiter': %w", err)
+		}
+	case "query-budget":
+		opt := rdns.QueryBudgetOptions{
+			Daily:     g.BudgetDaily,
+			Monthly:   g.BudgetMonthly,
+			Exhausted: rdns.QueryBudgetAction(g.BudgetExhausted),
+			StaleTTL:  time.Duration(g.BudgetStaleTTL) * time.Second,
+			Filename:  g.BudgetFile,
+		}
+		if g.BudgetResolver != "" {
+			resolver, ok := resolvers[g.BudgetResolver]
+			if !ok {
+				return fmt.Errorf("query-budget '%s' references non-existent resolver or group '%s'", id, g.BudgetResolver)
+			}
+			opt.FailoverResolver = resolver
+		}
+		if g.BudgetBackend != nil {
+			opt.Backend, err = instantiateCacheBackend(id, g.BudgetBackend)
+			if err != nil {
+				return err
+			}
+		}
+		budget, err := rdns.NewQueryBudget(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'query-budget': %w", err)
+		}
+		onClose = append(onClose, func() { budget.Close() })
+		resolvers[id] = budget
+	case "response-router":
+		var opt rdns.ResponseRouterOptions
+		for _, route := range g.ResponseRoutes {
+			resolver, ok := resolvers[route.Resolver]
+			if !ok {
+				return fmt.Errorf("response-router '%s' references non-existent resolver or group '%s'", id, route.Resolver)
+			}
+			opt.Routes = append(opt.Routes, rdns.ResponseRoute{
+				Rcodes:      route.Rcodes,
+				AnswerCount: route.AnswerCount,
+				Flags:       route.Flags,
+				Error:       route.Error,
+				CNAME:       route.CNAME,
+				Resolver:    resolver,
+			})
+		}
+		resolvers[id], err = rdns.NewResponseRouter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'response-router': %w", err)
+		}
+	case "hosts":
+		opt := rdns.HostsResolverOptions{
+			Files: g.HostsFiles,
+			TTL:   g.HostsTTL,
+		}
+		hosts, err := rdns.NewHostsResolver(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'hosts': %w", err)
+		}
+		onClose = append(onClose, func() { hosts.Close() })
+		resolvers[id] = hosts
+	case "http-api":
+		if len(gr) > 1 {
+			return fmt.Errorf("type http-api only supports one resolver in '%s'", id)
+		}
+		var resolver rdns.Resolver
+		if len(gr) == 1 {
+			resolver = gr[0]
+		}
+		opt := rdns.HTTPAPIOptions{
+			URL:       g.HTTPAPIURL,
+			Headers:   g.HTTPAPIHeaders,
+			Timeout:   time.Duration(g.HTTPAPITimeout) * time.Second,
+			TTL:       g.HTTPAPITTL,
+			CacheSize: g.HTTPAPICacheSize,
+		}
+		resolvers[id], err = rdns.NewHTTPAPI(id, resolver, opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'http-api': %w", err)
+		}
+	case "catalog-zone":
+		opt := rdns.CatalogZoneOptions{
+			Zone:           g.CatalogZone,
+			Primary:        rdns.AddressWithDefault(g.CatalogPrimary, rdns.PlainDNSPort),
+			MemberResolver: resolvers[g.CatalogResolver],
+			Refresh:        time.Duration(g.CatalogRefresh) * time.Second,
+			TSIGName:       g.CatalogTSIGName,
+			TSIGSecret:     g.CatalogTSIGSecret,
+			TSIGAlgorithm:  g.CatalogTSIGAlgorithm,
+		}
+		catalog, err := rdns.NewCatalogZone(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'catalog-zone': %w", err)
+		}
+		onClose = append(onClose, func() { catalog.Close() })
+		resolvers[id] = catalog
+	case "kubernetes":
+		opt := rdns.KubernetesOptions{
+			Server:        g.KubernetesServer,
+			TokenFile:     g.KubernetesTokenFile,
+			CAFile:        g.KubernetesCA,
+			ClientCrtFile: g.KubernetesClientCrt,
+			ClientKeyFile: g.KubernetesClientKey,
+			Domain:        g.KubernetesDomain,
+			Namespaces:    g.KubernetesNamespaces,
+			LabelSelector: g.KubernetesLabelSelector,
+			PodRecords:    g.KubernetesPodRecords,
+			TTL:           g.KubernetesTTL,
+		}
+		k, err := rdns.NewKubernetes(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("failed to initialize 'kubernetes': %w", err)
+		}
+		onClose = append(onClose, func() { k.Close() })
+		resolvers[id] = k
+	case "https-synth":
+		opt := rdns.HTTPSSynthOptions{
+			NODATA:     g.HTTPSNODATA,
+			Synthesize: g.HTTPSSynthesize,
+		}
+		resolvers[id] = rdns.NewHTTPSSynth(id, gr[0], opt)
 	default:
 		return fmt.Errorf("unsupported group type '%s' for group '%s'", g.Type, id)
 	}
 	return nil
 }
 
+// Starts the coordination with the other instance of an active-standby pair
+// and marks the listeners it manages.
+func startHACoordinator(config config, listeners map[string]*runningListener) (*rdns.HACoordinator, error) {
+	managed := make(map[string]bool)
+	if len(config.HA.Listeners) > 0 {
+		for _, id := range config.HA.Listeners {
+			if _, ok := config.Listeners[id]; !ok {
+				return nil, fmt.Errorf("ha references non-existent listener '%s'", id)
+			}
+			managed[id] = true
+		}
+	} else {
+		for id, l := range config.Listeners {
+			managed[id] = l.Protocol != "admin" && l.Protocol != "prometheus"
+		}
+	}
+	var (
+		opt          rdns.HACoordinatorOptions
+		waitForLists bool
+	)
+	for id, l := range listeners {
+		if !managed[id] {
+			continue
+		}
+		sl, ok := l.ln.(rdns.StoppableListener)
+		if !ok {
+			return nil, fmt.Errorf("listener '%s' can't be managed by ha", id)
+		}
+		l.managed = true
+		opt.Listeners = append(opt.Listeners, sl)
+		waitForLists = waitForLists || config.Listeners[id].WaitForLists
+	}
+
+	var err error
+	if config.HA.PeerCA != "" {
+		opt.TLSConfig, err = rdns.TLSClientConfig(config.HA.PeerCA, "", "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b := config.HA.StateStore; b != nil {
+		if b.Type != "redis" {
+			return nil, fmt.Errorf("unsupported ha state-store type '%s', only 'redis' is supported", b.Type)
+		}
+		store := rdns.NewRedisBackend(rdns.RedisBackendOptions{
+			RedisOptions: redisOptions(b),
+			KeyPrefix:    b.RedisKeyPrefix,
+		})
+		onClose = append(onClose, func() { store.Close() })
+		opt.StateStore = store
+		opt.Groups = haGroups
+	}
+	opt.Role = config.HA.Role
+	opt.PeerURL = config.HA.PeerURL
+	opt.Interval = time.Duration(config.HA.Interval) * time.Second
+	opt.Failures = config.HA.Failures
+	opt.OnActive = config.HA.OnActive
+	opt.OnStandby = config.HA.OnStandby
+	c, err := rdns.NewHACoordinator("ha", opt)
+	if err != nil {
+		return nil, fmt.Errorf("ha: %w", err)
+	}
+	go func() {
+		if waitForLists {
+			rdns.WaitForLists()
+		}
+		c.Run()
+	}()
+	return c, nil
+}
+
+// Instantiate a cache backend from its configuration.
+func instantiateCacheBackend(id string, b *cacheBackend) (rdns.CacheBackend, error) {
+	var backend rdns.CacheBackend
+	switch b.Type {
+	case "memory":
+		backend = rdns.NewMemoryBackend(rdns.MemoryBackendOptions{
+			Capacity:     b.Size,
+			MaxMemory:    b.MaxMemory << 20,
+			Shards:       b.Shards,
+			GCPeriod:     time.Duration(b.GCPeriod) * time.Second,
+			Filename:     b.Filename,
+			SaveInterval: time.Duration(b.SaveInterval) * time.Second,
+			Journal:      b.Journal,
+		})
+		onClose = append(onClose, func() { backend.Close() })
+	case "redis":
+		backend = rdns.NewRedisBackend(rdns.RedisBackendOptions{
+			RedisOptions: redisOptions(b),
+			KeyPrefix:    b.RedisKeyPrefix,
+		})
+		onClose = append(onClose, func() { backend.Close() })
+	case "tiered":
+		if b.L1 == nil || b.L2 == nil {
+			return nil, errors.New("tiered cache backend requires l1 and l2")
+		}
+		l1, err := instantiateCacheBackend(id, b.L1)
+		if err != nil {
+			return nil, err
+		}
+		l2, err := instantiateCacheBackend(id, b.L2)
+		if err != nil {
+			return nil, err
+		}
+		backend = rdns.NewTieredBackend(id, rdns.TieredBackendOptions{L1: l1, L2: l2})
+	default:
+		return nil, fmt.Errorf("unsupported cache backend %q", b.Type)
+	}
+	return backend, nil
+}
+
+// Returns the options of a Redis client from the configuration of a Redis
+// cache backend.
+func redisOptions(b *cacheBackend) redis.Options {
+	minRetryBackoff := time.Duration(b.RedisMinRetryBackoff) * time.Millisecond
+	if b.RedisMinRetryBackoff == -1 {
+		minRetryBackoff = -1
+	}
+	maxRetryBackoff := time.Duration(b.RedisMaxRetryBackoff) * time.Millisecond
+	if b.RedisMaxRetryBackoff == -1 {
+		maxRetryBackoff = -1
+	}
+	return redis.Options{
+		Network:               b.RedisNetwork,
+		Addr:                  b.RedisAddress,
+		Username:              b.RedisUsername,
+		Password:              b.RedisPassword,
+		DB:                    b.RedisDB,
+		ContextTimeoutEnabled: true,
+		MaxRetries:            b.RedisMaxRetries,
+		MinRetryBackoff:       minRetryBackoff,
+		MaxRetryBackoff:       maxRetryBackoff,
+	}
+}
+
 // Instantiate a router object based on configuration and add to the map of resolvers by ID.
 func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver) error {
 	router := rdns.NewRouter(id)
@@ -882,41 +1793,237 @@ func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver)
 		if !ok {
 			return fmt.Errorf("router '%s' references non-existent resolver or group '%s'", id, route.Resolver)
 		}
+		if route.ClientGroup != "" && !clientGroups.Has(route.ClientGroup) {
+			return fmt.Errorf("router '%s' references non-existent client group '%s'", id, route.ClientGroup)
+		}
 		types := route.Types
 		if route.Type != "" { // Support the deprecated "Type" by just adding it to "Types" if defined
 			types = append(types, route.Type)
 		}
-		r, err := rdns.NewRoute(route.Name, route.Class, types, route.Weekdays, route.Before, route.After, route.Source, route.DoHPath, route.Listener, route.TLSServerName, resolver)
+		r, err := rdns.NewRoute(route.Name, route.Class, types, route.Weekdays, route.Before, route.After, route.Source, route.DoHPath, route.Listener, route.TLSServerName, route.ClientGroup, route.Opcodes, route.Transports, route.MinSize, route.MaxSize, resolver)
 		if err != nil {
 			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
 		}
 		r.Invert(route.Invert)
+		if err := r.SetMinRate(route.MinRate, time.Duration(route.RateWindow)*time.Second); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
 		router.Add(r)
 	}
+	routers[id] = router
 	resolvers[id] = router
 	return nil
 }
 
+// Instantiate a notifier from its configuration and register it.
+func instantiateNotifier(id string, n notifier) error {
+	switch n.Type {
+	case "webhook":
+		opt := rdns.WebhookNotifierOptions{
+			URL:        n.URL,
+			Events:     n.Events,
+			Retries:    n.Retries,
+			RetryDelay: time.Duration(n.RetryDelay) * time.Second,
+		}
+		wh, err := rdns.NewWebhookNotifier(id, opt)
+		if err != nil {
+			return fmt.Errorf("notifier '%s': %w", id, err)
+		}
+		rdns.AddNotifier(wh)
+	default:
+		return fmt.Errorf("unsupported notifier type '%s' for '%s'", n.Type, id)
+	}
+	return nil
+}
+
+// Instantiate an access control list from its configuration.
+func instantiateACL(id string, a acl, resolvers map[string]rdns.Resolver) (*rdns.ACL, error) {
+	var opt rdns.ACLOptions
+	for _, r := range a.Rules {
+		n, err := rdns.ParseCIDR(r.Net)
+		if err != nil {
+			return nil, fmt.Errorf("acl '%s': %w", id, err)
+		}
+		rule, err := newACLRule(id, r, resolvers)
+		if err != nil {
+			return nil, err
+		}
+		rule.Network = n
+		opt.Rules = append(opt.Rules, rule)
+	}
+
+	// Refuse clients that don't match any rule unless a default is defined. IPv6
+	// clients are handled like IPv4 clients unless there's a separate default.
+	opt.Default4 = rdns.ACLRule{Action: rdns.ACLActionRefuse}
+	if a.Default4 != nil {
+		rule, err := newACLRule(id, *a.Default4, resolvers)
+		if err != nil {
+			return nil, err
+		}
+		opt.Default4 = rule
+	}
+	opt.Default6 = opt.Default4
+	if a.Default6 != nil {
+		rule, err := newACLRule(id, *a.Default6, resolvers)
+		if err != nil {
+			return nil, err
+		}
+		opt.Default6 = rule
+	}
+	acl, err := rdns.NewACL(id, opt)
+	if err != nil {
+		return nil, fmt.Errorf("acl '%s': %w", id, err)
+	}
+	return acl, nil
+}
+
+func newACLRule(id string, r aclRule, resolvers map[string]rdns.Resolver) (rdns.ACLRule, error) {
+	action, err := rdns.ParseACLAction(r.Action)
+	if err != nil {
+		return rdns.ACLRule{}, fmt.Errorf("acl '%s': %w", id, err)
+	}
+	rule := rdns.ACLRule{Action: action}
+	if r.Resolver != "" {
+		resolver, ok := resolvers[r.Resolver]
+		if !ok {
+			return rule, fmt.Errorf("acl '%s' references non-existent resolver, group or router '%s'", id, r.Resolver)
+		}
+		rule.Resolver = resolver
+	}
+	return rule, nil
+}
+
+// Loads the list sources of an element concurrently and returns the databases
+// in the order of the sources. Sources with the background option are loaded
+// after startup, the background function wraps their databases until then.
+func loadLists[T any](id string, sources []list, load func(list) (T, error), background func(id, name string, load func() (T, error)) T) ([]T, error) {
+	dbs := make([]T, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, s := range sources {
+		load := func() (T, error) { return loadList(id, s, load) }
+		if s.Background {
+			dbs[i] = background(id, listName(s), load)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dbs[i], errs[i] = load()
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return dbs, nil
+}
+
+// Loads a list source once there's a free slot and logs how long it took.
+func loadList[T any](id string, s list, load func(list) (T, error)) (T, error) {
+	listLoadSlots <- struct{}{}
+	defer func() { <-listLoadSlots }()
+	start := time.Now()
+	db, err := load(s)
+	if err != nil {
+		return db, err
+	}
+	rdns.Log.Info("loaded list", "id", id, "list", listName(s), "duration", time.Since(start))
+	return db, nil
+}
+
+func backgroundDB(id, name string, load func() (rdns.BlocklistDB, error)) rdns.BlocklistDB {
+	return rdns.NewBackgroundDB(id, name, load)
+}
+
+func backgroundIPDB(id, name string, load func() (rdns.IPBlocklistDB, error)) rdns.IPBlocklistDB {
+	return rdns.NewBackgroundIPDB(id, name, load)
+}
+
+// Applies the reload guard options of an element to one of its list sources.
+func withGuard(id string, g group, l list) list {
+	l.element = id
+	l.maxChange = g.ReloadMaxChange
+	return l
+}
+
+// Returns the verifier for the integrity of a list, or nil if it's not
+// verified.
+func listVerifier(l list) (rdns.ListVerifier, error) {
+	switch {
+	case l.MinisignKey != "":
+		if l.SHA256 != "" || l.SHA256URL != "" {
+			return nil, fmt.Errorf("list '%s' can't use both minisign and sha256 verification", listName(l))
+		}
+		v, err := rdns.NewMinisignVerifier(l.MinisignKey, l.MinisignURL)
+		if err != nil {
+			return nil, fmt.Errorf("list '%s': %w", listName(l), err)
+		}
+		return v, nil
+	case l.SHA256 != "" && l.SHA256URL != "":
+		return nil, fmt.Errorf("list '%s' can't use both sha256 and sha256-url", listName(l))
+	case l.SHA256 != "":
+		sum, err := hex.DecodeString(l.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("list '%s' has invalid sha256 '%s'", listName(l), l.SHA256)
+		}
+		return &rdns.SHA256Verifier{Sum: sum}, nil
+	case l.SHA256URL != "":
+		return &rdns.SHA256Verifier{SumURL: l.SHA256URL}, nil
+	}
+	return nil, nil
+}
+
+// Returns the name of a list used in logs, the source if it doesn't have one.
+func listName(l list) string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Source
+}
+
 func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 	loc, err := url.Parse(l.Source)
 	if err != nil {
 		return nil, err
 	}
-	name := l.Name
-	if name == "" {
-		name = l.Source
+	name := listName(l)
+	if l.Format == "compiled" {
+		if len(rules) > 0 || loc.Scheme != "" {
+			return nil, errors.New("compiled lists can only be loaded from local files")
+		}
+		return rdns.NewCompiledDB(name, l.Source)
 	}
 	var loader rdns.BlocklistLoader
 	if len(rules) > 0 {
 		loader = rdns.NewStaticLoader(rules)
 	} else {
+		verifier, err := listVerifier(l)
+		if err != nil {
+			return nil, err
+		}
+		if verifier != nil && loc.Scheme != "http" && loc.Scheme != "https" {
+			return nil, fmt.Errorf("list '%s' can only be verified if it's loaded via http or https", name)
+		}
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
 				CacheDir:     l.CacheDir,
 				AllowFailure: l.AllowFailure,
+				Verifier:     verifier,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
+		case "git", "git+https", "git+http", "git+ssh", "git+file":
+			opt := rdns.GitLoaderOptions{
+				Branch:       l.GitBranch,
+				Path:         l.GitPath,
+				CacheDir:     l.CacheDir,
+				AllowFailure: l.AllowFailure,
+			}
+			loader, err = rdns.NewGitLoader(strings.TrimPrefix(l.Source, "git+"), opt)
+			if err != nil {
+				return nil, err
+			}
 		case "":
 			opt := rdns.FileLoaderOptions{
 				AllowFailure: l.AllowFailure,
@@ -925,6 +2032,9 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 		default:
 			return nil, fmt.Errorf("unsupported scheme '%s' in '%s'", loc.Scheme, l.Source)
 		}
+		if l.maxChange > 0 {
+			loader = rdns.NewGuardLoader(l.element, name, loader, rdns.GuardLoaderOptions{MaxChange: l.maxChange})
+		}
 	}
 	switch l.Format {
 	case "regexp", "":
@@ -945,21 +2055,37 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 	if err != nil {
 		return nil, err
 	}
-	name := l.Name
-	if name == "" {
-		name = l.Source
-	}
+	name := listName(l)
 	var loader rdns.BlocklistLoader
 	if len(rules) > 0 {
 		loader = rdns.NewStaticLoader(rules)
 	} else {
+		verifier, err := listVerifier(l)
+		if err != nil {
+			return nil, err
+		}
+		if verifier != nil && loc.Scheme != "http" && loc.Scheme != "https" {
+			return nil, fmt.Errorf("list '%s' can only be verified if it's loaded via http or https", name)
+		}
 		switch loc.Scheme {
 		case "http", "https":
 			opt := rdns.HTTPLoaderOptions{
 				CacheDir:     l.CacheDir,
 				AllowFailure: l.AllowFailure,
+				Verifier:     verifier,
 			}
 			loader = rdns.NewHTTPLoader(l.Source, opt)
+		case "git", "git+https", "git+http", "git+ssh", "git+file":
+			opt := rdns.GitLoaderOptions{
+				Branch:       l.GitBranch,
+				Path:         l.GitPath,
+				CacheDir:     l.CacheDir,
+				AllowFailure: l.AllowFailure,
+			}
+			loader, err = rdns.NewGitLoader(strings.TrimPrefix(l.Source, "git+"), opt)
+			if err != nil {
+				return nil, err
+			}
 		case "":
 			opt := rdns.FileLoaderOptions{
 				AllowFailure: l.AllowFailure,
@@ -968,6 +2094,9 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 		default:
 			return nil, fmt.Errorf("unsupported scheme '%s' in '%s'", loc.Scheme, l.Source)
 		}
+		if l.maxChange > 0 {
+			loader = rdns.NewGuardLoader(l.element, name, loader, rdns.GuardLoaderOptions{MaxChange: l.maxChange})
+		}
 	}
 
 	switch l.Format {
@@ -982,6 +2111,41 @@ func newIPBlocklistDB(l list, locationDB string, rules []string) (rdns.IPBlockli
 	}
 }
 
+// Parses the addresses of block page servers.
+func parseBlockPageIPs(addrs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsUnspecified() {
+			return nil, fmt.Errorf("invalid block-page-ip '%s'", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Returns the redaction rules of a syslog or query-log group, or nil if none
+// are configured.
+func logRedaction(id string, g group) (*rdns.LogRedaction, error) {
+	if len(g.RedactZones) == 0 && !g.RedactClients && len(g.RedactSkip) == 0 {
+		return nil, nil
+	}
+	opt := rdns.LogRedactionOptions{
+		PrivateZones:    g.RedactZones,
+		Mode:            rdns.RedactMode(g.RedactMode),
+		TokenizeClients: g.RedactClients,
+		Key:             g.RedactKey,
+	}
+	if len(g.RedactSkip) > 0 {
+		db, err := rdns.NewDomainDB(id, rdns.NewStaticLoader(g.RedactSkip))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redact-skip in '%s': %w", id, err)
+		}
+		opt.SkipDB = db
+	}
+	return rdns.NewLogRedaction(opt)
+}
+
 func networkForIPVersion(base string, ipVersion int) string {
 	if ipVersion == 0 {
 		return base
@@ -989,6 +2153,22 @@ func networkForIPVersion(base string, ipVersion int) string {
 	return base + strconv.Itoa(ipVersion)
 }
 
+// Convert logrus levels to slog levels
+func slogLevel(logLevel uint32) slog.Level {
+	switch logLevel {
+	case 0:
+		return slog.LevelError
+	case 1, 2:
+		return slog.LevelWarn
+	case 3, 4:
+		return slog.LevelInfo
+	case 5, 6:
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
 func printVersion() {
 	fmt.Println("Build: ", rdns.BuildNumber)
 	fmt.Println("Build Time: ", rdns.BuildTime)
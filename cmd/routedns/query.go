@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// Formats of queries read from stdin and responses written to stdout.
+const (
+	queryFormatText   = "text"   // Name and type per line, responses in dig-style presentation format
+	queryFormatBase64 = "base64" // Base64 encoded wire format per line
+	queryFormatWire   = "wire"   // Wire format, prefixed with the length like DNS over TCP
+)
+
+type queryOptions struct {
+	listener string
+	resolver string
+	client   string
+	format   string
+	logLevel uint32
+}
+
+func newQueryCommand() *cobra.Command {
+	var opt queryOptions
+	cmd := &cobra.Command{
+		Use:   "query <config> [<config>..]",
+		Short: "Resolve queries from stdin with a configuration",
+		Long: `Resolve queries from stdin with a configuration.
+
+Loads the configuration without starting any listeners or binding
+any sockets, reads queries from stdin and writes the responses to
+stdout. Queries are sent through a listener, including its ACL,
+or directly to a resolver, group or router. This is useful in
+scripts and pipelines where running a daemon is overkill.
+
+Queries are read as one name and optional type per line in text
+format, or as DNS messages in base64 or wire format. Responses are
+written in the same format, text responses look like dig output.
+`,
+		Example: `  echo "example.com AAAA" | routedns query config.toml
+  routedns query --resolver cloudflare-dot --format base64 config.toml < queries.txt`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opt.logLevel > 6 {
+				return fmt.Errorf("invalid log level: %d", opt.logLevel)
+			}
+			rdns.Log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slogLevel(opt.logLevel)}))
+			return runQueries(opt, args, os.Stdin, os.Stdout)
+		},
+		SilenceUsage: true,
+	}
+	cmd.Flags().StringVarP(&opt.listener, "listener", "L", "", "ID of the listener that receives the queries, optional if there's only one")
+	cmd.Flags().StringVarP(&opt.resolver, "resolver", "r", "", "ID of a resolver, group or router to send the queries to, instead of a listener")
+	cmd.Flags().StringVarP(&opt.client, "client", "c", "127.0.0.1", "IP of the client sending the queries")
+	cmd.Flags().StringVarP(&opt.format, "format", "f", queryFormatText, "format of queries and responses; text, base64 or wire")
+	cmd.Flags().Uint32VarP(&opt.logLevel, "log-level", "l", 1, "log level; 0=None .. 6=Trace")
+	return cmd
+}
+
+// Loads the configuration and resolves all queries read from in.
+func runQueries(opt queryOptions, configFiles []string, in io.Reader, out io.Writer) error {
+	switch opt.format {
+	case queryFormatText, queryFormatBase64, queryFormatWire:
+	default:
+		return fmt.Errorf("unsupported format '%s'", opt.format)
+	}
+	sourceIP := rdns.ParseClientIP(opt.client)
+	if sourceIP == nil {
+		return fmt.Errorf("invalid client ip '%s'", opt.client)
+	}
+	config, err := loadConfig(configFiles...)
+	if err != nil {
+		return err
+	}
+	// Use the only listener if there's no other target
+	if opt.listener == "" && opt.resolver == "" && len(config.Listeners) == 1 {
+		for id := range config.Listeners {
+			opt.listener = id
+		}
+	}
+	resolvers, err := instantiateResolvers(config)
+	if err != nil {
+		return err
+	}
+	acls, err := instantiateACLs(config, resolvers)
+	if err != nil {
+		return err
+	}
+	listenOpt, resolver, protocol, err := queryTarget(opt.listener, opt.resolver, config, resolvers, acls)
+	if err != nil {
+		return err
+	}
+	ci := rdns.ClientInfo{
+		SourceIP:  sourceIP,
+		Listener:  opt.listener,
+		Transport: protocol,
+	}
+
+	w := bufio.NewWriter(out)
+	if opt.format == queryFormatWire {
+		return resolveWire(bufio.NewReader(in), w, ci, listenOpt, resolver)
+	}
+
+	var invalid int
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var q *dns.Msg
+		if opt.format == queryFormatBase64 {
+			q, err = parseBase64Query(line)
+		} else {
+			q, err = parseTextQuery(line)
+		}
+		if err != nil {
+			invalid++
+			fmt.Fprintf(os.Stderr, "invalid query '%s': %s\n", line, err)
+			continue
+		}
+		a, _ := rdns.ResolveQuery(q, ci, listenOpt, resolver)
+		if opt.format == queryFormatBase64 {
+			err = writeBase64Response(w, a)
+		} else {
+			err = writeTextResponse(w, q, a)
+		}
+		if err != nil {
+			return err
+		}
+		// Flush after every response so they can be consumed interactively
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid queries", invalid)
+	}
+	return nil
+}
+
+// Parses a query in the form "<name> [<type>]".
+func parseTextQuery(line string) (*dns.Msg, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected '%s'", fields[2])
+	}
+	name := fields[0]
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name '%s'", name)
+	}
+	qtype := dns.TypeA
+	if len(fields) == 2 {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type '%s'", fields[1])
+		}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return q, nil
+}
+
+// Parses a query in wire format encoded with base64, with or without padding
+// and in standard or URL alphabet, as used in DoH GET requests.
+func parseBase64Query(line string) (*dns.Msg, error) {
+	line = strings.TrimRight(line, "=")
+	line = strings.NewReplacer("+", "-", "/", "_").Replace(line)
+	b, err := base64.RawURLEncoding.DecodeString(line)
+	if err != nil {
+		return nil, err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Writes a response in dig-style presentation format, separated by an empty
+// line from the next one.
+func writeTextResponse(w io.Writer, q, a *dns.Msg) error {
+	var err error
+	if a == nil {
+		_, err = fmt.Fprintf(w, ";; %s query for %s dropped\n\n", dns.TypeToString[q.Question[0].Qtype], q.Question[0].Name)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", a)
+	}
+	return err
+}
+
+// Writes a response as base64 encoded line. Dropped queries result in an
+// empty line so responses stay in the order of the queries.
+func writeBase64Response(w io.Writer, a *dns.Msg) error {
+	var s string
+	if a != nil {
+		b, err := a.Pack()
+		if err != nil {
+			return err
+		}
+		s = base64.RawURLEncoding.EncodeToString(b)
+	}
+	_, err := fmt.Fprintln(w, s)
+	return err
+}
+
+// Reads queries in wire format, each prefixed with its length like in DNS
+// over TCP, and writes the responses the same way. Dropped queries result
+// in a zero-length response.
+func resolveWire(r *bufio.Reader, w *bufio.Writer, ci rdns.ClientInfo, opt rdns.ListenOptions, resolver rdns.Resolver) error {
+	for {
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+		a, _ := rdns.ResolveQuery(q, ci, opt, resolver)
+		var resp []byte
+		if a != nil {
+			var err error
+			if resp, err = a.Pack(); err != nil {
+				return err
+			}
+		}
+		if err := binary.Write(w, binary.BigEndian, uint16(len(resp))); err != nil {
+			return err
+		}
+		if _, err := w.Write(resp); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+)
+
+// server holds the running listeners and the state that's kept when the
+// configuration is reloaded. On reload, all resolvers, groups and routers
+// are instantiated again. Listeners whose settings didn't change keep their
+// sockets and pass queries to the new resolvers, other listeners are
+// replaced.
+type server struct {
+	args          []string
+	config        config
+	updateChecker *rdns.UpdateChecker
+	ha            *rdns.HACoordinator
+
+	// Resolvers that rules of access control lists route queries to, by ID.
+	// ACLs of listeners that are kept use the new resolvers once they're
+	// swapped in.
+	aclResolvers map[string]*rdns.ReloadableResolver
+
+	listeners map[string]*runningListener
+}
+
+// A listener and the settings it was started with.
+type runningListener struct {
+	ln       rdns.Listener
+	settings listenerSettings
+	managed  bool // Started and stopped by the HA coordinator
+
+	// Resolver the listener passes queries to, nil for listeners that
+	// don't resolve queries.
+	resolver *rdns.ReloadableResolver
+
+	stopped chan struct{}
+}
+
+// Everything that requires a listener to be replaced when it changes.
+type listenerSettings struct {
+	config       listener // Without the resolver, which is swapped instead
+	acl          acl
+	clientGroups map[string]clientGroup
+	leaseFiles   []string
+	resinfo      group    // Group with the resolver information served by DoH listeners
+	files        [][]byte // Content of the CA, certificate and key files
+}
+
+// A configuration that's been instantiated but isn't running yet.
+type pendingConfig struct {
+	config config
+
+	// All resolvers, groups and routers of the configuration by ID.
+	resolvers map[string]rdns.Resolver
+
+	// Resolvers of ACL rules by ID, to swap into the ones in use and to add
+	// if they're new.
+	aclResolvers    map[string]rdns.Resolver
+	newACLResolvers map[string]*rdns.ReloadableResolver
+
+	// New resolvers of the listeners that are kept, by listener ID.
+	kept map[string]rdns.Resolver
+
+	// Listeners that are new or replace one with changed settings.
+	listeners map[string]*runningListener
+}
+
+func newServer(args []string, updateChecker *rdns.UpdateChecker) *server {
+	return &server{
+		args:          args,
+		updateChecker: updateChecker,
+		aclResolvers:  make(map[string]*rdns.ReloadableResolver),
+		listeners:     make(map[string]*runningListener),
+	}
+}
+
+// Instantiates the ACLs and the listeners of a configuration that need to
+// be started, using the given resolvers.
+func (s *server) prepare(config config, resolvers map[string]rdns.Resolver) (*pendingConfig, error) {
+	p := &pendingConfig{
+		config:          config,
+		resolvers:       resolvers,
+		aclResolvers:    make(map[string]rdns.Resolver),
+		newACLResolvers: make(map[string]*rdns.ReloadableResolver),
+		kept:            make(map[string]rdns.Resolver),
+		listeners:       make(map[string]*runningListener),
+	}
+
+	// Access control lists can be shared between listeners and may route queries to
+	// any of the resolvers, so they're built after all resolvers are available.
+	aclResolvers := make(map[string]rdns.Resolver, len(resolvers))
+	for id, r := range resolvers {
+		if rr, ok := s.aclResolvers[id]; ok {
+			aclResolvers[id] = rr
+			p.aclResolvers[id] = r
+		} else {
+			rr = rdns.NewReloadableResolver(r)
+			aclResolvers[id] = rr
+			p.newACLResolvers[id] = rr
+		}
+	}
+	acls, err := instantiateACLs(config, aclResolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Metrics are exported with the protocol or type of their element
+	admin := adminState{
+		graph:         newConfigGraph(config),
+		updateChecker: s.updateChecker,
+		prometheus:    &rdns.PrometheusExporter{Protocols: elementProtocols(config)},
+		resolvers:     resolvers,
+	}
+
+	// Build the Listeners last as they can point to routers, groups or resolvers directly.
+	for id, l := range config.Listeners {
+		resolver, ok := resolvers[l.Resolver]
+		// All Listeners should route queries (except the admin service).
+		if !ok && l.Protocol != "admin" && l.Protocol != "block-page" && l.Protocol != "mdns-reflector" && l.Protocol != "prometheus" {
+			return nil, fmt.Errorf("listener '%s' references non-existent resolver, group or router '%s'", id, l.Resolver)
+		}
+		settings := newListenerSettings(l, config)
+
+		// Keep listeners that didn't change. The admin and prometheus
+		// listeners are always replaced since they serve the state of the
+		// configuration.
+		if running, ok := s.listeners[id]; ok && l.Protocol != "admin" && l.Protocol != "prometheus" {
+			_, stoppable := running.ln.(rdns.StoppableListener)
+			changed := !reflect.DeepEqual(running.settings, settings)
+			switch {
+			case !changed:
+			case running.managed:
+				rdns.Log.Warn("listener managed by ha changed, restart to apply", "id", id)
+			case !stoppable:
+				rdns.Log.Warn("listener changed but can't be stopped, restart to apply", "id", id)
+			}
+			if !changed || running.managed || !stoppable {
+				if running.resolver != nil && resolver != nil {
+					p.kept[id] = resolver
+				}
+				continue
+			}
+		}
+
+		var rr *rdns.ReloadableResolver
+		if resolver != nil {
+			rr = rdns.NewReloadableResolver(resolver)
+			resolver = rr
+		}
+		ln, err := instantiateListener(id, l, resolver, acls, admin)
+		if err != nil {
+			return nil, err
+		}
+		p.listeners[id] = &runningListener{
+			ln:       ln,
+			settings: settings,
+			resolver: rr,
+			stopped:  make(chan struct{}),
+		}
+	}
+	return p, nil
+}
+
+// Swaps in the resolvers of a prepared configuration and replaces the
+// listeners that changed.
+func (s *server) commit(p *pendingConfig) {
+	for id, r := range p.aclResolvers {
+		s.aclResolvers[id].Swap(r)
+	}
+	for id, rr := range p.newACLResolvers {
+		s.aclResolvers[id] = rr
+	}
+	for id, r := range p.kept {
+		s.listeners[id].resolver.Swap(r)
+	}
+
+	// Stop listeners that were removed or are replaced before starting new
+	// ones, they may use the same address.
+	for id, running := range s.listeners {
+		_, configured := p.config.Listeners[id]
+		_, replaced := p.listeners[id]
+		if configured && !replaced {
+			continue
+		}
+		if running.managed || !running.stop() {
+			rdns.Log.Warn("listener removed but can't be stopped, restart to apply", "id", id)
+			continue
+		}
+		delete(s.listeners, id)
+	}
+	for id, l := range p.listeners {
+		s.listeners[id] = l
+		if !l.managed {
+			l.start()
+		}
+	}
+	if s.ha != nil {
+		s.ha.SetGroups(haGroups)
+	}
+	s.config = p.config
+}
+
+// Loads the configuration files again and replaces the running
+// configuration with it. Keeps the running configuration if the new one
+// can't be loaded.
+func (s *server) reload() {
+	rdns.Log.Info("reloading configuration")
+	if err := s.reloadConfig(); err != nil {
+		rdns.Log.Error("failed to reload configuration", "error", err)
+		rdns.Notify(rdns.Event{
+			Type:    rdns.EventConfigReloadFailed,
+			Message: fmt.Sprintf("failed to reload configuration: %v", err),
+		})
+		return
+	}
+	rdns.Notify(rdns.Event{
+		Type:    rdns.EventConfigLoaded,
+		Message: "configuration reloaded from " + strings.Join(s.args, ", "),
+	})
+}
+
+func (s *server) reloadConfig() error {
+	config, err := loadConfig(s.args...)
+	if err != nil {
+		return err
+	}
+	for name, unchanged := range map[string]bool{
+		"notifiers":             reflect.DeepEqual(config.Notifiers, s.config.Notifiers),
+		"update-check":          reflect.DeepEqual(config.UpdateCheck, s.config.UpdateCheck),
+		"ha":                    reflect.DeepEqual(config.HA, s.config.HA),
+		"list-load-concurrency": config.ListLoadConcurrency == s.config.ListLoadConcurrency,
+	} {
+		if !unchanged {
+			rdns.Log.Warn("configuration changed in section that isn't reloaded, restart to apply", "section", name)
+		}
+	}
+
+	// Save the statistics so the new instances continue with them
+	for id, stats := range queryStats {
+		if err := stats.Save(); err != nil {
+			rdns.Log.Error("failed to save statistics", "id", id, "error", err)
+		}
+	}
+
+	// Instantiate the new configuration with its own set of elements that
+	// need to be closed or are served by the admin listener. The running
+	// ones are restored if that fails.
+	prevClose, prevBlocklists, prevHAGroups, prevStats, prevRouters, prevResInfos, prevClientGroups := onClose, blocklists, haGroups, queryStats, routers, resInfos, clientGroups
+	onClose = nil
+	blocklists = make(map[string]*rdns.Blocklist)
+	haGroups = make(map[string]rdns.HAStateGroup)
+	queryStats = make(map[string]*rdns.QueryStats)
+	routers = make(map[string]*rdns.Router)
+	resInfos = make(map[string]*rdns.ResInfo)
+	p, err := s.prepareConfig(config)
+	if err != nil {
+		for _, f := range onClose {
+			f()
+		}
+		onClose, blocklists, haGroups, queryStats, routers, resInfos, clientGroups = prevClose, prevBlocklists, prevHAGroups, prevStats, prevRouters, prevResInfos, prevClientGroups
+		return err
+	}
+	s.commit(p)
+
+	// Close the elements of the previous configuration
+	for _, f := range prevClose {
+		f()
+	}
+
+	// Drop the status of elements that were removed, after they're closed
+	// so they don't add it again
+	ids := make([]string, 0, len(p.resolvers))
+	for id := range p.resolvers {
+		ids = append(ids, id)
+	}
+	rdns.RetainElementStatuses(ids)
+	return nil
+}
+
+func (s *server) prepareConfig(config config) (*pendingConfig, error) {
+	resolvers, err := instantiateResolvers(config)
+	if err != nil {
+		return nil, err
+	}
+	return s.prepare(config, resolvers)
+}
+
+// Starts the listener and restarts it when it fails, until it's stopped.
+// The start is delayed if it waits for lists loading in the background.
+func (l *runningListener) start() {
+	go func() {
+		if l.settings.config.WaitForLists {
+			rdns.WaitForLists()
+		}
+		for {
+			select {
+			case <-l.stopped:
+				return
+			default:
+			}
+			err := l.ln.Start()
+			select {
+			case <-l.stopped:
+				return
+			default:
+			}
+			rdns.Log.Error("listener failed",
+				"id", l.ln.String(),
+				"error", err)
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// Stops the listener. Returns false if it can't be stopped.
+func (l *runningListener) stop() bool {
+	sl, ok := l.ln.(rdns.StoppableListener)
+	if !ok {
+		return false
+	}
+	close(l.stopped)
+	if err := sl.Stop(); err != nil {
+		rdns.Log.Error("failed to stop listener", "id", l.ln.String(), "error", err)
+	}
+	return true
+}
+
+func newListenerSettings(l listener, config config) listenerSettings {
+	settings := listenerSettings{
+		config:       l,
+		clientGroups: config.ClientGroups,
+		leaseFiles:   config.DHCPLeaseFiles,
+	}
+	settings.config.Resolver = ""
+	if l.ACL != "" {
+		settings.acl = config.ACLs[l.ACL]
+	}
+	if l.ResInfo != "" {
+		settings.resinfo = config.Groups[l.ResInfo]
+	}
+	for _, name := range []string{l.CA, l.ServerCrt, l.ServerKey} {
+		var b []byte
+		if name != "" {
+			b, _ = os.ReadFile(name)
+		}
+		settings.files = append(settings.files, b)
+	}
+	return settings
+}
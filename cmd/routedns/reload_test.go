@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadReleasesGoroutines(t *testing.T) {
+	// Upstream server for the clients, over UDP and TCP on the same port
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.LocalAddr().String()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		_ = w.WriteMsg(a)
+	})
+	udp := &dns.Server{PacketConn: l, Handler: handler}
+	go func() { _ = udp.ActivateAndServe() }()
+	defer udp.Shutdown()
+	tl, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	tcp := &dns.Server{Listener: tl, Handler: handler}
+	go func() { _ = tcp.ActivateAndServe() }()
+	defer tcp.Shutdown()
+
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	require.NoError(t, os.WriteFile(hostsFile, []byte("127.0.0.1 localhost\n"), 0o644))
+	configFile := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+[resolvers.upstream-udp]
+address = "%[1]s"
+protocol = "udp"
+
+[resolvers.upstream-tcp]
+address = "%[1]s"
+protocol = "tcp"
+
+[groups.failback]
+type = "fail-back"
+resolvers = ["upstream-tcp", "upstream-udp"]
+
+[groups.cache]
+type = "cache"
+resolvers = ["failback"]
+backend = {type = "memory", gc-period = 1}
+
+[groups.hosts]
+type = "hosts"
+resolvers = ["cache"]
+hosts-files = ["%[2]s"]
+`, addr, hostsFile)), 0o644))
+
+	s := newServer([]string{configFile}, nil)
+	config, err := loadConfig(configFile)
+	require.NoError(t, err)
+	p, err := s.prepareConfig(config)
+	require.NoError(t, err)
+	s.commit(p)
+	defer func() {
+		for _, f := range onClose {
+			f()
+		}
+	}()
+
+	// Send a query through all elements so the clients open connections
+	resolve := func() {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, err := s.aclResolvers["cache"].Resolve(q, rdns.ClientInfo{})
+		require.NoError(t, err)
+		_, err = s.aclResolvers["upstream-udp"].Resolve(q, rdns.ClientInfo{})
+		require.NoError(t, err)
+	}
+	resolve()
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.reloadConfig())
+		resolve()
+	}
+
+	// Goroutines of closed elements may take a moment to stop, the cache GC
+	// up to its period
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); after > before && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	require.LessOrEqual(t, after, before, "goroutines left running after reload")
+}
@@ -1,22 +1,48 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strings"
 	"time"
 
 	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
 )
 
 // Instantiates an rdns.Resolver from a resolver config
 func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolver) error {
 	var err error
+	var bootstrap rdns.Resolver
+	if r.Bootstrap != "" {
+		if r.BootstrapAddr != "" || r.Socks5Address != "" || r.HTTPProxyAddress != "" {
+			return fmt.Errorf("resolver '%s' can't use bootstrap-resolver with bootstrap-address, socks5-address or http-proxy-address", id)
+		}
+		var ok bool
+		bootstrap, ok = resolvers[r.Bootstrap]
+		if !ok {
+			return fmt.Errorf("resolver '%s' references non-existent bootstrap-resolver '%s'", id, r.Bootstrap)
+		}
+	}
+	if err := validateSocks5Config(id, r); err != nil {
+		return err
+	}
+	if err := validateHTTPProxyConfig(id, r); err != nil {
+		return err
+	}
 	switch r.Protocol {
 
 	case "doq":
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoQPort)
+		if r.BootstrapAddr, err = lookupBootstrapAddr(r.Address, bootstrap); err != nil {
+			return fmt.Errorf("failed to look up address of '%s': %w", id, err)
+		}
 
-		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		tlsConfig, err := clientTLSConfig(r)
 		if err != nil {
 			return err
 		}
@@ -26,6 +52,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			TLSConfig:     tlsConfig,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
 			Use0RTT:       r.Use0RTT,
+			Dialer:        proxyDialerFromConfig(r),
 		}
 		resolvers[id], err = rdns.NewDoQClient(id, r.Address, opt)
 		if err != nil {
@@ -34,7 +61,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 	case "dot":
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoTPort)
 
-		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		tlsConfig, err := clientTLSConfig(r)
 		if err != nil {
 			return err
 		}
@@ -43,7 +70,8 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			TLSConfig:     tlsConfig,
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:        socks5DialerFromConfig(r),
+			Dialer:        dialerFromConfig(r, "tcp", bootstrap),
+			TCP:           tcpOptions(r.TCPFastOpen, r.TCPKeepAlive, r.TCPUserTimeout),
 		}
 		resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
 		if err != nil {
@@ -51,6 +79,9 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		}
 	case "dtls":
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DTLSPort)
+		if r.BootstrapAddr, err = lookupBootstrapAddr(r.Address, bootstrap); err != nil {
+			return fmt.Errorf("failed to look up address of '%s': %w", id, err)
+		}
 
 		dtlsConfig, err := rdns.DTLSClientConfig(r.CA, r.ClientCrt, r.ClientKey)
 		if err != nil {
@@ -69,8 +100,20 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		}
 	case "doh":
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoHPort)
+		if r.HappyEyeballs && (r.Socks5Address != "" || r.HTTPProxyAddress != "") {
+			return fmt.Errorf("resolver '%s' can't use happy-eyeballs with socks5-address or http-proxy-address", id)
+		}
+		dialer := dialerFromConfig(r, "tcp", bootstrap)
+		if (r.Transport == "quic" || r.Transport == "auto") && !r.HappyEyeballs {
+			if r.BootstrapAddr, err = lookupBootstrapAddr(r.Address, bootstrap); err != nil {
+				return fmt.Errorf("failed to look up address of '%s': %w", id, err)
+			}
+			// The dialer is used for QUIC as well, only a proxy is needed since
+			// the bootstrap address was already looked up
+			dialer = proxyDialerFromConfig(r)
+		}
 
-		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		tlsConfig, err := clientTLSConfig(r)
 		if err != nil {
 			return err
 		}
@@ -81,15 +124,33 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:        socks5DialerFromConfig(r),
+			Dialer:        dialer,
 			Use0RTT:       r.Use0RTT,
+
+			HappyEyeballs:            r.HappyEyeballs,
+			ReconnectOnNetworkChange: r.ReconnectOnNetworkChange,
+			MaxConcurrentStreams:     r.MaxConcurrentStreams,
+			H2PingInterval:           time.Duration(r.H2PingInterval) * time.Second,
+			H2PingTimeout:            time.Duration(r.H2PingTimeout) * time.Second,
+			H2MaxStreamErrors:        r.H2MaxStreamErrors,
+		}
+		if r.HappyEyeballs && bootstrap != nil {
+			opt.Resolver = rdns.NewNetResolver(bootstrap)
+		}
+		if r.ShareConnections {
+			opt.SharedTransportKey = sharedTransportKey(r)
 		}
 		resolvers[id], err = rdns.NewDoHClient(id, r.Address, opt)
 		if err != nil {
 			return err
 		}
 	case "odoh":
-		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+		if r.Transport == "quic" {
+			if r.BootstrapAddr, err = lookupBootstrapAddr(r.Address, bootstrap); err != nil {
+				return fmt.Errorf("failed to look up address of '%s': %w", id, err)
+			}
+		}
+		tlsConfig, err := clientTLSConfig(r)
 		if err != nil {
 			return err
 		}
@@ -100,6 +161,7 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Dialer:        bootstrapDialer(bootstrap, "tcp", r.LocalAddr),
 		}
 		resolvers[id], err = rdns.NewODoHClient(id, r.Address, r.Target, r.TargetConfig, opt)
 		if err != nil {
@@ -109,21 +171,179 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		r.Address = rdns.AddressWithDefault(r.Address, rdns.PlainDNSPort)
 
 		opt := rdns.DNSClientOptions{
-			LocalAddr:    net.ParseIP(r.LocalAddr),
-			UDPSize:      r.EDNS0UDPSize,
-			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
-			Dialer:       socks5DialerFromConfig(r),
+			LocalAddr:     net.ParseIP(r.LocalAddr),
+			UDPSize:       r.EDNS0UDPSize,
+			QueryTimeout:  time.Duration(r.QueryTimeout) * time.Second,
+			Dialer:        dialerFromConfig(r, r.Protocol, bootstrap),
+			EDNS0Fallback: r.EDNS0Fallback,
+			TCP:           tcpOptions(r.TCPFastOpen, r.TCPKeepAlive, r.TCPUserTimeout),
 		}
 		resolvers[id], err = rdns.NewDNSClient(id, r.Address, r.Protocol, opt)
 		if err != nil {
 			return err
 		}
+	case "mdns":
+		if r.Address == "" {
+			r.Address = "224.0.0.251:5353"
+		}
+		r.Address = rdns.AddressWithDefault(r.Address, rdns.MDNSPort)
+
+		opt := rdns.MDNSClientOptions{
+			Mode:         r.MDNSMode,
+			Interface:    r.MDNSInterface,
+			QueryTimeout: time.Duration(r.QueryTimeout) * time.Second,
+			CacheTTL:     time.Duration(r.MDNSCacheTTL) * time.Second,
+		}
+		resolvers[id], err = rdns.NewMDNSClient(id, r.Address, opt)
+		if err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unsupported protocol '%s' for resolver '%s'", r.Protocol, id)
 	}
+	// Close the connections of the client when the configuration is replaced
+	if c, ok := resolvers[id].(io.Closer); ok {
+		onClose = append(onClose, func() { c.Close() })
+	}
+	if r.QPSLimit > 0 {
+		opt := rdns.QPSLimiterOptions{
+			QPS:     r.QPSLimit,
+			Burst:   r.QPSBurst,
+			MaxWait: time.Duration(r.QPSMaxWait) * time.Millisecond,
+		}
+		resolvers[id], err = rdns.NewQPSLimiter(id, resolvers[id], opt)
+		if err != nil {
+			return err
+		}
+	}
+	if r.HealthCheckInterval > 0 {
+		opt := rdns.HealthCheckOptions{
+			Name:          r.HealthCheckName,
+			Interval:      time.Duration(r.HealthCheckInterval) * time.Second,
+			Timeout:       time.Duration(r.HealthCheckTimeout) * time.Second,
+			FallThreshold: r.HealthCheckFall,
+			RiseThreshold: r.HealthCheckRise,
+		}
+		if r.HealthCheckType != "" {
+			qtype, ok := dns.StringToType[strings.ToUpper(r.HealthCheckType)]
+			if !ok {
+				return fmt.Errorf("resolver '%s' has invalid health-check-type '%s'", id, r.HealthCheckType)
+			}
+			opt.Type = qtype
+		}
+		healthCheck := rdns.NewHealthCheck(id, resolvers[id], opt)
+		onClose = append(onClose, func() { healthCheck.Close() })
+		resolvers[id] = healthCheck
+	}
 	return nil
 }
 
+// Builds the TLS client config for a resolver. If connections are shared, the
+// session cache is shared with all resolvers that have the same TLS options.
+func clientTLSConfig(r resolver) (*tls.Config, error) {
+	tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey, r.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if r.ShareConnections {
+		tlsConfig.ClientSessionCache = rdns.SharedTLSSessionCache(sharedTLSKey(r))
+	}
+	return tlsConfig, nil
+}
+
+// Returns a key that identifies the TLS options of a resolver.
+func sharedTLSKey(r resolver) string {
+	return fmt.Sprintf("%q", []string{r.CA, r.ClientCrt, r.ClientKey, r.ServerName})
+}
+
+// Returns a key that identifies all options that affect how a DoH resolver
+// establishes connections. Resolvers with the same key can share a transport.
+func sharedTransportKey(r resolver) string {
+	return fmt.Sprintf("%q", []string{
+		r.Protocol,
+		sharedTLSKey(r),
+		r.BootstrapAddr,
+		r.Bootstrap,
+		r.LocalAddr,
+		r.Socks5Address,
+		r.Socks5Username,
+		r.Socks5Password,
+		fmt.Sprint(r.Socks5ResolveLocal),
+		fmt.Sprint(r.Socks5Isolate),
+		r.HTTPProxyAddress,
+		r.HTTPProxyUsername,
+		r.HTTPProxyPassword,
+		fmt.Sprint(r.HappyEyeballs),
+		fmt.Sprint(r.H2PingInterval),
+		fmt.Sprint(r.H2PingTimeout),
+		fmt.Sprint(r.H2MaxStreamErrors),
+	})
+}
+
+// Returns a dialer that looks up hostnames with the bootstrap resolver if one
+// is given, or a proxy dialer if a proxy is configured. Returns nil otherwise.
+func dialerFromConfig(cfg resolver, network string, bootstrap rdns.Resolver) rdns.Dialer {
+	if bootstrap != nil {
+		return bootstrapDialer(bootstrap, network, cfg.LocalAddr)
+	}
+	return proxyDialerFromConfig(cfg)
+}
+
+// Returns a socks5 or HTTP proxy dialer if a proxy is configured, nil otherwise
+func proxyDialerFromConfig(cfg resolver) rdns.Dialer {
+	if cfg.HTTPProxyAddress != "" {
+		return rdns.NewHTTPProxyDialer(
+			cfg.HTTPProxyAddress,
+			rdns.HTTPProxyDialerOptions{
+				Username:  cfg.HTTPProxyUsername,
+				Password:  cfg.HTTPProxyPassword,
+				LocalAddr: net.ParseIP(cfg.LocalAddr),
+			})
+	}
+	return socks5DialerFromConfig(cfg)
+}
+
+// Returns a dialer that uses the bootstrap resolver to look up hostnames, or nil
+// if there is no bootstrap resolver.
+func bootstrapDialer(bootstrap rdns.Resolver, network, localAddr string) rdns.Dialer {
+	if bootstrap == nil {
+		return nil
+	}
+	d := rdns.NewNetDialer(bootstrap)
+	if ip := net.ParseIP(localAddr); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return d
+}
+
+// Looks up the IP of the host in an endpoint with the bootstrap resolver. Used
+// for protocols that don't support custom dialers. Returns an empty string if
+// there is no bootstrap resolver.
+func lookupBootstrapAddr(endpoint string, bootstrap rdns.Resolver) (string, error) {
+	if bootstrap == nil {
+		return "", nil
+	}
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ips, err := rdns.NewNetResolver(bootstrap).LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0].String(), nil
+}
+
 // Returns a dialer if a socks5 proxy is configured, nil otherwise
 func socks5DialerFromConfig(cfg resolver) rdns.Dialer {
 	if cfg.Socks5Address == "" {
@@ -132,12 +352,66 @@ func socks5DialerFromConfig(cfg resolver) rdns.Dialer {
 	r := rdns.NewSocks5Dialer(
 		cfg.Socks5Address,
 		rdns.Socks5DialerOptions{
-			Username:     cfg.Socks5Username,
-			Password:     cfg.Socks5Password,
-			TCPTimeout:   0,
-			UDPTimeout:   5 * time.Second,
-			ResolveLocal: cfg.Socks5ResolveLocal,
-			LocalAddr:    net.ParseIP(cfg.LocalAddr),
+			Username:       cfg.Socks5Username,
+			Password:       cfg.Socks5Password,
+			TCPTimeout:     0,
+			UDPTimeout:     5 * time.Second,
+			ResolveLocal:   cfg.Socks5ResolveLocal,
+			LocalAddr:      net.ParseIP(cfg.LocalAddr),
+			IsolateStreams: cfg.Socks5Isolate,
 		})
 	return r
 }
+
+// Checks that names of Tor hidden services (.onion) are only used with a SOCKS5 proxy
+// that resolves them. Lookups for these names must never leave the proxy.
+func validateSocks5Config(id string, r resolver) error {
+	host := r.Address
+	if u, err := url.Parse(r.Address); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(strings.TrimSuffix(strings.ToLower(host), "."), ".onion") {
+		return nil
+	}
+	// Tor only carries TCP
+	switch r.Protocol {
+	case "tcp", "dot":
+	case "doh":
+		if r.Transport == "quic" || r.Transport == "auto" {
+			return fmt.Errorf("resolver '%s' with .onion address doesn't support %s transport", id, r.Transport)
+		}
+	default:
+		return fmt.Errorf("resolver '%s' with .onion address doesn't support protocol '%s'", id, r.Protocol)
+	}
+	if r.Socks5Address == "" {
+		return fmt.Errorf("resolver '%s' with .onion address requires socks5-address", id)
+	}
+	if r.Socks5ResolveLocal || r.BootstrapAddr != "" {
+		return fmt.Errorf("resolver '%s' with .onion address can't use socks5-resolve-local or bootstrap-address", id)
+	}
+	return nil
+}
+
+// Checks that an HTTP proxy is only used with protocols running over TCP, since
+// CONNECT doesn't support UDP. Queries would otherwise bypass the proxy.
+func validateHTTPProxyConfig(id string, r resolver) error {
+	if r.HTTPProxyAddress == "" {
+		return nil
+	}
+	if r.Socks5Address != "" {
+		return fmt.Errorf("resolver '%s' can't use socks5-address and http-proxy-address", id)
+	}
+	switch r.Protocol {
+	case "tcp", "dot":
+	case "doh":
+		if r.Transport == "quic" || r.Transport == "auto" {
+			return fmt.Errorf("resolver '%s' can't use http-proxy-address with %s transport", id, r.Transport)
+		}
+	default:
+		return fmt.Errorf("resolver '%s' can't use http-proxy-address with protocol '%s'", id, r.Protocol)
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/spf13/cobra"
+)
+
+// Files changed by the setup command and the --resolv-conf option. Variables
+// so they can be pointed elsewhere when trying things out.
+var (
+	resolvConfPath     = "/etc/resolv.conf"
+	resolvConfBackup   = "/etc/resolv.conf.routedns-backup"
+	resolvedDropIn     = "/etc/systemd/resolved.conf.d/routedns.conf"
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+	procDir            = "/proc"
+)
+
+// Address of the stub listener of systemd-resolved.
+const resolvedStubAddr = "127.0.0.53"
+
+type setupOptions struct {
+	address string
+	apply   bool
+	restore bool
+}
+
+func newSetupCommand() *cobra.Command {
+	var opt setupOptions
+	cmd := &cobra.Command{
+		Use:   "setup [<config>..]",
+		Short: "Check for and resolve conflicts with other local DNS services",
+		Long: `Check for and resolve conflicts with other local DNS services.
+
+Lists the processes listening on port 53, such as the stub listener
+of systemd-resolved on 127.0.0.53 or dnsmasq, and the listeners in the
+configuration they conflict with. Also checks if the system resolver
+in /etc/resolv.conf sends queries to RouteDNS.
+
+With --apply, systemd-resolved is configured to forward queries to
+RouteDNS with its stub listener disabled, and /etc/resolv.conf is
+pointed at RouteDNS. The original /etc/resolv.conf is kept and put
+back with --restore. Other services, like dnsmasq, need to be
+reconfigured manually.
+`,
+		Example: `  routedns setup config.toml
+  sudo routedns setup --apply config.toml
+  sudo routedns setup --restore`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opt.restore {
+				return restoreSetup(os.Stdout)
+			}
+			return runSetup(opt, args, os.Stdout)
+		},
+		SilenceUsage: true,
+	}
+	cmd.Flags().StringVarP(&opt.address, "address", "a", "", "IP address RouteDNS answers local queries on, defaults to the first plain DNS listener in the configuration")
+	cmd.Flags().BoolVar(&opt.apply, "apply", false, "configure systemd-resolved and /etc/resolv.conf to use RouteDNS")
+	cmd.Flags().BoolVar(&opt.restore, "restore", false, "undo the changes made with --apply")
+	cmd.MarkFlagsMutuallyExclusive("apply", "restore")
+	return cmd
+}
+
+// A socket bound to port 53.
+type dnsSocket struct {
+	network string // "udp" or "tcp"
+	ip      net.IP
+	process string // Name of the process, empty if unknown
+}
+
+func (s dnsSocket) String() string {
+	process := s.process
+	if process == "" {
+		process = "unknown process"
+	}
+	return fmt.Sprintf("%s %s (%s)", s.network, net.JoinHostPort(s.ip.String(), "53"), process)
+}
+
+func runSetup(opt setupOptions, configFiles []string, out io.Writer) error {
+	var listeners map[string]listener
+	if len(configFiles) > 0 {
+		config, err := loadConfig(configFiles...)
+		if err != nil {
+			return err
+		}
+		listeners = config.Listeners
+	}
+	address := opt.address
+	if address == "" {
+		address = localAddress(listeners)
+	}
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid address '%s'", address)
+	}
+
+	// Processes on port 53, other than RouteDNS itself
+	sockets, err := dnsSockets()
+	if err != nil {
+		fmt.Fprintf(out, "Can't list sockets on port 53: %v\n", err)
+	}
+	sockets = slices.DeleteFunc(sockets, func(s dnsSocket) bool { return s.process == "routedns" })
+	var resolved bool
+	if len(sockets) == 0 {
+		fmt.Fprintln(out, "No other processes listening on port 53")
+	} else {
+		fmt.Fprintln(out, "Processes listening on port 53:")
+		for _, s := range sockets {
+			fmt.Fprintf(out, "  %s\n", s)
+			resolved = resolved || s.process == "systemd-resolve" || s.ip.Equal(net.ParseIP(resolvedStubAddr))
+		}
+	}
+
+	// Listeners in the configuration that can't bind
+	ids := make([]string, 0, len(listeners))
+	for id := range listeners {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		l := listeners[id]
+		for _, s := range sockets {
+			if listenerConflicts(l, s) {
+				fmt.Fprintf(out, "Listener '%s' on %s conflicts with %s\n", id, l.Address, s)
+			}
+		}
+	}
+
+	// Check where the system resolver sends queries
+	nameservers, err := resolvConfNameservers(resolvConfPath)
+	if err != nil {
+		fmt.Fprintf(out, "Can't read %s: %v\n", resolvConfPath, err)
+	} else {
+		fmt.Fprintf(out, "Name servers in %s: %s\n", resolvConfPath, strings.Join(nameservers, ", "))
+		if slices.Contains(nameservers, resolvedStubAddr) {
+			resolved = true
+			fmt.Fprintln(out, "System queries are sent to the systemd-resolved stub listener, not RouteDNS")
+		} else if !slices.Contains(nameservers, address) {
+			fmt.Fprintf(out, "System queries are not sent to RouteDNS on %s\n", address)
+		}
+	}
+
+	if !opt.apply {
+		if resolved {
+			fmt.Fprintln(out, "Run with --apply to forward queries from systemd-resolved to RouteDNS and disable its stub listener")
+		}
+		for _, s := range sockets {
+			if s.process == "dnsmasq" {
+				fmt.Fprintln(out, "Disable the DNS server of dnsmasq with 'port=0' in its configuration, or limit it to other addresses with 'bind-interfaces'")
+				break
+			}
+		}
+		return nil
+	}
+
+	if resolved {
+		if err := configureResolved(address, out); err != nil {
+			return err
+		}
+		// Use the resolv.conf of systemd-resolved that lists the upstream
+		// servers, RouteDNS, rather than its stub listener
+		if err := replaceResolvConf(func(path string) error { return os.Symlink(resolvedResolvConf, path) }); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Linked %s to %s\n", resolvConfPath, resolvedResolvConf)
+		return nil
+	}
+	if err := writeResolvConf(address); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Pointed %s to %s\n", resolvConfPath, address)
+	return nil
+}
+
+// Undoes the changes made by the setup command.
+func restoreSetup(out io.Writer) error {
+	if err := os.Remove(resolvedDropIn); err == nil {
+		fmt.Fprintf(out, "Removed %s\n", resolvedDropIn)
+		if err := restartResolved(); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	restored, err := restoreResolvConf()
+	if err != nil {
+		return err
+	}
+	if restored {
+		fmt.Fprintf(out, "Restored %s\n", resolvConfPath)
+	}
+	return nil
+}
+
+// Returns the IP of the first plain DNS listener, 127.0.0.1 if it listens on
+// all addresses or there's none.
+func localAddress(listeners map[string]listener) string {
+	ids := make([]string, 0, len(listeners))
+	for id, l := range listeners {
+		if l.Protocol == "udp" {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		host, _, err := net.SplitHostPort(rdns.AddressWithDefault(listeners[id].Address, rdns.PlainDNSPort))
+		if ip := net.ParseIP(host); err == nil && ip != nil && !ip.IsUnspecified() {
+			return ip.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+// Returns true if a plain DNS listener can't bind because of the socket.
+func listenerConflicts(l listener, s dnsSocket) bool {
+	if l.Protocol != s.network {
+		return false
+	}
+	host, port, err := net.SplitHostPort(rdns.AddressWithDefault(l.Address, rdns.PlainDNSPort))
+	if err != nil || port != "53" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsUnspecified() || s.ip.IsUnspecified() || ip.Equal(s.ip)
+}
+
+// Lists the UDP sockets and listening TCP sockets on port 53 from /proc,
+// along with the names of the processes they belong to.
+func dnsSockets() ([]dnsSocket, error) {
+	inodes := make(map[string]dnsSocket)
+	var order []string
+	for _, name := range []string{"udp", "udp6", "tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(procDir, "net", name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(name, "6") {
+				continue // IPv6 disabled
+			}
+			return nil, err
+		}
+		network := strings.TrimSuffix(name, "6")
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // Header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			ip, port, ok := parseProcAddr(fields[1])
+			// Unconnected UDP sockets have state 07, listening TCP sockets 0A
+			if !ok || port != 53 || (network == "udp" && fields[3] != "07") || (network == "tcp" && fields[3] != "0A") {
+				continue
+			}
+			inode := fields[9]
+			if _, ok := inodes[inode]; !ok {
+				order = append(order, inode)
+			}
+			inodes[inode] = dnsSocket{network: network, ip: ip}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	processes := socketProcesses()
+	sockets := make([]dnsSocket, 0, len(order))
+	for _, inode := range order {
+		s := inodes[inode]
+		s.process = processes[inode]
+		sockets = append(sockets, s)
+	}
+	return sockets, nil
+}
+
+// Parses an address in /proc/net/udp and tcp, like "3500007F:0035". The IP
+// is stored in host byte order in groups of 4 bytes.
+func parseProcAddr(s string) (net.IP, int, bool) {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, false
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(b), int(p), true
+}
+
+// Returns the names of processes by the inodes of their sockets. Only sockets
+// of processes whose file descriptors are readable, typically those of the
+// same user or all when running as root, are included.
+func socketProcesses() map[string]string {
+	processes := make(map[string]string)
+	dirs, _ := os.ReadDir(procDir)
+	for _, dir := range dirs {
+		if _, err := strconv.Atoi(dir.Name()); err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(procDir, dir.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		var comm string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(procDir, dir.Name(), "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if comm == "" {
+				b, _ := os.ReadFile(filepath.Join(procDir, dir.Name(), "comm"))
+				comm = strings.TrimSpace(string(b))
+			}
+			processes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = comm
+		}
+	}
+	return processes
+}
+
+// Returns the addresses of the name servers in a resolv.conf file.
+func resolvConfNameservers(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers, nil
+}
+
+// Writes a drop-in for systemd-resolved that forwards all queries to RouteDNS
+// and disables the stub listener, then restarts it.
+func configureResolved(address string, out io.Writer) error {
+	if err := os.MkdirAll(filepath.Dir(resolvedDropIn), 0o755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(`# Written by "routedns setup --apply", remove with "routedns setup --restore"
+[Resolve]
+DNS=%s
+Domains=~.
+DNSStubListener=no
+`, address)
+	if err := os.WriteFile(resolvedDropIn, []byte(content), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote %s\n", resolvedDropIn)
+	return restartResolved()
+}
+
+func restartResolved() error {
+	if b, err := exec.Command("systemctl", "try-restart", "systemd-resolved").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart systemd-resolved: %w: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// Points /etc/resolv.conf at RouteDNS, keeping the original to be restored.
+func writeResolvConf(address string) error {
+	content := fmt.Sprintf("# Written by RouteDNS, the original is in %s\nnameserver %s\n", resolvConfBackup, address)
+	return replaceResolvConf(func(path string) error {
+		return os.WriteFile(path, []byte(content), 0o644)
+	})
+}
+
+// Moves /etc/resolv.conf to the backup, unless there already is one from an
+// earlier change, and creates a new one.
+func replaceResolvConf(create func(path string) error) error {
+	if _, err := os.Lstat(resolvConfBackup); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(resolvConfPath, resolvConfBackup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(resolvConfPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return create(resolvConfPath)
+}
+
+// Moves the original /etc/resolv.conf back. Returns false if there was
+// nothing to restore.
+func restoreResolvConf() (bool, error) {
+	if _, err := os.Lstat(resolvConfBackup); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err := os.Rename(resolvConfBackup, resolvConfPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
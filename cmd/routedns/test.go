@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// File with sample queries and their expected outcome
+type testFile struct {
+	Tests []queryTest `toml:"tests"`
+}
+
+type queryTest struct {
+	Name          string
+	Listener      string   // ID of the listener that receives the query
+	Resolver      string   // ID of a resolver, group or router to send the query to, instead of a listener
+	Client        string   // Client IP, defaults to 127.0.0.1
+	DoHPath       string   `toml:"doh-path"`   // DoH query path used by the client
+	TLSServerName string   `toml:"servername"` // TLS server name used by the client
+	Transport     string   // Transport the query is received over, defaults to the protocol of the listener
+	Query         string   // Query name
+	Type          string   // Query type, defaults to "A"
+	Rcode         string   // Expected response code, "NOERROR", "NXDOMAIN", etc
+	Blocked       *bool    // Expect the query to be blocked, or not, by any blocklist
+	BlockedBy     string   `toml:"blocked-by"` // ID of the blocklist, or name of the list, expected to block the query
+	Answer        []string // Records expected in the answer, TTL is ignored
+	Drop          bool     // Expect the query to be dropped
+}
+
+func newTestCommand() *cobra.Command {
+	var logLevel uint32
+	cmd := &cobra.Command{
+		Use:   "test <config> [<config>..] <tests>",
+		Short: "Run sample queries against a configuration",
+		Long: `Run sample queries against a configuration.
+
+Loads the configuration without starting any listeners and sends
+the queries defined in the tests file through it. Each query is
+checked against its expected outcome, such as the response code
+or the blocklist that should block it. Exits with an error if any
+of the tests fail.
+`,
+		Example: `  routedns test config.toml tests.toml`,
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if logLevel > 6 {
+				return fmt.Errorf("invalid log level: %d", logLevel)
+			}
+			rdns.Log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slogLevel(logLevel)}))
+			return runTests(args[:len(args)-1], args[len(args)-1])
+		},
+		SilenceUsage: true,
+	}
+	cmd.Flags().Uint32VarP(&logLevel, "log-level", "l", 1, "log level; 0=None .. 6=Trace")
+	return cmd
+}
+
+// Loads the configuration and runs all tests against it.
+func runTests(configFiles []string, testsFile string) error {
+	var tests testFile
+	if _, err := toml.DecodeFile(testsFile, &tests); err != nil {
+		return err
+	}
+	config, err := loadConfig(configFiles...)
+	if err != nil {
+		return err
+	}
+	resolvers, err := instantiateResolvers(config)
+	if err != nil {
+		return err
+	}
+	acls, err := instantiateACLs(config, resolvers)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i, t := range tests.Tests {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+		qt, err := newQueryTest(t, config, resolvers, acls)
+		if err == nil {
+			err = qt.Run()
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			continue
+		}
+		fmt.Printf("PASS %s\n", name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(tests.Tests))
+	}
+	return nil
+}
+
+// Builds a query test from its definition in the tests file.
+func newQueryTest(t queryTest, config config, resolvers map[string]rdns.Resolver, acls map[string]*rdns.ACL) (rdns.QueryTest, error) {
+	var qt rdns.QueryTest
+	if t.Query == "" {
+		return qt, errors.New("no query name")
+	}
+	qtype := dns.TypeA
+	if t.Type != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(t.Type)]
+		if !ok {
+			return qt, fmt.Errorf("unknown query type '%s'", t.Type)
+		}
+	}
+	qt.Query = new(dns.Msg)
+	qt.Query.SetQuestion(dns.Fqdn(t.Query), qtype)
+
+	client := "127.0.0.1"
+	if t.Client != "" {
+		client = t.Client
+	}
+	qt.Client = rdns.ClientInfo{
+		SourceIP:      rdns.ParseClientIP(client),
+		DoHPath:       t.DoHPath,
+		TLSServerName: t.TLSServerName,
+		Listener:      t.Listener,
+		Transport:     t.Transport,
+	}
+	if qt.Client.SourceIP == nil {
+		return qt, fmt.Errorf("invalid client ip '%s'", t.Client)
+	}
+
+	var (
+		protocol string
+		err      error
+	)
+	qt.ListenOptions, qt.Resolver, protocol, err = queryTarget(t.Listener, t.Resolver, config, resolvers, acls)
+	if err != nil {
+		return qt, err
+	}
+	if qt.Client.Transport == "" {
+		qt.Client.Transport = protocol
+	}
+
+	if t.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(t.Rcode)]
+		if !ok {
+			return qt, fmt.Errorf("unknown rcode '%s'", t.Rcode)
+		}
+		qt.Expect.Rcode = &rcode
+	}
+	for _, s := range t.Answer {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return qt, fmt.Errorf("invalid answer record '%s': %w", s, err)
+		}
+		if rr == nil {
+			return qt, errors.New("empty answer record")
+		}
+		qt.Expect.Answer = append(qt.Expect.Answer, rr)
+	}
+	qt.Expect.Blocked = t.Blocked
+	qt.Expect.BlockedBy = t.BlockedBy
+	qt.Expect.Drop = t.Drop
+	return qt, nil
+}
+
+// Returns the options and resolver of the listener that queries are sent
+// through, along with its protocol, or just the resolver if no listener is
+// given.
+func queryTarget(listenerID, resolverID string, config config, resolvers map[string]rdns.Resolver, acls map[string]*rdns.ACL) (rdns.ListenOptions, rdns.Resolver, string, error) {
+	var (
+		opt      rdns.ListenOptions
+		protocol string
+	)
+	switch {
+	case listenerID != "" && resolverID != "":
+		return opt, nil, "", errors.New("can't use both listener and resolver")
+	case listenerID != "":
+		l, ok := config.Listeners[listenerID]
+		if !ok {
+			return opt, nil, "", fmt.Errorf("listener '%s' not found", listenerID)
+		}
+		var err error
+		opt, err = listenOptions(listenerID, l, acls)
+		if err != nil {
+			return opt, nil, "", err
+		}
+		resolverID = l.Resolver
+		protocol = l.Protocol
+	case resolverID == "":
+		return opt, nil, "", errors.New("no listener or resolver")
+	}
+	resolver, ok := resolvers[resolverID]
+	if !ok {
+		return opt, nil, "", fmt.Errorf("resolver '%s' not found", resolverID)
+	}
+	return opt, resolver, protocol, nil
+}
@@ -0,0 +1,34 @@
+package rdns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Default number of CNAME records followed when checking the names in a CNAME
+// chain against blocklists.
+const defaultCNAMEMaxDepth = 10
+
+// Returns the targets of the CNAME chain in a response, in order, starting
+// with the CNAME of the query name. At most maxDepth records are followed, the
+// second return value is false if the chain is longer than that.
+func cnameChain(name string, a *dns.Msg, maxDepth int) ([]string, bool) {
+	var chain []string
+next:
+	for {
+		for _, rr := range a.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !strings.EqualFold(cname.Hdr.Name, name) {
+				continue
+			}
+			if len(chain) >= maxDepth {
+				return chain, false
+			}
+			chain = append(chain, cname.Target)
+			name = cname.Target
+			continue next
+		}
+		return chain, true
+	}
+}
@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ConcurrencyLimiter limits the number of queries a resolver is working on at
+// the same time, to protect upstream servers that can't handle bursts. Queries
+// over the limit wait in a queue for up to a configurable time. Queries that
+// don't fit into the queue or time out in it are handled as configured, by
+// failing, dropping or sending them to a fallback resolver.
+type ConcurrencyLimiter struct {
+	id       string
+	resolver Resolver
+	opt      ConcurrencyLimiterOptions
+	metrics  *ConcurrencyLimiterMetrics
+
+	slots chan struct{} // Holds a value for every query in flight
+	queue chan struct{} // Holds a value for every query waiting for a slot
+}
+
+// ConcurrencyLimiterOptions contain settings for the concurrency limiter.
+type ConcurrencyLimiterOptions struct {
+	// Maximum number of queries passed to the resolver at the same time.
+	Limit int
+
+	// Number of queries that can wait for a slot once the limit is reached.
+	// Queries over the limit are handled as overflow right away if 0.
+	QueueSize int
+
+	// Maximum time a query waits in the queue. Default 1 second.
+	QueueTimeout time.Duration
+
+	// How queries are handled that exceed the limit and don't fit into the
+	// queue or time out in it. Defaults to ConcurrencyOverflowServfail.
+	Overflow ConcurrencyOverflow
+
+	// Resolver for overflow queries with ConcurrencyOverflowFallback.
+	FallbackResolver Resolver
+}
+
+// ConcurrencyOverflow defines how queries over the concurrency limit are
+// handled.
+type ConcurrencyOverflow string
+
+const (
+	// Respond with SERVFAIL.
+	ConcurrencyOverflowServfail ConcurrencyOverflow = "servfail"
+
+	// Drop the query without response.
+	ConcurrencyOverflowDrop ConcurrencyOverflow = "drop"
+
+	// Send the query to the fallback resolver.
+	ConcurrencyOverflowFallback ConcurrencyOverflow = "fallback"
+)
+
+type ConcurrencyLimiterMetrics struct {
+	// Queries currently passed to the resolver.
+	inFlight *Gauge
+	// Queries currently waiting in the queue.
+	queued *Gauge
+	// Queries that had to wait in the queue.
+	waited *Counter
+	// Queries over the limit that were handled as overflow, by reason.
+	overflow *CounterMap
+}
+
+var _ Resolver = &ConcurrencyLimiter{}
+
+// NewConcurrencyLimiter returns a new instance of a concurrency limiter.
+func NewConcurrencyLimiter(id string, resolver Resolver, opt ConcurrencyLimiterOptions) (*ConcurrencyLimiter, error) {
+	if opt.Limit <= 0 {
+		return nil, errors.New("concurrency limit must be greater than 0")
+	}
+	switch opt.Overflow {
+	case "":
+		opt.Overflow = ConcurrencyOverflowServfail
+	case ConcurrencyOverflowServfail, ConcurrencyOverflowDrop:
+	case ConcurrencyOverflowFallback:
+		if opt.FallbackResolver == nil {
+			return nil, errors.New("concurrency limiter with fallback overflow requires a fallback resolver")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported overflow %q", opt.Overflow)
+	}
+	if opt.QueueTimeout <= 0 {
+		opt.QueueTimeout = time.Second
+	}
+	return &ConcurrencyLimiter{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		slots:    make(chan struct{}, opt.Limit),
+		queue:    make(chan struct{}, max(opt.QueueSize, 0)),
+		metrics: &ConcurrencyLimiterMetrics{
+			inFlight: getGauge("router", id, "in-flight"),
+			queued:   getGauge("router", id, "queued"),
+			waited:   getCounter("router", id, "waited"),
+			overflow: getCounterMap("router", id, "overflow", "reason"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query once there are less than the maximum number of queries
+// in flight.
+func (r *ConcurrencyLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	if reason := r.acquire(); reason != "" {
+		r.metrics.overflow.Add(reason, 1)
+		switch r.opt.Overflow {
+		case ConcurrencyOverflowDrop:
+			log.Debug("concurrency limit reached, dropping query", "reason", reason)
+			return nil, nil
+		case ConcurrencyOverflowFallback:
+			log.Debug("concurrency limit reached, forwarding query to fallback resolver", "reason", reason, "resolver", r.opt.FallbackResolver.String())
+			return r.opt.FallbackResolver.Resolve(q, ci)
+		default:
+			log.Debug("concurrency limit reached, responding with servfail", "reason", reason)
+			return servfail(q), nil
+		}
+	}
+	defer r.release()
+	log.With("resolver", r.resolver.String()).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *ConcurrencyLimiter) String() string {
+	return r.id
+}
+
+// Takes a slot for a query, waiting in the queue if none is free. Returns the
+// reason if no slot could be taken, "queue-full" or "queue-timeout".
+func (r *ConcurrencyLimiter) acquire() string {
+	select {
+	case r.slots <- struct{}{}:
+		r.metrics.inFlight.Set(int64(len(r.slots)))
+		return ""
+	default:
+	}
+
+	// All slots are taken, wait in the queue if there's room
+	select {
+	case r.queue <- struct{}{}:
+	default:
+		return "queue-full"
+	}
+	r.metrics.waited.Add(1)
+	r.metrics.queued.Set(int64(len(r.queue)))
+	defer func() {
+		<-r.queue
+		r.metrics.queued.Set(int64(len(r.queue)))
+	}()
+	timer := time.NewTimer(r.opt.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		r.metrics.inFlight.Set(int64(len(r.slots)))
+		return ""
+	case <-timer.C:
+		return "queue-timeout"
+	}
+}
+
+func (r *ConcurrencyLimiter) release() {
+	<-r.slots
+	r.metrics.inFlight.Set(int64(len(r.slots)))
+}
@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	// Upstream that blocks until released
+	release := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-release
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	fallback := new(TestResolver)
+	r, err := NewConcurrencyLimiter("test-concurrency", upstream, ConcurrencyLimiterOptions{
+		Limit:            2,
+		QueueSize:        1,
+		QueueTimeout:     time.Hour,
+		Overflow:         ConcurrencyOverflowFallback,
+		FallbackResolver: fallback,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Fill both slots and the queue
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, dns.RcodeSuccess, a.Rcode)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return r.metrics.inFlight.Value() == 2 && r.metrics.queued.Value() == 1
+	}, time.Second, time.Millisecond)
+
+	// The next query doesn't fit and goes to the fallback
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, fallback.HitCount())
+	require.Equal(t, int64(1), r.metrics.overflow.Get("queue-full").Value())
+
+	// Once released, the queued query is resolved as well
+	close(release)
+	wg.Wait()
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, int64(0), r.metrics.inFlight.Value())
+	require.Equal(t, int64(0), r.metrics.queued.Value())
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-release
+			return nil, nil
+		},
+	}
+	r, err := NewConcurrencyLimiter("test-concurrency-timeout", upstream, ConcurrencyLimiterOptions{
+		Limit:        1,
+		QueueSize:    1,
+		QueueTimeout: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	go func() { _, _ = r.Resolve(q, ClientInfo{}) }()
+	require.Eventually(t, func() bool { return r.metrics.inFlight.Value() == 1 }, time.Second, time.Millisecond)
+
+	// Waits in the queue and times out with SERVFAIL
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, int64(1), r.metrics.overflow.Get("queue-timeout").Value())
+	require.Equal(t, int64(1), r.metrics.waited.Value())
+}
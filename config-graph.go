@@ -0,0 +1,106 @@
+package rdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ConfigGraph describes the elements of a configuration, listeners, routers,
+// groups and resolvers, and how queries flow between them. It can be rendered
+// as JSON or Graphviz DOT to visualize a configuration.
+type ConfigGraph struct {
+	Nodes []ConfigGraphNode `json:"nodes"`
+	Edges []ConfigGraphEdge `json:"edges"`
+}
+
+// ConfigGraphNode is an element in the configuration.
+type ConfigGraphNode struct {
+	ID      string            `json:"id"`
+	Kind    string            `json:"kind"` // "listener", "acl", "router", "group" or "resolver"
+	Type    string            `json:"type"` // Protocol of listeners and resolvers, type of groups
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// ConfigGraphEdge is a connection from an element to another one it can pass
+// queries to.
+type ConfigGraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"` // For example the route conditions or the role of the resolver
+}
+
+// Sort orders nodes by kind and ID, and edges by their nodes, to produce
+// the same output for the same configuration.
+func (g *ConfigGraph) Sort() {
+	kindOrder := map[string]int{"listener": 0, "acl": 1, "router": 2, "group": 3, "resolver": 4}
+	sort.SliceStable(g.Nodes, func(i, j int) bool {
+		a, b := g.Nodes[i], g.Nodes[j]
+		if a.Kind != b.Kind {
+			return kindOrder[a.Kind] < kindOrder[b.Kind]
+		}
+		return a.ID < b.ID
+	})
+	// Edges from routers keep their order since it's the order of the routes
+	sort.SliceStable(g.Edges, func(i, j int) bool {
+		return g.Edges[i].From < g.Edges[j].From
+	})
+}
+
+// WriteJSON writes the graph in JSON format.
+func (g *ConfigGraph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the graph in Graphviz DOT format. Nodes are labeled with
+// their ID, type and options.
+func (g *ConfigGraph) WriteDOT(w io.Writer) error {
+	shapes := map[string]string{
+		"listener": "invhouse",
+		"acl":      "octagon",
+		"router":   "diamond",
+		"group":    "box",
+		"resolver": "house",
+	}
+	var b strings.Builder
+	b.WriteString("digraph routedns {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=9];\n")
+	for _, n := range g.Nodes {
+		label := []string{n.ID, n.Kind + ": " + n.Type}
+		keys := make([]string, 0, len(n.Options))
+		for k := range n.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			label = append(label, k+" = "+n.Options[k])
+		}
+		shape, ok := shapes[n.Kind]
+		if !ok {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %s [shape=%s, label=%s];\n", dotQuote(n.ID), shape, dotQuote(strings.Join(label, "\n")))
+	}
+	for _, e := range g.Edges {
+		if e.Label == "" {
+			fmt.Fprintf(&b, "  %s -> %s;\n", dotQuote(e.From), dotQuote(e.To))
+			continue
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Label))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Returns the string as quoted DOT ID.
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigGraph(t *testing.T) {
+	g := &ConfigGraph{
+		Nodes: []ConfigGraphNode{
+			{ID: "cloudflare", Kind: "resolver", Type: "dot", Options: map[string]string{"address": "1.1.1.1:853"}},
+			{ID: "router", Kind: "router", Type: "router"},
+			{ID: "local", Kind: "listener", Type: "udp"},
+		},
+		Edges: []ConfigGraphEdge{
+			{From: "router", To: "cloudflare", Label: `name=\.com\.$`},
+			{From: "local", To: "router"},
+		},
+	}
+	g.Sort()
+	require.Equal(t, "local", g.Nodes[0].ID)
+	require.Equal(t, "cloudflare", g.Nodes[2].ID)
+
+	var dot bytes.Buffer
+	require.NoError(t, g.WriteDOT(&dot))
+	require.Equal(t, `digraph routedns {
+  rankdir=LR;
+  node [fontname="Helvetica", fontsize=10];
+  edge [fontname="Helvetica", fontsize=9];
+  "local" [shape=invhouse, label="local\nlistener: udp"];
+  "router" [shape=diamond, label="router\nrouter: router"];
+  "cloudflare" [shape=house, label="cloudflare\nresolver: dot\naddress = 1.1.1.1:853"];
+  "local" -> "router";
+  "router" -> "cloudflare" [label="name=\\.com\\.$"];
+}
+`, dot.String())
+
+	var buf bytes.Buffer
+	require.NoError(t, g.WriteJSON(&buf))
+	var decoded ConfigGraph
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, *g, decoded)
+}
+
+func TestConfigGraphAdminACL(t *testing.T) {
+	g := &ConfigGraph{Nodes: []ConfigGraphNode{{ID: "cloudflare", Kind: "resolver", Type: "dot"}}}
+	admin, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}},
+		Graph:         g,
+	})
+	require.NoError(t, err)
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/routedns/graph", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		admin.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// Clients outside of the allowed network don't get the graph
+	w := get("192.0.2.1:1234")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.NotContains(t, w.Body.String(), "cloudflare")
+
+	w = get("10.0.0.1:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "cloudflare")
+}
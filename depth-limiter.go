@@ -0,0 +1,61 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxDepth is the maximum number of elements a query can pass through
+// if no other limit is configured.
+const DefaultMaxDepth = 64
+
+// DepthLimiter wraps a resolver and counts the number of elements a query has
+// passed through in ClientInfo.Depth. If the query exceeds the maximum, it is
+// answered with SERVFAIL, and an extended error if the query supports EDNS0,
+// instead of being forwarded.
+// This protects against loops between elements that can't be detected when
+// the configuration is loaded, which would otherwise only end when the stack
+// is exhausted.
+type DepthLimiter struct {
+	resolver Resolver
+	max      int
+}
+
+var _ Resolver = &DepthLimiter{}
+
+// NewDepthLimiter returns a resolver that limits the depth of queries before
+// passing them to the given resolver. Uses DefaultMaxDepth if max is 0.
+func NewDepthLimiter(resolver Resolver, max int) *DepthLimiter {
+	if max == 0 {
+		max = DefaultMaxDepth
+	}
+	return &DepthLimiter{
+		resolver: resolver,
+		max:      max,
+	}
+}
+
+// Resolve increments the depth of the query and passes it to the resolver
+// unless the maximum depth is exceeded.
+func (r *DepthLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	ci.Depth++
+	if ci.Depth > r.max {
+		logger(r.resolver.String(), q, ci).Warn("maximum query depth exceeded, possible loop", "max-depth", r.max)
+		a := new(dns.Msg)
+		a.SetRcode(q, dns.RcodeServerFailure)
+		if edns0 := q.IsEdns0(); edns0 != nil {
+			a.SetEdns0(edns0.UDPSize(), edns0.Do())
+			opt := a.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeOther,
+				ExtraText: "maximum query depth exceeded",
+			})
+		}
+		return a, nil
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+// String returns the ID of the wrapped resolver.
+func (r *DepthLimiter) String() string {
+	return r.resolver.String()
+}
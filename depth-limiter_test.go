@@ -0,0 +1,43 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDepthLimiterLoop(t *testing.T) {
+	// Build a loop, the resolver sends every query back to the limiter
+	var limiter *DepthLimiter
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return limiter.Resolve(q, ci)
+		},
+	}
+	limiter = NewDepthLimiter(r, 10)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	a, err := limiter.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 10, r.HitCount())
+
+	ede, ok := a.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeOther, ede.InfoCode)
+}
+
+func TestDepthLimiterPassThrough(t *testing.T) {
+	r := new(TestResolver)
+	limiter := NewDepthLimiter(NewDepthLimiter(r, 0), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := limiter.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, r.String(), limiter.String())
+}
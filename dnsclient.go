@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"log/slog"
@@ -18,6 +19,12 @@ type DNSClient struct {
 	net      string
 	pipeline *Pipeline // Pipeline also provides operation metrics.
 	opt      DNSClientOptions
+
+	// Set when the upstream failed to handle EDNS0 queries. Queries are sent
+	// without EDNS0 until the time has passed.
+	mu           sync.RWMutex
+	noEDNS0Until time.Time
+	fallback     *Counter
 }
 
 type Dialer interface {
@@ -36,8 +43,20 @@ type DNSClientOptions struct {
 
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
+
+	// Retry queries without EDNS0 if the upstream responds with FORMERR. Once
+	// a retry succeeded, queries are sent without EDNS0 for a while to avoid
+	// sending every query twice.
+	EDNS0Fallback bool
+
+	// Socket options of TCP connections. Not used with proxies.
+	TCP TCPOptions
 }
 
+// Time after which EDNS0 is tried again on an upstream that previously
+// failed to handle EDNS0 queries.
+const edns0FallbackDuration = time.Hour
+
 var _ Resolver = &DNSClient{}
 
 // NewDNSClient returns a new instance of DNSClient which is a plain DNS resolver
@@ -52,6 +71,7 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		TLSConfig: &tls.Config{},
 		LocalAddr: opt.LocalAddr,
 		Timeout:   opt.QueryTimeout,
+		TCP:       opt.TCP,
 	}
 	return &DNSClient{
 		id:       id,
@@ -59,11 +79,14 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		endpoint: endpoint,
 		pipeline: NewPipeline(id, endpoint, client, opt.QueryTimeout),
 		opt:      opt,
+		fallback: getCounter("client", id, "edns0fallback"),
 	}, nil
 }
 
 // Resolve a DNS query.
 func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	// Packing a message is not always a read-only operation, make a copy
 	q = q.Copy()
 	log := logger(d.id, q, ci)
@@ -76,13 +99,59 @@ func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Remove padding before sending over the wire in plain
 	stripPadding(q)
-	return d.pipeline.Resolve(q)
+
+	if !d.opt.EDNS0Fallback || q.IsEdns0() == nil {
+		return d.pipeline.Resolve(q)
+	}
+
+	// Skip EDNS0 if the upstream is known not to support it
+	d.mu.RLock()
+	noEDNS0 := time.Now().Before(d.noEDNS0Until)
+	d.mu.RUnlock()
+	if noEDNS0 {
+		return d.pipeline.Resolve(withoutEDNS0(q))
+	}
+
+	a, err := d.pipeline.Resolve(q)
+	if err != nil || a.Rcode != dns.RcodeFormatError {
+		return a, err
+	}
+
+	// Try again without EDNS0 and remember if that worked
+	log.Debug("received formerr, retrying without edns0")
+	a, err = d.pipeline.Resolve(withoutEDNS0(q))
+	if err == nil && a.Rcode != dns.RcodeFormatError {
+		d.fallback.Add(1)
+		d.mu.Lock()
+		d.noEDNS0Until = time.Now().Add(edns0FallbackDuration)
+		d.mu.Unlock()
+	}
+	return a, err
+}
+
+// Close the upstream connection.
+func (d *DNSClient) Close() error {
+	return d.pipeline.Close()
 }
 
 func (d *DNSClient) String() string {
 	return d.id
 }
 
+// Returns a copy of the query with the OPT record removed.
+func withoutEDNS0(q *dns.Msg) *dns.Msg {
+	q = q.Copy()
+	extra := make([]dns.RR, 0, len(q.Extra))
+	for _, rr := range q.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	q.Extra = extra
+	return q
+}
+
 // GenericDNSClient is a workaround for dns.Client not supporting custom dialers
 // (only *net.Dialer) which prevents the use of proxies. It implements the same
 // Dial functionality, while supporting custom dialers.
@@ -92,6 +161,7 @@ type GenericDNSClient struct {
 	TLSConfig *tls.Config
 	LocalAddr net.IP
 	Timeout   time.Duration
+	TCP       TCPOptions
 }
 
 func (d GenericDNSClient) Dial(address string) (*dns.Conn, error) {
@@ -116,6 +186,11 @@ func (d GenericDNSClient) Dial(address string) (*dns.Conn, error) {
 		}
 	}
 
+	// Set the TCP socket options, unless it's a proxy
+	if nd, ok := dialer.(*net.Dialer); ok && network == "tcp" {
+		dialer = d.TCP.dialer(nd)
+	}
+
 	var (
 		conn = &dns.Conn{
 			UDPSize: 4096,
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"sync/atomic"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -24,3 +25,46 @@ func TestDNSClientSimpleUDP(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDNSClientEDNS0Fallback(t *testing.T) {
+	// Start a server that doesn't support EDNS0 and counts the queries it receives
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	var queries, ednsQueries atomic.Int32
+	srv := &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		queries.Add(1)
+		a := new(dns.Msg)
+		if q.IsEdns0() != nil {
+			ednsQueries.Add(1)
+			a.SetRcode(q, dns.RcodeFormatError)
+		} else {
+			a.SetReply(q)
+		}
+		_ = w.WriteMsg(a)
+	})}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ListenAndServe() }()
+	defer srv.Shutdown()
+	<-started
+
+	d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{EDNS0Fallback: true})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	// The first query should be retried without EDNS0
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, int32(2), queries.Load())
+	require.Equal(t, int32(1), ednsQueries.Load())
+
+	// The next query should be sent without EDNS0 right away
+	a, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, int32(3), queries.Load())
+	require.Equal(t, int32(1), ednsQueries.Load())
+}
@@ -3,6 +3,8 @@ package rdns
 import (
 	"crypto/tls"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -10,7 +12,8 @@ import (
 // DNSListener is a standard DNS listener for UDP or TCP.
 type DNSListener struct {
 	*dns.Server
-	id string
+	id  string
+	tcp TCPOptions
 }
 
 var _ Listener = &DNSListener{}
@@ -18,16 +21,77 @@ var _ Listener = &DNSListener{}
 type ListenOptions struct {
 	// Network allowed to query this listener.
 	AllowedNet []*net.IPNet
+
+	// Access control list that determines how queries from clients are
+	// handled. Takes precedence over AllowedNet if set.
+	ACL *ACL
+
+	// Name compression in responses. By default, responses are only compressed
+	// if necessary to fit into a UDP response.
+	Compression CompressionMode
+
+	// Maximum size of UDP responses. Responses are limited to the smaller of this
+	// and the buffer size advertised by the client. Uses the client's buffer size
+	// if 0.
+	MaxUDPSize uint16
+
+	// Determines how UDP responses that are too large are handled. Defaults to
+	// removing records until the response fits.
+	TruncatePolicy TruncatePolicy
+
+	// Socket options of TCP connections, used by TCP and DoT listeners.
+	TCP TCPOptions
+
+	// Classifies clients into groups that are attached to their queries.
+	ClientGroups *ClientGroups
+
+	// Handling of CHAOS class queries like version.bind.
+	Chaos ChaosOptions
+
+	// Return a breakdown of the time spent resolving a query to clients that
+	// ask for it with the EDNS0TimingCode option. DoH listeners also return it
+	// in the Server-Timing header of every response.
+	ServerTiming bool
+
+	// Accept dynamic UPDATE messages so they can be routed by opcode. Only
+	// standard queries and NOTIFY are accepted by default.
+	AcceptUpdate bool
 }
 
+// CompressionMode controls name compression in responses.
+type CompressionMode string
+
+const (
+	CompressionAuto   CompressionMode = "auto"
+	CompressionAlways CompressionMode = "always"
+	CompressionNever  CompressionMode = "never"
+)
+
+// TruncatePolicy defines how UDP responses that exceed the maximum size are
+// truncated. The TC flag is set on truncated responses in all cases except
+// TruncatePolicyNever.
+type TruncatePolicy string
+
+const (
+	// Remove records from the response until it fits.
+	TruncatePolicyFit TruncatePolicy = "fit"
+	// Remove all records from the response. Clients are expected to retry the
+	// query over TCP.
+	TruncatePolicyEmpty TruncatePolicy = "empty"
+	// Never truncate responses and rely on IP fragmentation.
+	TruncatePolicyNever TruncatePolicy = "never"
+)
+
 // NewDNSListener returns an instance of either a UDP or TCP DNS listener.
 func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver) *DNSListener {
 	return &DNSListener{
-		id: id,
+		id:  id,
+		tcp: opt.TCP,
 		Server: &dns.Server{
-			Addr:    addr,
-			Net:     net,
-			Handler: listenHandler(id, net, addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Net:           net,
+			Handler:       listenHandler(id, net, addr, resolver, opt),
+			MsgAcceptFunc: opt.acceptMsg,
 		},
 	}
 }
@@ -35,36 +99,52 @@ func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver)
 // Start the DNS listener.
 func (s DNSListener) Start() error {
 	Log.Info("starting listener", "id", s.id, "protocol", s.Net, "addr", s.Addr)
+	switch s.Net {
+	case "tcp", "tcp4", "tcp6":
+		ln, err := s.tcp.listen(s.Net, s.Addr)
+		if err != nil {
+			return err
+		}
+		s.Listener = ln
+		return s.ActivateAndServe()
+	}
 	return s.ListenAndServe()
 }
 
+// Stop the listener.
+func (s DNSListener) Stop() error {
+	Log.Info("stopping listener", "id", s.id, "protocol", s.Net, "addr", s.Addr)
+	return s.Shutdown()
+}
+
 func (s DNSListener) String() string {
 	return s.id
 }
 
 // DNS handler to forward all incoming requests to a given resolver.
-func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNet) dns.HandlerFunc {
+func listenHandler(id, protocol, addr string, r Resolver, opt ListenOptions) dns.HandlerFunc {
 	metrics := NewListenerMetrics("listener", id)
+	transport := strings.TrimRight(protocol, "46") // "udp4" -> "udp"
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		var err error
 
 		ci := ClientInfo{
-			Listener: id,
+			Listener:  id,
+			Transport: transport,
+			Encrypted: transport == "dot" || transport == "dtls",
 		}
 
 		if r, ok := w.(interface{ ConnectionState() *tls.ConnectionState }); ok {
 			connState := r.ConnectionState()
 			if connState != nil {
 				ci.TLSServerName = connState.ServerName
+				ci.TLSClientName = tlsClientName(connState)
 			}
 		}
 
-		switch addr := w.RemoteAddr().(type) {
-		case *net.TCPAddr:
-			ci.SourceIP = addr.IP
-		case *net.UDPAddr:
-			ci.SourceIP = addr.IP
-		}
+		ci.SourceIP = addrIP(w.RemoteAddr())
+		ci = opt.classify(req, ci)
+		req, ci, timings := opt.startTiming(req, ci, false)
 
 		log := Log.With(
 			"id", id,
@@ -75,17 +155,26 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		)
 		log.Debug("received query")
 		metrics.query.Add(1)
+		start := time.Now()
 
 		a := new(dns.Msg)
-		if isAllowed(allowedNet, ci.SourceIP) {
-			log.With("resolver", r.String()).Debug("forwarding query to resolver")
-			a, err = r.Resolve(req, ci)
-			if err != nil {
+		switch action, resolver := opt.clientAction(ci.SourceIP, r); action {
+		case ACLActionAllow, ACLActionRoute:
+			log.With("resolver", resolver.String()).Debug("forwarding query to resolver")
+			a, err = opt.chaos(resolver).Resolve(req, ci)
+			if isPolicyError(err) {
+				log.Debug("query rejected by policy", "error", err)
+				a = policyResponse(req, err)
+			} else if err != nil {
 				metrics.err.Add("resolve", 1)
 				log.Error("failed to resolve", "error", err)
 				a = servfail(req)
 			}
-		} else {
+		case ACLActionDrop:
+			metrics.err.Add("acl", 1)
+			log.Debug("dropping query from client ip")
+			a = nil
+		default:
 			metrics.err.Add("acl", 1)
 			log.Debug("refusing client ip")
 			a.SetRcode(req, dns.RcodeRefused)
@@ -98,6 +187,11 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			return
 		}
 
+		timings.finish(req, a)
+
+		// Apply the compression setting before padding as it changes the size of the response
+		opt.compress(a)
+
 		// If the client asked via DoT and EDNS0 is enabled, the response should be padded for extra security.
 		// See rfc7830 and rfc8467.
 		if protocol == "dot" || protocol == "dtls" {
@@ -107,19 +201,32 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 		}
 
 		// Check the response actually fits if the query was sent over UDP. If not, respond with TC flag.
-		if protocol == "udp" || protocol == "dtls" {
-			maxSize := dns.MinMsgSize
-			if edns0 := req.IsEdns0(); edns0 != nil {
-				maxSize = int(edns0.UDPSize())
-			}
-			a.Truncate(maxSize)
+		if strings.HasPrefix(protocol, "udp") || protocol == "dtls" {
+			opt.truncate(req, a)
 		}
 
 		metrics.response.Add(rCode(a), 1)
+		metrics.duration.Observe(time.Since(start).Seconds())
 		_ = w.WriteMsg(a)
 	}
 }
 
+// Accepts the same messages as dns.DefaultMsgAcceptFunc, as well as dynamic
+// updates if enabled, which can then be routed based on their opcode.
+func (opt ListenOptions) acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if opt.AcceptUpdate && !isResponse && opcode == dns.OpcodeUpdate {
+		// The zone section has to contain exactly one record, the other
+		// sections hold prerequisites and updates of any size.
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
 func isAllowed(allowedNet []*net.IPNet, ip net.IP) bool {
 	if len(allowedNet) == 0 {
 		return true
@@ -131,3 +238,83 @@ func isAllowed(allowedNet []*net.IPNet, ip net.IP) bool {
 	}
 	return false
 }
+
+// Truncate a UDP response to fit into the buffer size advertised by the client
+// and the configured maximum.
+func (opt ListenOptions) truncate(q, a *dns.Msg) {
+	if opt.TruncatePolicy == TruncatePolicyNever {
+		return
+	}
+	maxSize := dns.MinMsgSize
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		maxSize = int(edns0.UDPSize())
+	}
+	if opt.MaxUDPSize > 0 && int(opt.MaxUDPSize) < maxSize {
+		maxSize = max(int(opt.MaxUDPSize), dns.MinMsgSize)
+	}
+
+	switch opt.TruncatePolicy {
+	case TruncatePolicyEmpty:
+		// Check the size the response is sent with, compressed if it's
+		// configured or the response already was
+		opt.compress(a)
+		if a.Len() > maxSize {
+			a.Answer = nil
+			a.Ns = nil
+			a.Extra = optRecords(a.Extra)
+			a.Truncated = true
+		}
+	default:
+		if opt.Compression == CompressionNever {
+			truncateUncompressed(a, maxSize)
+		} else {
+			a.Truncate(maxSize)
+		}
+	}
+	opt.compress(a)
+}
+
+// Set the compression flag on a response as per configuration.
+func (opt ListenOptions) compress(a *dns.Msg) {
+	switch opt.Compression {
+	case CompressionAlways:
+		a.Compress = true
+	case CompressionNever:
+		a.Compress = false
+	}
+}
+
+// Remove records from the end of a message until it fits into size bytes without
+// using name compression. OPT records are retained.
+func truncateUncompressed(a *dns.Msg, size int) {
+	a.Compress = false
+	for a.Len() > size {
+		switch {
+		case len(a.Extra) > len(optRecords(a.Extra)):
+			for i := len(a.Extra) - 1; i >= 0; i-- {
+				if _, ok := a.Extra[i].(*dns.OPT); !ok {
+					a.Extra = append(a.Extra[:i], a.Extra[i+1:]...)
+					break
+				}
+			}
+		case len(a.Ns) > 0:
+			a.Ns = a.Ns[:len(a.Ns)-1]
+		case len(a.Answer) > 0:
+			a.Answer = a.Answer[:len(a.Answer)-1]
+		default:
+			return
+		}
+		a.Truncated = true
+	}
+}
+
+// Returns only the OPT records from a list of records.
+func optRecords(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Build a response with n A records.
+func largeResponse(q *dns.Msg, n int) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	for i := 0; i < n; i++ {
+		a.Answer = append(a.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: qName(q), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+	return a
+}
+
+func TestListenOptionsTruncate(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("a-somewhat-long-name.example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	tests := []struct {
+		opt       ListenOptions
+		records   int // Records in the response, 50 if not set
+		truncated bool
+		maxLen    int
+		answers   func(int) bool
+		compress  bool
+	}{
+		// Fits into the client buffer size
+		{opt: ListenOptions{}, truncated: false, maxLen: 4096, answers: func(n int) bool { return n == 50 }, compress: false},
+		// Limited by the configured max size
+		{opt: ListenOptions{MaxUDPSize: 512}, truncated: true, maxLen: 512, answers: func(n int) bool { return n > 0 && n < 50 }, compress: true},
+		// Limited and no compression
+		{opt: ListenOptions{MaxUDPSize: 512, Compression: CompressionNever}, truncated: true, maxLen: 512, answers: func(n int) bool { return n > 0 && n < 50 }, compress: false},
+		// Empty response when truncated, without changing the compression in auto mode
+		{opt: ListenOptions{MaxUDPSize: 512, TruncatePolicy: TruncatePolicyEmpty}, truncated: true, maxLen: 512, answers: func(n int) bool { return n == 0 }, compress: false},
+		// Empty response if it doesn't fit uncompressed
+		{opt: ListenOptions{MaxUDPSize: 512, TruncatePolicy: TruncatePolicyEmpty}, records: 20, truncated: true, maxLen: 512, answers: func(n int) bool { return n == 0 }, compress: false},
+		// Fits when compression is always used
+		{opt: ListenOptions{MaxUDPSize: 512, TruncatePolicy: TruncatePolicyEmpty, Compression: CompressionAlways}, records: 20, truncated: false, maxLen: 512, answers: func(n int) bool { return n == 20 }, compress: true},
+		// Never truncate
+		{opt: ListenOptions{MaxUDPSize: 512, TruncatePolicy: TruncatePolicyNever}, truncated: false, maxLen: 4096, answers: func(n int) bool { return n == 50 }, compress: false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			records := test.records
+			if records == 0 {
+				records = 50
+			}
+			a := largeResponse(q, records)
+			test.opt.truncate(q, a)
+			require.Equal(t, test.truncated, a.Truncated)
+			require.Equal(t, test.compress, a.Compress)
+			require.LessOrEqual(t, a.Len(), test.maxLen)
+			require.True(t, test.answers(len(a.Answer)), "unexpected number of answers %d", len(a.Answer))
+		})
+	}
+}
+
+func TestListenOptionsCompress(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	a := largeResponse(q, 2)
+	ListenOptions{Compression: CompressionAlways}.compress(a)
+	require.True(t, a.Compress)
+
+	ListenOptions{Compression: CompressionNever}.compress(a)
+	require.False(t, a.Compress)
+
+	// Auto doesn't change the existing setting
+	a.Compress = true
+	ListenOptions{}.compress(a)
+	require.True(t, a.Compress)
+}
+
+func TestDNSListenerUDPSourceAddress(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Find a free port and start the listener on the wildcard address with it
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	s := NewDNSListener("test-ln", ":"+port, "udp", ListenOptions{}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	// Send queries to two different local addresses. The client only accepts
+	// responses from the address it sent the query to.
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		c := &dns.Client{Net: "udp", Timeout: time.Second}
+		conn, err := c.Dial(net.JoinHostPort(ip, port))
+		require.NoError(t, err)
+
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, _, err = c.ExchangeWithConn(q, conn)
+		require.NoError(t, err, ip)
+		conn.Close()
+	}
+	require.Equal(t, 2, upstream.HitCount())
+}
@@ -0,0 +1,289 @@
+package rdns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECMonitor is a resolver that passes all queries through unchanged, and
+// uses the resolver to regularly check the DNSSEC configuration of a list of
+// zones. It alerts on problems that would make a zone fail validation, or
+// will do so soon:
+//
+//   - None of the DS records in the parent zone match a DNSKEY of the zone.
+//   - CDS or CDNSKEY records are published that don't match the DS records,
+//     meaning a key rollover is pending in the parent zone.
+//   - RRSIGs over the DNSKEY, CDS, CDNSKEY or SOA records expire soon or have
+//     expired already.
+//
+// Alerts are logged, counted in metrics and sent to notifiers.
+type DNSSECMonitor struct {
+	id       string
+	resolver Resolver
+	opt      DNSSECMonitorOptions
+	metrics  *DNSSECMonitorMetrics
+
+	// Set once the monitor is closed, stops the checks.
+	closed atomic.Bool
+}
+
+// DNSSECMonitorOptions contain settings for the DNSSEC monitor.
+type DNSSECMonitorOptions struct {
+	// Zones to monitor.
+	Zones []string
+
+	// Time between checks. Defaults to 1 hour.
+	Interval time.Duration
+
+	// Alert when signatures expire within this time. Defaults to 7 days.
+	ExpiryWarning time.Duration
+
+	// Source of time for the check interval and signature expiry. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+type DNSSECMonitorMetrics struct {
+	// Number of alerts by type.
+	alerts *CounterMap
+	// Seconds until the first signature expires, by zone.
+	expiry *GaugeMap
+}
+
+// DNSSECAlert is a problem found with the DNSSEC configuration of a zone.
+type DNSSECAlert struct {
+	Zone    string    `json:"zone"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Types of DNSSEC alerts.
+const (
+	DNSSECAlertQueryFailed   = "query-failed"
+	DNSSECAlertDSMismatch    = "ds-mismatch"
+	DNSSECAlertCDSPending    = "cds-pending"
+	DNSSECAlertRRSIGExpiring = "rrsig-expiring"
+	DNSSECAlertRRSIGExpired  = "rrsig-expired"
+	DNSSECAlertNotSigned     = "not-signed"
+)
+
+var _ Resolver = &DNSSECMonitor{}
+
+// NewDNSSECMonitor returns a new instance of a DNSSEC monitor and starts
+// checking the zones in the background.
+func NewDNSSECMonitor(id string, resolver Resolver, opt DNSSECMonitorOptions) *DNSSECMonitor {
+	if opt.Interval == 0 {
+		opt.Interval = time.Hour
+	}
+	if opt.ExpiryWarning == 0 {
+		opt.ExpiryWarning = 7 * 24 * time.Hour
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	m := &DNSSECMonitor{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &DNSSECMonitorMetrics{
+			alerts: getCounterMap("router", id, "alert", "type"),
+			expiry: getGaugeMap("router", id, "expiry", "zone"),
+		},
+	}
+	go m.checkLoop()
+	return m
+}
+
+// Resolve passes the query to the resolver.
+func (r *DNSSECMonitor) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *DNSSECMonitor) String() string {
+	return r.id
+}
+
+// Close stops checking the zones.
+func (r *DNSSECMonitor) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
+func (r *DNSSECMonitor) checkLoop() {
+	for !r.closed.Load() {
+		for _, zone := range r.opt.Zones {
+			for _, alert := range r.check(dns.Fqdn(zone)) {
+				r.alert(alert)
+			}
+		}
+		r.opt.Clock.Sleep(r.opt.Interval)
+	}
+}
+
+// Runs all checks for a zone and returns the problems found.
+func (r *DNSSECMonitor) check(zone string) []DNSSECAlert {
+	now := r.opt.Clock.Now()
+	var alerts []DNSSECAlert
+	add := func(typ, format string, args ...any) {
+		alerts = append(alerts, DNSSECAlert{Zone: zone, Type: typ, Message: fmt.Sprintf(format, args...), Time: now})
+	}
+
+	records := make(map[uint16][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, t := range []uint16{dns.TypeDNSKEY, dns.TypeDS, dns.TypeCDS, dns.TypeCDNSKEY, dns.TypeSOA} {
+		rrs, err := r.query(zone, t)
+		if err != nil {
+			add(DNSSECAlertQueryFailed, "failed to query %s: %v", dns.TypeToString[t], err)
+			return alerts
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.RRSIG:
+				// The DS RRSIG is made by the parent and monitored there
+				if rr.TypeCovered != dns.TypeDS {
+					sigs = append(sigs, rr)
+				}
+			default:
+				if rr.Header().Rrtype == t {
+					records[t] = append(records[t], rr)
+				}
+			}
+		}
+	}
+
+	// DS records in the parent need to match at least one DNSKEY
+	var keys []*dns.DNSKEY
+	for _, rr := range records[dns.TypeDNSKEY] {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	ds := dsSet(records[dns.TypeDS])
+	if len(ds) > 0 && !dsMatchesKeys(ds, keys) {
+		add(DNSSECAlertDSMismatch, "none of the DS records match a DNSKEY of the zone")
+	}
+
+	// CDS and CDNSKEY records signal the DS records the parent should have
+	cds := dsSet(records[dns.TypeCDS])
+	if len(cds) > 0 && !sameDSSet(cds, ds) {
+		add(DNSSECAlertCDSPending, "CDS records don't match the DS records in the parent zone")
+	}
+	for _, rr := range records[dns.TypeCDNSKEY] {
+		key := &rr.(*dns.CDNSKEY).DNSKEY
+		if key.Algorithm == 0 { // Delete request, RFC8078
+			continue
+		}
+		if !dsMatchesKeys(ds, []*dns.DNSKEY{key}) {
+			add(DNSSECAlertCDSPending, "CDNSKEY with key tag %d has no matching DS record in the parent zone", key.KeyTag())
+		}
+	}
+
+	// Signatures
+	if len(ds) > 0 && len(sigs) == 0 {
+		add(DNSSECAlertNotSigned, "zone has DS records but no signatures")
+	}
+	earliest := time.Duration(-1)
+	for _, sig := range sigs {
+		// Serial number arithmetic as per RFC4034, section 3.1.5
+		left := time.Duration(int32(sig.Expiration-uint32(now.Unix()))) * time.Second
+		if earliest < 0 || left < earliest {
+			earliest = left
+		}
+		typ := dns.TypeToString[sig.TypeCovered]
+		switch {
+		case left <= 0:
+			add(DNSSECAlertRRSIGExpired, "RRSIG over %s with key tag %d expired %s ago", typ, sig.KeyTag, -left)
+		case left < r.opt.ExpiryWarning:
+			add(DNSSECAlertRRSIGExpiring, "RRSIG over %s with key tag %d expires in %s", typ, sig.KeyTag, left)
+		}
+	}
+	if len(sigs) > 0 {
+		r.metrics.expiry.Set(zone, int64(earliest.Seconds()))
+	}
+	return alerts
+}
+
+// Queries the resolver with the DO bit set and returns answer records.
+func (r *DNSSECMonitor) query(zone string, qtype uint16) ([]dns.RR, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(zone, qtype)
+	q.SetEdns0(4096, true)
+	a, err := r.resolver.Resolve(q, ClientInfo{})
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("no response")
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("response code %s", dns.RcodeToString[a.Rcode])
+	}
+	return a.Answer, nil
+}
+
+// Logs an alert, adds it to the metrics and sends it to notifiers.
+func (r *DNSSECMonitor) alert(a DNSSECAlert) {
+	Log.Warn("dnssec problem detected", "id", r.id, "zone", a.Zone, "type", a.Type, "message", a.Message)
+	r.metrics.alerts.Add(a.Type, 1)
+	Notify(Event{
+		Type:    EventDNSSECProblem,
+		ID:      r.id,
+		Message: a.Message,
+		Time:    a.Time,
+		Details: map[string]string{"zone": a.Zone, "problem": a.Type},
+	})
+}
+
+// Returns the DS records in a list of DS or CDS records, ignoring CDS
+// delete requests.
+func dsSet(rrs []dns.RR) []*dns.DS {
+	var ds []*dns.DS
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = append(ds, rr)
+		case *dns.CDS:
+			if rr.Algorithm != 0 {
+				ds = append(ds, &rr.DS)
+			}
+		}
+	}
+	return ds
+}
+
+// Returns true if any of the DS records matches any of the keys.
+func dsMatchesKeys(ds []*dns.DS, keys []*dns.DNSKEY) bool {
+	for _, d := range ds {
+		for _, key := range keys {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			computed := key.ToDS(d.DigestType)
+			if computed != nil && strings.EqualFold(computed.Digest, d.Digest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if both sets contain the same DS records.
+func sameDSSet(a, b []*dns.DS) bool {
+	key := func(d *dns.DS) string {
+		return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToLower(d.Digest))
+	}
+	set := make(map[string]struct{})
+	for _, d := range a {
+		set[key(d)] = struct{}{}
+	}
+	if len(set) != len(b) {
+		return false
+	}
+	for _, d := range b {
+		if _, ok := set[key(d)]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package rdns
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSSECMonitor(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+
+	// Signed zone with a KSK, published DS and a CDS for a new key
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	newKey := &dns.DNSKEY{Hdr: key.Hdr, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	_, err = newKey.Generate(256)
+	require.NoError(t, err)
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		KeyTag:     key.KeyTag(),
+		SignerName: "example.com.",
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(now.Add(-24 * time.Hour).Unix()),
+		Expiration: uint32(now.Add(2 * 24 * time.Hour).Unix()),
+	}
+	require.NoError(t, sig.Sign(priv.(crypto.Signer), []dns.RR{key}))
+
+	ds := key.ToDS(dns.SHA256)
+	cds := &dns.CDS{DS: *newKey.ToDS(dns.SHA256)}
+	cds.Hdr.Rrtype = dns.TypeCDS
+
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Qtype {
+			case dns.TypeDNSKEY:
+				a.Answer = []dns.RR{key, sig}
+			case dns.TypeDS:
+				a.Answer = []dns.RR{ds}
+			case dns.TypeCDS:
+				a.Answer = []dns.RR{cds}
+			}
+			return a, nil
+		},
+	}
+
+	m := NewDNSSECMonitor("test-dnssec-monitor", upstream, DNSSECMonitorOptions{
+		Zones: []string{"example.com"},
+		Clock: clock,
+	})
+
+	// Wait for the first check to complete
+	clock.BlockUntil(1)
+	require.Equal(t, "172800", m.metrics.expiry.Get("example.com.").String())
+	require.Equal(t, "1", m.metrics.alerts.Get(DNSSECAlertRRSIGExpiring).String())
+	require.Equal(t, "1", m.metrics.alerts.Get(DNSSECAlertCDSPending).String())
+	require.Nil(t, m.metrics.alerts.Get(DNSSECAlertDSMismatch))
+
+	// Replace the DS with one that doesn't match, and let the signature expire
+	ds = newKey.ToDS(dns.SHA256)
+	clock.Advance(3 * 24 * time.Hour)
+	clock.BlockUntil(1)
+	require.Equal(t, "1", m.metrics.alerts.Get(DNSSECAlertDSMismatch).String())
+	require.Equal(t, "1", m.metrics.alerts.Get(DNSSECAlertRRSIGExpired).String())
+	require.Equal(t, "-86400", m.metrics.expiry.Get("example.com.").String())
+}
@@ -0,0 +1,990 @@
+package rdns
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECValidator validates the DNSSEC signatures of responses from its
+// upstream resolver, following the chain of trust down from the trust anchors.
+// Responses that fail validation are replaced with SERVFAIL and an Extended
+// DNS Error explaining why. Validated responses have the AD flag set if the
+// client asked for it. Signatures and denial-of-existence records are removed
+// from responses to clients that didn't set the DO flag.
+//
+// Queries are sent upstream with the CD flag so the upstream resolver returns
+// responses even if it considers them bogus. Queries with the CD flag from
+// clients are passed through without validation. Keys and zone cuts found
+// while following the chain of trust are cached.
+type DNSSECValidator struct {
+	id       string
+	resolver Resolver
+	opt      DNSSECValidatorOptions
+	metrics  *DNSSECValidatorMetrics
+	anchors  map[string][]*dns.DS // Trust anchors by zone
+
+	mu   sync.Mutex
+	cuts map[string]*dnssecCut
+}
+
+// DNSSECValidatorOptions contain settings for the DNSSEC validator.
+type DNSSECValidatorOptions struct {
+	// DS records the chain of trust starts from, typically of the root
+	// zone. Anchors for other zones can be added for private zones that
+	// aren't signed from the root. Defaults to the root zone keys.
+	TrustAnchors []*dns.DS
+
+	// Maximum time keys and zone cuts are cached, default 1 hour. Entries
+	// are never cached longer than the TTL of their records.
+	KeyCacheTTL time.Duration
+
+	// Source of time for validity of signatures and the cache. Defaults
+	// to the system clock.
+	Clock Clock
+}
+
+type DNSSECValidatorMetrics struct {
+	// Responses by validation result, "secure", "insecure" or "bogus".
+	result *CounterMap
+}
+
+// Result of checking whether a name is a zone cut.
+type dnssecCut struct {
+	kind   dnssecCutKind
+	keys   []*dns.DNSKEY // Validated keys of the zone, if it's a secure cut
+	expiry time.Time
+}
+
+type dnssecCutKind int
+
+const (
+	dnssecNoCut       dnssecCutKind = iota // Name is part of the parent zone
+	dnssecSecureCut                        // Signed child zone with validated keys
+	dnssecInsecureCut                      // Delegation without DS records
+	dnssecNoName                           // Name doesn't exist
+)
+
+// Error for responses that failed validation, with the EDE code returned
+// to clients.
+type dnssecError struct {
+	code uint16
+	text string
+}
+
+func (e *dnssecError) Error() string {
+	return e.text
+}
+
+func bogus(code uint16, format string, args ...any) *dnssecError {
+	return &dnssecError{code: code, text: fmt.Sprintf(format, args...)}
+}
+
+// Returned when the name is in an unsigned zone, or there's no trust anchor
+// for it.
+var errDNSSECInsecure = errors.New("insecure")
+
+// Root zone trust anchors, KSK-2017 and KSK-2024. Published by IANA at
+// https://data.iana.org/root-anchors/root-anchors.xml
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const defaultDNSSECKeyCacheTTL = time.Hour
+
+var _ Resolver = &DNSSECValidator{}
+
+// NewDNSSECValidator returns a new instance of a DNSSEC validator.
+func NewDNSSECValidator(id string, resolver Resolver, opt DNSSECValidatorOptions) (*DNSSECValidator, error) {
+	if len(opt.TrustAnchors) == 0 {
+		for _, s := range rootTrustAnchors {
+			ds, err := ParseTrustAnchor(s)
+			if err != nil {
+				return nil, err
+			}
+			opt.TrustAnchors = append(opt.TrustAnchors, ds)
+		}
+	}
+	if opt.KeyCacheTTL <= 0 {
+		opt.KeyCacheTTL = defaultDNSSECKeyCacheTTL
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	anchors := make(map[string][]*dns.DS)
+	for _, ds := range opt.TrustAnchors {
+		zone := canonicalName(ds.Hdr.Name)
+		anchors[zone] = append(anchors[zone], ds)
+	}
+	return &DNSSECValidator{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		anchors:  anchors,
+		cuts:     make(map[string]*dnssecCut),
+		metrics: &DNSSECValidatorMetrics{
+			result: getCounterMap("router", id, "dnssec", "result"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query and validate the response.
+func (r *DNSSECValidator) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return r.resolver.Resolve(q, ci)
+	}
+	edns0 := q.IsEdns0()
+	do := edns0 != nil && edns0.Do()
+
+	// Ask for signatures, and for the response even if the upstream resolver
+	// considers it bogus, to be able to tell why
+	uq := q.Copy()
+	setDO(uq)
+	uq.CheckingDisabled = true
+	a, err := r.resolver.Resolve(uq, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	var secure bool
+	if !q.CheckingDisabled {
+		log := logger(r.id, q, ci)
+		secure, err = r.validate(a)
+		var e *dnssecError
+		switch {
+		case errors.As(err, &e):
+			log.Debug("dnssec validation failed", "error", e, "ede", e.code)
+			r.metrics.result.Add("bogus", 1)
+			return bogusResponse(q, e), nil
+		case err != nil:
+			log.Debug("failed to validate response", "error", err)
+			return nil, err
+		case secure:
+			r.metrics.result.Add("secure", 1)
+		default:
+			r.metrics.result.Add("insecure", 1)
+		}
+	}
+
+	a = a.Copy()
+	a.Id = q.Id
+	a.CheckingDisabled = q.CheckingDisabled
+	a.AuthenticatedData = secure && (do || q.AuthenticatedData)
+	if a.AuthenticatedData {
+		recordLocalValidation(ci)
+	}
+	if !do {
+		stripDNSSEC(a, q.Question[0].Qtype, edns0 != nil)
+	}
+	return a, nil
+}
+
+type localValidationKey struct{}
+
+// Adds a flag to the query that's set if a DNSSEC validator down the pipeline
+// validated the response, for elements that only trust the AD flag if it was
+// set locally.
+func trackLocalValidation(ci ClientInfo) (ClientInfo, *atomic.Bool) {
+	validated := new(atomic.Bool)
+	return ci.WithValue(localValidationKey{}, validated), validated
+}
+
+// Records that the response was validated, if an element up the pipeline asked
+// for it.
+func recordLocalValidation(ci ClientInfo) {
+	if validated, ok := ci.Value(localValidationKey{}).(*atomic.Bool); ok {
+		validated.Store(true)
+	}
+}
+
+func (r *DNSSECValidator) String() string {
+	return r.id
+}
+
+// Validates the records in a response and proofs of non-existence. Returns
+// true if everything is signed and valid, false if any part of it is
+// insecure, or a *dnssecError if it's bogus.
+func (r *DNSSECValidator) validate(a *dns.Msg) (bool, error) {
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	if len(a.Question) != 1 {
+		return false, nil
+	}
+	question := a.Question[0]
+	now := r.opt.Clock.Now()
+	secure := true
+
+	// The authority section can contain unsigned NS records of the parent
+	// zone, only the SOA and denial records are validated there
+	var authority []dns.RR
+	for _, rr := range a.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			authority = append(authority, rr)
+		}
+	}
+	answer, wildcards, err := r.validateRRsets(a.Answer, now)
+	if errors.Is(err, errDNSSECInsecure) {
+		secure = false
+	} else if err != nil {
+		return false, err
+	}
+	denial, _, err := r.validateRRsets(authority, now)
+	if errors.Is(err, errDNSSECInsecure) {
+		secure = false
+	} else if err != nil {
+		return false, err
+	}
+
+	// Follow CNAMEs to the name the response is for
+	sname := canonicalName(question.Name)
+	for range answer {
+		target := ""
+		for _, rr := range answer {
+			if c, ok := rr.(*dns.CNAME); ok && canonicalName(c.Hdr.Name) == sname && question.Qtype != dns.TypeCNAME {
+				target = canonicalName(c.Target)
+			}
+		}
+		if target == "" {
+			break
+		}
+		sname = target
+	}
+	var hasAnswer bool
+	for _, rr := range answer {
+		if canonicalName(rr.Header().Name) == sname && (rr.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY) {
+			hasAnswer = true
+		}
+	}
+
+	// Answers synthesized from wildcards need proof there's no closer match
+	for _, name := range wildcards {
+		if !secure {
+			break
+		}
+		if !provesNoCloserMatch(denial, name.owner, name.labels) {
+			return false, bogus(dns.ExtendedErrorCodeNSECMissing, "no proof for wildcard answer for %s", name.owner)
+		}
+	}
+
+	// Negative responses need proof that the name or type doesn't exist
+	if hasAnswer || !secure {
+		return secure, nil
+	}
+
+	// The proof has to come from the zone of the name, or the parent for DS
+	// records. Records replayed from a parent zone don't prove anything about
+	// names below a delegation.
+	zoneName := sname
+	if question.Qtype == dns.TypeDS && sname != "." {
+		zoneName = dns.Fqdn(strings.Join(dns.SplitDomainName(sname)[1:], "."))
+	}
+	zone, keys, err := r.zone(zoneName)
+	if errors.Is(err, errDNSSECInsecure) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	denial = denialFor(denial, sname)
+	if len(denial) == 0 {
+		return false, bogus(dns.ExtendedErrorCodeNSECMissing, "no proof of non-existence for %s", sname)
+	}
+	if err := r.verifyDenial(a.Ns, denial, zone, keys, now); err != nil {
+		return false, err
+	}
+	if a.Rcode == dns.RcodeNameError {
+		if !provesNameError(denial, sname) {
+			return false, bogus(dns.ExtendedErrorCodeDNSBogus, "invalid proof of non-existence for %s", sname)
+		}
+		return true, nil
+	}
+	if !provesNoData(denial, sname, question.Qtype) {
+		return false, bogus(dns.ExtendedErrorCodeDNSBogus, "invalid proof of non-existence for %s %s", sname, dns.TypeToString[question.Qtype])
+	}
+	return true, nil
+}
+
+// Owner and number of labels in the signature of an answer expanded from a
+// wildcard.
+type dnssecWildcard struct {
+	owner  string
+	labels uint8
+}
+
+// Validates all RRsets in a list of records. Returns the validated records
+// without signatures and the names of answers expanded from wildcards.
+// Returns errDNSSECInsecure along with the records if any of them are in an
+// insecure zone.
+func (r *DNSSECValidator) validateRRsets(rrs []dns.RR, now time.Time) ([]dns.RR, []dnssecWildcard, error) {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	sigs := make(map[setKey][]*dns.RRSIG)
+	var order []setKey
+	var records []dns.RR
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := setKey{canonicalName(sig.Hdr.Name), sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := setKey{canonicalName(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+		records = append(records, rr)
+	}
+
+	var insecure bool
+	var wildcards []dnssecWildcard
+	for _, key := range order {
+		set, setSigs := sets[key], sigs[key]
+		if len(setSigs) == 0 {
+			// Unsigned records are only acceptable in insecure zones
+			_, _, err := r.zone(key.name)
+			if errors.Is(err, errDNSSECInsecure) {
+				insecure = true
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no signature for %s %s", key.name, dns.TypeToString[key.rtype])
+		}
+		signer := canonicalName(setSigs[0].SignerName)
+		if !dns.IsSubDomain(signer, key.name) {
+			return nil, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "signer %s is not a parent of %s", signer, key.name)
+		}
+		zone, keys, err := r.zone(signer)
+		if errors.Is(err, errDNSSECInsecure) {
+			insecure = true
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if zone != signer {
+			return nil, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "signer %s of %s is not a zone", signer, key.name)
+		}
+		sig, err := verifyRRset(set, setSigs, keys, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if labels := uint8(dns.CountLabel(key.name)); sig.Labels < labels {
+			wildcards = append(wildcards, dnssecWildcard{owner: key.name, labels: sig.Labels})
+		}
+	}
+	if insecure {
+		return records, wildcards, errDNSSECInsecure
+	}
+	return records, wildcards, nil
+}
+
+// Returns the zone containing a name and its validated keys, following the
+// chain of trust down from the closest trust anchor. Returns
+// errDNSSECInsecure if the zone isn't signed.
+func (r *DNSSECValidator) zone(name string) (string, []*dns.DNSKEY, error) {
+	name = canonicalName(name)
+	labels := dns.SplitDomainName(name)
+	// Find the closest trust anchor
+	start := -1
+	for i := 0; i <= len(labels); i++ {
+		if _, ok := r.anchors[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return "", nil, errDNSSECInsecure
+	}
+	zone := dns.Fqdn(strings.Join(labels[start:], "."))
+	keys, err := r.anchorKeys(zone)
+	if err != nil {
+		return "", nil, err
+	}
+	// Check every name below the anchor for zone cuts
+	for i := start - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		cut, err := r.cut(child, zone, keys)
+		if err != nil {
+			return "", nil, err
+		}
+		switch cut.kind {
+		case dnssecSecureCut:
+			zone, keys = child, cut.keys
+		case dnssecInsecureCut:
+			return "", nil, errDNSSECInsecure
+		case dnssecNoName:
+			return zone, keys, nil
+		}
+	}
+	return zone, keys, nil
+}
+
+// Returns the validated keys of a zone with a trust anchor.
+func (r *DNSSECValidator) anchorKeys(zone string) ([]*dns.DNSKEY, error) {
+	if cut := r.cached(zone); cut != nil {
+		return cut.keys, nil
+	}
+	keys, ttl, err := r.zoneKeys(zone, r.anchors[zone])
+	if err != nil {
+		return nil, err
+	}
+	r.cache(zone, &dnssecCut{kind: dnssecSecureCut, keys: keys}, ttl)
+	return keys, nil
+}
+
+// Determines if a name is a zone cut below the given zone, by looking up its
+// DS records which are signed by the parent.
+func (r *DNSSECValidator) cut(name, parent string, parentKeys []*dns.DNSKEY) (*dnssecCut, error) {
+	if cut := r.cached(name); cut != nil {
+		return cut, nil
+	}
+	now := r.opt.Clock.Now()
+	a, err := r.query(name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	var ds []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			if canonicalName(rr.Hdr.Name) == name {
+				ds = append(ds, rr)
+			}
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDS && canonicalName(rr.Hdr.Name) == name {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	// Signed child zone, validate its keys with the DS records
+	if a.Rcode == dns.RcodeSuccess && len(ds) > 0 {
+		if _, err := verifyRRset(ds, sigs, parentKeys, now); err != nil {
+			return nil, err
+		}
+		keys, ttl, err := r.zoneKeys(name, dsSet(ds))
+		if err != nil {
+			return nil, err
+		}
+		cut := &dnssecCut{kind: dnssecSecureCut, keys: keys}
+		r.cache(name, cut, min(ttl, rrsetTTL(ds)))
+		return cut, nil
+	}
+
+	// Otherwise the parent has to prove there are no DS records
+	var denial []dns.RR
+	for _, rr := range a.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			denial = append(denial, rr)
+		}
+	}
+	if err := r.verifyDenial(a.Ns, denial, parent, parentKeys, now); err != nil {
+		return nil, err
+	}
+	denial = denialFor(denial, name)
+	cut := &dnssecCut{kind: dnssecNoCut}
+	switch {
+	case a.Rcode == dns.RcodeNameError:
+		if !provesNameError(denial, name) {
+			return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "invalid proof of non-existence for %s", name)
+		}
+		cut.kind = dnssecNoName
+	case a.Rcode != dns.RcodeSuccess:
+		return nil, fmt.Errorf("failed to query DS for %s: %s", name, rCode(a))
+	default:
+		types, ok := nameTypes(denial, name)
+		switch {
+		case ok && slices.Contains(types, dns.TypeDS):
+			return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "DS records for %s missing", name)
+		case ok && slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+			cut.kind = dnssecInsecureCut
+		case ok:
+		case optOutCovers(denial, name):
+			cut.kind = dnssecInsecureCut
+		case nsecCoversEmptyNonTerminal(denial, name):
+		default:
+			return nil, bogus(dns.ExtendedErrorCodeNSECMissing, "no proof of missing DS records for %s", name)
+		}
+	}
+	r.cache(name, cut, rrsetTTL(denial))
+	return cut, nil
+}
+
+// Validates the signatures of NSEC and NSEC3 records in a response, which
+// have to be made by the given zone.
+func (r *DNSSECValidator) verifyDenial(rrs, denial []dns.RR, zone string, keys []*dns.DNSKEY, now time.Time) error {
+	if len(denial) == 0 {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof of non-existence in %s", zone)
+	}
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	for _, rr := range denial {
+		key := setKey{canonicalName(rr.Header().Name), rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+	for key, set := range sets {
+		var sigs []*dns.RRSIG
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == key.rtype && canonicalName(sig.Hdr.Name) == key.name && canonicalName(sig.SignerName) == zone {
+				sigs = append(sigs, sig)
+			}
+		}
+		if _, err := verifyRRset(set, sigs, keys, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queries the DNSKEY records of a zone and returns those that are validated
+// by the DS records, along with the TTL they can be cached for.
+func (r *DNSSECValidator) zoneKeys(zone string, ds []*dns.DS) ([]*dns.DNSKEY, time.Duration, error) {
+	a, err := r.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("failed to query DNSKEY for %s: %s", zone, rCode(a))
+	}
+	var set []dns.RR
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range a.Answer {
+		if canonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			set = append(set, rr)
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	// The key set has to be signed by a key that matches a DS record
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		if dsMatchesKeys(ds, []*dns.DNSKEY{key}) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, 0, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s matches its DS records", zone)
+	}
+	if _, err := verifyRRset(set, sigs, trusted, r.opt.Clock.Now()); err != nil {
+		return nil, 0, err
+	}
+	return keys, rrsetTTL(set), nil
+}
+
+// Sends a query for DNSSEC records to the upstream resolver.
+func (r *DNSSECValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(4096, true)
+	q.CheckingDisabled = true
+	a, err := r.resolver.Resolve(q, ClientInfo{})
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("no response for %s %s", name, dns.TypeToString[qtype])
+	}
+	return a, nil
+}
+
+func (r *DNSSECValidator) cached(name string) *dnssecCut {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cut, ok := r.cuts[name]
+	if !ok {
+		return nil
+	}
+	if r.opt.Clock.Now().After(cut.expiry) {
+		delete(r.cuts, name)
+		return nil
+	}
+	return cut
+}
+
+func (r *DNSSECValidator) cache(name string, cut *dnssecCut, ttl time.Duration) {
+	cut.expiry = r.opt.Clock.Now().Add(min(ttl, r.opt.KeyCacheTTL))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Drop expired entries once in a while to limit the size
+	if len(r.cuts) >= 10000 {
+		now := r.opt.Clock.Now()
+		for name, c := range r.cuts {
+			if now.After(c.expiry) {
+				delete(r.cuts, name)
+			}
+		}
+	}
+	r.cuts[name] = cut
+}
+
+// Checks the signatures of an RRset with the keys. Returns the signature that
+// validated it, or the reason none did.
+func verifyRRset(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) (*dns.RRSIG, error) {
+	name := set[0].Header().Name
+	typ := dns.TypeToString[set[0].Header().Rrtype]
+	if len(sigs) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no signature for %s %s", name, typ)
+	}
+	var err *dnssecError
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(key, set) != nil {
+				err = bogus(dns.ExtendedErrorCodeDNSBogus, "invalid signature for %s %s", name, typ)
+				continue
+			}
+			if sig.ValidityPeriod(now) {
+				return sig, nil
+			}
+			// Serial number arithmetic as per RFC4034, section 3.1.5
+			if int32(sig.Inception-uint32(now.Unix())) > 0 {
+				err = bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "signature for %s %s not yet valid", name, typ)
+			} else {
+				err = bogus(dns.ExtendedErrorCodeSignatureExpired, "signature for %s %s expired", name, typ)
+			}
+		}
+	}
+	if err == nil {
+		err = bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no key for signature of %s %s", name, typ)
+	}
+	return nil, err
+}
+
+// Returns the types that exist at a name according to a matching NSEC or
+// NSEC3 record. Returns false if there's none for the name.
+func nameTypes(denial []dns.RR, name string) ([]uint16, bool) {
+	for _, rr := range denial {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if canonicalName(rr.Hdr.Name) == name {
+				return rr.TypeBitMap, true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return rr.TypeBitMap, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Returns the denial records that can prove something about a name. Records of
+// a delegation above the name come from the parent zone, which isn't
+// authoritative for names below the delegation, RFC4035 section 5.4 and
+// RFC6840 section 4.1.
+func denialFor(denial []dns.RR, name string) []dns.RR {
+	delegation := func(types []uint16) bool {
+		return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+	}
+	return slices.DeleteFunc(slices.Clone(denial), func(rr dns.RR) bool {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			owner := canonicalName(rr.Hdr.Name)
+			return owner != name && dns.IsSubDomain(owner, name) && delegation(rr.TypeBitMap)
+		case *dns.NSEC3:
+			if !delegation(rr.TypeBitMap) {
+				return false
+			}
+			labels := dns.SplitDomainName(name)
+			for i := 1; i <= len(labels); i++ {
+				if rr.Match(dns.Fqdn(strings.Join(labels[i:], "."))) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// Returns true if an NSEC or NSEC3 record proves that the name doesn't exist.
+func nameCovered(denial []dns.RR, name string) bool {
+	for _, rr := range denial {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Cover(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the closest encloser of a name that doesn't exist, the closest
+// ancestor that does, proven by the denial records.
+func closestEncloser(denial []dns.RR, name string) (string, bool) {
+	labels := dns.SplitDomainName(name)
+	var nsec3 bool
+	for _, rr := range denial {
+		if _, ok := rr.(*dns.NSEC3); ok {
+			nsec3 = true
+		}
+	}
+	for i := 1; i <= len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		if nsec3 {
+			// RFC5155, section 8.3
+			if _, ok := nameTypes(denial, candidate); ok && nameCovered(denial, nextCloser) {
+				return candidate, true
+			}
+			continue
+		}
+		// With NSEC, the closest encloser is the longest ancestor shared
+		// with the names of the NSEC record covering the name
+		for _, rr := range denial {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok || !nsecCovers(nsec, name) {
+				continue
+			}
+			if dns.IsSubDomain(candidate, canonicalName(nsec.Hdr.Name)) || dns.IsSubDomain(candidate, canonicalName(nsec.NextDomain)) {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns true if the denial records prove that a name doesn't exist, and
+// there's no wildcard it could be expanded from.
+func provesNameError(denial []dns.RR, name string) bool {
+	if !nameCovered(denial, name) {
+		return false
+	}
+	ce, ok := closestEncloser(denial, name)
+	if !ok {
+		return false
+	}
+	return nameCovered(denial, "*."+ce)
+}
+
+// Returns true if the denial records prove that a name has no records of the
+// type, directly or through a wildcard.
+func provesNoData(denial []dns.RR, name string, qtype uint16) bool {
+	if types, ok := nameTypes(denial, name); ok {
+		return !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+	}
+	if nsecCoversEmptyNonTerminal(denial, name) {
+		return true
+	}
+	// Opt-out only applies to delegations, RFC5155 section 8.6
+	if qtype == dns.TypeDS && optOutCovers(denial, name) {
+		return true
+	}
+	// Wildcard without records of the type
+	ce, ok := closestEncloser(denial, name)
+	if !ok {
+		return false
+	}
+	types, ok := nameTypes(denial, "*."+ce)
+	return ok && !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+}
+
+// Returns true if a wildcard expansion for the name is valid, meaning the
+// denial records prove the name itself doesn't exist.
+func provesNoCloserMatch(denial []dns.RR, name string, labels uint8) bool {
+	// The next closer name is one label longer than the wildcard's parent
+	parts := dns.SplitDomainName(name)
+	if int(labels) >= len(parts) {
+		return false
+	}
+	nextCloser := dns.Fqdn(strings.Join(parts[len(parts)-int(labels)-1:], "."))
+	return nameCovered(denial, nextCloser) || nameCovered(denial, name)
+}
+
+// Returns true if an opt-out NSEC3 record covers the name, so it could be an
+// unsigned delegation.
+func optOutCovers(denial []dns.RR, name string) bool {
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		nextCloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, rr := range denial {
+			if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Flags&1 == 1 && nsec3.Cover(nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if an NSEC record proves the name is an empty non-terminal,
+// a name that exists only because there are names below it.
+func nsecCoversEmptyNonTerminal(denial []dns.RR, name string) bool {
+	for _, rr := range denial {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) && dns.IsSubDomain(name, canonicalName(nsec.NextDomain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the name is between the owner and next name of the NSEC
+// record in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := canonicalName(nsec.Hdr.Name), canonicalName(nsec.NextDomain)
+	if canonicalCompare(owner, next) >= 0 { // Last record in the zone
+		return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+}
+
+// Compares names in canonical DNS order, RFC4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// Returns the lowest TTL of the records.
+func rrsetTTL[T dns.RR](rrs []T) time.Duration {
+	ttl := uint32(0)
+	for i, rr := range rrs {
+		if t := rr.Header().Ttl; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// Sets the DO flag in a query, adding an OPT record if needed.
+func setDO(q *dns.Msg) {
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		edns0.SetDo()
+		return
+	}
+	q.SetEdns0(4096, true)
+}
+
+// Removes DNSSEC records from a response to a client that didn't ask for
+// them, unless they're what was queried.
+func stripDNSSEC(a *dns.Msg, qtype uint16, edns bool) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+			t := rr.Header().Rrtype
+			return t != qtype && (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3)
+		})
+	}
+	a.Answer = strip(a.Answer)
+	a.Ns = strip(a.Ns)
+	a.Extra = strip(a.Extra)
+	if opt := a.IsEdns0(); opt != nil {
+		if !edns {
+			a.Extra = slices.DeleteFunc(a.Extra, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeOPT })
+		} else {
+			opt.SetDo(false)
+		}
+	}
+}
+
+// Returns SERVFAIL for a query with a bogus response, with the reason as EDE
+// if the client supports EDNS0.
+func bogusResponse(q *dns.Msg, e *dnssecError) *dns.Msg {
+	a := servfail(q)
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		a.SetEdns0(edns0.UDPSize(), edns0.Do())
+		opt := a.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  e.code,
+			ExtraText: e.text,
+		})
+	}
+	return a
+}
+
+// ParseTrustAnchor parses a DS record in presentation format, for example
+// ". IN DS 20326 8 2 E06D44B8...".
+func ParseTrustAnchor(s string) (*dns.DS, error) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		return nil, err
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return nil, fmt.Errorf("trust anchor '%s' is not a DS record", s)
+	}
+	return ds, nil
+}
+
+// LoadTrustAnchorFile reads trust anchors from a file in the XML format IANA
+// publishes the root zone trust anchors in. Anchors that aren't valid at the
+// given time are skipped.
+func LoadTrustAnchorFile(filename string, now time.Time) ([]*dns.DS, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Zone       string `xml:"Zone"`
+		KeyDigests []struct {
+			ValidFrom  string `xml:"validFrom,attr"`
+			ValidUntil string `xml:"validUntil,attr"`
+			KeyTag     uint16 `xml:"KeyTag"`
+			Algorithm  uint8  `xml:"Algorithm"`
+			DigestType uint8  `xml:"DigestType"`
+			Digest     string `xml:"Digest"`
+		} `xml:"KeyDigest"`
+	}
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchors in %s: %w", filename, err)
+	}
+	var anchors []*dns.DS
+	for _, d := range doc.KeyDigests {
+		if from, err := time.Parse(time.RFC3339, d.ValidFrom); err == nil && now.Before(from) {
+			continue
+		}
+		if until, err := time.Parse(time.RFC3339, d.ValidUntil); err == nil && now.After(until) {
+			continue
+		}
+		anchors = append(anchors, &dns.DS{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(doc.Zone), Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     d.KeyTag,
+			Algorithm:  d.Algorithm,
+			DigestType: d.DigestType,
+			Digest:     strings.ToUpper(strings.TrimSpace(d.Digest)),
+		})
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no valid trust anchors in %s", filename)
+	}
+	return anchors, nil
+}
@@ -0,0 +1,198 @@
+package rdns
+
+import (
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Signed zone used to serve a test hierarchy.
+type testSignedZone struct {
+	t    *testing.T
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSignedZone(t *testing.T, name string) *testSignedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return &testSignedZone{t: t, name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// Returns the records followed by a signature over them, valid at the time.
+func (z *testSignedZone) sign(now time.Time, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	require.NoError(z.t, sig.Sign(z.priv, rrs))
+	return append(rrs, sig)
+}
+
+func (z *testSignedZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	now := time.Now()
+	root := newTestSignedZone(t, ".")
+	example := newTestSignedZone(t, "example.")
+
+	// NSEC chain of the example zone, with an unsigned delegation to
+	// insecure.example.
+	nsecApex := testRR(t, "example. 3600 IN NSEC insecure.example. NS SOA RRSIG NSEC DNSKEY")
+	nsecInsecure := testRR(t, "insecure.example. 3600 IN NSEC www.example. NS RRSIG NSEC")
+	nsecWWW := testRR(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC")
+
+	// NSEC of the delegation to example. in the root zone
+	nsecDelegation := testRR(t, "example. 3600 IN NSEC f. NS DS RRSIG NSEC")
+
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			require.True(t, q.CheckingDisabled)
+			require.True(t, q.IsEdns0().Do())
+			a := new(dns.Msg)
+			a.SetReply(q)
+			question := q.Question[0]
+			switch question.Name + dns.TypeToString[question.Qtype] {
+			case ".DNSKEY":
+				a.Answer = root.sign(now, root.key)
+			case "example.DS":
+				ds := example.ds()
+				ds.Hdr.Ttl = 3600
+				a.Answer = root.sign(now, ds)
+			case "example.DNSKEY":
+				a.Answer = example.sign(now, example.key)
+			case "insecure.example.DS":
+				a.Ns = example.sign(now, nsecInsecure)
+			case "www.example.DS":
+				a.Ns = example.sign(now, nsecWWW)
+			case "www.example.TXT":
+				// Unsigned record in a signed zone
+				a.Answer = []dns.RR{testRR(t, "www.example. 300 IN TXT unsigned")}
+			case "www.example.A":
+				a.Answer = example.sign(now, testRR(t, "www.example. 300 IN A 192.0.2.1"))
+			case "tampered.example.A":
+				a.Answer = example.sign(now, testRR(t, "tampered.example. 300 IN A 192.0.2.1"))
+				a.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+			case "expired.example.A":
+				a.Answer = example.sign(now.Add(-3*time.Hour), testRR(t, "expired.example. 300 IN A 192.0.2.1"))
+			case "www.insecure.example.A":
+				a.Answer = []dns.RR{testRR(t, "www.insecure.example. 300 IN A 192.0.2.3")}
+			case "missing.example.A", "missing.example.DS", "forged.example.DS":
+				a.Rcode = dns.RcodeNameError
+				a.Ns = append(example.sign(now, nsecInsecure), example.sign(now, nsecApex)...)
+			case "forged.example.A":
+				// Replayed from the parent zone
+				a.Rcode = dns.RcodeNameError
+				a.Ns = root.sign(now, nsecDelegation)
+			case "unproven.example.A", "unproven.example.DS":
+				a.Rcode = dns.RcodeNameError
+			default:
+				t.Fatalf("unexpected query %s", question.String())
+			}
+			return a, nil
+		},
+	}
+
+	r, err := NewDNSSECValidator("test-dnssec", upstream, DNSSECValidatorOptions{
+		TrustAnchors: []*dns.DS{root.ds()},
+		Clock:        NewFakeClock(now),
+	})
+	require.NoError(t, err)
+
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		q.SetEdns0(1232, do)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+	ede := func(a *dns.Msg) uint16 {
+		require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+		for _, o := range a.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				return e.InfoCode
+			}
+		}
+		t.Fatal("no extended error in response")
+		return 0
+	}
+
+	// Secure answer, signatures only returned to clients that set DO
+	a := query("www.example.", dns.TypeA, true)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 2)
+	a = query("www.example.", dns.TypeA, false)
+	require.False(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+
+	// Bogus answers
+	require.Equal(t, dns.ExtendedErrorCodeDNSBogus, ede(query("tampered.example.", dns.TypeA, false)))
+	require.Equal(t, dns.ExtendedErrorCodeSignatureExpired, ede(query("expired.example.", dns.TypeA, false)))
+	require.Equal(t, dns.ExtendedErrorCodeRRSIGsMissing, ede(query("www.example.", dns.TypeTXT, false)))
+
+	// Unsigned delegation
+	a = query("www.insecure.example.", dns.TypeA, true)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.False(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+
+	// Proven and unproven non-existence
+	a = query("missing.example.", dns.TypeA, true)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.True(t, a.AuthenticatedData)
+	require.Equal(t, dns.ExtendedErrorCodeNSECMissing, ede(query("unproven.example.", dns.TypeA, false)))
+
+	// Proof from the parent zone for a name below the delegation
+	a = query("forged.example.", dns.TypeA, true)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.False(t, a.AuthenticatedData)
+
+	// No validation if the client disabled it
+	q := new(dns.Msg)
+	q.SetQuestion("tampered.example.", dns.TypeA)
+	q.CheckingDisabled = true
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Nil(t, a.IsEdns0())
+
+	require.Equal(t, int64(3), r.metrics.result.Get("secure").Value())
+}
+
+func TestDNSSECValidatorTrustAnchorFile(t *testing.T) {
+	anchors, err := LoadTrustAnchorFile("testdata/root-anchors.xml", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, anchors, 2)
+	require.Equal(t, uint16(20326), anchors[0].KeyTag)
+	require.Equal(t, ".", anchors[0].Hdr.Name)
+
+	// Default anchors are the same
+	r, err := NewDNSSECValidator("test-dnssec-anchors", &TestResolver{}, DNSSECValidatorOptions{})
+	require.NoError(t, err)
+	require.True(t, sameDSSet(anchors, r.anchors["."]))
+}
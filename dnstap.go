@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Minimal encoder for dnstap (https://dnstap.info) messages of client queries
+// and responses, written in Frame Streams format as read by "dnstap -r" and
+// other dnstap tools.
+
+// Content type of dnstap in Frame Streams.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frames.
+const (
+	fstrmControlStart     = 2
+	fstrmControlStop      = 3
+	fstrmFieldContentType = 1
+)
+
+// Protobuf wire types.
+const (
+	protobufVarint          = 0
+	protobufLengthDelimited = 2
+	protobufFixed32         = 5
+)
+
+// Field numbers of the Dnstap message, and its only type.
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldExtra    = 3
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+
+	dnstapTypeMessage = 1
+)
+
+// Field numbers of the Message message.
+const (
+	dnstapMsgType             = 1
+	dnstapMsgSocketFamily     = 2
+	dnstapMsgSocketProtocol   = 3
+	dnstapMsgQueryAddress     = 4
+	dnstapMsgQueryTimeSec     = 8
+	dnstapMsgQueryTimeNsec    = 9
+	dnstapMsgQueryMessage     = 10
+	dnstapMsgResponseTimeSec  = 12
+	dnstapMsgResponseTimeNsec = 13
+	dnstapMsgResponseMessage  = 14
+)
+
+// Values of the enums of the Message message.
+const (
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+
+	dnstapFamilyInet  = 1
+	dnstapFamilyInet6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	dnstapProtocolDOT = 3
+	dnstapProtocolDOH = 4
+	dnstapProtocolDOQ = 7
+)
+
+// dnstapMessage holds the fields of a client query or response.
+type dnstapMessage struct {
+	identity, version, extra string
+
+	client    net.IP
+	transport string // Transport of the query, like "udp" or "doh"
+
+	queryTime time.Time
+	query     []byte
+
+	// Only set in responses.
+	responseTime time.Time
+	response     []byte
+}
+
+// Returns the message as Frame Streams data frame.
+func (m dnstapMessage) frame() []byte {
+	var msg []byte
+	if m.response == nil {
+		msg = appendProtobufVarint(msg, dnstapMsgType, dnstapClientQuery)
+	} else {
+		msg = appendProtobufVarint(msg, dnstapMsgType, dnstapClientResponse)
+	}
+	if ip4 := m.client.To4(); ip4 != nil {
+		msg = appendProtobufVarint(msg, dnstapMsgSocketFamily, dnstapFamilyInet)
+		msg = appendProtobufBytes(msg, dnstapMsgQueryAddress, ip4)
+	} else if len(m.client) == net.IPv6len {
+		msg = appendProtobufVarint(msg, dnstapMsgSocketFamily, dnstapFamilyInet6)
+		msg = appendProtobufBytes(msg, dnstapMsgQueryAddress, m.client)
+	}
+	msg = appendProtobufVarint(msg, dnstapMsgSocketProtocol, dnstapProtocol(m.transport))
+	msg = appendProtobufVarint(msg, dnstapMsgQueryTimeSec, uint64(m.queryTime.Unix()))
+	msg = appendProtobufFixed32(msg, dnstapMsgQueryTimeNsec, uint32(m.queryTime.Nanosecond()))
+	if m.response == nil {
+		msg = appendProtobufBytes(msg, dnstapMsgQueryMessage, m.query)
+	} else {
+		msg = appendProtobufVarint(msg, dnstapMsgResponseTimeSec, uint64(m.responseTime.Unix()))
+		msg = appendProtobufFixed32(msg, dnstapMsgResponseTimeNsec, uint32(m.responseTime.Nanosecond()))
+		msg = appendProtobufBytes(msg, dnstapMsgResponseMessage, m.response)
+	}
+
+	var b []byte
+	if m.identity != "" {
+		b = appendProtobufBytes(b, dnstapFieldIdentity, []byte(m.identity))
+	}
+	if m.version != "" {
+		b = appendProtobufBytes(b, dnstapFieldVersion, []byte(m.version))
+	}
+	if m.extra != "" {
+		b = appendProtobufBytes(b, dnstapFieldExtra, []byte(m.extra))
+	}
+	b = appendProtobufBytes(b, dnstapFieldMessage, msg)
+	b = appendProtobufVarint(b, dnstapFieldType, dnstapTypeMessage)
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	return append(frame, b...)
+}
+
+// Returns the socket protocol of a transport.
+func dnstapProtocol(transport string) uint64 {
+	switch transport {
+	case "tcp":
+		return dnstapProtocolTCP
+	case "dot":
+		return dnstapProtocolDOT
+	case "doh", "odoh":
+		return dnstapProtocolDOH
+	case "doq":
+		return dnstapProtocolDOQ
+	}
+	return dnstapProtocolUDP
+}
+
+// Returns a Frame Streams control frame, START frames with the dnstap content
+// type.
+func fstrmControlFrame(typ uint32) []byte {
+	control := binary.BigEndian.AppendUint32(nil, typ)
+	if typ == fstrmControlStart {
+		control = binary.BigEndian.AppendUint32(control, fstrmFieldContentType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(dnstapContentType)))
+		control = append(control, dnstapContentType...)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, 0) // Escape, length 0
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	return append(frame, control...)
+}
+
+func appendProtobufVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protobufVarint))
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtobufFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protobufFixed32))
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendProtobufBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protobufLengthDelimited))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -22,6 +22,15 @@ Routers are used to send DNS queries to resolvers, groups, or even other routers
 the query content. As with groups, routers too are resolvers that can be combined to form
 more advanced configurations.
 
+Middleware
+
+Cross-cutting behavior such as recovering from panics or tracking the status of an element
+can be added to any resolver with a Middleware, a function that wraps a resolver in another.
+Multiple middlewares are combined with Chain, the first one being the outermost.
+
+	wrap := rdns.Chain(rdns.StatusTrackerMiddleware(), rdns.PanicRecoveryMiddleware())
+	r = wrap(r)
+
 Listeners
 
 While resolvers handle outgoing queries to upstream servers, listeners are the receivers
@@ -0,0 +1,177 @@
+package rdns
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoHRelatedMode defines how the DoH listener handles records that are likely
+// to be queried by the client after a query, like AAAA after A. Experimental.
+type DoHRelatedMode string
+
+const (
+	DoHRelatedOff DoHRelatedMode = ""
+
+	// Resolve related records in the background after responding so they're
+	// in a cache when the client asks for them.
+	DoHRelatedPrefetch DoHRelatedMode = "prefetch"
+
+	// Send related records to the client with HTTP/2 server push. Falls back
+	// to prefetch if the client doesn't support push.
+	DoHRelatedPush DoHRelatedMode = "push"
+)
+
+// Header marking pushed requests, those don't trigger further pushes.
+const dohPushHeader = "X-Routedns-Push"
+
+// Time in which follow-up queries for prefetched records are counted as hits.
+const dohRelatedWindow = 30 * time.Second
+
+// Maximum number of prefetched records to track for hit metrics.
+const dohRelatedMaxTracked = 10000
+
+// Maximum number of queries with related records prefetched at the same time.
+// Further ones are skipped rather than adding load while the resolver is
+// slow or the listener is busy.
+const dohRelatedMaxPrefetch = 64
+
+// Returns queries for records related to the one in q. These are the A, AAAA
+// and HTTPS records of the same name, other than the one queried.
+func relatedQueries(q *dns.Msg) []*dns.Msg {
+	question := q.Question[0]
+	var types []uint16
+	switch question.Qtype {
+	case dns.TypeA:
+		types = []uint16{dns.TypeAAAA, dns.TypeHTTPS}
+	case dns.TypeAAAA:
+		types = []uint16{dns.TypeA, dns.TypeHTTPS}
+	case dns.TypeHTTPS:
+		types = []uint16{dns.TypeA, dns.TypeAAAA}
+	default:
+		return nil
+	}
+	queries := make([]*dns.Msg, 0, len(types))
+	for _, t := range types {
+		rq := new(dns.Msg)
+		rq.SetQuestion(question.Name, t)
+		rq.Id = 0 // As recommended for DoH to make responses cacheable
+		rq.RecursionDesired = q.RecursionDesired
+		if edns0 := q.IsEdns0(); edns0 != nil {
+			rq.SetEdns0(edns0.UDPSize(), edns0.Do())
+		}
+		queries = append(queries, rq)
+	}
+	return queries
+}
+
+// Handles records related to a query that was answered successfully, either
+// by pushing them to the client or resolving them in the background.
+func (s *DoHListener) related(w http.ResponseWriter, r *http.Request, q *dns.Msg, ci ClientInfo, resolver Resolver) {
+	queries := relatedQueries(q)
+	if len(queries) == 0 {
+		return
+	}
+	log := Log.With("id", s.id, "client", ci.SourceIP, "qname", qName(q))
+	if pusher, ok := w.(http.Pusher); ok && s.opt.Related == DoHRelatedPush {
+		var pushed int
+		for _, rq := range queries {
+			b, err := rq.Pack()
+			if err != nil {
+				continue
+			}
+			target := r.URL.Path + "?dns=" + base64.RawURLEncoding.EncodeToString(b)
+			err = pusher.Push(target, &http.PushOptions{
+				Method: "GET",
+				Header: http.Header{
+					"Accept":      {"application/dns-message"},
+					dohPushHeader: {"1"},
+				},
+			})
+			if errors.Is(err, http.ErrNotSupported) { // Client disabled push
+				break
+			}
+			if err != nil {
+				log.Debug("failed to push related record", "qtype", qType(rq), "error", err)
+				continue
+			}
+			s.metrics.push.Add(1)
+			pushed++
+		}
+		if pushed > 0 {
+			return
+		}
+	}
+	select {
+	case s.relatedSlots <- struct{}{}:
+	default:
+		log.Debug("too many related records prefetched, skipping")
+		s.metrics.prefetchSkipped.Add(int64(len(queries)))
+		return
+	}
+	go func() {
+		defer func() { <-s.relatedSlots }()
+		for _, rq := range queries {
+			log.Debug("prefetching related record", "qtype", qType(rq))
+			s.metrics.prefetch.Add(1)
+			s.relatedTracker.add(ci.SourceIP, rq)
+			_, _ = resolver.Resolve(rq, ci)
+		}
+	}()
+}
+
+// Keeps track of prefetched records to count follow-up queries for them.
+type relatedTracker struct {
+	mu    sync.Mutex
+	items map[relatedKey]time.Time
+}
+
+type relatedKey struct {
+	client string
+	name   string
+	qtype  uint16
+}
+
+func newRelatedTracker() *relatedTracker {
+	return &relatedTracker{items: make(map[relatedKey]time.Time)}
+}
+
+func (t *relatedTracker) key(client net.IP, q *dns.Msg) relatedKey {
+	return relatedKey{client: client.String(), name: q.Question[0].Name, qtype: q.Question[0].Qtype}
+}
+
+// Records a prefetched query.
+func (t *relatedTracker) add(client net.IP, q *dns.Msg) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.items) >= dohRelatedMaxTracked {
+		for k, expiry := range t.items {
+			if now.After(expiry) {
+				delete(t.items, k)
+			}
+		}
+		if len(t.items) >= dohRelatedMaxTracked {
+			return
+		}
+	}
+	t.items[t.key(client, q)] = now.Add(dohRelatedWindow)
+}
+
+// Returns true if the query was prefetched for the client recently.
+func (t *relatedTracker) hit(client net.IP, q *dns.Msg) bool {
+	k := t.key(client, q)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiry, ok := t.items[k]
+	if !ok {
+		return false
+	}
+	delete(t.items, k)
+	return time.Now().Before(expiry)
+}
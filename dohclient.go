@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -33,7 +34,9 @@ type DoHClientOptions struct {
 	// the service's hostname with potentially plain DNS.
 	BootstrapAddr string
 
-	// Transport protocol to run HTTPS over. "quic" or "tcp", defaults to "tcp".
+	// Transport protocol to run HTTPS over. "quic", "tcp" or "auto", defaults
+	// to "tcp". With "auto", HTTP/3 over QUIC is preferred and HTTP/2 over TCP
+	// is used if QUIC is blocked or slower.
 	Transport string
 
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
@@ -43,23 +46,65 @@ type DoHClientOptions struct {
 
 	QueryTimeout time.Duration
 
-	// Optional dialer, e.g. proxy
+	// Optional dialer, e.g. proxy. Used for QUIC as well, which requires a
+	// dialer that supports UDP, like a SOCKS5 proxy with UDP ASSOCIATE.
 	Dialer Dialer
 
 	Use0RTT bool
+
+	// Race connections to all IPv6 and IPv4 addresses of the endpoint's
+	// hostname and use the one that's established first.
+	HappyEyeballs bool
+
+	// Resolver used to look up the addresses of the endpoint with
+	// HappyEyeballs. Uses the system's resolver if nil.
+	Resolver *net.Resolver
+
+	// Close connections when addresses or routes of the host change, so
+	// new ones are established on the new network path.
+	ReconnectOnNetworkChange bool
+
+	// Maximum number of queries sent to the upstream at the same time, each
+	// using a stream of the connection. Further queries wait for one of them
+	// to complete. Unlimited if 0.
+	MaxConcurrentStreams int
+
+	// Send a ping over HTTP/2 connections that didn't receive a frame for
+	// this long, and close them if the ping isn't answered within
+	// H2PingTimeout, 15 seconds if 0. Disabled if 0.
+	H2PingInterval time.Duration
+	H2PingTimeout  time.Duration
+
+	// Close all HTTP/2 connections after this many queries in a row failed,
+	// so new ones are established. Disabled if 0.
+	H2MaxStreamErrors int
+
+	// Optional key to share the HTTP transport, and with it the connection
+	// pool, with other clients using the same key. Only used with the "tcp"
+	// transport. Clients using the same key must have identical TLS, bootstrap,
+	// local address and dialer options.
+	SharedTransportKey string
 }
 
 // Returns an HTTP client based on the DoH options
-func (opt DoHClientOptions) client(endpoint string) (*http.Client, error) {
+func (opt DoHClientOptions) client(id, endpoint string) (*http.Client, error) {
 	var (
 		tr  http.RoundTripper
 		err error
 	)
 	switch opt.Transport {
 	case "tcp", "":
-		tr, err = dohTcpTransport(opt)
+		if opt.SharedTransportKey != "" {
+			tr, err = sharedTransport(opt.SharedTransportKey, func() (http.RoundTripper, error) {
+				return dohTcpTransport(id, opt)
+			})
+			break
+		}
+		tr, err = dohTcpTransport(id, opt)
 	case "quic":
 		tr, err = dohQuicTransport(endpoint, opt)
+	case "auto":
+		tr, err = dohAutoTransport(id, endpoint, opt)
 	default:
 		err = fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
@@ -79,6 +124,15 @@ type DoHClient struct {
 	client   *http.Client
 	opt      DoHClientOptions
 	metrics  *ListenerMetrics
+
+	// Results of queries sent as 0-RTT data.
+	zeroRTT *CounterMap
+
+	// Limits the number of concurrent queries, nil if unlimited.
+	streams chan struct{}
+
+	// Stops watching for network changes, nil if not enabled.
+	stopNetworkWatch func()
 }
 
 var _ Resolver = &DoHClient{}
@@ -90,7 +144,7 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 		return nil, err
 	}
 
-	client, err := opt.client(endpoint)
+	client, err := opt.client(id, endpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +152,7 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 	if opt.Method == "" {
 		opt.Method = "POST"
 	}
-	if opt.Use0RTT && opt.Transport == "quic" {
+	if opt.Use0RTT && (opt.Transport == "quic" || opt.Transport == "auto") {
 		opt.Method = "GET"
 	}
 	if opt.Method != "POST" && opt.Method != "GET" {
@@ -108,18 +162,49 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 		opt.QueryTimeout = defaultQueryTimeout
 	}
 
-	return &DoHClient{
+	var streams chan struct{}
+	if opt.MaxConcurrentStreams > 0 {
+		streams = make(chan struct{}, opt.MaxConcurrentStreams)
+	}
+
+	d := &DoHClient{
 		id:       id,
 		endpoint: endpoint,
 		template: template,
 		client:   client,
 		opt:      opt,
 		metrics:  NewListenerMetrics("client", id),
-	}, nil
+		zeroRTT:  getCounterMap("client", id, "0rtt", "result"),
+		streams:  streams,
+	}
+	if opt.ReconnectOnNetworkChange {
+		d.stopNetworkWatch, err = onNetworkChange(func() {
+			Log.Info("network change detected, closing connections", "id", id)
+			closeConnections(client.Transport)
+		})
+		if err != nil {
+			Log.Error("failed to watch for network changes", "id", id, "error", err)
+		}
+	}
+	return d, nil
+}
+
+// Close stops watching for network changes and closes the connections,
+// unless the transport is shared with other clients.
+func (d *DoHClient) Close() error {
+	if d.stopNetworkWatch != nil {
+		d.stopNetworkWatch()
+	}
+	if d.opt.SharedTransportKey == "" {
+		closeConnections(d.client.Transport)
+	}
+	return nil
 }
 
 // Resolve a DNS query.
 func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	// Packing a message is not always a read-only operation, make a copy
 	q = q.Copy()
 	log := logger(d.id, q, ci)
@@ -141,23 +226,54 @@ func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	d.metrics.query.Add(1)
+	start := time.Now()
 
 	ctx, cancel := context.WithTimeout(context.Background(), d.opt.QueryTimeout)
 	defer cancel()
 
+	// Wait for a free stream if their number is limited
+	if d.streams != nil {
+		select {
+		case d.streams <- struct{}{}:
+			defer func() { <-d.streams }()
+		case <-ctx.Done():
+			d.metrics.err.Add("streams", 1)
+			return nil, upstreamError(d.id, QueryTimeoutError{q})
+		}
+	}
+
 	// Build a DoH request and execute it
+	ctx, early := withEarlyDataFlag(ctx)
 	req, err := d.buildRequest(ctx, msg)
 	if err != nil {
 		return nil, err
 	}
 	resp, err := d.do(req)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// The server rejected the 0-RTT data. Replay the query with a
+		// regular GET which waits for the handshake to complete.
+		d.zeroRTT.Add("rejected", 1)
+		log.Debug("0-rtt rejected, replaying query after full handshake")
+		req, err = d.buildGetRequest(ctx, msg, http.MethodGet)
+		if err != nil {
+			return nil, err
+		}
+		d.zeroRTT.Add("replayed", 1)
+		resp, err = d.do(req)
+	} else if err == nil && early.Load() {
+		d.zeroRTT.Add("accepted", 1)
+	}
 	if err != nil {
-		return nil, err
+		return nil, upstreamError(d.id, err)
 	}
 	defer resp.Body.Close()
 
 	// Extract the DNS response from the HTTP response
-	return d.responseFromHTTP(resp)
+	a, err := d.responseFromHTTP(resp)
+	if err == nil {
+		d.metrics.duration.Observe(time.Since(start).Seconds())
+	}
+	return a, err
 }
 
 func (d *DoHClient) buildRequest(ctx context.Context, msg []byte) (*http.Request, error) {
@@ -165,7 +281,11 @@ func (d *DoHClient) buildRequest(ctx context.Context, msg []byte) (*http.Request
 	case "POST":
 		return d.buildPostRequest(ctx, msg)
 	case "GET":
-		return d.buildGetRequest(ctx, msg)
+		method := http.MethodGet
+		if d.opt.Use0RTT && (d.opt.Transport == "quic" || d.opt.Transport == "auto") {
+			method = http3.MethodGet0RTT
+		}
+		return d.buildGetRequest(ctx, msg, method)
 	default:
 		return nil, errors.New("unsupported method")
 	}
@@ -174,7 +294,10 @@ func (d *DoHClient) buildRequest(ctx context.Context, msg []byte) (*http.Request
 func (d *DoHClient) do(req *http.Request) (*http.Response, error) {
 	resp, err := d.client.Do(req)
 	if err != nil {
-		d.metrics.err.Add(req.Method, 1)
+		// Rejected 0-RTT requests are replayed, they're not counted as errors
+		if !errors.Is(err, quic.Err0RTTRejected) {
+			d.metrics.err.Add(req.Method, 1)
+		}
 		return nil, err
 	}
 	return resp, err
@@ -198,7 +321,7 @@ func (d *DoHClient) buildPostRequest(ctx context.Context, msg []byte) (*http.Req
 	return req, nil
 }
 
-func (d *DoHClient) buildGetRequest(ctx context.Context, msg []byte) (*http.Request, error) {
+func (d *DoHClient) buildGetRequest(ctx context.Context, msg []byte, method string) (*http.Request, error) {
 	// Encode the query as base64url
 	b64 := base64.RawURLEncoding.EncodeToString(msg)
 
@@ -209,11 +332,6 @@ func (d *DoHClient) buildGetRequest(ctx context.Context, msg []byte) (*http.Requ
 		return nil, err
 	}
 
-	method := http.MethodGet
-	if d.opt.Use0RTT && d.opt.Transport == "quic" {
-		method = http3.MethodGet0RTT
-	}
-
 	req, err := http.NewRequestWithContext(ctx, method, u, nil)
 	if err != nil {
 		d.metrics.err.Add("http", 1)
@@ -248,7 +366,7 @@ func (d *DoHClient) responseFromHTTP(resp *http.Response) (*dns.Msg, error) {
 	return a, err
 }
 
-func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
+func dohTcpTransport(id string, opt DoHClientOptions) (http.RoundTripper, error) {
 	tr := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		TLSClientConfig:       opt.TLSConfig,
@@ -256,16 +374,36 @@ func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
 		ResponseHeaderTimeout: 10 * time.Second,
 		IdleConnTimeout:       30 * time.Second,
 	}
+	// A proxy configured with a dialer is used instead of the one from the
+	// environment
+	if opt.Dialer != nil {
+		tr.Proxy = nil
+	}
 	// If we're using a custom tls.Config, HTTP2 isn't enabled by default in
 	// the HTTP library. Turn it on for this transport.
-	if tr.TLSClientConfig != nil {
-		if err := http2.ConfigureTransport(tr); err != nil {
+	if tr.TLSClientConfig != nil || opt.H2PingInterval > 0 {
+		h2, err := http2.ConfigureTransports(tr)
+		if err != nil {
 			return nil, err
 		}
+		h2.ReadIdleTimeout = opt.H2PingInterval
+		h2.PingTimeout = opt.H2PingTimeout
 	}
 
-	// Use a custom dialer if a bootstrap address or local address was provided
-	if opt.BootstrapAddr != "" || opt.LocalAddr != nil || opt.Dialer != nil {
+	if opt.HappyEyeballs {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			addrs, err := opt.dialAddrs(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			dial := func(ctx context.Context, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			}
+			return happyEyeballsDial(ctx, addrs, dial, func(c net.Conn) { c.Close() })
+		}
+	} else if opt.BootstrapAddr != "" || opt.LocalAddr != nil || opt.Dialer != nil {
+		// Use a custom dialer if a bootstrap address or local address was provided
 		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
 		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 			if opt.BootstrapAddr != "" {
@@ -281,9 +419,114 @@ func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
 			return d.DialContext(ctx, network, addr)
 		}
 	}
+
+	if opt.H2MaxStreamErrors > 0 {
+		return newDoHHealthTransport(id, tr, opt.H2MaxStreamErrors), nil
+	}
 	return tr, nil
 }
 
+// HTTP transport that closes all its connections after a number of requests
+// in a row failed. A wedged HTTP/2 connection otherwise fails all queries
+// until it's closed for being idle, which doesn't happen while queries are
+// sent over it.
+type dohHealthTransport struct {
+	*http.Transport
+	id        string
+	maxErrors int64
+	errors    atomic.Int64 // Consecutive failed requests
+	conns     *connTracker
+	reconnect *Counter
+}
+
+func newDoHHealthTransport(id string, tr *http.Transport, maxErrors int) *dohHealthTransport {
+	dial := tr.DialContext
+	if dial == nil {
+		d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		dial = d.DialContext
+	}
+	conns := newConnTracker()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return conns.add(conn), nil
+	}
+	return &dohHealthTransport{
+		Transport: tr,
+		id:        id,
+		maxErrors: int64(maxErrors),
+		conns:     conns,
+		reconnect: getCounter("client", id, "reconnect"),
+	}
+}
+
+func (t *dohHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	switch {
+	case err == nil:
+		t.errors.Store(0)
+	case errors.Is(err, context.Canceled): // Canceled by the client, not a failure
+	case t.errors.Add(1) >= t.maxErrors:
+		Log.Warn("queries failing, replacing connections", "id", t.id, "errors", t.errors.Load(), "error", err)
+		t.errors.Store(0)
+		t.reconnect.Add(1)
+		t.conns.closeAll()
+	}
+	return resp, err
+}
+
+// Keeps track of open connections so they can be closed, including those
+// with requests in progress.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+func (t *connTracker) add(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, tracker: t}
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+	return c
+}
+
+// Returns the number of open connections.
+func (t *connTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.mu.Lock()
+	delete(c.tracker.conns, c)
+	c.tracker.mu.Unlock()
+	return c.Conn.Close()
+}
+
 func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper, error) {
 	var tlsConfig *tls.Config
 	if opt.TLSConfig == nil {
@@ -296,8 +539,11 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 		return nil, err
 	}
 
-	// enable TLS session caching for session resumption and 0-RTT
-	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(100)
+	// enable TLS session caching for session resumption and 0-RTT, unless
+	// a (shared) cache was already provided
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(100)
+	}
 	tlsConfig.ServerName = u.Hostname()
 	lAddr := net.IPv4zero
 	if opt.LocalAddr != nil {
@@ -305,7 +551,7 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 	}
 
 	dialer := func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
-		return newQuicConnection(u.Hostname(), addr, lAddr, tlsConfig, config, opt.Use0RTT)
+		return newQuicConnection(ctx, u.Hostname(), addr, lAddr, opt.Dialer, tlsConfig, config, opt.Use0RTT)
 	}
 	if opt.BootstrapAddr != "" {
 		dialer = func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
@@ -314,7 +560,19 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 				return nil, err
 			}
 			addr = net.JoinHostPort(opt.BootstrapAddr, port)
-			return newQuicConnection(u.Hostname(), addr, lAddr, tlsConfig, config, opt.Use0RTT)
+			return newQuicConnection(ctx, u.Hostname(), addr, lAddr, opt.Dialer, tlsConfig, config, opt.Use0RTT)
+		}
+	}
+	if opt.HappyEyeballs {
+		dialer = func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+			addrs, err := opt.dialAddrs(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			dial := func(ctx context.Context, addr string) (quic.EarlyConnection, error) {
+				return newQuicConnection(ctx, u.Hostname(), addr, lAddr, opt.Dialer, tlsConfig, config, opt.Use0RTT)
+			}
+			return happyEyeballsDial(ctx, addrs, dial, func(c quic.EarlyConnection) { c.CloseWithError(DOQNoError, "") })
 		}
 	}
 
@@ -328,6 +586,153 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 	return tr, nil
 }
 
+// Returns the addresses to race connections to with happy eyeballs. Only
+// the bootstrap address if there is one.
+func (opt DoHClientOptions) dialAddrs(ctx context.Context, addr string) ([]string, error) {
+	if opt.BootstrapAddr != "" {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []string{net.JoinHostPort(opt.BootstrapAddr, port)}, nil
+	}
+	return happyEyeballsAddrs(ctx, opt.Resolver, addr)
+}
+
+// Time to wait for an HTTP/3 response before sending the request over
+// HTTP/2 as well.
+const dohFallbackDelay = 300 * time.Millisecond
+
+// Time HTTP/2 is used exclusively after it was faster than HTTP/3, before
+// HTTP/3 is tried again.
+const dohFallbackDuration = 5 * time.Minute
+
+// HTTP transport that prefers HTTP/3 and falls back to HTTP/2 when QUIC is
+// blocked or slower, for example on networks that filter UDP on port 443.
+// Requests are sent over HTTP/3 first, and over HTTP/2 as well if there's no
+// response after a short delay or the HTTP/3 request failed. If HTTP/2 wins,
+// it is used exclusively for a while before HTTP/3 is tried again.
+type dohFallbackTransport struct {
+	id       string
+	h3       http.RoundTripper
+	h2       http.RoundTripper
+	fallback *Counter
+
+	// Time until which only HTTP/2 is used, in unix nanoseconds
+	h2Until atomic.Int64
+}
+
+func dohAutoTransport(id, endpoint string, opt DoHClientOptions) (http.RoundTripper, error) {
+	h3, err := dohQuicTransport(endpoint, opt)
+	if err != nil {
+		return nil, err
+	}
+	h2, err := dohTcpTransport(id, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &dohFallbackTransport{
+		id:       id,
+		h3:       h3,
+		h2:       h2,
+		fallback: getCounter("client", id, "fallback"),
+	}, nil
+}
+
+func (t *dohFallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if time.Now().UnixNano() < t.h2Until.Load() {
+		return t.h2.RoundTrip(dohH2Request(req))
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+		h2   bool
+	}
+	results := make(chan result, 2)
+	go func() {
+		resp, err := t.h3.RoundTrip(req)
+		results <- result{resp, err, false}
+	}()
+	pending := 1
+	startH2 := func() {
+		if pending > 1 {
+			return
+		}
+		pending++
+		r := dohH2Request(req)
+		go func() {
+			resp, err := t.h2.RoundTrip(r)
+			results <- result{resp, err, true}
+		}()
+	}
+	timer := time.NewTimer(dohFallbackDelay)
+	defer timer.Stop()
+
+	var errs []error
+	for received := 0; received < pending; {
+		select {
+		case res := <-results:
+			received++
+			if res.err == nil {
+				if res.h2 {
+					Log.Debug("http/3 failed or slower than http/2, falling back", "id", t.id, "duration", dohFallbackDuration)
+					t.fallback.Add(1)
+					t.h2Until.Store(time.Now().Add(dohFallbackDuration).UnixNano())
+				}
+				// Discard the response that comes in last
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.err == nil {
+							res.resp.Body.Close()
+						}
+					}
+				}(pending - received)
+				return res.resp, nil
+			}
+			// Rejected 0-RTT requests are replayed by the client over HTTP/3
+			if !res.h2 && errors.Is(res.err, quic.Err0RTTRejected) && pending == 1 {
+				return nil, res.err
+			}
+			errs = append(errs, res.err)
+			startH2()
+		case <-timer.C:
+			startH2()
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Returns a copy of a request to be sent over HTTP/2.
+func dohH2Request(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	if r.Method == http3.MethodGet0RTT {
+		r.Method = http.MethodGet
+	}
+	if req.GetBody != nil {
+		r.Body, _ = req.GetBody()
+	}
+	return r
+}
+
+// Closes the connections of an HTTP transport, so new ones are established
+// on the next request. Active HTTP/2 connections are closed once idle, unless
+// the transport keeps track of them to replace failing ones.
+func closeConnections(tr http.RoundTripper) {
+	switch t := tr.(type) {
+	case *http.Transport:
+		t.CloseIdleConnections()
+	case *dohHealthTransport:
+		t.conns.closeAll()
+	case *http3.Transport:
+		t.Close()
+	case *dohFallbackTransport:
+		closeConnections(t.h2)
+		closeConnections(t.h3)
+		t.h2Until.Store(0)
+	}
+}
+
 // QUIC connection that automatically restarts when it's used after having timed out. Needed
 // since the quic-go RoundTripper doesn't have any connection management and timed out
 // connections aren't restarted. This one uses EarlyConnection so we can use 0-RTT if the
@@ -338,15 +743,16 @@ type quicConnection struct {
 	hostname  string
 	rAddr     string
 	lAddr     net.IP
+	dialer    Dialer // Optional, e.g. a SOCKS5 proxy
 	tlsConfig *tls.Config
 	config    *quic.Config
 	mu        sync.Mutex
-	udpConn   *net.UDPConn
+	udpConn   net.PacketConn
 	Use0RTT   bool
 }
 
-func newQuicConnection(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config, use0RTT bool) (quic.EarlyConnection, error) {
-	connection, udpConn, err := quicDial(context.TODO(), rAddr, lAddr, tlsConfig, config, use0RTT)
+func newQuicConnection(ctx context.Context, hostname, rAddr string, lAddr net.IP, dialer Dialer, tlsConfig *tls.Config, config *quic.Config, use0RTT bool) (quic.EarlyConnection, error) {
+	connection, udpConn, err := quicDial(ctx, rAddr, lAddr, dialer, tlsConfig, config, use0RTT)
 	if err != nil {
 		return nil, err
 	}
@@ -362,6 +768,7 @@ func newQuicConnection(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Conf
 		hostname:        hostname,
 		rAddr:           rAddr,
 		lAddr:           lAddr,
+		dialer:          dialer,
 		tlsConfig:       tlsConfig,
 		config:          config,
 		udpConn:         udpConn,
@@ -374,6 +781,14 @@ func (s *quicConnection) OpenStreamSync(ctx context.Context) (quic.Stream, error
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	stream, err := s.EarlyConnection.OpenStreamSync(ctx)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// Once the server rejected 0-RTT, streams can only be opened after the
+		// handshake completed
+		if _, err = s.EarlyConnection.NextConnection(ctx); err != nil {
+			return nil, err
+		}
+		stream, err = s.EarlyConnection.OpenStreamSync(ctx)
+	}
 	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
 		Log.Debug("temporary fail when trying to open stream, attempting new connection", "error", err)
 		if err = quicRestart(s); err != nil {
@@ -381,6 +796,9 @@ func (s *quicConnection) OpenStreamSync(ctx context.Context) (quic.Stream, error
 		}
 		stream, err = s.EarlyConnection.OpenStreamSync(ctx)
 	}
+	if err == nil {
+		markEarlyData(ctx, s.EarlyConnection)
+	}
 	return stream, err
 }
 
@@ -398,10 +816,37 @@ func (s *quicConnection) OpenStream() (quic.Stream, error) {
 	return stream, err
 }
 
+// Closes the connection and the UDP socket it owns.
+func (s *quicConnection) CloseWithError(code quic.ApplicationErrorCode, desc string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.EarlyConnection.CloseWithError(code, desc)
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+		s.udpConn = nil
+	}
+	return err
+}
+
 func (s *quicConnection) NextConnection(context.Context) (quic.Connection, error) {
 	return nil, errors.New("not implemented")
 }
 
+// Closes the connection and the UDP socket if they're open. A new connection
+// is opened if the connection is used again.
+func (s *quicConnection) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.EarlyConnection != nil {
+		_ = s.EarlyConnection.CloseWithError(DOQNoError, "")
+		s.EarlyConnection = nil
+	}
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+		s.udpConn = nil
+	}
+}
+
 func quicRestart(s *quicConnection) error {
 	// Try to open a new connection, but clean up our mess before we do so
 	// This function should be called with the quicConnection locked, but lock checking isn't provided
@@ -421,7 +866,7 @@ func quicRestart(s *quicConnection) error {
 	)
 	var err error
 	var earlyConn quic.EarlyConnection
-	earlyConn, s.udpConn, err = quicDial(context.TODO(), s.rAddr, s.lAddr, s.tlsConfig, s.config, s.Use0RTT)
+	earlyConn, s.udpConn, err = quicDial(context.TODO(), s.rAddr, s.lAddr, s.dialer, s.tlsConfig, s.config, s.Use0RTT)
 	if err != nil || s.udpConn == nil {
 		Log.Error("couldn't restart quic connection", slog.Group("details", slog.String("protocol", "quic"), slog.String("address", s.hostname), slog.String("local", s.lAddr.String())), "error", err)
 		return err
@@ -432,31 +877,51 @@ func quicRestart(s *quicConnection) error {
 	return nil
 }
 
-func quicDial(ctx context.Context, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config, use0RTT bool) (quic.EarlyConnection, *net.UDPConn, error) {
-	var earlyConn quic.EarlyConnection
-	udpAddr, err := net.ResolveUDPAddr("udp", rAddr)
-	if err != nil {
-		Log.Error("couldn't resolve remote addr for UDP quic client", "error", err, "rAddr", rAddr)
-		return nil, nil, err
-	}
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: lAddr, Port: 0})
-	if err != nil {
-		Log.Error("couldn't listen on UDP socket on local address", "error", err, "local", lAddr.String())
-		return nil, nil, err
+func quicDial(ctx context.Context, rAddr string, lAddr net.IP, dialer Dialer, tlsConfig *tls.Config, config *quic.Config, use0RTT bool) (quic.EarlyConnection, net.PacketConn, error) {
+	var (
+		earlyConn quic.EarlyConnection
+		udpConn   net.PacketConn
+		udpAddr   net.Addr
+		err       error
+	)
+	if dialer != nil {
+		// Packets are sent through the dialer, e.g. a SOCKS5 proxy with UDP
+		// ASSOCIATE. The address is resolved by the dialer, not locally.
+		udpConn, udpAddr, err = dialPacketConn(dialer, rAddr)
+		if err != nil {
+			Log.Error("couldn't dial UDP connection for quic client", "error", err, "rAddr", rAddr)
+			return nil, nil, err
+		}
+	} else {
+		udpAddr, err = net.ResolveUDPAddr("udp", rAddr)
+		if err != nil {
+			Log.Error("couldn't resolve remote addr for UDP quic client", "error", err, "rAddr", rAddr)
+			return nil, nil, err
+		}
+		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: lAddr, Port: 0})
+		if err != nil {
+			Log.Error("couldn't listen on UDP socket on local address", "error", err, "local", lAddr.String())
+			return nil, nil, err
+		}
 	}
 
 	if use0RTT {
 		earlyConn, err = quic.DialEarly(ctx, udpConn, udpAddr, tlsConfig, config)
 		if err != nil {
 			_ = udpConn.Close()
-			Log.Error("couldn't dial quic early connection", "error", err)
+			// Attempts that lost a happy eyeballs race are canceled
+			if ctx.Err() == nil {
+				Log.Error("couldn't dial quic early connection", "error", err)
+			}
 			return nil, nil, err
 		}
 	} else {
 		conn, err := quic.Dial(ctx, udpConn, udpAddr, tlsConfig, config)
 		if err != nil {
 			_ = udpConn.Close()
-			Log.Error("couldn't dial quic connection", "error", err)
+			if ctx.Err() == nil {
+				Log.Error("couldn't dial quic connection", "error", err)
+			}
 			return nil, nil, err
 		}
 		earlyConn = &earlyConnWrapper{Connection: conn}
@@ -464,6 +929,79 @@ func quicDial(ctx context.Context, rAddr string, lAddr net.IP, tlsConfig *tls.Co
 	return earlyConn, udpConn, nil
 }
 
+// Opens a UDP connection to the address with a dialer and returns it as a
+// packet connection QUIC can be used over.
+func dialPacketConn(dialer Dialer, rAddr string) (net.PacketConn, net.Addr, error) {
+	conn, err := dialer.Dial("udp", rAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Dialers like SOCKS5 set a deadline for a single query, the connection
+	// is long-lived with QUIC
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		addr = dialedAddr(rAddr)
+	}
+	return &connectedPacketConn{Conn: conn, rAddr: addr}, addr, nil
+}
+
+// Packet connection over a connected UDP socket, or a proxy connection that
+// behaves like one. Packets can only be exchanged with the address the
+// connection was dialed to.
+type connectedPacketConn struct {
+	net.Conn
+	rAddr net.Addr
+}
+
+func (c *connectedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.rAddr, err
+}
+
+func (c *connectedPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// Address a connection was dialed to, used if it's not known to the dialer,
+// for example because a proxy resolved the name.
+type dialedAddr string
+
+func (a dialedAddr) Network() string { return "udp" }
+func (a dialedAddr) String() string  { return string(a) }
+
+// Context key of a flag that is set when a stream is opened before the
+// handshake of the connection completed, meaning data is sent as 0-RTT data.
+type earlyDataKey struct{}
+
+// Returns a context that records if a stream opened with it carries 0-RTT
+// data.
+func withEarlyDataFlag(ctx context.Context) (context.Context, *atomic.Bool) {
+	early := new(atomic.Bool)
+	return context.WithValue(ctx, earlyDataKey{}, early), early
+}
+
+// Sets the flag in the context if the handshake of the connection isn't
+// complete yet.
+func markEarlyData(ctx context.Context, conn quic.EarlyConnection) {
+	early, ok := ctx.Value(earlyDataKey{}).(*atomic.Bool)
+	if ok && !handshakeComplete(conn) {
+		early.Store(true)
+	}
+}
+
+func handshakeComplete(conn quic.EarlyConnection) bool {
+	select {
+	case <-conn.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
 type earlyConnWrapper struct {
 	quic.Connection
 }
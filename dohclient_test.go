@@ -1,7 +1,11 @@
 package rdns
 
 import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -26,3 +30,221 @@ func TestDoHClientSimpleGET(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDoHClientSharedTransport(t *testing.T) {
+	opt := DoHClientOptions{SharedTransportKey: "test-shared-transport"}
+	d1, err := NewDoHClient("test-doh1", "https://1.1.1.1/dns-query", opt)
+	require.NoError(t, err)
+	d2, err := NewDoHClient("test-doh2", "https://1.0.0.1/dns-query", opt)
+	require.NoError(t, err)
+	d3, err := NewDoHClient("test-doh3", "https://1.0.0.1/dns-query", DoHClientOptions{})
+	require.NoError(t, err)
+
+	require.Same(t, d1.client.Transport, d2.client.Transport)
+	require.NotSame(t, d1.client.Transport, d3.client.Transport)
+}
+
+func TestDoHClient0RTTReplay(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Two listeners with different session ticket keys. Sessions from one
+	// can't be resumed with the other, which then rejects 0-RTT data.
+	addrA, err := getUDPLnAddress()
+	require.NoError(t, err)
+	addrB, err := getUDPLnAddress()
+	require.NoError(t, err)
+	for _, addr := range []string{addrA, addrB} {
+		tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+		require.NoError(t, err)
+		s, err := NewDoHListener("test-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig, Transport: "quic"}, upstream)
+		require.NoError(t, err)
+		go s.Start()
+		defer s.Stop()
+	}
+	time.Sleep(time.Second)
+
+	// All clients share the session cache
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	opt := DoHClientOptions{TLSConfig: tlsConfig, Transport: "quic", Use0RTT: true}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The first query needs a full handshake, the second is sent as 0-RTT data
+	c, err := NewDoHClient("test-doh-0rtt-accept", "https://"+addrA+"/dns-query{?dns}", opt)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond) // Wait for the session ticket
+	c, err = NewDoHClient("test-doh-0rtt-accept", "https://"+addrA+"/dns-query{?dns}", opt)
+	require.NoError(t, err)
+	accepted := c.zeroRTT.Values()["accepted"]
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, accepted+1, c.zeroRTT.Values()["accepted"])
+
+	// The other listener rejects 0-RTT, the query is replayed
+	c, err = NewDoHClient("test-doh-0rtt-reject", "https://"+addrB+"/dns-query{?dns}", opt)
+	require.NoError(t, err)
+	rejected, replayed := c.zeroRTT.Values()["rejected"], c.zeroRTT.Values()["replayed"]
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, rejected+1, c.zeroRTT.Values()["rejected"])
+	require.Equal(t, replayed+1, c.zeroRTT.Values()["replayed"])
+	require.Equal(t, 3, upstream.HitCount())
+}
+
+func TestDoHClientAutoTransport(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+
+	// Only listen on TCP, as if QUIC was blocked
+	tcp, err := NewDoHListener("test-doh-tcp", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go tcp.Start()
+	defer tcp.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoHClient("test-doh-auto", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsConfig, Transport: "auto"})
+	require.NoError(t, err)
+	tr := c.client.Transport.(*dohFallbackTransport)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The query is answered over HTTP/2, which is then used exclusively
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), tr.fallback.Value())
+	require.Greater(t, tr.h2Until.Load(), time.Now().UnixNano())
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// HTTP/3 is tried again after a network change, and used once it's
+	// available
+	quic, err := NewDoHListener("test-doh-quic", addr, DoHListenerOptions{TLSConfig: tlsServerConfig, Transport: "quic"}, upstream)
+	require.NoError(t, err)
+	go quic.Start()
+	defer quic.Stop()
+	time.Sleep(time.Second)
+	closeConnections(tr)
+	require.Zero(t, tr.h2Until.Load())
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), tr.fallback.Value())
+}
+
+func TestDoHClientHappyEyeballs(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// The hostname resolves to an IPv6 address nothing listens on, and the
+	// IPv4 address of the listener
+	bootstrap := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				rr, _ := dns.NewRR("doh.test. 60 IN A 127.0.0.1")
+				a.Answer = append(a.Answer, rr)
+			case dns.TypeAAAA:
+				rr, _ := dns.NewRR("doh.test. 60 IN AAAA ::1")
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "localhost")
+	require.NoError(t, err)
+	opt := DoHClientOptions{TLSConfig: tlsConfig, HappyEyeballs: true, Resolver: NewNetResolver(bootstrap)}
+	c, err := NewDoHClient("test-doh-happy-eyeballs", "https://doh.test:"+port+"/dns-query", opt)
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
+
+func TestDoHClientH2Health(t *testing.T) {
+	var wedged atomic.Bool
+	release := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if wedged.Load() {
+				<-release
+			}
+			return q, nil
+		},
+	}
+	defer close(release)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh-h2-health", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	c, err := NewDoHClient("test-doh-h2-health", "https://"+addr+"/dns-query", DoHClientOptions{
+		TLSConfig:            tlsConfig,
+		QueryTimeout:         300 * time.Millisecond,
+		MaxConcurrentStreams: 1,
+		H2PingInterval:       time.Second,
+		H2MaxStreamErrors:    2,
+	})
+	require.NoError(t, err)
+	tr := c.client.Transport.(*dohHealthTransport)
+	reconnects := tr.reconnect.Value() // Metrics are global
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, tr.conns.len())
+
+	// Queries wait for a free stream while all are in use
+	c.streams <- struct{}{}
+	_, err = c.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrTimeout)
+	<-c.streams
+	require.Zero(t, tr.errors.Load())
+
+	// Queries time out on a stuck connection
+	wedged.Store(true)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrTimeout)
+	require.Equal(t, int64(1), tr.errors.Load())
+
+	// The connection is replaced after the second failure in a row
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, reconnects+1, tr.reconnect.Value())
+	require.Zero(t, tr.conns.len())
+
+	wedged.Store(false)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), tr.errors.Load())
+}
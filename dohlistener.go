@@ -1,14 +1,15 @@
 package rdns
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
-	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +23,9 @@ import (
 // Read/Write timeout in the DoH server
 const dohServerTimeout = 10 * time.Second
 
+// Responses smaller than this are not worth compressing.
+const dohCompressMinSize = 512
+
 // DoHListener is a DNS listener/server for DNS-over-HTTPS.
 type DoHListener struct {
 	httpServer *http.Server
@@ -32,7 +36,10 @@ type DoHListener struct {
 	r    Resolver
 	opt  DoHListenerOptions
 
-	metrics *DoHListenerMetrics
+	metrics        *DoHListenerMetrics
+	relatedTracker *relatedTracker
+	// Limits the number of related records prefetched at the same time.
+	relatedSlots chan struct{}
 }
 
 var _ Listener = &DoHListener{}
@@ -51,6 +58,16 @@ type DoHListenerOptions struct {
 
 	// Disable TLS on the server (insecure, for testing purposes only).
 	NoTLS bool
+
+	// Compress responses with gzip if the client supports it.
+	HTTPCompression bool
+
+	// Push or prefetch records related to queries. Experimental.
+	Related DoHRelatedMode
+
+	// Resolver information served at ResolverInfoPath (RFC9606), if set.
+	ResolverInfo *ResolverInfo
+
 	// Custom request handler used with the Oblivious listener
 	customMux *http.ServeMux
 }
@@ -59,20 +76,39 @@ type DoHListenerMetrics struct {
 	ListenerMetrics
 
 	// HTTP method used for query.
-	get  *expvar.Int
-	post *expvar.Int
+	get  *Counter
+	post *Counter
+
+	// Responses sent with gzip content-encoding.
+	gzip *Counter
+
+	// Related records pushed to clients.
+	push *Counter
+	// Related records resolved in advance.
+	prefetch *Counter
+	// Related records not prefetched because too many prefetches were
+	// already in progress.
+	prefetchSkipped *Counter
+	// Queries for records that were prefetched shortly before.
+	relatedHit *Counter
 }
 
 func NewDoHListenerMetrics(id string) *DoHListenerMetrics {
 	return &DoHListenerMetrics{
 		ListenerMetrics: ListenerMetrics{
-			query:    getVarInt("listener", id, "query"),
-			response: getVarMap("listener", id, "response"),
-			err:      getVarMap("listener", id, "error"),
-			drop:     getVarInt("listener", id, "drop"),
+			query:    getCounter("listener", id, "query"),
+			response: getCounterMap("listener", id, "response", "rcode"),
+			err:      getCounterMap("listener", id, "error", "reason"),
+			drop:     getCounter("listener", id, "drop"),
+			duration: getHistogram("listener", id, "duration", DefaultDurationBuckets),
 		},
-		get:  getVarInt("listener", id, "get"),
-		post: getVarInt("listener", id, "post"),
+		get:             getCounter("listener", id, "get"),
+		post:            getCounter("listener", id, "post"),
+		gzip:            getCounter("listener", id, "gzip"),
+		push:            getCounter("listener", id, "push"),
+		prefetch:        getCounter("listener", id, "prefetch"),
+		prefetchSkipped: getCounter("listener", id, "prefetch-skipped"),
+		relatedHit:      getCounter("listener", id, "related-hit"),
 	}
 }
 
@@ -86,18 +122,28 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 	default:
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
+	switch opt.Related {
+	case DoHRelatedOff, DoHRelatedPrefetch, DoHRelatedPush:
+	default:
+		return nil, fmt.Errorf("unknown related records mode: '%s'", opt.Related)
+	}
 
 	l := &DoHListener{
-		id:      id,
-		addr:    addr,
-		r:       resolver,
-		opt:     opt,
-		metrics: NewDoHListenerMetrics(id),
+		id:             id,
+		addr:           addr,
+		r:              resolver,
+		opt:            opt,
+		metrics:        NewDoHListenerMetrics(id),
+		relatedTracker: newRelatedTracker(),
+		relatedSlots:   make(chan struct{}, dohRelatedMaxPrefetch),
 	}
 
 	if opt.customMux == nil {
 		mux := http.NewServeMux()
 		mux.HandleFunc("/", l.dohHandler)
+		if opt.ResolverInfo != nil {
+			mux.Handle(ResolverInfoPath, opt.ResolverInfo)
+		}
 		l.opt.customMux = mux
 	}
 	return l, nil
@@ -184,6 +230,11 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no dns query value found", http.StatusBadRequest)
 		return
 	}
+	if len(b64[0]) > base64.RawURLEncoding.EncodedLen(dns.MaxMsgSize) {
+		s.metrics.err.Add("toolarge", 1)
+		http.Error(w, "dns query too long", http.StatusRequestURITooLong)
+		return
+	}
 	b, err := base64.RawURLEncoding.DecodeString(b64[0])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -193,11 +244,17 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
+	// Read one byte more than the largest possible query to detect larger ones
+	b, err := io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if len(b) > dns.MaxMsgSize {
+		s.metrics.err.Add("toolarge", 1)
+		http.Error(w, "dns query too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	s.parseAndRespond(b, w, r)
 }
 
@@ -205,7 +262,7 @@ func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
 // reverse proxies.
 func (s *DoHListener) extractClientAddress(r *http.Request) net.IP {
 	client, _, _ := net.SplitHostPort(r.RemoteAddr)
-	clientIP := net.ParseIP(client)
+	clientIP := ParseClientIP(client)
 
 	// TODO: Prefer RFC 7239 Forwarded once https://github.com/golang/go/issues/30963
 	//       is resolved and provides a safe parser.
@@ -217,9 +274,9 @@ func (s *DoHListener) extractClientAddress(r *http.Request) net.IP {
 	}
 
 	// If our client is a reverse proxy then use the last entry in X-Forwarded-For.
-	chain := strings.Split(xForwardedFor, ", ")
+	chain := strings.Split(xForwardedFor, ",")
 	if clientIP != nil && s.opt.HTTPProxyNet.Contains(clientIP) {
-		if ip := net.ParseIP(chain[len(chain)-1]); ip != nil {
+		if ip := ParseClientIP(chain[len(chain)-1]); ip != nil {
 			// Ignore XFF whe the client is local to the proxy.
 			if !ip.IsLoopback() {
 				return ip
@@ -234,10 +291,23 @@ func (s *DoHListener) extractClientAddress(r *http.Request) net.IP {
 	return clientIP
 }
 
+// Returns true if the request was received over HTTPS by a trusted reverse
+// proxy, as indicated by X-Forwarded-Proto.
+func (s *DoHListener) proxiedHTTPS(r *http.Request) bool {
+	if s.opt.HTTPProxyNet == nil {
+		return false
+	}
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	clientIP := ParseClientIP(client)
+	return clientIP != nil && s.opt.HTTPProxyNet.Contains(clientIP) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
 func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.Request) {
 	s.metrics.query.Add(1)
-	q := new(dns.Msg)
-	if err := q.Unpack(b); err != nil {
+	start := time.Now()
+	q, err := s.opt.unpackQuery(b)
+	if err != nil {
 		s.metrics.err.Add("unpack", 1)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -257,8 +327,14 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		SourceIP:      clientIP,
 		DoHPath:       r.URL.Path,
 		TLSServerName: tlsServerName,
+		TLSClientName: tlsClientName(r.TLS),
 		Listener:      s.id,
+		Transport:     "doh",
+		Encrypted:     r.TLS != nil || s.proxiedHTTPS(r),
 	}
+	ci = s.opt.classify(q, ci)
+	q, ci, timings := s.opt.startTiming(q, ci, true)
+	ci, age := trackResponseAge(ci)
 	log := Log.With(
 		"id", s.id,
 		"client", ci.SourceIP,
@@ -270,17 +346,34 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 	)
 	log.Debug("received query")
 
-	var err error
+	// Records related to pushed or prefetched queries were already handled
+	// with the original query
+	relatedDone := r.Header.Get(dohPushHeader) != ""
+	if s.opt.Related != DoHRelatedOff && !relatedDone && s.relatedTracker.hit(ci.SourceIP, q) {
+		s.metrics.relatedHit.Add(1)
+		relatedDone = true
+	}
+
 	a := new(dns.Msg)
-	if isAllowed(s.opt.AllowedNet, ci.SourceIP) {
-		log.With("resolver", s.r.String()).Debug("forwarding query to resolver")
-		a, err = s.r.Resolve(q, ci)
-		if err != nil {
+	switch action, resolver := s.opt.clientAction(ci.SourceIP, s.r); action {
+	case ACLActionAllow, ACLActionRoute:
+		log.With("resolver", resolver.String()).Debug("forwarding query to resolver")
+		a, err = s.opt.chaos(resolver).Resolve(q, ci)
+		if isPolicyError(err) {
+			log.Debug("query rejected by policy", "error", err)
+			a = policyResponse(q, err)
+		} else if err != nil {
 			log.Error("failed to resolve", "error", err)
 			a = new(dns.Msg)
 			a.SetRcode(q, dns.RcodeServerFailure)
 		}
-	} else {
+		if s.opt.Related != DoHRelatedOff && !relatedDone && err == nil && a != nil && a.Rcode == dns.RcodeSuccess {
+			s.related(w, r, q, ci, resolver)
+		}
+	case ACLActionDrop:
+		log.Debug("dropping query from client ip")
+		a = nil
+	default:
 		log.Debug("refusing client ip")
 		a.SetRcode(q, dns.RcodeRefused)
 	}
@@ -292,10 +385,14 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	serverTiming := timings.finish(q, a)
+
 	// Pad the packet according to rfc8467 and rfc7830
+	s.opt.compress(a)
 	padAnswer(q, a)
 
 	s.metrics.response.Add(rCode(a), 1)
+	s.metrics.duration.Observe(time.Since(start).Seconds())
 	out, err := a.Pack()
 	if err != nil {
 		s.metrics.err.Add("pack", 1)
@@ -303,5 +400,58 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 	w.Header().Set("content-type", "application/dns-message")
+	cc, responseAge := cacheControl(a, time.Duration(age.Load()))
+	w.Header().Set("cache-control", cc)
+	if responseAge != "" {
+		w.Header().Set("age", responseAge)
+	}
+	if serverTiming != "" {
+		w.Header().Set("server-timing", serverTiming)
+	}
+	if s.opt.HTTPCompression {
+		w.Header().Set("vary", "accept-encoding")
+		if len(out) >= dohCompressMinSize && acceptsEncoding(r.Header.Get("accept-encoding"), "gzip") {
+			s.metrics.gzip.Add(1)
+			w.Header().Set("content-encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(out)
+			_ = gz.Close()
+			return
+		}
+	}
 	_, _ = w.Write(out)
 }
+
+// Returns true if the Accept-Encoding header value lists the encoding and
+// doesn't disable it with q=0.
+func acceptsEncoding(header, encoding string) bool {
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the Cache-Control and Age header values for a response. As per RFC8484,
+// the freshness lifetime is the smallest TTL in the response. Responses from a
+// cache have their TTLs reduced by the time spent in it, which is sent as Age,
+// so the lifetime is the TTL before it was reduced. Responses without any
+// records should not be cached by HTTP caches and have no Age.
+func cacheControl(a *dns.Msg, age time.Duration) (string, string) {
+	ttl, ok := minTTL(a)
+	if !ok || a.Rcode == dns.RcodeServerFailure {
+		return "no-cache", ""
+	}
+	seconds := uint32(age.Seconds())
+	if seconds == 0 {
+		return fmt.Sprintf("max-age=%d", ttl), ""
+	}
+	return fmt.Sprintf("max-age=%d", ttl+seconds), strconv.FormatUint(uint64(seconds), 10)
+}
@@ -1,8 +1,12 @@
 package rdns
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -214,6 +218,29 @@ func TestClientBehindProxy(t *testing.T) {
 	r.Header.Add("X-Forwarded-For", "192.168.1.2, 10.0.0.2")
 	client = s.extractClientAddress(r)
 	require.Equal(t, "10.0.1.6", client.String())
+
+	// IPv4-mapped and scoped addresses are normalized.
+	r, _ = http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "[::ffff:10.0.0.2]:1234"
+	r.Header.Add("X-Forwarded-For", "192.168.1.2,fe80::1%eth0")
+	client = s.extractClientAddress(r)
+	require.Equal(t, "fe80::1", client.String())
+	r, _ = http.NewRequest("GET", "https://www.example.com", nil)
+	r.RemoteAddr = "[fe80::2%eth0]:1234"
+	client = s.extractClientAddress(r)
+	require.Equal(t, "fe80::2", client.String())
+
+	// Queries received over HTTPS by our proxy are encrypted, the header is
+	// ignored if it's not from our proxy.
+	r, _ = http.NewRequest("GET", "http://www.example.com", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Add("X-Forwarded-Proto", "https")
+	require.True(t, s.proxiedHTTPS(r))
+	r.Header.Set("X-Forwarded-Proto", "http")
+	require.False(t, s.proxiedHTTPS(r))
+	r.RemoteAddr = "10.0.1.6:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	require.False(t, s.proxiedHTTPS(r))
 }
 
 func TestIPv6Proxy(t *testing.T) {
@@ -254,5 +281,160 @@ func TestIPv6Proxy(t *testing.T) {
 	r.RemoteAddr = "[2001:4860:4860::8]:1234"
 	r.Header.Add("X-Forwarded-For", "10.0.1.5")
 	client = s.extractClientAddress(r)
-	require.Equal(t, net.IPv4(10, 0, 1, 5), client)
+	require.Equal(t, net.IPv4(10, 0, 1, 5).To4(), client)
+}
+
+func TestDoHListenerCompression(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return largeResponse(q, 100), nil
+		},
+	}
+	s, err := NewDoHListener("test-doh", "127.0.0.1:0", DoHListenerOptions{HTTPCompression: true}, upstream)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	// Client that supports gzip
+	req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+	req.Header.Set("accept-encoding", "br, gzip;q=0.5")
+	w := httptest.NewRecorder()
+	s.dohHandler(w, req)
+	require.Equal(t, "gzip", w.Header().Get("content-encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	out, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	a := new(dns.Msg)
+	require.NoError(t, a.Unpack(out))
+	require.Len(t, a.Answer, 100)
+
+	// Client that doesn't support gzip
+	req = httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+	req.Header.Set("accept-encoding", "gzip;q=0")
+	w = httptest.NewRecorder()
+	s.dohHandler(w, req)
+	require.Empty(t, w.Header().Get("content-encoding"))
+	require.NoError(t, a.Unpack(w.Body.Bytes()))
+}
+
+func TestDoHListenerCacheHeaders(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+	clock := NewFakeClock(time.Now())
+	cache := NewCache("test-cache", upstream, CacheOptions{Clock: clock})
+	defer cache.Close()
+	s, err := NewDoHListener("test-doh", "127.0.0.1:0", DoHListenerOptions{}, cache)
+	require.NoError(t, err)
+
+	query := func() (*httptest.ResponseRecorder, *dns.Msg) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		s.dohHandler(w, req)
+		a := new(dns.Msg)
+		require.NoError(t, a.Unpack(w.Body.Bytes()))
+		return w, a
+	}
+
+	// Response from upstream
+	w, _ := query()
+	require.Equal(t, "max-age=300", w.Header().Get("cache-control"))
+	require.Empty(t, w.Header().Get("age"))
+
+	// Response from the cache, the TTL is reduced by the age
+	clock.Advance(100 * time.Second)
+	w, a := query()
+	require.Equal(t, "max-age=300", w.Header().Get("cache-control"))
+	require.Equal(t, "100", w.Header().Get("age"))
+	require.Equal(t, uint32(200), a.Answer[0].Header().Ttl)
+}
+
+// Response recorder that supports HTTP/2 server push.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (r *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	r.pushed = append(r.pushed, target)
+	return nil
+}
+
+func TestDoHListenerRelated(t *testing.T) {
+	upstream := new(TestResolver)
+	s, err := NewDoHListener("test-doh-related", "127.0.0.1:0", DoHListenerOptions{Related: DoHRelatedPush}, upstream)
+	require.NoError(t, err)
+
+	query := func(qtype uint16, w http.ResponseWriter, header http.Header) {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(b))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		s.dohHandler(w, req)
+	}
+
+	// Client that supports push gets the AAAA and HTTPS records pushed
+	w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	query(dns.TypeA, w, nil)
+	require.Len(t, w.pushed, 2)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, int64(2), s.metrics.push.Value())
+
+	// Pushed requests don't trigger more pushes
+	w = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	query(dns.TypeAAAA, w, http.Header{dohPushHeader: {"1"}})
+	require.Empty(t, w.pushed)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Without push support, related records are resolved in the background
+	query(dns.TypeA, httptest.NewRecorder(), nil)
+	require.Eventually(t, func() bool { return upstream.HitCount() == 5 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(2), s.metrics.prefetch.Value())
+
+	// The follow-up query from the client is counted as hit and doesn't
+	// trigger another prefetch
+	query(dns.TypeAAAA, httptest.NewRecorder(), nil)
+	require.Equal(t, int64(1), s.metrics.relatedHit.Value())
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 6, upstream.HitCount())
+
+	// Other types don't have related records
+	query(dns.TypeMX, httptest.NewRecorder(), nil)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 7, upstream.HitCount())
+
+	// Prefetches are skipped while too many are in progress
+	s.relatedTracker = newRelatedTracker()
+	for range cap(s.relatedSlots) {
+		s.relatedSlots <- struct{}{}
+	}
+	query(dns.TypeHTTPS, httptest.NewRecorder(), nil)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 8, upstream.HitCount())
+	require.Equal(t, int64(2), s.metrics.prefetchSkipped.Value())
+}
+
+func TestDoHListenerRelatedInvalid(t *testing.T) {
+	_, err := NewDoHListener("test-doh", "127.0.0.1:0", DoHListenerOptions{Related: "invalid"}, new(TestResolver))
+	require.Error(t, err)
 }
@@ -28,6 +28,9 @@ type DoQClient struct {
 	log      *slog.Logger
 	metrics  *ListenerMetrics
 
+	// Results of queries sent as 0-RTT data.
+	zeroRTT *CounterMap
+
 	connection quicConnection
 }
 
@@ -42,6 +45,10 @@ type DoQClientOptions struct {
 	TLSConfig    *tls.Config
 	QueryTimeout time.Duration
 	Use0RTT      bool
+
+	// Optional dialer, e.g. proxy. Needs to support UDP, like a SOCKS5 proxy
+	// with UDP ASSOCIATE.
+	Dialer Dialer
 }
 
 var _ Resolver = &DoQClient{}
@@ -78,7 +85,7 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 	tlsConfig.ServerName = host
 
 	// enable TLS session caching for session resumption and 0-RTT
-	if opt.Use0RTT {
+	if opt.Use0RTT && tlsConfig.ClientSessionCache == nil {
 		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(100)
 	}
 
@@ -98,6 +105,7 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 		connection: quicConnection{
 			hostname:  host,
 			lAddr:     lAddr,
+			dialer:    opt.Dialer,
 			tlsConfig: tlsConfig,
 			config: &quic.Config{
 				TokenStore:           quic.NewLRUTokenStore(10, 10),
@@ -106,14 +114,18 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 			Use0RTT: opt.Use0RTT,
 		},
 		metrics: NewListenerMetrics("client", id),
+		zeroRTT: getCounterMap("client", id, "0rtt", "result"),
 	}, nil
 }
 
 // Resolve a DNS query.
 func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	Log.Debug("querying upstream resolver", slog.Group("details", slog.String("id", d.id), slog.String("resolver", d.endpoint), slog.String("protocol", "doq"), slog.String("qname", qName(q)), slog.String("qtype", qType(q))))
 
 	d.metrics.query.Add(1)
+	start := time.Now()
 
 	// When sending queries over a DoQ, the DNS Message ID MUST be set to zero.
 	// Make a deep copy because if there are multiple upstreams second
@@ -149,43 +161,24 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	binary.BigEndian.PutUint16(b, uint16(len(p)))
 	copy(b[2:], p)
 
-	// Get a new stream in the connection
-	stream, err := d.connection.getStream(d.endpoint, d.log)
-	if err != nil {
-		d.metrics.err.Add("getstream", 1)
-		return nil, err
+	// Send the query and read the response. If the server rejected the query
+	// sent as 0-RTT data, replay it once the handshake is complete.
+	rb, early, err := d.exchange(b, deadlineTime, false)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		d.zeroRTT.Add("rejected", 1)
+		d.log.Debug("0-rtt rejected, replaying query after full handshake")
+		d.zeroRTT.Add("replayed", 1)
+		rb, _, err = d.exchange(b, deadlineTime, true)
+	} else if err == nil && early {
+		d.zeroRTT.Add("accepted", 1)
 	}
-
-	// Write the query into the stream and close it. Only one stream per query/response
-	_ = stream.SetWriteDeadline(deadlineTime)
-	if _, err = stream.Write(b); err != nil {
-		d.metrics.err.Add("write", 1)
-		return nil, err
-	}
-	if err = stream.Close(); err != nil {
-		d.metrics.err.Add("close", 1)
-		return nil, err
-	}
-
-	_ = stream.SetReadDeadline(deadlineTime)
-
-	// DoQ requires a length prefix, like TCP
-	var length uint16
-	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
-		d.metrics.err.Add("read", 1)
-		return nil, err
-	}
-
-	// Read the response
-	b = make([]byte, length)
-	if _, err = io.ReadFull(stream, b); err != nil {
-		d.metrics.err.Add("read", 1)
-		return nil, err
+	if err != nil {
+		return nil, upstreamError(d.id, err)
 	}
 
 	// Decode the response and restore the ID
 	a := new(dns.Msg)
-	err = a.Unpack(b)
+	err = a.Unpack(rb)
 	a.Id = q.Id
 
 	// Receiving a edns-tcp-keepalive EDNS(0) option is a fatal error according to the RFC
@@ -200,48 +193,126 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 	}
 	d.metrics.response.Add(rCode(a), 1)
+	d.metrics.duration.Observe(time.Since(start).Seconds())
 
 	return a, err
 }
 
+// Sends a length-prefixed query in a new stream and returns the response.
+// Returns true if the query was sent as 0-RTT data. If fullHandshake is set,
+// the stream is only opened once the handshake is complete.
+func (d *DoQClient) exchange(b []byte, deadline time.Time, fullHandshake bool) ([]byte, bool, error) {
+	// Count errors, except for rejected 0-RTT data which is replayed
+	fail := func(reason string, err error) ([]byte, bool, error) {
+		if !errors.Is(err, quic.Err0RTTRejected) {
+			d.metrics.err.Add(reason, 1)
+		}
+		return nil, false, err
+	}
+
+	// Get a new stream in the connection
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	stream, early, err := d.connection.getStream(ctx, d.endpoint, d.log, fullHandshake)
+	if err != nil {
+		return fail("getstream", err)
+	}
+
+	// Write the query into the stream and close it. Only one stream per query/response
+	_ = stream.SetWriteDeadline(deadline)
+	if _, err = stream.Write(b); err != nil {
+		return fail("write", err)
+	}
+	if err = stream.Close(); err != nil {
+		return fail("close", err)
+	}
+
+	_ = stream.SetReadDeadline(deadline)
+
+	// DoQ requires a length prefix, like TCP
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return fail("read", err)
+	}
+
+	// Read the response
+	rb := make([]byte, length)
+	if _, err = io.ReadFull(stream, rb); err != nil {
+		return fail("read", err)
+	}
+	return rb, early, nil
+}
+
+// Close the upstream connection.
+func (d *DoQClient) Close() error {
+	d.connection.close()
+	return nil
+}
+
 func (d *DoQClient) String() string {
 	return d.id
 }
 
-func (s *quicConnection) getStream(endpoint string, log *slog.Logger) (quic.Stream, error) {
+// Returns a new stream in the connection, opening the connection if needed.
+// Returns true if the handshake isn't complete yet, meaning data written to
+// the stream is sent as 0-RTT data. If fullHandshake is set, waits for the
+// handshake to complete before opening the stream.
+func (s *quicConnection) getStream(ctx context.Context, endpoint string, log *slog.Logger, fullHandshake bool) (quic.Stream, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// If we don't have a connection yet, make one
 	if s.EarlyConnection == nil {
 		var err error
-		s.EarlyConnection, s.udpConn, err = quicDial(context.TODO(), endpoint, s.lAddr, s.tlsConfig, s.config, s.Use0RTT)
+		s.EarlyConnection, s.udpConn, err = quicDial(context.TODO(), endpoint, s.lAddr, s.dialer, s.tlsConfig, s.config, s.Use0RTT)
 		if err != nil {
 			log.Error("failed to open connection",
 				"hostname", s.hostname,
 				"error", err,
 			)
-			return nil, err
+			return nil, false, err
 		}
 		s.rAddr = endpoint
 	}
 
+	stream, early, err := s.openStream(ctx, fullHandshake)
+
+	// Once the server rejected 0-RTT, streams can only be opened after the
+	// handshake completed
+	if errors.Is(err, quic.Err0RTTRejected) {
+		stream, early, err = s.openStream(ctx, true)
+	}
+
 	// If we can't get a stream then restart the connection and try again once
-	stream, err := s.EarlyConnection.OpenStream()
 	if err != nil {
 		log.Debug("temporary fail when trying to open stream, attempting new connection",
 			"error", err,
 		)
 		if err = quicRestart(s); err != nil {
 			log.Error("failed to open connection", "hostname", s.hostname, "error", err)
-			return nil, err
+			return nil, false, err
 		}
-		stream, err = s.EarlyConnection.OpenStream()
+		stream, early, err = s.openStream(ctx, fullHandshake)
 		if err != nil {
 			log.Error("failed to open stream",
 				"error", err,
 			)
 		}
 	}
-	return stream, err
+	return stream, early, err
+}
+
+// Opens a stream in the connection. This function should be called with the
+// quicConnection locked.
+func (s *quicConnection) openStream(ctx context.Context, fullHandshake bool) (quic.Stream, bool, error) {
+	if fullHandshake && s.Use0RTT {
+		// Waits for the handshake and, if 0-RTT was rejected, switches to
+		// the streams of the full handshake
+		if _, err := s.EarlyConnection.NextConnection(ctx); err != nil {
+			return nil, false, err
+		}
+	}
+	early := !handshakeComplete(s.EarlyConnection)
+	stream, err := s.EarlyConnection.OpenStream()
+	return stream, early, err
 }
@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"crypto/tls"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -29,3 +31,51 @@ func TestDOQError(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, id, q.Id) // Shouldn't touch the ID in the query
 }
+
+func TestDOQ0RTTReplay(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Two listeners with different session ticket keys. Sessions from one
+	// can't be resumed with the other, which then rejects 0-RTT data.
+	addrA, err := getUDPLnAddress()
+	require.NoError(t, err)
+	addrB, err := getUDPLnAddress()
+	require.NoError(t, err)
+	for _, addr := range []string{addrA, addrB} {
+		tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+		require.NoError(t, err)
+		s := NewQUICListener("test-doq", addr, DoQListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+		go s.Start()
+	}
+	time.Sleep(time.Second)
+
+	// All clients share the session cache
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The first query needs a full handshake, the second is sent as 0-RTT data
+	c, err := NewDoQClient("test-doq-0rtt-accept", addrA, DoQClientOptions{TLSConfig: tlsConfig, Use0RTT: true})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond) // Wait for the session ticket
+	c, err = NewDoQClient("test-doq-0rtt-accept", addrA, DoQClientOptions{TLSConfig: tlsConfig, Use0RTT: true})
+	require.NoError(t, err)
+	accepted := c.zeroRTT.Values()["accepted"]
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, accepted+1, c.zeroRTT.Values()["accepted"])
+
+	// The other listener rejects 0-RTT, the query is replayed
+	c, err = NewDoQClient("test-doq-0rtt-reject", addrB, DoQClientOptions{TLSConfig: tlsConfig, Use0RTT: true})
+	require.NoError(t, err)
+	rejected, replayed := c.zeroRTT.Values()["rejected"], c.zeroRTT.Values()["replayed"]
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, rejected+1, c.zeroRTT.Values()["rejected"])
+	require.Equal(t, replayed+1, c.zeroRTT.Values()["replayed"])
+	require.Equal(t, 3, upstream.HitCount())
+}
@@ -4,9 +4,8 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
-	"expvar"
+	"fmt"
 	"io"
-	"net"
 	"time"
 
 	"log/slog"
@@ -39,21 +38,22 @@ type DoQListenerMetrics struct {
 	ListenerMetrics
 
 	// Count of connections initiated.
-	connection *expvar.Int
+	connection *Counter
 	// Count of streams seen in all connections.
-	stream *expvar.Int
+	stream *Counter
 }
 
 func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
 	return &DoQListenerMetrics{
 		ListenerMetrics: ListenerMetrics{
-			query:    getVarInt("listener", id, "query"),
-			response: getVarMap("listener", id, "response"),
-			drop:     getVarInt("listener", id, "drop"),
-			err:      getVarMap("listener", id, "error"),
+			query:    getCounter("listener", id, "query"),
+			response: getCounterMap("listener", id, "response", "rcode"),
+			drop:     getCounter("listener", id, "drop"),
+			err:      getCounterMap("listener", id, "error", "reason"),
+			duration: getHistogram("listener", id, "duration", DefaultDurationBuckets),
 		},
-		connection: getVarInt("listener", id, "session"),
-		stream:     getVarInt("listener", id, "stream"),
+		connection: getCounter("listener", id, "session"),
+		stream:     getCounter("listener", id, "stream"),
 	}
 }
 
@@ -104,21 +104,22 @@ func (s DoQListener) Stop() error {
 }
 
 func (s DoQListener) handleConnection(connection quic.Connection) {
-	tlsServerName := connection.ConnectionState().TLS.ServerName
+	tlsState := connection.ConnectionState().TLS
 
 	ci := ClientInfo{
 		Listener:      s.id,
-		TLSServerName: tlsServerName,
-	}
-	switch addr := connection.RemoteAddr().(type) {
-	case *net.TCPAddr:
-		ci.SourceIP = addr.IP
-	case *net.UDPAddr:
-		ci.SourceIP = addr.IP
+		TLSServerName: tlsState.ServerName,
+		TLSClientName: tlsClientName(&tlsState),
+		SourceIP:      addrIP(connection.RemoteAddr()),
+		Transport:     "doq",
+		Encrypted:     true,
 	}
 	log := s.log.With("client", connection.RemoteAddr())
 
-	if !isAllowed(s.opt.AllowedNet, ci.SourceIP) {
+	// The ACL is evaluated once per connection. Clients that are refused
+	// still get a REFUSED response for every query on the connection.
+	action, resolver := s.opt.clientAction(ci.SourceIP, s.r)
+	if action == ACLActionDrop {
 		log.Debug("rejecting incoming connection")
 		s.metrics.drop.Add(1)
 		return
@@ -133,37 +134,28 @@ func (s DoQListener) handleConnection(connection quic.Connection) {
 		}
 		log.With("stream", stream.StreamID()).Debug("opening stream")
 		go func() {
-			s.handleStream(stream, log, ci)
+			s.handleStream(stream, log, ci, action, resolver)
 			log.With("stream", stream.StreamID()).Debug("closing stream")
 		}()
 	}
 }
 
-func (s DoQListener) handleStream(stream quic.Stream, log *slog.Logger, ci ClientInfo) {
+func (s DoQListener) handleStream(stream quic.Stream, log *slog.Logger, ci ClientInfo, action ACLAction, resolver Resolver) {
 	// DNS over QUIC uses one stream per query/response.
 	defer stream.Close()
 	s.metrics.stream.Add(1)
 
-	// DoQ requires a length prefix, like TCP
-	var length uint16
-	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
-		s.metrics.err.Add("read", 1)
-		log.Error("failed to read query", "error", err)
-		return
-	}
-
-	// Read the raw query
-	b := make([]byte, length)
 	_ = stream.SetReadDeadline(time.Now().Add(time.Second)) // TODO: configurable timeout
-	if _, err := io.ReadFull(stream, b); err != nil {
+	b, err := readDoQQuery(stream)
+	if err != nil {
 		s.metrics.err.Add("read", 1)
 		log.Error("failed to read query", "error", err)
 		return
 	}
 
 	// Decode the query
-	q := new(dns.Msg)
-	if err := q.Unpack(b); err != nil {
+	q, err := s.opt.unpackQuery(b)
+	if err != nil {
 		s.metrics.err.Add("unpack", 1)
 		log.Error("failed to decode query", "error", err)
 		return
@@ -171,6 +163,7 @@ func (s DoQListener) handleStream(stream quic.Stream, log *slog.Logger, ci Clien
 	log = log.With("qname", qName(q))
 	log.Debug("received query")
 	s.metrics.query.Add(1)
+	start := time.Now()
 
 	// Receiving a edns-tcp-keepalive EDNS(0) option is a fatal error according to the RFC
 	edns0 := q.IsEdns0()
@@ -185,13 +178,36 @@ func (s DoQListener) handleStream(stream quic.Stream, log *slog.Logger, ci Clien
 	}
 
 	// Resolve the query using the next hop
-	a, err := s.r.Resolve(q, ci)
-	if err != nil {
-		log.Error("failed to resolve", "error", err)
-		a = new(dns.Msg)
-		a.SetRcode(q, dns.RcodeServerFailure)
+	var (
+		a       *dns.Msg
+		timings *queryTimings
+	)
+	if action == ACLActionRefuse {
+		log.Debug("refusing client ip")
+		s.metrics.err.Add("acl", 1)
+		a = refused(q)
+	} else {
+		var err error
+		q, ci, timings = s.opt.startTiming(q, s.opt.classify(q, ci), false)
+		a, err = s.opt.chaos(resolver).Resolve(q, ci)
+		if isPolicyError(err) {
+			log.Debug("query rejected by policy", "error", err)
+			a = policyResponse(q, err)
+		} else if err != nil {
+			log.Error("failed to resolve", "error", err)
+			a = new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+		}
 	}
 
+	// A nil response from the resolvers means "drop"
+	if a == nil {
+		s.metrics.drop.Add(1)
+		return
+	}
+
+	timings.finish(q, a)
+	s.opt.compress(a)
 	p, err := a.Pack()
 	if err != nil {
 		log.Error("failed to encode response", "error", err)
@@ -211,6 +227,24 @@ func (s DoQListener) handleStream(stream quic.Stream, log *slog.Logger, ci Clien
 		log.Error("failed to send response", "error", err)
 	}
 	s.metrics.response.Add(rCode(a), 1)
+	s.metrics.duration.Observe(time.Since(start).Seconds())
+}
+
+// Reads a query with its 2-byte length prefix from a stream. The length is
+// checked before allocating the buffer for the query.
+func readDoQQuery(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < dnsHeaderLen {
+		return nil, fmt.Errorf("invalid query length %d", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 func (s DoQListener) String() string {
@@ -32,6 +32,9 @@ type DoTClientOptions struct {
 
 	// Optional dialer, e.g. proxy
 	Dialer Dialer
+
+	// Socket options of TCP connections. Not used with proxies.
+	TCP TCPOptions
 }
 
 var _ Resolver = &DoTClient{}
@@ -47,6 +50,7 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 		TLSConfig: opt.TLSConfig,
 		Dialer:    opt.Dialer,
 		LocalAddr: opt.LocalAddr,
+		TCP:       opt.TCP,
 	}
 	// If a bootstrap address was provided, we need to use the IP for the connection but the
 	// hostname in the TLS handshake. The DNS library doesn't support custom dialers, so
@@ -69,6 +73,8 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 
 // Resolve a DNS query.
 func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	// Packing a message is not always a read-only operation, make a copy
 	q = q.Copy()
 	log := logger(d.id, q, ci)
@@ -79,6 +85,11 @@ func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return d.pipeline.Resolve(q)
 }
 
+// Close the upstream connection.
+func (d *DoTClient) Close() error {
+	return d.pipeline.Close()
+}
+
 func (d *DoTClient) String() string {
 	return d.id
 }
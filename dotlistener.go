@@ -2,6 +2,8 @@ package rdns
 
 import (
 	"crypto/tls"
+	"errors"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -9,7 +11,8 @@ import (
 // DoTListener is a DNS listener/server for DNS-over-TLS.
 type DoTListener struct {
 	*dns.Server
-	id string
+	id  string
+	tcp TCPOptions
 }
 
 var _ Listener = &DoTListener{}
@@ -27,12 +30,14 @@ func NewDoTListener(id, addr, network string, opt DoTListenerOptions, resolver R
 		network = "tcp-tls"
 	}
 	return &DoTListener{
-		id: id,
+		id:  id,
+		tcp: opt.TCP,
 		Server: &dns.Server{
-			Addr:      addr,
-			Net:       network,
-			TLSConfig: opt.TLSConfig,
-			Handler:   listenHandler(id, "dot", addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Net:           network,
+			TLSConfig:     opt.TLSConfig,
+			Handler:       listenHandler(id, "dot", addr, resolver, opt.ListenOptions),
+			MsgAcceptFunc: opt.acceptMsg,
 		},
 	}
 }
@@ -43,7 +48,15 @@ func (s DoTListener) Start() error {
 		"id", s.id,
 		"protocol", "dot",
 		"addr", s.Addr)
-	return s.ListenAndServe()
+	if s.TLSConfig == nil || (len(s.TLSConfig.Certificates) == 0 && s.TLSConfig.GetCertificate == nil) {
+		return errors.New("neither certificates nor GetCertificate set in the tls config")
+	}
+	ln, err := s.tcp.listen(strings.TrimSuffix(s.Net, "-tls"), s.Addr)
+	if err != nil {
+		return err
+	}
+	s.Listener = tls.NewListener(ln, s.TLSConfig)
+	return s.ActivateAndServe()
 }
 
 // Stop the server.
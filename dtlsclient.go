@@ -92,6 +92,8 @@ func NewDTLSClient(id, endpoint string, opt DTLSClientOptions) (*DTLSClient, err
 
 // Resolve a DNS query.
 func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	// Packing a message is not always a read-only operation, make a copy
 	q = q.Copy()
 
@@ -108,6 +110,11 @@ func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return d.pipeline.Resolve(q)
 }
 
+// Close the upstream connection.
+func (d *DTLSClient) Close() error {
+	return d.pipeline.Close()
+}
+
 func (d *DTLSClient) String() string {
 	return d.id
 }
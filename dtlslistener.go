@@ -35,8 +35,9 @@ func NewDTLSListener(id, addr string, opt DTLSListenerOptions, resolver Resolver
 	return &DTLSListener{
 		id: id,
 		Server: &dns.Server{
-			Addr:    addr,
-			Handler: listenHandler(id, "dtls", addr, resolver, opt.AllowedNet),
+			Addr:          addr,
+			Handler:       listenHandler(id, "dtls", addr, resolver, opt.ListenOptions),
+			MsgAcceptFunc: opt.acceptMsg,
 		},
 		opt: opt,
 	}
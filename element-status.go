@@ -0,0 +1,294 @@
+package rdns
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ElementStatus is the health of an element in the configuration, as seen by
+// the queries passing through it, reloads of its lists and its upstream
+// connection.
+type ElementStatus struct {
+	ID string `json:"id"`
+
+	// False if the last query failed, the last reload of a list failed, the
+	// upstream connection can't be opened or lists are still loading.
+	Healthy bool `json:"healthy"`
+
+	// Lists of the element are loading in the background.
+	Loading bool `json:"loading,omitempty"`
+
+	LastSuccess      *time.Time `json:"last-success,omitempty"`
+	LastError        *time.Time `json:"last-error,omitempty"`
+	LastErrorMessage string     `json:"last-error-message,omitempty"`
+
+	// Time and error of the last reload of blocklists and allowlists.
+	LastReload      *time.Time `json:"last-reload,omitempty"`
+	LastReloadError string     `json:"last-reload-error,omitempty"`
+
+	// State of the upstream connection of DNS, DoT and DTLS resolvers.
+	Connection        ConnectionState `json:"connection,omitempty"`
+	ConnectionChanged *time.Time      `json:"connection-changed,omitempty"`
+	ConnectionError   string          `json:"connection-error,omitempty"`
+}
+
+// ConnectionState is the state of the connection of an upstream resolver.
+type ConnectionState string
+
+const (
+	// Connection is open.
+	ConnectionOpen ConnectionState = "open"
+
+	// Connection was closed, it's opened again with the next query.
+	ConnectionIdle ConnectionState = "idle"
+
+	// Connection failed to open.
+	ConnectionFailed ConnectionState = "failed"
+)
+
+// Status of an element, updated as queries pass through it.
+type elementStatus struct {
+	lastSuccess atomic.Int64 // Unix nanoseconds, 0 if never
+
+	mu                sync.Mutex
+	lastError         time.Time
+	lastErrorMessage  string
+	lastReload        time.Time
+	lastReloadError   string
+	connection        ConnectionState
+	connectionChanged time.Time
+	connectionError   string
+	loading           int // Number of lists loading in the background
+}
+
+// Status of all elements, by ID.
+var elementStatuses = &statusRegistry{items: make(map[string]*elementStatus)}
+
+type statusRegistry struct {
+	mu    sync.RWMutex
+	items map[string]*elementStatus
+}
+
+// Returns the status of an element, adding it if it's not known yet.
+func (r *statusRegistry) get(id string) *elementStatus {
+	r.mu.RLock()
+	s, ok := r.items[id]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.items[id]; ok {
+		return s
+	}
+	s = new(elementStatus)
+	r.items[id] = s
+	return s
+}
+
+// Removes the status of all elements other than the given ones.
+func (r *statusRegistry) retain(ids []string) {
+	keep := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		keep[id] = struct{}{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.items {
+		if _, ok := keep[id]; !ok {
+			delete(r.items, id)
+		}
+	}
+}
+
+// RetainElementStatuses removes the status of elements that aren't in the
+// given list of IDs, to drop elements that were removed from the
+// configuration on reload. Elements that are kept continue with their status.
+func RetainElementStatuses(ids []string) {
+	elementStatuses.retain(ids)
+}
+
+// Records the result of a query passing through the element.
+func (s *elementStatus) query(err error) {
+	now := time.Now()
+	if err == nil {
+		s.lastSuccess.Store(now.UnixNano())
+		return
+	}
+	s.mu.Lock()
+	s.lastError = now
+	s.lastErrorMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// Records the result of reloading a list of an element.
+func statusReload(id string, err error) {
+	s := elementStatuses.get(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastReload = time.Now()
+	s.lastReloadError = ""
+	if err != nil {
+		s.lastReloadError = err.Error()
+	}
+}
+
+// Records the start (1) or end (-1) of loading a list in the background.
+func statusLoading(id string, delta int) {
+	s := elementStatuses.get(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loading += delta
+}
+
+// Records a change of the upstream connection of an element.
+func statusConnection(id string, state ConnectionState, err error) {
+	s := elementStatuses.get(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connection = state
+	s.connectionChanged = time.Now()
+	s.connectionError = ""
+	if err != nil {
+		s.connectionError = err.Error()
+	}
+}
+
+func (s *elementStatus) status(id string) ElementStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ElementStatus{
+		ID:               id,
+		Healthy:          true,
+		LastErrorMessage: s.lastErrorMessage,
+		LastReloadError:  s.lastReloadError,
+		Connection:       s.connection,
+		ConnectionError:  s.connectionError,
+		Loading:          s.loading > 0,
+	}
+	if status.Loading {
+		status.Healthy = false
+	}
+	var lastSuccess time.Time
+	if ns := s.lastSuccess.Load(); ns != 0 {
+		lastSuccess = time.Unix(0, ns)
+		status.LastSuccess = &lastSuccess
+	}
+	// Copy the times, the status must not point into the element
+	lastError, lastReload, connectionChanged := s.lastError, s.lastReload, s.connectionChanged
+	if !lastError.IsZero() {
+		status.LastError = &lastError
+		if lastError.After(lastSuccess) {
+			status.Healthy = false
+		}
+	}
+	if !lastReload.IsZero() {
+		status.LastReload = &lastReload
+		if s.lastReloadError != "" {
+			status.Healthy = false
+		}
+	}
+	if !connectionChanged.IsZero() {
+		status.ConnectionChanged = &connectionChanged
+		if s.connection == ConnectionFailed {
+			status.Healthy = false
+		}
+	}
+	return status
+}
+
+// ElementStatuses returns the status of all elements, sorted by ID.
+func ElementStatuses() []ElementStatus {
+	elementStatuses.mu.RLock()
+	statuses := make([]ElementStatus, 0, len(elementStatuses.items))
+	for id, s := range elementStatuses.items {
+		statuses = append(statuses, s.status(id))
+	}
+	elementStatuses.mu.RUnlock()
+	slices.SortFunc(statuses, func(a, b ElementStatus) int { return strings.Compare(a.ID, b.ID) })
+	return statuses
+}
+
+// GetElementStatus returns the status of an element. Returns false if there's
+// no element with the ID.
+func GetElementStatus(id string) (ElementStatus, bool) {
+	elementStatuses.mu.RLock()
+	s, ok := elementStatuses.items[id]
+	elementStatuses.mu.RUnlock()
+	if !ok {
+		return ElementStatus{}, false
+	}
+	return s.status(id), true
+}
+
+// StatusTracker wraps a resolver and records the results of queries in the
+// status of the element, served by the admin listener. It also adds the
+// element to the path of responses, for elements that need to know where a
+// response came from.
+type StatusTracker struct {
+	resolver Resolver
+	status   *elementStatus
+}
+
+var _ Resolver = &StatusTracker{}
+
+// NewStatusTracker returns a resolver that records the status of the given
+// resolver.
+func NewStatusTracker(resolver Resolver) *StatusTracker {
+	return &StatusTracker{
+		resolver: resolver,
+		status:   elementStatuses.get(resolver.String()),
+	}
+}
+
+// Resolve passes the query to the resolver and records if it failed.
+func (r *StatusTracker) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	r.status.query(err)
+	if err == nil && a != nil {
+		recordResponsePath(ci, r.resolver.String())
+	}
+	return a, err
+}
+
+// String returns the ID of the wrapped resolver.
+func (r *StatusTracker) String() string {
+	return r.resolver.String()
+}
+
+// Elements a response passed through, recorded for the element that added it
+// to the metadata of the query.
+type responsePath struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+type responsePathKey struct{}
+
+// Adds an element to the path of a response, if an element up the pipeline
+// asked for it.
+func recordResponsePath(ci ClientInfo, id string) {
+	if p, ok := ci.Value(responsePathKey{}).(*responsePath); ok {
+		p.mu.Lock()
+		p.ids = append(p.ids, id)
+		p.mu.Unlock()
+	}
+}
+
+// Returns true if the response passed through any of the elements.
+func (p *responsePath) contains(ids ...string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		if slices.Contains(p.ids, id) {
+			return true
+		}
+	}
+	return false
+}
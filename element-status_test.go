@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusTracker(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	upstream := new(TestResolver)
+	r := NewStatusTracker(namedTestResolver{upstream, "test-status"})
+
+	// Known before the first query
+	_, ok := GetElementStatus("test-status")
+	require.True(t, ok)
+
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	status, _ := GetElementStatus("test-status")
+	require.True(t, status.Healthy)
+	require.NotNil(t, status.LastSuccess)
+
+	// A failed query makes it unhealthy until the next successful one
+	upstream.SetFail(true)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	status, _ = GetElementStatus("test-status")
+	require.False(t, status.Healthy)
+	require.Equal(t, "failed", status.LastErrorMessage)
+
+	upstream.SetFail(false)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	status, _ = GetElementStatus("test-status")
+	require.True(t, status.Healthy)
+
+	// Failed reloads and connections make it unhealthy as well
+	statusReload("test-status", errors.New("not found"))
+	status, _ = GetElementStatus("test-status")
+	require.False(t, status.Healthy)
+	require.Equal(t, "not found", status.LastReloadError)
+
+	statusReload("test-status", nil)
+	statusConnection("test-status", ConnectionFailed, errors.New("refused"))
+	status, _ = GetElementStatus("test-status")
+	require.False(t, status.Healthy)
+	require.Equal(t, ConnectionFailed, status.Connection)
+
+	statusConnection("test-status", ConnectionOpen, nil)
+	status, _ = GetElementStatus("test-status")
+	require.True(t, status.Healthy)
+
+	_, ok = GetElementStatus("test-unknown")
+	require.False(t, ok)
+}
+
+func TestRetainElementStatuses(t *testing.T) {
+	statusReload("test-retain-kept", nil)
+	statusReload("test-retain-removed", nil)
+
+	RetainElementStatuses([]string{"test-retain-kept"})
+
+	status, ok := GetElementStatus("test-retain-kept")
+	require.True(t, ok)
+	require.NotNil(t, status.LastReload)
+	_, ok = GetElementStatus("test-retain-removed")
+	require.False(t, ok)
+}
@@ -1,11 +1,43 @@
 package rdns
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
 
 	"github.com/miekg/dns"
 )
 
+// Errors that can be returned by resolvers, groups and modifiers. Use errors.Is
+// to check for them since they are typically wrapped in one of the error types
+// below which carry more details.
+var (
+	// ErrTimeout indicates that no response was received from an upstream
+	// resolver in time.
+	ErrTimeout = errors.New("query timed out")
+
+	// ErrUpstreamUnreachable indicates that a query could not be sent to, or
+	// a response not be read from an upstream resolver.
+	ErrUpstreamUnreachable = errors.New("upstream resolver unreachable")
+
+	// ErrBlocked indicates that a query was rejected by a blocklist.
+	ErrBlocked = errors.New("query blocked")
+
+	// ErrRateLimited indicates that a query was rejected because the client
+	// exceeded the configured query rate.
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrCircuitOpen indicates that a query wasn't sent to a resolver since
+	// it failed repeatedly and its circuit breaker is open.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	// ErrQPSExceeded indicates that a query wasn't sent to an upstream
+	// resolver since it would have exceeded the resolver's query rate limit.
+	ErrQPSExceeded = errors.New("upstream query rate exceeded")
+)
+
 // QueryTimeoutError is returned when a query times out.
 type QueryTimeoutError struct {
 	query *dns.Msg
@@ -14,3 +46,95 @@ type QueryTimeoutError struct {
 func (e QueryTimeoutError) Error() string {
 	return fmt.Sprintf("query for '%s' timed out", qName(e.query))
 }
+
+// Is allows matching a QueryTimeoutError with ErrTimeout.
+func (e QueryTimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// UpstreamError is returned by resolvers when communication with an upstream
+// resolver failed. It matches ErrTimeout if the underlying error was a timeout
+// and ErrUpstreamUnreachable otherwise.
+type UpstreamError struct {
+	Resolver string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream '%s': %s", e.Resolver, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows matching an UpstreamError with ErrTimeout or ErrUpstreamUnreachable.
+func (e *UpstreamError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return isTimeout(e.Err)
+	case ErrUpstreamUnreachable:
+		return !isTimeout(e.Err)
+	}
+	return false
+}
+
+// BlockedError is returned when a query is rejected by a blocklist without
+// a response. It matches ErrBlocked.
+type BlockedError struct {
+	List string // Name of the list that matched
+	Rule string // Rule in the list that matched
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("blocked by rule '%s' in list '%s'", e.Rule, e.List)
+}
+
+// Is allows matching a BlockedError with ErrBlocked.
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Wraps an error from an upstream resolver in an UpstreamError unless it
+// already is one.
+func upstreamError(resolver string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		return err
+	}
+	return &UpstreamError{Resolver: resolver, Err: err}
+}
+
+// Returns true if the error indicates a timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Returns true if a resolver group should try another resolver after receiving
+// this error. Policy decisions like blocks or rate-limits would not be different
+// when using another resolver and are returned as they are.
+func isFailoverError(err error) bool {
+	return err != nil && !isPolicyError(err)
+}
+
+// Returns true if the error is the result of a policy decision rather than a
+// failure.
+func isPolicyError(err error) bool {
+	return errors.Is(err, ErrBlocked) || errors.Is(err, ErrRateLimited)
+}
+
+// Builds the response a listener sends for a policy error. Blocked queries are
+// refused while rate-limited queries are dropped (nil response).
+func policyResponse(q *dns.Msg, err error) *dns.Msg {
+	if errors.Is(err, ErrBlocked) {
+		return refused(q)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamError(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Timeouts from the pipeline or the network match ErrTimeout
+	for _, err := range []error{QueryTimeoutError{q}, os.ErrDeadlineExceeded} {
+		err = upstreamError("test", err)
+		require.ErrorIs(t, err, ErrTimeout)
+		require.NotErrorIs(t, err, ErrUpstreamUnreachable)
+	}
+
+	// Other errors are considered unreachable
+	err := upstreamError("test", errors.New("connection refused"))
+	require.ErrorIs(t, err, ErrUpstreamUnreachable)
+	require.NotErrorIs(t, err, ErrTimeout)
+	var upErr *UpstreamError
+	require.ErrorAs(t, err, &upErr)
+	require.Equal(t, "test", upErr.Resolver)
+
+	// Already wrapped errors are not wrapped again
+	require.Equal(t, err, upstreamError("other", err))
+	require.NoError(t, upstreamError("test", nil))
+}
+
+func TestPolicyError(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	err := &BlockedError{List: "list", Rule: "example.com"}
+	require.ErrorIs(t, err, ErrBlocked)
+	require.False(t, isFailoverError(err))
+	require.Equal(t, dns.RcodeRefused, policyResponse(q, err).Rcode)
+
+	require.False(t, isFailoverError(ErrRateLimited))
+	require.Nil(t, policyResponse(q, ErrRateLimited))
+
+	require.True(t, isFailoverError(upstreamError("test", errors.New("failed"))))
+}
@@ -1,7 +1,6 @@
 package rdns
 
 import (
-	"expvar"
 	"sync"
 	"time"
 
@@ -23,8 +22,11 @@ type FailBack struct {
 	mu        sync.RWMutex
 	failCh    chan struct{} // signal the timer to reset on failure
 	active    int
+	lastFail  time.Time
 	opt       FailBackOptions
 	metrics   *FailRouterMetrics
+	done      chan struct{} // stops the reset timer
+	closeOnce sync.Once
 }
 
 // FailBackOptions contain group-specific options.
@@ -36,26 +38,30 @@ type FailBackOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Source of time for the reset timer. Defaults to the system clock.
+	Clock Clock
 }
 
 var _ Resolver = &FailBack{}
+var _ HAStateGroup = &FailBack{}
 
 type FailRouterMetrics struct {
 	RouterMetrics
 	// Failover count
-	failover *expvar.Int
+	failover *Counter
 }
 
 func NewFailRouterMetrics(id string, available int) *FailRouterMetrics {
-	avail := getVarInt("router", id, "available")
+	avail := getGauge("router", id, "available")
 	avail.Set(int64(available))
 	return &FailRouterMetrics{
 		RouterMetrics: RouterMetrics{
-			route:     getVarMap("router", id, "route"),
-			failure:   getVarMap("router", id, "failure"),
+			route:     getCounterMap("router", id, "route", "resolver"),
+			failure:   getCounterMap("router", id, "failure", "resolver"),
 			available: avail,
 		},
-		failover: getVarInt("router", id, "failover"),
+		failover: getCounter("router", id, "failover"),
 	}
 }
 
@@ -64,11 +70,13 @@ func NewFailBack(id string, opt FailBackOptions, resolvers ...Resolver) *FailBac
 	if opt.ResetAfter == 0 {
 		opt.ResetAfter = time.Minute
 	}
+	opt.Clock = clockOrDefault(opt.Clock)
 	return &FailBack{
 		id:        id,
 		resolvers: resolvers,
 		opt:       opt,
 		metrics:   NewFailRouterMetrics(id, len(resolvers)),
+		done:      make(chan struct{}),
 	}
 }
 
@@ -82,12 +90,21 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	)
 	for i := 0; i < len(r.resolvers); i++ {
 		resolver, active := r.current()
+		// Skip resolvers that failed their health check, unless they all did
+		if upstreamDown(resolver) && !allUpstreamsDown(r.resolvers) {
+			log.With("resolver", resolver.String()).Debug("skipping resolver that is down")
+			r.errorFrom(active)
+			continue
+		}
 		log.With("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
 		a, err = resolver.Resolve(q, ci)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
+		if err != nil && !isFailoverError(err) { // Policy errors are the same with every resolver
+			return a, err
+		}
 		log.With("resolver", resolver.String()).Debug("resolver returned failure",
 			"error", err)
 		r.metrics.failure.Add(resolver.String(), 1)
@@ -101,6 +118,12 @@ func (r *FailBack) String() string {
 	return r.id
 }
 
+// Close stops the reset timer.
+func (r *FailBack) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return nil
+}
+
 // Thread-safe method to return the currently active resolver.
 func (r *FailBack) current() (Resolver, int) {
 	r.mu.RLock()
@@ -108,6 +131,43 @@ func (r *FailBack) current() (Resolver, int) {
 	return r.resolvers[r.active], r.active
 }
 
+// ActiveResolver returns the index of the currently active resolver.
+func (r *FailBack) ActiveResolver() int {
+	_, active := r.current()
+	return active
+}
+
+// SetActiveResolver makes the resolver with index i active, as if the ones
+// before it had failed. The reset timer is started if it's not the first one.
+// Invalid indexes are ignored.
+func (r *FailBack) SetActiveResolver(i int) {
+	r.mu.Lock()
+	if i < 0 || i >= len(r.resolvers) || i == r.active {
+		r.mu.Unlock()
+		return
+	}
+	switch {
+	case r.active == 0:
+		r.metrics.available.Add(-1)
+	case i == 0:
+		r.metrics.available.Add(1)
+	}
+	r.active = i
+	if i == 0 {
+		r.mu.Unlock()
+		return
+	}
+	if r.failCh == nil {
+		r.failCh = r.startResetTimer()
+	}
+	r.lastFail = r.opt.Clock.Now()
+	r.mu.Unlock()
+	select {
+	case r.failCh <- struct{}{}:
+	default:
+	}
+}
+
 // Fail over to the next available resolver after receiving an error from i (the active). We
 // need i to know which store returned the error as there could be failures from concurrent
 // requests. Another request could have initiated the failover already. So ignore if i is not
@@ -122,35 +182,54 @@ func (r *FailBack) errorFrom(i int) {
 		r.failCh = r.startResetTimer()
 	}
 	r.active = (r.active + 1) % len(r.resolvers)
+	r.lastFail = r.opt.Clock.Now()
 	Log.Debug("failing over to resolver", slog.Group("details", slog.String("id", r.id), slog.String("resolver", r.resolvers[r.active].String())))
+	failed, active := r.resolvers[i], r.resolvers[r.active]
 	r.mu.Unlock()
 	r.metrics.failover.Add(1)
 	r.metrics.available.Add(-1)
-	r.failCh <- struct{}{} // signal the timer to wait some more before switching back
+	notifyFailover(r.id, failed, active)
+
+	// Signal the timer to wait some more before switching back. It's enough
+	// to have one signal pending since the timer reads the time of the last
+	// failure anyway.
+	select {
+	case r.failCh <- struct{}{}:
+	default:
+	}
 }
 
-// Set active=0 regularly after the reset timer has expired without further failures. Any failure,
-// as signalled by the channel resets the timer again.
+// Set active=0 after the reset timer has expired without further failures. Any failure,
+// as signalled by the channel, starts the timer again if it isn't already running and
+// failures while it's running extend the time.
 func (r *FailBack) startResetTimer() chan struct{} {
 	failCh := make(chan struct{}, 1)
 	go func() {
-		timer := time.NewTimer(r.opt.ResetAfter)
 		for {
 			select {
 			case <-failCh:
-				if !timer.Stop() {
-					<-timer.C
-				}
-			case <-timer.C:
+			case <-r.done:
+				return
+			}
+			for {
 				r.mu.Lock()
-				r.active = 0
-				Log.Debug("failing back to resolver", slog.Group("details", slog.String("resolver", r.resolvers[r.active].String())))
+				wait := r.lastFail.Add(r.opt.ResetAfter).Sub(r.opt.Clock.Now())
+				// Wait for the first resolver to pass its health check again
+				if wait <= 0 && r.active != 0 && upstreamDown(r.resolvers[0]) {
+					r.lastFail = r.opt.Clock.Now()
+					wait = r.opt.ResetAfter
+				}
+				if wait <= 0 && r.active != 0 {
+					r.active = 0
+					Log.Debug("failing back to resolver", slog.Group("details", slog.String("resolver", r.resolvers[r.active].String())))
+					r.metrics.available.Add(1)
+				}
 				r.mu.Unlock()
-				r.metrics.available.Add(1)
-				// we just reset to the first resolver, let's wait for another failure before running again
-				<-failCh
+				if wait <= 0 {
+					break
+				}
+				r.opt.Clock.Sleep(wait)
 			}
-			timer.Reset(r.opt.ResetAfter)
 		}
 	}()
 	return failCh
@@ -14,7 +14,8 @@ func TestFailBack(t *testing.T) {
 	r1 := new(TestResolver)
 	r2 := new(TestResolver)
 
-	g := NewFailBack("test-fb", FailBackOptions{ResetAfter: time.Second}, r1, r2)
+	clock := NewFakeClock(time.Now())
+	g := NewFailBack("test-fb", FailBackOptions{ResetAfter: time.Second, Clock: clock}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
@@ -37,7 +38,12 @@ func TestFailBack(t *testing.T) {
 
 	// Fix the 1st resolver and wait a second
 	r1.SetFail(false)
-	time.Sleep(time.Second + 100*time.Millisecond)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	require.Eventually(t, func() bool {
+		_, active := g.current()
+		return active == 0
+	}, time.Second, time.Millisecond)
 
 	// It should have been reset and the first should be active again now
 	_, err = g.Resolve(q, ci)
@@ -130,3 +136,23 @@ func TestFailBackServfailOKOption(t *testing.T) {
 	require.NotEqual(t, dns.RcodeServerFailure, a.Rcode)
 	require.Equal(t, 1, goodResolver.hitCount)
 }
+
+func TestFailBackPolicyError(t *testing.T) {
+	var ci ClientInfo
+	r1 := &TestResolver{
+		ResolveFunc: func(*dns.Msg, ClientInfo) (*dns.Msg, error) {
+			return nil, ErrRateLimited
+		},
+	}
+	r2 := new(TestResolver)
+
+	g := NewFailBack("test-fb", FailBackOptions{}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// A policy error should be returned as is without failing over
+	_, err := g.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 0, r2.HitCount())
+}
@@ -30,6 +30,7 @@ type FailRotateOptions struct {
 }
 
 var _ Resolver = &FailRotate{}
+var _ HAStateGroup = &FailRotate{}
 
 // NewFailRotate returns a new instance of a failover resolver group.
 func NewFailRotate(id string, opt FailRotateOptions, resolvers ...Resolver) *FailRotate {
@@ -51,12 +52,21 @@ func (r *FailRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	)
 	for i := 0; i < len(r.resolvers); i++ {
 		resolver, active := r.current()
+		// Skip resolvers that failed their health check, unless they all did
+		if upstreamDown(resolver) && !allUpstreamsDown(r.resolvers) {
+			log.With("resolver", resolver.String()).Debug("skipping resolver that is down")
+			r.errorFrom(active)
+			continue
+		}
 		log.With("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
 		a, err = resolver.Resolve(q, ci)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
+		if err != nil && !isFailoverError(err) { // Policy errors are the same with every resolver
+			return a, err
+		}
 		log.With("resolver", resolver.String()).Debug("resolver returned failure",
 			"error", err)
 		r.metrics.failure.Add(resolver.String(), 1)
@@ -77,6 +87,23 @@ func (r *FailRotate) current() (Resolver, int) {
 	return r.resolvers[r.active], r.active
 }
 
+// ActiveResolver returns the index of the currently active resolver.
+func (r *FailRotate) ActiveResolver() int {
+	_, active := r.current()
+	return active
+}
+
+// SetActiveResolver makes the resolver with index i active. Invalid indexes
+// are ignored.
+func (r *FailRotate) SetActiveResolver(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i < 0 || i >= len(r.resolvers) {
+		return
+	}
+	r.active = i
+}
+
 // Fail over to the next available resolver after receiving an error from i (the active). We
 // need i to know which store returned the error as there could be failures from concurrent
 // requests. Another request could have initiated the failover already. So ignore if i is not
@@ -90,6 +117,7 @@ func (r *FailRotate) errorFrom(i int) {
 	r.metrics.failover.Add(1)
 	r.active = (r.active + 1) % len(r.resolvers)
 	Log.Debug("failing over to resolver", slog.Group("details", slog.String("id", r.id), slog.String("resolver", r.resolvers[r.active].String())))
+	notifyFailover(r.id, r.resolvers[i], r.resolvers[r.active])
 }
 
 // Returns true is the response is considered successful given the options.
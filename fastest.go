@@ -53,6 +53,9 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			log.With("resolver", resolver.String()).Debug("using response from resolver")
 			return a, err
 		}
+		if err != nil && !isFailoverError(err) { // Policy errors are the same with every resolver
+			return a, err
+		}
 		log.With("resolver", resolver.String()).Debug("resolver returned failure, waiting for next response",
 			"error", err)
 
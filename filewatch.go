@@ -0,0 +1,18 @@
+package rdns
+
+import "time"
+
+// Time to wait after the last change of a watched file before calling the
+// handler. Editors and tools often write files in several steps.
+const fileChangeDelay = 500 * time.Millisecond
+
+// Calls f whenever one of the files changes, until the returned function is
+// called.
+func onFileChange(files []string, f func()) (stop func(), err error) {
+	events, stop, err := fileEvents(files)
+	if err != nil {
+		return nil, err
+	}
+	go watchNetworkChanges(events, fileChangeDelay, f)
+	return stop, nil
+}
@@ -0,0 +1,63 @@
+package rdns
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns a channel that receives an event whenever something changes in the
+// directories of the files. The directories are watched with inotify rather
+// than the files themselves since files are often replaced by renaming a new
+// one over them, or by swapping symlinks like in Kubernetes volumes. Files
+// that are directories are watched themselves as well, to pick up changes of
+// the files in them. The channel is closed once stop is called.
+func fileEvents(files []string) (events <-chan struct{}, stop func(), err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("inotify_init1", err)
+	}
+	dirs := make(map[string]struct{})
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = struct{}{}
+		if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+			dirs[file] = struct{}{}
+		}
+	}
+	for dir := range dirs {
+		mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO)
+		if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+			unix.Close(fd)
+			return nil, nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+	}
+	// Reads from the non-blocking descriptor go through the runtime poller,
+	// so they return once the file is closed
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		b := make([]byte, 64*1024)
+		for {
+			if _, err := f.Read(b); err != nil {
+				if errors.Is(err, os.ErrClosed) {
+					return
+				}
+				if errors.Is(err, unix.EINTR) {
+					continue
+				}
+				Log.Error("failed to read from inotify", "error", err)
+				f.Close()
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default: // an event is already pending
+			}
+		}
+	}()
+	return ch, func() { f.Close() }, nil
+}
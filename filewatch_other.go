@@ -0,0 +1,79 @@
+//go:build !linux
+
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Interval at which files are checked for changes on platforms without a
+// notification mechanism.
+const filePollInterval = 5 * time.Second
+
+// Returns a channel that receives an event whenever one of the files changes.
+// Polls the modification time and size of the files regularly. For
+// directories, those of the files in them are compared as well. The channel
+// is closed once stop is called.
+func fileEvents(files []string) (events <-chan struct{}, stop func(), err error) {
+	prev := fileStates(files)
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(filePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			states := fileStates(files)
+			if slices.Equal(states, prev) {
+				continue
+			}
+			prev = states
+			select {
+			case ch <- struct{}{}:
+			default: // an event is already pending
+			}
+		}
+	}()
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(done) }) }, nil
+}
+
+type fileState struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// Returns the modification time and size of the files, zero for files that
+// don't exist. Directories are followed by the files in them.
+func fileStates(files []string) []fileState {
+	states := make([]fileState, 0, len(files))
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			states = append(states, fileState{name: file})
+			continue
+		}
+		states = append(states, fileState{file, fi.ModTime(), fi.Size()})
+		if !fi.IsDir() {
+			continue
+		}
+		entries, _ := os.ReadDir(file)
+		for _, entry := range entries {
+			name := filepath.Join(file, entry.Name())
+			if fi, err := os.Stat(name); err == nil {
+				states = append(states, fileState{name, fi.ModTime(), fi.Size()})
+			}
+		}
+	}
+	return states
+}
@@ -0,0 +1,26 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileEventsStop(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(file, []byte("127.0.0.1 localhost\n"), 0o644))
+	events, stop, err := fileEvents([]string{file})
+	require.NoError(t, err)
+	stop()
+	select {
+	case _, ok := <-events:
+		for ok {
+			_, ok = <-events
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed after stop")
+	}
+}
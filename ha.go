@@ -0,0 +1,329 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Roles of instances in an active-standby pair.
+const (
+	// The instance runs its listeners from the start.
+	HARoleActive = "active"
+
+	// The instance monitors the active one and only runs its listeners
+	// while the active one is down.
+	HARoleStandby = "standby"
+)
+
+// HACoordinator runs the listeners of one of two RouteDNS instances that
+// share a virtual identity, like a virtual IP moved by a hook script. The
+// active instance serves queries and publishes the state of its failover
+// groups to a shared store. The standby monitors the health endpoint of
+// the active instance, and takes over when that fails repeatedly, with
+// the state last published by the active instance. It hands back once the
+// active instance is healthy again.
+type HACoordinator struct {
+	id      string
+	opt     HACoordinatorOptions
+	client  *http.Client
+	metrics *HACoordinatorMetrics
+
+	mu      sync.Mutex
+	active  bool
+	stopped chan struct{} // Closed when the listeners are stopped
+}
+
+// HACoordinatorOptions contain settings for the coordination of an
+// active-standby pair.
+type HACoordinatorOptions struct {
+	// Role of this instance, HARoleActive or HARoleStandby.
+	Role string
+
+	// URL of the health endpoint of the active instance, used by the
+	// standby. Responses with a 2xx status are healthy, like those of the
+	// /routedns/status?id=<id> endpoint of the admin listener.
+	PeerURL string
+
+	// TLS settings to connect to the health endpoint.
+	TLSConfig *tls.Config
+
+	// Time between health checks, and between publishing the state.
+	// Defaults to 2 seconds.
+	Interval time.Duration
+
+	// Number of consecutive failed checks before the standby takes over,
+	// and of successful checks before it hands back. Defaults to 3.
+	Failures int
+
+	// Listeners started by the active instance, and by the standby while
+	// it has taken over.
+	Listeners []StoppableListener
+
+	// Commands run when the instance becomes active or standby, for
+	// example to move a virtual IP. The new role is passed in the
+	// environment variable ROUTEDNS_HA_ROLE. Optional.
+	OnActive  []string
+	OnStandby []string
+
+	// Store the state of the groups is handed over with. Optional.
+	StateStore HAStateStore
+
+	// Groups with state to hand over, by ID.
+	Groups map[string]HAStateGroup
+
+	// Source of time for checks. Defaults to the system clock.
+	Clock Clock
+}
+
+// HAStateGroup is implemented by groups with state that a standby instance
+// takes over, like the active resolver of failover groups.
+type HAStateGroup interface {
+	// ActiveResolver returns the index of the active resolver.
+	ActiveResolver() int
+
+	// SetActiveResolver makes the resolver with the index active.
+	SetActiveResolver(i int)
+}
+
+// HAStateStore persists the state of groups, typically in a store shared
+// by both instances such as Redis.
+type HAStateStore interface {
+	// SaveHAState stores the active resolver of groups by ID.
+	SaveHAState(state map[string]int) error
+
+	// LoadHAState returns the last stored state.
+	LoadHAState() (map[string]int, error)
+}
+
+type HACoordinatorMetrics struct {
+	// 1 while this instance runs its listeners.
+	active *Gauge
+	// Number of times the standby took over.
+	takeover *Counter
+	// Failed health checks of the peer.
+	peerFailure *Counter
+	// Failures to publish or load the state.
+	stateErr *Counter
+}
+
+// Time a hook command may run for.
+const haHookTimeout = 30 * time.Second
+
+// NewHACoordinator returns a coordinator for the listeners of an instance in
+// an active-standby pair. Call Run to start it.
+func NewHACoordinator(id string, opt HACoordinatorOptions) (*HACoordinator, error) {
+	switch opt.Role {
+	case HARoleActive:
+	case HARoleStandby:
+		if opt.PeerURL == "" {
+			return nil, errors.New("standby requires the url of the active instance")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ha role '%s'", opt.Role)
+	}
+	if opt.Interval == 0 {
+		opt.Interval = 2 * time.Second
+	}
+	if opt.Failures == 0 {
+		opt.Failures = 3
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	return &HACoordinator{
+		id:  id,
+		opt: opt,
+		client: &http.Client{
+			Timeout: opt.Interval,
+			Transport: &http.Transport{
+				TLSClientConfig: opt.TLSConfig,
+			},
+		},
+		metrics: &HACoordinatorMetrics{
+			active:      getGauge("ha", id, "active"),
+			takeover:    getCounter("ha", id, "takeover"),
+			peerFailure: getCounter("ha", id, "peer-failure"),
+			stateErr:    getCounter("ha", id, "state-error"),
+		},
+	}, nil
+}
+
+// Run starts the listeners of the active instance and publishes its state,
+// or monitors the active instance if this is the standby. Doesn't return.
+func (c *HACoordinator) Run() {
+	if c.opt.Role == HARoleActive {
+		c.activate()
+		for {
+			c.saveState()
+			c.opt.Clock.Sleep(c.opt.Interval)
+		}
+	}
+	c.runHook(c.opt.OnStandby, HARoleStandby)
+	var failures, successes int
+	for {
+		err := c.checkPeer()
+		if err != nil {
+			c.metrics.peerFailure.Add(1)
+			failures, successes = failures+1, 0
+			Log.Debug("health check of active instance failed", "id", c.id, "error", err)
+		} else {
+			failures, successes = 0, successes+1
+		}
+		switch {
+		case !c.isActive() && failures == c.opt.Failures:
+			Log.Warn("active instance is down, taking over", "id", c.id, "error", err)
+			c.metrics.takeover.Add(1)
+			c.loadState()
+			c.activate()
+		case c.isActive() && successes == c.opt.Failures:
+			Log.Info("active instance is up again, handing back", "id", c.id)
+			c.deactivate()
+		}
+		c.opt.Clock.Sleep(c.opt.Interval)
+	}
+}
+
+func (c *HACoordinator) String() string {
+	return c.id
+}
+
+// SetGroups replaces the groups with state to hand over, for example after
+// the configuration was reloaded.
+func (c *HACoordinator) SetGroups(groups map[string]HAStateGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opt.Groups = groups
+}
+
+func (c *HACoordinator) groups() map[string]HAStateGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opt.Groups
+}
+
+func (c *HACoordinator) isActive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// Starts the listeners and runs the hook for the active role. Listeners that
+// fail are restarted until they're stopped.
+func (c *HACoordinator) activate() {
+	c.mu.Lock()
+	c.active = true
+	stopped := make(chan struct{})
+	c.stopped = stopped
+	c.mu.Unlock()
+	for _, l := range c.opt.Listeners {
+		go func(l StoppableListener) {
+			for {
+				err := l.Start()
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				Log.Error("listener failed", "id", l.String(), "error", err)
+				time.Sleep(time.Second)
+			}
+		}(l)
+	}
+	c.metrics.active.Set(1)
+	c.notify(HARoleActive)
+	c.runHook(c.opt.OnActive, HARoleActive)
+}
+
+// Stops the listeners and runs the hook for the standby role.
+func (c *HACoordinator) deactivate() {
+	c.mu.Lock()
+	c.active = false
+	close(c.stopped)
+	c.mu.Unlock()
+	for _, l := range c.opt.Listeners {
+		if err := l.Stop(); err != nil {
+			Log.Error("failed to stop listener", "id", l.String(), "error", err)
+		}
+	}
+	c.metrics.active.Set(0)
+	c.notify(HARoleStandby)
+	c.runHook(c.opt.OnStandby, HARoleStandby)
+}
+
+// Returns an error if the health endpoint of the peer doesn't respond with
+// a 2xx status.
+func (c *HACoordinator) checkPeer() error {
+	resp, err := c.client.Get(c.opt.PeerURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Publishes the active resolver of all groups.
+func (c *HACoordinator) saveState() {
+	groups := c.groups()
+	if c.opt.StateStore == nil || len(groups) == 0 {
+		return
+	}
+	state := make(map[string]int, len(groups))
+	for id, g := range groups {
+		state[id] = g.ActiveResolver()
+	}
+	if err := c.opt.StateStore.SaveHAState(state); err != nil {
+		c.metrics.stateErr.Add(1)
+		Log.Error("failed to save ha state", "id", c.id, "error", err)
+	}
+}
+
+// Applies the state last published by the active instance to the groups.
+func (c *HACoordinator) loadState() {
+	groups := c.groups()
+	if c.opt.StateStore == nil || len(groups) == 0 {
+		return
+	}
+	state, err := c.opt.StateStore.LoadHAState()
+	if err != nil {
+		c.metrics.stateErr.Add(1)
+		Log.Error("failed to load ha state", "id", c.id, "error", err)
+		return
+	}
+	for id, active := range state {
+		if g, ok := groups[id]; ok {
+			g.SetActiveResolver(active)
+		}
+	}
+}
+
+// Runs a hook command, if any, and logs its output if it fails.
+func (c *HACoordinator) runHook(command []string, role string) {
+	if len(command) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), haHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "ROUTEDNS_HA_ROLE="+role)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		Log.Error("ha hook failed", "id", c.id, "role", role, "error", err, "output", string(out))
+	}
+}
+
+// Sends an event for a change of the role.
+func (c *HACoordinator) notify(role string) {
+	Notify(Event{
+		Type:    EventHARoleChanged,
+		ID:      c.id,
+		Message: fmt.Sprintf("instance is now %s", role),
+		Details: map[string]string{"role": role},
+	})
+}
@@ -0,0 +1,144 @@
+package rdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Listener that runs until it's stopped.
+type testHAListener struct {
+	mu      sync.Mutex
+	running bool
+	stop    chan struct{}
+}
+
+func (l *testHAListener) Start() error {
+	l.mu.Lock()
+	l.running = true
+	l.stop = make(chan struct{})
+	stop := l.stop
+	l.mu.Unlock()
+	<-stop
+	return nil
+}
+
+func (l *testHAListener) Stop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+	close(l.stop)
+	return nil
+}
+
+func (l *testHAListener) String() string { return "test-listener" }
+
+func (l *testHAListener) isRunning() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running
+}
+
+type testHAStateStore struct {
+	mu    sync.Mutex
+	state map[string]int
+}
+
+func (s *testHAStateStore) SaveHAState(state map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *testHAStateStore) LoadHAState() (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, nil
+}
+
+func TestHACoordinatorStandby(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer peer.Close()
+
+	listener := new(testHAListener)
+	group := NewFailRotate("test-ha-group", FailRotateOptions{}, new(TestResolver), new(TestResolver))
+	store := &testHAStateStore{state: map[string]int{"test-ha-group": 1}}
+	clock := NewFakeClock(time.Now())
+	c, err := NewHACoordinator("test-ha", HACoordinatorOptions{
+		Role:       HARoleStandby,
+		PeerURL:    peer.URL,
+		Interval:   time.Second,
+		Failures:   2,
+		Listeners:  []StoppableListener{listener},
+		StateStore: store,
+		Groups:     map[string]HAStateGroup{"test-ha-group": group},
+		Clock:      clock,
+	})
+	require.NoError(t, err)
+	go c.Run()
+
+	// Nothing happens while the active instance is healthy
+	clock.BlockUntil(1)
+	require.False(t, c.isActive())
+
+	// Take over after 2 failed checks, with the state of the active instance
+	healthy.Store(false)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	require.False(t, c.isActive())
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	require.True(t, c.isActive())
+	require.Equal(t, 1, group.ActiveResolver())
+	require.Eventually(t, listener.isRunning, time.Second, time.Millisecond)
+
+	// Hand back after 2 successful checks
+	healthy.Store(true)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	require.True(t, c.isActive())
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	require.False(t, c.isActive())
+	require.False(t, listener.isRunning())
+}
+
+func TestHACoordinatorActive(t *testing.T) {
+	listener := new(testHAListener)
+	group := NewFailRotate("test-ha-active-group", FailRotateOptions{}, new(TestResolver), new(TestResolver))
+	group.SetActiveResolver(1)
+	store := new(testHAStateStore)
+	clock := NewFakeClock(time.Now())
+	c, err := NewHACoordinator("test-ha-active", HACoordinatorOptions{
+		Role:       HARoleActive,
+		Listeners:  []StoppableListener{listener},
+		StateStore: store,
+		Groups:     map[string]HAStateGroup{"test-ha-active-group": group},
+		Clock:      clock,
+	})
+	require.NoError(t, err)
+	go c.Run()
+
+	// The active instance runs its listeners and publishes its state
+	clock.BlockUntil(1)
+	require.Eventually(t, listener.isRunning, time.Second, time.Millisecond)
+	state, err := store.LoadHAState()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"test-ha-active-group": 1}, state)
+
+	// A standby requires the address of the active instance
+	_, err = NewHACoordinator("test-ha-invalid", HACoordinatorOptions{Role: HARoleStandby})
+	require.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Time to wait for a connection attempt before starting the next one in
+// parallel, as recommended in RFC8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Looks up all addresses of the host in addr and returns them with the port,
+// alternating between IPv6 and IPv4, starting with IPv6 as per RFC8305. Uses
+// the system's resolver if r is nil.
+func happyEyeballsAddrs(ctx context.Context, r *net.Resolver, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var ip4, ip6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for i := 0; i < len(ip4) || i < len(ip6); i++ {
+		if i < len(ip6) {
+			addrs = append(addrs, net.JoinHostPort(ip6[i].String(), port))
+		}
+		if i < len(ip4) {
+			addrs = append(addrs, net.JoinHostPort(ip4[i].String(), port))
+		}
+	}
+	return addrs, nil
+}
+
+// Races connection attempts to the addresses and returns the first one that
+// is established. Attempts are started in order, the next one when the
+// previous one failed or after happyEyeballsDelay. Connections established
+// after the first one are closed.
+func happyEyeballsDial[T any](ctx context.Context, addrs []string, dial func(context.Context, string) (T, error), closeConn func(T)) (T, error) {
+	var zero T
+	if len(addrs) == 0 {
+		return zero, errors.New("no addresses to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn T
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	pending := 0
+	next := func() {
+		if len(addrs) == 0 {
+			return
+		}
+		addr := addrs[0]
+		addrs = addrs[1:]
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, err}
+		}()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(happyEyeballsDelay)
+	}
+	next()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections that are established after this one
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.err == nil {
+							closeConn(res.conn)
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			next()
+		case <-timer.C:
+			next()
+		}
+	}
+	return zero, errors.Join(errs...)
+}
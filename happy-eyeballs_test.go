@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHappyEyeballsAddrs(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			var records []string
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				records = []string{"IN A 192.0.2.1", "IN A 192.0.2.2", "IN A 192.0.2.3"}
+			case dns.TypeAAAA:
+				records = []string{"IN AAAA 2001:db8::1"}
+			}
+			for _, record := range records {
+				rr, _ := dns.NewRR("example.com. 60 " + record)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	addrs, err := happyEyeballsAddrs(context.Background(), NewNetResolver(r), "example.com:443")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"[2001:db8::1]:443", "192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443"}, addrs)
+	require.Equal(t, "[2001:db8::1]:443", addrs[0])
+
+	// IP addresses aren't looked up
+	addrs, err = happyEyeballsAddrs(context.Background(), NewNetResolver(r), "192.0.2.9:443")
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.9:443"}, addrs)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	var closed []string
+	closeConn := func(addr string) { closed = append(closed, addr) }
+
+	// The first address doesn't respond, the second fails, the third is used
+	dial := func(ctx context.Context, addr string) (string, error) {
+		switch addr {
+		case "a":
+			<-ctx.Done()
+			return "", ctx.Err()
+		case "b":
+			return "", errors.New("failed")
+		}
+		return addr, nil
+	}
+	start := time.Now()
+	conn, err := happyEyeballsDial(context.Background(), []string{"a", "b", "c"}, dial, closeConn)
+	require.NoError(t, err)
+	require.Equal(t, "c", conn)
+	require.Less(t, time.Since(start), 2*happyEyeballsDelay)
+
+	// All attempts fail
+	dial = func(ctx context.Context, addr string) (string, error) {
+		return "", errors.New("failed " + addr)
+	}
+	_, err = happyEyeballsDial(context.Background(), []string{"a", "b"}, dial, closeConn)
+	require.ErrorContains(t, err, "failed a")
+	require.ErrorContains(t, err, "failed b")
+	require.Empty(t, closed)
+}
@@ -0,0 +1,154 @@
+package rdns
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// HeaderFlags is a resolver that enforces a policy on the flags in the header
+// of responses, and the CD flag in queries sent upstream. Depending on the
+// path a query takes through the configuration and the upstream resolver,
+// responses could otherwise have flags set inconsistently, for example AA on
+// responses forwarded from a recursive resolver, or AD from an upstream
+// resolver that isn't trusted.
+type HeaderFlags struct {
+	id       string
+	resolver Resolver
+	opt      HeaderFlagsOptions
+}
+
+// HeaderFlagsOptions contain the policy for the header flags.
+type HeaderFlagsOptions struct {
+	// Clear the Authoritative Answer flag in responses.
+	ClearAA bool
+
+	// Set or clear the Recursion Available flag in responses. Unchanged if
+	// empty.
+	RA HeaderFlagAction
+
+	// RA flag action by listener ID, overriding RA for queries received by
+	// those listeners.
+	RAByListener map[string]HeaderFlagAction
+
+	// Policy for the Authenticated Data flag in responses. Unchanged if
+	// empty.
+	AD HeaderFlagADPolicy
+
+	// Set or clear the Checking Disabled flag in queries sent upstream. The
+	// flag in the client's query is forwarded if empty.
+	CD HeaderFlagAction
+}
+
+// HeaderFlagAction defines what happens with a flag.
+type HeaderFlagAction string
+
+const (
+	HeaderFlagKeep  HeaderFlagAction = ""
+	HeaderFlagSet   HeaderFlagAction = "set"
+	HeaderFlagClear HeaderFlagAction = "clear"
+)
+
+// HeaderFlagADPolicy defines how the AD flag in responses is handled.
+type HeaderFlagADPolicy string
+
+const (
+	// Leave the AD flag as returned by the upstream resolver.
+	HeaderFlagADKeep HeaderFlagADPolicy = ""
+
+	// Clear the AD flag unless it was set by a validating group down the
+	// pipeline (the dnssec group), so clients only rely on validation done by
+	// RouteDNS itself and not on the AD flag of an upstream resolver.
+	HeaderFlagADStrip HeaderFlagADPolicy = "strip"
+
+	// Only keep the AD flag if the client signalled it understands it by
+	// setting AD or DO in the query, as per RFC6840 section 5.7 and 5.8.
+	HeaderFlagADClient HeaderFlagADPolicy = "client"
+)
+
+var _ Resolver = &HeaderFlags{}
+
+// NewHeaderFlags returns a new instance of a header flag modifier.
+func NewHeaderFlags(id string, resolver Resolver, opt HeaderFlagsOptions) (*HeaderFlags, error) {
+	validAction := func(a HeaderFlagAction) bool {
+		return a == HeaderFlagKeep || a == HeaderFlagSet || a == HeaderFlagClear
+	}
+	if !validAction(opt.RA) {
+		return nil, fmt.Errorf("invalid RA flag action %q", opt.RA)
+	}
+	for listener, a := range opt.RAByListener {
+		if !validAction(a) {
+			return nil, fmt.Errorf("invalid RA flag action %q for listener %q", a, listener)
+		}
+	}
+	if !validAction(opt.CD) {
+		return nil, fmt.Errorf("invalid CD flag action %q", opt.CD)
+	}
+	switch opt.AD {
+	case HeaderFlagADKeep, HeaderFlagADStrip, HeaderFlagADClient:
+	default:
+		return nil, fmt.Errorf("invalid AD flag policy %q", opt.AD)
+	}
+	return &HeaderFlags{id: id, resolver: resolver, opt: opt}, nil
+}
+
+// Resolve a DNS query and apply the flag policy to the query and response.
+func (r *HeaderFlags) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	clientCD := q.CheckingDisabled
+	clientAD := q.AuthenticatedData
+	var clientDO bool
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		clientDO = edns0.Do()
+	}
+
+	if cd, ok := applyFlag(r.opt.CD, q.CheckingDisabled); ok && cd != q.CheckingDisabled {
+		q = q.Copy()
+		q.CheckingDisabled = cd
+	}
+
+	var validated *atomic.Bool
+	if r.opt.AD == HeaderFlagADStrip {
+		ci, validated = trackLocalValidation(ci)
+	}
+
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	if r.opt.ClearAA {
+		a.Authoritative = false
+	}
+	ra := r.opt.RA
+	if action, ok := r.opt.RAByListener[ci.Listener]; ok {
+		ra = action
+	}
+	a.RecursionAvailable, _ = applyFlag(ra, a.RecursionAvailable)
+	switch r.opt.AD {
+	case HeaderFlagADStrip:
+		a.AuthenticatedData = a.AuthenticatedData && validated.Load()
+	case HeaderFlagADClient:
+		a.AuthenticatedData = a.AuthenticatedData && (clientAD || clientDO)
+	}
+
+	// The CD flag in the response is a copy of the one in the client's
+	// query, RFC4035 section 3.1.6
+	a.CheckingDisabled = clientCD
+	return a, nil
+}
+
+func (r *HeaderFlags) String() string {
+	return r.id
+}
+
+// Returns the new value of a flag and whether it was set by the action.
+func applyFlag(action HeaderFlagAction, value bool) (bool, bool) {
+	switch action {
+	case HeaderFlagSet:
+		return true, true
+	case HeaderFlagClear:
+		return false, true
+	}
+	return value, false
+}
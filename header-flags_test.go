@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderFlags(t *testing.T) {
+	var upstreamCD bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamCD = q.CheckingDisabled
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Authoritative = true
+			a.RecursionAvailable = true
+			a.AuthenticatedData = true
+			return a, nil
+		},
+	}
+	r, err := NewHeaderFlags("test-flags", upstream, HeaderFlagsOptions{
+		ClearAA:      true,
+		RAByListener: map[string]HeaderFlagAction{"local": HeaderFlagClear},
+		AD:           HeaderFlagADClient,
+		CD:           HeaderFlagSet,
+	})
+	require.NoError(t, err)
+
+	// Plain query without AD or DO
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Authoritative)
+	require.True(t, a.RecursionAvailable)
+	require.False(t, a.AuthenticatedData)
+	require.True(t, upstreamCD)
+	require.False(t, a.CheckingDisabled)
+	require.False(t, q.CheckingDisabled, "client query must not be modified")
+
+	// DO bit set, received by a listener that doesn't offer recursion
+	q.SetEdns0(4096, true)
+	a, err = r.Resolve(q, ClientInfo{Listener: "local"})
+	require.NoError(t, err)
+	require.False(t, a.RecursionAvailable)
+	require.True(t, a.AuthenticatedData)
+
+	// Invalid policy
+	_, err = NewHeaderFlags("test-flags", upstream, HeaderFlagsOptions{AD: "validate"})
+	require.Error(t, err)
+}
+
+func TestHeaderFlagsStripAD(t *testing.T) {
+	var validate bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.AuthenticatedData = true
+			if validate {
+				recordLocalValidation(ci)
+			}
+			return a, nil
+		},
+	}
+	r, err := NewHeaderFlags("test-flags", upstream, HeaderFlagsOptions{AD: HeaderFlagADStrip})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+
+	// AD from the upstream resolver is cleared
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.AuthenticatedData)
+
+	// AD set by a local validator is kept
+	validate = true
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.AuthenticatedData)
+}
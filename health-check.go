@@ -0,0 +1,247 @@
+package rdns
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthCheck passes queries to a resolver unchanged and sends probe queries
+// to it in the background to find out if it's reachable. The resolver is
+// marked down after a number of failed probes in a row, and up again after a
+// number of successful ones. Fail-rotate, fail-back and random groups don't
+// send queries to resolvers that are down, as long as other resolvers in the
+// group are up.
+type HealthCheck struct {
+	id       string
+	resolver Resolver
+	opt      HealthCheckOptions
+	metrics  *HealthCheckMetrics
+
+	down     atomic.Bool
+	failures int // Consecutive failed probes while up
+	success  int // Consecutive successful probes while down
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// HealthCheckOptions contain settings for probing a resolver.
+type HealthCheckOptions struct {
+	// Name and type of the probe query. Default ".", with type NS for the
+	// root and A for other names.
+	Name string
+	Type uint16
+
+	// Time between probes. Default 10 seconds.
+	Interval time.Duration
+
+	// Time to wait for the response to a probe. Default 2 seconds.
+	Timeout time.Duration
+
+	// Number of failed probes in a row after which the resolver is marked
+	// down. Default 3.
+	FallThreshold int
+
+	// Number of successful probes in a row after which the resolver is
+	// marked up again. Default 2.
+	RiseThreshold int
+
+	// Source of time for the probe interval. Defaults to the system clock.
+	Clock Clock
+}
+
+type HealthCheckMetrics struct {
+	// 1 if the resolver is up, 0 if it's down.
+	up *Gauge
+	// Probe results, success or failure.
+	probe *CounterMap
+	// Number of times the resolver was marked down.
+	down *Counter
+}
+
+var _ Resolver = &HealthCheck{}
+
+// Health checks by ID of the resolver, used by groups to skip resolvers that
+// are down.
+var healthChecks sync.Map
+
+var errProbeTimeout = errors.New("probe timed out")
+
+// NewHealthCheck returns a new instance of a health check and starts probing
+// the resolver.
+func NewHealthCheck(id string, resolver Resolver, opt HealthCheckOptions) *HealthCheck {
+	if opt.Name == "" {
+		opt.Name = "."
+	}
+	if opt.Type == 0 {
+		opt.Type = dns.TypeA
+		if opt.Name == "." {
+			opt.Type = dns.TypeNS
+		}
+	}
+	opt.Name = dns.Fqdn(opt.Name)
+	if opt.Interval <= 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.FallThreshold <= 0 {
+		opt.FallThreshold = 3
+	}
+	if opt.RiseThreshold <= 0 {
+		opt.RiseThreshold = 2
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	r := &HealthCheck{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		stop:     make(chan struct{}),
+		metrics: &HealthCheckMetrics{
+			up:    getGauge("client", id, "up"),
+			probe: getCounterMap("client", id, "probe", "result"),
+			down:  getCounter("client", id, "down"),
+		},
+	}
+	r.metrics.up.Set(1)
+	healthChecks.Store(id, r)
+	go r.run()
+	return r
+}
+
+// Resolve a DNS query with the resolver.
+func (r *HealthCheck) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *HealthCheck) String() string {
+	return r.id
+}
+
+// Healthy returns false if the resolver failed the probes.
+func (r *HealthCheck) Healthy() bool {
+	return !r.down.Load()
+}
+
+// Close stops probing the resolver.
+func (r *HealthCheck) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		healthChecks.CompareAndDelete(r.id, r)
+	})
+}
+
+// Sends probes until the health check is closed.
+func (r *HealthCheck) run() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		r.record(r.probe())
+		r.opt.Clock.Sleep(r.opt.Interval)
+	}
+}
+
+// Sends a probe query and returns an error if it failed.
+func (r *HealthCheck) probe() error {
+	q := new(dns.Msg)
+	q.SetQuestion(r.opt.Name, r.opt.Type)
+	type result struct {
+		a   *dns.Msg
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		a, err := r.resolver.Resolve(q, ClientInfo{})
+		resultCh <- result{a, err}
+	}()
+	var res result
+	select {
+	case res = <-resultCh:
+	case <-time.After(r.opt.Timeout):
+		return errProbeTimeout
+	}
+	if res.err != nil {
+		return res.err
+	}
+	if res.a == nil {
+		return errors.New("no response")
+	}
+	// Any response other than SERVFAIL or REFUSED means the resolver is
+	// reachable and working
+	switch res.a.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return errors.New(dns.RcodeToString[res.a.Rcode])
+	}
+	return nil
+}
+
+// Records the result of a probe and changes the state of the resolver once
+// the threshold is reached.
+func (r *HealthCheck) record(err error) {
+	log := Log.With("id", r.id)
+	if err != nil {
+		r.metrics.probe.Add("failure", 1)
+		log.Debug("probe failed", "error", err)
+	} else {
+		r.metrics.probe.Add("success", 1)
+	}
+	if r.down.Load() {
+		if err != nil {
+			r.success = 0
+			return
+		}
+		r.success++
+		if r.success >= r.opt.RiseThreshold {
+			log.Info("resolver is up")
+			r.success = 0
+			r.down.Store(false)
+			r.metrics.up.Set(1)
+		}
+		return
+	}
+	if err == nil {
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if r.failures >= r.opt.FallThreshold {
+		log.Warn("resolver is down", "error", err)
+		r.failures = 0
+		r.down.Store(true)
+		r.metrics.up.Set(0)
+		r.metrics.down.Add(1)
+	}
+}
+
+// Returns true if a health check marked the resolver down.
+func upstreamDown(resolver Resolver) bool {
+	v, ok := healthChecks.Load(resolver.String())
+	return ok && !v.(*HealthCheck).Healthy()
+}
+
+// Returns true if all resolvers are marked down by their health checks.
+func allUpstreamsDown(resolvers []Resolver) bool {
+	for _, resolver := range resolvers {
+		if !upstreamDown(resolver) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the resolvers that aren't marked down by their health checks. All
+// are returned if none, or all of them, are down.
+func healthyUpstreams(resolvers []Resolver) []Resolver {
+	if !slices.ContainsFunc(resolvers, upstreamDown) || allUpstreamsDown(resolvers) {
+		return resolvers
+	}
+	return slices.DeleteFunc(slices.Clone(resolvers), upstreamDown)
+}
@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	var queries atomic.Int64
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name == "probe.example." {
+				if failing.Load() {
+					return nil, errors.New("unreachable")
+				}
+				return new(dns.Msg).SetReply(q), nil
+			}
+			queries.Add(1)
+			return new(dns.Msg).SetReply(q), nil
+		},
+	}
+	clock := NewFakeClock(time.Now())
+	hc := NewHealthCheck("test-health-check-primary", upstream, HealthCheckOptions{
+		Name:          "probe.example.",
+		Interval:      10 * time.Second,
+		FallThreshold: 2,
+		RiseThreshold: 2,
+		Clock:         clock,
+	})
+	defer hc.Close()
+	downBefore := hc.metrics.down.Value()
+	secondary := NewHealthCheck("test-health-check-secondary", &TestResolver{}, HealthCheckOptions{Clock: clock})
+	defer secondary.Close()
+	g := NewFailRotate("test-health-check-group", FailRotateOptions{}, hc, secondary)
+
+	// Runs the next round of probes of both health checks
+	probe := func() {
+		clock.BlockUntil(2)
+		clock.Advance(10 * time.Second)
+		clock.BlockUntil(2)
+	}
+	clock.BlockUntil(2)
+	require.True(t, hc.Healthy())
+
+	// Marked down after two failed probes
+	failing.Store(true)
+	probe()
+	require.True(t, hc.Healthy())
+	probe()
+	require.False(t, hc.Healthy())
+	require.Equal(t, int64(0), hc.metrics.up.Value())
+
+	// Queries to the group skip the primary
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), queries.Load())
+	require.Equal(t, 1, g.ActiveResolver())
+
+	// Marked up again after two successful probes
+	failing.Store(false)
+	probe()
+	require.False(t, hc.Healthy())
+	probe()
+	require.True(t, hc.Healthy())
+	require.Equal(t, downBefore+1, hc.metrics.down.Value())
+}
+
+func TestHealthyUpstreams(t *testing.T) {
+	var up, down HealthCheck
+	up.id, down.id = "test-healthy-upstreams-up", "test-healthy-upstreams-down"
+	down.down.Store(true)
+	healthChecks.Store(up.id, &up)
+	healthChecks.Store(down.id, &down)
+	defer healthChecks.Delete(up.id)
+	defer healthChecks.Delete(down.id)
+
+	require.Equal(t, []Resolver{&up}, healthyUpstreams([]Resolver{&down, &up}))
+
+	// All resolvers are used if all are down
+	require.Equal(t, []Resolver{&down}, healthyUpstreams([]Resolver{&down}))
+}
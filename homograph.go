@@ -0,0 +1,174 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// HomographDetector flags queries for internationalized names that look like
+// one of the protected domains, or names in them, like "аррӏе.com" spelled
+// with Cyrillic letters to look like "apple.com". Such names are used in
+// phishing. Detected queries are logged and counted, and optionally blocked.
+// All other queries are passed through.
+type HomographDetector struct {
+	id       string
+	resolver Resolver
+	opt      HomographDetectorOptions
+	metrics  *HomographDetectorMetrics
+
+	// Protected domains by the skeleton of their unicode form.
+	protected map[string]homographDomain
+}
+
+// HomographDetectorOptions contain settings for the homograph detector.
+type HomographDetectorOptions struct {
+	// Domains to detect look-alikes of, like "example.com". Can be
+	// internationalized names, in unicode or punycode form.
+	Domains []string
+
+	// Respond to queries for look-alikes with NXDOMAIN, rather than only
+	// logging and counting them.
+	Block bool
+}
+
+type HomographDetectorMetrics struct {
+	// Queries for look-alikes by protected domain.
+	detected *CounterMap
+}
+
+// A protected domain in both forms.
+type homographDomain struct {
+	ascii, unicode string
+}
+
+var _ Resolver = &HomographDetector{}
+
+// NewHomographDetector returns a resolver that detects queries for look-alikes
+// of protected domains.
+func NewHomographDetector(id string, resolver Resolver, opt HomographDetectorOptions) (*HomographDetector, error) {
+	if len(opt.Domains) == 0 {
+		return nil, errors.New("no protected domains")
+	}
+	protected := make(map[string]homographDomain)
+	for _, domain := range opt.Domains {
+		ascii, err := idna.ToASCII(strings.ToLower(dns.Fqdn(domain)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected domain '%s': %w", domain, err)
+		}
+		unicode, err := idna.ToUnicode(ascii)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected domain '%s': %w", domain, err)
+		}
+		protected[homographSkeleton(unicode)] = homographDomain{ascii: ascii, unicode: unicode}
+	}
+	return &HomographDetector{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &HomographDetectorMetrics{
+			detected: getCounterMap("router", id, "detected", "domain"),
+		},
+		protected: protected,
+	}, nil
+}
+
+// Resolve a DNS query after checking if it's for a look-alike of a protected
+// domain.
+func (r *HomographDetector) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	domain, ok := r.lookAlike(q.Question[0].Name)
+	if !ok {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci).With("protected", domain.ascii)
+	r.metrics.detected.Add(strings.TrimSuffix(domain.ascii, "."), 1)
+	if !r.opt.Block {
+		log.Warn("query for look-alike of protected domain, forwarding", "resolver", r.resolver.String())
+		return r.resolver.Resolve(q, ci)
+	}
+	log.Warn("query for look-alike of protected domain, blocking")
+	traceBlocked(ci, r.id, &BlocklistMatch{Rule: domain.unicode})
+	return nxdomain(q), nil
+}
+
+func (r *HomographDetector) String() string {
+	return r.id
+}
+
+// Returns the protected domain a name looks like, if it's not in that domain
+// itself. Only names with punycode labels are checked.
+func (r *HomographDetector) lookAlike(name string) (homographDomain, bool) {
+	u := unicodeName(name)
+	if u == "" {
+		return homographDomain{}, false
+	}
+	skeleton := homographSkeleton(u)
+	name = strings.ToLower(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(skeleton, off) {
+		domain, ok := r.protected[skeleton[off:]]
+		if !ok {
+			continue
+		}
+		if name == domain.ascii || strings.HasSuffix(name, "."+domain.ascii) {
+			return homographDomain{}, false
+		}
+		return domain, true
+	}
+	return homographDomain{}, false
+}
+
+// Returns the name with characters that look like latin letters replaced with
+// those, so look-alikes have the same skeleton.
+func homographSkeleton(name string) string {
+	return strings.Map(func(r rune) rune {
+		if base, ok := homographChars[r]; ok {
+			return base
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// Characters that look like latin letters: letters with diacritics, and
+// Cyrillic, Greek and Armenian letters.
+var homographChars = func() map[rune]rune {
+	chars := map[rune]string{
+		'a': "àáâãäåāăąǎạảаӑӓαάɑ",
+		'b': "ьḃ",
+		'c': "çćĉċčсϲ",
+		'd': "ďđԁḋ",
+		'e': "èéêëēĕėęěẹẻẽеёєε",
+		'g': "ĝğġģǧɡց",
+		'h': "ĥħһհ",
+		'i': "ìíîïĩīĭįıǐịỉіїιίϊ",
+		'j': "ĵјǰ",
+		'k': "ķкκ",
+		'l': "ĺļľŀłӏ",
+		'm': "ṁ",
+		'n': "ñńņňŉոη",
+		'o': "òóôõöøōŏőǒọỏоοόօ",
+		'p': "рρṗ",
+		'q': "ԛզ",
+		'r': "ŕŗř",
+		's': "śŝşšѕș",
+		't': "ţťŧțτ",
+		'u': "ùúûüũūŭůűųǔụủυύսμ",
+		'v': "ѵν",
+		'w': "ŵԝωẁẃẅ",
+		'x': "хχ",
+		'y': "ýÿŷуүỳỵỷỹ",
+		'z': "źżžẓ",
+	}
+	m := make(map[rune]rune)
+	for base, list := range chars {
+		for _, c := range list {
+			m[c] = base
+		}
+	}
+	return m
+}()
@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomographDetector(t *testing.T) {
+	upstream := new(TestResolver)
+	r, err := NewHomographDetector("test-homograph", upstream, HomographDetectorOptions{
+		Domains: []string{"apple.com", "paypal.com.", "bücher.example"},
+		Block:   true,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{name: "apple.com.", blocked: false},
+		{name: "www.apple.com.", blocked: false},
+		{name: "xn--80ak6aa92e.com.", blocked: true},        // аррӏе.com
+		{name: "www.XN--80ak6aa92e.com.", blocked: true},    // www.аррӏе.com
+		{name: "xn--ypal-43d9g.com.", blocked: true},        // раypal.com
+		{name: "xn--ypal-43d9g.org.", blocked: false},       // раypal.org
+		{name: "xn--ggle-55da.com.", blocked: false},        // gооgle.com
+		{name: "xn--bcher-kva.example.", blocked: false},    // bücher.example
+		{name: "bucher.example.", blocked: false},           // Not an internationalized name
+		{name: "xn--bcher-mgb.example.", blocked: true},     // bűcher.example
+		{name: "xn--80ak6aa92e.apple.com.", blocked: false}, // In a protected domain
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits := upstream.HitCount()
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, dns.TypeA)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			if !test.blocked {
+				require.Equal(t, hits+1, upstream.HitCount())
+				return
+			}
+			require.Equal(t, hits, upstream.HitCount())
+			require.Equal(t, dns.RcodeNameError, a.Rcode)
+		})
+	}
+}
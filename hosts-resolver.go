@@ -0,0 +1,252 @@
+package rdns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// HostsResolver answers queries for names in hosts files, like /etc/hosts,
+// and passes all other queries through. The files are reloaded whenever they
+// change, which makes it suitable for local overrides that change often, or
+// are written by other tools into a directory like /etc/hosts.d.
+// Names in the files are fully overridden, queries for types without
+// addresses in the files are answered with NODATA rather than forwarded.
+type HostsResolver struct {
+	id       string
+	resolver Resolver
+	opt      HostsResolverOptions
+	hosts    atomic.Pointer[hostsEntries]
+	metrics  *HostsResolverMetrics
+
+	// Stops watching the files for changes
+	stopWatch func()
+}
+
+// HostsResolverOptions contain settings for the hosts file resolver.
+type HostsResolverOptions struct {
+	// Hosts files to serve. Entries of all files are combined. Directories
+	// hold any number of files, which are loaded in the order of their names.
+	Files []string
+
+	// TTL of the records. Defaults to 60 seconds.
+	TTL uint32
+}
+
+type HostsResolverMetrics struct {
+	// Queries answered from the hosts files.
+	local *Counter
+	// Queries passed through to the resolver.
+	forwarded *Counter
+	// Number of names in the hosts files.
+	names *Gauge
+	// Failed reloads of the files.
+	reloadErr *Counter
+}
+
+// Entries of hosts files, by lower-case name. Reverse lookup names of the
+// addresses map to the names of the address.
+type hostsEntries struct {
+	addrs map[string][]net.IP
+	names map[string][]string
+}
+
+var _ Resolver = &HostsResolver{}
+
+// NewHostsResolver returns a resolver that answers queries from hosts files.
+// Fails if the files can't be loaded.
+func NewHostsResolver(id string, resolver Resolver, opt HostsResolverOptions) (*HostsResolver, error) {
+	if len(opt.Files) == 0 {
+		return nil, errors.New("no hosts files")
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 60
+	}
+	r := &HostsResolver{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &HostsResolverMetrics{
+			local:     getCounter("router", id, "hosts-local"),
+			forwarded: getCounter("router", id, "forwarded"),
+			names:     getGauge("router", id, "names"),
+			reloadErr: getCounter("router", id, "reload-error"),
+		},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	stop, err := onFileChange(opt.Files, r.reload)
+	if err != nil {
+		return nil, err
+	}
+	r.stopWatch = stop
+	return r, nil
+}
+
+// Resolve a DNS query. Queries for names in the hosts files, or for the
+// reverse lookup names of their addresses, are answered from the files, all
+// others are forwarded.
+func (r *HostsResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	hosts := r.hosts.Load()
+	ips, isName := hosts.addrs[name]
+	ptrs, isAddr := hosts.names[name]
+	if !isName && !isAddr {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	log.Debug("answering query from hosts files")
+	r.metrics.local.Add(1)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	a.RecursionAvailable = q.RecursionDesired
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: r.opt.TTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: ip4})
+			}
+		}
+	case dns.TypeAAAA:
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		for _, ptr := range ptrs {
+			a.Answer = append(a.Answer, &dns.PTR{Hdr: hdr, Ptr: ptr})
+		}
+	}
+	return a, nil
+}
+
+// Close stops watching the files for changes.
+func (r *HostsResolver) Close() error {
+	r.stopWatch()
+	return nil
+}
+
+func (r *HostsResolver) String() string {
+	return r.id
+}
+
+// Reloads the files after they changed. The current entries are kept if
+// that fails.
+func (r *HostsResolver) reload() {
+	err := r.load()
+	statusReload(r.id, err)
+	if err != nil {
+		Log.Error("failed to reload hosts files", "id", r.id, "error", err)
+		r.metrics.reloadErr.Add(1)
+		notifyReloadFailed(r.id, err)
+		return
+	}
+	Log.Info("reloaded hosts files", "id", r.id, "names", len(r.hosts.Load().addrs))
+}
+
+// Loads the entries of all files.
+func (r *HostsResolver) load() error {
+	hosts := &hostsEntries{
+		addrs: make(map[string][]net.IP),
+		names: make(map[string][]string),
+	}
+	for _, path := range r.opt.Files {
+		files, err := hostsFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := hosts.load(file); err != nil {
+				return err
+			}
+		}
+	}
+	r.hosts.Store(hosts)
+	r.metrics.names.Set(int64(len(hosts.addrs)))
+	return nil
+}
+
+// Returns the files to load for a path, which is either a file or a
+// directory of files. Hidden files and backups of editors in directories are
+// skipped.
+func hostsFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		file := filepath.Join(path, name)
+		// Follows symlinks, files can disappear while they're listed
+		if fi, err := os.Stat(file); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Adds the entries of a hosts file. Lines consist of an address followed by
+// one or more names, everything after a # is a comment.
+func (h *hostsEntries) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, _, _ := strings.Cut(fields[0], "%") // Drop the zone of link-local addresses
+		ip := net.ParseIP(addr)
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("invalid entry in %s line %d: %q", file, line, scanner.Text())
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return err
+		}
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return fmt.Errorf("invalid name in %s line %d: %q", file, line, name)
+			}
+			name = dns.Fqdn(strings.ToLower(name))
+			h.addrs[name] = append(h.addrs[name], ip)
+			h.names[reverse] = append(h.names[reverse], name)
+		}
+	}
+	return scanner.Err()
+}
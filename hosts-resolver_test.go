@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsResolver(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	require.NoError(t, os.WriteFile(file, []byte(`
+# Local overrides
+192.168.1.10  nas.home.arpa nas  # with alias
+192.168.1.10  backup.home.arpa
+fd00::10      nas.home.arpa
+fe80::1%lo0   router.home.arpa
+`), 0o644))
+
+	upstream := new(TestResolver)
+	r, err := NewHostsResolver("test-hosts", upstream, HostsResolverOptions{Files: []string{file}, TTL: 30})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		answer    []string
+		forwarded bool
+	}{
+		{name: "nas.home.arpa.", qtype: dns.TypeA, answer: []string{"nas.home.arpa.\t30\tIN\tA\t192.168.1.10"}},
+		{name: "NAS.home.arpa.", qtype: dns.TypeAAAA, answer: []string{"NAS.home.arpa.\t30\tIN\tAAAA\tfd00::10"}},
+		{name: "nas.", qtype: dns.TypeA, answer: []string{"nas.\t30\tIN\tA\t192.168.1.10"}},
+		{name: "nas.home.arpa.", qtype: dns.TypeMX},
+		{name: "router.home.arpa.", qtype: dns.TypeAAAA, answer: []string{"router.home.arpa.\t30\tIN\tAAAA\tfe80::1"}},
+		{name: "10.1.168.192.in-addr.arpa.", qtype: dns.TypePTR, answer: []string{
+			"10.1.168.192.in-addr.arpa.\t30\tIN\tPTR\tnas.home.arpa.",
+			"10.1.168.192.in-addr.arpa.\t30\tIN\tPTR\tnas.",
+			"10.1.168.192.in-addr.arpa.\t30\tIN\tPTR\tbackup.home.arpa.",
+		}},
+		{name: "example.com.", qtype: dns.TypeA, forwarded: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits := upstream.HitCount()
+			a := resolve(test.name, test.qtype)
+			if test.forwarded {
+				require.Equal(t, hits+1, upstream.HitCount())
+				return
+			}
+			require.Equal(t, hits, upstream.HitCount())
+			require.Equal(t, dns.RcodeSuccess, a.Rcode)
+			var answer []string
+			for _, rr := range a.Answer {
+				answer = append(answer, rr.String())
+			}
+			require.Equal(t, test.answer, answer)
+		})
+	}
+
+	// Replacing the file reloads it
+	tmp := filepath.Join(dir, "hosts.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("192.168.1.20 nas.home.arpa\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, file))
+	require.Eventually(t, func() bool {
+		a := resolve("nas.home.arpa.", dns.TypeA)
+		return len(a.Answer) == 1 && a.Answer[0].(*dns.A).A.String() == "192.168.1.20"
+	}, 10*time.Second, 50*time.Millisecond)
+	hits := upstream.HitCount()
+	resolve("backup.home.arpa.", dns.TypeA)
+	require.Equal(t, hits+1, upstream.HitCount())
+
+	// Invalid entries keep the previous ones
+	require.NoError(t, os.WriteFile(file, []byte("192.168.1 nas.home.arpa\n"), 0o644))
+	require.Eventually(t, func() bool {
+		s, _ := GetElementStatus("test-hosts")
+		return s.LastReloadError != ""
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Len(t, resolve("nas.home.arpa.", dns.TypeA).Answer, 1)
+}
+
+func TestHostsResolverDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "10-nas"), []byte("192.168.1.10 nas.home.arpa\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".10-nas.swp"), []byte("invalid"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "10-nas~"), []byte("192.168.1.99 nas.home.arpa\n"), 0o644))
+
+	upstream := new(TestResolver)
+	r, err := NewHostsResolver("test-hosts-dir", upstream, HostsResolverOptions{Files: []string{dir}})
+	require.NoError(t, err)
+
+	resolve := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+	a := resolve("nas.home.arpa.")
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+
+	// Files added to the directory are loaded
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20-app"), []byte("10.0.0.5 app.home.arpa\n"), 0o644))
+	require.Eventually(t, func() bool {
+		return len(resolve("app.home.arpa.").Answer) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Names of removed files are forwarded again
+	require.NoError(t, os.Remove(filepath.Join(dir, "20-app")))
+	require.Eventually(t, func() bool {
+		hits := upstream.HitCount()
+		resolve("app.home.arpa.")
+		return upstream.HitCount() == hits+1
+	}, 10*time.Second, 50*time.Millisecond)
+}
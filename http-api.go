@@ -0,0 +1,306 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HTTPAPI answers queries with records returned by an HTTP endpoint. The
+// question and client are sent as JSON, the endpoint replies with the records
+// in JSON, or asks for the query to be forwarded to the resolver. This makes
+// it easy to serve names from inventory or IP management systems. Replies
+// are cached for their TTL.
+type HTTPAPI struct {
+	id       string
+	resolver Resolver
+	opt      HTTPAPIOptions
+	client   *http.Client
+	metrics  *HTTPAPIMetrics
+
+	mu    sync.Mutex
+	cache map[httpAPIRequest]*httpAPIAnswer
+}
+
+// HTTPAPIOptions contain settings for the HTTP API resolver.
+type HTTPAPIOptions struct {
+	// URL of the endpoint that requests are POSTed to.
+	URL string
+
+	// Headers added to every request, typically for authentication.
+	Headers map[string]string
+
+	// Time to wait for a reply. Defaults to 2 seconds.
+	Timeout time.Duration
+
+	// TTL of records and of replies in the cache if the reply doesn't
+	// contain one. Defaults to 60 seconds.
+	TTL uint32
+
+	// Maximum number of replies kept in the cache. Defaults to 1000,
+	// a negative value disables the cache.
+	CacheSize int
+}
+
+type HTTPAPIMetrics struct {
+	// Queries answered from the endpoint's replies, by response code.
+	local *CounterMap
+	// Queries passed through to the resolver.
+	forwarded *Counter
+	// Queries answered from the cache.
+	cacheHit *Counter
+	// Failed requests to the endpoint.
+	err *Counter
+}
+
+// Request sent to the endpoint.
+type httpAPIRequest struct {
+	QName  string `json:"qname"`
+	QType  string `json:"qtype"`
+	Client string `json:"client"`
+}
+
+// Reply of the endpoint.
+type httpAPIReply struct {
+	Rcode   string          `json:"rcode"`   // Response code like "NXDOMAIN", default "NOERROR"
+	TTL     *uint32         `json:"ttl"`     // Default TTL of the records and time the reply is cached
+	Forward bool            `json:"forward"` // Pass the query to the resolver
+	Answer  []httpAPIRecord `json:"answer"`
+}
+
+type httpAPIRecord struct {
+	Name string  `json:"name"` // Defaults to the query name
+	Type string  `json:"type"` // Defaults to the query type
+	TTL  *uint32 `json:"ttl"`
+	Data string  `json:"data"` // Record data in zone file format, like "192.168.1.1"
+}
+
+// Reply converted to DNS records, as kept in the cache.
+type httpAPIAnswer struct {
+	rcode   int
+	forward bool
+	answer  []dns.RR
+	expiry  time.Time
+}
+
+var _ Resolver = &HTTPAPI{}
+
+// NewHTTPAPI returns a resolver that answers queries with records from an
+// HTTP endpoint. The resolver is only used for queries the endpoint asks to
+// be forwarded and can be nil.
+func NewHTTPAPI(id string, resolver Resolver, opt HTTPAPIOptions) (*HTTPAPI, error) {
+	if !strings.HasPrefix(opt.URL, "http://") && !strings.HasPrefix(opt.URL, "https://") {
+		return nil, fmt.Errorf("invalid http-api url '%s'", opt.URL)
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 60
+	}
+	if opt.CacheSize == 0 {
+		opt.CacheSize = 1000
+	}
+	return &HTTPAPI{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		client: &http.Client{
+			Timeout: opt.Timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+			},
+		},
+		metrics: &HTTPAPIMetrics{
+			local:     getCounterMap("router", id, "local", "rcode"),
+			forwarded: getCounter("router", id, "forwarded"),
+			cacheHit:  getCounter("router", id, "cache-hit"),
+			err:       getCounter("router", id, "error"),
+		},
+		cache: make(map[httpAPIRequest]*httpAPIAnswer),
+	}, nil
+}
+
+// Resolve a DNS query by asking the endpoint for the records.
+func (r *HTTPAPI) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	req := httpAPIRequest{
+		QName: strings.ToLower(question.Name),
+		QType: dns.Type(question.Qtype).String(),
+	}
+	if ci.SourceIP != nil {
+		req.Client = ci.SourceIP.String()
+	}
+	log := logger(r.id, q, ci)
+
+	answer, ok := r.fromCache(req)
+	if ok {
+		r.metrics.cacheHit.Add(1)
+	} else {
+		var err error
+		answer, err = r.query(req)
+		if err != nil {
+			log.Error("failed to query http api", "error", err)
+			r.metrics.err.Add(1)
+			return nil, err
+		}
+		r.toCache(req, answer)
+	}
+
+	if answer.forward {
+		if r.resolver == nil {
+			r.metrics.err.Add(1)
+			return nil, errors.New("http api requested forwarding but no resolver is configured")
+		}
+		log.With("resolver", r.resolver).Debug("forwarding query to resolver")
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+
+	log.Debug("answering query from http api")
+	r.metrics.local.Add(dns.RcodeToString[answer.rcode], 1)
+	a := new(dns.Msg)
+	a.SetRcode(q, answer.rcode)
+	a.Authoritative = true
+	a.RecursionAvailable = q.RecursionDesired
+
+	// Lower the TTL of cached records to the time left until they expire
+	ttl := uint32(time.Until(answer.expiry).Round(time.Second).Seconds())
+	for _, rr := range answer.answer {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, question.Name) {
+			rr.Header().Name = question.Name // Keep the case of the query
+		}
+		rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+		a.Answer = append(a.Answer, rr)
+	}
+	return a, nil
+}
+
+func (r *HTTPAPI) String() string {
+	return r.id
+}
+
+// Sends the request to the endpoint and converts the reply.
+func (r *HTTPAPI) query(req httpAPIRequest) (*httpAPIAnswer, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, r.opt.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	for k, v := range r.opt.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, r.opt.URL)
+	}
+	var reply httpAPIReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid reply from %s: %w", r.opt.URL, err)
+	}
+	return reply.convert(req, r.opt.TTL)
+}
+
+// Converts the reply into the answer to a request.
+func (reply httpAPIReply) convert(req httpAPIRequest, defaultTTL uint32) (*httpAPIAnswer, error) {
+	ttl := defaultTTL
+	if reply.TTL != nil {
+		ttl = *reply.TTL
+	}
+	a := &httpAPIAnswer{
+		forward: reply.Forward,
+		expiry:  time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	if reply.Forward {
+		return a, nil
+	}
+	if reply.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(reply.Rcode)]
+		if !ok {
+			return nil, fmt.Errorf("invalid rcode '%s' in reply", reply.Rcode)
+		}
+		a.rcode = rcode
+	}
+	for _, record := range reply.Answer {
+		name, typ, recordTTL := req.QName, req.QType, ttl
+		if record.Name != "" {
+			name = dns.Fqdn(record.Name)
+		}
+		if record.Type != "" {
+			typ = strings.ToUpper(record.Type)
+		}
+		if record.TTL != nil {
+			recordTTL = *record.TTL
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, recordTTL, typ, record.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid record in reply: %w", err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("invalid record in reply: no data for %s record", typ)
+		}
+		a.answer = append(a.answer, rr)
+	}
+	return a, nil
+}
+
+// Returns the cached answer to a request if it hasn't expired.
+func (r *HTTPAPI) fromCache(req httpAPIRequest) (*httpAPIAnswer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.cache[req]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(a.expiry) {
+		delete(r.cache, req)
+		return nil, false
+	}
+	return a, true
+}
+
+// Adds an answer to the cache. If it's full, expired answers are removed
+// first, then arbitrary ones.
+func (r *HTTPAPI) toCache(req httpAPIRequest, a *httpAPIAnswer) {
+	if r.opt.CacheSize < 0 || !time.Now().Before(a.expiry) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.opt.CacheSize {
+		now := time.Now()
+		for k, v := range r.cache {
+			if now.After(v.expiry) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < r.opt.CacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[req] = a
+}
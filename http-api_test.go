@@ -0,0 +1,129 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var req httpAPIRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch req.QName {
+		case "host.example.com.":
+			require.Equal(t, "192.168.1.2", req.Client)
+			w.Write([]byte(`{"ttl":300,"answer":[{"data":"10.0.0.1"},{"data":"10.0.0.2","ttl":30}]}`))
+		case "alias.example.com.":
+			w.Write([]byte(`{"answer":[{"type":"CNAME","data":"host.example.com."},{"name":"host.example.com","type":"A","data":"10.0.0.1"}]}`))
+		case "missing.example.com.":
+			w.Write([]byte(`{"rcode":"NXDOMAIN"}`))
+		case "uncached.example.com.":
+			w.Write([]byte(`{"ttl":0,"answer":[{"type":"TXT","data":"\"hello\""}]}`))
+		case "forward.example.com.":
+			w.Write([]byte(`{"forward":true}`))
+		case "invalid.example.com.":
+			w.Write([]byte(`{"answer":[{"data":"not-an-ip"}]}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	upstream := new(TestResolver)
+	r, err := NewHTTPAPI("test-http-api", upstream, HTTPAPIOptions{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	})
+	require.NoError(t, err)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.2")}
+
+	resolve := func(name string, qtype uint16) (*dns.Msg, error) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		return r.Resolve(q, ci)
+	}
+
+	// Records with the TTL of the reply or their own
+	a, err := resolve("Host.example.com.", dns.TypeA)
+	require.NoError(t, err)
+	require.True(t, a.Authoritative)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "Host.example.com.", a.Answer[0].Header().Name)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(300), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(30), a.Answer[1].Header().Ttl)
+	require.Equal(t, int32(1), requests.Load())
+
+	// Answered from the cache
+	a, err = resolve("host.example.com.", dns.TypeA)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, int32(1), requests.Load())
+
+	// Records of other names and types
+	a, err = resolve("alias.example.com.", dns.TypeA)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "host.example.com.", a.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "host.example.com.", a.Answer[1].Header().Name)
+
+	a, err = resolve("missing.example.com.", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+
+	// Replies with a TTL of 0 aren't cached
+	requests.Store(0)
+	for range 2 {
+		a, err = resolve("uncached.example.com.", dns.TypeTXT)
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1)
+	}
+	require.Equal(t, int32(2), requests.Load())
+
+	// Forwarded to the resolver
+	_, err = resolve("forward.example.com.", dns.TypeA)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Failures
+	_, err = resolve("invalid.example.com.", dns.TypeA)
+	require.Error(t, err)
+	_, err = resolve("error.example.com.", dns.TypeA)
+	require.Error(t, err)
+}
+
+func TestHTTPAPITimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	r, err := NewHTTPAPI("test-http-api-timeout", nil, HTTPAPIOptions{
+		URL:     server.URL,
+		Timeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	_, err = r.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,103 @@
+package rdns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPProxyDialer opens TCP connections through an HTTP proxy with the CONNECT
+// method. UDP isn't supported, so it can't be used for QUIC.
+type HTTPProxyDialer struct {
+	addr string
+	opt  HTTPProxyDialerOptions
+}
+
+type HTTPProxyDialerOptions struct {
+	// Credentials for basic authentication with the proxy. Optional.
+	Username string
+	Password string
+
+	// Timeout for establishing the connection through the proxy. Default 10
+	// seconds.
+	Timeout time.Duration
+
+	LocalAddr net.IP
+}
+
+var _ Dialer = (*HTTPProxyDialer)(nil)
+
+// NewHTTPProxyDialer returns a dialer for the proxy listening on addr.
+func NewHTTPProxyDialer(addr string, opt HTTPProxyDialerOptions) *HTTPProxyDialer {
+	if opt.Timeout == 0 {
+		opt.Timeout = 10 * time.Second
+	}
+	return &HTTPProxyDialer{addr: addr, opt: opt}
+}
+
+// Dial opens a connection to address through the proxy.
+func (d *HTTPProxyDialer) Dial(network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http proxy doesn't support network '%s'", network)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.Timeout)
+	defer cancel()
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: d.opt.LocalAddr}}
+	conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.opt.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.opt.Username + ":" + d.opt.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy failed to connect to %s: %s", address, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The server talks first in some protocols, and could already have sent
+	// data that was read into the buffer
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// Connection with data that was already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
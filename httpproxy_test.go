@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPProxyDialer(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+
+	// Proxy that requires authentication
+	var connects atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := parseProxyAuth(r)
+		if r.Method != http.MethodConnect || !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		connects.Add(1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(target, brw)
+		io.Copy(conn, target)
+	}))
+	defer proxy.Close()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	dialer := NewHTTPProxyDialer(proxy.Listener.Addr().String(), HTTPProxyDialerOptions{Username: "user", Password: "secret"})
+	c, err := NewDoHClient("test-doh-http-proxy", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsConfig, Dialer: dialer})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), connects.Load())
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Wrong credentials
+	dialer = NewHTTPProxyDialer(proxy.Listener.Addr().String(), HTTPProxyDialerOptions{Username: "user", Password: "wrong"})
+	_, err = dialer.Dial("tcp", addr)
+	require.Error(t, err)
+
+	// UDP isn't supported
+	_, err = dialer.Dial("udp", addr)
+	require.Error(t, err)
+}
+
+// Returns the credentials in the Proxy-Authorization header.
+func parseProxyAuth(r *http.Request) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	return req.BasicAuth()
+}
@@ -0,0 +1,191 @@
+package rdns
+
+import (
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// HTTPSSynth is a resolver that handles HTTPS (type 65) queries for configured
+// domains without waiting on upstream resolvers that may be slow to answer or
+// don't support the type. Depending on the domain, it either responds with
+// NODATA right away, or synthesizes an HTTPS record with address hints from
+// the A and AAAA records of the name. All other queries are passed through.
+type HTTPSSynth struct {
+	id       string
+	resolver Resolver
+	opt      HTTPSSynthOptions
+	metrics  *HTTPSSynthMetrics
+}
+
+// HTTPSSynthOptions contain the domains the resolver applies to. Domains are
+// given as suffixes, "." matches all names. If a name matches domains in both
+// lists, the longest (most specific) match is used.
+type HTTPSSynthOptions struct {
+	// Respond to HTTPS queries for these domains with NODATA.
+	NODATA []string
+
+	// Synthesize HTTPS records from A/AAAA records for these domains.
+	Synthesize []string
+}
+
+type HTTPSSynthMetrics struct {
+	// Queries answered with NODATA.
+	nodata *Counter
+	// Queries answered with a synthesized record.
+	synthesized *Counter
+	// Queries passed through to the resolver.
+	forwarded *Counter
+}
+
+var _ Resolver = &HTTPSSynth{}
+
+// NewHTTPSSynth returns a new instance of an HTTPS record synthesizer.
+func NewHTTPSSynth(id string, resolver Resolver, opt HTTPSSynthOptions) *HTTPSSynth {
+	return &HTTPSSynth{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &HTTPSSynthMetrics{
+			nodata:      getCounter("router", id, "nodata"),
+			synthesized: getCounter("router", id, "synthesized"),
+			forwarded:   getCounter("router", id, "forwarded"),
+		},
+	}
+}
+
+// Resolve a DNS query. HTTPS queries for matching domains are answered with
+// NODATA or a synthesized record, everything else is forwarded.
+func (r *HTTPSSynth) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeHTTPS {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	nodata := matchLength(q.Question[0].Name, r.opt.NODATA)
+	synth := matchLength(q.Question[0].Name, r.opt.Synthesize)
+	switch {
+	case nodata > synth:
+		log.Debug("responding with nodata")
+		r.metrics.nodata.Add(1)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.RecursionAvailable = q.RecursionDesired
+		return a, nil
+	case synth > nodata:
+		log.Debug("synthesizing response")
+		r.metrics.synthesized.Add(1)
+		return r.synthesize(q, ci)
+	}
+	log.With("resolver", r.resolver.String()).Debug("forwarding query to resolver")
+	r.metrics.forwarded.Add(1)
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *HTTPSSynth) String() string {
+	return r.id
+}
+
+// Query A and AAAA records for the name and build an HTTPS record with address
+// hints from them.
+func (r *HTTPSSynth) synthesize(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	var (
+		wg        sync.WaitGroup
+		responses [2]*dns.Msg
+		errs      [2]error
+	)
+	for i, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			aq := q.Copy()
+			aq.Question[0].Qtype = t
+			responses[i], errs[i] = r.resolver.Resolve(aq, ci)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		v4, v6 []dns.RR
+		first  *dns.Msg
+	)
+	for i, a := range responses {
+		if errs[i] != nil || a == nil {
+			continue
+		}
+		if first == nil {
+			first = a
+		}
+		for _, rr := range a.Answer {
+			switch rr.(type) {
+			case *dns.A:
+				v4 = append(v4, rr)
+			case *dns.AAAA:
+				v6 = append(v6, rr)
+			}
+		}
+	}
+
+	// Both failed, return the error of the A query
+	if first == nil {
+		return nil, errs[0]
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(q)
+	answer.RecursionAvailable = first.RecursionAvailable
+
+	// Nothing to build a record from, respond with the code of the upstream
+	// response (NODATA or NXDOMAIN) and the SOA if there is one.
+	if len(v4) == 0 && len(v6) == 0 {
+		answer.Rcode = first.Rcode
+		answer.Ns = first.Ns
+		return answer, nil
+	}
+
+	ttl := uint32(math.MaxUint32)
+	rr := &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   q.Question[0].Name,
+				Rrtype: dns.TypeHTTPS,
+				Class:  q.Question[0].Qclass,
+			},
+			Priority: 1,
+			Target:   ".",
+		},
+	}
+	if len(v4) > 0 {
+		hint := new(dns.SVCBIPv4Hint)
+		for _, a := range v4 {
+			hint.Hint = append(hint.Hint, a.(*dns.A).A)
+			ttl = min(ttl, a.Header().Ttl)
+		}
+		rr.Value = append(rr.Value, hint)
+	}
+	if len(v6) > 0 {
+		hint := new(dns.SVCBIPv6Hint)
+		for _, a := range v6 {
+			hint.Hint = append(hint.Hint, a.(*dns.AAAA).AAAA)
+			ttl = min(ttl, a.Header().Ttl)
+		}
+		rr.Value = append(rr.Value, hint)
+	}
+	rr.Hdr.Ttl = ttl
+	answer.Answer = []dns.RR{rr}
+	return answer, nil
+}
+
+// Returns the number of labels of the longest domain in the list that matches
+// the name, or -1 if none match.
+func matchLength(name string, domains []string) int {
+	longest := -1
+	for _, domain := range domains {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(domain)), strings.ToLower(name)) {
+			longest = max(longest, dns.CountLabel(dns.Fqdn(domain)))
+		}
+	}
+	return longest
+}
@@ -0,0 +1,58 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSSynth(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				a.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")}}
+			case dns.TypeAAAA:
+				hdr.Ttl = 60
+				a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")}}
+			}
+			return a, nil
+		},
+	}
+	r := NewHTTPSSynth("test-https", upstream, HTTPSSynthOptions{
+		NODATA:     []string{"."},
+		Synthesize: []string{"example.com"},
+	})
+	q := new(dns.Msg)
+
+	// Synthesized from A and AAAA records
+	q.SetQuestion("www.example.com.", dns.TypeHTTPS)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Len(t, a.Answer, 1)
+	rr, ok := a.Answer[0].(*dns.HTTPS)
+	require.True(t, ok)
+	require.Equal(t, uint32(60), rr.Hdr.Ttl)
+	require.Len(t, rr.Value, 2)
+
+	// Other domains get NODATA without going upstream
+	q.SetQuestion("example.org.", dns.TypeHTTPS)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Other types are forwarded
+	q.SetQuestion("example.org.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+}
@@ -0,0 +1,32 @@
+package rdns
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Returns the unicode form of a name with punycode labels (xn--), like
+// "bücher.example." for "xn--bcher-kva.example.". Returns an empty string if
+// the name has no punycode labels or they're invalid, so the unicode form
+// can be omitted where it's no different.
+func unicodeName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasPrefix(name, "xn--") && !strings.Contains(name, ".xn--") {
+		return ""
+	}
+	u, err := idna.ToUnicode(name)
+	if err != nil || u == name {
+		return ""
+	}
+	return u
+}
+
+// Returns the name for display, followed by its unicode form in brackets if
+// it has punycode labels.
+func displayName(name string) string {
+	if u := unicodeName(name); u != "" {
+		return name + " (" + u + ")"
+	}
+	return name
+}
@@ -0,0 +1,15 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnicodeName(t *testing.T) {
+	require.Equal(t, "bücher.example.", unicodeName("xn--bcher-kva.example."))
+	require.Equal(t, "www.bücher.example.", unicodeName("www.XN--bcher-kva.example."))
+	require.Equal(t, "", unicodeName("example.com."))
+	require.Equal(t, "", unicodeName("xn--zz.example."))
+	require.Equal(t, "xn--bcher-kva.example. (bücher.example.)", displayName("xn--bcher-kva.example."))
+}
@@ -0,0 +1,316 @@
+package rdns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Location of the service account credentials in pods.
+const (
+	kubeServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeServiceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+const (
+	// Time to wait before listing or watching again after a failure.
+	kubeRetryInterval = 5 * time.Second
+
+	// Time after which the API server ends a watch, it's then resumed.
+	kubeWatchTimeout = 5 * time.Minute
+)
+
+// Returned when a watch can't be resumed and the resources need to be
+// listed again.
+var errKubeGone = errors.New("resource version too old")
+
+// Client for the Kubernetes API, limited to listing and watching resources.
+type kubeClient struct {
+	server    string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubeClient(opt KubernetesOptions) (*kubeClient, error) {
+	server, tokenFile, caFile := opt.Server, opt.TokenFile, opt.CAFile
+	if server == "" {
+		// Running in a pod, use the API server and service account of the
+		// cluster
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no kubernetes API server configured and not running in a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+		if tokenFile == "" {
+			tokenFile = kubeServiceAccountToken
+		}
+		if caFile == "" {
+			caFile = kubeServiceAccountCA
+		}
+	}
+	tlsConfig, err := TLSClientConfig(caFile, opt.ClientCrtFile, opt.ClientKeyFile, "")
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		server:    strings.TrimSuffix(server, "/"),
+		tokenFile: tokenFile,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}, nil
+}
+
+// Sends a GET request to the API. The token is read for every request since
+// service account tokens are rotated.
+func (c *kubeClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errKubeGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var status kubeStatus
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&status); err == nil && status.Message != "" {
+			return nil, fmt.Errorf("kubernetes API %s: %s", path, status.Message)
+		}
+		return nil, fmt.Errorf("kubernetes API %s: unexpected status code %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Resources read from the API, only the fields that are used.
+type kubeMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Type                     string   `json:"type"`
+		ClusterIP                string   `json:"clusterIP"`
+		ClusterIPs               []string `json:"clusterIPs"`
+		ExternalName             string   `json:"externalName"`
+		PublishNotReadyAddresses bool     `json:"publishNotReadyAddresses"`
+		Ports                    []struct {
+			Name     string `json:"name"`
+			Protocol string `json:"protocol"`
+			Port     uint16 `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeEndpointSlice struct {
+	Metadata  kubeMeta `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Hostname   string   `json:"hostname"`
+		Conditions struct {
+			Ready *bool `json:"ready"` // Unknown if nil, treated as ready
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name     string `json:"name"`
+		Protocol string `json:"protocol"`
+		Port     uint16 `json:"port"`
+	} `json:"ports"`
+}
+
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s kubeService) meta() kubeMeta       { return s.Metadata }
+func (s kubeEndpointSlice) meta() kubeMeta { return s.Metadata }
+
+type kubeObject interface {
+	kubeService | kubeEndpointSlice
+	meta() kubeMeta
+}
+
+// Keeps a copy of all resources of a type in a namespace, or all namespaces,
+// by listing and then watching them.
+type kubeWatcher[T kubeObject] struct {
+	client   *kubeClient
+	path     string
+	selector string
+	onChange func()
+	onStatus func(error)
+
+	mu     sync.RWMutex
+	items  map[string]T // By namespace/name
+	synced bool         // Resources were listed at least once
+}
+
+func newKubeWatcher[T kubeObject](client *kubeClient, path, selector string, onChange func(), onStatus func(error)) *kubeWatcher[T] {
+	return &kubeWatcher[T]{
+		client:   client,
+		path:     path,
+		selector: selector,
+		onChange: onChange,
+		onStatus: onStatus,
+		items:    make(map[string]T),
+	}
+}
+
+// Returns the resources and true if they were listed at least once.
+func (w *kubeWatcher[T]) snapshot() ([]T, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	items := make([]T, 0, len(w.items))
+	for _, item := range w.items {
+		items = append(items, item)
+	}
+	return items, w.synced
+}
+
+// Lists and watches the resources until the context is canceled.
+func (w *kubeWatcher[T]) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		version, err := w.list(ctx)
+		for err == nil {
+			w.onStatus(nil)
+			version, err = w.watch(ctx, version)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !errors.Is(err, errKubeGone) {
+			w.onStatus(err)
+			select {
+			case <-time.After(kubeRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Lists all resources, replacing those already known. Returns the version
+// to start watching from.
+func (w *kubeWatcher[T]) list(ctx context.Context) (string, error) {
+	query := url.Values{}
+	if w.selector != "" {
+		query.Set("labelSelector", w.selector)
+	}
+	resp, err := w.client.get(ctx, w.path, query)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata kubeMeta `json:"metadata"`
+		Items    []T      `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	items := make(map[string]T, len(list.Items))
+	for _, item := range list.Items {
+		items[kubeKey(item.meta())] = item
+	}
+	w.mu.Lock()
+	w.items = items
+	w.synced = true
+	w.mu.Unlock()
+	w.onChange()
+	return list.Metadata.ResourceVersion, nil
+}
+
+// Applies changes to the resources until the watch ends. Returns the version
+// to resume watching from.
+func (w *kubeWatcher[T]) watch(ctx context.Context, version string) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", version)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", fmt.Sprint(int(kubeWatchTimeout.Seconds())))
+	if w.selector != "" {
+		query.Set("labelSelector", w.selector)
+	}
+	resp, err := w.client.get(ctx, w.path, query)
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return version, nil // Watch timed out, resume it
+			}
+			return version, err
+		}
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return version, err
+			}
+			if status.Code == http.StatusGone {
+				return version, errKubeGone
+			}
+			return version, fmt.Errorf("kubernetes API %s: %s", w.path, status.Message)
+		}
+		var item T
+		if err := json.Unmarshal(event.Object, &item); err != nil {
+			return version, err
+		}
+		version = item.meta().ResourceVersion
+		w.mu.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.items[kubeKey(item.meta())] = item
+		case "DELETED":
+			delete(w.items, kubeKey(item.meta()))
+		default: // Bookmarks only move the version forward
+			w.mu.Unlock()
+			continue
+		}
+		w.mu.Unlock()
+		w.onChange()
+	}
+}
+
+func kubeKey(m kubeMeta) string {
+	return m.Namespace + "/" + m.Name
+}
@@ -0,0 +1,406 @@
+package rdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Kubernetes answers queries for names of services and pods in a Kubernetes
+// cluster, like the DNS service inside the cluster does, by watching the
+// services and endpoints in the API server. This allows resolving in-cluster
+// names from outside the cluster without forwarding queries to the cluster
+// DNS. Queries for names outside of the cluster domain are passed through.
+type Kubernetes struct {
+	id       string
+	resolver Resolver
+	opt      KubernetesOptions
+	zone     string
+	soa      *dns.SOA
+
+	services []*kubeWatcher[kubeService]
+	slices   []*kubeWatcher[kubeEndpointSlice]
+	mu       sync.Mutex // Serializes updates of the records
+	records  atomic.Pointer[kubeRecords]
+	cancel   context.CancelFunc
+	metrics  *KubernetesMetrics
+}
+
+// KubernetesOptions contain settings for the Kubernetes resolver.
+type KubernetesOptions struct {
+	// URL of the API server, like "https://k8s.example.com:6443". Defaults to
+	// the API server of the cluster if running in a pod.
+	Server string
+
+	// File with the bearer token used to authenticate. Re-read for every
+	// request since tokens can be rotated. Defaults to the token of the
+	// service account if running in a pod.
+	TokenFile string
+
+	// CA certificate to verify the API server with. Defaults to the CA of
+	// the service account if running in a pod.
+	CAFile string
+
+	// Client certificate and key used to authenticate, as alternative to a
+	// token.
+	ClientCrtFile string
+	ClientKeyFile string
+
+	// Domain of the cluster. Defaults to "cluster.local".
+	Domain string
+
+	// Namespaces to serve records for. All namespaces if empty.
+	Namespaces []string
+
+	// Only serve records for services matching the label selector, like
+	// "app=web,tier!=internal".
+	LabelSelector string
+
+	// Answer queries for pod names like "10-1-2-3.default.pod.cluster.local"
+	// with the address in the name, as the cluster DNS does.
+	PodRecords bool
+
+	// TTL of the records. Defaults to 5 seconds.
+	TTL uint32
+}
+
+type KubernetesMetrics struct {
+	// Queries answered from cluster records, by response code.
+	local *CounterMap
+	// Queries passed through to the resolver.
+	forwarded *Counter
+	// Number of services records are served for.
+	services *Gauge
+	// Failures to list or watch resources.
+	err *Counter
+}
+
+var _ Resolver = &Kubernetes{}
+
+// Label that links endpoint slices to their service.
+const kubeServiceNameLabel = "kubernetes.io/service-name"
+
+// NewKubernetes returns a resolver for names in a Kubernetes cluster. It
+// starts watching the API server in the background.
+func NewKubernetes(id string, resolver Resolver, opt KubernetesOptions) (*Kubernetes, error) {
+	if opt.Domain == "" {
+		opt.Domain = "cluster.local"
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 5
+	}
+	client, err := newKubeClient(opt)
+	if err != nil {
+		return nil, err
+	}
+	zone := dns.Fqdn(strings.ToLower(opt.Domain))
+	r := &Kubernetes{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		zone:     zone,
+		soa: &dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: opt.TTL},
+			Ns:      "ns.dns." + zone,
+			Mbox:    "hostmaster." + zone,
+			Serial:  1,
+			Refresh: 7200,
+			Retry:   1800,
+			Expire:  86400,
+			Minttl:  opt.TTL,
+		},
+		metrics: &KubernetesMetrics{
+			local:     getCounterMap("router", id, "local", "rcode"),
+			forwarded: getCounter("router", id, "forwarded"),
+			services:  getGauge("router", id, "services"),
+			err:       getCounter("router", id, "error"),
+		},
+	}
+
+	// Watch the whole cluster, or each of the namespaces
+	servicesPaths := []string{"/api/v1/services"}
+	slicesPaths := []string{"/apis/discovery.k8s.io/v1/endpointslices"}
+	if len(opt.Namespaces) > 0 {
+		servicesPaths, slicesPaths = nil, nil
+		for _, ns := range opt.Namespaces {
+			servicesPaths = append(servicesPaths, "/api/v1/namespaces/"+ns+"/services")
+			slicesPaths = append(slicesPaths, "/apis/discovery.k8s.io/v1/namespaces/"+ns+"/endpointslices")
+		}
+	}
+	for _, path := range servicesPaths {
+		r.services = append(r.services, newKubeWatcher[kubeService](client, path, opt.LabelSelector, r.update, r.watchStatus))
+	}
+	for _, path := range slicesPaths {
+		r.slices = append(r.slices, newKubeWatcher[kubeEndpointSlice](client, path, "", r.update, r.watchStatus))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	statusLoading(id, 1)
+	for _, w := range r.services {
+		go w.run(ctx)
+	}
+	for _, w := range r.slices {
+		go w.run(ctx)
+	}
+	return r, nil
+}
+
+// Resolve a DNS query. Queries for names in the cluster domain are answered
+// from the records of the cluster, all others are forwarded.
+func (r *Kubernetes) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	if !dns.IsSubDomain(r.zone, name) {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	a.RecursionAvailable = q.RecursionDesired
+	defer func() { r.metrics.local.Add(dns.RcodeToString[a.Rcode], 1) }()
+
+	records := r.records.Load()
+	if records == nil {
+		log.Debug("kubernetes records not loaded yet")
+		a.Rcode = dns.RcodeServerFailure
+		return a, nil
+	}
+	rrs, ok := records.names[name]
+	if !ok {
+		rrs, ok = r.podRecords(name)
+	}
+	if !ok {
+		log.Debug("name not found in cluster")
+		a.Rcode = dns.RcodeNameError
+		a.Ns = []dns.RR{records.soa}
+		return a, nil
+	}
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrtype == question.Qtype || rrtype == dns.TypeCNAME || question.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			a.Answer = append(a.Answer, rr)
+		}
+	}
+	if len(a.Answer) == 0 {
+		a.Ns = []dns.RR{records.soa}
+	}
+	log.Debug("answering query from kubernetes records", "answers", len(a.Answer))
+	return a, nil
+}
+
+func (r *Kubernetes) String() string {
+	return r.id
+}
+
+// Close stops watching the API server.
+func (r *Kubernetes) Close() error {
+	r.cancel()
+	return nil
+}
+
+// Records of a cluster, by lower-case name. Names without records, like
+// "svc.cluster.local.", exist with an empty list.
+type kubeRecords struct {
+	names map[string][]dns.RR
+	soa   *dns.SOA
+}
+
+// Builds the records from the current services and endpoints. Called by the
+// watchers whenever something changes.
+func (r *Kubernetes) update() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var services []kubeService
+	for _, w := range r.services {
+		items, synced := w.snapshot()
+		if !synced {
+			return // Not complete yet
+		}
+		services = append(services, items...)
+	}
+	slicesByService := make(map[string][]kubeEndpointSlice)
+	for _, w := range r.slices {
+		items, synced := w.snapshot()
+		if !synced {
+			return
+		}
+		for _, slice := range items {
+			key := slice.Metadata.Namespace + "/" + slice.Metadata.Labels[kubeServiceNameLabel]
+			slicesByService[key] = append(slicesByService[key], slice)
+		}
+	}
+
+	records := &kubeRecords{names: make(map[string][]dns.RR)}
+	for _, svc := range services {
+		r.addService(records, svc, slicesByService[kubeKey(svc.Metadata)])
+	}
+
+	// New serial, so secondary caches can tell the records changed
+	soa := dns.Copy(r.soa).(*dns.SOA)
+	soa.Serial = uint32(time.Now().Unix())
+	records.soa = soa
+	records.names[r.zone] = []dns.RR{soa}
+
+	if r.records.Swap(records) == nil {
+		statusLoading(r.id, -1)
+		Log.Info("loaded kubernetes records", "id", r.id, "services", len(services))
+	}
+	r.metrics.services.Set(int64(len(services)))
+}
+
+// Adds the records of a service and its endpoints.
+func (r *Kubernetes) addService(records *kubeRecords, svc kubeService, slices []kubeEndpointSlice) {
+	name := strings.ToLower(svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc." + r.zone)
+	records.add(r.zone, name, nil)
+	switch {
+	case svc.Spec.Type == "ExternalName":
+		records.add(r.zone, name, &dns.CNAME{
+			Hdr:    r.header(name, dns.TypeCNAME),
+			Target: dns.Fqdn(svc.Spec.ExternalName),
+		})
+	case svc.Spec.ClusterIP == "None":
+		// Headless services resolve to the addresses of their endpoints,
+		// endpoints with a hostname get their own name
+		for _, slice := range slices {
+			for _, ep := range slice.Endpoints {
+				if ep.Conditions.Ready != nil && !*ep.Conditions.Ready && !svc.Spec.PublishNotReadyAddresses {
+					continue
+				}
+				var host string
+				if ep.Hostname != "" {
+					host = strings.ToLower(ep.Hostname) + "." + name
+				}
+				for _, addr := range ep.Addresses {
+					records.add(r.zone, name, r.addressRecord(name, addr))
+					if host != "" {
+						records.add(r.zone, host, r.addressRecord(host, addr))
+					}
+				}
+				if host == "" {
+					continue
+				}
+				for _, port := range slice.Ports {
+					if port.Name != "" {
+						r.addSRV(records, name, port.Name, port.Protocol, port.Port, host)
+					}
+				}
+			}
+		}
+	default:
+		ips := svc.Spec.ClusterIPs
+		if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+			ips = []string{svc.Spec.ClusterIP}
+		}
+		for _, addr := range ips {
+			records.add(r.zone, name, r.addressRecord(name, addr))
+		}
+		for _, port := range svc.Spec.Ports {
+			if port.Name != "" {
+				r.addSRV(records, name, port.Name, port.Protocol, port.Port, name)
+			}
+		}
+	}
+}
+
+// Adds an SRV record for a named port of a service, like
+// "_http._tcp.web.default.svc.cluster.local.".
+func (r *Kubernetes) addSRV(records *kubeRecords, service, port, protocol string, number uint16, target string) {
+	if protocol == "" {
+		protocol = "TCP"
+	}
+	name := strings.ToLower("_" + port + "._" + protocol + "." + service)
+	records.add(r.zone, name, &dns.SRV{
+		Hdr:      r.header(name, dns.TypeSRV),
+		Priority: 0,
+		Weight:   100,
+		Port:     number,
+		Target:   target,
+	})
+}
+
+// Returns an A or AAAA record for the address, nil if it's invalid.
+func (r *Kubernetes) addressRecord(name, addr string) dns.RR {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: r.header(name, dns.TypeA), A: ip4}
+	}
+	return &dns.AAAA{Hdr: r.header(name, dns.TypeAAAA), AAAA: ip}
+}
+
+// Returns the record for a pod name like "10-1-2-3.default.pod.cluster.local."
+// with the address in the first label.
+func (r *Kubernetes) podRecords(name string) ([]dns.RR, bool) {
+	if !r.opt.PodRecords {
+		return nil, false
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, r.zone))
+	if len(labels) != 3 || labels[2] != "pod" {
+		return nil, false
+	}
+	if len(r.opt.Namespaces) > 0 && !slices.Contains(r.opt.Namespaces, labels[1]) {
+		return nil, false
+	}
+	rr := r.addressRecord(name, strings.ReplaceAll(labels[0], "-", "."))
+	if rr == nil {
+		rr = r.addressRecord(name, strings.ReplaceAll(labels[0], "-", ":"))
+	}
+	if rr == nil {
+		return nil, false
+	}
+	return []dns.RR{rr}, true
+}
+
+func (r *Kubernetes) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: r.opt.TTL}
+}
+
+// Records the state of the connection to the API server.
+func (r *Kubernetes) watchStatus(err error) {
+	if err != nil {
+		Log.Warn("failed to watch kubernetes API", "id", r.id, "error", err)
+		r.metrics.err.Add(1)
+		statusConnection(r.id, ConnectionFailed, fmt.Errorf("kubernetes API: %w", err))
+		return
+	}
+	statusConnection(r.id, ConnectionOpen, nil)
+}
+
+// Adds a record to a name, and makes sure all names between it and the zone
+// exist. The record can be nil to only add the name.
+func (k *kubeRecords) add(zone, name string, rr dns.RR) {
+	if rr != nil {
+		k.names[name] = append(k.names[name], rr)
+	} else if _, ok := k.names[name]; !ok {
+		k.names[name] = nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		parent := name[off:]
+		if parent == zone {
+			break
+		}
+		if _, ok := k.names[parent]; !ok {
+			k.names[parent] = nil
+		}
+	}
+}
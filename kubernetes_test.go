@@ -0,0 +1,165 @@
+package rdns
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal API server that lists resources and streams watch events.
+type testKubeAPI struct {
+	lists  map[string]string      // Path to list response
+	events map[string]chan string // Path to watch events
+	tokens chan string            // Bearer tokens of the requests
+}
+
+func (s *testKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case s.tokens <- r.Header.Get("Authorization"):
+	default:
+	}
+	list, ok := s.lists[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"kind":"Status","code":404,"message":"not found"}`)
+		return
+	}
+	if r.URL.Query().Get("watch") == "" {
+		fmt.Fprint(w, list)
+		return
+	}
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-s.events[r.URL.Path]:
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	const (
+		servicesPath = "/api/v1/namespaces/default/services"
+		slicesPath   = "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices"
+	)
+	api := &testKubeAPI{
+		lists: map[string]string{
+			servicesPath: `{"metadata":{"resourceVersion":"10"},"items":[
+				{"metadata":{"name":"web","namespace":"default"},"spec":{"type":"ClusterIP","clusterIP":"10.96.0.10","clusterIPs":["10.96.0.10","fd00::10"],"ports":[{"name":"http","protocol":"TCP","port":80}]}},
+				{"metadata":{"name":"db","namespace":"default"},"spec":{"clusterIP":"None","ports":[{"name":"pg","port":5432}]}},
+				{"metadata":{"name":"ext","namespace":"default"},"spec":{"type":"ExternalName","externalName":"db.example.com"}}
+			]}`,
+			slicesPath: `{"metadata":{"resourceVersion":"11"},"items":[
+				{"metadata":{"name":"db-abc","namespace":"default","labels":{"kubernetes.io/service-name":"db"}},"addressType":"IPv4",
+				 "endpoints":[
+				   {"addresses":["10.1.0.1"],"hostname":"db-0","conditions":{"ready":true}},
+				   {"addresses":["10.1.0.2"],"hostname":"db-1","conditions":{"ready":false}},
+				   {"addresses":["10.1.0.3"]}
+				 ],
+				 "ports":[{"name":"pg","protocol":"TCP","port":5432}]}
+			]}`,
+		},
+		events: map[string]chan string{
+			servicesPath: make(chan string, 1),
+			slicesPath:   make(chan string, 1),
+		},
+		tokens: make(chan string, 1),
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	upstream := new(TestResolver)
+	r, err := NewKubernetes("test-kubernetes", upstream, KubernetesOptions{
+		Server:     server.URL,
+		TokenFile:  tokenFile,
+		Namespaces: []string{"default"},
+		PodRecords: true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, "Bearer secret", <-api.tokens)
+	require.Eventually(t, func() bool { return r.records.Load() != nil }, time.Second, 10*time.Millisecond)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		rcode     int
+		answer    []string
+		forwarded bool
+	}{
+		{name: "web.default.svc.cluster.local.", qtype: dns.TypeA, answer: []string{"10.96.0.10"}},
+		{name: "Web.Default.svc.cluster.local.", qtype: dns.TypeAAAA, answer: []string{"fd00::10"}},
+		{name: "web.default.svc.cluster.local.", qtype: dns.TypeMX},
+		{name: "_http._tcp.web.default.svc.cluster.local.", qtype: dns.TypeSRV, answer: []string{"0 100 80 web.default.svc.cluster.local."}},
+		{name: "db.default.svc.cluster.local.", qtype: dns.TypeA, answer: []string{"10.1.0.1", "10.1.0.3"}},
+		{name: "db-0.db.default.svc.cluster.local.", qtype: dns.TypeA, answer: []string{"10.1.0.1"}},
+		{name: "db-1.db.default.svc.cluster.local.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "_pg._tcp.db.default.svc.cluster.local.", qtype: dns.TypeSRV, answer: []string{"0 100 5432 db-0.db.default.svc.cluster.local."}},
+		{name: "ext.default.svc.cluster.local.", qtype: dns.TypeA, answer: []string{"db.example.com."}},
+		{name: "default.svc.cluster.local.", qtype: dns.TypeA},
+		{name: "cluster.local.", qtype: dns.TypeSOA, answer: []string{"ns.dns.cluster.local."}},
+		{name: "missing.default.svc.cluster.local.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "10-1-0-5.default.pod.cluster.local.", qtype: dns.TypeA, answer: []string{"10.1.0.5"}},
+		{name: "10-1-0-5.other.pod.cluster.local.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "example.com.", qtype: dns.TypeA, forwarded: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits := upstream.HitCount()
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, test.qtype)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			if test.forwarded {
+				require.Equal(t, hits+1, upstream.HitCount())
+				return
+			}
+			require.Equal(t, hits, upstream.HitCount())
+			require.Equal(t, test.rcode, a.Rcode)
+			require.True(t, a.Authoritative)
+			var answer []string
+			for _, rr := range a.Answer {
+				require.Equal(t, test.name, rr.Header().Name)
+				answer = append(answer, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+			if len(test.answer) == 0 {
+				require.Empty(t, answer)
+				require.Len(t, a.Ns, 1)
+				return
+			}
+			for _, want := range test.answer {
+				require.Contains(t, strings.Join(answer, "\n"), want)
+			}
+			require.Len(t, answer, len(test.answer))
+		})
+	}
+
+	// Changes are picked up from the watch
+	api.events[servicesPath] <- `{"type":"ADDED","object":{"metadata":{"name":"new","namespace":"default","resourceVersion":"12"},"spec":{"clusterIP":"10.96.0.20"}}}`
+	api.events[servicesPath] <- `{"type":"DELETED","object":{"metadata":{"name":"web","namespace":"default","resourceVersion":"13"}}}`
+	rcode := func(name string) int {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a.Rcode
+	}
+	require.Eventually(t, func() bool {
+		return rcode("new.default.svc.cluster.local.") == dns.RcodeSuccess &&
+			rcode("web.default.svc.cluster.local.") == dns.RcodeNameError
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,9 +1,12 @@
 package rdns
 
 import (
-	"expvar"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+
+	"github.com/miekg/dns"
 )
 
 // Listener is an interface for a DNS listener.
@@ -12,6 +15,12 @@ type Listener interface {
 	fmt.Stringer
 }
 
+// StoppableListener is a listener that can be stopped and started again.
+type StoppableListener interface {
+	Listener
+	Stop() error
+}
+
 // ClientInfo carries information about the client making the request that
 // can be used to route requests.
 type ClientInfo struct {
@@ -24,31 +33,88 @@ type ClientInfo struct {
 	// TLS SNI server name
 	TLSServerName string
 
+	// Common name of the TLS client certificate, if the client presented one
+	TLSClientName string
+
 	// Listener ID of the listener that first received the request. Can be
 	// used to route queries.
 	Listener string
+
+	// Transport the query was received over by the listener, "udp", "tcp",
+	// "dot", "doh", "doq", "dtls" or "odoh".
+	Transport string
+
+	// The query was received over an encrypted transport. Not set for DoH
+	// without TLS, unless a trusted proxy received it over HTTPS.
+	Encrypted bool
+
+	// Number of elements the query has passed through so far. Maintained by
+	// DepthLimiter.
+	Depth int
+
+	// Metadata added by elements for downstream elements, see WithValue.
+	meta *metadata
 }
 
 // Metrics that are available from listeners and clients.
 type ListenerMetrics struct {
 	// DNS query count.
-	query *expvar.Int
+	query *Counter
 	// DNS response type counts.
-	response *expvar.Map
+	response *CounterMap
 	// Number of queries dropped (denied).
-	drop *expvar.Int
+	drop *Counter
 	// RouteDNS failure reason counts.
-	err *expvar.Map
+	err *CounterMap
 	// Maximum number of queries queued (optional).
-	maxQueueLen *expvar.Int
+	maxQueueLen *Gauge
+	// Time to respond to queries in seconds.
+	duration *Histogram
 }
 
 func NewListenerMetrics(base string, id string) *ListenerMetrics {
 	return &ListenerMetrics{
-		query:       getVarInt(base, id, "query"),
-		response:    getVarMap(base, id, "response"),
-		drop:        getVarInt(base, id, "drop"),
-		err:         getVarMap(base, id, "error"),
-		maxQueueLen: getVarInt(base, id, "maxqueue"),
+		query:       getCounter(base, id, "query"),
+		response:    getCounterMap(base, id, "response", "rcode"),
+		drop:        getCounter(base, id, "drop"),
+		err:         getCounterMap(base, id, "error", "reason"),
+		maxQueueLen: getGauge(base, id, "maxqueue"),
+		duration:    getHistogram(base, id, "duration", DefaultDurationBuckets),
+	}
+}
+
+// Length of the DNS message header, shorter messages are invalid.
+const dnsHeaderLen = 12
+
+var errQueryRejected = errors.New("query rejected")
+
+// Decodes a query received by a DoH, DoQ or ODoH listener. The header is
+// checked against the same rules the UDP and TCP listeners apply before the
+// message is decoded, so responses, messages with an unsupported opcode or
+// without exactly one question never reach the resolvers.
+func (opt ListenOptions) unpackQuery(b []byte) (*dns.Msg, error) {
+	if len(b) < dnsHeaderLen || len(b) > dns.MaxMsgSize {
+		return nil, fmt.Errorf("invalid message length %d", len(b))
+	}
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(b[0:]),
+		Bits:    binary.BigEndian.Uint16(b[2:]),
+		Qdcount: binary.BigEndian.Uint16(b[4:]),
+		Ancount: binary.BigEndian.Uint16(b[6:]),
+		Nscount: binary.BigEndian.Uint16(b[8:]),
+		Arcount: binary.BigEndian.Uint16(b[10:]),
+	}
+	if opt.acceptMsg(dh) != dns.MsgAccept {
+		return nil, errQueryRejected
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil, err
+	}
+	// The counts in the header can disagree with the records that were
+	// actually decoded
+	if len(q.Question) != 1 {
+		return nil, errQueryRejected
 	}
+	return q, nil
 }
@@ -0,0 +1,210 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	odoh "github.com/cloudflare/odoh-go"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Resolver for fuzz tests answering every query with a record.
+func fuzzResolver() *TestResolver {
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+}
+
+// Valid queries used as seed for the fuzz corpus.
+func fuzzSeedQueries(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, build := range []func(q *dns.Msg){
+		func(q *dns.Msg) {},
+		func(q *dns.Msg) { q.SetEdns0(1232, true) },
+		func(q *dns.Msg) {
+			q.SetEdns0(4096, false)
+			q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+		},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.com.", dns.TypeA)
+		build(q)
+		b, err := q.Pack()
+		require.NoError(f, err)
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+// Response writer recording the response of a DNS listener handler.
+type fuzzResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *fuzzResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *fuzzResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+func (w *fuzzResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *fuzzResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fuzzResponseWriter) Close() error                { return nil }
+func (w *fuzzResponseWriter) TsigStatus() error           { return nil }
+func (w *fuzzResponseWriter) TsigTimersOnly(bool)         {}
+func (w *fuzzResponseWriter) Hijack()                     {}
+
+// Queries over UDP and TCP are framed and decoded by the dns package, which
+// applies the same header checks as unpackQuery before passing them to the
+// listener handler.
+func FuzzDNSListener(f *testing.F) {
+	for _, b := range fuzzSeedQueries(f) {
+		f.Add(b)
+	}
+	handlers := map[string]dns.HandlerFunc{}
+	for _, protocol := range []string{"udp", "tcp", "dot"} {
+		handlers[protocol] = listenHandler("test-fuzz-"+protocol, protocol, "127.0.0.1:53", fuzzResolver(), ListenOptions{})
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		q, err := ListenOptions{}.unpackQuery(b)
+		if err != nil {
+			return
+		}
+		for protocol, handler := range handlers {
+			w := new(fuzzResponseWriter)
+			handler(w, q.Copy())
+			require.NotNil(t, w.msg)
+			p, err := w.msg.Pack()
+			if err != nil {
+				continue
+			}
+			// UDP responses have to fit the size the client advertised
+			if protocol == "udp" {
+				size := dns.MinMsgSize
+				if edns0 := q.IsEdns0(); edns0 != nil {
+					size = max(int(edns0.UDPSize()), dns.MinMsgSize)
+				}
+				require.LessOrEqual(t, len(p), max(size, len(b)), "response too large")
+			}
+		}
+	})
+}
+
+func FuzzDoHListener(f *testing.F) {
+	for _, b := range fuzzSeedQueries(f) {
+		f.Add(b, false)
+		f.Add([]byte(base64.RawURLEncoding.EncodeToString(b)), true)
+	}
+	f.Add([]byte("%%%"), true)
+	s, err := NewDoHListener("test-fuzz-doh", "127.0.0.1:0", DoHListenerOptions{}, fuzzResolver())
+	require.NoError(f, err)
+	f.Fuzz(func(t *testing.T, b []byte, get bool) {
+		var req *http.Request
+		if get {
+			req = httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			req.URL.RawQuery = "dns=" + string(b)
+		} else {
+			req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+			req.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+		}
+		w := httptest.NewRecorder()
+		s.dohHandler(w, req)
+		if w.Code == http.StatusOK {
+			a := new(dns.Msg)
+			require.NoError(t, a.Unpack(w.Body.Bytes()))
+		}
+	})
+}
+
+func FuzzDoQListener(f *testing.F) {
+	for _, b := range fuzzSeedQueries(f) {
+		f.Add(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...))
+	}
+	f.Add([]byte{0xff, 0xff, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		query, err := readDoQQuery(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		require.LessOrEqual(t, len(query), len(b)-2)
+		_, _ = ListenOptions{}.unpackQuery(query)
+	})
+}
+
+func FuzzODoHListener(f *testing.F) {
+	s, err := NewODoHListener("test-fuzz-odoh", "127.0.0.1:0", ODoHListenerOptions{}, fuzzResolver())
+	require.NoError(f, err)
+	for _, b := range fuzzSeedQueries(f) {
+		msg, _, err := s.odohKeyPair.Config.Contents.EncryptQuery(odoh.CreateObliviousDNSQuery(b, 0))
+		require.NoError(f, err)
+		f.Add(msg.Marshal())
+	}
+	// Length of the encrypted message overflowing the 16 bit length
+	f.Add([]byte{1, 0, 0, 0xff, 0xfe})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req := httptest.NewRequest(http.MethodPost, ODOH_QUERY_PATH, bytes.NewReader(b))
+		req.Header.Set("Content-Type", ODOH_CONTENT_TYPE)
+		w := httptest.NewRecorder()
+		s.ODoHqueryHandler(w, req)
+		_, _ = io.ReadAll(w.Body)
+	})
+}
+
+func TestUnpackQuery(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	_, err = ListenOptions{}.unpackQuery(b)
+	require.NoError(t, err)
+
+	// Too short
+	_, err = ListenOptions{}.unpackQuery(b[:11])
+	require.Error(t, err)
+
+	// Responses and queries without question are rejected
+	a := new(dns.Msg)
+	a.SetReply(q)
+	b, err = a.Pack()
+	require.NoError(t, err)
+	_, err = ListenOptions{}.unpackQuery(b)
+	require.Error(t, err)
+	b, err = new(dns.Msg).Pack()
+	require.NoError(t, err)
+	_, err = ListenOptions{}.unpackQuery(b)
+	require.Error(t, err)
+
+	// UPDATE messages are only accepted if enabled, NOTIFY always
+	u := new(dns.Msg)
+	u.SetUpdate("example.com.")
+	b, err = u.Pack()
+	require.NoError(t, err)
+	_, err = ListenOptions{}.unpackQuery(b)
+	require.Error(t, err)
+	_, err = ListenOptions{AcceptUpdate: true}.unpackQuery(b)
+	require.NoError(t, err)
+	n := new(dns.Msg)
+	n.SetNotify("example.com.")
+	b, err = n.Pack()
+	require.NoError(t, err)
+	_, err = ListenOptions{}.unpackQuery(b)
+	require.NoError(t, err)
+
+	// Length prefix of DoQ queries
+	_, err = readDoQQuery(bytes.NewReader([]byte{0xff, 0xff, 0x00}))
+	require.Error(t, err)
+}
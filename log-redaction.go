@@ -0,0 +1,161 @@
+package rdns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LogRedaction removes private information from query logs, so logging can
+// be enabled where names or clients are sensitive. Names in private zones are
+// hashed or truncated, client addresses are replaced with tokens, and queries
+// for some names aren't logged at all. A nil LogRedaction logs everything
+// unmodified.
+type LogRedaction struct {
+	opt   LogRedactionOptions
+	zones []string
+	key   []byte
+}
+
+// LogRedactionOptions contain the settings for redacting query logs.
+type LogRedactionOptions struct {
+	// Zones with private names, like "corp.example.com". The labels of
+	// names in these zones are redacted, the zone itself is logged.
+	PrivateZones []string
+
+	// How names in private zones are redacted. Defaults to RedactHash.
+	Mode RedactMode
+
+	// Replace client addresses with tokens. The same address always gets
+	// the same token as long as the key doesn't change.
+	TokenizeClients bool
+
+	// Key for the hashes of names and the tokens of clients. A random key
+	// is used if not set, so hashes and tokens change on restart.
+	Key string
+
+	// Queries matching this list aren't logged.
+	SkipDB BlocklistDB
+}
+
+// RedactMode defines how names in private zones are redacted.
+type RedactMode string
+
+const (
+	// Replace the labels below the zone with a hash of them, so queries for
+	// the same name can still be correlated.
+	RedactHash RedactMode = "hash"
+
+	// Replace the labels below the zone with "*".
+	RedactTruncate RedactMode = "truncate"
+)
+
+// Length of hashes and tokens in hex characters.
+const redactHashLen = 16
+
+// NewLogRedaction returns a new instance of log redaction rules.
+func NewLogRedaction(opt LogRedactionOptions) (*LogRedaction, error) {
+	switch opt.Mode {
+	case "":
+		opt.Mode = RedactHash
+	case RedactHash, RedactTruncate:
+	default:
+		return nil, fmt.Errorf("unsupported redaction mode %q", opt.Mode)
+	}
+	r := &LogRedaction{opt: opt}
+	for _, zone := range opt.PrivateZones {
+		r.zones = append(r.zones, strings.ToLower(dns.Fqdn(strings.TrimPrefix(zone, "."))))
+	}
+	if opt.Key != "" {
+		r.key = []byte(opt.Key)
+	} else {
+		r.key = make([]byte, 32)
+		if _, err := rand.Read(r.key); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Skip returns true if the query should not be logged.
+func (r *LogRedaction) Skip(q *dns.Msg) bool {
+	if r == nil || r.opt.SkipDB == nil || len(q.Question) == 0 {
+		return false
+	}
+	_, _, _, ok := r.opt.SkipDB.Match(q)
+	return ok
+}
+
+// Name returns the name as it should be logged. Names in private zones are
+// redacted, others are returned unmodified.
+func (r *LogRedaction) Name(name string) string {
+	if r == nil {
+		return name
+	}
+	lower := strings.ToLower(dns.Fqdn(name))
+	for _, zone := range r.zones {
+		if lower == zone || !dns.IsSubDomain(zone, lower) {
+			continue
+		}
+		// Labels below the zone, and the zone with a leading dot unless
+		// it's the root
+		suffix := "." + zone
+		if zone == "." {
+			suffix = "."
+		}
+		if r.opt.Mode == RedactTruncate {
+			return "*" + suffix
+		}
+		return r.hash(strings.TrimSuffix(lower, suffix)) + suffix
+	}
+	return name
+}
+
+// RR returns the record as it should be logged. The owner name and names in
+// the data of common record types are redacted if they're in private zones.
+// The record is copied if anything is redacted.
+func (r *LogRedaction) RR(rr dns.RR) dns.RR {
+	if r == nil || len(r.zones) == 0 {
+		return rr
+	}
+	rr = dns.Copy(rr)
+	rr.Header().Name = r.Name(rr.Header().Name)
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		rr.Target = r.Name(rr.Target)
+	case *dns.DNAME:
+		rr.Target = r.Name(rr.Target)
+	case *dns.NS:
+		rr.Ns = r.Name(rr.Ns)
+	case *dns.PTR:
+		rr.Ptr = r.Name(rr.Ptr)
+	case *dns.MX:
+		rr.Mx = r.Name(rr.Mx)
+	case *dns.SRV:
+		rr.Target = r.Name(rr.Target)
+	}
+	return rr
+}
+
+// Client returns the client address as it should be logged, a token if
+// clients are tokenized.
+func (r *LogRedaction) Client(ip net.IP) string {
+	if r == nil || !r.opt.TokenizeClients || ip == nil {
+		return ip.String()
+	}
+	return r.hash(NormalizeIP(ip).String())
+}
+
+// Returns a keyed hash of the value, so it can't be reversed by hashing
+// guessed values without the key.
+func (r *LogRedaction) hash(s string) string {
+	h := hmac.New(sha256.New, r.key)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:redactHashLen]
+}
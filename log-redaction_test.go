@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRedactionNames(t *testing.T) {
+	r, err := NewLogRedaction(LogRedactionOptions{
+		PrivateZones: []string{"corp.example.com"},
+		Key:          "secret",
+	})
+	require.NoError(t, err)
+
+	// Names outside the private zones, and the zone itself, are logged as is
+	require.Equal(t, "www.example.com.", r.Name("www.example.com."))
+	require.Equal(t, "corp.example.com.", r.Name("corp.example.com."))
+
+	// Names in the zone are hashed consistently, regardless of case
+	hashed := r.Name("Payroll.corp.example.com.")
+	require.True(t, strings.HasSuffix(hashed, ".corp.example.com."))
+	require.NotContains(t, hashed, "payroll")
+	require.Equal(t, hashed, r.Name("payroll.corp.example.com."))
+	require.NotEqual(t, hashed, r.Name("wiki.corp.example.com."))
+
+	// Names in records are redacted as well
+	rr, err := dns.NewRR("payroll.corp.example.com. 60 IN CNAME host1.corp.example.com.")
+	require.NoError(t, err)
+	redacted := r.RR(rr).(*dns.CNAME)
+	require.Equal(t, hashed, redacted.Hdr.Name)
+	require.Equal(t, r.Name("host1.corp.example.com."), redacted.Target)
+	require.Equal(t, "payroll.corp.example.com.", rr.Header().Name)
+
+	r, err = NewLogRedaction(LogRedactionOptions{
+		PrivateZones: []string{"corp.example.com", "."},
+		Mode:         RedactTruncate,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "*.corp.example.com.", r.Name("payroll.corp.example.com."))
+	require.Equal(t, "*.", r.Name("www.example.com."))
+
+	_, err = NewLogRedaction(LogRedactionOptions{Mode: "drop"})
+	require.Error(t, err)
+
+	// Without redaction, everything is logged
+	var none *LogRedaction
+	require.Equal(t, "payroll.corp.example.com.", none.Name("payroll.corp.example.com."))
+	require.Equal(t, "192.0.2.1", none.Client(net.ParseIP("192.0.2.1")))
+}
+
+func TestLogRedactionClients(t *testing.T) {
+	db, err := NewDomainDB("skip", NewStaticLoader([]string{".internal.test"}))
+	require.NoError(t, err)
+	r, err := NewLogRedaction(LogRedactionOptions{
+		TokenizeClients: true,
+		Key:             "secret",
+		SkipDB:          db,
+	})
+	require.NoError(t, err)
+
+	// Tokens are the same for the same client, also when IPv4-mapped
+	token := r.Client(net.ParseIP("192.0.2.1"))
+	require.Len(t, token, redactHashLen)
+	require.Equal(t, token, r.Client(net.ParseIP("::ffff:192.0.2.1")))
+	require.NotEqual(t, token, r.Client(net.ParseIP("192.0.2.2")))
+
+	// Tokens depend on the key
+	other, err := NewLogRedaction(LogRedactionOptions{TokenizeClients: true, Key: "other"})
+	require.NoError(t, err)
+	require.NotEqual(t, token, other.Client(net.ParseIP("192.0.2.1")))
+
+	q := new(dns.Msg)
+	q.SetQuestion("host.internal.test.", dns.TypeA)
+	require.True(t, r.Skip(q))
+	q.SetQuestion("example.com.", dns.TypeA)
+	require.False(t, r.Skip(q))
+}
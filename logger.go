@@ -11,10 +11,17 @@ import (
 var Log = slog.Default()
 
 func logger(id string, q *dns.Msg, ci ClientInfo) *slog.Logger {
-	return Log.With(
+	log := Log.With(
 		slog.String("id", id),
 		slog.Any("client", ci.SourceIP),
 		slog.String("qtype", dns.Type(q.Question[0].Qtype).String()),
 		slog.String("qname", qName(q)),
 	)
+	if u := unicodeName(qName(q)); u != "" {
+		log = log.With(slog.String("qname-unicode", u))
+	}
+	if group := ci.ClientGroup(); group != "" {
+		log = log.With(slog.String("client-group", group))
+	}
+	return log
 }
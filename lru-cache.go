@@ -10,6 +10,8 @@ import (
 
 type lruCache struct {
 	maxItems   int
+	maxBytes   int64 // Limit of the approximate memory used by items, unlimited if 0
+	bytes      int64 // Approximate memory used by all items
 	items      map[lruKey]*cacheItem
 	head, tail *cacheItem
 }
@@ -17,6 +19,7 @@ type lruCache struct {
 type cacheItem struct {
 	Key        lruKey
 	Answer     *cacheAnswer
+	size       int64 // Approximate memory used by the item
 	prev, next *cacheItem
 }
 
@@ -24,6 +27,7 @@ type lruKey struct {
 	Question dns.Question
 	Net      string
 	Do       bool
+	Cd       bool
 }
 
 type cacheAnswer struct {
@@ -64,7 +68,7 @@ func (c *cacheAnswer) UnmarshalJSON(data []byte) error {
 	return c.Msg.Unpack(aux.Msg)
 }
 
-func newLRUCache(capacity int) *lruCache {
+func newLRUCache(capacity int, maxBytes int64) *lruCache {
 	head := new(cacheItem)
 	tail := new(cacheItem)
 	head.next = tail
@@ -72,6 +76,7 @@ func newLRUCache(capacity int) *lruCache {
 
 	return &lruCache{
 		maxItems: capacity,
+		maxBytes: maxBytes,
 		items:    make(map[lruKey]*cacheItem),
 		head:     head,
 		tail:     tail,
@@ -84,23 +89,29 @@ func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) {
 }
 
 func (c *lruCache) addKey(key lruKey, answer *cacheAnswer) {
+	size := cacheItemSize(key, answer)
 	item := c.touch(key)
 	if item != nil {
 		// Update the item, it's already at the top of the list
 		// so we can just change the value
 		item.Answer = answer
+		c.bytes += size - item.size
+		item.size = size
+		c.resize()
 		return
 	}
 	// Add new item to the top of the linked list
 	item = &cacheItem{
 		Key:    key,
 		Answer: answer,
+		size:   size,
 		next:   c.head.next,
 		prev:   c.head,
 	}
 	c.head.next.prev = item
 	c.head.next = item
 	c.items[key] = item
+	c.bytes += size
 	c.resize()
 }
 
@@ -121,18 +132,30 @@ func (c *lruCache) touch(key lruKey) *cacheItem {
 }
 
 func (c *lruCache) delete(q *dns.Msg) {
-	key := lruKeyFromQuery(q)
+	c.deleteKey(lruKeyFromQuery(q))
+}
+
+func (c *lruCache) deleteKey(key lruKey) {
 	item := c.items[key]
 	if item == nil {
 		return
 	}
+	c.remove(item)
+}
+
+// Removes an item from the list and the map.
+func (c *lruCache) remove(item *cacheItem) {
 	item.prev.next = item.next
 	item.next.prev = item.prev
-	delete(c.items, key)
+	delete(c.items, item.Key)
+	c.bytes -= item.size
 }
 
 func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
-	key := lruKeyFromQuery(query)
+	return c.getKey(lruKeyFromQuery(query))
+}
+
+func (c *lruCache) getKey(key lruKey) *cacheAnswer {
 	item := c.touch(key)
 	if item != nil {
 		return item.Answer
@@ -140,17 +163,12 @@ func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
 	return nil
 }
 
-// Shrink the cache down to the maximum number of items.
+// Shrink the cache down to the maximum number of items and memory by
+// removing the least-recently used ones.
 func (c *lruCache) resize() {
-	if c.maxItems <= 0 { // no size limit
-		return
-	}
-	drop := len(c.items) - c.maxItems
-	for i := 0; i < drop; i++ {
-		item := c.tail.prev
-		item.prev.next = c.tail
-		c.tail.prev = item.prev
-		delete(c.items, item.Key)
+	for c.tail.prev != c.head &&
+		((c.maxItems > 0 && len(c.items) > c.maxItems) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.remove(c.tail.prev)
 	}
 }
 
@@ -164,6 +182,7 @@ func (c *lruCache) reset() {
 	c.head = head
 	c.tail = tail
 	c.items = make(map[lruKey]*cacheItem)
+	c.bytes = 0
 }
 
 // Iterate over the cached answers and call the provided function. If it
@@ -172,9 +191,7 @@ func (c *lruCache) deleteFunc(f func(*cacheAnswer) bool) {
 	item := c.head.next
 	for item != c.tail {
 		if f(item.Answer) {
-			item.prev.next = item.next
-			item.next.prev = item.prev
-			delete(c.items, item.Key)
+			c.remove(item)
 		}
 		item = item.next
 	}
@@ -184,6 +201,16 @@ func (c *lruCache) size() int {
 	return len(c.items)
 }
 
+// Returns the approximate memory used by the cached items.
+func (c *lruCache) memoryUsage() int64 {
+	return c.bytes
+}
+
+// Returns the approximate memory used by a cache item.
+func cacheItemSize(key lruKey, answer *cacheAnswer) int64 {
+	return cacheItemOverhead + int64(len(key.Question.Name)+len(key.Net)) + msgMemoryUsage(answer.Msg)
+}
+
 func (c *lruCache) serialize(w io.Writer) error {
 	enc := json.NewEncoder(w)
 	for item := c.tail.prev; item != c.head; item = item.prev {
@@ -194,24 +221,8 @@ func (c *lruCache) serialize(w io.Writer) error {
 	return nil
 }
 
-func (c *lruCache) deserialize(r io.Reader) error {
-	dec := json.NewDecoder(r)
-	for dec.More() {
-		item := new(cacheItem)
-		if err := dec.Decode(item); err != nil {
-			return err
-		}
-		// Skip bad (or incompatible) records
-		if item.Key.Question.Name == "" || item.Answer == nil {
-			continue
-		}
-		c.addKey(item.Key, item.Answer)
-	}
-	return nil
-}
-
 func lruKeyFromQuery(q *dns.Msg) lruKey {
-	key := lruKey{Question: q.Question[0]}
+	key := lruKey{Question: q.Question[0], Cd: q.CheckingDisabled}
 
 	edns0 := q.IsEdns0()
 	if edns0 != nil {
@@ -10,7 +10,7 @@ import (
 )
 
 func TestLRUAddGet(t *testing.T) {
-	c := newLRUCache(5)
+	c := newLRUCache(5, 0)
 
 	type item struct {
 		query  *dns.Msg
@@ -66,3 +66,46 @@ func TestLRUAddGet(t *testing.T) {
 	})
 	require.Equal(t, 2, c.size())
 }
+
+func TestLRUMaxBytes(t *testing.T) {
+	newAnswer := func(name string, records int) (*dns.Msg, *cacheAnswer) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		for i := range records {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{127, 0, 0, byte(i)},
+			})
+		}
+		return msg, &cacheAnswer{Msg: msg}
+	}
+	q1, a1 := newAnswer("test1.com.", 1)
+	q2, a2 := newAnswer("test2.com.", 1)
+	q3, a3 := newAnswer("test3.com.", 20)
+	small := cacheItemSize(lruKeyFromQuery(q1), a1)
+	large := cacheItemSize(lruKeyFromQuery(q3), a3)
+	require.Greater(t, large, 2*small)
+
+	// Room for the large item and one small one
+	c := newLRUCache(0, large+small)
+	c.add(q1, a1)
+	c.add(q2, a2)
+	require.Equal(t, 2*small, c.memoryUsage())
+
+	// Adding the large item evicts the least-recently used small one
+	c.get(q1)
+	c.add(q3, a3)
+	require.Equal(t, 2, c.size())
+	require.Equal(t, large+small, c.memoryUsage())
+	require.NotNil(t, c.get(q1))
+	require.Nil(t, c.get(q2))
+
+	// Replacing an item updates the usage
+	c.add(q3, a2)
+	require.Equal(t, 2*small, c.memoryUsage())
+
+	c.delete(q1)
+	require.Equal(t, small, c.memoryUsage())
+	c.reset()
+	require.Equal(t, int64(0), c.memoryUsage())
+}
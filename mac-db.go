@@ -50,10 +50,28 @@ func (m *MACDB) Reload() (BlocklistDB, error) {
 }
 
 func (m *MACDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool) {
+	opt65001 := queryMAC(msg)
+	if opt65001 == nil {
+		return nil, nil, nil, false
+	}
+
+	// Match against the MAC addresses on the blocklist
+	for _, mac := range m.macs {
+		if bytes.Equal(mac, opt65001) {
+			return nil, nil, &BlocklistMatch{List: m.name, Rule: hex.EncodeToString(mac)}, true
+		}
+
+	}
+	return nil, nil, nil, false
+}
+
+// Returns the MAC address of the client in the EDNS0 option 65001 of a
+// query, or nil if there isn't one.
+func queryMAC(msg *dns.Msg) []byte {
 	// Do we have an EDNS0 record?
 	edns0 := msg.IsEdns0()
 	if edns0 == nil {
-		return nil, nil, nil, false
+		return nil
 	}
 
 	// Check if there's an option 65001 in it
@@ -73,26 +91,22 @@ func (m *MACDB) Match(msg *dns.Msg) ([]net.IP, []string, *BlocklistMatch, bool)
 		}
 		opt65001 = local.Data
 	}
-
-	// Did we find a EDNS0 record with option 65001
-	if len(opt65001) != 6 {
-		return nil, nil, nil, false
-	}
-
-	// Match against the MAC addresses on the blocklist
-	for _, mac := range m.macs {
-		if bytes.Equal(mac, opt65001) {
-			return nil, nil, &BlocklistMatch{List: m.name, Rule: hex.EncodeToString(mac)}, true
-		}
-
-	}
-	return nil, nil, nil, false
+	return opt65001
 }
 
 func (m *MACDB) Close() error {
 	return nil
 }
 
+// Returns the approximate memory used by the addresses.
+func (m *MACDB) memoryUsage() int64 {
+	size := int64(sliceOverhead)
+	for _, mac := range m.macs {
+		size += sliceOverhead + int64(len(mac))
+	}
+	return size
+}
+
 func (m *MACDB) String() string {
 	return "MAC-blocklist"
 }
@@ -0,0 +1,378 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MDNSReflector repeats multicast DNS packets received on one interface on
+// all others, so services can be discovered across network segments, like
+// VLANs, that are otherwise separated. Optionally only packets for some
+// services, like printers, are reflected.
+type MDNSReflector struct {
+	id       string
+	opt      MDNSReflectorOptions
+	services []string // Lower-case service names in the "local." zone
+	metrics  *MDNSReflectorMetrics
+
+	// Host names of allowed service instances, and until when they are
+	// allowed.
+	mu    sync.Mutex
+	hosts map[string]time.Time
+
+	// Addresses of the host, to skip packets sent by local mDNS services.
+	localMu      sync.Mutex
+	localAddrs   map[string]struct{}
+	localExpires time.Time
+}
+
+type MDNSReflectorOptions struct {
+	// Names of the interfaces to reflect packets between, at least two.
+	Interfaces []string
+
+	// Services to reflect, like "_ipp._tcp". All packets are reflected if
+	// empty.
+	Services []string
+
+	// Reflect IPv4 (4), IPv6 (6) or both (0) mDNS groups.
+	IPVersion int
+}
+
+type MDNSReflectorMetrics struct {
+	// Packets reflected, by receiving interface.
+	reflected *CounterMap
+	// Packets not reflected because they aren't for any of the services.
+	filtered *Counter
+	// Packets that failed to parse or send.
+	err *CounterMap
+}
+
+// Time host names of service instances are reflected for if the TTL of the
+// SRV record is shorter.
+const mdnsMinHostTTL = 2 * time.Minute
+
+// How long the addresses of the host are cached for.
+const mdnsLocalAddrTTL = 30 * time.Second
+
+// Name queried to list the services on the network (RFC6763).
+const mdnsServiceEnumeration = "_services._dns-sd._udp.local."
+
+var _ Listener = &MDNSReflector{}
+
+// Connection on the mDNS port of one of the IP families.
+type mdnsPacketConn interface {
+	// Reads a packet and returns the interface it was received on.
+	readFrom(b []byte) (int, int, *net.UDPAddr, error)
+	// Sends a packet to the group on an interface.
+	writeTo(b []byte, ifIndex int) error
+}
+
+// NewMDNSReflector returns a reflector for mDNS packets between interfaces.
+func NewMDNSReflector(id string, opt MDNSReflectorOptions) (*MDNSReflector, error) {
+	if len(opt.Interfaces) < 2 {
+		return nil, errors.New("mdns reflector requires at least two interfaces")
+	}
+	switch opt.IPVersion {
+	case 0, 4, 6:
+	default:
+		return nil, fmt.Errorf("invalid ip version %d", opt.IPVersion)
+	}
+	r := &MDNSReflector{
+		id:  id,
+		opt: opt,
+		metrics: &MDNSReflectorMetrics{
+			reflected: getCounterMap("listener", id, "reflected", "interface"),
+			filtered:  getCounter("listener", id, "filtered"),
+			err:       getCounterMap("listener", id, "error", "reason"),
+		},
+		hosts: make(map[string]time.Time),
+	}
+	for _, service := range opt.Services {
+		s := strings.ToLower(strings.Trim(service, "."))
+		s = strings.TrimSuffix(s, ".local")
+		if s == "" {
+			return nil, fmt.Errorf("invalid mdns service '%s'", service)
+		}
+		r.services = append(r.services, s+".local.")
+	}
+	return r, nil
+}
+
+// Start reflecting packets. Blocks until reading from the interfaces fails.
+func (r *MDNSReflector) Start() error {
+	Log.Info("starting listener",
+		"id", r.id,
+		"protocol", "mdns-reflector",
+		"interfaces", strings.Join(r.opt.Interfaces, ","))
+	var ifaces []net.Interface
+	for _, name := range r.opt.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("interface '%s': %w", name, err)
+		}
+		ifaces = append(ifaces, *ifi)
+	}
+	var networks []string
+	if r.opt.IPVersion != 6 {
+		networks = append(networks, "udp4")
+	}
+	if r.opt.IPVersion != 4 {
+		networks = append(networks, "udp6")
+	}
+	errs := make(chan error, len(networks))
+	for _, network := range networks {
+		go func() {
+			errs <- r.run(network, ifaces)
+		}()
+	}
+	// With both families, keep going with one if the other isn't available
+	var err error
+	for range networks {
+		if err = <-errs; r.opt.IPVersion != 0 {
+			return err
+		}
+		Log.Warn("failed to reflect mdns packets", "id", r.id, "error", err)
+	}
+	return err
+}
+
+func (r *MDNSReflector) String() string {
+	return r.id
+}
+
+// Reflects the packets of one IP family.
+func (r *MDNSReflector) run(network string, ifaces []net.Interface) error {
+	conn, err := listenMDNS(network, ifaces)
+	if err != nil {
+		return fmt.Errorf("mdns reflector %s: %w", network, err)
+	}
+	defer conn.Close()
+	var pc mdnsPacketConn
+	if network == "udp6" {
+		p := ipv6.NewPacketConn(conn)
+		if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+			return err
+		}
+		// Don't receive the reflected packets again
+		if err := p.SetMulticastLoopback(false); err != nil {
+			return err
+		}
+		if err := p.SetMulticastHopLimit(255); err != nil {
+			return err
+		}
+		pc = mdnsPacketConn6{p}
+	} else {
+		p := ipv4.NewPacketConn(conn)
+		if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			return err
+		}
+		if err := p.SetMulticastLoopback(false); err != nil {
+			return err
+		}
+		if err := p.SetMulticastTTL(255); err != nil {
+			return err
+		}
+		pc = mdnsPacketConn4{p}
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, src, err := pc.readFrom(buf)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(ifaces, func(ifi net.Interface) bool { return ifi.Index == ifIndex })
+		if i < 0 || src.Port != mdnsPort || r.isLocal(src.IP) {
+			// Not from one of the interfaces, a one-shot query that the
+			// response can't be reflected for, or from an mDNS service on
+			// this host which sends on all interfaces itself
+			continue
+		}
+		b, ok := r.filter(buf[:n], time.Now())
+		if !ok {
+			continue
+		}
+		r.metrics.reflected.Add(ifaces[i].Name, 1)
+		for _, ifi := range ifaces {
+			if ifi.Index == ifIndex {
+				continue
+			}
+			if err := pc.writeTo(b, ifi.Index); err != nil {
+				Log.Debug("failed to reflect mdns packet", "id", r.id, "interface", ifi.Name, "error", err)
+				r.metrics.err.Add("send", 1)
+			}
+		}
+	}
+}
+
+// Returns the packet to reflect, or false if it isn't reflected. Unicast
+// responses to reflected queries couldn't be reflected back, so the
+// unicast-response bits of queries are cleared. With services configured,
+// only the questions and records related to them are reflected.
+func (r *MDNSReflector) filter(b []byte, now time.Time) ([]byte, bool) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		r.metrics.err.Add("parse", 1)
+		return nil, false
+	}
+	if len(r.services) > 0 {
+		r.learnHosts(msg, now)
+		if !msg.Response {
+			msg.Question = slices.DeleteFunc(msg.Question, func(q dns.Question) bool { return !r.allowed(q.Name, "", now) })
+			if len(msg.Question) == 0 {
+				r.metrics.filtered.Add(1)
+				return nil, false
+			}
+		}
+		msg.Answer = r.filterRecords(msg.Answer, now)
+		msg.Ns = r.filterRecords(msg.Ns, now)
+		msg.Extra = r.filterRecords(msg.Extra, now)
+		if msg.Response && len(msg.Answer) == 0 {
+			r.metrics.filtered.Add(1)
+			return nil, false
+		}
+	} else if msg.Response {
+		return b, true
+	}
+	for i := range msg.Question {
+		msg.Question[i].Qclass &^= mdnsClassBit
+	}
+	msg.Compress = true
+	out, err := msg.Pack()
+	if err != nil {
+		r.metrics.err.Add("parse", 1)
+		return nil, false
+	}
+	return out, true
+}
+
+// Returns the records related to the services.
+func (r *MDNSReflector) filterRecords(rrs []dns.RR, now time.Time) []dns.RR {
+	return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			return false
+		}
+		var target string
+		if ptr, ok := rr.(*dns.PTR); ok {
+			target = ptr.Ptr
+		}
+		return !r.allowed(rr.Header().Name, target, now)
+	})
+}
+
+// Returns true if a name, or the target of a PTR record, belongs to one of
+// the services, or is the host name of an instance of them.
+func (r *MDNSReflector) allowed(name, target string, now time.Time) bool {
+	name = strings.ToLower(name)
+	target = strings.ToLower(target)
+	for _, s := range r.services {
+		if mdnsInZone(name, s) || (target != "" && mdnsInZone(target, s)) {
+			return true
+		}
+	}
+	// Queries for the list of services are reflected, the PTR records of
+	// the responses only for the services
+	if name == mdnsServiceEnumeration {
+		return target == ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.hosts[name]
+	return ok && now.Before(until)
+}
+
+// Remembers the host names of instances of the services from SRV records, so
+// queries and records for their addresses are reflected as well.
+func (r *MDNSReflector) learnHosts(msg *dns.Msg, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rr := range slices.Concat(msg.Answer, msg.Ns, msg.Extra) {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(srv.Hdr.Name)
+		if !slices.ContainsFunc(r.services, func(s string) bool { return mdnsInZone(name, s) }) {
+			continue
+		}
+		ttl := max(time.Duration(srv.Hdr.Ttl)*time.Second, mdnsMinHostTTL)
+		r.hosts[strings.ToLower(srv.Target)] = now.Add(ttl)
+	}
+	for name, until := range r.hosts {
+		if now.After(until) {
+			delete(r.hosts, name)
+		}
+	}
+}
+
+// Returns true if the address is one of the host's.
+func (r *MDNSReflector) isLocal(ip net.IP) bool {
+	r.localMu.Lock()
+	defer r.localMu.Unlock()
+	if time.Now().After(r.localExpires) {
+		r.localAddrs = make(map[string]struct{})
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			Log.Warn("failed to read local addresses", "id", r.id, "error", err)
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				r.localAddrs[n.IP.String()] = struct{}{}
+			}
+		}
+		r.localExpires = time.Now().Add(mdnsLocalAddrTTL)
+	}
+	_, ok := r.localAddrs[ip.String()]
+	return ok
+}
+
+type mdnsPacketConn4 struct {
+	*ipv4.PacketConn
+}
+
+func (c mdnsPacketConn4) readFrom(b []byte) (int, int, *net.UDPAddr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	addr, _ := src.(*net.UDPAddr)
+	if cm == nil || addr == nil {
+		return n, 0, &net.UDPAddr{}, nil
+	}
+	return n, cm.IfIndex, addr, nil
+}
+
+func (c mdnsPacketConn4) writeTo(b []byte, ifIndex int) error {
+	_, err := c.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, mdnsGroup4)
+	return err
+}
+
+type mdnsPacketConn6 struct {
+	*ipv6.PacketConn
+}
+
+func (c mdnsPacketConn6) readFrom(b []byte) (int, int, *net.UDPAddr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	addr, _ := src.(*net.UDPAddr)
+	if cm == nil || addr == nil {
+		return n, 0, &net.UDPAddr{}, nil
+	}
+	return n, cm.IfIndex, addr, nil
+}
+
+func (c mdnsPacketConn6) writeTo(b []byte, ifIndex int) error {
+	_, err := c.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex}, mdnsGroup6)
+	return err
+}
@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSReflectorFilter(t *testing.T) {
+	r, err := NewMDNSReflector("test-mdns-reflector", MDNSReflectorOptions{
+		Interfaces: []string{"lan", "iot"},
+		Services:   []string{"_ipp._tcp"},
+	})
+	require.NoError(t, err)
+	now := time.Now()
+
+	pack := func(msg *dns.Msg) []byte {
+		b, err := msg.Pack()
+		require.NoError(t, err)
+		return b
+	}
+	unpack := func(b []byte) *dns.Msg {
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(b))
+		return msg
+	}
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 120}
+	}
+
+	// Queries for other services and hosts aren't reflected
+	q := new(dns.Msg)
+	q.Question = []dns.Question{
+		{Name: "_airplay._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	_, ok := r.filter(pack(q), now)
+	require.False(t, ok)
+
+	// Only questions for the service are reflected, without the
+	// unicast-response bit
+	q.Question = append(q.Question, dns.Question{Name: "_IPP._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET | mdnsClassBit})
+	b, ok := r.filter(pack(q), now)
+	require.True(t, ok)
+	out := unpack(b)
+	require.Len(t, out.Question, 1)
+	require.Equal(t, uint16(dns.ClassINET), out.Question[0].Qclass)
+
+	// Responses are limited to records of the service, and the host names
+	// of its instances
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Answer = []dns.RR{
+		&dns.PTR{Hdr: hdr("_ipp._tcp.local.", dns.TypePTR), Ptr: "Office._ipp._tcp.local."},
+		&dns.PTR{Hdr: hdr("_services._dns-sd._udp.local.", dns.TypePTR), Ptr: "_ipp._tcp.local."},
+		&dns.PTR{Hdr: hdr("_services._dns-sd._udp.local.", dns.TypePTR), Ptr: "_airplay._tcp.local."},
+	}
+	resp.Extra = []dns.RR{
+		&dns.SRV{Hdr: hdr("Office._ipp._tcp.local.", dns.TypeSRV), Port: 631, Target: "printer.local."},
+		&dns.A{Hdr: hdr("printer.local.", dns.TypeA), A: net.IPv4(192, 168, 1, 10)},
+		&dns.A{Hdr: hdr("tv.local.", dns.TypeA), A: net.IPv4(192, 168, 1, 11)},
+	}
+	b, ok = r.filter(pack(resp), now)
+	require.True(t, ok)
+	out = unpack(b)
+	require.Len(t, out.Answer, 2)
+	require.Len(t, out.Extra, 2)
+
+	// Now that the host is known, queries for it are reflected too
+	q.Question = []dns.Question{{Name: "printer.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	_, ok = r.filter(pack(q), now)
+	require.True(t, ok)
+	_, ok = r.filter(pack(q), now.Add(time.Hour))
+	require.False(t, ok)
+
+	// Without services, all packets are reflected
+	r, err = NewMDNSReflector("test-mdns-reflector-all", MDNSReflectorOptions{Interfaces: []string{"lan", "iot"}})
+	require.NoError(t, err)
+	b, ok = r.filter(pack(resp), now)
+	require.True(t, ok)
+	require.Equal(t, pack(resp), b)
+}
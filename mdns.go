@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Multicast DNS (RFC6762) groups and port.
+const mdnsPort = 5353
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+// The top bit of the class is the unicast-response bit in mDNS questions and
+// the cache-flush bit in records.
+const mdnsClassBit = 1 << 15
+
+// Opens a UDP socket on the mDNS port and joins the group on the interfaces.
+// The port is shared with other mDNS services on the host, like avahi, where
+// the platform supports it.
+func listenMDNS(network string, ifaces []net.Interface) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: mdnsControl}
+	c, err := lc.ListenPacket(context.Background(), network, ":5353")
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UDPConn)
+	var errs []error
+	for _, ifi := range ifaces {
+		if network == "udp6" {
+			err = ipv6.NewPacketConn(conn).JoinGroup(&ifi, mdnsGroup6)
+		} else {
+			err = ipv4.NewPacketConn(conn).JoinGroup(&ifi, mdnsGroup4)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Only fail if the group couldn't be joined at all, interfaces may not
+	// have addresses of both families
+	if len(errs) > 0 && len(errs) == len(ifaces) {
+		conn.Close()
+		return nil, errors.Join(errs...)
+	}
+	return conn, nil
+}
+
+// Sets the options to share the mDNS port on new sockets. Failing to set them
+// is logged, binding the port then fails if it's already in use.
+func mdnsControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setMDNSSockopts(fd)
+	}); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		Log.Warn("unable to share the mdns port with other services", "addr", address, "error", err)
+	}
+	return nil
+}
+
+// Returns true if the name is in the zone. Both are expected to be lower-case
+// and fully qualified.
+func mdnsInZone(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// Removes the cache-flush bit from the class of the records.
+func mdnsClearCacheFlush(rrs []dns.RR) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Class &^= mdnsClassBit
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package rdns
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allows other sockets, like those of avahi, to bind the mDNS port as well.
+// Multicast packets are delivered to all of them.
+func setMDNSSockopts(fd uintptr) error {
+	return errors.Join(
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1),
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1),
+	)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rdns
+
+import "errors"
+
+// Sharing the mDNS port is only supported on Linux.
+func setMDNSSockopts(fd uintptr) error {
+	return errors.New("sharing the mdns port is not supported on this platform")
+}
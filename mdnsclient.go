@@ -0,0 +1,367 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MDNSClient resolves queries with multicast DNS (RFC6762), typically for
+// names in the "local." zone, by sending them to the mDNS group and waiting
+// for the first response that answers the question.
+type MDNSClient struct {
+	id      string
+	group   *net.UDPAddr
+	network string
+	ifi     *net.Interface
+	opt     MDNSClientOptions
+	metrics *MDNSClientMetrics
+	cache   *mdnsCache
+}
+
+// Modes of sending mDNS queries.
+const (
+	// One-shot queries from a random port, asking for unicast responses.
+	MDNSModeQU = "qu"
+
+	// Standard queries from the mDNS port, responses are multicast and
+	// update the caches of all mDNS stacks on the network.
+	MDNSModeQM = "qm"
+)
+
+type MDNSClientOptions struct {
+	// How queries are sent, MDNSModeQU (default) or MDNSModeQM.
+	Mode string
+
+	// Name of the interface to send queries on. Chosen by the routing table
+	// if empty.
+	Interface string
+
+	// Time to wait for a response. Defaults to 1 second.
+	QueryTimeout time.Duration
+
+	// Maximum time responses are cached, limited by the TTL of their
+	// records. Queries nothing responded to are cached for the same time.
+	// Defaults to 10 seconds, negative values disable the cache.
+	CacheTTL time.Duration
+
+	// Source of time for the cache. Defaults to the system clock.
+	Clock Clock
+}
+
+type MDNSClientMetrics struct {
+	// Queries sent.
+	query *Counter
+	// Queries without a response before the timeout.
+	noAnswer *Counter
+	// Queries answered from the cache.
+	cacheHit *Counter
+}
+
+var _ Resolver = &MDNSClient{}
+
+// NewMDNSClient returns a resolver that sends queries to an mDNS group,
+// like "224.0.0.251:5353" or "[ff02::fb]:5353".
+func NewMDNSClient(id, endpoint string, opt MDNSClientOptions) (*MDNSClient, error) {
+	switch opt.Mode {
+	case "":
+		opt.Mode = MDNSModeQU
+	case MDNSModeQU, MDNSModeQM:
+	default:
+		return nil, fmt.Errorf("unsupported mdns mode '%s'", opt.Mode)
+	}
+	if opt.QueryTimeout == 0 {
+		opt.QueryTimeout = time.Second
+	}
+	if opt.CacheTTL == 0 {
+		opt.CacheTTL = 10 * time.Second
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	group, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	var ifi *net.Interface
+	if opt.Interface != "" {
+		ifi, err = net.InterfaceByName(opt.Interface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &MDNSClient{
+		id:      id,
+		group:   group,
+		network: network,
+		ifi:     ifi,
+		opt:     opt,
+		metrics: &MDNSClientMetrics{
+			query:    getCounter("client", id, "query"),
+			noAnswer: getCounter("client", id, "noanswer"),
+			cacheHit: getCounter("client", id, "cache-hit"),
+		},
+	}
+	if opt.CacheTTL > 0 {
+		c.cache = newMDNSCache(opt.CacheTTL, opt.Clock)
+	}
+	return c, nil
+}
+
+// Resolve a DNS query. Queries that nothing on the network responds to
+// before the timeout are answered with NXDOMAIN. PTR queries for addresses
+// of names that were resolved recently are answered from the cache.
+func (c *MDNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, c.id)
+	defer recordTiming(ci, "upstream", c.id, time.Now())
+	if len(q.Question) != 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	log := logger(c.id, q, ci).With("resolver", c.group.String(), "protocol", "mdns", "mode", c.opt.Mode)
+	if c.cache != nil {
+		if a, ok := c.cache.get(q); ok {
+			log.Debug("cache-hit")
+			c.metrics.cacheHit.Add(1)
+			return a, nil
+		}
+	}
+	log.Debug("sending query")
+	c.metrics.query.Add(1)
+
+	query := new(dns.Msg)
+	query.Question = []dns.Question{question}
+	if c.opt.Mode == MDNSModeQU {
+		// Responders echo the ID of one-shot queries, it's 0 otherwise
+		query.Id = dns.Id()
+		query.Question[0].Qclass |= mdnsClassBit
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.open()
+	if err != nil {
+		return nil, upstreamError(c.id, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.opt.QueryTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(b, c.group); err != nil {
+		return nil, upstreamError(c.id, err)
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Debug("no response received")
+			c.metrics.noAnswer.Add(1)
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			a.RecursionAvailable = q.RecursionDesired
+			c.store(a)
+			return a, nil
+		}
+		if err != nil {
+			return nil, upstreamError(c.id, err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response {
+			continue // Our own query if looped back, or other queries in qm mode
+		}
+		if a := mdnsAnswer(q, resp); a != nil {
+			log.Debug("received response")
+			c.store(a)
+			return a, nil
+		}
+	}
+}
+
+func (c *MDNSClient) String() string {
+	return c.id
+}
+
+// Stores a copy of the answer in the cache if it's enabled.
+func (c *MDNSClient) store(a *dns.Msg) {
+	if c.cache != nil {
+		c.cache.add(a.Copy())
+	}
+}
+
+// Opens the socket to send the query and receive responses on. Responses to
+// queries from the mDNS port are multicast, so that needs to join the group.
+func (c *MDNSClient) open() (*net.UDPConn, error) {
+	var (
+		conn *net.UDPConn
+		err  error
+	)
+	if c.opt.Mode == MDNSModeQM {
+		var ifaces []net.Interface
+		if c.ifi != nil {
+			ifaces = append(ifaces, *c.ifi)
+		} else {
+			ifaces = append(ifaces, net.Interface{}) // Default interface
+		}
+		conn, err = listenMDNS(c.network, ifaces)
+	} else {
+		conn, err = net.ListenUDP(c.network, nil)
+	}
+	if err != nil || c.ifi == nil {
+		return conn, err
+	}
+	if c.network == "udp6" {
+		err = ipv6.NewPacketConn(conn).SetMulticastInterface(c.ifi)
+	} else {
+		err = ipv4.NewPacketConn(conn).SetMulticastInterface(c.ifi)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Returns the answer to a query built from an mDNS response, or nil if the
+// response doesn't answer the question. Records for the question go into the
+// answer section, all others into the additional section.
+func mdnsAnswer(q, resp *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.RecursionAvailable = q.RecursionDesired
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		h := rr.Header()
+		switch h.Rrtype {
+		case dns.TypeOPT, dns.TypeNSEC:
+			continue
+		}
+		if strings.EqualFold(h.Name, question.Name) && (h.Rrtype == question.Qtype || h.Rrtype == dns.TypeCNAME || question.Qtype == dns.TypeANY) {
+			a.Answer = append(a.Answer, rr)
+		} else {
+			a.Extra = append(a.Extra, rr)
+		}
+	}
+	if len(a.Answer) == 0 {
+		return nil
+	}
+	mdnsClearCacheFlush(a.Answer)
+	mdnsClearCacheFlush(a.Extra)
+	return a
+}
+
+// Short-lived cache of mDNS answers. Devices on the local network can come
+// and go at any time, so answers are only kept for a few seconds, but that's
+// enough to avoid waiting for the timeout on every query for names that don't
+// exist, and to answer the PTR queries that often follow forward lookups.
+type mdnsCache struct {
+	maxTTL time.Duration
+	clock  Clock
+
+	mu    sync.Mutex
+	items map[dns.Question]mdnsCacheItem
+}
+
+type mdnsCacheItem struct {
+	msg       *dns.Msg
+	timestamp time.Time
+	expiry    time.Time
+}
+
+func newMDNSCache(maxTTL time.Duration, clock Clock) *mdnsCache {
+	return &mdnsCache{
+		maxTTL: maxTTL,
+		clock:  clock,
+		items:  make(map[dns.Question]mdnsCacheItem),
+	}
+}
+
+// Returns a cached answer to the query with its TTLs adjusted.
+func (c *mdnsCache) get(q *dns.Msg) (*dns.Msg, bool) {
+	key := mdnsCacheKey(q.Question[0])
+	now := c.clock.Now()
+	c.mu.Lock()
+	item, ok := c.items[key]
+	c.mu.Unlock()
+	if !ok || !now.Before(item.expiry) {
+		return nil, false
+	}
+	a := item.msg.Copy()
+	if !adjustTTL(a, now, item.timestamp, item.expiry) {
+		return nil, false
+	}
+	a.Id = q.Id
+	a.RecursionDesired = q.RecursionDesired
+	a.RecursionAvailable = q.RecursionDesired
+	return withQuestion(a, q), true
+}
+
+// Adds an answer to the cache, as well as answers to PTR queries for the
+// addresses in it.
+func (c *mdnsCache) add(a *dns.Msg) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Remove expired items before adding new ones
+	for key, item := range c.items {
+		if !now.Before(item.expiry) {
+			delete(c.items, key)
+		}
+	}
+
+	c.set(a, now)
+	for _, rr := range append(a.Answer, a.Extra...) {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		name, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		ptr := new(dns.Msg)
+		ptr.SetQuestion(name, dns.TypePTR)
+		ptr.Response = true
+		ptr.Authoritative = true
+		ptr.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+			Ptr: rr.Header().Name,
+		}}
+		c.set(ptr, now)
+	}
+}
+
+// Stores an answer for at most the maximum TTL of the cache or the lowest
+// TTL of its records. Must be called with the lock held.
+func (c *mdnsCache) set(a *dns.Msg, now time.Time) {
+	ttl := c.maxTTL
+	if recordTTL, ok := minTTL(a); ok {
+		ttl = min(ttl, time.Duration(recordTTL)*time.Second)
+	}
+	c.items[mdnsCacheKey(a.Question[0])] = mdnsCacheItem{
+		msg:       a,
+		timestamp: now,
+		expiry:    now.Add(ttl),
+	}
+}
+
+func mdnsCacheKey(q dns.Question) dns.Question {
+	return dns.Question{Name: strings.ToLower(q.Name), Qtype: q.Qtype, Qclass: dns.ClassINET}
+}
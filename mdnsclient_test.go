@@ -0,0 +1,110 @@
+package rdns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSClient(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Responder that answers queries for printer.local, after a response
+	// for another name
+	var queries atomic.Int64
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			if q.Question[0].Qclass&mdnsClassBit == 0 {
+				continue // Not a QU query
+			}
+			queries.Add(1)
+			other := new(dns.Msg)
+			other.Response = true
+			other.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "other.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IPv4(192, 168, 1, 2)}}
+			b, _ := other.Pack()
+			conn.WriteToUDP(b, addr)
+			if q.Question[0].Name != "printer.local." {
+				continue
+			}
+			a := new(dns.Msg)
+			a.Id = q.Id
+			a.Response = true
+			a.Authoritative = true
+			a.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeA, Class: dns.ClassINET | mdnsClassBit, Ttl: 120}, A: net.IPv4(192, 168, 1, 10)}}
+			a.Extra = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "printer.local.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET | mdnsClassBit, Ttl: 120}, AAAA: net.ParseIP("fe80::10")}}
+			b, _ = a.Pack()
+			conn.WriteToUDP(b, addr)
+		}
+	}()
+
+	clock := NewFakeClock(time.Now())
+	c, err := NewMDNSClient("test-mdns", conn.LocalAddr().String(), MDNSClientOptions{
+		QueryTimeout: 200 * time.Millisecond,
+		Clock:        clock,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("printer.local.", dns.TypeA)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint16(dns.ClassINET), a.Answer[0].Header().Class)
+	require.Len(t, a.Extra, 1)
+
+	// Nothing answers
+	q.SetQuestion("missing.local.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, int64(2), queries.Load())
+
+	// Repeated queries, and reverse lookups of the addresses in responses,
+	// are answered from the cache
+	clock.Advance(5 * time.Second)
+	q.SetQuestion("Printer.local.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, "Printer.local.", a.Answer[0].Header().Name)
+	require.Equal(t, uint32(5), a.Answer[0].Header().Ttl)
+	for _, addr := range []string{"192.168.1.10", "fe80::10"} {
+		name, err := dns.ReverseAddr(addr)
+		require.NoError(t, err)
+		q.SetQuestion(name, dns.TypePTR)
+		a, err = c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, "printer.local.", a.Answer[0].(*dns.PTR).Ptr)
+	}
+	q.SetQuestion("missing.local.", dns.TypeA)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, int64(2), queries.Load())
+
+	// Expired answers are queried again
+	clock.Advance(5 * time.Second)
+	q.SetQuestion("printer.local.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), queries.Load())
+}
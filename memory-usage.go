@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"net"
+	"regexp"
+
+	"github.com/miekg/dns"
+)
+
+// Rough sizes of runtime structures, used to estimate how much memory caches
+// and lists hold. The estimates are meant to be in the right order of
+// magnitude, to compare elements and set limits, not to be exact.
+const (
+	mapOverhead      = 48 // Map header
+	mapEntryOverhead = 24 // Bucket slot of a map entry, excluding key and value
+	stringOverhead   = 16 // String header
+	sliceOverhead    = 24 // Slice header
+
+	// Per record, question and message in cached responses, in addition
+	// to their wire size.
+	rrOverhead  = 64
+	msgOverhead = 160
+
+	// Per cached item, the list element, key and map entry.
+	cacheItemOverhead = 192
+
+	// Compiled regular expressions, per rule and per byte of the pattern.
+	regexpOverhead  = 1024
+	regexpByteUsage = 64
+)
+
+// Implemented by caches and lists that can estimate the memory they use.
+type memoryUser interface {
+	memoryUsage() int64
+}
+
+// Returns the approximate memory used by a cache backend or list, or 0 if
+// it doesn't keep its data in memory or can't tell.
+func memoryUsage(v any) int64 {
+	if m, ok := v.(memoryUser); ok {
+		return m.memoryUsage()
+	}
+	return 0
+}
+
+// Returns the approximate memory used by a DNS message. Records are
+// held in memory as structs with pointers and strings, which take about
+// twice the space of the wire format.
+func msgMemoryUsage(m *dns.Msg) int64 {
+	if m == nil {
+		return 0
+	}
+	n := len(m.Question) + len(m.Answer) + len(m.Ns) + len(m.Extra)
+	return msgOverhead + int64(n)*rrOverhead + 2*int64(m.Len())
+}
+
+func stringMemoryUsage(s string) int64 {
+	return stringOverhead + int64(len(s))
+}
+
+func ipsMemoryUsage(ips []net.IP) int64 {
+	size := int64(sliceOverhead)
+	for _, ip := range ips {
+		size += sliceOverhead + int64(len(ip))
+	}
+	return size
+}
+
+func regexpMemoryUsage(rules []*regexp.Regexp) int64 {
+	var size int64
+	for _, re := range rules {
+		size += regexpOverhead + regexpByteUsage*int64(len(re.String()))
+	}
+	return size
+}
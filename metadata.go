@@ -0,0 +1,50 @@
+package rdns
+
+import "reflect"
+
+// Metadata of a ClientInfo. Immutable list of key-value pairs, most recently
+// added first.
+type metadata struct {
+	parent     *metadata
+	key, value any
+}
+
+// WithValue returns a copy of the ClientInfo with metadata key set to value.
+// This allows elements to annotate a query with information for elements
+// further down the pipeline, for example a client profile determined from the
+// client certificate, without adding a field to ClientInfo for every use.
+//
+// Ownership works like values in a context.Context. Since ClientInfo is passed
+// by value, metadata added by an element is only seen by the elements it
+// passes the query to, never by the element that called it or by other
+// branches of the pipeline. Values must not be modified once added, neither by
+// the element that added them nor by elements reading them. Adding a key that
+// already exists shadows the earlier value for downstream elements.
+//
+// The key must be comparable and should be of an unexported type defined by
+// the package that owns the metadata to avoid collisions, for example:
+//
+//	type profileKey struct{}
+//
+//	ci = ci.WithValue(profileKey{}, "kids")
+//	profile, _ := ci.Value(profileKey{}).(string)
+func (ci ClientInfo) WithValue(key, value any) ClientInfo {
+	if key == nil {
+		panic("nil metadata key")
+	}
+	if !reflect.TypeOf(key).Comparable() {
+		panic("metadata key is not comparable")
+	}
+	ci.meta = &metadata{parent: ci.meta, key: key, value: value}
+	return ci
+}
+
+// Value returns the metadata value for a key, or nil if it isn't set.
+func (ci ClientInfo) Value(key any) any {
+	for m := ci.meta; m != nil; m = m.parent {
+		if m.key == key {
+			return m.value
+		}
+	}
+	return nil
+}
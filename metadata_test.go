@@ -0,0 +1,56 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testMetaKey struct{}
+
+// Sets the metadata value for downstream resolvers.
+type testMetaAnnotator struct {
+	resolver Resolver
+	value    string
+}
+
+func (r *testMetaAnnotator) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	return r.resolver.Resolve(q, ci.WithValue(testMetaKey{}, r.value))
+}
+
+func (r *testMetaAnnotator) String() string { return "annotator" }
+
+func TestClientInfoMetadata(t *testing.T) {
+	var seen []any
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			seen = append(seen, ci.Value(testMetaKey{}))
+			return q, nil
+		},
+	}
+	a := &testMetaAnnotator{resolver: upstream, value: "a"}
+	b := &testMetaAnnotator{resolver: upstream, value: "b"}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{Listener: "test"}
+
+	// Metadata set by one branch is not visible to the caller or other branches
+	_, err := a.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = upstream.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, []any{"a", "b", nil}, seen)
+	require.Nil(t, ci.Value(testMetaKey{}))
+
+	// Later values shadow earlier ones, other fields are retained
+	ci2 := ci.WithValue(testMetaKey{}, 1).WithValue("other", 2).WithValue(testMetaKey{}, 3)
+	require.Equal(t, 3, ci2.Value(testMetaKey{}))
+	require.Equal(t, 2, ci2.Value("other"))
+	require.Equal(t, "test", ci2.Listener)
+
+	require.Panics(t, func() { ci.WithValue([]string{"not comparable"}, 1) })
+}
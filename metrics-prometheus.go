@@ -0,0 +1,141 @@
+package rdns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusExporter publishes the metrics of a registry in the Prometheus
+// text exposition format.
+type PrometheusExporter struct {
+	// Registry to export. Defaults to DefaultRegistry.
+	Registry *Registry
+
+	// Protocol or type of elements by ID, like "dot" or "cache". Added to
+	// the metrics of the elements as "protocol" label. Optional.
+	Protocols map[string]string
+}
+
+var _ http.Handler = &PrometheusExporter{}
+
+// Content type of the text exposition format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP writes all metrics in the response.
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	_ = e.Write(w)
+}
+
+// Write all metrics to w. Metrics with the same name are grouped under one
+// TYPE line, CounterMap and GaugeMap values are written with the map label,
+// histograms with cumulative buckets, sum and count.
+func (e *PrometheusExporter) Write(w io.Writer) error {
+	reg := e.Registry
+	if reg == nil {
+		reg = DefaultRegistry
+	}
+	b := bufio.NewWriter(w)
+	var previous string
+	for _, m := range reg.Metrics() {
+		if m.Name != previous {
+			fmt.Fprintf(b, "# TYPE %s %s\n", m.Name, m.Kind)
+			previous = m.Name
+		}
+		labels := m.Labels
+		if protocol, ok := e.Protocols[m.Labels["id"]]; ok {
+			labels = make(map[string]string, len(m.Labels)+1)
+			for k, v := range m.Labels {
+				labels[k] = v
+			}
+			labels["protocol"] = protocol
+		}
+		switch v := m.Value.(type) {
+		case *Counter:
+			writePrometheusSample(b, m.Name, labels, "", "", float64(v.Value()))
+		case *Gauge:
+			writePrometheusSample(b, m.Name, labels, "", "", float64(v.Value()))
+		case *CounterMap:
+			writePrometheusMap(b, m.Name, labels, m.MapLabel, v.Values())
+		case *GaugeMap:
+			writePrometheusMap(b, m.Name, labels, m.MapLabel, v.Values())
+		case *Histogram:
+			s := v.Snapshot()
+			bounds := make([]float64, 0, len(s.Buckets))
+			for k := range s.Buckets {
+				bound, _ := strconv.ParseFloat(k, 64)
+				bounds = append(bounds, bound)
+			}
+			sort.Float64s(bounds)
+			for _, bound := range bounds {
+				le := strconv.FormatFloat(bound, 'g', -1, 64)
+				writePrometheusSample(b, m.Name+"_bucket", labels, "le", le, float64(s.Buckets[le]))
+			}
+			writePrometheusSample(b, m.Name+"_bucket", labels, "le", "+Inf", float64(s.Count))
+			writePrometheusSample(b, m.Name+"_sum", labels, "", "", s.Sum)
+			writePrometheusSample(b, m.Name+"_count", labels, "", "", float64(s.Count))
+		}
+	}
+	return b.Flush()
+}
+
+// Writes the values of a CounterMap or GaugeMap, ordered by key.
+func writePrometheusMap(w io.Writer, name string, labels map[string]string, mapLabel string, values map[string]int64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Internationalized names get their unicode form as extra label
+		l := labels
+		if u := unicodeName(k); u != "" {
+			l = maps.Clone(labels)
+			l[mapLabel+"_unicode"] = u
+		}
+		writePrometheusSample(w, name, l, mapLabel, k, float64(values[k]))
+	}
+}
+
+// Writes one sample with sorted labels, plus an extra label if extraName
+// isn't empty.
+func writePrometheusSample(w io.Writer, name string, labels map[string]string, extraName, extraValue string, value float64) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, escapePrometheusLabel(labels[k])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapePrometheusLabel(extraValue)))
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatPrometheusValue(value))
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePrometheusLabel(s string) string {
+	return prometheusLabelEscaper.Replace(s)
+}
+
+func formatPrometheusValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,301 @@
+package rdns
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MetricKind is the type of a metric.
+type MetricKind string
+
+const (
+	// Value that only increases, like the number of queries.
+	MetricCounter MetricKind = "counter"
+	// Value that goes up and down, like the number of available resolvers.
+	MetricGauge MetricKind = "gauge"
+	// Distribution of observed values, like query durations.
+	MetricHistogram MetricKind = "histogram"
+)
+
+// Metric is a metric in the registry, identified by its name and labels.
+type Metric struct {
+	// Name of the metric, for example "routedns_listener_query".
+	Name string
+
+	// Kind of the metric. Counters and gauges that have values per label
+	// value, such as response counts per rcode, have the kind of their
+	// values.
+	Kind MetricKind
+
+	// Labels identifying the metric, for example "id" with the ID of the
+	// element.
+	Labels map[string]string
+
+	// Name of the label the values of a CounterMap or GaugeMap are keyed
+	// by, like "rcode". Empty for other metrics.
+	MapLabel string
+
+	// The metric itself, *Counter, *Gauge, *CounterMap, *GaugeMap or
+	// *Histogram.
+	Value expvar.Var
+}
+
+// Registry holds metrics of all elements. It can be read by exporters to
+// publish metrics in other formats.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*Metric
+
+	// First metric registered under each name, all metrics of a family
+	// need to have the same type and labels.
+	families map[string]*Metric
+}
+
+// DefaultRegistry is used by all elements. Metrics in it are also published
+// with expvar, under names like "routedns.listener.<id>.query".
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics:  make(map[string]*Metric),
+		families: make(map[string]*Metric),
+	}
+}
+
+// Metrics returns all metrics in the registry, ordered by name and labels.
+func (r *Registry) Metrics() []*Metric {
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.metrics))
+	for k := range r.metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*Metric, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, r.metrics[k])
+	}
+	r.mu.Unlock()
+	return list
+}
+
+// Returns the metric with the name and labels, or registers a new one built
+// by newValue if there isn't one yet. Panics if a metric with the same name
+// but different type or labels exists since that's a programming error.
+func (r *Registry) get(name string, kind MetricKind, labels map[string]string, mapLabel string, newValue func() expvar.Var) *Metric {
+	key := metricKey(name, labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[key]; ok {
+		if m.Kind != kind || m.MapLabel != mapLabel {
+			panic(fmt.Sprintf("metric %s registered as %s with different type", key, m.Kind))
+		}
+		return m
+	}
+	if f, ok := r.families[name]; ok && (f.Kind != kind || f.MapLabel != mapLabel || !sameLabelNames(f.Labels, labels)) {
+		panic(fmt.Sprintf("metric %s registered as %s with different labels", name, f.Kind))
+	}
+	m := &Metric{Name: name, Kind: kind, Labels: labels, MapLabel: mapLabel, Value: newValue()}
+	r.metrics[key] = m
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = m
+	}
+	return m
+}
+
+// Returns true if both sets of labels have the same names.
+func sameLabelNames(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a unique key for a metric name and labels.
+func metricKey(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "{%s=%q}", k, labels[k])
+	}
+	return b.String()
+}
+
+// Counter is a metric with a value that only increases.
+type Counter struct {
+	v atomic.Int64
+}
+
+// Add increments the counter by delta.
+func (c *Counter) Add(delta int64) { c.v.Add(delta) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+func (c *Counter) String() string { return strconv.FormatInt(c.Value(), 10) }
+
+// Gauge is a metric with a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Add changes the value of the gauge by delta.
+func (g *Gauge) Add(delta int64) { g.v.Add(delta) }
+
+// Set the value of the gauge.
+func (g *Gauge) Set(v int64) { g.v.Store(v) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+func (g *Gauge) String() string { return strconv.FormatInt(g.Value(), 10) }
+
+// CounterMap is a set of counters keyed by the value of a label, for
+// example the number of responses per response code.
+type CounterMap struct {
+	m sync.Map // string -> *Counter
+}
+
+// Add increments the counter for the key by delta.
+func (m *CounterMap) Add(key string, delta int64) {
+	if c, ok := m.m.Load(key); ok {
+		c.(*Counter).Add(delta)
+		return
+	}
+	c, _ := m.m.LoadOrStore(key, new(Counter))
+	c.(*Counter).Add(delta)
+}
+
+// Get returns the counter for a key, nil if there is none.
+func (m *CounterMap) Get(key string) *Counter {
+	c, ok := m.m.Load(key)
+	if !ok {
+		return nil
+	}
+	return c.(*Counter)
+}
+
+// Values returns the current value for every key.
+func (m *CounterMap) Values() map[string]int64 {
+	values := make(map[string]int64)
+	m.m.Range(func(k, v any) bool {
+		values[k.(string)] = v.(*Counter).Value()
+		return true
+	})
+	return values
+}
+
+func (m *CounterMap) String() string { return mapString(m.Values()) }
+
+// GaugeMap is a set of gauges keyed by the value of a label.
+type GaugeMap struct {
+	m sync.Map // string -> *Gauge
+}
+
+// Set the value of the gauge for a key.
+func (m *GaugeMap) Set(key string, v int64) {
+	g, _ := m.m.LoadOrStore(key, new(Gauge))
+	g.(*Gauge).Set(v)
+}
+
+// Get returns the gauge for a key, nil if there is none.
+func (m *GaugeMap) Get(key string) *Gauge {
+	g, ok := m.m.Load(key)
+	if !ok {
+		return nil
+	}
+	return g.(*Gauge)
+}
+
+// Values returns the current value for every key.
+func (m *GaugeMap) Values() map[string]int64 {
+	values := make(map[string]int64)
+	m.m.Range(func(k, v any) bool {
+		values[k.(string)] = v.(*Gauge).Value()
+		return true
+	})
+	return values
+}
+
+func (m *GaugeMap) String() string { return mapString(m.Values()) }
+
+// Returns the values as JSON object, sorted by key like expvar.Map.
+func mapString(values map[string]int64) string {
+	b, _ := json.Marshal(values) // Maps are marshalled with sorted keys
+	return string(b)
+}
+
+// DefaultDurationBuckets are the upper bounds of histogram buckets for
+// durations in seconds.
+var DefaultDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observed values in buckets with fixed upper bounds.
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64 // Non-cumulative, one more than buckets for values above the largest bound
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds, which
+// must be sorted in increasing order.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// HistogramSnapshot holds the values of a histogram at a point in time.
+type HistogramSnapshot struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	// Cumulative counts of values less or equal to the upper bound of each
+	// bucket.
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// Snapshot returns the current values of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{Count: h.count, Sum: h.sum, Buckets: make(map[string]uint64)}
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		s.Buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = cumulative
+	}
+	return s
+}
+
+func (h *Histogram) String() string {
+	b, _ := json.Marshal(h.Snapshot())
+	return string(b)
+}
@@ -0,0 +1,86 @@
+package rdns
+
+import (
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	c := getCounter("listener", "test-metrics", "query")
+	c.Add(2)
+
+	// Same element and name returns the same counter
+	require.Same(t, c, getCounter("listener", "test-metrics", "query"))
+
+	// Published with expvar under the flat name
+	require.Equal(t, "2", expvar.Get("routedns.listener.test-metrics.query").String())
+
+	// Available with labels in the registry
+	var found *Metric
+	for _, m := range DefaultRegistry.Metrics() {
+		if m.Name == "routedns_listener_query" && m.Labels["id"] == "test-metrics" {
+			found = m
+		}
+	}
+	require.NotNil(t, found)
+	require.Equal(t, MetricCounter, found.Kind)
+	require.Same(t, c, found.Value)
+
+	// Registering the same metric with a different type is an error
+	require.Panics(t, func() { getGauge("listener", "test-metrics", "query") })
+
+	// All metrics of a family have the same labels, across elements
+	require.Panics(t, func() { getCounterMap("listener", "test-metrics-other", "query", "rcode") })
+
+	m := getCounterMap("listener", "test-metrics", "response", "rcode")
+	m.Add("NOERROR", 3)
+	m.Add("NXDOMAIN", 1)
+	require.Equal(t, `{"NOERROR":3,"NXDOMAIN":1}`, m.String())
+	require.Nil(t, m.Get("SERVFAIL"))
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+	s := h.Snapshot()
+	require.Equal(t, uint64(4), s.Count)
+	require.InDelta(t, 3.65, s.Sum, 0.0001)
+	require.Equal(t, map[string]uint64{"0.1": 2, "1": 3}, s.Buckets)
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	reg := NewRegistry()
+	labels := map[string]string{"id": "local-udp"}
+	reg.get("routedns_listener_query", MetricCounter, labels, "", func() expvar.Var { return new(Counter) }).Value.(*Counter).Add(3)
+	responses := reg.get("routedns_listener_response", MetricCounter, labels, "rcode", func() expvar.Var { return new(CounterMap) }).Value.(*CounterMap)
+	responses.Add("NXDOMAIN", 1)
+	responses.Add("NOERROR", 2)
+	reg.get("routedns_cache_entries", MetricGauge, map[string]string{"id": `my"cache`}, "", func() expvar.Var { return new(Gauge) }).Value.(*Gauge).Set(7)
+	h := reg.get("routedns_listener_duration", MetricHistogram, labels, "", func() expvar.Var { return NewHistogram([]float64{0.1, 1}) }).Value.(*Histogram)
+	h.Observe(0.05)
+	h.Observe(2)
+
+	e := &PrometheusExporter{Registry: reg, Protocols: map[string]string{"local-udp": "udp"}}
+	var b strings.Builder
+	require.NoError(t, e.Write(&b))
+	require.Equal(t, `# TYPE routedns_cache_entries gauge
+routedns_cache_entries{id="my\"cache"} 7
+# TYPE routedns_listener_duration histogram
+routedns_listener_duration_bucket{id="local-udp",protocol="udp",le="0.1"} 1
+routedns_listener_duration_bucket{id="local-udp",protocol="udp",le="1"} 1
+routedns_listener_duration_bucket{id="local-udp",protocol="udp",le="+Inf"} 2
+routedns_listener_duration_sum{id="local-udp",protocol="udp"} 2.05
+routedns_listener_duration_count{id="local-udp",protocol="udp"} 2
+# TYPE routedns_listener_query counter
+routedns_listener_query{id="local-udp",protocol="udp"} 3
+# TYPE routedns_listener_response counter
+routedns_listener_response{id="local-udp",protocol="udp",rcode="NOERROR"} 2
+routedns_listener_response{id="local-udp",protocol="udp",rcode="NXDOMAIN"} 1
+`, b.String())
+}
@@ -0,0 +1,43 @@
+package rdns
+
+// Middleware wraps a resolver to add behavior to every query passing through
+// it, for example logging, metrics or recovery from panics. Wrapped resolvers
+// should return the ID of the resolver they wrap from String(), so the
+// combination still appears as one element.
+type Middleware func(Resolver) Resolver
+
+// Chain combines middlewares into one. The first middleware is the outermost
+// and sees queries first, the last one is closest to the wrapped resolver.
+// Chain(a, b)(r) is the same as a(b(r)).
+func Chain(middlewares ...Middleware) Middleware {
+	return func(r Resolver) Resolver {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			r = middlewares[i](r)
+		}
+		return r
+	}
+}
+
+// PanicRecoveryMiddleware returns a middleware that recovers from panics in
+// the wrapped resolver, see PanicRecovery.
+func PanicRecoveryMiddleware() Middleware {
+	return func(r Resolver) Resolver {
+		return NewPanicRecovery(r)
+	}
+}
+
+// StatusTrackerMiddleware returns a middleware that records the status of the
+// wrapped resolver for the admin listener, see StatusTracker.
+func StatusTrackerMiddleware() Middleware {
+	return func(r Resolver) Resolver {
+		return NewStatusTracker(r)
+	}
+}
+
+// DepthLimiterMiddleware returns a middleware that limits how many elements
+// a query can pass through, see DepthLimiter.
+func DepthLimiterMiddleware(max int) Middleware {
+	return func(r Resolver) Resolver {
+		return NewDepthLimiter(r, max)
+	}
+}
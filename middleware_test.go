@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Resolver recording the order queries pass through middlewares.
+type testOrderResolver struct {
+	name     string
+	resolver Resolver
+	order    *[]string
+}
+
+func (r *testOrderResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	*r.order = append(*r.order, r.name)
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *testOrderResolver) String() string {
+	return r.resolver.String()
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(r Resolver) Resolver {
+			return &testOrderResolver{name: name, resolver: r, order: &order}
+		}
+	}
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			panic("test")
+		},
+	}
+	r := Chain(middleware("a"), Chain(middleware("b"), PanicRecoveryMiddleware()))(upstream)
+	require.Equal(t, upstream.String(), r.String())
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := r.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, []string{"a", "b"}, order)
+
+	// An empty chain doesn't wrap the resolver
+	require.Same(t, upstream, Chain()(upstream))
+}
@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// nameRate tracks the rate of queries per name over a sliding window, to
+// detect names that are queried unusually often, for example by clients
+// stuck retrying a name that fails to resolve. Counts are kept for the
+// current and previous window, the rate is estimated from the part of the
+// previous window that overlaps the sliding one.
+type nameRate struct {
+	limit  float64 // Queries per second
+	window time.Duration
+	clock  Clock
+
+	mu    sync.Mutex
+	start time.Time // Start of the current window
+	curr  map[string]int
+	prev  map[string]int
+}
+
+// Default length of the window the rate is measured over.
+const defaultNameRateWindow = time.Second
+
+func newNameRate(limit float64, window time.Duration, clock Clock) *nameRate {
+	if window <= 0 {
+		window = defaultNameRateWindow
+	}
+	clock = clockOrDefault(clock)
+	return &nameRate{
+		limit:  limit,
+		window: window,
+		clock:  clock,
+		start:  clock.Now(),
+		curr:   make(map[string]int),
+		prev:   make(map[string]int),
+	}
+}
+
+// Counts a query for the name and returns true if the rate of queries for
+// it, including this one, exceeds the limit.
+func (r *nameRate) exceeded(name string) bool {
+	name = strings.ToLower(name)
+	now := r.clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elapsed := now.Sub(r.start); elapsed >= r.window {
+		// Only keep the last window, older counts are outside the sliding one
+		if elapsed >= 2*r.window {
+			clear(r.prev)
+		} else {
+			r.prev = r.curr
+		}
+		r.curr = make(map[string]int, len(r.prev))
+		r.start = now.Add(-(elapsed % r.window))
+	}
+	r.curr[name]++
+	overlap := 1 - float64(now.Sub(r.start))/float64(r.window)
+	count := float64(r.curr[name]) + float64(r.prev[name])*overlap
+	return count/r.window.Seconds() > r.limit
+}
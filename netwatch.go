@@ -0,0 +1,40 @@
+package rdns
+
+import (
+	"time"
+)
+
+// Time to wait after the last network change event before calling the
+// handler. Changes typically come in bursts, for example when an interface
+// comes up and is assigned addresses and routes.
+const networkChangeDelay = 2 * time.Second
+
+// Calls f whenever addresses or routes of the host change, until the returned
+// function is called.
+func onNetworkChange(f func()) (stop func(), err error) {
+	events, stop, err := networkEvents()
+	if err != nil {
+		return nil, err
+	}
+	go watchNetworkChanges(events, networkChangeDelay, f)
+	return stop, nil
+}
+
+// Calls f once no further events have been received for the length of delay.
+// Returns when the events channel is closed.
+func watchNetworkChanges(events <-chan struct{}, delay time.Duration, f func()) {
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			f()
+		}
+	}
+}
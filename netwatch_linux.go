@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns a channel that receives an event whenever an address or route is
+// added or removed. Uses a netlink socket subscribed to the relevant groups.
+// The channel is closed once stop is called.
+func networkEvents() (events <-chan struct{}, stop func(), err error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("bind", err)
+	}
+	// Reads from the non-blocking socket go through the runtime poller, so
+	// they return once the file is closed
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		b := make([]byte, os.Getpagesize())
+		for {
+			n, err := f.Read(b)
+			if err != nil {
+				if errors.Is(err, os.ErrClosed) {
+					return
+				}
+				if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOBUFS) {
+					continue
+				}
+				Log.Error("failed to read from netlink socket", "error", err)
+				f.Close()
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(b[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+					select {
+					case ch <- struct{}{}:
+					default: // an event is already pending
+					}
+				}
+			}
+		}
+	}()
+	return ch, func() { f.Close() }, nil
+}
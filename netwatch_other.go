@@ -0,0 +1,67 @@
+//go:build !linux
+
+package rdns
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Interval at which the interface addresses are checked for changes on
+// platforms without a notification mechanism.
+const networkPollInterval = 10 * time.Second
+
+// Returns a channel that receives an event whenever the addresses of the host
+// change. Polls the interface addresses regularly. The channel is closed once
+// stop is called.
+func networkEvents() (events <-chan struct{}, stop func(), err error) {
+	prev, err := interfaceAddrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(networkPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			addrs, err := interfaceAddrs()
+			if err != nil {
+				Log.Error("failed to read interface addresses", "error", err)
+				continue
+			}
+			if slices.Equal(addrs, prev) {
+				continue
+			}
+			prev = addrs
+			select {
+			case ch <- struct{}{}:
+			default: // an event is already pending
+			}
+		}
+	}()
+	var once sync.Once
+	return ch, func() { once.Do(func() { close(done) }) }, nil
+}
+
+// Returns a sorted list of all interface addresses.
+func interfaceAddrs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		s = append(s, addr.String())
+	}
+	slices.Sort(s)
+	return s, nil
+}
@@ -0,0 +1,43 @@
+package rdns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchNetworkChanges(t *testing.T) {
+	events := make(chan struct{})
+	var calls atomic.Int32
+	go watchNetworkChanges(events, 100*time.Millisecond, func() { calls.Add(1) })
+
+	// A burst of events should only result in one call
+	for i := 0; i < 5; i++ {
+		events <- struct{}{}
+	}
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(1), calls.Load())
+
+	events <- struct{}{}
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, int32(2), calls.Load())
+	close(events)
+}
+
+func TestNetworkEventsStop(t *testing.T) {
+	events, stop, err := networkEvents()
+	if err != nil {
+		t.Skipf("unable to watch for network changes: %v", err)
+	}
+	stop()
+	select {
+	case _, ok := <-events:
+		for ok {
+			_, ok = <-events
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed after stop")
+	}
+}
@@ -0,0 +1,294 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Event is an operational event, such as a failover to another upstream
+// resolver, that operators may want to be alerted about.
+type Event struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"` // ID of the element that generated the event
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Types of events.
+const (
+	EventFailover              = "failover"
+	EventBlocklistReloadFailed = "blocklist-reload-failed"
+	EventCertificateExpiring   = "certificate-expiring"
+	EventRateLimited           = "rate-limited"
+	EventConfigLoaded          = "config-loaded"
+	EventConfigReloadFailed    = "config-reload-failed"
+	EventDNSSECProblem         = "dnssec-problem"
+	EventUpdateAvailable       = "update-available"
+	EventHARoleChanged         = "ha-role-changed"
+)
+
+// Notifier receives operational events. Implementations must not block.
+type Notifier interface {
+	Notify(Event)
+}
+
+// Notifiers that events are sent to.
+var notifiers struct {
+	mu   sync.RWMutex
+	list []Notifier
+}
+
+// AddNotifier registers a notifier to receive all events.
+func AddNotifier(n Notifier) {
+	notifiers.mu.Lock()
+	defer notifiers.mu.Unlock()
+	notifiers.list = append(notifiers.list, n)
+}
+
+// Notify sends an event to all registered notifiers. The time of the event
+// is set if it's empty.
+func Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	notifiers.mu.RLock()
+	defer notifiers.mu.RUnlock()
+	for _, n := range notifiers.list {
+		n.Notify(e)
+	}
+}
+
+// Sends an event for a failover from one resolver to another.
+func notifyFailover(id string, from, to Resolver) {
+	Notify(Event{
+		Type:    EventFailover,
+		ID:      id,
+		Message: fmt.Sprintf("failing over from resolver %s to %s", from, to),
+		Details: map[string]string{"from": from.String(), "to": to.String()},
+	})
+}
+
+// Sends an event for a blocklist that failed to reload.
+func notifyReloadFailed(id string, err error) {
+	Notify(Event{
+		Type:    EventBlocklistReloadFailed,
+		ID:      id,
+		Message: fmt.Sprintf("failed to reload blocklist: %v", err),
+	})
+}
+
+// WebhookNotifier sends events as JSON to a URL with POST requests. Events
+// are queued and sent in the background. Failed requests are retried.
+type WebhookNotifier struct {
+	id      string
+	opt     WebhookNotifierOptions
+	queue   chan Event
+	metrics *WebhookNotifierMetrics
+}
+
+// WebhookNotifierOptions contain settings for a webhook notifier.
+type WebhookNotifierOptions struct {
+	// URL to send events to.
+	URL string
+
+	// Types of events to send. All events are sent if empty.
+	Events []string
+
+	// Number of times a failed request is retried. Defaults to 3.
+	Retries int
+
+	// Time to wait before the first retry. Doubles with every retry.
+	// Defaults to 5 seconds.
+	RetryDelay time.Duration
+
+	// Number of events that can be queued while earlier ones are being
+	// sent. Further events are dropped. Defaults to 100.
+	QueueSize int
+
+	// Used to wait between retries. Defaults to the system clock.
+	Clock Clock
+}
+
+type WebhookNotifierMetrics struct {
+	// Number of events sent.
+	sent *Counter
+	// Number of failed requests.
+	failed *Counter
+	// Number of events dropped because the queue was full or all retries
+	// failed.
+	dropped *Counter
+}
+
+var _ Notifier = &WebhookNotifier{}
+
+// NewWebhookNotifier returns a new webhook notifier and starts sending
+// events in the background.
+func NewWebhookNotifier(id string, opt WebhookNotifierOptions) (*WebhookNotifier, error) {
+	if opt.URL == "" {
+		return nil, errors.New("no url defined for webhook")
+	}
+	if opt.Retries == 0 {
+		opt.Retries = 3
+	}
+	if opt.RetryDelay == 0 {
+		opt.RetryDelay = 5 * time.Second
+	}
+	if opt.QueueSize == 0 {
+		opt.QueueSize = 100
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	n := &WebhookNotifier{
+		id:    id,
+		opt:   opt,
+		queue: make(chan Event, opt.QueueSize),
+		metrics: &WebhookNotifierMetrics{
+			sent:    getCounter("notifier", id, "sent"),
+			failed:  getCounter("notifier", id, "failed"),
+			dropped: getCounter("notifier", id, "dropped"),
+		},
+	}
+	go n.run()
+	return n, nil
+}
+
+// Notify queues the event to be sent, unless it's of a type that isn't
+// configured or the queue is full.
+func (n *WebhookNotifier) Notify(e Event) {
+	if len(n.opt.Events) > 0 && !slices.Contains(n.opt.Events, e.Type) {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		n.metrics.dropped.Add(1)
+	}
+}
+
+func (n *WebhookNotifier) String() string {
+	return n.id
+}
+
+func (n *WebhookNotifier) run() {
+	for e := range n.queue {
+		delay := n.opt.RetryDelay
+		for i := 0; ; i++ {
+			err := postWebhook(n.opt.URL, e)
+			if err == nil {
+				n.metrics.sent.Add(1)
+				break
+			}
+			n.metrics.failed.Add(1)
+			if i >= n.opt.Retries {
+				Log.Error("failed to send event to webhook", "id", n.id, "url", n.opt.URL, "type", e.Type, "error", err)
+				n.metrics.dropped.Add(1)
+				break
+			}
+			Log.Debug("failed to send event to webhook, retrying", "id", n.id, "url", n.opt.URL, "type", e.Type, "error", err)
+			n.opt.Clock.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// Sends the value as JSON to the URL.
+func postWebhook(url string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// CertificateMonitorOptions contain settings for MonitorCertificate.
+type CertificateMonitorOptions struct {
+	// Send an event when the certificate expires within this time. Defaults
+	// to 14 days.
+	ExpiryWarning time.Duration
+
+	// Time between checks. Defaults to 12 hours.
+	Interval time.Duration
+
+	// Defaults to the system clock.
+	Clock Clock
+}
+
+// MonitorCertificate regularly reads the first certificate in a PEM file and
+// sends an EventCertificateExpiring event if it expires soon. The file is
+// read on every check so replaced certificates are picked up.
+func MonitorCertificate(id, crtFile string, opt CertificateMonitorOptions) {
+	if opt.ExpiryWarning == 0 {
+		opt.ExpiryWarning = 14 * 24 * time.Hour
+	}
+	if opt.Interval == 0 {
+		opt.Interval = 12 * time.Hour
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	go func() {
+		for {
+			now := opt.Clock.Now()
+			notAfter, err := certificateExpiry(crtFile)
+			if err != nil {
+				Log.Error("failed to read certificate", "id", id, "file", crtFile, "error", err)
+			} else if left := notAfter.Sub(now); left < opt.ExpiryWarning {
+				Log.Warn("certificate expires soon", "id", id, "file", crtFile, "not-after", notAfter)
+				Notify(Event{
+					Type:    EventCertificateExpiring,
+					ID:      id,
+					Message: fmt.Sprintf("certificate %s expires in %s", crtFile, left.Round(time.Minute)),
+					Time:    now,
+					Details: map[string]string{"file": crtFile, "not-after": notAfter.Format(time.RFC3339)},
+				})
+			}
+			opt.Clock.Sleep(opt.Interval)
+		}
+	}()
+}
+
+// Returns the expiry time of the first certificate in a PEM file.
+func certificateExpiry(crtFile string) (time.Time, error) {
+	b, err := os.ReadFile(crtFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate found")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cert.NotAfter, nil
+	}
+}
@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	received := make(chan Event, 10)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// Fail the first request to trigger a retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received <- e
+	}))
+	defer srv.Close()
+
+	n, err := NewWebhookNotifier("test-webhook", WebhookNotifierOptions{
+		URL:    srv.URL,
+		Events: []string{EventFailover},
+		Clock:  clock,
+	})
+	require.NoError(t, err)
+
+	// Events of other types are not sent
+	n.Notify(Event{Type: EventRateLimited, ID: "test-limiter"})
+	n.Notify(Event{Type: EventFailover, ID: "test-failrotate", Message: "failing over"})
+
+	// The first attempt fails, the event is sent again after the retry delay
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	select {
+	case e := <-received:
+		require.Equal(t, EventFailover, e.Type)
+		require.Equal(t, "test-failrotate", e.ID)
+		require.Equal(t, "failing over", e.Message)
+	case <-time.After(time.Second):
+		t.Fatal("event not received")
+	}
+	require.Equal(t, 2, requests)
+	require.Eventually(t, func() bool { return n.metrics.sent.Value() == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, int64(1), n.metrics.failed.Value())
+}
@@ -67,6 +67,8 @@ func NewODoHClient(id, proxy, target, targetConfig string, opt DoHClientOptions)
 
 // Resolve a DNS query.
 func (d *ODoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	traceUpstream(ci, d.id)
+	defer recordTiming(ci, "upstream", d.id, time.Now())
 	// Build the encrypted query. The target key is retrieved on-demand
 	msg, queryContext, err := d.buildTargetQuery(q)
 	if err != nil {
@@ -88,7 +90,7 @@ func (d *ODoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// Perform the HTTP call to the proxy (which forwards to the target)
 	resp, err := d.proxy.do(req)
 	if err != nil {
-		return nil, err
+		return nil, upstreamError(d.id, err)
 	}
 	defer resp.Body.Close()
 
@@ -96,6 +98,11 @@ func (d *ODoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	return d.decodeProxyResponse(resp, queryContext)
 }
 
+// Close the connections to the proxy.
+func (d *ODoHClient) Close() error {
+	return d.proxy.Close()
+}
+
 func (d *ODoHClient) String() string {
 	return d.id
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -199,7 +200,7 @@ func (s *ODoHListener) ODoHqueryHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	msg, err := odoh.UnmarshalDNSMessage(b)
+	msg, err := s.parseObliviousQuery(b)
 	if err != nil {
 		http.Error(w, "error while parsing oblivious query", http.StatusBadRequest)
 		return
@@ -211,19 +212,38 @@ func (s *ODoHListener) ODoHqueryHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	q := &dns.Msg{}
-	if q.Unpack(obliviousQuery.Message()) != nil {
+	q, err := s.opt.unpackQuery(obliviousQuery.Message())
+	if err != nil {
 		http.Error(w, "unpacking oblivious query failed", http.StatusBadRequest)
 		return
 	}
 
-	a, err := s.r.Resolve(q, ClientInfo{Listener: s.id, TLSServerName: r.TLS.ServerName})
-	if err != nil {
+	ci := ClientInfo{
+		Listener:      s.id,
+		TLSClientName: tlsClientName(r.TLS),
+		Transport:     "odoh",
+		Encrypted:     true,
+	}
+	if r.TLS != nil {
+		ci.TLSServerName = r.TLS.ServerName
+	}
+	q, ci, timings := s.opt.startTiming(q, s.opt.classify(q, ci), false)
+	a, err := s.opt.chaos(s.r).Resolve(q, ci)
+	if isPolicyError(err) {
+		a = policyResponse(q, err)
+	} else if err != nil {
 		Log.Error("failed to resolve", "error", err)
 		a = new(dns.Msg)
 		a.SetRcode(q, dns.RcodeServerFailure)
 	}
 
+	// A nil response from the resolvers means "drop", return blank response
+	if a == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	timings.finish(q, a)
 	p, err := a.Pack()
 	if err != nil {
 		Log.Error("failed to encode response", "error", err)
@@ -241,6 +261,35 @@ func (s *ODoHListener) ODoHqueryHandler(w http.ResponseWriter, r *http.Request)
 	w.Write(obliviousResponse.Marshal())
 }
 
+// Decodes an oblivious query. The odoh package doesn't check the length
+// fields against the size of the message and the HPKE encapsulated key, which
+// leads to panics on crafted queries, so the framing is validated first.
+func (s *ODoHListener) parseObliviousQuery(b []byte) (odoh.ObliviousDNSMessage, error) {
+	// Message type followed by key ID and encrypted message, both prefixed
+	// with their 2-byte length
+	rest := b
+	var fields [][]byte
+	if len(rest) < 1 {
+		return odoh.ObliviousDNSMessage{}, errors.New("empty oblivious message")
+	}
+	rest = rest[1:]
+	for range 2 {
+		if len(rest) < 2 {
+			return odoh.ObliviousDNSMessage{}, errors.New("truncated oblivious message")
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+n {
+			return odoh.ObliviousDNSMessage{}, errors.New("truncated oblivious message")
+		}
+		fields = append(fields, rest[2:2+n])
+		rest = rest[2+n:]
+	}
+	if len(fields[1]) <= len(s.odohKeyPair.Config.Contents.PublicKeyBytes) {
+		return odoh.ObliviousDNSMessage{}, errors.New("oblivious message too short")
+	}
+	return odoh.UnmarshalDNSMessage(b)
+}
+
 func (s *ODoHListener) String() string {
 	return s.id
 }
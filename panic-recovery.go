@@ -0,0 +1,49 @@
+package rdns
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/miekg/dns"
+)
+
+// PanicRecovery wraps a resolver and recovers from panics in it. Instead of
+// taking down the whole process, the panic is logged with the stack trace and
+// the query fails with an error, which listeners answer with SERVFAIL. Other
+// queries are not affected.
+type PanicRecovery struct {
+	resolver Resolver
+	panics   *Counter
+}
+
+var _ Resolver = &PanicRecovery{}
+
+// NewPanicRecovery returns a resolver that recovers from panics in the given
+// resolver.
+func NewPanicRecovery(resolver Resolver) *PanicRecovery {
+	return &PanicRecovery{
+		resolver: resolver,
+		panics:   getCounter("router", resolver.String(), "panic"),
+	}
+}
+
+// Resolve passes the query to the resolver. Returns an error if the resolver
+// panics.
+func (r *PanicRecovery) Resolve(q *dns.Msg, ci ClientInfo) (a *dns.Msg, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.panics.Add(1)
+			logger(r.resolver.String(), q, ci).Error("recovered from panic",
+				"panic", p,
+				"stack", string(debug.Stack()),
+			)
+			a, err = nil, fmt.Errorf("panic in '%s': %v", r.resolver.String(), p)
+		}
+	}()
+	return r.resolver.Resolve(q, ci)
+}
+
+// String returns the ID of the wrapped resolver.
+func (r *PanicRecovery) String() string {
+	return r.resolver.String()
+}
@@ -0,0 +1,68 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name == "panic.example.com." {
+				panic("test")
+			}
+			return q, nil
+		},
+	}
+	g := NewPanicRecovery(r)
+
+	q := new(dns.Msg)
+	q.SetQuestion("panic.example.com.", dns.TypeA)
+	_, err := g.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+
+	// Other queries are not affected
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+}
+
+func TestPanicRecoveryDedup(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(*dns.Msg, ClientInfo) (*dns.Msg, error) {
+			time.Sleep(100 * time.Millisecond)
+			panic("test")
+		},
+	}
+	var g Resolver = NewRequestDedup("test-dedup", NewPanicRecovery(r))
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// All duplicate queries fail instead of waiting forever
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := g.Resolve(q, ClientInfo{})
+			require.Error(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// A panic passing through the dedup element still releases the waiting requests
+	g = NewPanicRecovery(NewRequestDedup("test-dedup", r))
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := g.Resolve(q, ClientInfo{})
+			require.Error(t, err)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,229 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PCAPWriter is a resolver that writes a sample of the queries passing through
+// it, and the responses to them, to a file in PCAP format. Since the element
+// only sees DNS messages, not the packets they were received in, every message
+// is written as a UDP packet with synthetic IP and UDP headers. The source IP
+// of queries is the IP of the client, the server address is unspecified. This
+// allows analyzing traffic received over encrypted protocols with tools like
+// Wireshark.
+type PCAPWriter struct {
+	id       string
+	resolver Resolver
+	opt      PCAPWriterOptions
+	out      *rotatingFile
+	metrics  *PCAPWriterMetrics
+}
+
+// PCAPWriterOptions contain settings for the PCAP writer.
+type PCAPWriterOptions struct {
+	// Name of the file to write packets to.
+	OutputFile string
+
+	// Fraction of queries to write, between 0 and 1. Defaults to 1 (all).
+	SampleRate float64
+
+	// Rotate the file when it grows beyond this size in bytes. Disabled if 0.
+	MaxSize int64
+
+	// Number of rotated files to keep, named <OutputFile>.1 to .N with .1
+	// being the most recent. Defaults to 1.
+	MaxFiles int
+}
+
+type PCAPWriterMetrics struct {
+	// Number of queries written to the file.
+	sampled *Counter
+	// Number of errors writing to the file.
+	errors *Counter
+}
+
+var _ Resolver = &PCAPWriter{}
+
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapSnapLen     = 65535
+	pcapLinkTypeRaw = 101 // Packets start with an IPv4 or IPv6 header
+
+	pcapServerPort = 53
+	pcapClientPort = 40000
+
+	// Largest DNS message that fits into a UDP packet with IPv4 header.
+	pcapMaxPayload = 65535 - 20 - 8
+)
+
+// NewPCAPWriter returns a new instance of a PCAP writer.
+func NewPCAPWriter(id string, resolver Resolver, opt PCAPWriterOptions) (*PCAPWriter, error) {
+	if opt.OutputFile == "" {
+		return nil, errors.New("no output file defined for pcap writer")
+	}
+	if opt.SampleRate < 0 || opt.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid sample rate %v, must be between 0 and 1", opt.SampleRate)
+	}
+	if opt.SampleRate == 0 {
+		opt.SampleRate = 1
+	}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	out, err := openRotatingFile(opt.OutputFile, rotatingFileOptions{
+		MaxSize:  opt.MaxSize,
+		MaxFiles: opt.MaxFiles,
+		Header:   header,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PCAPWriter{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		out:      out,
+		metrics: &PCAPWriterMetrics{
+			sampled: getCounter("router", id, "sampled"),
+			errors:  getCounter("router", id, "error"),
+		},
+	}, nil
+}
+
+// Resolve passes the query to the resolver and writes the query and the
+// response to the file if the query is part of the sample.
+func (r *PCAPWriter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.opt.SampleRate < 1 && rand.Float64() >= r.opt.SampleRate {
+		return r.resolver.Resolve(q, ci)
+	}
+	r.metrics.sampled.Add(1)
+	client := ci.SourceIP
+	if client == nil {
+		client = net.IPv4zero
+	}
+	r.writeMsg(q, client, pcapClientPort, nil, pcapServerPort)
+	a, err := r.resolver.Resolve(q, ci)
+	if a != nil {
+		r.writeMsg(a, nil, pcapServerPort, client, pcapClientPort)
+	}
+	return a, err
+}
+
+func (r *PCAPWriter) String() string {
+	return r.id
+}
+
+// Close the output file.
+func (r *PCAPWriter) Close() error {
+	return r.out.Close()
+}
+
+// Writes a DNS message as UDP packet. Nil addresses are replaced with the
+// unspecified address of the other side's address family.
+func (r *PCAPWriter) writeMsg(msg *dns.Msg, src net.IP, srcPort uint16, dst net.IP, dstPort uint16) {
+	// Packing a message is not always a read-only operation, make a copy
+	payload, err := msg.Copy().Pack()
+	if err != nil || len(payload) > pcapMaxPayload {
+		r.metrics.errors.Add(1)
+		return
+	}
+	pkt := udpPacket(src, srcPort, dst, dstPort, payload)
+
+	// Record header: timestamp, captured and original length
+	rec := make([]byte, 16, 16+len(pkt))
+	now := time.Now()
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+
+	if _, err := r.out.Write(rec); err != nil {
+		Log.Error("failed to write to pcap file", "id", r.id, "error", err)
+		r.metrics.errors.Add(1)
+	}
+}
+
+// Builds an IPv4 or IPv6 packet with UDP header and the payload. Nil addresses
+// are replaced with the unspecified address of the family of the other one.
+func udpPacket(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, payload []byte) []byte {
+	ipv4 := (src == nil || src.To4() != nil) && (dst == nil || dst.To4() != nil)
+	if src == nil {
+		src = net.IPv6unspecified
+		if ipv4 {
+			src = net.IPv4zero
+		}
+	}
+	if dst == nil {
+		dst = net.IPv6unspecified
+		if ipv4 {
+			dst = net.IPv4zero
+		}
+	}
+
+	udpLen := 8 + len(payload)
+	udp := make([]byte, 8, udpLen)
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	udp = append(udp, payload...)
+
+	var ip, pseudo []byte
+	if ipv4 {
+		src, dst = src.To4(), dst.To4()
+		ip = make([]byte, 20)
+		ip[0] = 0x45 // Version 4, header length 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+
+		pseudo = append(append(append([]byte{}, src...), dst...), 0, 17, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(udpLen))
+	} else {
+		src, dst = src.To16(), dst.To16()
+		ip = make([]byte, 40)
+		ip[0] = 0x60 // Version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = 17 // Next header UDP
+		ip[7] = 64 // Hop limit
+		copy(ip[8:], src)
+		copy(ip[24:], dst)
+
+		pseudo = append(append(append([]byte{}, src...), dst...), 0, 0, 0, 0, 0, 0, 0, 17)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(udpLen))
+	}
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(ip, udp...)
+}
+
+// Adds the data to a ones' complement internet checksum as per RFC1071.
+func checksum(initial uint16, b []byte) uint16 {
+	sum := uint32(initial)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
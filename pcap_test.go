@@ -0,0 +1,74 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPCAPWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pcap")
+	r, err := NewPCAPWriter("test-pcap", new(TestResolver), PCAPWriterOptions{OutputFile: filename})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.10")})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	b, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, uint32(pcapMagic), binary.LittleEndian.Uint32(b))
+	require.Equal(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(b[20:]))
+	b = b[24:]
+
+	// Query and response packets, check addresses and checksums
+	for _, src := range []net.IP{net.ParseIP("192.168.1.10").To4(), net.IPv4zero.To4()} {
+		n := binary.LittleEndian.Uint32(b[8:])
+		pkt := b[16 : 16+n]
+		b = b[16+n:]
+
+		require.Equal(t, byte(0x45), pkt[0])
+		require.Equal(t, uint16(0xffff), checksum(0, pkt[:20]))
+		require.Equal(t, src, net.IP(pkt[12:16]))
+
+		udp := pkt[20:]
+		pseudo := append(append([]byte{}, pkt[12:20]...), 0, 17, byte(len(udp)>>8), byte(len(udp)))
+		require.Equal(t, uint16(0xffff), checksum(checksum(0, pseudo), udp))
+
+		m := new(dns.Msg)
+		require.NoError(t, m.Unpack(udp[8:]))
+		require.Equal(t, "example.com.", m.Question[0].Name)
+	}
+	require.Empty(t, b)
+}
+
+func TestPCAPWriterRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pcap")
+	r, err := NewPCAPWriter("test-pcap", new(TestResolver), PCAPWriterOptions{
+		OutputFile: filename,
+		MaxSize:    200,
+		MaxFiles:   2,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("2001:db8::1")})
+		require.NoError(t, err)
+	}
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		require.LessOrEqual(t, fi.Size(), int64(200))
+	}
+	_, err = os.Stat(filename + ".3")
+	require.True(t, os.IsNotExist(err))
+}
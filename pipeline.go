@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -21,11 +22,15 @@ const idleTimeout = 10 * time.Second
 // gracefully. It opens a single connection on demand and uses it for all queries.
 // It can manage UDP, TCP, DNS-over-TLS, and DNS-over-DTLS connections.
 type Pipeline struct {
+	id       string
 	addr     string
 	client   DNSDialer
 	requests chan *request
 	metrics  *ListenerMetrics
 	timeout  time.Duration
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // DNSDialer is an abstraction for a dns.Client that returns a *dns.Conn.
@@ -39,11 +44,13 @@ func NewPipeline(id string, addr string, client DNSDialer, timeout time.Duration
 		timeout = defaultQueryTimeout
 	}
 	c := &Pipeline{
+		id:       id,
 		addr:     addr,
 		client:   client,
 		requests: make(chan *request),
 		metrics:  NewListenerMetrics("client", id),
 		timeout:  timeout,
+		closed:   make(chan struct{}),
 	}
 	go c.start()
 	return c
@@ -52,6 +59,7 @@ func NewPipeline(id string, addr string, client DNSDialer, timeout time.Duration
 // Resolve a single query using this connection.
 func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
 	r := newRequest(q)
+	start := time.Now()
 
 	timeout := time.NewTimer(c.timeout)
 	defer timeout.Stop()
@@ -59,9 +67,11 @@ func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
 	// Queue up the request or time out
 	select {
 	case c.requests <- r:
+	case <-c.closed:
+		return nil, upstreamError(c.id, errPipelineClosed)
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
-		return nil, QueryTimeoutError{q}
+		return nil, upstreamError(c.id, QueryTimeoutError{q})
 	}
 
 	// Wait for the request to complete or time out
@@ -69,12 +79,25 @@ func (c *Pipeline) Resolve(q *dns.Msg) (*dns.Msg, error) {
 	case <-r.done:
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
-		return nil, QueryTimeoutError{q}
+		return nil, upstreamError(c.id, QueryTimeoutError{q})
+	}
+
+	a, err := r.waitFor()
+	if err == nil {
+		c.metrics.duration.Observe(time.Since(start).Seconds())
 	}
+	return a, upstreamError(c.id, err)
+}
 
-	return r.waitFor()
+// Close the connection and stop the pipeline. Queries in flight fail with a
+// timeout.
+func (c *Pipeline) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
 }
 
+var errPipelineClosed = errors.New("pipeline closed")
+
 // Starts a loop that will wait for queries and open an upstream connection on-demand, writing queries
 // and reading answers concurrently using the same connection. It also handles errors like idle
 // close from upstream.
@@ -84,19 +107,34 @@ func (c *Pipeline) start() {
 		inFlight inFlightQueue
 	)
 	log := Log.With("addr", c.addr)
-	for req := range c.requests { // Lazy connection. Only open a real connection if there's a request
+	for {
+		// Lazy connection. Only open a real connection if there's a request
+		var req *request
+		select {
+		case req = <-c.requests:
+		case <-c.closed:
+			return
+		}
 		done := make(chan struct{})
 		log.Debug("opening connection")
 		conn, err := c.client.Dial(c.addr)
 		if err != nil {
 			c.metrics.err.Add("open", 1)
 			log.Error("failed to open connection", "error", err)
+			statusConnection(c.id, ConnectionFailed, err)
 			req.markDone(nil, err)
 			continue
 		}
+		statusConnection(c.id, ConnectionOpen, nil)
 		wg.Add(2)
 
-		go func(r *request) { c.requests <- r }(req) // re-queue the request that triggered the upstream connection
+		go func(r *request) { // re-queue the request that triggered the upstream connection
+			select {
+			case c.requests <- r:
+			case <-c.closed:
+				r.markDone(nil, errPipelineClosed)
+			}
+		}(req)
 
 		go func() { // writer
 			for {
@@ -118,6 +156,10 @@ func (c *Pipeline) start() {
 				case <-done: // the reader ran into an error and we want to stop using this connection
 					wg.Done()
 					return
+				case <-c.closed: // close the connection, which stops the reader as well
+					conn.Close()
+					wg.Done()
+					return
 				}
 			}
 		}()
@@ -130,6 +172,14 @@ func (c *Pipeline) start() {
 				_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
 				a, err := conn.ReadMsg()
 				if err != nil {
+					select {
+					case <-c.closed:
+						log.Debug("connection closed")
+						close(done)
+						wg.Done()
+						return
+					default:
+					}
 					switch e := err.(type) {
 					case net.Error:
 						if e.Timeout() {
@@ -179,6 +229,7 @@ func (c *Pipeline) start() {
 
 		// wait for both, sender and receiver to terminate before trying to reconnect
 		wg.Wait()
+		statusConnection(c.id, ConnectionIdle, nil)
 	}
 }
 
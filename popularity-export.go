@@ -0,0 +1,257 @@
+package rdns
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PopularityExport counts queries per domain and regularly sends the counts
+// to a URL, for example to contribute to research on blocklists shared by
+// several operators. Reports contain no client information. Names are only
+// included as-is if they were queried by at least K different clients in the
+// interval, otherwise they're replaced by a keyed hash so rare names, which
+// could identify a client, can't be read from the report.
+type PopularityExport struct {
+	id       string
+	resolver Resolver
+	opt      PopularityExportOptions
+	metrics  *PopularityExportMetrics
+	key      []byte
+
+	mu      sync.Mutex
+	start   time.Time // Start of the current interval
+	domains map[string]*popularityCounter
+	stop    chan struct{}
+}
+
+// PopularityExportOptions contain settings for the popularity export.
+type PopularityExportOptions struct {
+	// URL the reports are sent to in POST requests.
+	URL string
+
+	// Time between reports. Defaults to 1 hour.
+	Interval time.Duration
+
+	// Minimum number of different clients that queried a name in the
+	// interval for it to be reported as-is. Defaults to 10.
+	K int
+
+	// Key of the HMAC-SHA256 hash of names below K. Operators contributing
+	// to the same research can share a key to be able to compare hashes,
+	// but it must not be known to the receiver of the reports. A random key
+	// is used if empty, making hashes comparable only until restart.
+	HashKey string
+
+	// Maximum number of names counted per interval. Queries for further
+	// names are not counted. Defaults to 10000.
+	MaxEntries int
+
+	// Source of time for the intervals. Defaults to the system clock.
+	Clock Clock
+}
+
+// PopularityReport is the body of the request sent to the URL.
+type PopularityReport struct {
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	K       int               `json:"k"`
+	Domains []PopularityEntry `json:"domains"`
+}
+
+// PopularityEntry contains the counts for a name in a report. Either the
+// name or its hash is set.
+type PopularityEntry struct {
+	Name    string `json:"name,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Count   int64  `json:"count"`
+	Blocked int64  `json:"blocked"`
+}
+
+type PopularityExportMetrics struct {
+	// Reports sent.
+	exported *Counter
+	// Reports that failed to be sent.
+	failed *Counter
+}
+
+type popularityCounter struct {
+	count   int64
+	blocked int64
+	// Clients that queried the name, up to K. Never exported.
+	clients map[string]struct{}
+}
+
+const (
+	defaultPopularityInterval   = time.Hour
+	defaultPopularityK          = 10
+	defaultPopularityMaxEntries = 10000
+)
+
+var _ Resolver = &PopularityExport{}
+
+// NewPopularityExport returns a new instance of a popularity export and starts
+// sending reports in the background.
+func NewPopularityExport(id string, resolver Resolver, opt PopularityExportOptions) (*PopularityExport, error) {
+	if opt.URL == "" {
+		return nil, errors.New("no url defined for popularity export")
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = defaultPopularityInterval
+	}
+	if opt.K <= 0 {
+		opt.K = defaultPopularityK
+	}
+	if opt.MaxEntries <= 0 {
+		opt.MaxEntries = defaultPopularityMaxEntries
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	key := []byte(opt.HashKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	r := &PopularityExport{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		key:      key,
+		start:    opt.Clock.Now().UTC(),
+		domains:  make(map[string]*popularityCounter),
+		stop:     make(chan struct{}),
+		metrics: &PopularityExportMetrics{
+			exported: getCounter("router", id, "exported"),
+			failed:   getCounter("router", id, "export-failed"),
+		},
+	}
+	go r.exportLoop()
+	return r, nil
+}
+
+// Resolve a DNS query and count it.
+func (r *PopularityExport) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	blocked := new(atomic.Bool)
+	a, err := r.resolver.Resolve(q, ci.WithValue(queryStatsKey{}, blocked))
+	if blocked.Load() {
+		// Pass the flag on to elements in front of this one that count
+		// blocked queries as well
+		statsBlocked(ci)
+	}
+	var client string
+	if ci.SourceIP != nil {
+		client = ci.SourceIP.String()
+	}
+	r.record(strings.ToLower(qName(q)), client, blocked.Load())
+	return a, err
+}
+
+func (r *PopularityExport) String() string {
+	return r.id
+}
+
+// Close stops sending reports. Counts of the current interval are discarded.
+func (r *PopularityExport) Close() error {
+	close(r.stop)
+	return nil
+}
+
+func (r *PopularityExport) record(name, client string, blocked bool) {
+	if name == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.domains[name]
+	if !ok {
+		if len(r.domains) >= r.opt.MaxEntries {
+			return
+		}
+		c = &popularityCounter{clients: make(map[string]struct{})}
+		r.domains[name] = c
+	}
+	c.count++
+	if blocked {
+		c.blocked++
+	}
+	if client != "" && len(c.clients) < r.opt.K {
+		c.clients[client] = struct{}{}
+	}
+}
+
+// Returns the report of the current interval and starts a new one.
+func (r *PopularityExport) report() PopularityReport {
+	now := r.opt.Clock.Now().UTC()
+	r.mu.Lock()
+	domains, start := r.domains, r.start
+	r.domains = make(map[string]*popularityCounter)
+	r.start = now
+	r.mu.Unlock()
+
+	report := PopularityReport{
+		Start:   start,
+		End:     now,
+		K:       r.opt.K,
+		Domains: make([]PopularityEntry, 0, len(domains)),
+	}
+	for name, c := range domains {
+		entry := PopularityEntry{Count: c.count, Blocked: c.blocked}
+		if len(c.clients) >= r.opt.K {
+			entry.Name = name
+		} else {
+			entry.Hash = r.hash(name)
+		}
+		report.Domains = append(report.Domains, entry)
+	}
+	// Sort by count so the order doesn't tell when a name was first queried
+	slices.SortFunc(report.Domains, func(a, b PopularityEntry) int {
+		if n := cmp.Compare(b.Count, a.Count); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Name+a.Hash, b.Name+b.Hash)
+	})
+	return report
+}
+
+func (r *PopularityExport) hash(name string) string {
+	h := hmac.New(sha256.New, r.key)
+	h.Write([]byte(name))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sends a report of the current interval.
+func (r *PopularityExport) export() error {
+	report := r.report()
+	if err := postWebhook(r.opt.URL, report); err != nil {
+		r.metrics.failed.Add(1)
+		return err
+	}
+	r.metrics.exported.Add(1)
+	return nil
+}
+
+func (r *PopularityExport) exportLoop() {
+	ticker := time.NewTicker(r.opt.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.export(); err != nil {
+				Log.Warn("failed to send popularity report", "id", r.id, "url", r.opt.URL, "error", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopularityExport(t *testing.T) {
+	reports := make(chan PopularityReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report PopularityReport
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		reports <- report
+	}))
+	defer server.Close()
+
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if strings.EqualFold(q.Question[0].Name, "ads.example.com.") {
+				statsBlocked(ci)
+				return refused(q), nil
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r, err := NewPopularityExport("test-popularity", upstream, PopularityExportOptions{
+		URL:      server.URL,
+		Interval: time.Hour,
+		K:        3,
+		HashKey:  "secret",
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	query := func(name string, client int) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		ci := ClientInfo{SourceIP: net.ParseIP(fmt.Sprintf("192.168.1.%d", client))}
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Popular names queried by 3 clients, a rare name by only one client
+	for client := range 3 {
+		query("www.example.com.", client)
+		query("Ads.Example.com.", client)
+	}
+	query("www.example.com.", 0)
+	query("rare.example.com.", 0)
+	query("rare.example.com.", 0)
+	query("rare.example.com.", 0)
+	query("rare.example.com.", 0)
+	query("rare.example.com.", 0)
+
+	require.NoError(t, r.export())
+	report := <-reports
+	require.Equal(t, 3, report.K)
+	require.Equal(t, []PopularityEntry{
+		{Hash: r.hash("rare.example.com."), Count: 5},
+		{Name: "www.example.com.", Count: 4},
+		{Name: "ads.example.com.", Count: 3, Blocked: 3},
+	}, report.Domains)
+	require.NotContains(t, report.Domains[0].Hash, "rare")
+
+	// A new interval starts with every report
+	require.NoError(t, r.export())
+	report = <-reports
+	require.Empty(t, report.Domains)
+	require.Equal(t, int64(2), r.metrics.exported.Value())
+}
@@ -0,0 +1,98 @@
+package rdns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// PrometheusListener is an HTTP(S) server that publishes the metrics of all
+// elements at /metrics in the Prometheus text format, to be scraped by
+// Prometheus directly.
+type PrometheusListener struct {
+	httpServer *http.Server
+
+	id   string
+	addr string
+	opt  PrometheusListenerOptions
+}
+
+var _ Listener = &PrometheusListener{}
+
+// PrometheusListenerOptions contains options used by the metrics server.
+type PrometheusListenerOptions struct {
+	ListenOptions
+
+	TLSConfig *tls.Config
+
+	// Serve the metrics over plain HTTP.
+	NoTLS bool
+
+	// Exporter of the metrics. Defaults to one exporting DefaultRegistry.
+	Exporter *PrometheusExporter
+}
+
+// Read/Write timeout of the metrics server
+const prometheusServerTimeout = 10 * time.Second
+
+// NewPrometheusListener returns an instance of a metrics server.
+func NewPrometheusListener(id, addr string, opt PrometheusListenerOptions) *PrometheusListener {
+	if opt.Exporter == nil {
+		opt.Exporter = new(PrometheusExporter)
+	}
+	return &PrometheusListener{
+		id:   id,
+		addr: addr,
+		opt:  opt,
+	}
+}
+
+// Start the metrics server.
+func (s *PrometheusListener) Start() error {
+	Log.Info("starting listener",
+		"id", s.id,
+		"protocol", "prometheus",
+		"addr", s.addr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	s.httpServer = &http.Server{
+		Addr:         s.addr,
+		TLSConfig:    s.opt.TLSConfig,
+		Handler:      mux,
+		ReadTimeout:  prometheusServerTimeout,
+		WriteTimeout: prometheusServerTimeout,
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if s.opt.NoTLS {
+		return s.httpServer.Serve(ln)
+	}
+	return s.httpServer.ServeTLS(ln, "", "")
+}
+
+// Stop the server.
+func (s *PrometheusListener) Stop() error {
+	Log.Info("stopping listener",
+		"id", s.id,
+		"protocol", "prometheus",
+		"addr", s.addr)
+	return s.httpServer.Shutdown(context.Background())
+}
+
+func (s *PrometheusListener) String() string {
+	return s.id
+}
+
+func (s *PrometheusListener) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if action, _ := s.opt.clientAction(ParseClientIP(client), nil); action != ACLActionAllow {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.opt.Exporter.ServeHTTP(w, r)
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QPSLimiter limits the rate of queries sent to an upstream resolver with a
+// token bucket, for providers that block clients exceeding a number of queries
+// per second. Short bursts up to the bucket size are sent right away, queries
+// beyond that are paced to the rate. Queries that would have to wait longer
+// than the maximum wait time fail with ErrQPSExceeded, which groups like
+// fail-rotate treat as failure of the resolver.
+type QPSLimiter struct {
+	id       string
+	resolver Resolver
+	opt      QPSLimiterOptions
+	metrics  *QPSLimiterMetrics
+
+	mu     sync.Mutex
+	tokens float64   // Tokens in the bucket, negative if queries are waiting
+	last   time.Time // Time the bucket was last refilled
+}
+
+// QPSLimiterOptions contain settings for the outbound query rate limit.
+type QPSLimiterOptions struct {
+	// Queries per second sent to the resolver.
+	QPS float64
+
+	// Number of queries that can be sent at once after a quiet period.
+	// Defaults to the QPS, rounded up.
+	Burst int
+
+	// Maximum time a query waits to be sent. Queries exceeding the rate fail
+	// right away if 0.
+	MaxWait time.Duration
+
+	// Source of time for the bucket. Defaults to the system clock.
+	Clock Clock
+}
+
+type QPSLimiterMetrics struct {
+	// Queries that waited to be sent.
+	delayed *Counter
+	// Queries not sent since they would have waited too long.
+	rejected *Counter
+}
+
+var _ Resolver = &QPSLimiter{}
+
+// NewQPSLimiter returns a resolver that limits the rate of queries sent to
+// the given resolver.
+func NewQPSLimiter(id string, resolver Resolver, opt QPSLimiterOptions) (*QPSLimiter, error) {
+	if opt.QPS <= 0 {
+		return nil, fmt.Errorf("invalid qps limit %v", opt.QPS)
+	}
+	if opt.Burst <= 0 {
+		opt.Burst = int(math.Ceil(opt.QPS))
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	return &QPSLimiter{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		tokens:   float64(opt.Burst),
+		last:     opt.Clock.Now(),
+		metrics: &QPSLimiterMetrics{
+			delayed:  getCounter("client", id, "qps-delayed"),
+			rejected: getCounter("client", id, "qps-rejected"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query once the rate allows it.
+func (r *QPSLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	wait, ok := r.reserve()
+	if !ok {
+		log.Debug("query rate exceeded, failing query")
+		r.metrics.rejected.Add(1)
+		return nil, fmt.Errorf("%w for '%s'", ErrQPSExceeded, r.id)
+	}
+	if wait > 0 {
+		log.Debug("query rate exceeded, delaying query", "wait", wait)
+		r.metrics.delayed.Add(1)
+		r.opt.Clock.Sleep(wait)
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *QPSLimiter) String() string {
+	return r.resolver.String()
+}
+
+// Takes a token from the bucket and returns how long the query has to wait
+// for it. Returns false if that's longer than the maximum wait time, in which
+// case no token is taken.
+func (r *QPSLimiter) reserve() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.opt.Clock.Now()
+	if elapsed := now.Sub(r.last); elapsed > 0 {
+		r.tokens = min(float64(r.opt.Burst), r.tokens+elapsed.Seconds()*r.opt.QPS)
+		r.last = now
+	}
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - r.tokens) / r.opt.QPS * float64(time.Second))
+	if wait > r.opt.MaxWait {
+		return 0, false
+	}
+	r.tokens--
+	return wait, true
+}
@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQPSLimiter(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	upstream := new(TestResolver)
+	r, err := NewQPSLimiter("test-qps", upstream, QPSLimiterOptions{
+		QPS:     2,
+		Burst:   3,
+		MaxWait: time.Second,
+		Clock:   clock,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The burst is sent right away
+	for range 3 {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, upstream.HitCount())
+
+	// The next two queries wait for 500ms and 1s
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := r.Resolve(q, ClientInfo{})
+			done <- err
+		}()
+	}
+	clock.BlockUntil(2)
+
+	// A third would have to wait longer than allowed and fails with an error
+	// groups can fail over on
+	_, err = r.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrQPSExceeded)
+	require.True(t, isFailoverError(err))
+	require.Equal(t, int64(1), r.metrics.rejected.Value())
+
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, <-done)
+	require.Equal(t, 4, upstream.HitCount())
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, <-done)
+	require.Equal(t, 5, upstream.HitCount())
+	require.Equal(t, int64(2), r.metrics.delayed.Value())
+
+	// After a quiet period, the bucket is full again but never holds more
+	// than the burst
+	clock.Advance(time.Minute)
+	for range 3 {
+		_, err = r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(2), r.metrics.delayed.Value())
+}
+
+func TestQPSLimiterNoWait(t *testing.T) {
+	r, err := NewQPSLimiter("test-qps-nowait", new(TestResolver), QPSLimiterOptions{
+		QPS:   0.5,
+		Clock: NewFakeClock(time.Now()),
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.True(t, errors.Is(err, ErrQPSExceeded))
+}
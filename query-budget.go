@@ -0,0 +1,338 @@
+package rdns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryBudget is a resolver that limits the number of queries sent to its
+// upstream resolver per day and month, for example to control the cost of
+// paid DNS services. Once the budget is used up, queries are sent to an
+// alternative resolver or answered with stale responses until the next day
+// or month begins. Counters can be written to a file to survive restarts.
+type QueryBudget struct {
+	id       string
+	resolver Resolver
+	opt      QueryBudgetOptions
+	backend  cacheAnswerLookup
+	metrics  *QueryBudgetMetrics
+
+	// Set if the backend was created by the budget and needs to be closed
+	// with it.
+	ownBackend bool
+
+	mu    sync.Mutex
+	usage budgetUsage
+	saved budgetUsage // Counters last written to file
+	stop  chan struct{}
+}
+
+// QueryBudgetOptions contain settings for the query budget.
+type QueryBudgetOptions struct {
+	// Maximum number of queries per day (UTC). Unlimited if 0.
+	Daily int
+
+	// Maximum number of queries per month (UTC). Unlimited if 0.
+	Monthly int
+
+	// What to do with queries when the budget is exhausted. Defaults to
+	// QueryBudgetFailover.
+	Exhausted QueryBudgetAction
+
+	// Resolver for queries when the budget is exhausted. Used for queries
+	// without stale response with QueryBudgetStale.
+	FailoverResolver Resolver
+
+	// Load the counters from file on startup and write them regularly and
+	// on close. Counters are lost on restart if not set.
+	Filename string
+
+	// Backend holding the stale responses. Defaults to a memory backend.
+	Backend CacheBackend
+
+	// How long responses are kept to be served stale once the budget is
+	// exhausted. Defaults to 1 day.
+	StaleTTL time.Duration
+
+	// Source of time for the budget periods. Defaults to the system clock.
+	Clock Clock
+}
+
+// QueryBudgetAction defines how queries are handled when the budget is
+// exhausted.
+type QueryBudgetAction string
+
+const (
+	// Send queries to the failover resolver.
+	QueryBudgetFailover QueryBudgetAction = "fail-over"
+
+	// Answer queries with responses received while there was budget left,
+	// even if they're expired.
+	QueryBudgetStale QueryBudgetAction = "stale"
+)
+
+type QueryBudgetMetrics struct {
+	// Queries sent upstream in the current day.
+	daily *Gauge
+	// Queries sent upstream in the current month.
+	monthly *Gauge
+	// Queries received with the budget exhausted, by how they were handled.
+	exhausted *CounterMap
+}
+
+// Queries in the current day and month.
+type budgetUsage struct {
+	Day     string `json:"day"` // Day of the count in the form 2006-01-02
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"` // Month of the count in the form 2006-01
+	Monthly int    `json:"monthly"`
+}
+
+const (
+	// Time between writing counters to file.
+	budgetSaveInterval = 10 * time.Second
+
+	// TTL of records in stale responses, as recommended in RFC8767.
+	budgetStaleAnswerTTL = 30
+
+	// Default time to keep responses to serve them stale.
+	defaultBudgetStaleTTL = 24 * time.Hour
+)
+
+var _ Resolver = &QueryBudget{}
+
+// NewQueryBudget returns a new instance of a query budget resolver.
+func NewQueryBudget(id string, resolver Resolver, opt QueryBudgetOptions) (*QueryBudget, error) {
+	switch opt.Exhausted {
+	case "":
+		opt.Exhausted = QueryBudgetFailover
+		fallthrough
+	case QueryBudgetFailover:
+		if opt.FailoverResolver == nil {
+			return nil, errors.New("query budget with fail-over requires a failover resolver")
+		}
+	case QueryBudgetStale:
+	default:
+		return nil, fmt.Errorf("unsupported action %q", opt.Exhausted)
+	}
+	if opt.StaleTTL == 0 {
+		opt.StaleTTL = defaultBudgetStaleTTL
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	var ownBackend bool
+	if opt.Backend == nil {
+		opt.Backend = NewMemoryBackend(MemoryBackendOptions{Clock: opt.Clock})
+		ownBackend = true
+	}
+	backend, ok := opt.Backend.(cacheAnswerLookup)
+	if !ok {
+		return nil, errors.New("cache backend not supported by query budget")
+	}
+	r := &QueryBudget{
+		id:         id,
+		resolver:   resolver,
+		opt:        opt,
+		backend:    backend,
+		ownBackend: ownBackend,
+		stop:       make(chan struct{}),
+		metrics: &QueryBudgetMetrics{
+			daily:     getGauge("router", id, "budget-daily"),
+			monthly:   getGauge("router", id, "budget-monthly"),
+			exhausted: getCounterMap("router", id, "budget-exhausted", "action"),
+		},
+	}
+	if opt.Filename != "" {
+		r.loadFromFile()
+		go r.intervalSave()
+	}
+	return r, nil
+}
+
+// Resolve a DNS query using the upstream resolver if there's budget left.
+func (r *QueryBudget) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.spend() {
+		a, err := r.resolver.Resolve(q, ci)
+		if err == nil && r.opt.Exhausted == QueryBudgetStale {
+			r.storeStale(q, a)
+		}
+		return a, err
+	}
+	log := logger(r.id, q, ci)
+	if r.opt.Exhausted == QueryBudgetStale {
+		if a, ok := r.lookupStale(q); ok {
+			log.Debug("budget exhausted, responding with stale answer")
+			r.metrics.exhausted.Add("stale", 1)
+			return a, nil
+		}
+	}
+	if r.opt.FailoverResolver != nil {
+		log.Debug("budget exhausted, forwarding", "resolver", r.opt.FailoverResolver.String())
+		r.metrics.exhausted.Add("fail-over", 1)
+		return r.opt.FailoverResolver.Resolve(q, ci)
+	}
+	log.Debug("budget exhausted, no stale answer")
+	r.metrics.exhausted.Add("error", 1)
+	return nil, fmt.Errorf("query budget of '%s' exhausted", r.id)
+}
+
+func (r *QueryBudget) String() string {
+	return r.id
+}
+
+// Close writes the counters to file if one is configured, and closes the
+// backend unless it was passed in the options.
+func (r *QueryBudget) Close() error {
+	close(r.stop)
+	var errs []error
+	if r.opt.Filename != "" {
+		errs = append(errs, r.writeToFile())
+	}
+	if r.ownBackend {
+		errs = append(errs, r.opt.Backend.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Counts a query against the budget. Returns false if the budget is
+// exhausted.
+func (r *QueryBudget) spend() bool {
+	now := r.opt.Clock.Now().UTC()
+	r.mu.Lock()
+	r.usage.roll(now)
+	if (r.opt.Daily > 0 && r.usage.Daily >= r.opt.Daily) || (r.opt.Monthly > 0 && r.usage.Monthly >= r.opt.Monthly) {
+		r.mu.Unlock()
+		return false
+	}
+	r.usage.Daily++
+	r.usage.Monthly++
+	usage := r.usage
+	r.mu.Unlock()
+
+	r.metrics.daily.Set(int64(usage.Daily))
+	r.metrics.monthly.Set(int64(usage.Monthly))
+	return true
+}
+
+// Resets the counters when a new day or month begins.
+func (u *budgetUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); day != u.Day {
+		u.Day = day
+		u.Daily = 0
+	}
+	if month := now.Format("2006-01"); month != u.Month {
+		u.Month = month
+		u.Monthly = 0
+	}
+}
+
+// Writes the counters to file in an interval until the budget is closed.
+func (r *QueryBudget) intervalSave() {
+	ticker := time.NewTicker(budgetSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = r.writeToFile()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Writes the counters to file if they changed since the last write.
+func (r *QueryBudget) writeToFile() error {
+	r.mu.Lock()
+	usage, saved := r.usage, r.saved
+	r.mu.Unlock()
+	if usage == saved {
+		return nil
+	}
+	log := Log.With("id", r.id, "filename", r.opt.Filename)
+	b, err := json.Marshal(usage)
+	if err != nil {
+		log.Warn("failed to encode query budget counters", "error", err)
+		return err
+	}
+	// Write to a temporary file first to not lose the counters if writing
+	// fails part-way
+	tmp := r.opt.Filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		log.Warn("failed to write query budget counters", "error", err)
+		return err
+	}
+	if err := os.Rename(tmp, r.opt.Filename); err != nil {
+		log.Warn("failed to write query budget counters", "error", err)
+		return err
+	}
+	r.mu.Lock()
+	r.saved = usage
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *QueryBudget) loadFromFile() {
+	log := Log.With("id", r.id, "filename", r.opt.Filename)
+	b, err := os.ReadFile(r.opt.Filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("failed to read query budget counters", "error", err)
+		}
+		return
+	}
+	var u budgetUsage
+	if err := json.Unmarshal(b, &u); err != nil {
+		log.Warn("failed to decode query budget counters", "error", err)
+		return
+	}
+	r.saved = u
+	u.roll(r.opt.Clock.Now().UTC())
+	r.usage = u
+	r.metrics.daily.Set(int64(u.Daily))
+	r.metrics.monthly.Set(int64(u.Monthly))
+	log.Debug("loaded query budget counters", "daily", u.Daily, "monthly", u.Monthly)
+}
+
+// Stores a response to serve it stale once the budget is exhausted.
+func (r *QueryBudget) storeStale(q, a *dns.Msg) {
+	if a == nil || len(q.Question) != 1 || a.Truncated {
+		return
+	}
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return
+	}
+	now := r.opt.Clock.Now()
+	r.opt.Backend.Store(q, &cacheAnswer{
+		Timestamp: now,
+		Expiry:    now.Add(r.opt.StaleTTL),
+		Msg:       a.Copy(),
+	})
+}
+
+// Returns a stored response regardless of the TTL of its records, with the
+// TTLs set to a short value.
+func (r *QueryBudget) lookupStale(q *dns.Msg) (*dns.Msg, bool) {
+	if len(q.Question) != 1 {
+		return nil, false
+	}
+	item, ok := r.backend.lookupAnswer(q)
+	if !ok {
+		return nil, false
+	}
+	a := item.Msg
+	a.Id = q.Id
+	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+			rr.Header().Ttl = budgetStaleAnswerTTL
+		}
+	}
+	return a, true
+}
@@ -0,0 +1,100 @@
+package rdns
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryBudgetFailover(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	failover := new(TestResolver)
+	clock := NewFakeClock(time.Date(2026, 1, 30, 12, 0, 0, 0, time.UTC))
+	opt := QueryBudgetOptions{
+		Daily:            2,
+		Monthly:          3,
+		FailoverResolver: failover,
+		Filename:         filepath.Join(t.TempDir(), "budget.json"),
+		Clock:            clock,
+	}
+	r, err := NewQueryBudget("test-budget-failover", upstream, opt)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	resolve := func() {
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// Daily budget of 2 queries
+	resolve()
+	resolve()
+	resolve()
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 1, failover.HitCount())
+
+	// The next day, only 1 query is left in the monthly budget
+	clock.Advance(24 * time.Hour)
+	resolve()
+	resolve()
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, 2, failover.HitCount())
+
+	// Counters are written on close and loaded from file
+	require.NoError(t, r.Close())
+	r, err = NewQueryBudget("test-budget-failover", upstream, opt)
+	require.NoError(t, err)
+	defer r.Close()
+	resolve()
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, 3, failover.HitCount())
+
+	// New month, new budget
+	clock.Advance(24 * time.Hour)
+	resolve()
+	require.Equal(t, 4, upstream.HitCount())
+}
+
+func TestQueryBudgetStale(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+	clock := NewFakeClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	r, err := NewQueryBudget("test-budget-stale", upstream, QueryBudgetOptions{
+		Daily:     1,
+		Exhausted: QueryBudgetStale,
+		Clock:     clock,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+
+	// Budget exhausted, the response is served stale even after its TTL
+	clock.Advance(time.Hour)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(budgetStaleAnswerTTL), a.Answer[0].Header().Ttl)
+
+	// Nothing stale to serve and no failover resolver
+	q.SetQuestion("other.example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
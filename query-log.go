@@ -2,19 +2,26 @@ package rdns
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-// QueryLogResolver logs requests to STDOUT or file.
+// QueryLogResolver logs queries and their responses to STDOUT or file.
 type QueryLogResolver struct {
 	id       string
 	resolver Resolver
 	opt      QueryLogResolverOptions
 	logger   *slog.Logger
+	out      io.WriteCloser // Output file, nil for STDOUT
+	metrics  *QueryLogMetrics
 }
 
 var _ Resolver = &QueryLogResolver{}
@@ -22,6 +29,23 @@ var _ Resolver = &QueryLogResolver{}
 type QueryLogResolverOptions struct {
 	OutputFile   string // Output filename, leave blank for STDOUT
 	OutputFormat LogFormat
+
+	// Rotate the output file when it grows beyond this size in bytes.
+	// Disabled if 0.
+	MaxSize int64
+
+	// Number of rotated files to keep, named <OutputFile>.1 to .N with .1
+	// being the most recent. Defaults to 1.
+	MaxFiles int
+
+	// Optional, redact names and clients in the log. Not supported by the
+	// dnstap format which logs the complete messages.
+	Redaction *LogRedaction
+}
+
+type QueryLogMetrics struct {
+	// Failed writes to the log.
+	errors *Counter
 }
 
 type LogFormat string
@@ -29,45 +53,93 @@ type LogFormat string
 const (
 	LogFormatText LogFormat = "text"
 	LogFormatJSON LogFormat = "json"
+
+	// Client query and response messages in dnstap format, written to
+	// Frame Streams files.
+	LogFormatDnstap LogFormat = "dnstap"
 )
 
 // NewQueryLogResolver returns a new instance of a QueryLogResolver.
 func NewQueryLogResolver(id string, resolver Resolver, opt QueryLogResolverOptions) (*QueryLogResolver, error) {
-	w := os.Stdout
+	r := &QueryLogResolver{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &QueryLogMetrics{
+			errors: getCounter("router", id, "error"),
+		},
+	}
+	var fileOpt rotatingFileOptions
+	switch opt.OutputFormat {
+	case "", LogFormatText, LogFormatJSON:
+	case LogFormatDnstap:
+		if opt.OutputFile == "" {
+			return nil, errors.New("dnstap format requires an output file")
+		}
+		if opt.Redaction != nil {
+			return nil, errors.New("dnstap format doesn't support redaction")
+		}
+		fileOpt.Header = fstrmControlFrame(fstrmControlStart)
+		fileOpt.Footer = fstrmControlFrame(fstrmControlStop)
+	default:
+		return nil, fmt.Errorf("invalid output format %q", opt.OutputFormat)
+	}
+
+	var w io.Writer = os.Stdout
 	if opt.OutputFile != "" {
-		f, err := os.OpenFile(opt.OutputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		fileOpt.MaxSize = opt.MaxSize
+		fileOpt.MaxFiles = opt.MaxFiles
+		f, err := openRotatingFile(opt.OutputFile, fileOpt)
 		if err != nil {
 			return nil, err
 		}
+		r.out = f
 		w = f
 	}
 	handlerOpts := &slog.HandlerOptions{
 		ReplaceAttr: logReplaceAttr,
 	}
-	var logger *slog.Logger
 	switch opt.OutputFormat {
 	case "", LogFormatText:
-		logger = slog.New(slog.NewTextHandler(w, handlerOpts))
+		r.logger = slog.New(slog.NewTextHandler(w, handlerOpts))
 	case LogFormatJSON:
-		logger = slog.New(slog.NewJSONHandler(w, handlerOpts))
-	default:
-		return nil, fmt.Errorf("invalid output format %q", opt.OutputFormat)
+		r.logger = slog.New(slog.NewJSONHandler(w, handlerOpts))
 	}
-	return &QueryLogResolver{
-		resolver: resolver,
-		logger:   logger,
-	}, nil
+	return r, nil
 }
 
-// Resolve logs the query details and passes the query to the next resolver.
+// Resolve passes the query to the next resolver and logs the query details
+// with the response code, the time taken and the upstream resolvers.
 func (r *QueryLogResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.opt.Redaction.Skip(q) {
+		return r.resolver.Resolve(q, ci)
+	}
+	upstreams := new(queryLogUpstreams)
+	start := time.Now()
+	a, err := r.resolver.Resolve(q, ci.WithValue(queryLogKey{}, upstreams))
+	end := time.Now()
+
+	if r.opt.OutputFormat == LogFormatDnstap {
+		r.writeDnstap(q, a, ci, start, end, upstreams.String())
+		return a, err
+	}
+
 	question := q.Question[0]
+	name := r.opt.Redaction.Name(question.Name)
 	attrs := []slog.Attr{
-		slog.String("source-ip", ci.SourceIP.String()),
-		slog.String("question-name", question.Name),
+		slog.String("source-ip", r.opt.Redaction.Client(ci.SourceIP)),
+	}
+	if group := ci.ClientGroup(); group != "" {
+		attrs = append(attrs, slog.String("client-group", group))
+	}
+	attrs = append(attrs, slog.String("question-name", name))
+	if u := unicodeName(name); u != "" {
+		attrs = append(attrs, slog.String("question-name-unicode", u))
+	}
+	attrs = append(attrs,
 		slog.String("question-class", dns.Class(question.Qclass).String()),
 		slog.String("question-type", dns.Type(question.Qtype).String()),
-	}
+	)
 
 	// Add ECS attributes if present
 	edns0 := q.IsEdns0()
@@ -76,19 +148,100 @@ func (r *QueryLogResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error)
 		for _, opt := range edns0.Option {
 			ecs, ok := opt.(*dns.EDNS0_SUBNET)
 			if ok {
-				attrs = append(attrs, slog.String("ecs-addr", ecs.Address.String()))
+				attrs = append(attrs, slog.String("ecs-addr", r.opt.Redaction.Client(ecs.Address)))
 			}
 		}
 	}
 
+	switch {
+	case err != nil:
+		attrs = append(attrs, slog.String("error", err.Error()))
+	case a == nil:
+		attrs = append(attrs, slog.String("rcode", "DROP"))
+	default:
+		attrs = append(attrs, slog.String("rcode", dns.RcodeToString[a.Rcode]))
+	}
+	attrs = append(attrs, slog.Duration("rtt", end.Sub(start)))
+	if s := upstreams.String(); s != "" {
+		attrs = append(attrs, slog.String("upstream", s))
+	}
+
 	r.logger.LogAttrs(context.Background(), slog.LevelInfo, "", attrs...)
-	return r.resolver.Resolve(q, ci)
+	return a, err
 }
 
 func (r *QueryLogResolver) String() string {
 	return r.id
 }
 
+// Close the output file.
+func (r *QueryLogResolver) Close() error {
+	if r.out == nil {
+		return nil
+	}
+	return r.out.Close()
+}
+
+// Writes the query and response as dnstap messages. The upstream resolvers
+// are written in the extra field.
+func (r *QueryLogResolver) writeDnstap(q, a *dns.Msg, ci ClientInfo, start, end time.Time, upstreams string) {
+	m := dnstapMessage{
+		identity:  r.id,
+		version:   "routedns " + BuildVersion,
+		extra:     upstreams,
+		client:    ci.SourceIP,
+		transport: ci.Transport,
+		queryTime: start,
+	}
+	var err error
+	m.query, err = q.Pack()
+	if err != nil {
+		r.metrics.errors.Add(1)
+		return
+	}
+	frames := m.frame()
+	if a != nil {
+		m.responseTime = end
+		m.response, err = a.Pack()
+		if err != nil {
+			r.metrics.errors.Add(1)
+			return
+		}
+		frames = append(frames, m.frame()...)
+	}
+	if _, err := r.out.Write(frames); err != nil {
+		Log.Error("failed to write query log", "id", r.id, "error", err)
+		r.metrics.errors.Add(1)
+	}
+}
+
+// Metadata key of the upstream resolvers a query is sent to.
+type queryLogKey struct{}
+
+// Upstream resolvers a query was sent to. Safe for concurrent use, as groups
+// like "fastest" send queries to several resolvers at once.
+type queryLogUpstreams struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (u *queryLogUpstreams) String() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return strings.Join(u.ids, ",")
+}
+
+// Records that a query is sent to an upstream resolver, if it's logged.
+func traceUpstream(ci ClientInfo, id string) {
+	u, ok := ci.Value(queryLogKey{}).(*queryLogUpstreams)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	u.ids = append(u.ids, id)
+	u.mu.Unlock()
+}
+
 func logReplaceAttr(groups []string, a slog.Attr) slog.Attr {
 	if a.Key == "msg" || a.Key == "level" {
 		return slog.Attr{}
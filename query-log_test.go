@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLogJSON(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "query.log")
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			traceUpstream(ci, "upstream-dot")
+			return nxdomain(q), nil
+		},
+	}
+	r, err := NewQueryLogResolver("test-query-log", upstream, QueryLogResolverOptions{
+		OutputFile:   filename,
+		OutputFormat: LogFormatJSON,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	b, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(b, &record))
+	require.Equal(t, "192.0.2.1", record["source-ip"])
+	require.Equal(t, "example.com.", record["question-name"])
+	require.Equal(t, "NXDOMAIN", record["rcode"])
+	require.Equal(t, "upstream-dot", record["upstream"])
+	require.Contains(t, record, "rtt")
+	require.Contains(t, record, "time")
+}
+
+func TestQueryLogDnstap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "query.dnstap")
+	r, err := NewQueryLogResolver("test-query-log", new(TestResolver), QueryLogResolverOptions{
+		OutputFile:   filename,
+		OutputFormat: LogFormatDnstap,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1"), Transport: "doh"})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// START control frame, query and response data frames, STOP control frame
+	b, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	start := fstrmControlFrame(fstrmControlStart)
+	require.True(t, bytes.HasPrefix(b, start))
+	b = b[len(start):]
+	var frames [][]byte
+	for {
+		n := binary.BigEndian.Uint32(b)
+		if n == 0 {
+			break
+		}
+		frames = append(frames, b[4:4+n])
+		b = b[4+n:]
+	}
+	require.Equal(t, fstrmControlFrame(fstrmControlStop), b)
+	require.Len(t, frames, 2)
+
+	// The query message is contained in the first frame
+	packed, err := q.Pack()
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(frames[0], packed))
+	require.True(t, bytes.Contains(frames[0], []byte("test-query-log")))
+
+	// Files aren't appended to once they're closed with a STOP frame
+	r, err = NewQueryLogResolver("test-query-log", new(TestResolver), QueryLogResolverOptions{
+		OutputFile:   filename,
+		OutputFormat: LogFormatDnstap,
+	})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	_, err = os.Stat(filename + ".1")
+	require.NoError(t, err)
+}
@@ -0,0 +1,385 @@
+package rdns
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryStats is a resolver that aggregates query statistics over time, per
+// hour and per day. It counts queries per domain and per client, and which
+// of them were blocked by blocklists further down the pipeline. The counters
+// are served by the admin listener and can be written to a file to keep them
+// across restarts.
+type QueryStats struct {
+	id       string
+	resolver Resolver
+	opt      QueryStatsOptions
+
+	mu    sync.Mutex
+	hours []*statsBucket // Oldest first
+	days  []*statsBucket // Oldest first
+	stop  chan struct{}
+}
+
+// QueryStatsOptions contain settings for the query statistics.
+type QueryStatsOptions struct {
+	// Load the statistics from file on startup and write them on close.
+	Filename string
+
+	// Write the file in an interval. Only written on close if not set.
+	SaveInterval time.Duration
+
+	// Number of hourly buckets to keep. Defaults to 48.
+	HourlyRetention int
+
+	// Number of daily buckets to keep. Defaults to 30.
+	DailyRetention int
+
+	// Maximum number of domains and clients counted per bucket. Queries for
+	// further domains or from further clients are only included in the
+	// totals. Defaults to 10000.
+	MaxEntries int
+
+	// Source of time for the buckets. Defaults to the system clock.
+	Clock Clock
+}
+
+// StatsWindow is the granularity of query statistics.
+type StatsWindow string
+
+const (
+	StatsHour StatsWindow = "hour"
+	StatsDay  StatsWindow = "day"
+)
+
+// StatsKind selects the counters of a top list.
+type StatsKind string
+
+const (
+	StatsDomains        StatsKind = "domains"
+	StatsBlockedDomains StatsKind = "blocked"
+	StatsClients        StatsKind = "clients"
+)
+
+// StatsEntry is an item in a top list.
+type StatsEntry struct {
+	Name    string `json:"name"`
+	Unicode string `json:"unicode,omitempty"` // Unicode form of internationalized domains
+	Count   int64  `json:"count"`
+}
+
+// StatsTotal holds the number of queries in one hour or day.
+type StatsTotal struct {
+	Start   time.Time `json:"start"`
+	Queries int64     `json:"queries"`
+	Blocked int64     `json:"blocked"`
+}
+
+// Counters of one hour or day.
+type statsBucket struct {
+	Start          time.Time        `json:"start"`
+	Queries        int64            `json:"queries"`
+	Blocked        int64            `json:"blocked"`
+	Domains        map[string]int64 `json:"domains"`
+	BlockedDomains map[string]int64 `json:"blocked-domains"`
+	Clients        map[string]int64 `json:"clients"`
+}
+
+// Format of the statistics file.
+type statsFile struct {
+	Hours []*statsBucket `json:"hours"`
+	Days  []*statsBucket `json:"days"`
+}
+
+// Metadata key of the flag that's set when a query is blocked.
+type queryStatsKey struct{}
+
+const (
+	defaultStatsHourlyRetention = 48
+	defaultStatsDailyRetention  = 30
+	defaultStatsMaxEntries      = 10000
+)
+
+var _ Resolver = &QueryStats{}
+
+// NewQueryStats returns a new instance of a query statistics resolver.
+func NewQueryStats(id string, resolver Resolver, opt QueryStatsOptions) (*QueryStats, error) {
+	if opt.HourlyRetention < 0 || opt.DailyRetention < 0 || opt.MaxEntries < 0 {
+		return nil, errors.New("query stats retention and max entries can't be negative")
+	}
+	if opt.HourlyRetention == 0 {
+		opt.HourlyRetention = defaultStatsHourlyRetention
+	}
+	if opt.DailyRetention == 0 {
+		opt.DailyRetention = defaultStatsDailyRetention
+	}
+	if opt.MaxEntries == 0 {
+		opt.MaxEntries = defaultStatsMaxEntries
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	r := &QueryStats{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		stop:     make(chan struct{}),
+	}
+	if opt.Filename != "" {
+		r.loadFromFile()
+	}
+	go r.intervalSave()
+	return r, nil
+}
+
+// Resolve a DNS query and count it in the statistics.
+func (r *QueryStats) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	blocked := new(atomic.Bool)
+	a, err := r.resolver.Resolve(q, ci.WithValue(queryStatsKey{}, blocked))
+	if blocked.Load() {
+		// Pass the flag on to elements in front of this one that count
+		// blocked queries as well
+		statsBlocked(ci)
+	}
+	var client string
+	if ci.SourceIP != nil {
+		client = ci.SourceIP.String()
+	}
+	r.record(strings.ToLower(qName(q)), client, blocked.Load())
+	return a, err
+}
+
+func (r *QueryStats) String() string {
+	return r.id
+}
+
+// Counts a query in the current hour and day.
+func (r *QueryStats) record(name, client string, blocked bool) {
+	now := r.opt.Clock.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hours = r.current(r.hours, now.Truncate(time.Hour), r.opt.HourlyRetention)
+	r.days = r.current(r.days, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), r.opt.DailyRetention)
+	for _, b := range []*statsBucket{r.hours[len(r.hours)-1], r.days[len(r.days)-1]} {
+		b.Queries++
+		if name != "" {
+			b.add(b.Domains, name, r.opt.MaxEntries)
+		}
+		if client != "" {
+			b.add(b.Clients, client, r.opt.MaxEntries)
+		}
+		if blocked {
+			b.Blocked++
+			if name != "" {
+				b.add(b.BlockedDomains, name, r.opt.MaxEntries)
+			}
+		}
+	}
+}
+
+// Returns the buckets with one for the given start time at the end, dropping
+// the oldest ones beyond the retention.
+func (r *QueryStats) current(buckets []*statsBucket, start time.Time, retention int) []*statsBucket {
+	if n := len(buckets); n > 0 && buckets[n-1].Start.Equal(start) {
+		return buckets
+	}
+	buckets = append(buckets, newStatsBucket(start))
+	if len(buckets) > retention {
+		buckets = slices.Delete(buckets, 0, len(buckets)-retention)
+	}
+	return buckets
+}
+
+func newStatsBucket(start time.Time) *statsBucket {
+	return &statsBucket{
+		Start:          start,
+		Domains:        make(map[string]int64),
+		BlockedDomains: make(map[string]int64),
+		Clients:        make(map[string]int64),
+	}
+}
+
+// Increments a counter unless the map is full and doesn't have it yet.
+func (b *statsBucket) add(m map[string]int64, key string, max int) {
+	if _, ok := m[key]; !ok && len(m) >= max {
+		return
+	}
+	m[key]++
+}
+
+// Top returns the entries with the highest counts over the given period
+// before now, most frequent first. Uses hourly buckets if the period is
+// covered by them, daily buckets otherwise.
+func (r *QueryStats) Top(kind StatsKind, period time.Duration, limit int) ([]StatsEntry, error) {
+	since := r.opt.Clock.Now().UTC().Add(-period)
+	counts := make(map[string]int64)
+	r.mu.Lock()
+	buckets := r.hours
+	if period > time.Duration(r.opt.HourlyRetention)*time.Hour {
+		buckets = r.days
+		since = since.Truncate(24 * time.Hour)
+	} else {
+		since = since.Truncate(time.Hour)
+	}
+	for _, b := range buckets {
+		if b.Start.Before(since) {
+			continue
+		}
+		var m map[string]int64
+		switch kind {
+		case StatsDomains:
+			m = b.Domains
+		case StatsBlockedDomains:
+			m = b.BlockedDomains
+		case StatsClients:
+			m = b.Clients
+		default:
+			r.mu.Unlock()
+			return nil, errors.New("unsupported statistics kind")
+		}
+		for k, v := range m {
+			counts[k] += v
+		}
+	}
+	r.mu.Unlock()
+
+	entries := make([]StatsEntry, 0, len(counts))
+	for name, count := range counts {
+		entry := StatsEntry{Name: name, Count: count}
+		if kind != StatsClients {
+			entry.Unicode = unicodeName(name)
+		}
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b StatsEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// Totals returns the number of queries and blocked queries per hour or day,
+// oldest first.
+func (r *QueryStats) Totals(window StatsWindow) ([]StatsTotal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var buckets []*statsBucket
+	switch window {
+	case StatsHour:
+		buckets = r.hours
+	case StatsDay:
+		buckets = r.days
+	default:
+		return nil, errors.New("unsupported statistics window")
+	}
+	totals := make([]StatsTotal, 0, len(buckets))
+	for _, b := range buckets {
+		totals = append(totals, StatsTotal{Start: b.Start, Queries: b.Queries, Blocked: b.Blocked})
+	}
+	return totals, nil
+}
+
+// Close writes the statistics to file if one is configured.
+func (r *QueryStats) Close() error {
+	close(r.stop)
+	return r.Save()
+}
+
+// Save writes the statistics to the file, if there is one.
+func (r *QueryStats) Save() error {
+	if r.opt.Filename != "" {
+		return r.writeToFile()
+	}
+	return nil
+}
+
+func (r *QueryStats) writeToFile() error {
+	r.mu.Lock()
+	b, err := json.Marshal(statsFile{Hours: r.hours, Days: r.days})
+	r.mu.Unlock()
+	log := Log.With("id", r.id, "filename", r.opt.Filename)
+	if err != nil {
+		log.Warn("failed to encode query statistics", "error", err)
+		return err
+	}
+	// Write to a temporary file first to not lose the statistics if
+	// writing fails part-way
+	tmp := r.opt.Filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		log.Warn("failed to write query statistics", "error", err)
+		return err
+	}
+	if err := os.Rename(tmp, r.opt.Filename); err != nil {
+		log.Warn("failed to write query statistics", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (r *QueryStats) loadFromFile() {
+	log := Log.With("id", r.id, "filename", r.opt.Filename)
+	b, err := os.ReadFile(r.opt.Filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("failed to read query statistics", "error", err)
+		}
+		return
+	}
+	var f statsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		log.Warn("failed to decode query statistics", "error", err)
+		return
+	}
+	r.hours = validStatsBuckets(f.Hours, r.opt.HourlyRetention)
+	r.days = validStatsBuckets(f.Days, r.opt.DailyRetention)
+	log.Info("loaded query statistics", "hours", len(r.hours), "days", len(r.days))
+}
+
+// Returns the most recent buckets within the retention, dropping any that
+// are incomplete.
+func validStatsBuckets(buckets []*statsBucket, retention int) []*statsBucket {
+	buckets = slices.DeleteFunc(buckets, func(b *statsBucket) bool {
+		return b == nil || b.Domains == nil || b.BlockedDomains == nil || b.Clients == nil
+	})
+	slices.SortFunc(buckets, func(a, b *statsBucket) int { return a.Start.Compare(b.Start) })
+	if len(buckets) > retention {
+		buckets = buckets[len(buckets)-retention:]
+	}
+	return buckets
+}
+
+func (r *QueryStats) intervalSave() {
+	if r.opt.Filename == "" || r.opt.SaveInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.opt.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.writeToFile()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Flags a query as blocked for the query statistics if it passed through a
+// QueryStats or PopularityExport element.
+func statsBlocked(ci ClientInfo) {
+	if blocked, ok := ci.Value(queryStatsKey{}).(*atomic.Bool); ok {
+		blocked.Store(true)
+	}
+}
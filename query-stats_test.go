@@ -0,0 +1,117 @@
+package rdns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryStats(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC))
+	loader := NewStaticLoader([]string{`(^|\.)block\.test`})
+	db, err := NewRegexpDB("testlist", loader)
+	require.NoError(t, err)
+	bl, err := NewBlocklist("test-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "stats.json")
+	opt := QueryStatsOptions{Filename: filename, HourlyRetention: 2, Clock: clock}
+	stats, err := NewQueryStats("test-stats", bl, opt)
+	require.NoError(t, err)
+
+	resolve := func(name, client string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := stats.Resolve(q, ClientInfo{SourceIP: net.ParseIP(client)})
+		require.NoError(t, err)
+	}
+	resolve("example.com.", "192.0.2.1")
+	resolve("Example.com.", "192.0.2.2")
+	resolve("x.block.test.", "192.0.2.1")
+
+	// The next hour
+	clock.Advance(time.Hour)
+	resolve("example.com.", "192.0.2.1")
+	resolve("example.net.", "192.0.2.1")
+
+	top, err := stats.Top(StatsDomains, 2*time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{
+		{Name: "example.com.", Count: 3},
+		{Name: "example.net.", Count: 1},
+		{Name: "x.block.test.", Count: 1},
+	}, top)
+
+	top, err = stats.Top(StatsDomains, time.Minute, 1)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{{Name: "example.com.", Count: 1}}, top)
+
+	top, err = stats.Top(StatsBlockedDomains, 2*time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{{Name: "x.block.test.", Count: 1}}, top)
+
+	top, err = stats.Top(StatsClients, 2*time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{
+		{Name: "192.0.2.1", Count: 4},
+		{Name: "192.0.2.2", Count: 1},
+	}, top)
+
+	totals, err := stats.Totals(StatsHour)
+	require.NoError(t, err)
+	require.Equal(t, []StatsTotal{
+		{Start: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), Queries: 3, Blocked: 1},
+		{Start: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), Queries: 2},
+	}, totals)
+
+	// Periods longer than the hourly retention use daily buckets
+	top, err = stats.Top(StatsBlockedDomains, 7*24*time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{{Name: "x.block.test.", Count: 1}}, top)
+
+	// Hours beyond the retention are dropped
+	clock.Advance(time.Hour)
+	resolve("example.org.", "192.0.2.1")
+	totals, err = stats.Totals(StatsHour)
+	require.NoError(t, err)
+	require.Len(t, totals, 2)
+	require.Equal(t, time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), totals[0].Start)
+	totals, err = stats.Totals(StatsDay)
+	require.NoError(t, err)
+	require.Equal(t, []StatsTotal{
+		{Start: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), Queries: 6, Blocked: 1},
+	}, totals)
+
+	// The statistics are written on close and loaded again
+	require.NoError(t, stats.Close())
+	stats, err = NewQueryStats("test-stats", bl, opt)
+	require.NoError(t, err)
+	loaded, err := stats.Totals(StatsDay)
+	require.NoError(t, err)
+	require.Equal(t, totals[0].Queries, loaded[0].Queries)
+	require.True(t, totals[0].Start.Equal(loaded[0].Start))
+	top, err = stats.Top(StatsClients, 2*time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{{Name: "192.0.2.1", Count: 3}}, top)
+}
+
+func TestQueryStatsMaxEntries(t *testing.T) {
+	stats, err := NewQueryStats("test-stats", new(TestResolver), QueryStatsOptions{MaxEntries: 1})
+	require.NoError(t, err)
+	for _, name := range []string{"a.test.", "b.test.", "a.test."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := stats.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	top, err := stats.Top(StatsDomains, time.Hour, 10)
+	require.NoError(t, err)
+	require.Equal(t, []StatsEntry{{Name: "a.test.", Count: 2}}, top)
+	totals, err := stats.Totals(StatsHour)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), totals[0].Queries)
+}
@@ -0,0 +1,177 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// QueryTest is a sample query with its expected outcome. It's used to verify
+// that a configuration implements the intended policy, for example that a
+// name is blocked for some clients, without running any listeners.
+type QueryTest struct {
+	// Query to send.
+	Query *dns.Msg
+
+	// Client the query appears to come from, including the listener ID.
+	Client ClientInfo
+
+	// Options of the listener the query is received on. The ACL or allowed
+	// networks are applied to the client before resolving the query.
+	ListenOptions ListenOptions
+
+	// Resolver the listener forwards queries to.
+	Resolver Resolver
+
+	Expect QueryTestExpect
+}
+
+// QueryTestExpect holds the expected outcome of a test query. Only
+// expectations that are set are checked.
+type QueryTestExpect struct {
+	// Response code, for example dns.RcodeNameError for NXDOMAIN.
+	Rcode *int
+
+	// Whether the query should have been blocked by any blocklist.
+	Blocked *bool
+
+	// ID of the blocklist element, or name of the list, that should block
+	// the query.
+	BlockedBy string
+
+	// Records that must be in the answer section. TTLs are ignored.
+	Answer []dns.RR
+
+	// The query should be dropped without response.
+	Drop bool
+}
+
+// Run sends the query through the resolver the same way a listener would and
+// returns an error describing all expectations that aren't met.
+func (t QueryTest) Run() error {
+	trace := new(queryTrace)
+	ci := t.Client.WithValue(queryTraceKey{}, trace)
+	a, err := ResolveQuery(t.Query, ci, t.ListenOptions, t.Resolver)
+
+	var failures []string
+	if a == nil {
+		if !t.Expect.Drop {
+			failures = append(failures, "query was dropped")
+		}
+	} else {
+		if t.Expect.Drop {
+			failures = append(failures, fmt.Sprintf("expected drop, got %s", dns.RcodeToString[a.Rcode]))
+		}
+		if t.Expect.Rcode != nil && a.Rcode != *t.Expect.Rcode {
+			failures = append(failures, fmt.Sprintf("expected rcode %s, got %s", dns.RcodeToString[*t.Expect.Rcode], dns.RcodeToString[a.Rcode]))
+		}
+		for _, want := range t.Expect.Answer {
+			if !containsRR(a.Answer, want) {
+				failures = append(failures, fmt.Sprintf("answer doesn't contain '%s'", want))
+			}
+		}
+	}
+	blocks := trace.blocks()
+	if t.Expect.Blocked != nil && *t.Expect.Blocked != (len(blocks) > 0) {
+		if *t.Expect.Blocked {
+			failures = append(failures, "query wasn't blocked")
+		} else {
+			failures = append(failures, fmt.Sprintf("query was blocked by %s", blocks[0]))
+		}
+	}
+	if t.Expect.BlockedBy != "" {
+		var found bool
+		for _, b := range blocks {
+			if b.id == t.Expect.BlockedBy || b.list == t.Expect.BlockedBy {
+				found = true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("query wasn't blocked by '%s'", t.Expect.BlockedBy))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	if err != nil {
+		failures = append(failures, "resolver error: "+err.Error())
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
+
+// ResolveQuery sends a query through the resolver the same way a listener
+// with the given options would, applying its ACL to the client and turning
+// errors into responses. The response is nil if the query is dropped, the
+// error from the resolver is returned alongside the response.
+func ResolveQuery(q *dns.Msg, ci ClientInfo, opt ListenOptions, r Resolver) (*dns.Msg, error) {
+	ci = opt.classify(q, ci)
+	switch action, resolver := opt.clientAction(ci.SourceIP, r); action {
+	case ACLActionAllow, ACLActionRoute:
+		a, err := opt.chaos(resolver).Resolve(q, ci)
+		if isPolicyError(err) {
+			return policyResponse(q, err), err
+		} else if err != nil {
+			return servfail(q), err
+		}
+		return a, nil
+	case ACLActionDrop:
+		return nil, nil
+	default:
+		return refused(q), nil
+	}
+}
+
+// Returns true if the records contain one that's equal to rr, ignoring the TTL.
+func containsRR(records []dns.RR, rr dns.RR) bool {
+	for _, r := range records {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata key of the query trace.
+type queryTraceKey struct{}
+
+// Collects the blocklist matches of a test query. Unlike other metadata it's
+// added to by the elements the query passes through, so it's safe for
+// concurrent use.
+type queryTrace struct {
+	mu      sync.Mutex
+	matches []queryTraceBlock
+}
+
+type queryTraceBlock struct {
+	id, list, rule string
+}
+
+func (b queryTraceBlock) String() string {
+	if b.list == "" {
+		return fmt.Sprintf("'%s'", b.id)
+	}
+	return fmt.Sprintf("'%s' (list '%s', rule '%s')", b.id, b.list, b.rule)
+}
+
+func (t *queryTrace) blocks() []queryTraceBlock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.matches
+}
+
+// Records that a query was blocked by a blocklist if it's a test query, and
+// flags it for the query statistics.
+func traceBlocked(ci ClientInfo, id string, match *BlocklistMatch) {
+	statsBlocked(ci)
+	t, ok := ci.Value(queryTraceKey{}).(*queryTrace)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	t.matches = append(t.matches, queryTraceBlock{id: id, list: match.GetList(), rule: match.GetRule()})
+	t.mu.Unlock()
+}
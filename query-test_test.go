@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryTest(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+			a.Answer = []dns.RR{rr}
+			return a, nil
+		},
+	}
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{"blocked.test"}))
+	require.NoError(t, err)
+	blocklist, err := NewBlocklist("test-blocklist", upstream, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	query := func(name string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		return q
+	}
+	yes, no := true, false
+	nxdomain, noerror := dns.RcodeNameError, dns.RcodeSuccess
+	answer, _ := dns.NewRR("allowed.test. IN A 192.0.2.1")
+
+	// Blocked query
+	qt := QueryTest{
+		Query:    query("blocked.test."),
+		Client:   ClientInfo{SourceIP: net.ParseIP("127.0.0.1")},
+		Resolver: blocklist,
+		Expect:   QueryTestExpect{Rcode: &nxdomain, Blocked: &yes, BlockedBy: "test-blocklist"},
+	}
+	require.NoError(t, qt.Run())
+	qt.Expect = QueryTestExpect{BlockedBy: "testlist"}
+	require.NoError(t, qt.Run())
+	qt.Expect = QueryTestExpect{Blocked: &no}
+	require.EqualError(t, qt.Run(), "query was blocked by 'test-blocklist' (list 'testlist', rule 'blocked.test')")
+
+	// Allowed query
+	qt = QueryTest{
+		Query:    query("allowed.test."),
+		Client:   ClientInfo{SourceIP: net.ParseIP("127.0.0.1")},
+		Resolver: blocklist,
+		Expect:   QueryTestExpect{Rcode: &noerror, Blocked: &no, Answer: []dns.RR{answer}},
+	}
+	require.NoError(t, qt.Run())
+	qt.Expect = QueryTestExpect{Rcode: &nxdomain, BlockedBy: "test-blocklist"}
+	require.EqualError(t, qt.Run(), "expected rcode NXDOMAIN, got NOERROR; query wasn't blocked by 'test-blocklist'")
+
+	// Client not allowed by the listener
+	_, allowed, _ := net.ParseCIDR("192.168.1.0/24")
+	qt.ListenOptions = ListenOptions{AllowedNet: []*net.IPNet{allowed}}
+	qt.Expect = QueryTestExpect{Rcode: &noerror}
+	require.EqualError(t, qt.Run(), "expected rcode NOERROR, got REFUSED")
+}
+
+func TestResolveQuery(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	// Resolver errors are returned along with a SERVFAIL response
+	failing := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+	a, err := ResolveQuery(q, ci, ListenOptions{}, failing)
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+
+	// Clients not in the allowed networks are refused
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	a, err = ResolveQuery(q, ci, ListenOptions{AllowedNet: []*net.IPNet{allowed}}, failing)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 1, failing.HitCount())
+}
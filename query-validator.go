@@ -0,0 +1,136 @@
+package rdns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// QueryValidator is a resolver that rejects malformed queries before they
+// reach other elements, many of which assume a query has exactly one question
+// with a valid name. Header flags that only have a meaning in responses are
+// cleared in queries that are passed on. It's typically placed right after
+// the listeners.
+type QueryValidator struct {
+	id       string
+	resolver Resolver
+	opt      QueryValidatorOptions
+	metrics  *QueryValidatorMetrics
+}
+
+// QueryValidatorOptions contain settings for the query validator.
+type QueryValidatorOptions struct {
+	// Response code of invalid queries, dns.RcodeFormatError or
+	// dns.RcodeRefused. Defaults to FORMERR.
+	Rcode int
+
+	// Also reject queries for types that are reserved or can't be used
+	// in queries, like 0, OPT or TSIG.
+	RejectReservedTypes bool
+}
+
+type QueryValidatorMetrics struct {
+	// Rejected queries by reason.
+	rejected *CounterMap
+	// Queries passed through to the resolver.
+	allowed *Counter
+}
+
+var _ Resolver = &QueryValidator{}
+
+// NewQueryValidator returns a new instance of a query validator.
+func NewQueryValidator(id string, resolver Resolver, opt QueryValidatorOptions) (*QueryValidator, error) {
+	switch opt.Rcode {
+	case dns.RcodeSuccess:
+		opt.Rcode = dns.RcodeFormatError
+	case dns.RcodeFormatError, dns.RcodeRefused:
+	default:
+		return nil, fmt.Errorf("unsupported response code %d", opt.Rcode)
+	}
+	return &QueryValidator{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &QueryValidatorMetrics{
+			rejected: getCounterMap("router", id, "rejected", "reason"),
+			allowed:  getCounter("router", id, "allowed"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query after validating it. Invalid queries are answered with
+// the configured response code.
+func (r *QueryValidator) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if reason := r.validate(q); reason != "" {
+		// Can't use logger() here, the query may not have a question
+		Log.Debug("rejecting invalid query", "id", r.id, "client", ci.SourceIP, "qtype", qType(q), "qname", qName(q), "reason", reason)
+		r.metrics.rejected.Add(reason, 1)
+		a := new(dns.Msg)
+		a.SetRcode(q, r.opt.Rcode)
+		// Don't repeat an invalid name, the response might not be packable
+		if reason == "name" {
+			a.Question = nil
+		}
+		return a, nil
+	}
+	r.metrics.allowed.Add(1)
+
+	if q.Authoritative || q.Truncated || q.RecursionAvailable || q.Zero {
+		q = q.Copy()
+		q.Authoritative = false
+		q.Truncated = false
+		q.RecursionAvailable = false
+		q.Zero = false
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *QueryValidator) String() string {
+	return r.id
+}
+
+// Returns the reason a query is invalid, or an empty string if it's valid.
+func (r *QueryValidator) validate(q *dns.Msg) string {
+	if q.Response {
+		return "response"
+	}
+	if len(q.Question) != 1 {
+		return "qdcount"
+	}
+	// Dynamic updates and notifications use the answer and authority
+	// sections, queries don't
+	if q.Opcode == dns.OpcodeQuery && (len(q.Answer) > 0 || len(q.Ns) > 0) {
+		return "records"
+	}
+	question := q.Question[0]
+	if _, ok := dns.IsDomainName(question.Name); !ok || !dns.IsFqdn(question.Name) {
+		return "name"
+	}
+	switch question.Qclass {
+	case dns.ClassINET, dns.ClassCHAOS, dns.ClassHESIOD, dns.ClassANY:
+	case dns.ClassNONE: // Only valid in updates
+		if q.Opcode != dns.OpcodeUpdate {
+			return "class"
+		}
+	default:
+		return "class"
+	}
+	if r.opt.RejectReservedTypes && reservedQueryType(question.Qtype) {
+		return "qtype"
+	}
+	return ""
+}
+
+// Returns true for types that are reserved (RFC6895) or can only appear in the
+// additional section, not as query type.
+func reservedQueryType(t uint16) bool {
+	switch {
+	case t == dns.TypeNone, t == dns.TypeReserved:
+		return true
+	case t == dns.TypeOPT, t == dns.TypeTSIG:
+		return true
+	case t >= 128 && t <= 248: // Unassigned meta types
+		return true
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryValidator(t *testing.T) {
+	var upstreamQuery *dns.Msg
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamQuery = q
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r, err := NewQueryValidator("test-validator", upstream, QueryValidatorOptions{RejectReservedTypes: true})
+	require.NoError(t, err)
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		return q
+	}
+	tests := map[string]struct {
+		q     *dns.Msg
+		valid bool
+	}{
+		"valid":       {q: query("example.com.", dns.TypeA), valid: true},
+		"no question": {q: new(dns.Msg)},
+		"two questions": {q: func() *dns.Msg {
+			q := query("example.com.", dns.TypeA)
+			q.Question = append(q.Question, q.Question[0])
+			return q
+		}()},
+		"answer record":   {q: func() *dns.Msg { q := query("example.com.", dns.TypeA); q.Answer = []dns.RR{new(dns.A)}; return q }()},
+		"response":        {q: func() *dns.Msg { q := query("example.com.", dns.TypeA); q.Response = true; return q }()},
+		"long label":      {q: query("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.com.", dns.TypeA)},
+		"empty label":     {q: query("example..com.", dns.TypeA)},
+		"not fqdn":        {q: query("example.com", dns.TypeA)},
+		"unknown class":   {q: func() *dns.Msg { q := query("example.com.", dns.TypeA); q.Question[0].Qclass = 42; return q }()},
+		"class none":      {q: func() *dns.Msg { q := query("example.com.", dns.TypeA); q.Question[0].Qclass = dns.ClassNONE; return q }()},
+		"reserved type":   {q: query("example.com.", dns.TypeNone)},
+		"opt type":        {q: query("example.com.", dns.TypeOPT)},
+		"meta type":       {q: query("example.com.", 200)},
+		"any type":        {q: query("example.com.", dns.TypeANY), valid: true},
+		"unassigned type": {q: query("example.com.", 4000), valid: true},
+		"chaos class": {q: func() *dns.Msg {
+			q := query("version.bind.", dns.TypeTXT)
+			q.Question[0].Qclass = dns.ClassCHAOS
+			return q
+		}(), valid: true},
+		"update": {q: func() *dns.Msg {
+			q := query("example.com.", dns.TypeSOA)
+			q.Opcode = dns.OpcodeUpdate
+			q.Ns = []dns.RR{new(dns.A)}
+			return q
+		}(), valid: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			upstreamQuery = nil
+			a, err := r.Resolve(test.q, ClientInfo{})
+			require.NoError(t, err)
+			if test.valid {
+				require.Equal(t, dns.RcodeSuccess, a.Rcode)
+				require.NotNil(t, upstreamQuery)
+			} else {
+				require.Equal(t, dns.RcodeFormatError, a.Rcode)
+				require.Nil(t, upstreamQuery)
+			}
+		})
+	}
+
+	// Response flags are cleared in queries
+	q := query("example.com.", dns.TypeA)
+	q.Authoritative = true
+	q.RecursionAvailable = true
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, upstreamQuery.Authoritative)
+	require.False(t, upstreamQuery.RecursionAvailable)
+	require.True(t, q.Authoritative)
+
+	// Reserved types are allowed by default, invalid queries can be refused
+	r, err = NewQueryValidator("test-validator-refused", upstream, QueryValidatorOptions{Rcode: dns.RcodeRefused})
+	require.NoError(t, err)
+	a, err := r.Resolve(query("example.com.", dns.TypeOPT), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	a, err = r.Resolve(new(dns.Msg), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	_, err = NewQueryValidator("test-validator-invalid", upstream, QueryValidatorOptions{Rcode: dns.RcodeNameError})
+	require.Error(t, err)
+}
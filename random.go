@@ -3,6 +3,7 @@ package rdns
 import (
 	"errors"
 	"math/rand"
+	"net"
 	"sync"
 	"time"
 
@@ -30,6 +31,19 @@ type RandomOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and cause the resolver to be removed from the group temporarily.
 	ServfailError bool
+
+	// Pick the resolver based on the subnet of the client rather than
+	// randomly, so queries from the same subnet go to the same resolver
+	// while it's active. The subnet is taken from the ECS option if present.
+	SubnetAffinity bool
+
+	// Prefix lengths of client subnets used with SubnetAffinity. Default
+	// to DefaultSubnetPrefix4 and DefaultSubnetPrefix6.
+	SubnetPrefix4 uint8
+	SubnetPrefix6 uint8
+
+	// Source of time for re-enabling resolvers. Defaults to the system clock.
+	Clock Clock
 }
 
 // NewRandom returns a new instance of a random resolver group.
@@ -38,6 +52,13 @@ func NewRandom(id string, opt RandomOptions, resolvers ...Resolver) *Random {
 	if opt.ResetAfter == 0 {
 		opt.ResetAfter = time.Minute
 	}
+	if opt.SubnetPrefix4 == 0 {
+		opt.SubnetPrefix4 = DefaultSubnetPrefix4
+	}
+	if opt.SubnetPrefix6 == 0 {
+		opt.SubnetPrefix6 = DefaultSubnetPrefix6
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
 	return &Random{
 		id:        id,
 		resolvers: resolvers,
@@ -49,8 +70,12 @@ func NewRandom(id string, opt RandomOptions, resolvers ...Resolver) *Random {
 // Resolve a DNS query using a random resolver.
 func (r *Random) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
+	var subnet *net.IPNet
+	if r.opt.SubnetAffinity {
+		subnet = clientSubnet(q, ci, r.opt.SubnetPrefix4, r.opt.SubnetPrefix6)
+	}
 	for {
-		resolver := r.pick()
+		resolver := r.pick(subnet)
 		if resolver == nil {
 			log.Warn("no active resolvers left")
 			return nil, errors.New("no active resolvers left")
@@ -62,6 +87,9 @@ func (r *Random) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
+		if err != nil && !isFailoverError(err) { // Policy errors are the same with every resolver
+			return a, err
+		}
 		log.With("resolver", resolver.String()).Debug("resolver returned failure",
 			"error", err)
 		r.metrics.failure.Add(resolver.String(), 1)
@@ -73,8 +101,9 @@ func (r *Random) String() string {
 	return r.id
 }
 
-// Pick a random resolver from the list of active ones.
-func (r *Random) pick() Resolver {
+// Pick a random resolver from the list of active ones, or the one for the
+// client subnet if given.
+func (r *Random) pick(subnet *net.IPNet) Resolver {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	available := len(r.resolvers)
@@ -83,7 +112,11 @@ func (r *Random) pick() Resolver {
 	if available == 0 {
 		return nil
 	}
-	return r.resolvers[rand.Intn(available)]
+	resolvers := healthyUpstreams(r.resolvers)
+	if subnet != nil {
+		return pickBySubnet(subnet, resolvers)
+	}
+	return resolvers[rand.Intn(len(resolvers))]
 }
 
 // Remove the resolver from the list of active ones and schedule it to
@@ -108,7 +141,7 @@ func (r *Random) deactivate(bad Resolver) {
 
 // Bring back a failed resolver after some time.
 func (r *Random) reactivateLater(resolver Resolver) {
-	time.Sleep(r.opt.ResetAfter)
+	r.opt.Clock.Sleep(r.opt.ResetAfter)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	Log.Debug("re-activating resolver",
@@ -0,0 +1,40 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomSubnetAffinity(t *testing.T) {
+	r1, r2 := new(TestResolver), new(TestResolver)
+	g := NewRandom("test-random-subnet", RandomOptions{SubnetAffinity: true},
+		namedTestResolver{r1, "upstream-1"},
+		namedTestResolver{r2, "upstream-2"},
+	)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.0.2.1")}
+
+	// Queries from the same client always go to the same resolver
+	for i := 0; i < 10; i++ {
+		_, err := g.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 10, r1.HitCount()+r2.HitCount())
+	require.True(t, r1.HitCount() == 0 || r2.HitCount() == 0)
+
+	// If that resolver fails, the query goes to the other one
+	pinned, other := r1, r2
+	if r2.HitCount() > 0 {
+		pinned, other = r2, r1
+	}
+	pinned.SetFail(true)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 11, pinned.HitCount())
+	require.Equal(t, 1, other.HitCount())
+}
@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRateLimiterStore keeps the counters of rate limiters in Redis, so the
+// limits apply across all instances of RouteDNS using the same server.
+type RedisRateLimiterStore struct {
+	client *redis.Client
+	opt    RedisRateLimiterStoreOptions
+}
+
+type RedisRateLimiterStoreOptions struct {
+	RedisOptions redis.Options
+	KeyPrefix    string
+}
+
+var _ RateLimiterStore = (*RedisRateLimiterStore)(nil)
+
+// Time to wait for Redis before falling back to local counters.
+const redisRateLimiterTimeout = 100 * time.Millisecond
+
+// NewRedisRateLimiterStore returns a rate limiter store backed by Redis.
+func NewRedisRateLimiterStore(opt RedisRateLimiterStoreOptions) *RedisRateLimiterStore {
+	return &RedisRateLimiterStore{
+		client: redis.NewClient(&opt.RedisOptions),
+		opt:    opt,
+	}
+}
+
+// Increment the counter in Redis and set it to expire. Since all instances
+// use the same windows, the expiry is the same for all increments of a key.
+func (s *RedisRateLimiterStore) Increment(key string, expiry time.Duration) (uint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisRateLimiterTimeout)
+	defer cancel()
+	var incr *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, s.opt.KeyPrefix+key)
+		pipe.Expire(ctx, s.opt.KeyPrefix+key, expiry)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint(incr.Val()), nil
+}
+
+// Close the connection to Redis.
+func (s *RedisRateLimiterStore) Close() error {
+	return s.client.Close()
+}
@@ -1,9 +1,10 @@
 package rdns
 
 import (
-	"expvar"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,6 +21,10 @@ type RateLimiter struct {
 	currWinID int64
 	counters  map[string]*uint
 	metrics   *RateLimiterMetrics
+
+	// Window in which the last store failure was logged as warning, 0 while
+	// the store works.
+	storeWarnWinID atomic.Int64
 }
 
 var _ Resolver = &RateLimiter{}
@@ -30,15 +35,29 @@ type RateLimiterOptions struct {
 	Prefix4       uint8    // Netmask to identify IP4 clients
 	Prefix6       uint8    // Netmask to identify IP6 clients
 	LimitResolver Resolver // Alternate resolver for rate-limited requests
+
+	// Store for the counters, typically shared by several instances to apply
+	// the limits across all of them. Counters are kept in memory if nil, or
+	// if the store fails.
+	Store RateLimiterStore
+}
+
+// RateLimiterStore holds the query counters of rate limiters.
+type RateLimiterStore interface {
+	// Increment adds a query to a counter and returns the new count. The
+	// counter is no longer needed after the expiry.
+	Increment(key string, expiry time.Duration) (uint, error)
 }
 
 type RateLimiterMetrics struct {
 	// Count of queries.
-	query *expvar.Int
+	query *Counter
 	// Count of queries that have exceeded the rate limit.
-	exceed *expvar.Int
+	exceed *Counter
 	// Count of dropped queries.
-	drop *expvar.Int
+	drop *Counter
+	// Count of failed counter updates in the store.
+	storeErr *Counter
 }
 
 // NewRateLimiterIP returns a new instance of a query rate limiter.
@@ -57,14 +76,16 @@ func NewRateLimiter(id string, resolver Resolver, opt RateLimiterOptions) *RateL
 		resolver:           resolver,
 		RateLimiterOptions: opt,
 		metrics: &RateLimiterMetrics{
-			query:  getVarInt("router", id, "query"),
-			exceed: getVarInt("router", id, "exceed"),
-			drop:   getVarInt("router", id, "drop"),
+			query:    getCounter("router", id, "query"),
+			exceed:   getCounter("router", id, "exceed"),
+			drop:     getCounter("router", id, "drop"),
+			storeErr: getCounter("router", id, "store-error"),
 		},
 	}
 }
 
-// Resolve a DNS query while limiting the query rate per time period.
+// Resolve a DNS query while limiting the query rate per time period. Queries over
+// the limit are dropped by returning ErrRateLimited unless a LimitResolver is set.
 func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	log := logger(r.id, q, ci)
 	r.metrics.query.Add(1)
@@ -79,40 +100,52 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	key := source.String()
 
 	// Calculate the current (fixed) window
-	windowID := time.Now().Unix() / int64(r.Window)
-
-	var reject bool
-	r.mu.Lock()
-
-	// If we have moved on to the next window, re-initialize the counters
-	if windowID != r.currWinID {
-		r.currWinID = windowID
-		r.counters = make(map[string]*uint)
-	}
-
-	// Load the current counter for this client or make a new one
-	v, ok := r.counters[key]
-	if !ok {
-		v = new(uint)
-		r.counters[key] = v
+	now := time.Now().Unix()
+	windowID := now / int64(r.Window)
+
+	var count uint
+	if r.Store != nil {
+		// Keep the counter in the store until the window is over
+		expiry := time.Duration((windowID+1)*int64(r.Window)-now+1) * time.Second
+		var err error
+		count, err = r.Store.Increment(fmt.Sprintf("%s:%d:%s", r.id, windowID, key), expiry)
+		if err != nil {
+			r.metrics.storeErr.Add(1)
+			// Only warn once per window, failures are counted in the metrics
+			if r.storeWarnWinID.Swap(windowID) != windowID {
+				log.Warn("failed to update rate-limit counter in store, using local counter", "error", err)
+			} else {
+				log.Debug("failed to update rate-limit counter in store, using local counter", "error", err)
+			}
+			count = r.increment(key, windowID)
+		} else if r.storeWarnWinID.Swap(0) != 0 {
+			Log.Info("rate-limit counter store recovered", "id", r.id)
+		}
+	} else {
+		count = r.increment(key, windowID)
 	}
 
 	// Check the number of requests made in this window
-	if *v >= r.Requests {
-		reject = true
-	}
-	*v++
-	r.mu.Unlock()
+	reject := count > r.Requests
+	first := count == r.Requests+1
 
 	if reject {
 		r.metrics.exceed.Add(1)
+		if first { // Only notify once per client and window
+			Notify(Event{
+				Type:    EventRateLimited,
+				ID:      r.id,
+				Message: fmt.Sprintf("client %s exceeded the rate limit of %d queries in %d seconds", key, r.Requests, r.Window),
+				Details: map[string]string{"client": key},
+			})
+		}
 		if r.LimitResolver != nil {
 			log.With("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
 			return r.LimitResolver.Resolve(q, ci)
 		}
 		r.metrics.drop.Add(1)
 		log.Debug("rate-limit reached, dropping")
-		return nil, nil
+		return nil, ErrRateLimited
 	}
 	log.With("resolver", r.resolver).Debug("forwarding query to resolver")
 	return r.resolver.Resolve(q, ci)
@@ -121,3 +154,24 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *RateLimiter) String() string {
 	return r.id
 }
+
+// Adds a query to the in-memory counter of a client and returns the new count.
+func (r *RateLimiter) increment(key string, windowID int64) uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// If we have moved on to the next window, re-initialize the counters
+	if windowID != r.currWinID {
+		r.currWinID = windowID
+		r.counters = make(map[string]*uint)
+	}
+
+	// Load the current counter for this client or make a new one
+	v, ok := r.counters[key]
+	if !ok {
+		v = new(uint)
+		r.counters[key] = v
+	}
+	*v++
+	return *v
+}
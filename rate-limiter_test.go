@@ -0,0 +1,86 @@
+package rdns
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Rate limiter store shared between limiters in tests.
+type testRateLimiterStore struct {
+	mu       sync.Mutex
+	counters map[string]uint
+	fail     bool
+}
+
+func (s *testRateLimiterStore) Increment(key string, expiry time.Duration) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return 0, errors.New("store failed")
+	}
+	if s.counters == nil {
+		s.counters = make(map[string]uint)
+	}
+	s.counters[key]++
+	return s.counters[key], nil
+}
+
+func TestRateLimiterStore(t *testing.T) {
+	store := new(testRateLimiterStore)
+	r1, r2 := new(TestResolver), new(TestResolver)
+	opt := RateLimiterOptions{Requests: 2, Window: 3600, Store: store}
+	rl1 := NewRateLimiter("test-rl", r1, opt)
+	rl2 := NewRateLimiter("test-rl", r2, opt)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.0.2.1")}
+
+	// The limit applies to queries across both instances
+	_, err := rl1.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = rl2.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = rl1.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	_, err = rl2.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Other client networks have their own counter
+	_, err = rl1.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.3.1")})
+	require.NoError(t, err)
+
+	// If the store fails, queries are counted per instance. The failure is
+	// only logged as warning once.
+	var logs bytes.Buffer
+	defer func(l *slog.Logger) { Log = l }(Log)
+	Log = slog.New(slog.NewTextHandler(&logs, nil))
+	store.fail = true
+	_, err = rl1.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = rl1.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = rl1.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.Equal(t, 1, strings.Count(logs.String(), "level=WARN"))
+
+	// And again once the store recovered and fails another time
+	store.fail = false
+	_, err = rl1.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	store.fail = true
+	_, err = rl1.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.Equal(t, 2, strings.Count(logs.String(), "level=WARN"))
+}
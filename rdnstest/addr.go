@@ -0,0 +1,24 @@
+package rdnstest
+
+import "net"
+
+// FreeAddr returns an address on the loopback interface with a port that's
+// currently free on the network, "tcp" or "udp", to start listeners on.
+func FreeAddr(network string) (string, error) {
+	switch network {
+	case "udp", "udp4":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		defer pc.Close()
+		return pc.LocalAddr().String(), nil
+	default:
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		defer ln.Close()
+		return ln.Addr().String(), nil
+	}
+}
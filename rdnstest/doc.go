@@ -0,0 +1,27 @@
+/*
+Package rdnstest provides fixtures for tests of applications that embed routedns.
+
+Resolver is an in-process stand-in for any rdns.Resolver, which either runs a
+function, answers according to a script of rules, or echoes queries back. It
+counts the queries it receives and can be set to fail.
+
+Server is a DNS server on the loopback interface, serving plain DNS over UDP
+and TCP, that answers according to a script of rules. Rules can delay
+responses, set the response code, truncate responses sent over UDP or drop
+queries altogether, so timeouts, failover and retries over TCP can be tested
+with the real clients and listeners.
+
+	srv, err := rdnstest.NewServer(rdnstest.ServerOptions{
+		Rules: []rdnstest.Rule{
+			{Name: "example.com.", Type: dns.TypeA, Answer: []string{"example.com. 60 IN A 192.0.2.1"}},
+			{Name: "slow.example.com.", Delay: time.Second},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	r, _ := rdns.NewDNSClient("upstream", srv.Addr(), "udp", rdns.DNSClientOptions{})
+*/
+package rdnstest
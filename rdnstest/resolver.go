@@ -0,0 +1,79 @@
+package rdnstest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+)
+
+// Resolver is a configurable resolver for tests. It counts the queries it
+// receives and can be set to fail. Queries are passed to ResolveFunc if set,
+// otherwise they're answered according to the rules, or returned as they
+// are if there are none.
+type Resolver struct {
+	ResolveFunc func(*dns.Msg, rdns.ClientInfo) (*dns.Msg, error)
+
+	rules      []Rule
+	hitCount   int
+	shouldFail bool
+	mu         sync.Mutex
+}
+
+var _ rdns.Resolver = &Resolver{}
+
+// NewResolver returns a resolver that answers queries according to the
+// rules. Queries that don't match any rule are refused, and dropped queries
+// are answered with nil, which causes listeners to close the connection.
+func NewResolver(rules ...Rule) (*Resolver, error) {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{rules: compiled}, nil
+}
+
+func (r *Resolver) Resolve(q *dns.Msg, ci rdns.ClientInfo) (*dns.Msg, error) {
+	r.mu.Lock()
+	r.hitCount++
+	shouldFail := r.shouldFail
+	rules := r.rules
+	r.mu.Unlock()
+	if shouldFail {
+		return nil, errors.New("failed")
+	}
+	if r.ResolveFunc != nil {
+		return r.ResolveFunc(q, ci)
+	}
+	if rules == nil {
+		return q, nil
+	}
+	rule := matchRule(rules, q)
+	if rule != nil {
+		time.Sleep(rule.Delay)
+		if rule.Drop {
+			return nil, nil
+		}
+	}
+	return rule.response(q, true), nil
+}
+
+func (r *Resolver) String() string {
+	return "rdnstest.Resolver()"
+}
+
+// HitCount returns the number of queries the resolver received.
+func (r *Resolver) HitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hitCount
+}
+
+// SetFail makes the resolver return an error for all queries, or stop doing so.
+func (r *Resolver) SetFail(f bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shouldFail = f
+}
@@ -0,0 +1,58 @@
+package rdnstest
+
+import (
+	"testing"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Without rules, queries are echoed
+	r := new(Resolver)
+	a, err := r.Resolve(q, rdns.ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q, a)
+
+	r.SetFail(true)
+	_, err = r.Resolve(q, rdns.ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, 2, r.HitCount())
+
+	// Scripted answers
+	r, err = NewResolver(
+		Rule{Name: "example.com.", Type: dns.TypeA, Delay: 50 * time.Millisecond, Answer: []string{"example.com. 60 IN A 192.0.2.1"}},
+		Rule{Name: "big.example.com.", Truncate: true},
+		Rule{Name: "drop.example.com.", Drop: true},
+	)
+	require.NoError(t, err)
+
+	start := time.Now()
+	a, err = r.Resolve(q, rdns.ClientInfo{})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Len(t, a.Answer, 1)
+
+	q.SetQuestion("big.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, rdns.ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+
+	q.SetQuestion("drop.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, rdns.ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	q.SetQuestion("other.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, rdns.ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	_, err = NewResolver(Rule{Answer: []string{"invalid"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package rdnstest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Rule defines how queries are answered. Rules are evaluated in order and the
+// first one that matches a query is applied.
+type Rule struct {
+	// Name the query is for, like "example.com.". Matches all names if empty.
+	Name string
+
+	// Type of the query, like dns.TypeA. Matches all types if 0.
+	Type uint16
+
+	// Time to wait before responding.
+	Delay time.Duration
+
+	// Response code, NOERROR if 0.
+	Rcode int
+
+	// Records in the answer section of the response, in zone file format.
+	Answer []string
+
+	// Respond with the TC flag set and without any records. A Server only
+	// truncates responses to queries received over UDP, so clients can retry
+	// over TCP.
+	Truncate bool
+
+	// Don't respond at all.
+	Drop bool
+
+	answer []dns.RR
+}
+
+// Parses the answer records of the rules.
+func compileRules(rules []Rule) ([]Rule, error) {
+	compiled := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		rule.answer = nil
+		for _, s := range rule.Answer {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid answer record '%s': %w", s, err)
+			}
+			rule.answer = append(rule.answer, rr)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// Returns the first rule matching the query, or nil.
+func matchRule(rules []Rule, q *dns.Msg) *Rule {
+	if len(q.Question) == 0 {
+		return nil
+	}
+	question := q.Question[0]
+	for i, rule := range rules {
+		if rule.Name != "" && !strings.EqualFold(dns.Fqdn(rule.Name), question.Name) {
+			continue
+		}
+		if rule.Type != 0 && rule.Type != question.Qtype {
+			continue
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// Builds the response to a query according to the rule. Queries that don't
+// match any rule are refused.
+func (r *Rule) response(q *dns.Msg, truncate bool) *dns.Msg {
+	a := new(dns.Msg)
+	if r == nil {
+		return a.SetRcode(q, dns.RcodeRefused)
+	}
+	a.SetRcode(q, r.Rcode)
+	a.RecursionAvailable = true
+	if truncate && r.Truncate {
+		a.Truncated = true
+		return a
+	}
+	for _, rr := range r.answer {
+		a.Answer = append(a.Answer, dns.Copy(rr))
+	}
+	return a
+}
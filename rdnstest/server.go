@@ -0,0 +1,142 @@
+package rdnstest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server is a plain DNS server on the loopback interface that answers queries
+// according to a script of rules. It listens on the same, randomly chosen
+// port for UDP and TCP.
+type Server struct {
+	addr    string
+	servers []*dns.Server
+
+	mu      sync.Mutex
+	rules   []Rule
+	queries []*dns.Msg
+}
+
+// ServerOptions contain settings for a Server.
+type ServerOptions struct {
+	// Rules to answer queries with. Queries that don't match any rule are
+	// refused.
+	Rules []Rule
+}
+
+// NewServer starts a server. It's stopped with Close.
+func NewServer(opt ServerOptions) (*Server, error) {
+	rules, err := compileRules(opt.Rules)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{rules: rules}
+
+	// Listen on TCP first and use the same port for UDP. It can be taken on
+	// UDP already, so try a few times.
+	var (
+		ln net.Listener
+		pc net.PacketConn
+	)
+	for range 10 {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		pc, err = net.ListenPacket("udp", ln.Addr().String())
+		if err == nil {
+			break
+		}
+		ln.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.addr = ln.Addr().String()
+
+	started := make(chan struct{}, 2)
+	notify := func() { started <- struct{}{} }
+	s.servers = []*dns.Server{
+		{Listener: ln, Handler: s.handler("tcp"), NotifyStartedFunc: notify},
+		{PacketConn: pc, Handler: s.handler("udp"), NotifyStartedFunc: notify},
+	}
+	for _, srv := range s.servers {
+		go srv.ActivateAndServe()
+	}
+	for range s.servers {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			s.Close()
+			return nil, errors.New("timeout starting test server")
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the address of the server, like "127.0.0.1:5353".
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// SetRules replaces the rules queries are answered with.
+func (s *Server) SetRules(rules ...Rule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = compiled
+	return nil
+}
+
+// Queries returns copies of all queries the server received, in the order
+// they arrived.
+func (s *Server) Queries() []*dns.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := make([]*dns.Msg, 0, len(s.queries))
+	for _, q := range s.queries {
+		queries = append(queries, q.Copy())
+	}
+	return queries
+}
+
+// HitCount returns the number of queries the server received.
+func (s *Server) HitCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queries)
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	var errs []error
+	for _, srv := range s.servers {
+		errs = append(errs, srv.Shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) handler(network string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		s.mu.Lock()
+		s.queries = append(s.queries, q.Copy())
+		rules := s.rules
+		s.mu.Unlock()
+
+		rule := matchRule(rules, q)
+		if rule != nil {
+			time.Sleep(rule.Delay)
+			if rule.Drop {
+				return
+			}
+		}
+		_ = w.WriteMsg(rule.response(q, network == "udp"))
+	})
+}
@@ -0,0 +1,79 @@
+package rdnstest
+
+import (
+	"testing"
+	"time"
+
+	rdns "github.com/folbricht/routedns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	srv, err := NewServer(ServerOptions{
+		Rules: []Rule{
+			{Name: "example.com", Type: dns.TypeA, Answer: []string{"example.com. 60 IN A 192.0.2.1"}},
+			{Name: "big.example.com.", Truncate: true, Answer: []string{"big.example.com. 60 IN TXT \"big\""}},
+			{Name: "slow.example.com.", Delay: 200 * time.Millisecond, Rcode: dns.RcodeServerFailure},
+		},
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	udp, err := rdns.NewDNSClient("test-udp", srv.Addr(), "udp", rdns.DNSClientOptions{QueryTimeout: time.Second})
+	require.NoError(t, err)
+	tcp, err := rdns.NewDNSClient("test-tcp", srv.Addr(), "tcp", rdns.DNSClientOptions{QueryTimeout: time.Second})
+	require.NoError(t, err)
+
+	resolve := func(r rdns.Resolver, name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, rdns.ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Answer
+	a := resolve(udp, "EXAMPLE.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.1", a.Answer[0].(*dns.A).A.String())
+
+	// Not matching any rule
+	a = resolve(udp, "example.com.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Truncated over UDP only
+	a = resolve(udp, "big.example.com.", dns.TypeTXT)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+	a = resolve(tcp, "big.example.com.", dns.TypeTXT)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 1)
+
+	// Delayed response code
+	start := time.Now()
+	a = resolve(tcp, "slow.example.com.", dns.TypeA)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	require.Equal(t, 5, srv.HitCount())
+	require.Equal(t, "slow.example.com.", srv.Queries()[4].Question[0].Name)
+
+	// Change the script
+	require.NoError(t, srv.SetRules(Rule{Drop: true}))
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = udp.Resolve(q, rdns.ClientInfo{})
+	require.Error(t, err)
+
+	require.Error(t, srv.SetRules(Rule{Answer: []string{"invalid"}}))
+}
+
+func TestFreeAddr(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		addr, err := FreeAddr(network)
+		require.NoError(t, err)
+		require.NotEmpty(t, addr)
+	}
+}
@@ -0,0 +1,42 @@
+package rdns
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// ReloadableResolver passes queries to a resolver that can be replaced while
+// queries are being resolved. Listeners that keep running when the
+// configuration is reloaded send queries through it, so they use the
+// resolvers of the new configuration once they're swapped in. Queries that
+// are in progress finish with the previous resolver.
+type ReloadableResolver struct {
+	resolver atomic.Pointer[Resolver]
+}
+
+var _ Resolver = &ReloadableResolver{}
+
+// NewReloadableResolver returns a resolver that passes queries to the given
+// one until it's replaced with Swap.
+func NewReloadableResolver(resolver Resolver) *ReloadableResolver {
+	r := new(ReloadableResolver)
+	r.Swap(resolver)
+	return r
+}
+
+// Resolve a DNS query with the current resolver.
+func (r *ReloadableResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	return (*r.resolver.Load()).Resolve(q, ci)
+}
+
+// Swap replaces the resolver that queries are passed to.
+func (r *ReloadableResolver) Swap(resolver Resolver) {
+	r.resolver.Store(&resolver)
+}
+
+// Returns the ID of the current resolver, the reloadable resolver is
+// transparent in logs.
+func (r *ReloadableResolver) String() string {
+	return (*r.resolver.Load()).String()
+}
@@ -0,0 +1,28 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadableResolver(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r := NewReloadableResolver(r1)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// Queries go to the new resolver once it's swapped in
+	r.Swap(r2)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"encoding/binary"
+	"errors"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -104,16 +105,22 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	log.With("resolver", r.resolver).Debug("forwarding query to resolver")
 
-	// Not already in flight, make the request
+	// Release other goroutines waiting for the response and remove the
+	// request from the inflight list once done. Deferred so waiting
+	// goroutines are released even if the resolver panics.
+	defer func() {
+		close(req.done)
+		r.mu.Lock()
+		delete(r.inflight, k)
+		r.mu.Unlock()
+	}()
+
+	// Not already in flight, make the request. Waiting requests fail if the
+	// resolver doesn't return normally.
+	req.err = errors.New("no response from resolver")
 	a, err := r.resolver.Resolve(q, ci)
 	req.answer = a
 	req.err = err
-	close(req.done) // release other goroutines waiting for the response
-
-	// No longer in flight
-	r.mu.Lock()
-	delete(r.inflight, k)
-	r.mu.Unlock()
 
 	// Return a copy since it could be modified in the chain (i.e. in the listener)
 	// but it's also stored for other goroutines which need to copy it.
@@ -0,0 +1,110 @@
+package rdns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RequireEncrypted is a resolver that only passes queries for sensitive zones
+// through if they were received over an encrypted transport, like DoT or DoH.
+// Queries for them that were received in plaintext are refused, or sent to
+// another resolver. Queries for other names are passed through.
+type RequireEncrypted struct {
+	id       string
+	resolver Resolver
+	opt      RequireEncryptedOptions
+	metrics  *RequireEncryptedMetrics
+
+	zones map[string]struct{}
+}
+
+// RequireEncryptedOptions contain settings for the require-encrypted modifier.
+type RequireEncryptedOptions struct {
+	// Zones that require an encrypted transport, like "corp.example.com".
+	// Applies to all queries if empty.
+	Zones []string
+
+	// Resolver for plaintext queries for the zones. They're refused if nil.
+	PlaintextResolver Resolver
+}
+
+type RequireEncryptedMetrics struct {
+	// Plaintext queries for the zones that were refused.
+	refused *Counter
+	// Plaintext queries for the zones sent to the plaintext resolver.
+	redirected *Counter
+	// Queries passed through.
+	allowed *Counter
+}
+
+var _ Resolver = &RequireEncrypted{}
+
+// NewRequireEncrypted returns a new instance of a require-encrypted modifier.
+func NewRequireEncrypted(id string, resolver Resolver, opt RequireEncryptedOptions) *RequireEncrypted {
+	zones := make(map[string]struct{})
+	for _, zone := range opt.Zones {
+		zones[strings.ToLower(dns.Fqdn(zone))] = struct{}{}
+	}
+	return &RequireEncrypted{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &RequireEncryptedMetrics{
+			refused:    getCounter("router", id, "refused"),
+			redirected: getCounter("router", id, "redirected"),
+			allowed:    getCounter("router", id, "allowed"),
+		},
+		zones: zones,
+	}
+}
+
+// Resolve a DNS query, refusing or redirecting it if it requires an
+// encrypted transport but wasn't received over one.
+func (r *RequireEncrypted) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	if ci.Encrypted || !r.sensitive(q.Question[0].Name) {
+		r.metrics.allowed.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci).With("transport", ci.Transport)
+	if r.opt.PlaintextResolver != nil {
+		log.Debug("plaintext query requires encrypted transport, forwarding", "resolver", r.opt.PlaintextResolver.String())
+		r.metrics.redirected.Add(1)
+		return r.opt.PlaintextResolver.Resolve(q, ci)
+	}
+	log.Debug("plaintext query requires encrypted transport, refusing")
+	r.metrics.refused.Add(1)
+	a := refused(q)
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		a.SetEdns0(edns0.UDPSize(), edns0.Do())
+		opt := a.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeProhibited,
+			ExtraText: "encrypted transport required",
+		})
+	}
+	return a, nil
+}
+
+func (r *RequireEncrypted) String() string {
+	return r.id
+}
+
+// Returns true if the name is in one of the zones that require an encrypted
+// transport.
+func (r *RequireEncrypted) sensitive(name string) bool {
+	if len(r.zones) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := r.zones[name[off:]]; ok {
+			return true
+		}
+	}
+	return false
+}
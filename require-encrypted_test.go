@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireEncrypted(t *testing.T) {
+	upstream := new(TestResolver)
+	r := NewRequireEncrypted("test-require-encrypted", upstream, RequireEncryptedOptions{
+		Zones: []string{"corp.example.com"},
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("host.Corp.example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	// Plaintext query for the zone is refused
+	a, err := r.Resolve(q, ClientInfo{Transport: "udp"})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+	edns0 := a.IsEdns0()
+	require.NotNil(t, edns0)
+	require.Len(t, edns0.Option, 1)
+	ede, ok := edns0.Option[0].(*dns.EDNS0_EDE)
+	require.True(t, ok)
+	require.Equal(t, dns.ExtendedErrorCodeProhibited, ede.InfoCode)
+
+	// Encrypted query for the zone is passed through
+	_, err = r.Resolve(q, ClientInfo{Transport: "dot", Encrypted: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Plaintext queries for other names are passed through
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{Transport: "udp"})
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestRequireEncryptedRedirect(t *testing.T) {
+	upstream := new(TestResolver)
+	plaintext := new(TestResolver)
+	r := NewRequireEncrypted("test-require-encrypted", upstream, RequireEncryptedOptions{
+		PlaintextResolver: plaintext,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	// Without zones, all plaintext queries go to the plaintext resolver
+	_, err := r.Resolve(q, ClientInfo{Transport: "tcp"})
+	require.NoError(t, err)
+	require.Equal(t, 0, upstream.HitCount())
+	require.Equal(t, 1, plaintext.HitCount())
+
+	_, err = r.Resolve(q, ClientInfo{Transport: "doh", Encrypted: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, 1, plaintext.HitCount())
+}
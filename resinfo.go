@@ -0,0 +1,222 @@
+package rdns
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TypeRESINFO is the type of resolver information records (RFC9606).
+const TypeRESINFO uint16 = 261
+
+// ResolverInfoPath is the well-known path of the resolver information page
+// on DoH listeners (RFC9606).
+const ResolverInfoPath = "/.well-known/resolver-info/"
+
+// ResolverInfo describes the capabilities and policies of the resolver, as
+// published in RESINFO records (RFC9606) and on the resolver information page.
+type ResolverInfo struct {
+	// The resolver minimizes query names sent to authoritative servers
+	// (RFC9156).
+	QNameMinimization bool
+
+	// Extended DNS Error codes (RFC8914) the resolver can return, like 15
+	// (Blocked) for blocklists.
+	ExtendedErrors []uint16
+
+	// URL of the resolver information page, must use https. Typically a DoH
+	// listener's ResolverInfoPath.
+	InfoURL string
+
+	// Description of the filtering policy of the resolver, shown on the
+	// resolver information page.
+	Filtering string
+}
+
+// Returns the key-value pairs of a RESINFO record.
+func (i ResolverInfo) keys() []string {
+	var keys []string
+	if i.QNameMinimization {
+		keys = append(keys, "qnamemin")
+	}
+	if len(i.ExtendedErrors) > 0 {
+		keys = append(keys, "exterr="+edeRanges(i.ExtendedErrors))
+	}
+	if i.InfoURL != "" {
+		keys = append(keys, "infourl="+i.InfoURL)
+	}
+	return keys
+}
+
+var resolverInfoTemplate = template.Must(template.New("resolver-info").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Resolver Information</title></head>
+<body>
+<h1>Resolver Information</h1>
+<p>QNAME minimization: {{if .QNameMinimization}}enabled{{else}}disabled{{end}}</p>
+{{- if .ExtendedErrors}}
+<p>Extended DNS Errors:</p>
+<ul>
+{{- range .ExtendedErrors}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Filtering}}
+<p>Filtering: {{.Filtering}}</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// ServeHTTP serves the resolver information page.
+func (i *ResolverInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var codes []string
+	for _, code := range i.ExtendedErrors {
+		name, ok := dns.ExtendedErrorCodeToString[code]
+		if !ok {
+			name = "Unknown"
+		}
+		codes = append(codes, fmt.Sprintf("%d (%s)", code, name))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = resolverInfoTemplate.Execute(w, struct {
+		QNameMinimization bool
+		ExtendedErrors    []string
+		Filtering         string
+	}{i.QNameMinimization, codes, i.Filtering})
+}
+
+// ResInfo answers RESINFO queries (RFC9606) for the resolver's names with
+// information about its capabilities and policies. All other queries are
+// passed through.
+type ResInfo struct {
+	id       string
+	resolver Resolver
+	opt      ResInfoOptions
+	names    []string
+	metrics  *ResInfoMetrics
+}
+
+// ResInfoOptions contain settings for the RESINFO responder.
+type ResInfoOptions struct {
+	ResolverInfo
+
+	// Names RESINFO queries are answered for. Defaults to resolver.arpa,
+	// which clients query on unencrypted resolvers. Encrypted resolvers are
+	// queried with the name in their certificate.
+	Names []string
+
+	// TTL of the RESINFO record. Defaults to 3600.
+	TTL uint32
+}
+
+type ResInfoMetrics struct {
+	// RESINFO queries answered.
+	answered *Counter
+	// Queries passed through to the resolver.
+	forwarded *Counter
+}
+
+var _ Resolver = &ResInfo{}
+
+// NewResInfo returns a new instance of a RESINFO responder.
+func NewResInfo(id string, resolver Resolver, opt ResInfoOptions) (*ResInfo, error) {
+	if opt.InfoURL != "" && !strings.HasPrefix(opt.InfoURL, "https://") {
+		return nil, fmt.Errorf("info url '%s' must use https", opt.InfoURL)
+	}
+	if len(opt.Names) == 0 {
+		opt.Names = []string{"resolver.arpa."}
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 3600
+	}
+	names := make([]string, 0, len(opt.Names))
+	for _, name := range opt.Names {
+		names = append(names, dns.Fqdn(strings.ToLower(name)))
+	}
+	return &ResInfo{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		names:    names,
+		metrics: &ResInfoMetrics{
+			answered:  getCounter("router", id, "answered"),
+			forwarded: getCounter("router", id, "forwarded"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query. RESINFO queries for the resolver's names are answered,
+// all others forwarded.
+func (r *ResInfo) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 || q.Question[0].Qtype != TypeRESINFO || !slices.Contains(r.names, strings.ToLower(q.Question[0].Name)) {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	logger(r.id, q, ci).Debug("answering resinfo query")
+	r.metrics.answered.Add(1)
+	rr, err := resinfoRR(q.Question[0].Name, r.opt.TTL, r.opt.keys())
+	if err != nil {
+		return nil, err
+	}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	a.RecursionAvailable = q.RecursionDesired
+	a.Answer = []dns.RR{rr}
+	return a, nil
+}
+
+func (r *ResInfo) String() string {
+	return r.id
+}
+
+// Info returns the resolver information of the responder.
+func (r *ResInfo) Info() *ResolverInfo {
+	return &r.opt.ResolverInfo
+}
+
+// Builds a RESINFO record. Its data has the same format as TXT records, but
+// the type isn't known to the DNS library so it's encoded as unknown type.
+func resinfoRR(name string, ttl uint32, keys []string) (dns.RR, error) {
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: keys,
+	}
+	rr := new(dns.RFC3597)
+	if err := rr.ToRFC3597(txt); err != nil {
+		return nil, err
+	}
+	rr.Hdr.Rrtype = TypeRESINFO
+	return rr, nil
+}
+
+// Returns a list of EDE codes as comma-separated ranges, like "15-17,20".
+func edeRanges(codes []uint16) string {
+	codes = slices.Clone(codes)
+	slices.Sort(codes)
+	codes = slices.Compact(codes)
+	var ranges []string
+	for i := 0; i < len(codes); {
+		j := i
+		for j+1 < len(codes) && codes[j+1] == codes[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(codes[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", codes[i], codes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
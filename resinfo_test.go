@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResInfo(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r, err := NewResInfo("test-resinfo", upstream, ResInfoOptions{
+		ResolverInfo: ResolverInfo{
+			QNameMinimization: true,
+			ExtendedErrors:    []uint16{17, 15, 16, 20},
+			InfoURL:           "https://dns.example.com/.well-known/resolver-info/",
+			Filtering:         "Ads and malware are blocked.",
+		},
+		Names: []string{"resolver.arpa", "dns.example.com."},
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"resolver.arpa.", "DNS.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, TypeRESINFO)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, 0, upstream.HitCount())
+		require.True(t, a.Authoritative)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, TypeRESINFO, a.Answer[0].Header().Rrtype)
+
+		// The record survives the wire and has the data of a TXT record
+		b, err := a.Pack()
+		require.NoError(t, err)
+		require.NoError(t, a.Unpack(b))
+		txt := &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{"qnamemin", "exterr=15-17,20", "infourl=https://dns.example.com/.well-known/resolver-info/"},
+		}
+		expected := new(dns.RFC3597)
+		require.NoError(t, expected.ToRFC3597(txt))
+		rdata, err := hex.DecodeString(a.Answer[0].(*dns.RFC3597).Rdata)
+		require.NoError(t, err)
+		require.Equal(t, expected.Rdata, hex.EncodeToString(rdata))
+	}
+
+	// Other types and names are forwarded
+	q := new(dns.Msg)
+	q.SetQuestion("resolver.arpa.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	q.SetQuestion("example.com.", TypeRESINFO)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// The info URL must use https
+	_, err = NewResInfo("test-resinfo-http", upstream, ResInfoOptions{ResolverInfo: ResolverInfo{InfoURL: "http://dns.example.com/"}})
+	require.Error(t, err)
+}
+
+func TestResolverInfoPage(t *testing.T) {
+	info := &ResolverInfo{
+		ExtendedErrors: []uint16{15},
+		Filtering:      "Ads are <blocked>.",
+	}
+	l, err := NewDoHListener("test-resinfo-doh", "127.0.0.1:0", DoHListenerOptions{ResolverInfo: info}, new(TestResolver))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	l.opt.customMux.ServeHTTP(w, httptest.NewRequest("GET", ResolverInfoPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	require.Contains(t, body, "QNAME minimization: disabled")
+	require.Contains(t, body, "15 (Blocked)")
+	require.Contains(t, body, "Ads are &lt;blocked&gt;.")
+}
+
+func TestEDERanges(t *testing.T) {
+	require.Equal(t, "", edeRanges(nil))
+	require.Equal(t, "15", edeRanges([]uint16{15}))
+	require.Equal(t, "0,15-18,20", edeRanges([]uint16{18, 15, 16, 17, 20, 0, 16}))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -20,11 +21,15 @@ type TestResolver struct {
 	ResolveFunc func(*dns.Msg, ClientInfo) (*dns.Msg, error)
 	hitCount    int
 	shouldFail  bool
+	mu          sync.Mutex
 }
 
 func (r *TestResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.mu.Lock()
 	r.hitCount++
-	if r.shouldFail {
+	shouldFail := r.shouldFail
+	r.mu.Unlock()
+	if shouldFail {
 		return nil, errors.New("failed")
 	}
 	if r.ResolveFunc != nil {
@@ -38,9 +43,13 @@ func (r *TestResolver) String() string {
 }
 
 func (r *TestResolver) HitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return r.hitCount
 }
 
 func (r *TestResolver) SetFail(f bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.shouldFail = f
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
@@ -26,6 +27,9 @@ type ResponseBlocklistIP struct {
 	ResponseBlocklistIPOptions
 	resolver Resolver
 	mu       sync.RWMutex
+
+	// Set once the blocklist is closed, stops the refresh loop.
+	closed atomic.Bool
 }
 
 var _ Resolver = &ResponseBlocklistIP{}
@@ -49,10 +53,14 @@ type ResponseBlocklistIPOptions struct {
 	// Optional, allows specifying extended errors to be used in the
 	// response when blocking.
 	EDNS0EDETemplate *EDNS0EDETemplate
+
+	// Source of time for the refresh loop. Defaults to the system clock.
+	Clock Clock
 }
 
 // NewResponseBlocklistIP returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistIP(id string, resolver Resolver, opt ResponseBlocklistIPOptions) (*ResponseBlocklistIP, error) {
+	opt.Clock = clockOrDefault(opt.Clock)
 	blocklist := &ResponseBlocklistIP{id: id, resolver: resolver, ResponseBlocklistIPOptions: opt}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
@@ -72,6 +80,7 @@ func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, erro
 	if answer.Rcode != dns.RcodeSuccess {
 		return answer, err
 	}
+	defer recordTiming(ci, "blocklist", r.id, time.Now())
 	if r.Filter {
 		return r.filterMatch(q, answer, ci)
 	}
@@ -82,21 +91,35 @@ func (r *ResponseBlocklistIP) String() string {
 	return r.id
 }
 
+// Close stops refreshing the blocklist and closes its database.
+func (r *ResponseBlocklistIP) Close() error {
+	r.closed.Store(true)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.BlocklistDB.Close()
+}
+
 func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		r.Clock.Sleep(refresh)
+		if r.closed.Load() {
+			return
+		}
 		log := Log.With("id", r.id)
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
 			log.Error("failed to load rules",
 				"error", err)
+			notifyReloadFailed(r.id, err)
+			statusReload(r.id, err)
 			continue
 		}
 		r.mu.Lock()
 		r.BlocklistDB.Close()
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		statusReload(r.id, nil)
 	}
 }
 
@@ -118,6 +141,7 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 					slog.String("rule", match.GetRule()),
 					slog.String("ip", ip.String()),
 				)
+				traceBlocked(ci, r.id, match)
 				if r.BlocklistResolver != nil {
 					log.With(slog.String("resolver", r.BlocklistResolver.String())).Debug("blocklist match, forwarding to blocklist-resolver")
 					return r.BlocklistResolver.Resolve(query, ci)
@@ -171,6 +195,7 @@ func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.
 				slog.String("ip", ip.String()),
 			)
 			log.Debug("filtering response")
+			traceBlocked(ci, r.id, match)
 			continue
 		}
 		newRRs = append(newRRs, rr)
@@ -3,6 +3,7 @@ package rdns
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -15,10 +16,19 @@ type ResponseBlocklistName struct {
 	ResponseBlocklistNameOptions
 	resolver Resolver
 	mu       sync.RWMutex
+	metrics  *ResponseBlocklistNameMetrics
+
+	// Set once the blocklist is closed, stops the refresh loop.
+	closed atomic.Bool
 }
 
 var _ Resolver = &ResponseBlocklistName{}
 
+type ResponseBlocklistNameMetrics struct {
+	// Responses blocked because of a name in the CNAME chain.
+	blockedCNAME *Counter
+}
+
 type ResponseBlocklistNameOptions struct {
 	// Optional, if the response is found to match the blocklist, send the query to this resolver.
 	BlocklistResolver Resolver
@@ -31,14 +41,37 @@ type ResponseBlocklistNameOptions struct {
 	// Inverted behavior, only allow responses that can be found on at least one list.
 	Inverted bool
 
+	// Follow the CNAME chain from the query name and check its names in
+	// order, rather than the targets of all CNAME records in the response.
+	// Limits the number of CNAME records that are checked to CNAMEMaxDepth.
+	CNAMEChain bool
+
+	// Maximum number of CNAME records followed when CNAMEChain is set.
+	// Defaults to 10.
+	CNAMEMaxDepth int
+
 	// Optional, allows specifying extended errors to be used in the
 	// response when blocking.
 	EDNS0EDETemplate *EDNS0EDETemplate
+
+	// Source of time for the refresh loop. Defaults to the system clock.
+	Clock Clock
 }
 
 // NewResponseBlocklistName returns a new instance of a response blocklist resolver.
 func NewResponseBlocklistName(id string, resolver Resolver, opt ResponseBlocklistNameOptions) (*ResponseBlocklistName, error) {
-	blocklist := &ResponseBlocklistName{id: id, resolver: resolver, ResponseBlocklistNameOptions: opt}
+	if opt.CNAMEMaxDepth == 0 {
+		opt.CNAMEMaxDepth = defaultCNAMEMaxDepth
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	blocklist := &ResponseBlocklistName{
+		id:                           id,
+		resolver:                     resolver,
+		ResponseBlocklistNameOptions: opt,
+		metrics: &ResponseBlocklistNameMetrics{
+			blockedCNAME: getCounter("router", id, "deny-cname"),
+		},
+	}
 
 	// Start the refresh goroutines if we have a list and a refresh period was given
 	if blocklist.BlocklistDB != nil && blocklist.BlocklistRefresh > 0 {
@@ -54,6 +87,7 @@ func (r *ResponseBlocklistName) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, er
 	if err != nil || answer == nil {
 		return answer, err
 	}
+	defer recordTiming(ci, "blocklist", r.id, time.Now())
 	return r.blockIfMatch(q, answer, ci)
 }
 
@@ -61,68 +95,107 @@ func (r *ResponseBlocklistName) String() string {
 	return r.id
 }
 
+// Close stops refreshing the blocklist.
+func (r *ResponseBlocklistName) Close() error {
+	r.closed.Store(true)
+	return nil
+}
+
 func (r *ResponseBlocklistName) refreshLoopBlocklist(refresh time.Duration) {
 	for {
-		time.Sleep(refresh)
+		r.Clock.Sleep(refresh)
+		if r.closed.Load() {
+			return
+		}
 		log := Log.With("id", r.id)
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
 			log.Error("failed to load rules", "error", err)
+			notifyReloadFailed(r.id, err)
+			statusReload(r.id, err)
 			continue
 		}
 		r.mu.Lock()
 		r.BlocklistDB = db
 		r.mu.Unlock()
+		statusReload(r.id, nil)
 	}
 }
 
 func (r *ResponseBlocklistName) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.CNAMEChain && len(query.Question) > 0 {
+		chain, complete := cnameChain(query.Question[0].Name, answer, r.CNAMEMaxDepth)
+		if !complete {
+			logger(r.id, query, ci).Debug("cname chain too long, checking only part of it", "max-depth", r.CNAMEMaxDepth)
+		}
+		for _, name := range chain {
+			if a, blocked, err := r.blockName(query, ci, name); blocked {
+				r.metrics.blockedCNAME.Add(1)
+				return a, err
+			}
+		}
+	}
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
 			var name string
-			switch r := rr.(type) {
+			switch rec := rr.(type) {
 			case *dns.CNAME:
-				name = r.Target
+				if r.CNAMEChain { // Checked above
+					continue
+				}
+				name = rec.Target
 			case *dns.MX:
-				name = r.Mx
+				name = rec.Mx
 			case *dns.NS:
-				name = r.Ns
+				name = rec.Ns
 			case *dns.PTR:
-				name = r.Ptr
+				name = rec.Ptr
 			case *dns.SRV:
-				name = r.Target
+				name = rec.Target
 			case *dns.HTTPS:
-				name = svcbString(&r.SVCB)
+				name = svcbString(&rec.SVCB)
 			case *dns.TXT:
-				name = strings.Join(r.Txt, " ")
+				name = strings.Join(rec.Txt, " ")
 			case *dns.SVCB:
-				name = svcbString(r)
+				name = svcbString(rec)
 			case *dns.SOA:
-				name = r.Ns
+				name = rec.Ns
 			default:
 				continue
 			}
-			msg := new(dns.Msg)
-			msg.SetQuestion(name, 0)
-			if _, _, rule, ok := r.BlocklistDB.Match(msg); ok != r.Inverted {
-				log := logger(r.id, query, ci).With("rule", rule.GetRule())
-				if r.BlocklistResolver != nil {
-					log.With("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
-					return r.BlocklistResolver.Resolve(query, ci)
-				}
-				log.Debug("blocking response")
-				answer = nxdomain(query)
-				if err := r.EDNS0EDETemplate.Apply(answer, EDNS0EDEInput{query, rule}); err != nil {
-					log.Error("failed to apply edns0ede template", "error", err)
-				}
-				return answer, nil
+			if a, blocked, err := r.blockName(query, ci, name); blocked {
+				return a, err
 			}
 		}
 	}
 	return answer, nil
 }
 
+// Checks a name from the response against the blocklist. Returns the response
+// to the query and true if it's blocked.
+func (r *ResponseBlocklistName) blockName(query *dns.Msg, ci ClientInfo, name string) (*dns.Msg, bool, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, 0)
+	_, _, rule, ok := r.BlocklistDB.Match(msg)
+	if ok == r.Inverted {
+		return nil, false, nil
+	}
+	log := logger(r.id, query, ci).With("rule", rule.GetRule())
+	traceBlocked(ci, r.id, rule)
+	if r.BlocklistResolver != nil {
+		log.With("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
+		a, err := r.BlocklistResolver.Resolve(query, ci)
+		return a, true, err
+	}
+	log.Debug("blocking response")
+	answer := nxdomain(query)
+	if err := r.EDNS0EDETemplate.Apply(answer, EDNS0EDEInput{query, rule}); err != nil {
+		log.Error("failed to apply edns0ede template", "error", err)
+	}
+	return answer, true, nil
+}
+
 // Format an SVCB (and HTTPS) record as string like so "TARGET key1=value1 key2=value2"
 // For example: ". alpn=h2,h3"
 func svcbString(rr *dns.SVCB) string {
@@ -0,0 +1,40 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistNameCNAMEChain(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	r := &TestResolver{ResolveFunc: cnameChainResponse}
+
+	db, err := NewDomainDB("testlist", NewStaticLoader([]string{".ads.test"}))
+	require.NoError(t, err)
+
+	// The tracker is found by following the chain
+	b, err := NewResponseBlocklistName("test-rbl", r, ResponseBlocklistNameOptions{
+		BlocklistDB: db,
+		CNAMEChain:  true,
+	})
+	require.NoError(t, err)
+	q.SetQuestion("www.example.test.", dns.TypeA)
+	a, err := b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, int64(1), b.metrics.blockedCNAME.Value())
+
+	// CNAME records beyond the depth limit aren't checked
+	b, err = NewResponseBlocklistName("test-rbl-depth", r, ResponseBlocklistNameOptions{
+		BlocklistDB:   db,
+		CNAMEChain:    true,
+		CNAMEMaxDepth: 1,
+	})
+	require.NoError(t, err)
+	a, err = b.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+}
@@ -0,0 +1,210 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseClamp limits the number of answer records and the size of
+// responses, to protect clients on links with a low MTU or with small
+// buffers from very large RRsets. Records of the queried type beyond the
+// limits are removed from the answer, with the policy deciding which ones
+// are kept.
+type ResponseClamp struct {
+	id       string
+	resolver Resolver
+	opt      ResponseClampOptions
+	metrics  *ResponseClampMetrics
+
+	// Used to probe the records with the fastest-tcp policy
+	prober *FastestTCP
+}
+
+// ResponseClampPolicy determines which records are kept when the answer is
+// clamped.
+type ResponseClampPolicy string
+
+const (
+	// Keep the records in the order of the upstream response
+	ResponseClampFirst ResponseClampPolicy = "first"
+	// Keep a random subset of the records
+	ResponseClampRandom ResponseClampPolicy = "random"
+	// Keep the A/AAAA records with the fastest TCP connection probes
+	ResponseClampFastestTCP ResponseClampPolicy = "fastest-tcp"
+)
+
+// ResponseClampOptions contain settings for the response clamp.
+type ResponseClampOptions struct {
+	// Maximum number of answer records of the queried type, unlimited if 0.
+	MaxAnswers int
+
+	// Maximum size of the response in bytes, with name compression,
+	// unlimited if 0. Authority and additional records are removed first,
+	// then answer records. At least one answer record is kept.
+	MaxSize int
+
+	// Records to keep, default "first".
+	Policy ResponseClampPolicy
+
+	// Port number for TCP probes with the fastest-tcp policy, default 443.
+	Port int
+}
+
+type ResponseClampMetrics struct {
+	// Responses that were clamped.
+	clamped *Counter
+	// Records removed from responses.
+	removed *Counter
+}
+
+var _ Resolver = &ResponseClamp{}
+
+// NewResponseClamp returns a new instance of a response clamp.
+func NewResponseClamp(id string, resolver Resolver, opt ResponseClampOptions) (*ResponseClamp, error) {
+	switch opt.Policy {
+	case "":
+		opt.Policy = ResponseClampFirst
+	case ResponseClampFirst, ResponseClampRandom, ResponseClampFastestTCP:
+	default:
+		return nil, fmt.Errorf("unsupported clamp policy '%s'", opt.Policy)
+	}
+	if opt.MaxAnswers < 0 || opt.MaxSize < 0 {
+		return nil, errors.New("clamp limits can't be negative")
+	}
+	return &ResponseClamp{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &ResponseClampMetrics{
+			clamped: getCounter("router", id, "clamped"),
+			removed: getCounter("router", id, "removed"),
+		},
+		prober: NewFastestTCP(id, nil, FastestTCPOptions{Port: opt.Port}),
+	}, nil
+}
+
+// Resolve a DNS query with the upstream resolver and clamp the response.
+func (r *ResponseClamp) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || len(q.Question) < 1 {
+		return a, err
+	}
+	qtype := q.Question[0].Qtype
+
+	var rrs []dns.RR
+	for _, rr := range a.Answer {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	tooMany := r.opt.MaxAnswers > 0 && len(rrs) > r.opt.MaxAnswers
+	tooLarge := r.opt.MaxSize > 0 && compressedLen(a) > r.opt.MaxSize
+	if !tooMany && !tooLarge {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+	before := countRRs(a)
+
+	// Sort the records by preference before removing any
+	if len(rrs) > 1 {
+		switch r.opt.Policy {
+		case ResponseClampRandom:
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		case ResponseClampFastestTCP:
+			if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+				rrs = r.fastest(rrs)
+			}
+		}
+	}
+	if tooMany {
+		rrs = rrs[:r.opt.MaxAnswers]
+	}
+	setAnswerRRs(a, qtype, rrs)
+
+	// Remove records until the response fits, authority and additional
+	// records first, except for the OPT record.
+	if r.opt.MaxSize > 0 && compressedLen(a) > r.opt.MaxSize {
+		a.Ns = nil
+		var extra []dns.RR
+		for _, rr := range a.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		a.Extra = extra
+		for len(rrs) > 1 && compressedLen(a) > r.opt.MaxSize {
+			rrs = rrs[:len(rrs)-1]
+			setAnswerRRs(a, qtype, rrs)
+		}
+	}
+
+	removed := before - countRRs(a)
+	log.Debug("clamping response", "removed", removed, "size", compressedLen(a))
+	r.metrics.clamped.Add(1)
+	r.metrics.removed.Add(int64(removed))
+	return a, nil
+}
+
+func (r *ResponseClamp) String() string {
+	return r.id
+}
+
+// Returns the records ordered by the time it took to establish a TCP
+// connection, fastest first. Records that couldn't be probed come last, in
+// their original order.
+func (r *ResponseClamp) fastest(rrs []dns.RR) []dns.RR {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	log := Log.With("id", r.id, "port", r.prober.port)
+	resultCh := r.prober.probe(ctx, log, rrs)
+	sorted := make([]dns.RR, 0, len(rrs))
+	probed := make(map[dns.RR]struct{}, len(rrs))
+	for range rrs {
+		res := <-resultCh
+		if res.err == nil {
+			sorted = append(sorted, res.rr)
+			probed[res.rr] = struct{}{}
+		}
+	}
+	for _, rr := range rrs {
+		if _, ok := probed[rr]; !ok {
+			sorted = append(sorted, rr)
+		}
+	}
+	return sorted
+}
+
+// Replaces the answer records of the given type with a new set, keeping
+// all other records, like CNAMEs, in place.
+func setAnswerRRs(a *dns.Msg, qtype uint16, rrs []dns.RR) {
+	answer := make([]dns.RR, 0, len(a.Answer))
+	for _, rr := range a.Answer {
+		if rr.Header().Rrtype != qtype {
+			answer = append(answer, rr)
+			continue
+		}
+		if len(rrs) > 0 {
+			answer = append(answer, rrs[0])
+			rrs = rrs[1:]
+		}
+	}
+	a.Answer = answer
+}
+
+// Returns the size of the message in wire format, with name compression.
+func compressedLen(a *dns.Msg) int {
+	compress := a.Compress
+	a.Compress = true
+	n := a.Len()
+	a.Compress = compress
+	return n
+}
+
+func countRRs(a *dns.Msg) int {
+	return len(a.Answer) + len(a.Ns) + len(a.Extra)
+}
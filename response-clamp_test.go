@@ -0,0 +1,102 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseClamp(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			cname, _ := dns.NewRR("www.example.com. 60 IN CNAME example.com.")
+			a.Answer = append(a.Answer, cname)
+			for i := 1; i <= 20; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("example.com. 60 IN A 192.0.2.%d", i))
+				a.Answer = append(a.Answer, rr)
+			}
+			ns, _ := dns.NewRR("example.com. 60 IN NS ns.example.com.")
+			a.Ns = append(a.Ns, ns)
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	// Only the first A records are kept, the CNAME stays in place
+	r, err := NewResponseClamp("test-clamp", upstream, ResponseClampOptions{MaxAnswers: 8})
+	require.NoError(t, err)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 9)
+	require.Equal(t, dns.TypeCNAME, a.Answer[0].Header().Rrtype)
+	require.Equal(t, "192.0.2.1", a.Answer[1].(*dns.A).A.String())
+	require.Equal(t, "192.0.2.8", a.Answer[8].(*dns.A).A.String())
+	require.Len(t, a.Ns, 1)
+
+	// A random subset is kept
+	r, err = NewResponseClamp("test-clamp", upstream, ResponseClampOptions{MaxAnswers: 8, Policy: ResponseClampRandom})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 9)
+
+	// Authority records are removed first, then answer records until it fits
+	r, err = NewResponseClamp("test-clamp", upstream, ResponseClampOptions{MaxSize: 200})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Empty(t, a.Ns)
+	require.LessOrEqual(t, compressedLen(a), 200)
+	require.Greater(t, len(a.Answer), 2)
+	require.Less(t, len(a.Answer), 21)
+
+	// At least one record is kept
+	r, err = NewResponseClamp("test-clamp", upstream, ResponseClampOptions{MaxSize: 12})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+
+	_, err = NewResponseClamp("test-clamp", upstream, ResponseClampOptions{Policy: "fastest"})
+	require.Error(t, err)
+}
+
+func TestResponseClampFastestTCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// Only 127.0.0.1 accepts connections
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, ip := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.1"} {
+				rr, _ := dns.NewRR("example.com. 60 IN A " + ip)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	r, err := NewResponseClamp("test-clamp", upstream, ResponseClampOptions{
+		MaxAnswers: 2,
+		Policy:     ResponseClampFastestTCP,
+		Port:       port,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "127.0.0.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "127.0.0.2", a.Answer[1].(*dns.A).A.String())
+}
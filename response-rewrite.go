@@ -0,0 +1,197 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseRewrite modifies the data of records in responses, typically for
+// split-horizon setups behind NAT where the public addresses of local servers
+// aren't reachable from inside. Addresses in A and AAAA records are mapped
+// from one network to another keeping the host part, and the targets of CNAME,
+// SRV and MX records can be moved to another domain. Only the answer and
+// additional sections are modified.
+type ResponseRewrite struct {
+	id        string
+	resolver  Resolver
+	addresses []AddressMapping
+	names     []NameMapping
+	metrics   *ResponseRewriteMetrics
+}
+
+// AddressMapping maps addresses in one network to the same host in another
+// network of the same size.
+type AddressMapping struct {
+	From *net.IPNet
+	To   *net.IPNet
+}
+
+// NameMapping replaces the suffix of a name with another.
+type NameMapping struct {
+	From string
+	To   string
+}
+
+// ResponseRewriteOptions contain the rules for rewriting responses.
+type ResponseRewriteOptions struct {
+	// Address mappings. The most specific network that contains an address
+	// is used.
+	Addresses []AddressMapping
+
+	// Mappings of CNAME, SRV and MX targets. The most specific suffix of a
+	// name is replaced.
+	Names []NameMapping
+}
+
+type ResponseRewriteMetrics struct {
+	// Rewritten records by type.
+	rewrite *CounterMap
+}
+
+var _ Resolver = &ResponseRewrite{}
+
+// NewResponseRewrite returns a new instance of a response rewriter.
+func NewResponseRewrite(id string, resolver Resolver, opt ResponseRewriteOptions) (*ResponseRewrite, error) {
+	var addresses []AddressMapping
+	for _, m := range opt.Addresses {
+		fromOnes, fromBits := m.From.Mask.Size()
+		toOnes, toBits := m.To.Mask.Size()
+		if fromBits != toBits || len(m.From.IP) != len(m.To.IP) {
+			return nil, fmt.Errorf("can't map %s to %s of a different address family", m.From, m.To)
+		}
+		if fromOnes != toOnes {
+			return nil, fmt.Errorf("can't map %s to %s of a different size", m.From, m.To)
+		}
+		addresses = append(addresses, m)
+	}
+	// Most specific networks first
+	slices.SortStableFunc(addresses, func(a, b AddressMapping) int {
+		aOnes, _ := a.From.Mask.Size()
+		bOnes, _ := b.From.Mask.Size()
+		return bOnes - aOnes
+	})
+
+	var names []NameMapping
+	for _, m := range opt.Names {
+		from := strings.ToLower(dns.Fqdn(m.From))
+		to := strings.ToLower(dns.Fqdn(m.To))
+		if from == "." {
+			return nil, fmt.Errorf("can't map the root to %s", to)
+		}
+		names = append(names, NameMapping{From: from, To: to})
+	}
+	// Longest suffixes first
+	slices.SortStableFunc(names, func(a, b NameMapping) int {
+		return dns.CountLabel(b.From) - dns.CountLabel(a.From)
+	})
+
+	return &ResponseRewrite{
+		id:        id,
+		resolver:  resolver,
+		addresses: addresses,
+		names:     names,
+		metrics: &ResponseRewriteMetrics{
+			rewrite: getCounterMap("router", id, "rewrite", "type"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query and rewrite the records in the response.
+func (r *ResponseRewrite) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || len(q.Question) != 1 || (len(a.Answer) == 0 && len(a.Extra) == 0) {
+		return a, err
+	}
+	a = a.Copy()
+	qname := q.Question[0].Name
+
+	// Targets that were rewritten, the records of the old names further down
+	// the answer are renamed as well to keep the chain intact
+	renamed := make(map[string]string)
+	var modified bool
+	rewrite := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			var changed bool
+			switch rr := rr.(type) {
+			case *dns.A:
+				rr.A, changed = r.mapAddress(rr.A)
+			case *dns.AAAA:
+				rr.AAAA, changed = r.mapAddress(rr.AAAA)
+			case *dns.CNAME:
+				rr.Target, changed = r.mapName(rr.Target, renamed)
+			case *dns.SRV:
+				rr.Target, changed = r.mapName(rr.Target, renamed)
+			case *dns.MX:
+				rr.Mx, changed = r.mapName(rr.Mx, renamed)
+			}
+			if to, ok := renamed[strings.ToLower(rr.Header().Name)]; ok && !strings.EqualFold(rr.Header().Name, qname) {
+				rr.Header().Name = to
+				changed = true
+			}
+			if changed {
+				modified = true
+				r.metrics.rewrite.Add(dns.TypeToString[rr.Header().Rrtype], 1)
+			}
+		}
+	}
+	rewrite(a.Answer)
+	rewrite(a.Extra)
+	if !modified {
+		return a, nil
+	}
+	logger(r.id, q, ci).Debug("rewrote response")
+
+	// Signatures don't match the modified records anymore
+	a.AuthenticatedData = false
+	isSig := func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeRRSIG }
+	a.Answer = slices.DeleteFunc(a.Answer, isSig)
+	a.Extra = slices.DeleteFunc(a.Extra, isSig)
+	return a, nil
+}
+
+func (r *ResponseRewrite) String() string {
+	return r.id
+}
+
+// Maps an address to the network of the first mapping that contains it.
+func (r *ResponseRewrite) mapAddress(ip net.IP) (net.IP, bool) {
+	for _, m := range r.addresses {
+		if !m.From.Contains(ip) {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil && len(m.From.IP) == net.IPv4len {
+			ip = ip4
+		}
+		out := make(net.IP, len(m.To.IP))
+		for i := range out {
+			out[i] = m.To.IP[i]&m.To.Mask[i] | ip[i]&^m.From.Mask[i]
+		}
+		return out, true
+	}
+	return ip, false
+}
+
+// Replaces the suffix of a name according to the most specific mapping.
+// Records the new name in renamed.
+func (r *ResponseRewrite) mapName(name string, renamed map[string]string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, m := range r.names {
+		if !dns.IsSubDomain(m.From, lower) {
+			continue
+		}
+		newName := lower[:len(lower)-len(m.From)] + m.To
+		if m.To == "." {
+			newName = lower[:len(lower)-len(m.From)]
+		}
+		if _, ok := dns.IsDomainName(newName); !ok || newName == "" {
+			return name, false
+		}
+		renamed[lower] = newName
+		return newName, true
+	}
+	return name, false
+}
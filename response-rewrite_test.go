@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseRewrite(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.AuthenticatedData = true
+			for _, s := range []string{
+				"www.example.com. 60 IN CNAME web.cdn.example.com.",
+				"web.cdn.example.com. 60 IN A 203.0.113.10",
+				"web.cdn.example.com. 60 IN A 198.51.100.7",
+				"web.cdn.example.com. 60 IN AAAA 2001:db8:1::10",
+				"web.cdn.example.com. 60 IN RRSIG A 13 4 60 20300101000000 20200101000000 12345 example.com. AAAA",
+				"example.com. 60 IN MX 10 mail.example.com.",
+				"_sip._tcp.example.com. 60 IN SRV 0 0 5060 sip.other.net.",
+			} {
+				rr, err := dns.NewRR(s)
+				require.NoError(t, err)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	parse := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+	r, err := NewResponseRewrite("test-rewrite", upstream, ResponseRewriteOptions{
+		Addresses: []AddressMapping{
+			{From: parse("203.0.113.0/24"), To: parse("10.1.2.0/24")},
+			{From: parse("203.0.113.10/32"), To: parse("10.9.9.9/32")},
+			{From: parse("2001:db8:1::/48"), To: parse("fd00:1::/48")},
+		},
+		Names: []NameMapping{
+			{From: "example.com", To: "corp.internal"},
+			{From: "cdn.example.com.", To: "cache.lan."},
+		},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.AuthenticatedData)
+
+	var got []string
+	for _, rr := range a.Answer {
+		got = append(got, rr.String())
+	}
+	require.Equal(t, []string{
+		// The query name stays, the CNAME chain is renamed along with the target
+		"www.example.com.\t60\tIN\tCNAME\tweb.cache.lan.",
+		"web.cache.lan.\t60\tIN\tA\t10.9.9.9",
+		"web.cache.lan.\t60\tIN\tA\t198.51.100.7",
+		"web.cache.lan.\t60\tIN\tAAAA\tfd00:1::10",
+		"example.com.\t60\tIN\tMX\t10 mail.corp.internal.",
+		"_sip._tcp.example.com.\t60\tIN\tSRV\t0 0 5060 sip.other.net.",
+	}, got)
+
+	// Networks of different size can't be mapped
+	_, err = NewResponseRewrite("test-rewrite-invalid", upstream, ResponseRewriteOptions{
+		Addresses: []AddressMapping{{From: parse("203.0.113.0/24"), To: parse("10.0.0.0/16")}},
+	})
+	require.Error(t, err)
+}
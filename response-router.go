@@ -0,0 +1,211 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseRouter resolves queries with a primary resolver and then routes
+// them based on the response. If the response matches a route, the query is
+// sent to the resolver of that route and its response is returned instead,
+// for example to retry NXDOMAIN responses or empty answers with another
+// resolver, or to block names that are aliases of unwanted domains. Responses that don't match any of the routes are returned as-is.
+type ResponseRouter struct {
+	id       string
+	resolver Resolver
+	routes   []*ResponseRoute
+	metrics  *RouterMetrics
+}
+
+var _ Resolver = &ResponseRouter{}
+
+// ResponseRouterOptions contain the routes of a response router.
+type ResponseRouterOptions struct {
+	// Routes are evaluated in order, the first matching route is used.
+	Routes []ResponseRoute
+}
+
+// ResponseRoute matches responses from the primary resolver. All conditions
+// that are set have to match.
+type ResponseRoute struct {
+	// Response codes, "NXDOMAIN", "SERVFAIL", etc. The response has to have
+	// one of these.
+	Rcodes []string
+
+	// Number of records in the answer section of the response, for example
+	// 0 to match empty responses. Ignored if nil.
+	AnswerCount *int
+
+	// Flags that have to be set in the response, "AA", "TC", "RA", "AD" or
+	// "CD".
+	Flags []string
+
+	// Regular expression matched against the targets of CNAME records in the
+	// answer, for example to send queries for names that are aliases of
+	// tracking domains to a blocking resolver. At least one has to match.
+	CNAME string
+
+	// Match if the primary resolver failed or dropped the query. Can't be
+	// combined with the other conditions.
+	Error bool
+
+	// Resolver to send the query to if the route matches.
+	Resolver Resolver
+
+	rcodes []int
+	cname  *regexp.Regexp
+}
+
+// NewResponseRouter returns a new instance of a response router.
+func NewResponseRouter(id string, resolver Resolver, opt ResponseRouterOptions) (*ResponseRouter, error) {
+	r := &ResponseRouter{
+		id:       id,
+		resolver: resolver,
+		metrics:  NewRouterMetrics(id, len(opt.Routes)),
+	}
+	for i, route := range opt.Routes {
+		if route.Resolver == nil {
+			return nil, fmt.Errorf("no resolver defined for response route %d", i)
+		}
+		if route.Error && (len(route.Rcodes) > 0 || route.AnswerCount != nil || len(route.Flags) > 0 || route.CNAME != "") {
+			return nil, fmt.Errorf("response route %d can't match errors and responses", i)
+		}
+		for _, s := range route.Rcodes {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+			if !ok {
+				return nil, fmt.Errorf("unknown rcode '%s'", s)
+			}
+			route.rcodes = append(route.rcodes, rcode)
+		}
+		for _, flag := range route.Flags {
+			if _, err := responseFlag(new(dns.Msg), flag); err != nil {
+				return nil, err
+			}
+		}
+		if route.CNAME != "" {
+			re, err := regexp.Compile(route.CNAME)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cname expression in response route %d: %w", i, err)
+			}
+			route.cname = re
+		}
+		r.routes = append(r.routes, &route)
+	}
+	return r, nil
+}
+
+// Resolve a DNS query with the primary resolver, then pass it on to the
+// resolver of the first route matching the response.
+func (r *ResponseRouter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	for _, route := range r.routes {
+		if !route.match(a, err) {
+			continue
+		}
+		logger(r.id, q, ci).Debug("routing query by response",
+			"route", route.String(),
+			"resolver", route.Resolver.String())
+		r.metrics.route.Add(route.Resolver.String(), 1)
+		a, err = route.Resolver.Resolve(q, ci)
+		if err != nil {
+			r.metrics.failure.Add(route.Resolver.String(), 1)
+		}
+		return a, err
+	}
+	return a, err
+}
+
+func (r *ResponseRouter) String() string {
+	return r.id
+}
+
+func (r *ResponseRoute) match(a *dns.Msg, err error) bool {
+	if isFailoverError(err) || (err == nil && a == nil) {
+		return r.Error
+	}
+	if err != nil { // Policy errors are the same with every resolver
+		return false
+	}
+	if r.Error {
+		return false
+	}
+	if len(r.rcodes) > 0 {
+		var found bool
+		for _, rcode := range r.rcodes {
+			if a.Rcode == rcode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.AnswerCount != nil && len(a.Answer) != *r.AnswerCount {
+		return false
+	}
+	for _, flag := range r.Flags {
+		if set, _ := responseFlag(a, flag); !set {
+			return false
+		}
+	}
+	if r.cname != nil && !r.matchCNAME(a) {
+		return false
+	}
+	return true
+}
+
+// Returns true if the target of a CNAME record in the answer matches.
+func (r *ResponseRoute) matchCNAME(a *dns.Msg) bool {
+	for _, rr := range a.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && r.cname.MatchString(strings.ToLower(cname.Target)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ResponseRoute) String() string {
+	var fragments []string
+	if r.Error {
+		fragments = append(fragments, "error=true")
+	}
+	if len(r.Rcodes) > 0 {
+		fragments = append(fragments, fmt.Sprintf("rcodes=%v", r.Rcodes))
+	}
+	if r.AnswerCount != nil {
+		fragments = append(fragments, fmt.Sprintf("answer-count=%d", *r.AnswerCount))
+	}
+	if len(r.Flags) > 0 {
+		fragments = append(fragments, fmt.Sprintf("flags=%v", r.Flags))
+	}
+	if r.CNAME != "" {
+		fragments = append(fragments, "cname="+r.CNAME)
+	}
+	return "(" + strings.Join(fragments, ",") + ")"
+}
+
+// Returns whether a header flag is set in a message.
+func responseFlag(a *dns.Msg, flag string) (bool, error) {
+	switch strings.ToUpper(flag) {
+	case "AA":
+		return a.Authoritative, nil
+	case "TC":
+		return a.Truncated, nil
+	case "RA":
+		return a.RecursionAvailable, nil
+	case "AD":
+		return a.AuthenticatedData, nil
+	case "CD":
+		return a.CheckingDisabled, nil
+	default:
+		return false, fmt.Errorf("unknown flag '%s'", flag)
+	}
+}
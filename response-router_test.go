@@ -0,0 +1,160 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseRouter(t *testing.T) {
+	var rcode int
+	var answers []dns.RR
+	primary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, rcode)
+			a.Answer = answers
+			return a, nil
+		},
+	}
+	nxdomain := new(TestResolver)
+	empty := new(TestResolver)
+	failed := new(TestResolver)
+
+	zero := 0
+	r, err := NewResponseRouter("test-rr", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{
+			{Rcodes: []string{"nxdomain"}, Resolver: nxdomain},
+			{Rcodes: []string{"NOERROR"}, AnswerCount: &zero, Resolver: empty},
+			{Error: true, Resolver: failed},
+		},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Regular response, nothing is re-routed
+	answers = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, 0, nxdomain.HitCount()+empty.HitCount()+failed.HitCount())
+
+	// NXDOMAIN goes to the first route
+	rcode = dns.RcodeNameError
+	answers = nil
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, nxdomain.HitCount())
+
+	// Empty NOERROR response goes to the second
+	rcode = dns.RcodeSuccess
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, empty.HitCount())
+
+	// Failures go to the third
+	primary.SetFail(true)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, failed.HitCount())
+	require.Equal(t, 1, nxdomain.HitCount())
+	require.Equal(t, 1, empty.HitCount())
+}
+
+func TestResponseRouterFlags(t *testing.T) {
+	primary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Truncated = true
+			return a, nil
+		},
+	}
+	retry := new(TestResolver)
+	r, err := NewResponseRouter("test-rr-flags", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{{Flags: []string{"tc"}, Resolver: retry}},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, retry.HitCount())
+
+	// Invalid routes
+	_, err = NewResponseRouter("test-rr-invalid", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{{Flags: []string{"XX"}, Resolver: retry}},
+	})
+	require.Error(t, err)
+	_, err = NewResponseRouter("test-rr-invalid", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{{Error: true, Rcodes: []string{"SERVFAIL"}, Resolver: retry}},
+	})
+	require.Error(t, err)
+}
+
+func TestResponseRouterCNAME(t *testing.T) {
+	primary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Name == "metrics.example.com." {
+				a.Answer = []dns.RR{
+					&dns.CNAME{Hdr: dns.RR_Header{Name: "metrics.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "example.tracker.test."},
+					&dns.A{Hdr: dns.RR_Header{Name: "example.tracker.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 1}},
+				}
+			}
+			return a, nil
+		},
+	}
+	blocking := new(TestResolver)
+	r, err := NewResponseRouter("test-rr-cname", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{{CNAME: `(^|\.)tracker\.test\.$`, Resolver: blocking}},
+	})
+	require.NoError(t, err)
+
+	// Names that are aliases of the tracking domain are sent to the blocking resolver
+	q := new(dns.Msg)
+	q.SetQuestion("metrics.example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, blocking.HitCount())
+
+	// Others are not
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, blocking.HitCount())
+
+	// Invalid expression
+	_, err = NewResponseRouter("test-rr-invalid", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{{CNAME: `(`, Resolver: blocking}},
+	})
+	require.Error(t, err)
+}
+
+func TestResponseRouterPolicyError(t *testing.T) {
+	primary := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, &BlockedError{List: "test-list", Rule: "example.com"}
+		},
+	}
+	failed := new(TestResolver)
+	r, err := NewResponseRouter("test-rr-policy", primary, ResponseRouterOptions{
+		Routes: []ResponseRoute{
+			{Error: true, Resolver: failed},
+		},
+	})
+	require.NoError(t, err)
+
+	// Blocked queries are not re-resolved through the error route
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrBlocked)
+	require.Equal(t, 0, failed.HitCount())
+}
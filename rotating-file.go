@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a file that's renamed to <name>.1 once it grows beyond a
+// maximum size, with older files moved to .2 and up to the number of files
+// kept. Files can start with a header, and end with a footer that's written
+// before they're rotated or closed. Safe for concurrent use.
+type rotatingFile struct {
+	name string
+	opt  rotatingFileOptions
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+type rotatingFileOptions struct {
+	// Rotate the file when it grows beyond this size in bytes. Disabled if 0.
+	MaxSize int64
+
+	// Number of rotated files to keep. Defaults to 1.
+	MaxFiles int
+
+	// Written to the start of every new file.
+	Header []byte
+
+	// Written to the end of every file. Existing files aren't appended to
+	// if set, they're rotated when the file is opened.
+	Footer []byte
+}
+
+// Returns a file for writing. Existing files are appended to, unless there's a
+// footer.
+func openRotatingFile(name string, opt rotatingFileOptions) (*rotatingFile, error) {
+	if opt.MaxFiles == 0 {
+		opt.MaxFiles = 1
+	}
+	w := &rotatingFile{name: name, opt: opt}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	if w.size > 0 && len(opt.Footer) > 0 {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Write p to the file, rotating it first if p doesn't fit. The data is never
+// split across files.
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, errors.New("file is closed")
+	}
+	size := w.size + int64(len(p)+len(w.opt.Footer))
+	if w.opt.MaxSize > 0 && size > w.opt.MaxSize && w.size > int64(len(w.opt.Header)) {
+		if err := w.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %w", w.name, err)
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close writes the footer and closes the file.
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	_, err := w.f.Write(w.opt.Footer)
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// Opens the file for appending, and writes the header if it's new or empty.
+func (w *rotatingFile) open() error {
+	f, err := os.OpenFile(w.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	if w.size > 0 {
+		return nil
+	}
+	n, err := f.Write(w.opt.Header)
+	w.size += int64(n)
+	return err
+}
+
+// Closes the current file, renames it and older files, then opens a new one.
+// The current file is opened again if it can't be renamed.
+func (w *rotatingFile) rotate() error {
+	if _, err := w.f.Write(w.opt.Footer); err != nil {
+		return err
+	}
+	w.f.Close()
+	w.f = nil
+	for i := w.opt.MaxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.name, i), fmt.Sprintf("%s.%d", w.name, i+1))
+	}
+	err := os.Rename(w.name, w.name+".1")
+	if oerr := w.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,10 +26,19 @@ type route struct {
 	resolver      Resolver
 	listenerID    *regexp.Regexp
 	tlsServerName *regexp.Regexp
+	clientGroup   string
+	opcodes       []int
+	transports    []string
+	minSize       int
+	maxSize       int
+	rate          *nameRate
 }
 
+// Transports of listeners that routes can match on.
+var routeTransports = []string{"udp", "tcp", "dot", "doh", "doq", "dtls", "odoh"}
+
 // NewRoute initializes a route from string parameters.
-func NewRoute(name, class string, types, weekdays []string, before, after, source, dohPath, listenerID, tlsServerName string, resolver Resolver) (*route, error) {
+func NewRoute(name, class string, types, weekdays []string, before, after, source, dohPath, listenerID, tlsServerName, clientGroup string, opcodes, transports []string, minSize, maxSize int, resolver Resolver) (*route, error) {
 	if resolver == nil {
 		return nil, errors.New("no resolver defined for route")
 	}
@@ -52,6 +62,10 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 	if err != nil {
 		return nil, err
 	}
+	o, err := stringToOpcode(opcodes)
+	if err != nil {
+		return nil, err
+	}
 	re, err := regexp.Compile(name)
 	if err != nil {
 		return nil, err
@@ -68,9 +82,23 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 	if err != nil {
 		return nil, err
 	}
+	var tr []string
+	for _, t := range transports {
+		t = strings.ToLower(t)
+		if !slices.Contains(routeTransports, t) {
+			return nil, fmt.Errorf("unknown transport '%s'", t)
+		}
+		tr = append(tr, t)
+	}
+	if minSize < 0 || maxSize < 0 {
+		return nil, errors.New("query size limits can't be negative")
+	}
+	if maxSize > 0 && minSize > maxSize {
+		return nil, fmt.Errorf("min-size %d is larger than max-size %d", minSize, maxSize)
+	}
 	var sNet *net.IPNet
 	if source != "" {
-		_, sNet, err = net.ParseCIDR(source)
+		sNet, err = ParseCIDR(source)
 		if err != nil {
 			return nil, err
 		}
@@ -86,11 +114,19 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 		dohPath:       dohRe,
 		listenerID:    listenerRe,
 		tlsServerName: tlsRe,
+		clientGroup:   clientGroup,
+		opcodes:       o,
+		transports:    tr,
+		minSize:       minSize,
+		maxSize:       maxSize,
 		resolver:      resolver,
 	}, nil
 }
 
 func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
+	if !r.matchOpcode(q.Opcode) {
+		return r.inverted
+	}
 	question := q.Question[0]
 	if !r.matchType(question.Qtype) {
 		return r.inverted
@@ -113,6 +149,18 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	if !r.tlsServerName.MatchString(ci.TLSServerName) {
 		return r.inverted
 	}
+	if r.clientGroup != "" && r.clientGroup != ci.ClientGroup() {
+		return r.inverted
+	}
+	if len(r.transports) > 0 && !slices.Contains(r.transports, ci.Transport) {
+		return r.inverted
+	}
+	if r.minSize > 0 || r.maxSize > 0 {
+		size := q.Len()
+		if size < r.minSize || (r.maxSize > 0 && size > r.maxSize) {
+			return r.inverted
+		}
+	}
 	if len(r.weekdays) > 0 || r.before != nil || r.after != nil {
 		now := time.Now().Local()
 		hour := now.Hour()
@@ -137,6 +185,10 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 			return r.inverted
 		}
 	}
+	// Checked last so only queries that match otherwise are counted
+	if r.rate != nil && !r.rate.exceeded(question.Name) {
+		return r.inverted
+	}
 	return !r.inverted
 }
 
@@ -144,6 +196,21 @@ func (r *route) Invert(value bool) {
 	r.inverted = value
 }
 
+// SetMinRate limits the route to names queried more than rate times per
+// second, measured over the window, across all clients. Queries are counted
+// if they match all other criteria of the route.
+func (r *route) SetMinRate(rate float64, window time.Duration) error {
+	if rate < 0 || window < 0 {
+		return errors.New("query rate and window can't be negative")
+	}
+	if rate == 0 {
+		r.rate = nil
+		return nil
+	}
+	r.rate = newNameRate(rate, window, nil)
+	return nil
+}
+
 func (r *route) String() string {
 	if r.isDefault() {
 		return "(default)"
@@ -156,6 +223,13 @@ func (r *route) String() string {
 		}
 		fragments = append(fragments, fmt.Sprintf("types=%v", types))
 	}
+	if len(r.opcodes) > 0 {
+		var opcodes []string
+		for _, o := range r.opcodes {
+			opcodes = append(opcodes, dns.OpcodeToString[o])
+		}
+		fragments = append(fragments, fmt.Sprintf("opcodes=%v", opcodes))
+	}
 	if r.name.String() != "" {
 		fragments = append(fragments, "name="+r.name.String())
 	}
@@ -175,6 +249,18 @@ func (r *route) String() string {
 	if r.tlsServerName.String() != "" {
 		fragments = append(fragments, "servername="+r.tlsServerName.String())
 	}
+	if len(r.transports) > 0 {
+		fragments = append(fragments, fmt.Sprintf("transports=%v", r.transports))
+	}
+	if r.minSize > 0 {
+		fragments = append(fragments, fmt.Sprintf("min-size=%d", r.minSize))
+	}
+	if r.maxSize > 0 {
+		fragments = append(fragments, fmt.Sprintf("max-size=%d", r.maxSize))
+	}
+	if r.rate != nil {
+		fragments = append(fragments, fmt.Sprintf("min-rate=%v", r.rate.limit))
+	}
 	if len(r.weekdays) > 0 {
 		fragments = append(fragments, fmt.Sprintf("weekdays=%v", r.weekdays))
 	}
@@ -191,7 +277,19 @@ func (r *route) String() string {
 }
 
 func (r *route) isDefault() bool {
-	return r.class == 0 && len(r.types) == 0 && r.name.String() == ""
+	return r.class == 0 && len(r.types) == 0 && len(r.opcodes) == 0 && r.name.String() == ""
+}
+
+func (r *route) matchOpcode(opcode int) bool {
+	if len(r.opcodes) == 0 {
+		return true
+	}
+	for _, o := range r.opcodes {
+		if o == opcode {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *route) matchType(typ uint16) bool {
@@ -225,6 +323,19 @@ loop:
 	return types, nil
 }
 
+// Convert DNS opcode strings into their numerical form, for example "NOTIFY" -> 4.
+func stringToOpcode(s []string) ([]int, error) {
+	var opcodes []int
+	for _, name := range s {
+		o, ok := dns.StringToOpcode[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode '%s'", name)
+		}
+		opcodes = append(opcodes, o)
+	}
+	return opcodes, nil
+}
+
 // Convert a DNS class string into its numerical form, for example "INET" -> 1.
 func stringToClass(s string) (uint16, error) {
 	switch strings.ToUpper(s) {
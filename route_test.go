@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -79,7 +80,7 @@ func TestRoute(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		r, err := NewRoute(test.rName, test.rClass, test.rType, nil, "", "", "", "", "", "", &TestResolver{})
+		r, err := NewRoute(test.rName, test.rClass, test.rType, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, &TestResolver{})
 		require.NoError(t, err)
 		r.Invert(test.rInvert)
 
@@ -91,3 +92,83 @@ func TestRoute(t *testing.T) {
 		require.Equal(t, test.match, match)
 	}
 }
+
+func TestRouteTransportSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT) // 29 bytes
+
+	tests := []struct {
+		transports       []string
+		minSize, maxSize int
+		ci               ClientInfo
+		match            bool
+	}{
+		{transports: []string{"udp"}, ci: ClientInfo{Transport: "udp"}, match: true},
+		{transports: []string{"UDP", "doh"}, ci: ClientInfo{Transport: "doh"}, match: true},
+		{transports: []string{"udp"}, ci: ClientInfo{Transport: "tcp"}, match: false},
+		{transports: []string{"udp"}, ci: ClientInfo{}, match: false},
+		{minSize: 29, match: true},
+		{minSize: 30, match: false},
+		{maxSize: 29, match: true},
+		{maxSize: 28, match: false},
+		{transports: []string{"tcp"}, minSize: 20, maxSize: 40, ci: ClientInfo{Transport: "tcp"}, match: true},
+	}
+	for _, test := range tests {
+		r, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, test.transports, test.minSize, test.maxSize, &TestResolver{})
+		require.NoError(t, err)
+		require.Equal(t, test.match, r.match(q, test.ci), "%+v", test)
+	}
+
+	_, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, []string{"smtp"}, 0, 0, &TestResolver{})
+	require.Error(t, err)
+	_, err = NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 100, 50, &TestResolver{})
+	require.Error(t, err)
+}
+
+func TestRouteClientGroup(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	r, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", "kids", nil, nil, 0, 0, &TestResolver{})
+	require.NoError(t, err)
+	require.True(t, r.match(q, ClientInfo{}.WithValue(clientGroupKey{}, "kids")))
+	require.False(t, r.match(q, ClientInfo{}.WithValue(clientGroupKey{}, "guests")))
+	require.False(t, r.match(q, ClientInfo{}))
+}
+
+func TestRouteMinRate(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	r, err := NewRoute("", "", []string{"A"}, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, &TestResolver{})
+	require.NoError(t, err)
+	require.NoError(t, r.SetMinRate(2, time.Second))
+	r.rate.clock = clock
+	r.rate.start = clock.Now()
+
+	query := func(name string, typ uint16) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		return r.match(q, ClientInfo{})
+	}
+
+	// Matches from the third query for the same name within a second
+	require.False(t, query("broken.example.com.", dns.TypeA))
+	require.False(t, query("Broken.example.com.", dns.TypeA))
+	require.True(t, query("broken.example.com.", dns.TypeA))
+	require.False(t, query("other.example.com.", dns.TypeA))
+
+	// Queries that don't match the other criteria aren't counted
+	require.False(t, query("other.example.com.", dns.TypeMX))
+	require.False(t, query("other.example.com.", dns.TypeMX))
+	require.False(t, query("other.example.com.", dns.TypeA))
+
+	// Queries of the previous second still count while they're in the
+	// sliding window
+	clock.Advance(1500 * time.Millisecond)
+	require.True(t, query("broken.example.com.", dns.TypeA))
+	clock.Advance(2 * time.Second)
+	require.False(t, query("broken.example.com.", dns.TypeA))
+
+	require.Error(t, r.SetMinRate(-1, 0))
+	require.NoError(t, r.SetMinRate(0, 0))
+	require.Nil(t, r.rate)
+}
@@ -2,36 +2,49 @@ package rdns
 
 import (
 	"errors"
-	"expvar"
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/miekg/dns"
 )
 
 // Router for DNS requests based on query type and/or name. Implements the Resolver interface.
+// Routes can be changed while the router is in use.
 type Router struct {
 	id      string
-	routes  []*route
 	metrics *RouterMetrics
+
+	// Routes are replaced rather than modified, so queries can keep using
+	// the ones they started with.
+	mu     sync.RWMutex
+	routes []*route
+}
+
+// RouteInfo describes a route of a router.
+type RouteInfo struct {
+	Index    int    `json:"index"`
+	Route    string `json:"route"`
+	Resolver string `json:"resolver"`
 }
 
 var _ Resolver = &Router{}
 
 type RouterMetrics struct {
 	// Next route counts.
-	route *expvar.Map
+	route *CounterMap
 	// Next route failure counts.
-	failure *expvar.Map
+	failure *CounterMap
 	// Count of available routes.
-	available *expvar.Int
+	available *Gauge
 }
 
 func NewRouterMetrics(id string, available int) *RouterMetrics {
-	avail := getVarInt("router", id, "available")
+	avail := getGauge("router", id, "available")
 	avail.Set(int64(available))
 	return &RouterMetrics{
-		route:     getVarMap("router", id, "route"),
-		failure:   getVarMap("router", id, "failure"),
+		route:     getCounterMap("router", id, "route", "resolver"),
+		failure:   getCounterMap("router", id, "failure", "resolver"),
 		available: avail,
 	}
 }
@@ -52,7 +65,10 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
-	for _, route := range r.routes {
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+	for _, route := range routes {
 		if !route.match(q, ci) {
 			continue
 		}
@@ -76,8 +92,81 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 // applied to the name in the first question section of the DNS message.
 // Source is an IP or network in CIDR format.
 func (r *Router) Add(routes ...*route) {
-	r.routes = append(r.routes, routes...)
-	r.metrics.available.Add(1)
+	r.update(func(current []*route) ([]*route, error) {
+		return slices.Concat(current, routes), nil
+	})
+}
+
+// Insert routes before the route at the index. The index can be the number
+// of routes to append them.
+func (r *Router) Insert(index int, routes ...*route) error {
+	return r.update(func(current []*route) ([]*route, error) {
+		if index < 0 || index > len(current) {
+			return nil, fmt.Errorf("route index %d out of range", index)
+		}
+		return slices.Insert(slices.Clone(current), index, routes...), nil
+	})
+}
+
+// Remove the route at the index.
+func (r *Router) Remove(index int) error {
+	return r.update(func(current []*route) ([]*route, error) {
+		if index < 0 || index >= len(current) {
+			return nil, fmt.Errorf("route index %d out of range", index)
+		}
+		return slices.Delete(slices.Clone(current), index, index+1), nil
+	})
+}
+
+// Move the route at index from to index to, shifting the routes in between.
+func (r *Router) Move(from, to int) error {
+	return r.update(func(current []*route) ([]*route, error) {
+		if from < 0 || from >= len(current) {
+			return nil, fmt.Errorf("route index %d out of range", from)
+		}
+		if to < 0 || to >= len(current) {
+			return nil, fmt.Errorf("route index %d out of range", to)
+		}
+		moved := current[from]
+		routes := slices.Delete(slices.Clone(current), from, from+1)
+		return slices.Insert(routes, to, moved), nil
+	})
+}
+
+// Replace all routes of the router.
+func (r *Router) Replace(routes ...*route) {
+	r.update(func([]*route) ([]*route, error) {
+		return slices.Clone(routes), nil
+	})
+}
+
+// Routes returns descriptions of the routes in the order they're evaluated.
+func (r *Router) Routes() []RouteInfo {
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+	info := make([]RouteInfo, 0, len(routes))
+	for i, route := range routes {
+		info = append(info, RouteInfo{
+			Index:    i,
+			Route:    route.String(),
+			Resolver: route.resolver.String(),
+		})
+	}
+	return info
+}
+
+// Applies a change to the routes. The current routes must not be modified.
+func (r *Router) update(f func(current []*route) ([]*route, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes, err := f(r.routes)
+	if err != nil {
+		return err
+	}
+	r.routes = routes
+	r.metrics.available.Set(int64(len(routes)))
+	return nil
 }
 
 func (r *Router) String() string {
@@ -1,7 +1,12 @@
 package rdns
 
 import (
+	"encoding/json"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -14,8 +19,8 @@ func TestRouterType(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
@@ -41,8 +46,8 @@ func TestRouterClass(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute("", "ANY", nil, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "ANY", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
@@ -69,8 +74,8 @@ func TestRouterName(t *testing.T) {
 	q := new(dns.Msg)
 	var ci ClientInfo
 
-	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute(`\.acme\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
@@ -96,8 +101,8 @@ func TestRouterSource(t *testing.T) {
 	q := new(dns.Msg)
 	q.SetQuestion("acme.test.", dns.TypeA)
 
-	route1, _ := NewRoute("", "", nil, nil, "", "", "192.168.1.100/32", "", "", "", r1)
-	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", r2)
+	route1, _ := NewRoute("", "", nil, nil, "", "", "192.168.1.100/32", "", "", "", "", nil, nil, 0, 0, r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
 
 	router := NewRouter("my-router")
 	router.Add(route1, route2)
@@ -114,3 +119,188 @@ func TestRouterSource(t *testing.T) {
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 }
+
+func TestRouterOpcode(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	var ci ClientInfo
+
+	route1, err := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", []string{"notify", "UPDATE"}, nil, 0, 0, r1)
+	require.NoError(t, err)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	// Standard query, should go to r2
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeSOA)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// NOTIFY should go to r1
+	q = new(dns.Msg)
+	q.SetNotify("example.com.")
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// UPDATE should go to r1
+	q = new(dns.Msg)
+	q.SetUpdate("example.com.")
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Unknown opcodes are rejected
+	_, err = NewRoute("", "", nil, nil, "", "", "", "", "", "", "", []string{"BLA"}, nil, 0, 0, r1)
+	require.Error(t, err)
+}
+
+func TestRouterChangeRoutes(t *testing.T) {
+	r1 := &TestResolver{}
+	r2 := &TestResolver{}
+	r3 := &TestResolver{}
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeMX)
+	var ci ClientInfo
+
+	route1, _ := NewRoute("", "", []string{"MX"}, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r1)
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r2)
+	route3, _ := NewRoute(`\.test\.$`, "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r3)
+
+	router := NewRouter("test-router-change")
+	router.Add(route1, route2)
+	require.Equal(t, int64(2), router.metrics.available.Value())
+
+	resolve := func(expected *TestResolver) {
+		t.Helper()
+		hits := expected.HitCount()
+		_, err := router.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, hits+1, expected.HitCount())
+	}
+	resolve(r1)
+
+	// Insert before the MX route
+	require.NoError(t, router.Insert(0, route3))
+	resolve(r3)
+	require.Equal(t, int64(3), router.metrics.available.Value())
+
+	// Move the MX route to the top
+	require.NoError(t, router.Move(1, 0))
+	resolve(r1)
+	require.Equal(t, []string{route1.String(), route3.String(), route2.String()}, routeStrings(router))
+
+	// Remove it
+	require.NoError(t, router.Remove(0))
+	resolve(r3)
+	require.Equal(t, int64(2), router.metrics.available.Value())
+
+	// Indexes out of range
+	require.Error(t, router.Insert(3, route1))
+	require.Error(t, router.Remove(2))
+	require.Error(t, router.Move(0, 2))
+	require.Error(t, router.Move(-1, 0))
+
+	router.Replace(route2)
+	resolve(r2)
+	require.Equal(t, []RouteInfo{{Index: 0, Route: "(default)", Resolver: r2.String()}}, router.Routes())
+}
+
+func TestRouterAdminAPI(t *testing.T) {
+	r1 := &TestResolver{}
+	r2 := &TestResolver{}
+	route, _ := NewRoute("", "", nil, nil, "", "", "", "", "", "", "", nil, nil, 0, 0, r1)
+	router := NewRouter("test-router-admin")
+	router.Add(route)
+
+	admin, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		ListenOptions: ListenOptions{AllowedNet: []*net.IPNet{{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}},
+		Routers:       map[string]*Router{"test-router-admin": router},
+		ChangeRoutes:  true,
+		RoutesToken:   "secret",
+		Resolvers:     map[string]Resolver{"r2": r2},
+	})
+	require.NoError(t, err)
+	postWith := func(admin *AdminListener, form url.Values, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/routedns/routes", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		admin.mux.ServeHTTP(w, req)
+		return w
+	}
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		return postWith(admin, form, http.Header{"Authorization": {"Bearer secret"}})
+	}
+
+	// Changes need the token and can't be posted from other websites
+	add := url.Values{"action": {"add"}, "resolver": {"r2"}}
+	require.Equal(t, http.StatusForbidden, postWith(admin, add, nil).Code)
+	require.Equal(t, http.StatusForbidden, postWith(admin, add, http.Header{
+		"Authorization": {"Bearer secret"},
+		"Origin":        {"https://evil.test"},
+	}).Code)
+	require.Len(t, router.Routes(), 1)
+
+	// Add a route for MX queries in front of the default one
+	w := post(url.Values{"action": {"add"}, "index": {"0"}, "types": {"MX"}, "resolver": {"r2"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	var routes []RouteInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&routes))
+	require.Len(t, routes, 2)
+	require.Equal(t, "(types=[MX])", routes[0].Route)
+
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeMX)
+	_, err = router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// Move it behind the default route, then remove it
+	require.Equal(t, http.StatusOK, post(url.Values{"action": {"move"}, "index": {"0"}, "to": {"1"}}).Code)
+	require.Equal(t, "(default)", router.Routes()[0].Route)
+	require.Equal(t, http.StatusOK, post(url.Values{"action": {"remove"}, "index": {"1"}}).Code)
+	require.Len(t, router.Routes(), 1)
+
+	// Invalid changes
+	require.Equal(t, http.StatusBadRequest, post(url.Values{"action": {"remove"}, "index": {"1"}}).Code)
+	require.Equal(t, http.StatusBadRequest, post(url.Values{"action": {"add"}, "resolver": {"unknown"}}).Code)
+	require.Equal(t, http.StatusBadRequest, post(url.Values{"action": {"delete"}}).Code)
+	require.Equal(t, http.StatusNotFound, post(url.Values{"id": {"unknown"}, "action": {"remove"}, "index": {"0"}}).Code)
+
+	// List the routes
+	w = httptest.NewRecorder()
+	admin.mux.ServeHTTP(w, httptest.NewRequest("GET", "/routedns/routes?id=test-router-admin", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&routes))
+	require.Equal(t, []RouteInfo{{Index: 0, Route: "(default)", Resolver: r1.String()}}, routes)
+
+	// Changes have to be enabled, and need an ACL or token
+	readOnly, err := NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Routers:   map[string]*Router{"test-router-admin": router},
+		Resolvers: map[string]Resolver{"r2": r2},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, postWith(readOnly, add, nil).Code)
+	require.Len(t, router.Routes(), 1)
+	_, err = NewAdminListener("test-admin", "127.0.0.1:0", AdminListenerOptions{
+		Routers:      map[string]*Router{"test-router-admin": router},
+		ChangeRoutes: true,
+	})
+	require.Error(t, err)
+}
+
+func routeStrings(r *Router) []string {
+	var s []string
+	for _, route := range r.Routes() {
+		s = append(s, route.Route)
+	}
+	return s
+}
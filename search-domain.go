@@ -0,0 +1,139 @@
+package rdns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SearchDomain retries queries that fail with NXDOMAIN with search domains
+// appended to the name, like the search list in resolv.conf does on clients.
+// This is useful for clients that send their queries directly to RouteDNS
+// without a search list of their own. Only queries for single-label names, or
+// names ending in one of the configured suffixes, are retried. The first
+// positive answer is returned with the original name, otherwise the original
+// NXDOMAIN response.
+type SearchDomain struct {
+	id       string
+	resolver Resolver
+	opt      SearchDomainOptions
+	metrics  *SearchDomainMetrics
+}
+
+// SearchDomainOptions contain settings for the search domain modifier.
+type SearchDomainOptions struct {
+	// Domains appended to names that don't exist, tried in order. Required.
+	Domains []string
+
+	// Names ending in one of these suffixes are retried with the search
+	// domains as well. By default only single-label names are retried.
+	Suffixes []string
+}
+
+type SearchDomainMetrics struct {
+	// Queries answered with a search domain appended, by domain.
+	found *CounterMap
+	// Queries retried with all search domains without positive answer.
+	notFound *Counter
+}
+
+var _ Resolver = &SearchDomain{}
+
+// NewSearchDomain returns a new instance of a search domain modifier.
+func NewSearchDomain(id string, resolver Resolver, opt SearchDomainOptions) (*SearchDomain, error) {
+	if len(opt.Domains) == 0 {
+		return nil, errors.New("no search domains defined")
+	}
+	normalize := func(names []string) []string {
+		var out []string
+		for _, name := range names {
+			name = strings.ToLower(dns.Fqdn(strings.TrimPrefix(name, ".")))
+			if name != "." {
+				out = append(out, name)
+			}
+		}
+		return out
+	}
+	opt.Domains = normalize(opt.Domains)
+	opt.Suffixes = normalize(opt.Suffixes)
+	return &SearchDomain{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &SearchDomainMetrics{
+			found:    getCounterMap("router", id, "found", "domain"),
+			notFound: getCounter("router", id, "notfound"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query. If the name doesn't exist, it's retried with the
+// search domains appended.
+func (r *SearchDomain) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != dns.RcodeNameError || len(q.Question) != 1 {
+		return a, err
+	}
+	name := q.Question[0].Name
+	if !r.applies(name) {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+	for _, domain := range r.opt.Domains {
+		newName := dns.Fqdn(name) + domain
+		if _, ok := dns.IsDomainName(newName); !ok {
+			continue
+		}
+		sq := q.Copy()
+		sq.Question[0].Name = newName
+		log.Debug("retrying query with search domain", "new-qname", newName)
+		sa, err := r.resolver.Resolve(sq, ci)
+		if err != nil {
+			log.Debug("failed to resolve with search domain", "new-qname", newName, "error", err)
+			continue
+		}
+		if sa == nil || sa.Rcode != dns.RcodeSuccess || len(sa.Answer) == 0 {
+			continue
+		}
+		r.metrics.found.Add(domain, 1)
+		return restoreName(q, sa, newName), nil
+	}
+	r.metrics.notFound.Add(1)
+	return a, nil
+}
+
+func (r *SearchDomain) String() string {
+	return r.id
+}
+
+// Returns true if queries for the name should be retried with the search
+// domains.
+func (r *SearchDomain) applies(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	if dns.CountLabel(name) == 1 {
+		return true
+	}
+	for _, suffix := range r.opt.Suffixes {
+		if dns.IsSubDomain(suffix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of a response to a query for a different name, with the
+// question and the answers for that name changed back to the name in the
+// original query. Records for other names, like CNAME targets, are left as
+// they are.
+func restoreName(q, a *dns.Msg, name string) *dns.Msg {
+	a = a.Copy()
+	a.Id = q.Id
+	a.Question = []dns.Question{q.Question[0]}
+	for _, rr := range a.Answer {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = q.Question[0].Name
+		}
+	}
+	return a
+}
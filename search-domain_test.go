@@ -0,0 +1,70 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchDomain(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch strings.ToLower(q.Question[0].Name) {
+			case "printer.lab.example.com.", "nas.corp.lab.example.com.":
+				a.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, 1},
+				}}
+			case "www.example.com.", "empty.corp.example.com.":
+			default:
+				a.Rcode = dns.RcodeNameError
+			}
+			return a, nil
+		},
+	}
+	r, err := NewSearchDomain("test-search", upstream, SearchDomainOptions{
+		Domains:  []string{"corp.example.com", ".lab.example.com."},
+		Suffixes: []string{"corp"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		rcode   int
+		answers int
+		queries int
+	}{
+		// Found in the second search domain, with the original name
+		{name: "Printer.", rcode: dns.RcodeSuccess, answers: 1, queries: 3},
+		// Configured suffix
+		{name: "nas.corp.", rcode: dns.RcodeSuccess, answers: 1, queries: 3},
+		// NODATA isn't a positive answer
+		{name: "empty.", rcode: dns.RcodeNameError, queries: 3},
+		// Existing names and names without matching suffix aren't retried
+		{name: "www.example.com.", rcode: dns.RcodeSuccess, queries: 1},
+		{name: "missing.example.com.", rcode: dns.RcodeNameError, queries: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits := upstream.HitCount()
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, dns.TypeA)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, test.rcode, a.Rcode)
+			require.Equal(t, test.queries, upstream.HitCount()-hits)
+			require.Len(t, a.Answer, test.answers)
+			require.Equal(t, test.name, a.Question[0].Name)
+			for _, rr := range a.Answer {
+				require.Equal(t, test.name, rr.Header().Name)
+			}
+		})
+	}
+	require.Equal(t, int64(2), r.metrics.found.Get("lab.example.com.").Value())
+	require.Equal(t, int64(1), r.metrics.notFound.Value())
+}
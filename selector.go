@@ -0,0 +1,119 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SelectStrategy defines how a Selector picks the resolver for a query.
+type SelectStrategy string
+
+const (
+	// Send the query to all resolvers and use the first successful response.
+	SelectAll SelectStrategy = "all"
+
+	// Pick a resolver based on a hash of the query name. Queries for the
+	// same name always go to the same resolver.
+	SelectHash SelectStrategy = "hash"
+
+	// Pick the resolver that is named for the listener the query was
+	// received on.
+	SelectRoute SelectStrategy = "route"
+
+	// Pick a resolver based on the subnet of the client, taken from the ECS
+	// option if present. Queries from the same subnet always go to the
+	// same resolver.
+	SelectSubnet SelectStrategy = "subnet"
+)
+
+// Selector allows modifiers to wrap more than one resolver. It forwards each
+// query to one or all of its resolvers depending on the strategy. Unlike
+// the failover groups, it doesn't retry failed queries on another resolver.
+type Selector struct {
+	id        string
+	resolvers []Resolver
+	opt       SelectorOptions
+	all       *Fastest
+	metrics   *RouterMetrics
+}
+
+// SelectorOptions contain settings for a Selector.
+type SelectorOptions struct {
+	Strategy SelectStrategy
+
+	// Resolvers by listener ID, used with SelectRoute. Queries from
+	// listeners not in the map are sent to the first resolver.
+	Routes map[string]Resolver
+
+	// Prefix lengths of client subnets used with SelectSubnet. Default
+	// to DefaultSubnetPrefix4 and DefaultSubnetPrefix6.
+	SubnetPrefix4 uint8
+	SubnetPrefix6 uint8
+}
+
+var _ Resolver = &Selector{}
+
+// NewSelector returns a new instance of a resolver selector.
+func NewSelector(id string, opt SelectorOptions, resolvers ...Resolver) (*Selector, error) {
+	if len(resolvers) == 0 {
+		return nil, errors.New("no resolvers defined for selector")
+	}
+	switch opt.Strategy {
+	case SelectAll, SelectHash, SelectRoute, SelectSubnet:
+	default:
+		return nil, fmt.Errorf("unsupported select strategy %q", opt.Strategy)
+	}
+	if opt.SubnetPrefix4 == 0 {
+		opt.SubnetPrefix4 = DefaultSubnetPrefix4
+	}
+	if opt.SubnetPrefix6 == 0 {
+		opt.SubnetPrefix6 = DefaultSubnetPrefix6
+	}
+	return &Selector{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+		all:       NewFastest(id, resolvers...),
+		metrics:   NewRouterMetrics(id, len(resolvers)),
+	}, nil
+}
+
+// Resolve a DNS query using the resolver picked by the strategy.
+func (r *Selector) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.opt.Strategy == SelectAll {
+		return r.all.Resolve(q, ci)
+	}
+	resolver := r.pick(q, ci)
+	logger(r.id, q, ci).With("resolver", resolver.String()).Debug("forwarding query to resolver")
+	r.metrics.route.Add(resolver.String(), 1)
+	a, err := resolver.Resolve(q, ci)
+	if err != nil {
+		r.metrics.failure.Add(resolver.String(), 1)
+	}
+	return a, err
+}
+
+func (r *Selector) String() string {
+	return r.id
+}
+
+// Returns the resolver for a query, for strategies that use only one.
+func (r *Selector) pick(q *dns.Msg, ci ClientInfo) Resolver {
+	switch r.opt.Strategy {
+	case SelectHash:
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(qName(q))))
+		return r.resolvers[h.Sum32()%uint32(len(r.resolvers))]
+	case SelectRoute:
+		if resolver, ok := r.opt.Routes[ci.Listener]; ok {
+			return resolver
+		}
+	case SelectSubnet:
+		return pickBySubnet(clientSubnet(q, ci, r.opt.SubnetPrefix4, r.opt.SubnetPrefix6), r.resolvers)
+	}
+	return r.resolvers[0]
+}
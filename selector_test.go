@@ -0,0 +1,125 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorHash(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	s, err := NewSelector("test-select", SelectorOptions{Strategy: SelectHash}, r1, r2)
+	require.NoError(t, err)
+
+	// Queries for the same name should always go to the same resolver
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		_, err = s.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 10, r1.HitCount()+r2.HitCount())
+	require.True(t, r1.HitCount() == 0 || r2.HitCount() == 0)
+}
+
+func TestSelectorRoute(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	s, err := NewSelector("test-select", SelectorOptions{
+		Strategy: SelectRoute,
+		Routes:   map[string]Resolver{"listener-2": r2},
+	}, r1, r2)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Query from a listener with a route
+	_, err = s.Resolve(q, ClientInfo{Listener: "listener-2"})
+	require.NoError(t, err)
+	require.Equal(t, 0, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// Queries from other listeners go to the first resolver
+	_, err = s.Resolve(q, ClientInfo{Listener: "listener-1"})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
+
+func TestSelectorInvalidStrategy(t *testing.T) {
+	_, err := NewSelector("test-select", SelectorOptions{Strategy: "invalid"}, new(TestResolver))
+	require.Error(t, err)
+}
+
+// Test resolver with its own name, resolvers are identified by name when
+// picked by subnet.
+type namedTestResolver struct {
+	*TestResolver
+	name string
+}
+
+func (r namedTestResolver) String() string {
+	return r.name
+}
+
+func TestSelectorSubnet(t *testing.T) {
+	var resolvers []Resolver
+	var upstreams []*TestResolver
+	for i := 0; i < 4; i++ {
+		upstream := new(TestResolver)
+		upstreams = append(upstreams, upstream)
+		resolvers = append(resolvers, namedTestResolver{upstream, fmt.Sprintf("upstream-%d", i)})
+	}
+	s, err := NewSelector("test-select-subnet", SelectorOptions{Strategy: SelectSubnet}, resolvers...)
+	require.NoError(t, err)
+
+	// Returns the index of the resolver that received the query
+	resolvedBy := func(q *dns.Msg, ci ClientInfo) int {
+		var before []int
+		for _, u := range upstreams {
+			before = append(before, u.HitCount())
+		}
+		_, err := s.Resolve(q, ci)
+		require.NoError(t, err)
+		for i, u := range upstreams {
+			if u.HitCount() != before[i] {
+				return i
+			}
+		}
+		return -1
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Clients in the same /24 go to the same resolver
+	picked := resolvedBy(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.Equal(t, picked, resolvedBy(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.200")}))
+
+	// The ECS subnet takes precedence over the client IP
+	ecs := q.Copy()
+	ecs.SetEdns0(4096, false)
+	ecs.IsEdns0().Option = append(ecs.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.0.2.0").To4(),
+	})
+	require.Equal(t, picked, resolvedBy(ecs, ClientInfo{SourceIP: net.ParseIP("198.51.100.1")}))
+
+	// Many subnets are distributed across all resolvers
+	for i := 0; i < 256; i++ {
+		_, err = s.Resolve(q, ClientInfo{SourceIP: net.IPv4(10, byte(i), 0, 1)})
+		require.NoError(t, err)
+	}
+	for _, u := range upstreams {
+		require.Greater(t, u.HitCount(), 20)
+	}
+}
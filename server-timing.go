@@ -0,0 +1,112 @@
+package rdns
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0TimingCode is the EDNS0 option code clients add to a query to get a
+// breakdown of the time spent resolving it. The response contains an option
+// with the same code holding the timings in the format of the HTTP
+// Server-Timing header. Only used by listeners with ServerTiming enabled.
+const EDNS0TimingCode = 65002
+
+// Time spent in one step of resolving a query, like a cache lookup.
+type queryTiming struct {
+	name     string // Type of step, cache, blocklist or upstream
+	id       string // ID of the element
+	duration time.Duration
+}
+
+// Timings of a query, collected by the elements the query passes through.
+type queryTimings struct {
+	start  time.Time
+	option bool // Return the timings in an EDNS0 option
+
+	mu      sync.Mutex
+	entries []queryTiming
+}
+
+type queryTimingsKey struct{}
+
+// Records the time spent in a step of resolving a query since start, if the
+// listener collects timings for it.
+func recordTiming(ci ClientInfo, name, id string, start time.Time) {
+	t, ok := ci.Value(queryTimingsKey{}).(*queryTimings)
+	if !ok {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	t.entries = append(t.entries, queryTiming{name: name, id: id, duration: d})
+	t.mu.Unlock()
+}
+
+// Starts collecting timings for a query if enabled and asked for by the
+// client with the EDNS0 option, or always if force is set. The option is
+// removed from the query.
+func (opt ListenOptions) startTiming(q *dns.Msg, ci ClientInfo, force bool) (*dns.Msg, ClientInfo, *queryTimings) {
+	if !opt.ServerTiming {
+		return q, ci, nil
+	}
+	var requested bool
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		requested = slices.ContainsFunc(edns0.Option, isTimingOption)
+		if requested {
+			q = q.Copy()
+			edns0 = q.IsEdns0()
+			edns0.Option = slices.DeleteFunc(edns0.Option, isTimingOption)
+		}
+	}
+	if !requested && !force {
+		return q, ci, nil
+	}
+	t := &queryTimings{start: time.Now(), option: requested}
+	return q, ci.WithValue(queryTimingsKey{}, t), t
+}
+
+// Finishes collecting timings and adds them to the response if the client
+// asked for them with the EDNS0 option. Returns the timings in the format of
+// the Server-Timing header.
+func (t *queryTimings) finish(q, a *dns.Msg) string {
+	if t == nil {
+		return ""
+	}
+	total := time.Since(t.start)
+	t.mu.Lock()
+	entries := append(slices.Clone(t.entries), queryTiming{name: "total", duration: total})
+	t.mu.Unlock()
+
+	metrics := make([]string, 0, len(entries))
+	for _, e := range entries {
+		m := fmt.Sprintf("%s;dur=%.3f", e.name, float64(e.duration.Microseconds())/1000)
+		if e.id != "" {
+			m += fmt.Sprintf(";desc=%q", e.id)
+		}
+		metrics = append(metrics, m)
+	}
+	header := strings.Join(metrics, ", ")
+
+	if t.option && a != nil {
+		edns0 := a.IsEdns0()
+		if edns0 == nil {
+			size := uint16(dns.MinMsgSize)
+			if qEdns0 := q.IsEdns0(); qEdns0 != nil {
+				size = qEdns0.UDPSize()
+			}
+			a.SetEdns0(size, false)
+			edns0 = a.IsEdns0()
+		}
+		edns0.Option = append(edns0.Option, &dns.EDNS0_LOCAL{Code: EDNS0TimingCode, Data: []byte(header)})
+	}
+	return header
+}
+
+func isTimingOption(o dns.EDNS0) bool {
+	return o.Option() == EDNS0TimingCode
+}
@@ -0,0 +1,66 @@
+package rdns
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTiming(t *testing.T) {
+	cache := NewCache("test-server-timing-cache", fuzzResolver(), CacheOptions{})
+	opt := ListenOptions{ServerTiming: true}
+	handler := listenHandler("test-server-timing", "udp", "127.0.0.1:53", cache, opt)
+
+	query := func(timing bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		if timing {
+			q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS0TimingCode})
+		}
+		w := new(fuzzResponseWriter)
+		handler(w, q)
+		require.NotNil(t, w.msg)
+		return w.msg
+	}
+	timingOption := func(a *dns.Msg) string {
+		if a.IsEdns0() == nil {
+			return ""
+		}
+		for _, o := range a.IsEdns0().Option {
+			if o.Option() == EDNS0TimingCode {
+				return string(o.(*dns.EDNS0_LOCAL).Data)
+			}
+		}
+		return ""
+	}
+
+	// Only returned if asked for
+	require.Empty(t, timingOption(query(false)))
+	timings := timingOption(query(true))
+	require.Contains(t, timings, `cache;dur=`)
+	require.Contains(t, timings, `desc="test-server-timing-cache"`)
+	require.True(t, strings.HasPrefix(strings.Split(timings, ", ")[1], "total;dur="))
+
+	// DoH listeners return the timings of every query in a header
+	s, err := NewDoHListener("test-server-timing-doh", "127.0.0.1:0", DoHListenerOptions{ListenOptions: opt}, cache)
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+	req.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+	w := httptest.NewRecorder()
+	s.dohHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Server-Timing"), "total;dur=")
+	a := new(dns.Msg)
+	require.NoError(t, a.Unpack(w.Body.Bytes()))
+	require.Nil(t, a.IsEdns0())
+}
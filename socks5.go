@@ -2,6 +2,8 @@ package rdns
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net"
 	"sync"
 	"time"
@@ -29,6 +31,11 @@ type Socks5DialerOptions struct {
 	// name will be resolved either on the local system, or via the bootstrap-resolver
 	// if one is setup.
 	ResolveLocal bool
+
+	// Use random credentials for every connection to the proxy. Tor uses a separate
+	// circuit for connections with different credentials (IsolateSOCKSAuth), so
+	// connections can't be linked to each other by the exit node.
+	IsolateStreams bool
 }
 
 var _ Dialer = (*Socks5Dialer)(nil)
@@ -85,8 +92,25 @@ func (d *Socks5Dialer) Dial(network string, address string) (net.Conn, error) {
 
 	})
 
+	client := d.Client
+	if d.opt.IsolateStreams {
+		var err error
+		if client, err = d.isolatedClient(); err != nil {
+			return nil, err
+		}
+	}
 	if d.opt.LocalAddr != nil {
-		return d.Client.DialWithLocalAddr(network, d.opt.LocalAddr.String(), d.addr, nil)
+		return client.DialWithLocalAddr(network, d.opt.LocalAddr.String(), d.addr, nil)
+	}
+	return client.Dial(network, d.addr)
+}
+
+// Returns a client with random credentials for stream isolation.
+func (d *Socks5Dialer) isolatedClient() (*socks5.Client, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
 	}
-	return d.Client.Dial(network, d.addr)
+	creds := hex.EncodeToString(b)
+	return socks5.NewClient(d.Client.Server, creds[:16], creds[16:], d.Client.TCPTimeout, d.Client.UDPTimeout)
 }
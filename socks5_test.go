@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/txthinking/socks5"
+)
+
+func TestSocks5DialerIsolatedClient(t *testing.T) {
+	d := NewSocks5Dialer("127.0.0.1:9050", Socks5DialerOptions{IsolateStreams: true})
+
+	// Every client should use different credentials
+	c1, err := d.isolatedClient()
+	require.NoError(t, err)
+	c2, err := d.isolatedClient()
+	require.NoError(t, err)
+	require.NotEmpty(t, c1.UserName)
+	require.NotEqual(t, c1.UserName, c2.UserName)
+	require.NotEqual(t, c1.Password, c2.Password)
+	require.Equal(t, "127.0.0.1:9050", c1.Server)
+}
+
+func TestSocks5DialerQUIC(t *testing.T) {
+	upstream := new(TestResolver)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	dohAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	doh, err := NewDoHListener("test-doh-quic", dohAddr, DoHListenerOptions{TLSConfig: tlsServerConfig, Transport: "quic"}, upstream)
+	require.NoError(t, err)
+	go doh.Start()
+	defer doh.Stop()
+	doqAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	doq := NewQUICListener("test-doq", doqAddr, DoQListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go doq.Start()
+
+	// SOCKS5 proxy that counts the relayed packets
+	proxyAddr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	proxy, err := socks5.NewClassicServer(proxyAddr, "127.0.0.1", "", "", 0, 60)
+	require.NoError(t, err)
+	handler := &countingSocks5Handler{}
+	go proxy.ListenAndServe(handler)
+	defer proxy.Shutdown()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "", "")
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// DoH over QUIC
+	dialer := NewSocks5Dialer(proxyAddr, Socks5DialerOptions{UDPTimeout: 5 * time.Second})
+	c, err := NewDoHClient("test-doh-socks5", "https://"+dohAddr+"/dns-query", DoHClientOptions{TLSConfig: tlsConfig, Transport: "quic", Dialer: dialer})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	relayed := handler.packets.Load()
+	require.NotZero(t, relayed)
+
+	// DoQ, the connection stays open after the UDP timeout of the dialer
+	dialer = NewSocks5Dialer(proxyAddr, Socks5DialerOptions{UDPTimeout: time.Second})
+	d, err := NewDoQClient("test-doq-socks5", doqAddr, DoQClientOptions{TLSConfig: tlsConfig, Dialer: dialer})
+	require.NoError(t, err)
+	_, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	_, err = d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 3, upstream.HitCount())
+	require.Greater(t, handler.packets.Load(), relayed)
+}
+
+type countingSocks5Handler struct {
+	socks5.DefaultHandle
+	packets atomic.Int64
+}
+
+func (h *countingSocks5Handler) UDPHandle(s *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
+	h.packets.Add(1)
+	return h.DefaultHandle.UDPHandle(s, addr, d)
+}
@@ -0,0 +1,198 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SpecialUse is a resolver that answers queries for special-use domains
+// (RFC6761) and locally-served zones (RFC6303) itself rather than forwarding
+// them upstream where they can't be answered and would leak information about
+// the local network. All other queries are passed through.
+type SpecialUse struct {
+	id       string
+	resolver Resolver
+	zones    map[string]SpecialUseAction
+	metrics  *SpecialUseMetrics
+}
+
+// SpecialUseAction defines how queries for a special-use zone are handled.
+type SpecialUseAction string
+
+const (
+	// Respond with NXDOMAIN.
+	SpecialUseNXDOMAIN SpecialUseAction = "nxdomain"
+
+	// Respond with REFUSED.
+	SpecialUseRefused SpecialUseAction = "refused"
+
+	// Respond to A and AAAA queries with the loopback address, NODATA
+	// for other types.
+	SpecialUseLoopback SpecialUseAction = "loopback"
+
+	// Forward queries to the resolver, like any other query.
+	SpecialUseForward SpecialUseAction = "forward"
+)
+
+// DefaultSpecialUseZones contains the zones handled by default and how.
+var DefaultSpecialUseZones = map[string]SpecialUseAction{
+	// RFC6761
+	"localhost.": SpecialUseLoopback,
+	"invalid.":   SpecialUseNXDOMAIN,
+
+	// RFC7686
+	"onion.": SpecialUseNXDOMAIN,
+
+	// RFC6762, multicast DNS names and link-local reverse zone
+	"local.":                SpecialUseNXDOMAIN,
+	"254.169.in-addr.arpa.": SpecialUseNXDOMAIN,
+
+	// RFC8375
+	"home.arpa.": SpecialUseNXDOMAIN,
+
+	// RFC6303, reverse zones of private and link-local addresses
+	"10.in-addr.arpa.":      SpecialUseNXDOMAIN,
+	"16.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"17.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"18.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"19.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"20.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"21.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"22.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"23.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"24.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"25.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"26.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"27.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"28.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"29.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"30.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"31.172.in-addr.arpa.":  SpecialUseNXDOMAIN,
+	"168.192.in-addr.arpa.": SpecialUseNXDOMAIN,
+	"d.f.ip6.arpa.":         SpecialUseNXDOMAIN,
+	"8.e.f.ip6.arpa.":       SpecialUseNXDOMAIN,
+	"9.e.f.ip6.arpa.":       SpecialUseNXDOMAIN,
+	"a.e.f.ip6.arpa.":       SpecialUseNXDOMAIN,
+	"b.e.f.ip6.arpa.":       SpecialUseNXDOMAIN,
+}
+
+// SpecialUseOptions contain settings for the special-use domain resolver.
+type SpecialUseOptions struct {
+	// Zones with a different action than the default, or additional zones.
+	// For example, home.arpa can be set to SpecialUseForward if the upstream
+	// resolver is a home router that serves the zone.
+	Overrides map[string]SpecialUseAction
+}
+
+type SpecialUseMetrics struct {
+	// Queries answered locally, by zone.
+	local *CounterMap
+	// Queries passed through to the resolver.
+	forwarded *Counter
+}
+
+// TTL of records in locally generated responses.
+const specialUseTTL = 300
+
+var _ Resolver = &SpecialUse{}
+
+// NewSpecialUse returns a new instance of a special-use domain resolver.
+func NewSpecialUse(id string, resolver Resolver, opt SpecialUseOptions) (*SpecialUse, error) {
+	zones := make(map[string]SpecialUseAction)
+	for zone, action := range DefaultSpecialUseZones {
+		zones[zone] = action
+	}
+	for zone, action := range opt.Overrides {
+		switch action {
+		case SpecialUseNXDOMAIN, SpecialUseRefused, SpecialUseLoopback, SpecialUseForward:
+		default:
+			return nil, fmt.Errorf("unsupported action %q for zone %q", action, zone)
+		}
+		zones[dns.Fqdn(strings.ToLower(zone))] = action
+	}
+	return &SpecialUse{
+		id:       id,
+		resolver: resolver,
+		zones:    zones,
+		metrics: &SpecialUseMetrics{
+			local:     getCounterMap("router", id, "special-use-local", "zone"),
+			forwarded: getCounter("router", id, "forwarded"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query. Queries for special-use zones are answered according
+// to the action of the zone, all others are forwarded.
+func (r *SpecialUse) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	zone, action := r.match(q.Question[0].Name)
+	if action == "" || action == SpecialUseForward {
+		r.metrics.forwarded.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	log.Debug("answering query for special-use domain", "zone", zone, "action", action)
+	r.metrics.local.Add(zone, 1)
+
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	a.RecursionAvailable = q.RecursionDesired
+	question := q.Question[0]
+	switch action {
+	case SpecialUseRefused:
+		a.Rcode = dns.RcodeRefused
+		return a, nil
+	case SpecialUseNXDOMAIN:
+		a.Rcode = dns.RcodeNameError
+	case SpecialUseLoopback:
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: specialUseTTL}
+		switch question.Qtype {
+		case dns.TypeA:
+			a.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+			return a, nil
+		case dns.TypeAAAA:
+			a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+			return a, nil
+		}
+	}
+
+	// NXDOMAIN or NODATA, add an SOA so the response can be cached
+	a.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: specialUseTTL},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  specialUseTTL,
+	}}
+	return a, nil
+}
+
+func (r *SpecialUse) String() string {
+	return r.id
+}
+
+// Returns the most specific zone the name is in and its action. Returns an
+// empty action if the name isn't in any of the zones.
+func (r *SpecialUse) match(name string) (string, SpecialUseAction) {
+	name = dns.Fqdn(strings.ToLower(name))
+	for off := 0; ; {
+		if action, ok := r.zones[name[off:]]; ok {
+			return name[off:], action
+		}
+		next, end := dns.NextLabel(name, off)
+		if end {
+			return "", ""
+		}
+		off = next
+	}
+}
@@ -0,0 +1,60 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecialUse(t *testing.T) {
+	upstream := new(TestResolver)
+	r, err := NewSpecialUse("test-special", upstream, SpecialUseOptions{
+		Overrides: map[string]SpecialUseAction{
+			"home.arpa":       SpecialUseForward,
+			"test.home.arpa.": SpecialUseRefused,
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		rcode     int
+		answers   int
+		forwarded bool
+	}{
+		{name: "localhost.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "www.LocalHost.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "localhost.", qtype: dns.TypeMX, rcode: dns.RcodeSuccess, answers: 0},
+		{name: "something.invalid.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "1.0.168.192.in-addr.arpa.", qtype: dns.TypePTR, rcode: dns.RcodeNameError},
+		{name: "1.0.0.172.in-addr.arpa.", qtype: dns.TypePTR, forwarded: true},
+		{name: "router.home.arpa.", qtype: dns.TypeA, forwarded: true},
+		{name: "a.test.home.arpa.", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{name: "example.com.", qtype: dns.TypeA, forwarded: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits := upstream.HitCount()
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, test.qtype)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			if test.forwarded {
+				require.Equal(t, hits+1, upstream.HitCount())
+				return
+			}
+			require.Equal(t, hits, upstream.HitCount())
+			require.Equal(t, test.rcode, a.Rcode)
+			require.Len(t, a.Answer, test.answers)
+		})
+	}
+}
+
+func TestSpecialUseInvalidAction(t *testing.T) {
+	_, err := NewSpecialUse("test-special", new(TestResolver), SpecialUseOptions{
+		Overrides: map[string]SpecialUseAction{"home.arpa.": "bla"},
+	})
+	require.Error(t, err)
+}
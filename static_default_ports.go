@@ -13,6 +13,7 @@ var (
 	DTLSPort     string = DoTPort
 	DoHPort      string = "443"
 	PlainDNSPort        = "53"
+	MDNSPort            = "5353"
 )
 
 // AddressWithDefault takes an endpoint or a URL and adds a port unless it
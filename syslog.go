@@ -37,6 +37,9 @@ type SyslogOptions struct {
 
 	// Log all response records, including those that do not match the query type
 	Verbose bool
+
+	// Optional, redact names and clients in the log.
+	Redaction *LogRedaction
 }
 
 // NewSyslog returns a new instance of a Syslog generator.
@@ -57,9 +60,13 @@ func NewSyslog(id string, resolver Resolver, opt SyslogOptions) *Syslog {
 
 // Resolve passes a DNS query through unmodified. Query details are sent via syslog.
 func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if r.opt.Redaction.Skip(q) {
+		return r.resolver.Resolve(q, ci)
+	}
 	var msg string
+	name := r.opt.Redaction.Name(qName(q))
 	if r.opt.LogRequest {
-		msg = fmt.Sprintf("id=%s qid=%d type=query client=%s qtype=%s qname=%s", r.id, q.Id, ci.SourceIP.String(), qType(q), qName(q))
+		msg = fmt.Sprintf("id=%s qid=%d type=query client=%s qtype=%s qname=%s", r.id, q.Id, r.opt.Redaction.Client(ci.SourceIP), qType(q), name)
 		if _, err := r.writer.Write([]byte(msg)); err != nil {
 			logger(r.id, q, ci).Error("failed to send syslog",
 				"error", err)
@@ -82,8 +89,8 @@ func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			}
 
 			for i, rr := range answerRRs {
-				s := strings.ReplaceAll(rr.String(), "\t", " ")
-				msg = fmt.Sprintf("id=%s qid=%d type=answer answer-num=%d/%d qtype=%s qname=%s answer=%q", r.id, q.Id, i+1, len(answerRRs), qType(q), qName(q), s)
+				s := strings.ReplaceAll(r.opt.Redaction.RR(rr).String(), "\t", " ")
+				msg = fmt.Sprintf("id=%s qid=%d type=answer answer-num=%d/%d qtype=%s qname=%s answer=%q", r.id, q.Id, i+1, len(answerRRs), qType(q), name, s)
 				if _, err := r.writer.Write([]byte(msg)); err != nil {
 					logger(r.id, q, ci).Error("failed to send syslog",
 						"error", err)
@@ -91,14 +98,14 @@ func (r *Syslog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			}
 			// Synthesize a NODATA rcode when the response is NOERROR without any response records
 			if len(answerRRs) == 0 {
-				msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=NODATA", r.id, q.Id, qType(q), qName(q))
+				msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=NODATA", r.id, q.Id, qType(q), name)
 				if _, err := r.writer.Write([]byte(msg)); err != nil {
 					logger(r.id, q, ci).Error("failed to send syslog",
 						"error", err)
 				}
 			}
 		} else {
-			msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=%s", r.id, q.Id, qType(q), qName(q), dns.RcodeToString[a.Rcode])
+			msg = fmt.Sprintf("id=%s qid=%d type=answer qtype=%s qname=%s rcode=%s", r.id, q.Id, qType(q), name, dns.RcodeToString[a.Rcode])
 			if _, err := r.writer.Write([]byte(msg)); err != nil {
 				logger(r.id, q, ci).Error("failed to send syslog",
 					"error", err)
@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCPOptions are socket options for TCP connections of listeners and clients.
+// Options that aren't supported by the OS are skipped with a warning.
+type TCPOptions struct {
+	// Enable TCP Fast Open, sending data in the SYN packet to save a round
+	// trip when connecting.
+	FastOpen bool
+
+	// Interval of keepalive probes on idle connections. Uses the OS default
+	// if 0 and disables keepalive probes if negative.
+	KeepAlive time.Duration
+
+	// Maximum time sent data may remain unacknowledged before the connection
+	// is closed. Uses the OS default if 0.
+	UserTimeout time.Duration
+}
+
+// Length of the queue of pending TCP Fast Open connections of listeners.
+const tcpFastOpenQueueLen = 256
+
+// Returns a function that sets the socket options on new sockets. Failing to
+// set them is logged but doesn't fail the connection.
+func (o TCPOptions) control(listen bool) func(network, address string, c syscall.RawConn) error {
+	if !o.FastOpen && o.UserTimeout == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setTCPSockopts(fd, o, listen)
+		}); cerr != nil {
+			err = cerr
+		}
+		if err != nil {
+			Log.Warn("unable to set tcp socket options", "addr", address, "error", err)
+		}
+		return nil
+	}
+}
+
+// Returns a TCP listener with the socket options set.
+func (o TCPOptions) listen(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: o.KeepAlive,
+		Control:   o.control(true),
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// Returns a copy of the dialer that sets the socket options on connections.
+func (o TCPOptions) dialer(d *net.Dialer) *net.Dialer {
+	c := *d
+	if o.KeepAlive != 0 {
+		c.KeepAlive = o.KeepAlive
+	}
+	if control := o.control(false); control != nil {
+		prev := c.Control
+		c.Control = func(network, address string, rc syscall.RawConn) error {
+			if prev != nil {
+				if err := prev(network, address, rc); err != nil {
+					return err
+				}
+			}
+			return control(network, address, rc)
+		}
+	}
+	return &c
+}
@@ -0,0 +1,32 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the TCP Fast Open and user timeout options on a socket.
+func setTCPSockopts(fd uintptr, opt TCPOptions, listen bool) error {
+	var errs []error
+	if opt.FastOpen {
+		// Listeners accept data in SYN packets while clients send data
+		// with the SYN once the connection is used
+		if listen {
+			if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tcpFastOpenQueueLen); err != nil {
+				errs = append(errs, fmt.Errorf("tcp fast open: %w", err))
+			}
+		} else {
+			if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+				errs = append(errs, fmt.Errorf("tcp fast open: %w", err))
+			}
+		}
+	}
+	if opt.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(opt.UserTimeout.Milliseconds())); err != nil {
+			errs = append(errs, fmt.Errorf("tcp user timeout: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
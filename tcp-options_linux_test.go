@@ -0,0 +1,70 @@
+package rdns
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPOptionsDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	opt := TCPOptions{
+		FastOpen:    true,
+		KeepAlive:   10 * time.Second,
+		UserTimeout: 5 * time.Second,
+	}
+	d := opt.dialer(&net.Dialer{})
+	require.Equal(t, 10*time.Second, d.KeepAlive)
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The user timeout is set on the socket in milliseconds
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var (
+		userTimeout int
+		sockErr     error
+	)
+	err = rc.Control(func(fd uintptr) {
+		userTimeout, sockErr = syscall.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+	})
+	require.NoError(t, err)
+	require.NoError(t, sockErr)
+	require.Equal(t, 5000, userTimeout)
+}
+
+func TestTCPOptionsListener(t *testing.T) {
+	upstream := new(TestResolver)
+	opt := TCPOptions{
+		FastOpen:    true,
+		KeepAlive:   10 * time.Second,
+		UserTimeout: 5 * time.Second,
+	}
+
+	// Find a free port for the listener
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	s := NewDNSListener("test-ln", addr, "tcp", ListenOptions{TCP: opt}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	// Query the listener with a client using the same options
+	c, err := NewDNSClient("test-tcp", addr, "tcp", DNSClientOptions{TCP: opt})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rdns
+
+import "errors"
+
+// TCP Fast Open and user timeouts are only supported on Linux.
+func setTCPSockopts(fd uintptr, opt TCPOptions, listen bool) error {
+	return errors.New("tcp fast open and user timeout are not supported on this platform")
+}
@@ -0,0 +1,55 @@
+package rdns
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+)
+
+// Number of sessions held by each shared TLS session cache.
+const sharedSessionCacheSize = 1000
+
+// Process-wide registry of TLS session caches and HTTP transports that can be
+// used by more than one resolver.
+var shared = struct {
+	mu            sync.Mutex
+	sessionCaches map[string]tls.ClientSessionCache
+	transports    map[string]http.RoundTripper
+}{
+	sessionCaches: make(map[string]tls.ClientSessionCache),
+	transports:    make(map[string]http.RoundTripper),
+}
+
+// SharedTLSSessionCache returns the TLS client session cache for a key. All
+// callers using the same key get the same cache, which allows resolvers with
+// identical TLS settings to resume sessions established by each other rather
+// than each performing a full handshake. The key should identify the TLS
+// parameters, such as CA, client certificate and server name. Sessions are
+// stored by server name within a cache so different servers can use the same
+// key.
+func SharedTLSSessionCache(key string) tls.ClientSessionCache {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	c, ok := shared.sessionCaches[key]
+	if !ok {
+		c = tls.NewLRUClientSessionCache(sharedSessionCacheSize)
+		shared.sessionCaches[key] = c
+	}
+	return c
+}
+
+// Returns the HTTP transport for a key, or creates one with newTransport if
+// there isn't one yet.
+func sharedTransport(key string, newTransport func() (http.RoundTripper, error)) (http.RoundTripper, error) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if tr, ok := shared.transports[key]; ok {
+		return tr, nil
+	}
+	tr, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	shared.transports[key] = tr
+	return tr, nil
+}
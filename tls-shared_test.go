@@ -0,0 +1,15 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedTLSSessionCache(t *testing.T) {
+	c1 := SharedTLSSessionCache("a")
+	c2 := SharedTLSSessionCache("a")
+	c3 := SharedTLSSessionCache("b")
+	require.Same(t, c1, c2)
+	require.NotSame(t, c1, c3)
+}
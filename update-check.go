@@ -0,0 +1,230 @@
+package rdns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUpdateCheckURL returns the latest release of RouteDNS.
+const DefaultUpdateCheckURL = "https://api.github.com/repos/folbricht/routedns/releases/latest"
+
+// UpdateChecker regularly looks up the latest available version of RouteDNS
+// and compares it to the running version. It only reports when a newer
+// version is available, with a log message, a metric and a notification,
+// and never installs anything.
+type UpdateChecker struct {
+	id      string
+	opt     UpdateCheckerOptions
+	mu      sync.RWMutex
+	status  VersionStatus
+	metrics *UpdateCheckerMetrics
+}
+
+// UpdateCheckerOptions contain settings for the update checker.
+type UpdateCheckerOptions struct {
+	// URL to query for the latest version. The response can either be JSON
+	// with the version in the "tag_name" field, like the GitHub releases
+	// API, or plain text containing just the version. Defaults to
+	// DefaultUpdateCheckURL unless TXTName is set.
+	URL string
+
+	// Name of a TXT record holding the latest version, as alternative to
+	// URL.
+	TXTName string
+
+	// Time between checks. Defaults to 24 hours.
+	Interval time.Duration
+
+	// Defaults to the system clock.
+	Clock Clock
+}
+
+type UpdateCheckerMetrics struct {
+	// 1 if a newer version is available, 0 otherwise.
+	available *Gauge
+	// Number of failed checks.
+	err *Counter
+}
+
+// VersionStatus holds the running and the latest available version.
+type VersionStatus struct {
+	Version         string    `json:"version"`
+	BuildNumber     string    `json:"build-number"`
+	BuildTime       string    `json:"build-time"`
+	Latest          string    `json:"latest,omitempty"`
+	UpdateAvailable bool      `json:"update-available"`
+	LastCheck       time.Time `json:"last-check"`
+	LastError       string    `json:"last-error,omitempty"`
+}
+
+// NewUpdateChecker returns a new update checker and starts checking in the
+// background.
+func NewUpdateChecker(id string, opt UpdateCheckerOptions) *UpdateChecker {
+	if opt.URL == "" && opt.TXTName == "" {
+		opt.URL = DefaultUpdateCheckURL
+	}
+	if opt.Interval == 0 {
+		opt.Interval = 24 * time.Hour
+	}
+	opt.Clock = clockOrDefault(opt.Clock)
+	c := &UpdateChecker{
+		id:     id,
+		opt:    opt,
+		status: currentVersion(),
+		metrics: &UpdateCheckerMetrics{
+			available: getGauge("updatecheck", id, "available"),
+			err:       getCounter("updatecheck", id, "error"),
+		},
+	}
+	go c.checkLoop()
+	return c
+}
+
+// Status returns the running version and the result of the last check.
+func (c *UpdateChecker) Status() VersionStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+func (c *UpdateChecker) String() string {
+	return c.id
+}
+
+func (c *UpdateChecker) checkLoop() {
+	for {
+		c.check()
+		c.opt.Clock.Sleep(c.opt.Interval)
+	}
+}
+
+// Looks up the latest version and updates the status.
+func (c *UpdateChecker) check() {
+	log := Log.With("id", c.id)
+	latest, err := c.latestVersion()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.LastCheck = c.opt.Clock.Now()
+	if err != nil {
+		log.Warn("failed to check for updates", "error", err)
+		c.metrics.err.Add(1)
+		c.status.LastError = err.Error()
+		return
+	}
+	c.status.LastError = ""
+	previous := c.status.Latest
+	c.status.Latest = latest
+	c.status.UpdateAvailable = compareVersions(latest, c.status.Version) > 0
+	if !c.status.UpdateAvailable {
+		c.metrics.available.Set(0)
+		return
+	}
+	c.metrics.available.Set(1)
+	if latest == previous { // Only notify once per version
+		return
+	}
+	log.Info("newer version available", "version", c.status.Version, "latest", latest)
+	Notify(Event{
+		Type:    EventUpdateAvailable,
+		ID:      c.id,
+		Message: fmt.Sprintf("version %s is available, running %s", latest, c.status.Version),
+		Details: map[string]string{"version": c.status.Version, "latest": latest},
+	})
+}
+
+// Returns the latest version from the URL or TXT record.
+func (c *UpdateChecker) latestVersion() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if c.opt.TXTName != "" {
+		txt, err := net.DefaultResolver.LookupTXT(ctx, c.opt.TXTName)
+		if err != nil {
+			return "", err
+		}
+		if len(txt) == 0 {
+			return "", errors.New("no TXT record found")
+		}
+		return strings.TrimSpace(txt[0]), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.opt.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("user-agent", "routedns/"+BuildVersion)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if json.Unmarshal(b, &release) == nil {
+		if release.TagName == "" {
+			return "", errors.New("no tag_name in response")
+		}
+		return release.TagName, nil
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	if version == "" {
+		return "", errors.New("empty response")
+	}
+	return version, nil
+}
+
+// Returns the status with just the running version.
+func currentVersion() VersionStatus {
+	return VersionStatus{
+		Version:     BuildVersion,
+		BuildNumber: BuildNumber,
+		BuildTime:   BuildTime,
+	}
+}
+
+// Compares two versions like "v0.1.100" numerically by their dot-separated
+// components. Returns a positive number if a is newer than b, negative if
+// it's older and 0 if they're the same. Pre-release suffixes such as "-rc1"
+// are ignored.
+func compareVersions(a, b string) int {
+	parse := func(v string) []int {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+		v, _, _ = strings.Cut(v, "-")
+		var parts []int
+		for _, s := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(s)
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	pa, pb := parse(a), parse(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
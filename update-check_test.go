@@ -0,0 +1,62 @@
+package rdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateChecker(t *testing.T) {
+	latest := `{"tag_name": "v99.0.0", "name": "Release v99.0.0"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(latest))
+	}))
+	defer srv.Close()
+
+	clock := NewFakeClock(time.Now())
+	c := NewUpdateChecker("test-update-check", UpdateCheckerOptions{URL: srv.URL, Clock: clock})
+	clock.BlockUntil(1)
+	status := c.Status()
+	require.Equal(t, BuildVersion, status.Version)
+	require.Equal(t, "v99.0.0", status.Latest)
+	require.True(t, status.UpdateAvailable)
+	require.Empty(t, status.LastError)
+	require.Equal(t, int64(1), c.metrics.available.Value())
+
+	// Plain text response with the running version
+	latest = BuildVersion + "\n"
+	clock.Advance(24 * time.Hour)
+	clock.BlockUntil(1)
+	status = c.Status()
+	require.Equal(t, BuildVersion, status.Latest)
+	require.False(t, status.UpdateAvailable)
+	require.Equal(t, int64(0), c.metrics.available.Value())
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		result int
+	}{
+		{"v0.1.100", "v0.1.100", 0},
+		{"v0.1.101", "v0.1.100", 1},
+		{"v0.1.99", "v0.1.100", -1},
+		{"v0.2.0", "v0.1.100", 1},
+		{"0.2", "v0.2.0", 0},
+		{"v1.0.0-rc1", "v0.9.9", 1},
+	}
+	for _, test := range tests {
+		result := compareVersions(test.a, test.b)
+		switch {
+		case test.result > 0:
+			require.Positive(t, result, "%s vs %s", test.a, test.b)
+		case test.result < 0:
+			require.Negative(t, result, "%s vs %s", test.a, test.b)
+		default:
+			require.Zero(t, result, "%s vs %s", test.a, test.b)
+		}
+	}
+}
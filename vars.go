@@ -3,22 +3,51 @@ package rdns
 import (
 	"expvar"
 	"fmt"
+	"strings"
+	"sync"
 )
 
-// Get an *expvar.Int with the given path.
-func getVarInt(base string, id string, name string) *expvar.Int {
-	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
-	if v := expvar.Get(fullname); v != nil {
-		return v.(*expvar.Int)
-	}
-	return expvar.NewInt(fullname)
+// Serializes publishing metrics with expvar, which panics on duplicates.
+var publishMu sync.Mutex
+
+// Get a counter for an element from the default registry.
+func getCounter(base string, id string, name string) *Counter {
+	return register(base, id, name, MetricCounter, "", func() expvar.Var { return new(Counter) }).(*Counter)
+}
+
+// Get a gauge for an element from the default registry.
+func getGauge(base string, id string, name string) *Gauge {
+	return register(base, id, name, MetricGauge, "", func() expvar.Var { return new(Gauge) }).(*Gauge)
+}
+
+// Get a set of counters keyed by the value of a label for an element from
+// the default registry.
+func getCounterMap(base string, id string, name string, label string) *CounterMap {
+	return register(base, id, name, MetricCounter, label, func() expvar.Var { return new(CounterMap) }).(*CounterMap)
+}
+
+// Get a set of gauges keyed by the value of a label for an element from the
+// default registry.
+func getGaugeMap(base string, id string, name string, label string) *GaugeMap {
+	return register(base, id, name, MetricGauge, label, func() expvar.Var { return new(GaugeMap) }).(*GaugeMap)
+}
+
+// Get a histogram for an element from the default registry.
+func getHistogram(base string, id string, name string, buckets []float64) *Histogram {
+	return register(base, id, name, MetricHistogram, "", func() expvar.Var { return NewHistogram(buckets) }).(*Histogram)
 }
 
-// Get an *expvar.Map with the given path.
-func getVarMap(base string, id string, name string) *expvar.Map {
-	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
-	if v := expvar.Get(fullname); v != nil {
-		return v.(*expvar.Map)
+// Registers a metric named "routedns_<base>_<name>" with the element ID as
+// label, and publishes it with expvar as "routedns.<base>.<id>.<name>" unless
+// that name is already taken.
+func register(base, id, name string, kind MetricKind, mapLabel string, newValue func() expvar.Var) expvar.Var {
+	metricName := strings.ReplaceAll(fmt.Sprintf("routedns_%s_%s", base, name), "-", "_")
+	m := DefaultRegistry.get(metricName, kind, map[string]string{"id": id}, mapLabel, newValue)
+	expvarName := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if expvar.Get(expvarName) == nil {
+		expvar.Publish(expvarName, m.Value)
 	}
-	return expvar.NewMap(fullname)
+	return m.Value
 }
@@ -0,0 +1,302 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Timers used before the SOA of a zone is known, and lower limits for the
+// ones in the SOA so a primary can't make us query it in a tight loop.
+const (
+	zoneDefaultRefresh = time.Hour
+	zoneDefaultRetry   = time.Minute
+	zoneMinRefresh     = time.Minute
+	zoneMinRetry       = 10 * time.Second
+)
+
+// secondaryZone keeps a copy of a zone in sync with its primary server like
+// a secondary name server does, as per the timers in the SOA of the zone
+// (RFC1035 section 4.3.5). The serial is checked every refresh interval and
+// the zone is transferred with AXFR when the primary has a newer one. Failed
+// checks are repeated after the retry interval, and the zone expires if it
+// couldn't be checked for the expire interval. NOTIFY messages from the
+// primary (RFC1996) trigger a check right away.
+type secondaryZone struct {
+	id  string
+	opt secondaryZoneOptions
+
+	// Serializes checks of the serial and transfers
+	checkMu sync.Mutex
+
+	mu          sync.Mutex
+	soa         *dns.SOA  // SOA of the last loaded zone, nil if not loaded
+	expired     bool      // The loaded zone expired and must be transferred again
+	lastSuccess time.Time // Time of the last successful check
+	failing     bool      // The last check failed
+
+	notifyCh  chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type secondaryZoneOptions struct {
+	// Name of the zone and address of the primary server, host:port.
+	Zone    string
+	Primary string
+
+	// Fixed time between checks of the serial, overrides the refresh and
+	// retry intervals of the SOA if set.
+	Refresh time.Duration
+
+	// TSIG key to authenticate queries and transfers, disabled if the name
+	// is empty.
+	TSIGName      string
+	TSIGSecret    string
+	TSIGAlgorithm string
+
+	// Called with the records of the zone after a transfer. Returns the SOA
+	// of the zone, or an error if the zone is invalid and not loaded.
+	Load func(records []dns.RR) (*dns.SOA, error)
+
+	// Called when the zone expired and its records must not be used anymore.
+	Expire func()
+
+	// Counters of transfers and failed checks or transfers.
+	Transfers *Counter
+	Errors    *Counter
+
+	Clock Clock
+}
+
+func newSecondaryZone(id string, opt secondaryZoneOptions) *secondaryZone {
+	opt.Clock = clockOrDefault(opt.Clock)
+	return &secondaryZone{
+		id:       id,
+		opt:      opt,
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Loads the zone once and then keeps refreshing it in the background until
+// close is called.
+func (z *secondaryZone) start() {
+	z.refresh()
+	go z.refreshLoop()
+}
+
+func (z *secondaryZone) close() {
+	z.closeOnce.Do(func() { close(z.done) })
+}
+
+func (z *secondaryZone) refreshLoop() {
+	for {
+		wakeup := make(chan struct{})
+		go func(d time.Duration) {
+			z.opt.Clock.Sleep(d)
+			close(wakeup)
+		}(z.nextCheck())
+		select {
+		case <-wakeup:
+		case <-z.notifyCh:
+		case <-z.done:
+			return
+		}
+		z.refresh()
+	}
+}
+
+// Returns the time until the next check of the serial.
+func (z *secondaryZone) nextCheck() time.Duration {
+	if z.opt.Refresh > 0 {
+		return z.opt.Refresh
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	refresh, retry := zoneDefaultRefresh, zoneDefaultRetry
+	if z.soa != nil {
+		refresh = max(time.Duration(z.soa.Refresh)*time.Second, zoneMinRefresh)
+		retry = max(time.Duration(z.soa.Retry)*time.Second, zoneMinRetry)
+	}
+	if z.failing {
+		return retry
+	}
+	return refresh
+}
+
+// Checks the serial of the zone and transfers it if it changed. Expires the
+// zone if that failed for longer than the expire interval.
+func (z *secondaryZone) refresh() {
+	log := Log.With(slog.String("id", z.id), slog.String("zone", z.opt.Zone))
+	err := z.check(log)
+
+	z.mu.Lock()
+	z.failing = err != nil
+	var expired bool
+	if err == nil {
+		z.lastSuccess = z.opt.Clock.Now()
+	} else if z.soa != nil && !z.expired && z.opt.Clock.Now().Sub(z.lastSuccess) >= time.Duration(z.soa.Expire)*time.Second {
+		z.expired = true
+		expired = true
+	}
+	z.mu.Unlock()
+
+	if err != nil {
+		log.Error("failed to refresh zone", "error", err)
+		z.opt.Errors.Add(1)
+		notifyReloadFailed(z.id, err)
+	}
+	if expired {
+		log.Warn("zone expired, primary unreachable for longer than the soa expire interval")
+		z.opt.Expire()
+	}
+	statusReload(z.id, err)
+}
+
+func (z *secondaryZone) check(log *slog.Logger) error {
+	z.checkMu.Lock()
+	defer z.checkMu.Unlock()
+
+	serial, err := z.querySerial()
+	if err != nil {
+		return err
+	}
+	z.mu.Lock()
+	current, expired := z.soa, z.expired
+	z.mu.Unlock()
+	if current != nil && !expired && !serialNewer(serial, current.Serial) {
+		if serial != current.Serial {
+			log.Warn("serial on primary is older than the loaded one, not transferring", "serial", serial, "loaded", current.Serial)
+		}
+		log.Debug("zone unchanged", "serial", current.Serial)
+		return nil
+	}
+
+	log.Debug("transferring zone", "serial", serial)
+	z.opt.Transfers.Add(1)
+	records, err := z.transfer()
+	if err != nil {
+		return err
+	}
+	soa, err := z.opt.Load(records)
+	if err != nil {
+		return err
+	}
+	z.mu.Lock()
+	z.soa = soa
+	z.expired = false
+	z.mu.Unlock()
+	return nil
+}
+
+// Queries the primary for the serial of the zone.
+func (z *secondaryZone) querySerial() (uint32, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(z.opt.Zone, dns.TypeSOA)
+	c := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	if z.opt.TSIGName != "" {
+		q.SetTsig(z.opt.TSIGName, z.opt.TSIGAlgorithm, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{z.opt.TSIGName: z.opt.TSIGSecret}
+	}
+	a, _, err := c.Exchange(q, z.opt.Primary)
+	if err != nil {
+		return 0, err
+	}
+	if a.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("soa query failed with %s", dns.RcodeToString[a.Rcode])
+	}
+	for _, rr := range a.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no soa record in response")
+}
+
+// Transfers the zone with AXFR and returns all its records.
+func (z *secondaryZone) transfer() ([]dns.RR, error) {
+	q := new(dns.Msg)
+	q.SetAxfr(z.opt.Zone)
+	t := &dns.Transfer{
+		DialTimeout: 5 * time.Second,
+		ReadTimeout: 30 * time.Second,
+	}
+	if z.opt.TSIGName != "" {
+		q.SetTsig(z.opt.TSIGName, z.opt.TSIGAlgorithm, 300, time.Now().Unix())
+		t.TsigSecret = map[string]string{z.opt.TSIGName: z.opt.TSIGSecret}
+	}
+	env, err := t.In(q, z.opt.Primary)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		records = append(records, e.RR...)
+	}
+	return records, nil
+}
+
+// Returns true if the message is a NOTIFY for the zone.
+func (z *secondaryZone) isNotify(q *dns.Msg) bool {
+	return q.Opcode == dns.OpcodeNotify && len(q.Question) == 1 &&
+		strings.EqualFold(q.Question[0].Name, z.opt.Zone)
+}
+
+// Answers a NOTIFY for the zone and checks the serial right away if it's
+// from the primary. NOTIFY messages from other addresses are refused.
+func (z *secondaryZone) handleNotify(q *dns.Msg, ci ClientInfo) *dns.Msg {
+	log := logger(z.id, q, ci)
+	if !z.isPrimary(ci.SourceIP) {
+		log.Warn("refusing notify from address other than the primary", "primary", z.opt.Primary)
+		return refused(q)
+	}
+	log.Debug("received notify, checking serial")
+	select {
+	case z.notifyCh <- struct{}{}:
+	default: // A check is already pending
+	}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Authoritative = true
+	return a
+}
+
+// Returns true if the address is one of the primary's.
+func (z *secondaryZone) isPrimary(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(z.opt.Primary)
+	if primary := net.ParseIP(host); primary != nil {
+		return primary.Equal(ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if serial a is newer than b in serial number arithmetic
+// (RFC1982), so serials can wrap around.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}